@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+// apiServer is the embedded HTTP admin server.
+type apiServer struct {
+	d   *daemon
+	mux *http.ServeMux
+}
+
+func newAPIServer(d *daemon, events *eventHub) *apiServer {
+	s := &apiServer{
+		d:   d,
+		mux: http.NewServeMux(),
+	}
+	s.mux.Handle("GET /{$}", uiHandler())
+	s.mux.HandleFunc("GET /events", events.serveEvents)
+	s.mux.HandleFunc("GET /healthz", s.healthz)
+	s.mux.HandleFunc("GET /stats", s.stats)
+	s.mux.HandleFunc("GET /metrics", d.serveMetrics)
+	s.mux.HandleFunc("GET /leases", s.listLeases)
+	s.mux.HandleFunc("GET /leases/{mac}", s.getLease)
+	s.mux.HandleFunc("DELETE /leases/{mac}", s.deleteLease)
+	s.mux.HandleFunc("POST /leases/{mac}/hostname", s.setHostname)
+	s.mux.HandleFunc("POST /leases/{mac}/reserve", s.reserveLease)
+	s.mux.HandleFunc("POST /leases/{mac}/revoke", s.revokeLease)
+	s.mux.HandleFunc("POST /wake/{target}", s.wake)
+	s.mux.HandleFunc("GET /history", s.history)
+	return s
+}
+
+// serve serves the API on l, authorized by auth.
+func (s *apiServer) serve(ctx context.Context, l net.Listener, auth *apiAuth) error {
+	if auth.tlsEnabled {
+		l = tls.NewListener(l, auth.tlsConfig)
+	}
+	if !auth.enabled() {
+		slog.Warn("http api has no authentication configured", "addr", l.Addr())
+	}
+	slog.Info("http listen", "addr", l.Addr(), "tls", auth.tlsEnabled)
+	return s.serveListener(ctx, l, auth.wrap(s.mux))
+}
+
+// listenUnix creates the unix socket at path for dhcpeterctl. Access is
+// controlled by the socket's file permissions.
+func listenUnix(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// serveUnix serves the API on the control socket l.
+func (s *apiServer) serveUnix(ctx context.Context, l net.Listener) error {
+	slog.Info("control socket listen", "path", l.Addr())
+	return s.serveListener(ctx, l, s.mux)
+}
+
+func (s *apiServer) serveListener(ctx context.Context, l net.Listener, h http.Handler) error {
+	srv := &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	err := srv.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// stats returns lease statistics by interface name.
+func (s *apiServer) stats(w http.ResponseWriter, r *http.Request) {
+	stats := make(map[string]dhcp4d.Stats)
+	for iface, h := range s.d.allHandlers() {
+		stats[iface] = h.Stats()
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// interfaceLease is a lease along with the network it belongs to.
+type interfaceLease struct {
+	Interface string       `json:"interface"`
+	Lease     dhcp4d.Lease `json:"lease"`
+}
+
+// listLeases returns leases by interface name. The optional interface query
+// parameter limits the result to one network.
+func (s *apiServer) listLeases(w http.ResponseWriter, r *http.Request) {
+	handlers := s.d.allHandlers()
+	if iface := r.URL.Query().Get("interface"); iface != "" {
+		h, ok := handlers[iface]
+		if !ok {
+			httpError(w, http.StatusNotFound, "unknown interface")
+			return
+		}
+		handlers = map[string]*dhcp4d.Handler{iface: h}
+	}
+
+	leases := make(map[string][]dhcp4d.Lease, len(handlers))
+	for iface, h := range handlers {
+		leases[iface] = h.ListLeases()
+	}
+	writeJSON(w, http.StatusOK, leases)
+}
+
+func (s *apiServer) getLease(w http.ResponseWriter, r *http.Request) {
+	hw, ok := s.pathMAC(w, r)
+	if !ok {
+		return
+	}
+	iface, l, ok := s.findLease(hw)
+	if !ok {
+		httpError(w, http.StatusNotFound, "no lease for "+hw)
+		return
+	}
+	writeJSON(w, http.StatusOK, interfaceLease{Interface: iface, Lease: l})
+}
+
+func (s *apiServer) deleteLease(w http.ResponseWriter, r *http.Request) {
+	hw, ok := s.pathMAC(w, r)
+	if !ok {
+		return
+	}
+	iface, _, ok := s.findLease(hw)
+	if !ok {
+		httpError(w, http.StatusNotFound, "no lease for "+hw)
+		return
+	}
+	h, ok := s.d.handler(iface)
+	if !ok {
+		httpError(w, http.StatusNotFound, "no lease for "+hw)
+		return
+	}
+	h.DeleteLease(hw)
+	slog.Info("deleted lease", "iface", iface, "hw", hw)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *apiServer) setHostname(w http.ResponseWriter, r *http.Request) {
+	hw, ok := s.pathMAC(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Hostname string `json:"hostname"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	iface, _, ok := s.findLease(hw)
+	if !ok {
+		httpError(w, http.StatusNotFound, "no lease for "+hw)
+		return
+	}
+	h, ok := s.d.handler(iface)
+	if !ok {
+		httpError(w, http.StatusNotFound, "no lease for "+hw)
+		return
+	}
+	if err := h.SetHostname(hw, req.Hostname); err != nil {
+		httpError(w, http.StatusConflict, err.Error())
+		return
+	}
+	l, _ := h.Lease(hw)
+	writeJSON(w, http.StatusOK, interfaceLease{Interface: iface, Lease: l})
+}
+
+// revokeLease force-expires a lease identified by hardware or IP address.
+// With ?nak=true the client's next request is NAKed.
+func (s *apiServer) revokeLease(w http.ResponseWriter, r *http.Request) {
+	var (
+		iface string
+		l     dhcp4d.Lease
+		ok    bool
+	)
+	id := r.PathValue("mac")
+	if ip := net.ParseIP(id); ip != nil {
+		iface, l, ok = s.findLeaseByIP(ip)
+	} else if hw, err := net.ParseMAC(id); err == nil {
+		iface, l, ok = s.findLease(hw.String())
+	} else {
+		httpError(w, http.StatusBadRequest, "invalid mac or ip address")
+		return
+	}
+	if !ok {
+		httpError(w, http.StatusNotFound, "no lease for "+id)
+		return
+	}
+	nak, _ := strconv.ParseBool(r.URL.Query().Get("nak"))
+
+	h, ok := s.d.handler(iface)
+	if !ok {
+		httpError(w, http.StatusNotFound, "no lease for "+id)
+		return
+	}
+	h.RevokeLease(l.HardwareAddr, nak)
+	slog.Info("revoked lease", "iface", iface, "hw", l.HardwareAddr, "ip", l.Addr, "nak", nak)
+	l, _ = h.Lease(l.HardwareAddr)
+	writeJSON(w, http.StatusOK, interfaceLease{Interface: iface, Lease: l})
+}
+
+// wake sends a Wake-on-LAN packet to target, a hardware address or the
+// hostname of a lease or static lease. Hardware addresses without a lease
+// need the interface query parameter.
+func (s *apiServer) wake(w http.ResponseWriter, r *http.Request) {
+	target := r.PathValue("target")
+	iface := r.URL.Query().Get("interface")
+
+	hw, err := net.ParseMAC(target)
+	if err != nil {
+		var ok bool
+		iface, hw, ok = s.findHostname(target, iface)
+		if !ok {
+			httpError(w, http.StatusNotFound, "unknown host "+target)
+			return
+		}
+	} else if iface == "" {
+		var ok bool
+		iface, _, ok = s.findLease(hw.String())
+		if !ok {
+			httpError(w, http.StatusBadRequest, "no lease for "+hw.String()+", interface is required")
+			return
+		}
+	}
+
+	h, ok := s.d.handler(iface)
+	if !ok {
+		httpError(w, http.StatusNotFound, "unknown interface")
+		return
+	}
+	if err := h.Wake(hw); err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	slog.Info("sent wake-on-lan", "iface", iface, "hw", hw)
+	writeJSON(w, http.StatusOK, map[string]string{"interface": iface, "hardware_addr": hw.String()})
+}
+
+// history returns the lease history, filtered by the optional mac, ip,
+// since and until (RFC 3339) query parameters.
+func (s *apiServer) history(w http.ResponseWriter, r *http.Request) {
+	if s.d.history == nil {
+		httpError(w, http.StatusNotImplemented, "lease_history is not configured")
+		return
+	}
+	q := r.URL.Query()
+	var hw string
+	if v := q.Get("mac"); v != "" {
+		mac, err := net.ParseMAC(v)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "invalid mac address")
+			return
+		}
+		hw = mac.String()
+	}
+	var ip net.IP
+	if v := q.Get("ip"); v != "" {
+		if ip = net.ParseIP(v); ip == nil {
+			httpError(w, http.StatusBadRequest, "invalid ip address")
+			return
+		}
+	}
+	var since, until time.Time
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &since}, {"until", &until}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "invalid "+p.name+" time")
+			return
+		}
+		*p.t = t
+	}
+	records := s.d.history.query(hw, ip, since, until)
+	if records == nil {
+		records = []historyRecord{}
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+// findHostname finds a lease or static lease named name, optionally only
+// on iface.
+func (s *apiServer) findHostname(name, iface string) (string, net.HardwareAddr, bool) {
+	for i, h := range s.d.allHandlers() {
+		if iface != "" && i != iface {
+			continue
+		}
+		for _, l := range h.ListLeases() {
+			if strings.EqualFold(l.Hostname, name) {
+				if hw, err := net.ParseMAC(l.HardwareAddr); err == nil {
+					return i, hw, true
+				}
+			}
+		}
+		for _, sl := range h.StaticLeases() {
+			if strings.EqualFold(sl.Hostname, name) {
+				if hw, err := net.ParseMAC(sl.HardwareAddr); err == nil {
+					return i, hw, true
+				}
+			}
+		}
+	}
+	return "", nil, false
+}
+
+// reserveLease promotes a dynamic lease to a static lease and saves it to
+// the reservations file. With ?permanent=true the lease never expires.
+func (s *apiServer) reserveLease(w http.ResponseWriter, r *http.Request) {
+	hw, ok := s.pathMAC(w, r)
+	if !ok {
+		return
+	}
+	if s.d.reservations == nil {
+		httpError(w, http.StatusNotImplemented, "reservations_file is not configured")
+		return
+	}
+	iface, _, ok := s.findLease(hw)
+	if !ok {
+		httpError(w, http.StatusNotFound, "no lease for "+hw)
+		return
+	}
+	permanent, _ := strconv.ParseBool(r.URL.Query().Get("permanent"))
+	h, ok := s.d.handler(iface)
+	if !ok {
+		httpError(w, http.StatusNotFound, "no lease for "+hw)
+		return
+	}
+	sl, err := h.PromoteLease(hw, permanent)
+	if err != nil {
+		httpError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err := s.d.reservations.add(iface, sl); err != nil {
+		slog.Error("write reservations file err", "err", err)
+		httpError(w, http.StatusInternalServerError, "reservation is active but could not be saved: "+err.Error())
+		return
+	}
+	slog.Info("reserved lease", "iface", iface, "hw", hw, "ip", sl.Addr, "name", sl.Hostname, "permanent", sl.Permanent)
+	writeJSON(w, http.StatusOK, reservation{
+		Interface:    iface,
+		HardwareAddr: sl.HardwareAddr,
+		Hostname:     sl.Hostname,
+		IP:           sl.Addr.String(),
+		Permanent:    sl.Permanent,
+	})
+}
+
+type reservation struct {
+	Interface    string `json:"interface"`
+	HardwareAddr string `json:"hardware_addr"`
+	Hostname     string `json:"hostname"`
+	IP           string `json:"ip"`
+	Permanent    bool   `json:"permanent,omitempty"`
+}
+
+// findLease looks up the lease for hw on every network.
+func (s *apiServer) findLease(hw string) (string, dhcp4d.Lease, bool) {
+	for iface, h := range s.d.allHandlers() {
+		if l, ok := h.Lease(hw); ok {
+			return iface, l, true
+		}
+	}
+	return "", dhcp4d.Lease{}, false
+}
+
+// findLeaseByIP looks up the lease for ip on every network.
+func (s *apiServer) findLeaseByIP(ip net.IP) (string, dhcp4d.Lease, bool) {
+	for iface, h := range s.d.allHandlers() {
+		if l, ok := h.LeaseByIP(ip); ok {
+			return iface, l, true
+		}
+	}
+	return "", dhcp4d.Lease{}, false
+}
+
+// pathMAC returns the normalized {mac} path value.
+func (s *apiServer) pathMAC(w http.ResponseWriter, r *http.Request) (string, bool) {
+	hw, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid mac address")
+		return "", false
+	}
+	return hw.String(), true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		slog.Error("write json response err", "err", err)
+	}
+}
+
+func httpError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
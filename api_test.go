@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+func TestControlSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dhcpeterd.sock")
+	// A socket left behind by a previous run is replaced.
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	l, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0660 {
+		t.Errorf("control socket mode %v, want a socket with 0660", fi.Mode())
+	}
+
+	iface := &net.Interface{Index: 1, HardwareAddr: net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}}
+	h, err := dhcp4d.NewHandler(iface, net.IP{192, 168, 42, 1}, net.IP{192, 168, 42, 2}, net.IP{255, 255, 255, 0}, 10, time.Hour, nil, nil, dhcp4d.WithUDP())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.PutLease(dhcp4d.Lease{Addr: net.IP{192, 168, 42, 3}, HardwareAddr: "aa:bb:cc:dd:ee:ff", Expiry: time.Now().Add(time.Hour)})
+	d := &daemon{handlers: map[string]*dhcp4d.Handler{"eth0": h}}
+	api := newAPIServer(d, newEventHub())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- api.serveUnix(ctx, l) }()
+
+	hc := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+	do := func(method, path string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, "http://dhcpeterd"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := hc.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// The control socket needs no token.
+	resp := do("GET", "/leases")
+	var leases map[string][]dhcp4d.Lease
+	err = json.NewDecoder(resp.Body).Decode(&leases)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := leases["eth0"]; len(l) != 1 || l[0].HardwareAddr != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("leases = %+v, want the lease of eth0", leases)
+	}
+
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{"DELETE", "/leases/aa:bb:cc:dd:ee:ff", http.StatusNoContent},
+		{"GET", "/leases/aa:bb:cc:dd:ee:ff", http.StatusNotFound},
+		{"DELETE", "/leases/aa:bb:cc:dd:ee:ff", http.StatusNotFound},
+		{"GET", "/leases/nonsense", http.StatusBadRequest},
+	} {
+		resp := do(tt.method, tt.path)
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, resp.StatusCode, tt.want)
+		}
+	}
+
+	cancel()
+	if err := <-served; err != nil {
+		t.Errorf("serveUnix: %v", err)
+	}
+}
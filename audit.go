@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+// auditRecord is one line of the audit log.
+type auditRecord struct {
+	Time         time.Time  `json:"time"`
+	Event        string     `json:"event"` // grant, renew, nak, release or expire
+	Interface    string     `json:"interface"`
+	IP           net.IP     `json:"ip,omitempty"`
+	HardwareAddr string     `json:"hw"`
+	Hostname     string     `json:"hostname,omitempty"`
+	ClientID     string     `json:"client_id,omitempty"`
+	Expiry       *time.Time `json:"expiry,omitempty"`
+}
+
+// backupTimeFormat is the suffix of rotated audit logs and lease file
+// backups.
+const backupTimeFormat = "20060102T150405.000Z"
+
+var auditEvents = map[dhcp4d.EventType]string{
+	dhcp4d.EventAdd:     "grant",
+	dhcp4d.EventOld:     "renew",
+	dhcp4d.EventNAK:     "nak",
+	dhcp4d.EventRelease: "release",
+	dhcp4d.EventExpire:  "expire",
+}
+
+// auditLog appends lease events to a rotating JSON lines file.
+type auditLog struct {
+	conf  config.AuditLog
+	queue chan auditRecord
+
+	f       *os.File
+	size    int64
+	created time.Time
+}
+
+func newAuditLog(conf *config.AuditLog) (*auditLog, error) {
+	if conf.Path == "" {
+		return nil, fmt.Errorf("audit_log requires path")
+	}
+	a := &auditLog{
+		conf:  *conf,
+		queue: make(chan auditRecord, 256),
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) send(iface string, ev dhcp4d.Event) {
+	name, ok := auditEvents[ev.Type]
+	if !ok {
+		return
+	}
+	l := ev.Lease
+	rec := auditRecord{
+		Time:         time.Now(),
+		Event:        name,
+		Interface:    iface,
+		IP:           l.Addr,
+		HardwareAddr: l.HardwareAddr,
+		Hostname:     l.Hostname,
+		ClientID:     l.ClientID,
+	}
+	if !l.Expiry.IsZero() {
+		rec.Expiry = &l.Expiry
+	}
+	select {
+	case a.queue <- rec:
+	default:
+		slog.Error("audit log queue full, dropping event", "event", name, "hw", l.HardwareAddr)
+	}
+}
+
+func (a *auditLog) loop(ctx context.Context) {
+	defer a.f.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case rec := <-a.queue:
+			if err := a.write(rec); err != nil {
+				slog.Error("write audit log err", "err", err)
+			}
+		}
+	}
+}
+
+func (a *auditLog) write(rec auditRecord) error {
+	if a.needsRotate(rec.Time) {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	n, err := a.f.Write(b)
+	a.size += int64(n)
+	return err
+}
+
+func (a *auditLog) needsRotate(now time.Time) bool {
+	if a.size == 0 {
+		return false
+	}
+	if a.conf.MaxSize > 0 && a.size >= a.conf.MaxSize {
+		return true
+	}
+	return a.conf.MaxAge > 0 && now.Sub(a.created) >= a.conf.MaxAge
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.conf.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("open audit log err: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f = f
+	a.size = fi.Size()
+	a.created = time.Now()
+	if a.size > 0 {
+		// Rotation age is measured from the oldest write we know of.
+		a.created = fi.ModTime()
+	}
+	return nil
+}
+
+// rotate renames the current file with a timestamp suffix, opens a new one
+// and removes backups beyond MaxBackups.
+func (a *auditLog) rotate() error {
+	a.f.Close()
+	rotated := a.conf.Path + "." + time.Now().UTC().Format(backupTimeFormat)
+	if err := os.Rename(a.conf.Path, rotated); err != nil {
+		slog.Error("rotate audit log err", "err", err)
+	}
+	if err := a.open(); err != nil {
+		return err
+	}
+	if a.conf.MaxBackups <= 0 {
+		return nil
+	}
+
+	backups, err := filepath.Glob(a.conf.Path + ".*")
+	if err != nil {
+		return err
+	}
+	backups = filterBackups(a.conf.Path, backups)
+	sort.Strings(backups)
+	for len(backups) > a.conf.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			slog.Error("remove audit log backup err", "err", err)
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// filterBackups returns the names that look like rotated copies of path.
+func filterBackups(path string, names []string) []string {
+	var out []string
+	for _, n := range names {
+		suffix := strings.TrimPrefix(n, path+".")
+		if _, err := time.Parse(backupTimeFormat, suffix); err == nil {
+			out = append(out, n)
+		}
+	}
+	return out
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/psanford/dhcpeterd/config"
+)
+
+type scope int
+
+const (
+	scopeNone scope = iota
+	scopeRead
+	scopeWrite
+)
+
+func parseScope(s string) (scope, error) {
+	switch s {
+	case "read":
+		return scopeRead, nil
+	case "", "write":
+		return scopeWrite, nil
+	default:
+		return scopeNone, fmt.Errorf("invalid scope: %s", s)
+	}
+}
+
+// apiAuth authorizes HTTP API requests using bearer tokens and/or verified
+// client certificates. GET requests need read scope; everything else needs
+// write scope. If neither tokens nor client certificates are configured
+// all requests are allowed.
+type apiAuth struct {
+	tokens     map[string]scope
+	clientCA   bool
+	certScope  scope
+	tlsConfig  *tls.Config
+	tlsEnabled bool
+}
+
+func newAPIAuth(conf *config.Config) (*apiAuth, error) {
+	a := &apiAuth{
+		tokens: make(map[string]scope),
+	}
+	for i, t := range conf.APITokens {
+		token := t.Token
+		if t.TokenFile != "" {
+			b, err := os.ReadFile(t.TokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("api_tokens[%d]: %w", i, err)
+			}
+			token = strings.TrimSpace(string(b))
+		}
+		if token == "" {
+			return nil, fmt.Errorf("api_tokens[%d]: empty token", i)
+		}
+		sc, err := parseScope(t.Scope)
+		if err != nil {
+			return nil, fmt.Errorf("api_tokens[%d]: %w", i, err)
+		}
+		a.tokens[token] = sc
+	}
+
+	t := conf.HTTPTLS
+	if t == nil {
+		return a, nil
+	}
+	cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+	if err != nil {
+		return nil, fmt.Errorf("http_tls: %w", err)
+	}
+	a.tlsEnabled = true
+	a.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if t.ClientCA != "" {
+		pem, err := os.ReadFile(t.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("http_tls: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("http_tls: no certificates in client_ca %s", t.ClientCA)
+		}
+		a.clientCA = true
+		a.certScope, err = parseScope(t.ClientScope)
+		if err != nil {
+			return nil, fmt.Errorf("http_tls: %w", err)
+		}
+		a.tlsConfig.ClientCAs = pool
+		a.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		if len(a.tokens) > 0 {
+			// Token holders may connect without a certificate.
+			a.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return a, nil
+}
+
+func (a *apiAuth) enabled() bool {
+	return len(a.tokens) > 0 || a.clientCA
+}
+
+// scope returns the scope granted to r.
+func (a *apiAuth) scope(r *http.Request) scope {
+	granted := scopeNone
+	if a.clientCA && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		granted = a.certScope
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok && r.Method == "GET" && r.URL.Path == "/events" {
+		// EventSource can't set headers.
+		token = r.URL.Query().Get("access_token")
+	}
+	return max(granted, a.tokenScope(token))
+}
+
+// tokenScope returns the scope granted to the bearer token.
+func (a *apiAuth) tokenScope(token string) scope {
+	granted := scopeNone
+	if token == "" {
+		return granted
+	}
+	for t, sc := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 && sc > granted {
+			granted = sc
+		}
+	}
+	return granted
+}
+
+type scopeKey struct{}
+
+// requestScope returns the scope wrap granted to r. Requests that were not
+// authorized, such as those of the control socket, have every scope.
+func requestScope(r *http.Request) scope {
+	if sc, ok := r.Context().Value(scopeKey{}).(scope); ok {
+		return sc
+	}
+	return scopeWrite
+}
+
+func (a *apiAuth) wrap(next http.Handler) http.Handler {
+	if !a.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		need := scopeWrite
+		if r.Method == "GET" || r.Method == "HEAD" {
+			need = scopeRead
+		}
+		// The dashboard page itself holds no data; its API calls are
+		// authorized individually. Health checks are open to supervisors,
+		// which only get the status without read scope.
+		if r.URL.Path == "/" || r.URL.Path == "/healthz" {
+			need = scopeNone
+		}
+		switch got := a.scope(r); {
+		case got >= need:
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), scopeKey{}, got)))
+		case got == scopeNone:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dhcpeterd"`)
+			httpError(w, http.StatusUnauthorized, "unauthorized")
+		default:
+			httpError(w, http.StatusForbidden, "insufficient scope")
+		}
+	})
+}
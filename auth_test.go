@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestAuthScope(t *testing.T) {
+	a := &apiAuth{tokens: map[string]scope{"reader": scopeRead, "writer": scopeWrite}}
+	h := a.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strconv.Itoa(int(requestScope(r)))))
+	}))
+
+	for _, tt := range []struct {
+		method, path, token string
+		query               bool
+		status              int
+		scope               scope
+	}{
+		{method: "GET", path: "/healthz", status: http.StatusOK, scope: scopeNone},
+		{method: "GET", path: "/healthz", token: "reader", status: http.StatusOK, scope: scopeRead},
+		{method: "GET", path: "/healthz", token: "wrong", status: http.StatusOK, scope: scopeNone},
+		{method: "GET", path: "/leases", status: http.StatusUnauthorized},
+		{method: "GET", path: "/leases", token: "reader", status: http.StatusOK, scope: scopeRead},
+		{method: "DELETE", path: "/leases/aa:bb:cc:dd:ee:ff", token: "reader", status: http.StatusForbidden},
+		{method: "DELETE", path: "/leases/aa:bb:cc:dd:ee:ff", token: "writer", status: http.StatusOK, scope: scopeWrite},
+		{method: "GET", path: "/events", token: "reader", query: true, status: http.StatusOK, scope: scopeRead},
+		{method: "GET", path: "/leases", token: "reader", query: true, status: http.StatusUnauthorized},
+		{method: "DELETE", path: "/leases/aa:bb:cc:dd:ee:ff", token: "writer", query: true, status: http.StatusUnauthorized},
+	} {
+		path := tt.path
+		if tt.query {
+			path += "?access_token=" + tt.token
+		}
+		r := httptest.NewRequest(tt.method, path, nil)
+		if tt.token != "" && !tt.query {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s %s with %q: status %d, want %d", tt.method, tt.path, tt.token, w.Code, tt.status)
+			continue
+		}
+		if tt.status == http.StatusOK && w.Body.String() != strconv.Itoa(int(tt.scope)) {
+			t.Errorf("%s %s with %q: scope %s, want %d", tt.method, tt.path, tt.token, w.Body, tt.scope)
+		}
+	}
+}
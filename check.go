@@ -0,0 +1,400 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path"
+	"slices"
+
+	"github.com/psanford/dhcpeterd/config"
+)
+
+// runCheck implements "dhcpeterd check": it validates the config and
+// returns the process exit code.
+func runCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	path := fs.String("config", "dhcpeterd.toml", "Config path")
+	fs.Parse(args)
+
+	conf, err := config.Load(*path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *path, err)
+		return 1
+	}
+	errs := checkConfig(conf)
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *path, err)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	fmt.Printf("%s: ok\n", *path)
+	return 0
+}
+
+// checkConfig returns every problem found in conf, including networks whose
+// interface does not exist on this host.
+func checkConfig(conf *config.Config) []error {
+	var errs []error
+	if _, err := newTagRules(conf.Tags); err != nil {
+		errs = append(errs, err)
+	}
+	if conf.Webhook != nil {
+		if _, err := newWebhook(conf.Webhook); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if conf.DDNS != nil {
+		if _, err := newDDNSUpdater(conf.DDNS); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if conf.HostnameFallback != nil {
+		if _, err := newHostnameFallback(conf.HostnameFallback); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if conf.ReverseZones != nil {
+		if _, err := newReverseZones(conf.ReverseZones); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	var delegated []string
+	if conf.PrefixDelegation != nil {
+		if _, err := newPrefixDelegation(conf.PrefixDelegation); err != nil {
+			errs = append(errs, err)
+		}
+		delegated = conf.PrefixDelegation.Networks
+	}
+	if _, err := newFirewallSets(conf.FirewallSets); err != nil {
+		errs = append(errs, err)
+	}
+	if conf.MQTT != nil && conf.MQTT.Broker == "" {
+		errs = append(errs, fmt.Errorf("mqtt requires broker"))
+	}
+	if conf.Redis != nil && conf.Redis.URL == "" {
+		errs = append(errs, fmt.Errorf("redis requires url"))
+	}
+	if conf.Etcd != nil && len(conf.Etcd.Endpoints) == 0 {
+		errs = append(errs, fmt.Errorf("etcd requires endpoints"))
+	}
+	if conf.Redis != nil && conf.Etcd != nil {
+		errs = append(errs, fmt.Errorf("redis and etcd cannot both be configured"))
+	}
+	if conf.LeaseHistory != nil && conf.LeaseHistory.Path == "" {
+		errs = append(errs, fmt.Errorf("lease_history requires path"))
+	}
+	if conf.HA != nil {
+		if err := checkHA(conf.HA); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if _, err := parseLeaseQueryAllow(conf.LeaseQueryAllow); err != nil {
+		errs = append(errs, err)
+	}
+	if conf.Keepalived != nil && conf.Keepalived.FIFO == "" {
+		errs = append(errs, fmt.Errorf("keepalived requires fifo"))
+	}
+	for _, h := range conf.Hostapd {
+		if h.Socket == "" {
+			errs = append(errs, fmt.Errorf("hostapd requires socket"))
+		}
+	}
+	if conf.Failover != nil && conf.Failover.Peer == "" {
+		errs = append(errs, fmt.Errorf("failover requires peer"))
+	}
+	if conf.Tracing != nil {
+		if _, err := newOTLPExporter(conf.Tracing); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if conf.HTTPListen != "" || conf.GRPCListen != "" || conf.Tailscale != nil {
+		if _, err := newAPIAuth(conf); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if conf.Tailscale != nil && conf.Tailscale.StateDir == "" {
+		errs = append(errs, fmt.Errorf("tailscale requires state_dir"))
+	}
+	if conf.SandboxChroot != "" {
+		if fi, err := os.Stat(conf.SandboxChroot); err != nil {
+			errs = append(errs, fmt.Errorf("sandbox_chroot: %w", err))
+		} else if !fi.IsDir() {
+			errs = append(errs, fmt.Errorf("sandbox_chroot %s is not a directory", conf.SandboxChroot))
+		}
+	}
+	if len(conf.Networks) == 0 {
+		errs = append(errs, fmt.Errorf("no networks configured"))
+	}
+
+	seen := make(map[string]bool)
+	for i, n := range conf.Networks {
+		if n.Interface == "" {
+			errs = append(errs, fmt.Errorf("networks[%d]: missing interface", i))
+			continue
+		}
+		if seen[n.Interface] {
+			errs = append(errs, fmt.Errorf("duplicate network for interface %s", n.Interface))
+		}
+		seen[n.Interface] = true
+		if slices.Contains(delegated, n.Interface) {
+			// Check the network as numbered from an example prefix.
+			_, example, _ := net.ParseCIDR("2001:db8::/64")
+			n = delegatedNetwork(n, example, 0, 0)
+		}
+		errs = append(errs, checkNetwork(n)...)
+		if n.Failover && conf.Failover == nil {
+			errs = append(errs, fmt.Errorf("network %s: failover requires the failover section", n.Interface))
+		}
+	}
+	return errs
+}
+
+// checkHA returns an error if the HA settings are incomplete.
+func checkHA(ha *config.HA) error {
+	switch {
+	case ha.Secret == "":
+		return fmt.Errorf("ha requires secret")
+	case ha.Role == "primary" && ha.Listen == "":
+		return fmt.Errorf("ha primary requires listen")
+	case ha.Role == "standby" && ha.Peer == "":
+		return fmt.Errorf("ha standby requires peer")
+	case ha.Role != "primary" && ha.Role != "standby":
+		return fmt.Errorf("ha role must be primary or standby")
+	}
+	return nil
+}
+
+// checkNetwork returns the problems found in the network n.
+func checkNetwork(n config.Network) []error {
+	var errs []error
+	errorf := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf("network %s: "+format, append([]any{n.Interface}, args...)...))
+	}
+
+	startIP := net.ParseIP(n.StartIP).To4()
+	if startIP == nil {
+		errorf("invalid start_ip: %q", n.StartIP)
+	}
+	mask := parseNetMask(n.NetMask)
+	if mask == nil {
+		errorf("invalid net_mask: %q", n.NetMask)
+	}
+	if n.Range <= 0 && (n.Dynamic == nil || *n.Dynamic) {
+		errorf("range must be positive")
+	}
+	if n.LeaseDuration <= 0 {
+		errorf("lease_duration must be positive")
+	}
+	if n.VirtualIP != "" && net.ParseIP(n.VirtualIP).To4() == nil {
+		errorf("invalid virtual_ip: %q", n.VirtualIP)
+	}
+	if n.ServerID != "" {
+		if net.ParseIP(n.ServerID).To4() == nil {
+			errorf("invalid server_id: %q", n.ServerID)
+		}
+		if n.VirtualIP != "" {
+			errorf("server_id and virtual_ip cannot both be set")
+		}
+	}
+	if _, err := parseIPv4s(n.DNSServers); err != nil {
+		errorf("dns_servers: %s", err)
+	}
+
+	var subnet *net.IPNet
+	if startIP != nil && mask != nil {
+		subnet = &net.IPNet{IP: startIP.Mask(mask), Mask: mask}
+		if err := checkPool(subnet, startIP, n.Range); err != nil {
+			errorf("pool: %s", err)
+		}
+	}
+
+	if isInterfacePattern(n.Interface) {
+		// Matching interfaces may not exist yet.
+		if _, err := path.Match(n.Interface, ""); err != nil {
+			errorf("invalid interface pattern: %s", err)
+		}
+		if n.Netns != "" {
+			errorf("netns cannot be used with an interface pattern")
+		}
+	} else if addrs, err := interfaceAddrs(n); err != nil {
+		errorf("%s", err)
+	} else if startIP != nil {
+		found := false
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.Contains(startIP) {
+				found = true
+			}
+		}
+		if !found {
+			errorf("no address on the interface contains start_ip %s", startIP)
+		}
+	}
+
+	macs := make(map[string]string)
+	ips := make(map[string]string)
+	for _, sl := range n.StaticLeases {
+		hw, err := net.ParseMAC(sl.MacAddress)
+		if err != nil {
+			errorf("static lease %s: invalid mac: %q", sl.Name, sl.MacAddress)
+		} else if other, dup := macs[hw.String()]; dup {
+			errorf("static leases %s and %s have the same mac %s", other, sl.Name, hw)
+		} else {
+			macs[hw.String()] = sl.Name
+		}
+
+		ip := net.ParseIP(sl.IP).To4()
+		if ip == nil {
+			errorf("static lease %s: invalid ip: %q", sl.Name, sl.IP)
+			continue
+		}
+		if other, dup := ips[ip.String()]; dup {
+			errorf("static leases %s and %s have the same ip %s", other, sl.Name, ip)
+		} else {
+			ips[ip.String()] = sl.Name
+		}
+		if subnet != nil && !usableHost(subnet, ip) {
+			errorf("static lease %s: ip %s is not a host address in %s", sl.Name, ip, subnet)
+		}
+		if _, err := parseIPv4s(sl.DNSServers); err != nil {
+			errorf("static lease %s: dns_servers: %s", sl.Name, err)
+		}
+	}
+
+	classes := n.Classes
+	if n.Quarantine != nil {
+		classes = append(classes[:len(classes):len(classes)], *n.Quarantine)
+	}
+	for _, c := range classes {
+		if _, err := newClass(c, n.Interface); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if c.Range > 0 && subnet != nil {
+			if err := checkPool(subnet, net.ParseIP(c.StartIP).To4(), c.Range); err != nil {
+				errorf("class %s: %s", c.Name, err)
+			}
+		}
+	}
+
+	if _, err := newOptionSets(n); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := newMACFilter(n); err != nil {
+		errs = append(errs, err)
+	}
+	if n.DeviceLeaseDurations != nil {
+		if _, err := newDeviceLeasePeriods(n); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if n.SplitScope != nil {
+		if _, err := newLoadBalancing(n); err != nil {
+			errs = append(errs, err)
+		}
+		if n.Failover {
+			errorf("split_scope and failover cannot both be set")
+		}
+	}
+	if _, err := parseFQDNPolicy(n.ClientFQDN); err != nil {
+		errorf("%s", err)
+	}
+	if _, err := parseDuplicatePolicy(n.DuplicateHostnames); err != nil {
+		errorf("%s", err)
+	}
+	if _, err := parseAllocation(n.Allocation); err != nil {
+		errorf("%s", err)
+	}
+	if n.MinSecs < 0 || n.MinSecs > 65535 {
+		errorf("min_secs must be between 0 and 65535")
+	}
+	vlans := make(map[int]bool)
+	for _, v := range n.VLANs {
+		if err := checkVLAN(n, v); err != nil {
+			errorf("%s", err)
+		} else if vlans[v.ID] {
+			errorf("duplicate vlan %d", v.ID)
+		}
+		vlans[v.ID] = true
+	}
+	if n.DHCPv6 != nil {
+		if _, err := newDHCP6Handler(n.DHCPv6, nil); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if n.RouterAdvertisement != nil {
+		if _, err := newRASender(n, nil); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if n.RateLimit != nil && n.RateLimit.Rate <= 0 {
+		errorf("rate_limit requires a positive rate")
+	}
+	if n.FlapDetection != nil && n.FlapDetection.Threshold <= 0 {
+		errorf("flap_detection requires a positive threshold")
+	}
+	if n.ExpiredLeaseRetention < 0 {
+		errorf("expired_lease_retention must not be negative")
+	}
+	if n.PoolWarningThreshold < 0 || n.PoolWarningThreshold > 100 {
+		errorf("pool_warning_threshold must be between 0 and 100")
+	}
+	return errs
+}
+
+// parseNetMask parses a dotted IPv4 netmask, returning nil if s is not one.
+func parseNetMask(s string) net.IPMask {
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return nil
+	}
+	mask := net.IPMask(ip)
+	if ones, bits := mask.Size(); ones == 0 && bits == 0 {
+		return nil
+	}
+	return mask
+}
+
+// checkPool returns an error unless the size addresses from start are all
+// host addresses of subnet.
+func checkPool(subnet *net.IPNet, start net.IP, size int) error {
+	if size <= 0 {
+		return nil
+	}
+	if uint64(ipToUint32(start))+uint64(size-1) > math.MaxUint32 {
+		return fmt.Errorf("%d addresses from %s overflow the address space", size, start)
+	}
+	end := addIP(start, size-1)
+	if !usableHost(subnet, start) || !usableHost(subnet, end) {
+		return fmt.Errorf("%s-%s is not within the host addresses of %s", start, end, subnet)
+	}
+	return nil
+}
+
+// usableHost reports whether ip is in subnet and is neither its network nor
+// its broadcast address.
+func usableHost(subnet *net.IPNet, ip net.IP) bool {
+	if !subnet.Contains(ip) {
+		return false
+	}
+	if ones, bits := subnet.Mask.Size(); bits-ones < 2 {
+		return true
+	}
+	n := ipToUint32(ip)
+	network := ipToUint32(subnet.IP)
+	broadcast := network | ^ipToUint32(net.IP(subnet.Mask))
+	return n != network && n != broadcast
+}
+
+func addIP(ip net.IP, n int) net.IP {
+	v := ipToUint32(ip) + uint32(n)
+	return net.IPv4(byte(v>>24), byte(v>>16), byte(v>>8), byte(v)).To4()
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	ip = ip.To4()
+	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+}
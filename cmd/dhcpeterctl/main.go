@@ -0,0 +1,348 @@
+// Command dhcpeterctl manages a running dhcpeterd over its control socket.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+var (
+	socketPath = flag.String("socket", "/run/dhcpeterd.sock", "Control socket path")
+	jsonOutput = flag.Bool("json", false, "Print raw JSON responses")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: dhcpeterctl [flags] <command> [args]
+
+commands:
+  leases [interface]        list leases
+  stats                     show pool utilization
+  lease <mac>               show a single lease
+  revoke [-nak] <mac|ip>    expire a lease now; with -nak also refuse
+                            the client's next renewal
+  delete <mac>              remove a lease from the database
+  hostname <mac> <name>     set a hostname override ("" clears it)
+  reserve <mac>             turn a lease into a static reservation
+  wake <mac|hostname> [interface]
+                            send a wake-on-lan packet
+  health                    check the daemon's health; exits 1 if unhealthy
+  history [-since t] [-until t] [mac|ip]
+                            show the lease history, optionally of one
+                            device or address; times are RFC 3339
+
+flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	c := newClient(*socketPath)
+
+	var err error
+	switch cmd, args := args[0], args[1:]; {
+	case cmd == "leases" && len(args) <= 1:
+		err = listLeases(c, args)
+	case cmd == "stats" && len(args) == 0:
+		err = showStats(c)
+	case cmd == "lease" && len(args) == 1:
+		err = showLease(c, args[0])
+	case cmd == "revoke":
+		err = revokeLease(c, args)
+	case cmd == "delete" && len(args) == 1:
+		_, err = c.do("DELETE", "/leases/"+url.PathEscape(args[0]), nil)
+	case cmd == "hostname" && len(args) == 2:
+		err = setHostname(c, args[0], args[1])
+	case cmd == "wake" && (len(args) == 1 || len(args) == 2):
+		path := "/wake/" + url.PathEscape(args[0])
+		if len(args) == 2 {
+			path += "?interface=" + url.QueryEscape(args[1])
+		}
+		_, err = c.do("POST", path, nil)
+	case cmd == "history":
+		err = showHistory(c, args)
+	case cmd == "health" && len(args) == 0:
+		err = checkHealth(c)
+	case cmd == "reserve" && len(args) == 1:
+		_, err = c.do("POST", "/leases/"+url.PathEscape(args[0])+"/reserve", nil)
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dhcpeterctl: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func listLeases(c *client, args []string) error {
+	path := "/leases"
+	if len(args) == 1 {
+		path += "?interface=" + url.QueryEscape(args[0])
+	}
+	body, err := c.do("GET", path, nil)
+	if err != nil || *jsonOutput {
+		return err
+	}
+
+	var leases map[string][]dhcp4d.Lease
+	if err := json.Unmarshal(body, &leases); err != nil {
+		return err
+	}
+	ifaces := make([]string, 0, len(leases))
+	for iface := range leases {
+		ifaces = append(ifaces, iface)
+	}
+	sort.Strings(ifaces)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "INTERFACE\tIP\tMAC\tHOSTNAME\tEXPIRY\tVENDOR")
+	for _, iface := range ifaces {
+		for _, l := range leases[iface] {
+			printLease(tw, iface, l)
+		}
+	}
+	return tw.Flush()
+}
+
+func showStats(c *client) error {
+	body, err := c.do("GET", "/stats", nil)
+	if err != nil || *jsonOutput {
+		return err
+	}
+	var stats map[string]dhcp4d.Stats
+	if err := json.Unmarshal(body, &stats); err != nil {
+		return err
+	}
+	ifaces := make([]string, 0, len(stats))
+	for iface := range stats {
+		ifaces = append(ifaces, iface)
+	}
+	sort.Strings(ifaces)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "INTERFACE\tPOOL\tACTIVE\tEXPIRED\tSTATIC\tUTILIZATION")
+	for _, iface := range ifaces {
+		s := stats[iface]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%.1f%%\n", iface, s.PoolSize, s.Active, s.Expired, s.Static, s.Utilization)
+	}
+	return tw.Flush()
+}
+
+func showLease(c *client, mac string) error {
+	body, err := c.do("GET", "/leases/"+url.PathEscape(mac), nil)
+	if err != nil || *jsonOutput {
+		return err
+	}
+	var il struct {
+		Interface string       `json:"interface"`
+		Lease     dhcp4d.Lease `json:"lease"`
+	}
+	if err := json.Unmarshal(body, &il); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "INTERFACE\tIP\tMAC\tHOSTNAME\tEXPIRY\tVENDOR")
+	printLease(tw, il.Interface, il.Lease)
+	return tw.Flush()
+}
+
+func revokeLease(c *client, args []string) error {
+	fs := flag.NewFlagSet("revoke", flag.ExitOnError)
+	nak := fs.Bool("nak", false, "NAK the client's next request")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+	path := "/leases/" + url.PathEscape(fs.Arg(0)) + "/revoke"
+	if *nak {
+		path += "?nak=true"
+	}
+	_, err := c.do("POST", path, nil)
+	return err
+}
+
+func setHostname(c *client, mac, hostname string) error {
+	req, err := json.Marshal(map[string]string{"hostname": hostname})
+	if err != nil {
+		return err
+	}
+	_, err = c.do("POST", "/leases/"+url.PathEscape(mac)+"/hostname", req)
+	return err
+}
+
+func checkHealth(c *client) error {
+	// An unhealthy daemon answers 503 with the failed checks, so read the
+	// body regardless of status.
+	resp, err := c.hc.Get("http://dhcpeterd/healthz")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if *jsonOutput {
+		os.Stdout.Write(b)
+	}
+	var health struct {
+		OK     bool `json:"ok"`
+		Checks []struct {
+			Name  string `json:"name"`
+			OK    bool   `json:"ok"`
+			Error string `json:"error"`
+		} `json:"checks"`
+	}
+	if err := json.Unmarshal(b, &health); err != nil {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	if !*jsonOutput {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "CHECK\tSTATUS")
+		for _, c := range health.Checks {
+			status := "ok"
+			if !c.OK {
+				status = c.Error
+			}
+			fmt.Fprintf(tw, "%s\t%s\n", c.Name, status)
+		}
+		tw.Flush()
+	}
+	if !health.OK {
+		return fmt.Errorf("unhealthy")
+	}
+	return nil
+}
+
+func showHistory(c *client, args []string) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	since := fs.String("since", "", "Only show entries last seen at or after this RFC 3339 time")
+	until := fs.String("until", "", "Only show entries first seen at or before this RFC 3339 time")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		usage()
+		os.Exit(2)
+	}
+	q := url.Values{}
+	if fs.NArg() == 1 {
+		if net.ParseIP(fs.Arg(0)) != nil {
+			q.Set("ip", fs.Arg(0))
+		} else {
+			q.Set("mac", fs.Arg(0))
+		}
+	}
+	if *since != "" {
+		q.Set("since", *since)
+	}
+	if *until != "" {
+		q.Set("until", *until)
+	}
+	body, err := c.do("GET", "/history?"+q.Encode(), nil)
+	if err != nil || *jsonOutput {
+		return err
+	}
+
+	var records []struct {
+		HardwareAddr string    `json:"hardware_addr"`
+		Interface    string    `json:"interface"`
+		IP           net.IP    `json:"ip"`
+		Hostname     string    `json:"hostname"`
+		FirstSeen    time.Time `json:"first_seen"`
+		LastSeen     time.Time `json:"last_seen"`
+	}
+	if err := json.Unmarshal(body, &records); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "INTERFACE\tIP\tMAC\tHOSTNAME\tFIRST SEEN\tLAST SEEN")
+	for _, r := range records {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Interface, r.IP, r.HardwareAddr, r.Hostname,
+			r.FirstSeen.Local().Format(time.DateTime), r.LastSeen.Local().Format(time.DateTime))
+	}
+	return tw.Flush()
+}
+
+func printLease(w io.Writer, iface string, l dhcp4d.Lease) {
+	expiry := "never"
+	if !l.Expiry.IsZero() {
+		expiry = l.Expiry.Local().Format(time.DateTime)
+		if l.Expired(time.Now()) {
+			expiry += " (expired)"
+		}
+	}
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", iface, l.Addr, l.HardwareAddr, l.Hostname, expiry, l.Vendor)
+}
+
+type client struct {
+	hc *http.Client
+}
+
+func newClient(socket string) *client {
+	return &client{
+		hc: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// do performs a request against the daemon and returns the response body.
+// With -json the body is also printed.
+func (c *client) do(method, path string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, "http://dhcpeterd"+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(b, &e) == nil && e.Error != "" {
+			return nil, fmt.Errorf("%s", e.Error)
+		}
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	if *jsonOutput {
+		os.Stdout.Write(b)
+	}
+	return b, nil
+}
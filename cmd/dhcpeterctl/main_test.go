@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dhcpeterd.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"eth0":{}}`))
+	})
+	mux.HandleFunc("POST /leases/{mac}/hostname", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "bad content type", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"no lease for ` + r.PathValue("mac") + `"}`))
+	})
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	c := newClient(path)
+	body, err := c.do("GET", "/stats", nil)
+	if err != nil || string(body) != `{"eth0":{}}` {
+		t.Errorf("stats: %q, %v", body, err)
+	}
+	// Errors of the daemon are reported by their message.
+	if err := setHostname(c, "aa:bb:cc:dd:ee:ff", "laptop"); err == nil || err.Error() != "no lease for aa:bb:cc:dd:ee:ff" {
+		t.Errorf("hostname: %v, want the daemon's error", err)
+	}
+	if _, err := c.do("GET", "/missing", nil); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("missing: %v, want the status", err)
+	}
+}
@@ -1,7 +1,14 @@
 package config
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -10,9 +17,496 @@ import (
 type Config struct {
 	Networks  []Network `toml:"networks"`
 	LeaseFile string    `toml:"lease_file"`
+	Tags      []TagRule `toml:"tags"`
+
+	// IncludeDir is a directory of config fragments (*.toml, *.yaml,
+	// *.yml or *.json) merged in name order. Fragments may only set
+	// networks and tags. A network for an interface that is already
+	// configured may only add static leases to it. Relative paths are
+	// relative to the config file.
+	IncludeDir string `toml:"include_dir"`
+
+	// LeaseWriteInterval is the minimum time between writes of a lease
+	// file. Changes within it are coalesced into one write, at the risk of
+	// losing them on a crash; they are always written on shutdown. By
+	// default every change is written immediately.
+	LeaseWriteInterval time.Duration `toml:"lease_write_interval"`
+
+	// LeaseFileBackups is the number of timestamped backups kept of each
+	// lease file. A backup is made before a lease file is first replaced
+	// after startup and then at most hourly. Use "dhcpeterd
+	// restore-leases" to roll back to one.
+	LeaseFileBackups int `toml:"lease_file_backups"`
+
+	// Redis shares leases between instances through a Redis server. The
+	// lease files are kept as a local cache and used while it is
+	// unreachable.
+	Redis *Redis `toml:"redis"`
+
+	// Etcd shares leases between replicas through an etcd cluster. Like
+	// Redis, which it cannot be combined with, it keeps the lease files as
+	// a local cache.
+	Etcd *Etcd `toml:"etcd"`
+
+	// DnsmasqLeaseFile additionally receives the active leases of all
+	// networks in dnsmasq's lease file format, for tools that parse it.
+	// To use it instead of the JSON lease file, leave lease_file unset;
+	// leases are then not restored on restart.
+	DnsmasqLeaseFile string `toml:"dnsmasq_lease_file"`
+
+	// HostsFile receives the hostnames of the active leases of all
+	// networks in /etc/hosts format, for resolvers running alongside such
+	// as dnsmasq (addn-hosts) or CoreDNS (hosts plugin). Names are also
+	// listed qualified with HostsDomain if it is set.
+	HostsFile   string `toml:"hosts_file"`
+	HostsDomain string `toml:"hosts_domain"`
+
+	// HostsDir receives one hosts file per lease, named after the client's
+	// hardware address, which is removed when the lease expires. Resolvers
+	// that watch a directory, like dnsmasq's hostsdir, pick up changes
+	// without a full reload. The directory should not be shared with
+	// other files named like hardware addresses.
+	HostsDir string `toml:"hosts_dir"`
+
+	// SharedSocket receives the DHCP messages of all networks on one UDP
+	// socket on port 67, routed by the interface they arrive on, instead
+	// of a socket bound to each interface. Networks in another netns keep
+	// their own.
+	SharedSocket bool `toml:"shared_socket"`
+
+	// InterfaceWaitTimeout is how long a network waits for its interface
+	// to appear and be assigned an address in the network before failing
+	// (default 1m).
+	InterfaceWaitTimeout time.Duration `toml:"interface_wait_timeout"`
+
+	// LeaseDumpFile receives the lease table of every interface on
+	// SIGUSR1. If unset the table is written to the log.
+	LeaseDumpFile string `toml:"lease_dump_file"`
+
+	// ReservationsFile stores static leases created at runtime (e.g. by
+	// promoting a dynamic lease). They are merged into the static leases
+	// of the matching network on startup.
+	ReservationsFile string `toml:"reservations_file"`
+
+	// HostnameFallback names the leases of clients that send no hostname.
+	HostnameFallback *HostnameFallback `toml:"hostname_fallback"`
+
+	// HTTPListen is the address of the embedded HTTP server (e.g.
+	// "127.0.0.1:8067"). The server is disabled if unset.
+	HTTPListen string `toml:"http_listen"`
+
+	// GRPCListen is the address of the gRPC admin service defined in
+	// proto/dhcpeterd/v1 (e.g. "127.0.0.1:8068"). It is authorized like
+	// the HTTP API, with HTTPTLS and APITokens. Disabled if unset.
+	GRPCListen string `toml:"grpc_listen"`
+
+	// Tailscale serves the HTTP API and UI on a tailnet, in addition to or
+	// instead of HTTPListen.
+	Tailscale *Tailscale `toml:"tailscale"`
+
+	// ControlSocket is the path of the unix socket used by dhcpeterctl
+	// (e.g. "/run/dhcpeterd.sock"). It is disabled if unset.
+	ControlSocket string `toml:"control_socket"`
+
+	// HTTPTLS enables TLS, and optionally client certificate
+	// authentication, on HTTPListen and GRPCListen.
+	HTTPTLS *HTTPTLS `toml:"http_tls"`
+
+	// APITokens are bearer tokens accepted by the HTTP and gRPC APIs. If
+	// neither tokens nor a client CA are configured the APIs are
+	// unauthenticated.
+	APITokens []APIToken `toml:"api_tokens"`
+
+	// OUIDatabase is the path to the IEEE OUI registry (oui.txt or oui.csv)
+	// used to annotate leases with the device vendor. If unset, common
+	// distribution paths are tried.
+	OUIDatabase string `toml:"oui_database"`
+
+	// FingerprintDatabase is the path to a JSON list of additional DHCP
+	// fingerprint rules used to guess device types.
+	FingerprintDatabase string `toml:"fingerprint_database"`
+
+	// InventoryInterval is how often the kernel's neighbor (ARP) table is
+	// read to record devices on the served networks that never requested
+	// a lease. They are listed as unknown leases, which also keeps their
+	// addresses from being handed out. Disabled if zero.
+	InventoryInterval time.Duration `toml:"inventory_interval"`
+
+	// NewDevice is notified the first time a hardware address that has
+	// never been seen before receives a lease.
+	NewDevice *Notify `toml:"new_device"`
+
+	// OnLeaseScript is run for every lease change with the arguments
+	// "add|old|del <mac> <ip> [hostname]", like dnsmasq's dhcp-script;
+	// del is run when a lease is released or expires. Details are also passed in DHCPETERD_* environment variables.
+	OnLeaseScript string `toml:"on_lease_script"`
+
+	// Webhook receives lease events as JSON POSTs.
+	Webhook *Webhook `toml:"webhook"`
+
+	// MQTT publishes lease events and device presence to a broker.
+	MQTT *MQTT `toml:"mqtt"`
+
+	// Hostapd correlates Wi-Fi stations with leases through hostapd's
+	// control sockets.
+	Hostapd []Hostapd `toml:"hostapd"`
+
+	// FirewallSets keep the addresses of active leases in nftables sets or
+	// ipsets, for firewall rules that follow DHCP state.
+	FirewallSets []FirewallSet `toml:"firewall_sets"`
+
+	// AuditLog appends every lease grant, renewal, NAK, release and
+	// expiry to a JSON lines file.
+	AuditLog *AuditLog `toml:"audit_log"`
+
+	// LeaseHistory keeps the past addresses and hostnames of every
+	// device, for looking up who held an address at some point.
+	LeaseHistory *LeaseHistory `toml:"lease_history"`
+
+	// HA runs this instance as the primary or the standby of an
+	// active/standby pair.
+	HA *HA `toml:"ha"`
+
+	// LeaseQueryAllow lists the networks (CIDRs or addresses), such as
+	// of access concentrators, that may ask which client holds an
+	// address with RFC 4388 DHCPLEASEQUERY messages. Queries are
+	// answered on the interfaces of the served networks, about the
+	// leases of all of them. Disabled if empty.
+	LeaseQueryAllow []string `toml:"lease_query_allow"`
+
+	// Keepalived serves only while keepalived reports this instance as
+	// the VRRP master, so that a keepalived-managed pair does not both
+	// answer.
+	Keepalived *Keepalived `toml:"keepalived"`
+
+	// Failover makes this instance the secondary of an ISC dhcpd primary
+	// for the networks that set failover.
+	Failover *Failover `toml:"failover"`
+
+	// DDNS registers the hostnames of leases in DNS with dynamic updates.
+	DDNS *DDNS `toml:"ddns"`
+
+	// ReverseZones writes an RFC 1035 zone file of PTR records for the
+	// in-addr.arpa zone of each served subnet, for an authoritative server
+	// to load, include or serve by AXFR.
+	ReverseZones *ReverseZones `toml:"reverse_zones"`
+
+	// PrefixDelegation acquires an IPv6 prefix from upstream with
+	// DHCPv6-PD and numbers networks from it.
+	PrefixDelegation *PrefixDelegation `toml:"prefix_delegation"`
+
+	// Tracing exports a span per DHCP message over OTLP.
+	Tracing *Tracing `toml:"tracing"`
+
+	// LogLevel is the minimum level logged: "debug", "info" (the
+	// default), "warn" or "error".
+	LogLevel string `toml:"log_level"`
+
+	// LogFormat is "text" (the default) or "json". It does not apply to
+	// journald output.
+	LogFormat string `toml:"log_format"`
+
+	// Syslog sends logs to a syslog server in addition to stderr.
+	Syslog *Syslog `toml:"syslog"`
+
+	// Journald sends logs to the systemd journal, with attributes as
+	// structured fields, instead of stderr.
+	Journald bool `toml:"journald"`
+
+	// Seccomp restricts the daemon, once it has started, to the system
+	// calls of its serve loops and lease writers on amd64 and arm64.
+	// Others fail with EPERM. It cannot be used with settings that run
+	// commands: on_lease_script, firewall_sets and new_device commands.
+	Seccomp bool `toml:"seccomp"`
+
+	// Sandbox restricts the daemon's file system access, once it has
+	// started, to the files and directories of its configuration, such as
+	// the config and lease files and the control socket. It uses Landlock,
+	// which needs a build with CGO_ENABLED=0, or otherwise chroots to
+	// SandboxChroot if that is set. Commands it runs inherit the
+	// restriction; SandboxReadPaths and SandboxWritePaths list further
+	// paths they need. Paths added by a reload only become accessible
+	// after a restart, so reloads that add them fail.
+	Sandbox           bool     `toml:"sandbox"`
+	SandboxReadPaths  []string `toml:"sandbox_read_paths"`
+	SandboxWritePaths []string `toml:"sandbox_write_paths"`
+
+	// SandboxChroot is a directory holding the writable files of the
+	// configuration, the working directory and /dev/null at the same
+	// paths as the root directory, for example through bind mounts.
+	SandboxChroot string `toml:"sandbox_chroot"`
+
+	// ValueFiles are the files that "@file:" values were read from, which
+	// a reload reads again. Set by Load.
+	ValueFiles []string `toml:"-"`
+}
+
+// HTTPTLS configures TLS for the HTTP server. If ClientCA is set, clients
+// presenting a certificate signed by it are granted ClientScope ("read" or
+// "write", default "write").
+type HTTPTLS struct {
+	Cert        string `toml:"cert"`
+	Key         string `toml:"key"`
+	ClientCA    string `toml:"client_ca"`
+	ClientScope string `toml:"client_scope"`
+}
+
+// Tailscale serves the HTTP API on port 80 of a tailnet node named Hostname
+// (default "dhcpeterd") through tsnet, without listening on the host's
+// network. It is authorized like HTTPListen. The node's keys and state are
+// kept in StateDir. AuthKey adds the node to the tailnet the first time it
+// starts; without one, the login URL is logged. ControlURL sets the
+// coordination server if it is not Tailscale's, such as Headscale.
+type Tailscale struct {
+	Hostname   string `toml:"hostname"`
+	StateDir   string `toml:"state_dir"`
+	AuthKey    string `toml:"auth_key"`
+	ControlURL string `toml:"control_url"`
+}
+
+// APIToken is a bearer token for the HTTP API with Scope "read" (GET
+// requests only) or "write" (default). The token may be read from
+// TokenFile instead of being set inline.
+type APIToken struct {
+	Token     string `toml:"token"`
+	TokenFile string `toml:"token_file"`
+	Scope     string `toml:"scope"`
+}
+
+// Webhook POSTs lease events to URL. If Secret is set, the body is signed
+// with HMAC-SHA256 in the X-Dhcpeterd-Signature header. Events limits which
+// of "offer", "ack", "nak", "expire", "release", "flap", "pool_warning" and
+// "pool_exhausted" are sent (default all). Failed
+// deliveries are retried Retries times (default 3).
+type Webhook struct {
+	URL     string   `toml:"url"`
+	Secret  string   `toml:"secret"`
+	Events  []string `toml:"events"`
+	Retries *int     `toml:"retries"`
+}
+
+// MQTT configures the MQTT publisher. Broker is a URL such as
+// tcp://localhost:1883 or tls://broker:8883. Topics are published under
+// TopicPrefix (default "dhcpeterd"). If HomeAssistant is set, discovery
+// configs are published under DiscoveryPrefix (default "homeassistant")
+// so each client appears as a device_tracker.
+type MQTT struct {
+	Broker          string `toml:"broker"`
+	ClientID        string `toml:"client_id"`
+	Username        string `toml:"username"`
+	Password        string `toml:"password"`
+	TopicPrefix     string `toml:"topic_prefix"`
+	HomeAssistant   bool   `toml:"home_assistant"`
+	DiscoveryPrefix string `toml:"discovery_prefix"`
+}
+
+// Hostapd is the control socket of a hostapd interface, such as
+// "/var/run/hostapd/wlan0". The leases of stations associated with it record
+// its SSID and BSSID. If ExpireOnDisconnect is set, such as for a guest SSID,
+// a station's lease is expired when it disassociates.
+type Hostapd struct {
+	Socket             string `toml:"socket"`
+	ExpireOnDisconnect bool   `toml:"expire_on_disconnect"`
+}
+
+// FirewallSet keeps the addresses of active leases in the nftables set or
+// ipset Set, adding them when they are granted and removing them when they
+// expire or are released. Backend is "nft" (default), with Set given as
+// "family table set" (e.g. "inet filter guests"), or "ipset". If Class or
+// Tag is set, only leases of that class or with that tag are added. The set
+// is repopulated from the current leases on startup.
+type FirewallSet struct {
+	Backend string `toml:"backend"`
+	Set     string `toml:"set"`
+	Class   string `toml:"class"`
+	Tag     string `toml:"tag"`
+}
+
+// AuditLog configures the audit log at Path. The file is rotated once it
+// exceeds MaxSize bytes or is older than MaxAge (if set); rotated files get a
+// timestamp suffix and only the newest MaxBackups are kept (0 keeps all).
+type AuditLog struct {
+	Path       string        `toml:"path"`
+	MaxSize    int64         `toml:"max_size"`
+	MaxAge     time.Duration `toml:"max_age"`
+	MaxBackups int           `toml:"max_backups"`
+}
+
+// Redis configures the Redis lease store. URL is of the form
+// redis://[[user]:password@]host[:port][/db], or rediss:// for TLS. Keys
+// start with KeyPrefix (default "dhcpeterd:") followed by the name of the
+// lease file. Timeout (default 5s) applies to every command.
+type Redis struct {
+	URL       string        `toml:"url"`
+	KeyPrefix string        `toml:"key_prefix"`
+	Timeout   time.Duration `toml:"timeout"`
+}
+
+// Etcd configures the etcd lease store, which uses the v3 JSON API of the
+// Endpoints (such as "http://127.0.0.1:2379"), trying them in order. Keys
+// start with KeyPrefix (default "/dhcpeterd/") followed by the name of the
+// lease file. Lease keys are removed by etcd KeepExpired (default 24h)
+// after the DHCP lease expires. Timeout (default 5s) applies to every
+// request.
+type Etcd struct {
+	Endpoints   []string      `toml:"endpoints"`
+	Username    string        `toml:"username"`
+	Password    string        `toml:"password"`
+	KeyPrefix   string        `toml:"key_prefix"`
+	KeepExpired time.Duration `toml:"keep_expired"`
+	Timeout     time.Duration `toml:"timeout"`
+}
+
+// LeaseHistory configures the lease history file at Path. At most
+// MaxEntries (default 20) periods are kept per device, and periods last seen
+// more than MaxAge ago (if set) are dropped.
+type LeaseHistory struct {
+	Path       string        `toml:"path"`
+	MaxEntries int           `toml:"max_entries"`
+	MaxAge     time.Duration `toml:"max_age"`
+}
+
+// HA configures active/standby high availability. The primary (Role
+// "primary") listens on Listen and streams its lease database to the
+// standby (Role "standby"), which connects to it at Peer. Both sides
+// authenticate with Secret. The standby serves once it has not heard from
+// the primary for FailoverTimeout (default 5s; the primary sends a
+// heartbeat every HeartbeatInterval, default 1s) and stops when the primary
+// is back. Leases granted by the standby meanwhile are not sent back to the
+// primary; clients renew them with the primary.
+type HA struct {
+	Role              string        `toml:"role"`
+	Listen            string        `toml:"listen"`
+	Peer              string        `toml:"peer"`
+	Secret            string        `toml:"secret"`
+	HeartbeatInterval time.Duration `toml:"heartbeat_interval"`
+	FailoverTimeout   time.Duration `toml:"failover_timeout"`
+}
+
+// Keepalived follows the state keepalived writes to FIFO, its notify_fifo.
+// Until keepalived reports MASTER nothing is served. If Instance is set,
+// only the state of that vrrp_instance or vrrp_sync_group counts.
+type Keepalived struct {
+	FIFO     string `toml:"fifo"`
+	Instance string `toml:"instance"`
+}
+
+// Failover configures the DHCP failover protocol of ISC dhcpd, with this
+// instance as the secondary of the primary at Peer (host:port; the port
+// defaults to 647). Both servers connect to each other; this one listens
+// on Listen (default ":647"). Name must match the failover peer name of the
+// primary and MCLT its mclt (default 1h). Messages are neither signed nor
+// encrypted, so the link between the servers must be trusted.
+//
+// Only addresses the primary has handed over for backup are allocated to
+// new clients, and lease periods are limited to MCLT beyond what the
+// primary has acknowledged. While in the normal state only the clients of
+// the hash buckets the primary assigns are served, unless they have been
+// trying for LoadBalanceMaxSeconds (default 3). Partner-down is not
+// supported.
+type Failover struct {
+	Name                  string        `toml:"name"`
+	Listen                string        `toml:"listen"`
+	Peer                  string        `toml:"peer"`
+	MCLT                  time.Duration `toml:"mclt"`
+	LoadBalanceMaxSeconds int           `toml:"load_balance_max_seconds"`
+}
+
+// DDNS sends dynamic updates (RFC 2136) to Server (host[:port]), signed with
+// the TSIG key KeyName if set, whose KeySecret is base64 encoded and whose
+// KeyAlgorithm defaults to hmac-sha256. Leases with a hostname get an A
+// record in ForwardZone and, if their address is in ReverseZone, a PTR
+// record, with the given TTL (default 5m). Names are claimed with DHCID
+// records (RFC 4703), so a name registered by another client is left
+// alone. Records are removed when leases expire or are released.
+type DDNS struct {
+	Server       string        `toml:"server"`
+	ForwardZone  string        `toml:"forward_zone"`
+	ReverseZone  string        `toml:"reverse_zone"`
+	TTL          time.Duration `toml:"ttl"`
+	KeyName      string        `toml:"key_name"`
+	KeyAlgorithm string        `toml:"key_algorithm"`
+	KeySecret    string        `toml:"key_secret"`
+}
+
+// HostnameFallback configures where the names of clients that send no
+// hostname come from. File maps hardware or IP addresses to names in
+// /etc/ethers format and is reread when it changes. PTR looks up the
+// client's address in DNS and uses the first label of the answer; the
+// lease is named once the lookup completes.
+type HostnameFallback struct {
+	File string `toml:"file"`
+	PTR  bool   `toml:"ptr"`
+}
+
+// ReverseZones configures reverse zone files. Dir receives a file per zone,
+// named after it (e.g. "42.168.192.in-addr.arpa.zone"). PTR records point
+// to the lease hostnames qualified with Domain. NS is the zone's name
+// server and Hostmaster the SOA mailbox (hostmaster.<domain> by default).
+// TTL defaults to 5 minutes. Zones are on octet boundaries: a /22 network
+// gets the four zones of its /24s, and networks smaller than a /24 share
+// the zone of theirs.
+type ReverseZones struct {
+	Dir        string        `toml:"dir"`
+	Domain     string        `toml:"domain"`
+	NS         string        `toml:"ns"`
+	Hostmaster string        `toml:"hostmaster"`
+	TTL        time.Duration `toml:"ttl"`
+}
+
+// PrefixDelegation configures a DHCPv6-PD client on the upstream
+// interface. The delegated prefix is divided into /64s, the first for the
+// first of Networks, the second for the second and so on. The /64 of a
+// network is added to its router advertisement prefixes and replaces the
+// prefix of its dhcpv6 server, whose start_ip then only gives the
+// interface identifier (e.g. "::1000"). Lifetimes of advertised prefixes
+// are capped at those of the delegation.
+type PrefixDelegation struct {
+	Interface string `toml:"interface"`
+
+	// PrefixLength is the length of the prefix to ask for, e.g. 56. The
+	// server may delegate another.
+	PrefixLength int `toml:"prefix_length"`
+
+	// Networks are the interfaces of the networks that get a /64.
+	Networks []string `toml:"networks"`
+
+	// AssignAddresses adds the first address of its /64 (e.g.
+	// 2001:db8:0:1::1) to the interface of each network, so that the
+	// delegated prefix is routed to it (default true).
+	AssignAddresses *bool `toml:"assign_addresses"`
+}
+
+// Tracing configures OTLP/HTTP trace export. Endpoint is the collector base
+// URL, such as http://localhost:4318; spans are POSTed to /v1/traces under it.
+// Headers are added to every export request.
+type Tracing struct {
+	Endpoint    string            `toml:"endpoint"`
+	ServiceName string            `toml:"service_name"`
+	Headers     map[string]string `toml:"headers"`
+}
+
+// Syslog configures RFC 5424 syslog output. Address is a URL such as
+// udp://loghost:514, tcp://loghost:514 or unix:///dev/log (the default).
+// Facility defaults to "daemon" and Tag to "dhcpeterd".
+type Syslog struct {
+	Address  string `toml:"address"`
+	Facility string `toml:"facility"`
+	Tag      string `toml:"tag"`
+}
+
+// Notify describes how to deliver a notification. Command is run with the
+// event in DHCPETERD_* environment variables; URL receives it as a JSON POST.
+type Notify struct {
+	Command []string `toml:"command"`
+	URL     string   `toml:"url"`
 }
 
 type Network struct {
+	// Interface is the name of the interface to serve, or a glob pattern
+	// (e.g. "veth-*", see path.Match) to serve every matching interface
+	// with the same settings. Networks naming an interface explicitly take
+	// precedence over patterns.
 	Interface     string        `toml:"interface"`
 	StartIP       string        `toml:"start_ip"`
 	Range         int           `toml:"range"`
@@ -20,25 +514,499 @@ type Network struct {
 	LeaseDuration time.Duration `toml:"lease_duration"`
 	StaticLeases  []StaticLease `toml:"static_leases"`
 	DNSServers    []string      `toml:"dns_servers"`
+	Classes       []Class       `toml:"classes"`
+	OptionSets    []OptionSet   `toml:"option_sets"`
+
+	// DomainSearch is the domain search list, sent as option 119.
+	DomainSearch []string `toml:"domain_search"`
+
+	// Routes are classless static routes, sent as option 121. Clients
+	// that use them ignore the router option, so a default route through
+	// the server is added unless one of them has destination 0.0.0.0/0.
+	Routes []Route `toml:"routes"`
+
+	// AllowMACs and DenyMACs are full hardware addresses or OUI prefixes.
+	// If AllowMACs is set only listed clients (and static leases) are
+	// served. DenyAction is "ignore" (default) or "nak".
+	AllowMACs  []string `toml:"allow_macs"`
+	DenyMACs   []string `toml:"deny_macs"`
+	DenyAction string   `toml:"deny_action"`
+
+	// Ignore lists hardware addresses (or OUI prefixes) that are never
+	// responded to at all.
+	Ignore []string `toml:"ignore"`
+
+	// Quarantine, if set, is the class that clients without a static lease
+	// that have not been approved are put in.
+	Quarantine *Class `toml:"quarantine"`
+
+	// Dynamic set to false disables dynamic allocation so that only static
+	// leases are served. Other clients are handled according to DenyAction.
+	Dynamic *bool `toml:"dynamic"`
+
+	// DeviceLeaseDurations override the lease duration by hardware address
+	// prefix. If unset, the built-in "nintendo" profile is used with a 1h
+	// lease duration; set to an empty list to disable it.
+	DeviceLeaseDurations []DeviceLeaseDuration `toml:"device_lease_durations"`
+
+	// GroupRandomizedMACs correlates clients using randomized hardware
+	// addresses and keeps a single lease per device.
+	GroupRandomizedMACs bool `toml:"group_randomized_macs"`
+
+	// RateLimit drops messages from clients sending too many, so a
+	// misbehaving device cannot monopolize the server.
+	RateLimit *RateLimit `toml:"rate_limit"`
+
+	// FlapDetection logs and raises a "flap" event (delivered to webhooks
+	// and other subscribers) when a client sends more than Threshold
+	// requests, declines and releases within Window.
+	FlapDetection *FlapDetection `toml:"flap_detection"`
+
+	// PoolWarningThreshold is the utilization percentage of the pool at
+	// which a warning is logged and a "pool_warning" event is raised. An
+	// exhausted pool always raises "pool_exhausted".
+	PoolWarningThreshold float64 `toml:"pool_warning_threshold"`
+
+	// ExpiredLeaseRetention removes leases from the database once they
+	// have been expired for this long. Until then a returning client gets
+	// its old address back. By default expired leases are kept.
+	ExpiredLeaseRetention time.Duration `toml:"expired_lease_retention"`
+
+	// LeaseFile stores this network's leases instead of the global
+	// lease_file, so that busy networks don't cause the leases of the
+	// others to be rewritten.
+	LeaseFile string `toml:"lease_file"`
+
+	// SplitScope shares the network with a second server: each answers
+	// only the clients whose hardware address (or client identifier)
+	// hashes into its share, as in RFC 3074. Both servers need
+	// non-overlapping pools.
+	SplitScope *SplitScope `toml:"split_scope"`
+
+	// VirtualIP, such as a VRRP address, makes the network served only
+	// while the address is on the interface. It is used as the server
+	// identifier, so that clients renew with whichever server holds it.
+	VirtualIP string `toml:"virtual_ip"`
+
+	// ServerID is the address of the interface to use as the server
+	// identifier and source address of replies, instead of the first one
+	// in the same network as the pool.
+	ServerID string `toml:"server_id"`
+
+	// Failover shares the network's pool with the failover primary
+	// configured in the failover section.
+	Failover bool `toml:"failover"`
+
+	// ClientFQDN is how the Client FQDN option (81) is answered: "honor"
+	// (default) lets clients update their own A record or ask for no
+	// updates, "server" always has ddns update both records and "ignore"
+	// ignores the option.
+	ClientFQDN string `toml:"client_fqdn"`
+
+	// SanitizeHostnames makes the hostnames clients send valid DNS labels
+	// before they are stored and exported: lowercased, with invalid
+	// characters replaced by hyphens and truncated to 63 characters. The
+	// name as sent is kept in client_hostname.
+	SanitizeHostnames bool `toml:"sanitize_hostnames"`
+
+	// DuplicateHostnames is what happens when a client asks for the
+	// hostname of another active lease: "allow" (default) keeps it,
+	// "number" appends -2, -3 and so on, and "mac" appends the last three
+	// octets of the client's hardware address.
+	DuplicateHostnames string `toml:"duplicate_hostnames"`
+
+	// Allocation is how the address of a new lease is picked: "random"
+	// (default) anywhere in the pool, or "sequential", the lowest free
+	// address.
+	Allocation string `toml:"allocation"`
+
+	// MinSecs makes the server a backup that ignores DHCPDISCOVERs until
+	// the client has been trying for this many seconds (the secs field),
+	// leaving them to the primary server.
+	MinSecs int `toml:"min_secs"`
+
+	// AlwaysBroadcast broadcasts all replies, even to clients that do not
+	// set the broadcast flag, for clients that cannot receive unicast
+	// replies before they are configured.
+	AlwaysBroadcast bool `toml:"always_broadcast"`
+
+	// UDPOnly sends replies over the UDP socket instead of a packet
+	// socket, for containers without CAP_NET_RAW. Replies to clients
+	// without an address are then broadcast. This is the fallback if a
+	// packet socket cannot be opened anyway.
+	UDPOnly bool `toml:"udp_only"`
+
+	// Netns is the network namespace of the interface, a name of "ip
+	// netns" or a path such as /proc/PID/ns/net. The network's sockets
+	// are opened in it. Interface names must be unique across namespaces
+	// and cannot be patterns.
+	Netns string `toml:"netns"`
+
+	// VLANs are 802.1Q VLANs tagged on the interface, a trunk, that are
+	// served from a raw socket on it, without kernel VLAN interfaces.
+	VLANs []VLAN `toml:"vlans"`
+
+	// MDNS answers multicast DNS queries on the interface for
+	// <hostname>.local of active leases, and announces new leases, for
+	// clients such as printers that run no responder of their own.
+	// Clients seen answering for themselves are left to do so.
+	MDNS bool `toml:"mdns"`
+
+	// DHCPv6 serves addresses to DHCPv6 clients on the interface as well.
+	DHCPv6 *DHCPv6 `toml:"dhcpv6"`
+
+	// RouterAdvertisement sends IPv6 Router Advertisements on the
+	// interface, in place of radvd.
+	RouterAdvertisement *RouterAdvertisement `toml:"router_advertisement"`
+}
+
+// RouterAdvertisement configures the Router Advertisements of a network.
+// Unset lifetimes and intervals default to those of RFC 4861.
+type RouterAdvertisement struct {
+	// Managed and Other set the M and O flags, which tell hosts to get
+	// addresses and other configuration, respectively, with DHCPv6. A
+	// stateless dhcpv6 server implies Other.
+	Managed bool `toml:"managed"`
+	Other   bool `toml:"other"`
+
+	// Prefixes are advertised as on-link. They default to the dhcpv6
+	// prefix, if any.
+	Prefixes []string `toml:"prefixes"`
+	// Autonomous lets hosts configure addresses in Prefixes with SLAAC.
+	// It defaults to true unless Managed is set.
+	Autonomous *bool `toml:"autonomous"`
+
+	// MaxInterval (default 600s) and MinInterval (default a third of it)
+	// bound the time between unsolicited advertisements.
+	MaxInterval time.Duration `toml:"max_interval"`
+	MinInterval time.Duration `toml:"min_interval"`
+
+	// RouterLifetime is how long hosts use the router as their default
+	// router; 0s advertises no default route. It defaults to three times
+	// MaxInterval.
+	RouterLifetime *time.Duration `toml:"router_lifetime"`
+
+	// PrefixValidLifetime and PrefixPreferredLifetime default to 30 days
+	// and 7 days.
+	PrefixValidLifetime     time.Duration `toml:"prefix_valid_lifetime"`
+	PrefixPreferredLifetime time.Duration `toml:"prefix_preferred_lifetime"`
+
+	// DNSServers and DomainSearch are advertised in RDNSS and DNSSL
+	// options, valid for DNSLifetime (default three times MaxInterval).
+	DNSServers   []string      `toml:"dns_servers"`
+	DomainSearch []string      `toml:"domain_search"`
+	DNSLifetime  time.Duration `toml:"dns_lifetime"`
+
+	// HopLimit (default 64) is the hop limit hosts should use, and MTU,
+	// if set, the link MTU.
+	HopLimit int `toml:"hop_limit"`
+	MTU      int `toml:"mtu"`
+}
+
+// DHCPv6 configures a stateful DHCPv6 server that assigns addresses with
+// IA_NA. Routers still need to advertise the prefix with the managed flag
+// set for clients to use it.
+type DHCPv6 struct {
+	// Stateless only answers Information-Request messages with the DNS
+	// options, for networks whose hosts configure their addresses with
+	// SLAAC. No addresses are assigned, so the address settings, lease
+	// file and static leases are not used.
+	Stateless bool `toml:"stateless"`
+
+	// Prefix is the on-link prefix, e.g. "fd00:1::/64".
+	Prefix  string `toml:"prefix"`
+	StartIP string `toml:"start_ip"`
+	Range   int    `toml:"range"`
+
+	// PreferredLifetime and ValidLifetime default to 1h and 2h.
+	PreferredLifetime time.Duration `toml:"preferred_lifetime"`
+	ValidLifetime     time.Duration `toml:"valid_lifetime"`
+
+	DNSServers   []string `toml:"dns_servers"`
+	DomainSearch []string `toml:"domain_search"`
+
+	// RapidCommit assigns addresses without an ADVERTISE and REQUEST to
+	// clients that ask for it. Only enable it if this is the only DHCPv6
+	// server on the link.
+	RapidCommit bool `toml:"rapid_commit"`
+
+	// LeaseFile stores the leases as JSON so that clients keep their
+	// addresses across restarts.
+	LeaseFile string `toml:"lease_file"`
+
+	StaticLeases []StaticLease6 `toml:"static_leases"`
+}
+
+// StaticLease6 assigns a fixed address to a DHCPv6 client, identified by
+// its DUID in hex, e.g. "00:03:00:01:aa:bb:cc:dd:ee:ff".
+type StaticLease6 struct {
+	DUID string `toml:"duid"`
+	Name string `toml:"name"`
+	IP   string `toml:"ip"`
 }
 
 type StaticLease struct {
 	MacAddress string `toml:"mac"`
 	Name       string `toml:"name"`
 	IP         string `toml:"ip"`
+
+	// Permanent leases are handed out with an infinite lease time and
+	// never expire.
+	Permanent bool `toml:"permanent,omitempty"`
+
+	// DNSServers override the DNS servers (option 6) of the network,
+	// class and option sets for this client.
+	DNSServers []string `toml:"dns_servers,omitempty"`
+}
+
+// Route is a classless static route to Destination, in CIDR notation,
+// through Gateway.
+type Route struct {
+	Destination string `toml:"destination"`
+	Gateway     string `toml:"gateway"`
 }
 
+// Class assigns clients matching VendorClass (option 60, prefix match),
+// UserClass (option 77) and/or tags a different pool, lease duration and/or
+// options.
+type Class struct {
+	Name          string        `toml:"name"`
+	VendorClass   string        `toml:"vendor_class"`
+	UserClass     string        `toml:"user_class"`
+	RequireTags   []string      `toml:"require_tags"`
+	ExcludeTags   []string      `toml:"exclude_tags"`
+	StartIP       string        `toml:"start_ip"`
+	Range         int           `toml:"range"`
+	LeaseDuration time.Duration `toml:"lease_duration"`
+	DNSServers    []string      `toml:"dns_servers"`
+	Options       []Option      `toml:"options"`
+}
+
+// RateLimit allows each client, identified by client identifier or hardware
+// address, Burst messages at once, refilled at Rate messages per second.
+type RateLimit struct {
+	Rate  float64 `toml:"rate"`
+	Burst int     `toml:"burst"`
+}
+
+// FlapDetection configures lease flapping alarms. Window defaults to 5m.
+type FlapDetection struct {
+	Threshold int           `toml:"threshold"`
+	Window    time.Duration `toml:"window"`
+}
+
+// SplitScope configures RFC 3074 load balancing between two servers.
+type SplitScope struct {
+	// Role is "primary", serving hash buckets [0, Split), or
+	// "secondary", serving [Split, 256).
+	Role string `toml:"role"`
+
+	// Split is the first bucket of the secondary, 128 by default for
+	// an even split.
+	Split int `toml:"split"`
+
+	// FailoverAfter answers clients of the peer that have been trying
+	// for this long (per their secs field), in case the peer is down.
+	// Disabled by default.
+	FailoverAfter time.Duration `toml:"failover_after"`
+}
+
+// DeviceLeaseDuration applies LeaseDuration to clients whose hardware
+// address starts with one of MACPrefixes or belongs to the built-in Profile.
+type DeviceLeaseDuration struct {
+	Profile       string        `toml:"profile"`
+	MACPrefixes   []string      `toml:"mac_prefixes"`
+	LeaseDuration time.Duration `toml:"lease_duration"`
+}
+
+// TagRule sets Tag on every client matching all of the non-empty criteria.
+type TagRule struct {
+	Tag         string `toml:"tag"`
+	MACPrefix   string `toml:"mac_prefix"`
+	VendorClass string `toml:"vendor_class"`
+	UserClass   string `toml:"user_class"`
+	Interface   string `toml:"interface"`
+	HasOption   int    `toml:"has_option"`
+}
+
+// VLAN is a VLAN of a trunk network, with its own pool and options. Its
+// leases are stored as those of the interface <interface>.<id>; all other
+// settings are those of the network.
+type VLAN struct {
+	ID int `toml:"id"`
+
+	// ServerIP is the address of the server on the VLAN, used as the
+	// server identifier and router. It need not be on any interface.
+	ServerIP string `toml:"server_ip"`
+
+	StartIP       string        `toml:"start_ip"`
+	Range         int           `toml:"range"`
+	NetMask       string        `toml:"net_mask"`
+	LeaseDuration time.Duration `toml:"lease_duration"` // default the network's
+	StaticLeases  []StaticLease `toml:"static_leases"`
+	DNSServers    []string      `toml:"dns_servers"`
+	OptionSets    []OptionSet   `toml:"option_sets"`
+}
+
+// OptionSet is a block of options sent to clients that have all of
+// RequireTags and none of ExcludeTags.
+type OptionSet struct {
+	RequireTags []string `toml:"require_tags"`
+	ExcludeTags []string `toml:"exclude_tags"`
+	DNSServers  []string `toml:"dns_servers"`
+	Options     []Option `toml:"options"`
+}
+
+// Option is a raw DHCP option. Exactly one of Value (text), IPs or Hex
+// should be set.
+type Option struct {
+	Code  int      `toml:"code"`
+	Value string   `toml:"value"`
+	IPs   []string `toml:"ips"`
+	Hex   string   `toml:"hex"`
+}
+
+// Load reads the config at path and the fragments in its include directory.
+// Files ending in .json, .yaml or .yml are parsed as JSON or YAML with the
+// same schema; anything else is TOML. In any string value "${NAME}" is
+// replaced by the environment variable NAME, and a value "@file:path" by
+// the contents of path.
 func Load(path string) (*Config, error) {
+	conf, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+	if conf.IncludeDir == "" {
+		return conf, nil
+	}
+
+	dir := conf.IncludeDir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(path), dir)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		switch strings.ToLower(filepath.Ext(e.Name())) {
+		case ".toml", ".json", ".yaml", ".yml":
+		default:
+			continue
+		}
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		fragPath := filepath.Join(dir, e.Name())
+		frag, err := load(fragPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := conf.merge(frag); err != nil {
+			return nil, fmt.Errorf("%s: %w", fragPath, err)
+		}
+	}
+	return conf, nil
+}
+
+// merge adds the networks and tags of the fragment frag to conf.
+func (conf *Config) merge(frag *Config) error {
+	rest := *frag
+	rest.Networks = nil
+	rest.Tags = nil
+	rest.ValueFiles = nil
+	if !reflect.DeepEqual(rest, Config{}) {
+		return fmt.Errorf("include files may only set networks and tags")
+	}
+	conf.Tags = append(conf.Tags, frag.Tags...)
+	conf.ValueFiles = append(conf.ValueFiles, frag.ValueFiles...)
+
+	for _, n := range frag.Networks {
+		i := slices.IndexFunc(conf.Networks, func(c Network) bool {
+			return c.Interface == n.Interface
+		})
+		if i < 0 {
+			conf.Networks = append(conf.Networks, n)
+			continue
+		}
+		extra := n
+		extra.Interface = ""
+		extra.StaticLeases = nil
+		if !reflect.DeepEqual(extra, Network{}) {
+			return fmt.Errorf("network %s is already configured; only static_leases may be added to it", n.Interface)
+		}
+		conf.Networks[i].StaticLeases = append(conf.Networks[i].StaticLeases, n.StaticLeases...)
+	}
+	return nil
+}
+
+func load(path string) (*Config, error) {
 	tml, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
+	var doc map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		doc, err = parseJSON(tml)
+	case ".yaml", ".yml":
+		doc, err = parseYAML(tml)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if doc != nil {
+		// Re-encode as TOML so that every format is decoded by the same
+		// rules, including durations written as strings.
+		var buf bytes.Buffer
+		if err := toml.NewEncoder(&buf).Encode(doc); err != nil {
+			return nil, err
+		}
+		tml = buf.Bytes()
+	}
+
 	var conf Config
 	err = toml.Unmarshal(tml, &conf)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := expandValues(&conf, filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
 	return &conf, nil
 }
+
+// parseJSON decodes a JSON object, converting numbers to int64 or float64
+// for the TOML encoder.
+func parseJSON(b []byte) (map[string]any, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var doc map[string]any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return convertJSONNumbers(doc).(map[string]any), nil
+}
+
+func convertJSONNumbers(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for k, e := range v {
+			v[k] = convertJSONNumbers(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = convertJSONNumbers(e)
+		}
+	}
+	return v
+}
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIncludeDir(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("dhcpeterd.toml", `
+include_dir = "conf.d"
+
+[[networks]]
+interface = "eth0"
+start_ip = "192.168.1.100"
+range = 100
+
+[[networks.static_leases]]
+mac = "aa:bb:cc:dd:ee:01"
+ip = "192.168.1.10"
+`)
+	write("conf.d/10-vlan20.toml", `
+[[networks]]
+interface = "eth0.20"
+start_ip = "192.168.20.100"
+range = 50
+`)
+	write("conf.d/20-eth0.yaml", `
+networks:
+  - interface: eth0
+    static_leases:
+      - {mac: "aa:bb:cc:dd:ee:02", ip: 192.168.1.11}
+`)
+	write("conf.d/README", "not a config")
+
+	conf, err := Load(filepath.Join(dir, "dhcpeterd.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Networks) != 2 || conf.Networks[1].Interface != "eth0.20" || conf.Networks[1].Range != 50 {
+		t.Fatalf("networks = %+v", conf.Networks)
+	}
+	if sl := conf.Networks[0].StaticLeases; len(sl) != 2 || sl[1].IP != "192.168.1.11" {
+		t.Errorf("eth0 static leases = %+v", sl)
+	}
+
+	write("conf.d/30-bad.toml", `
+[[networks]]
+interface = "eth0"
+range = 10
+`)
+	if _, err := Load(filepath.Join(dir, "dhcpeterd.toml")); err == nil || !strings.Contains(err.Error(), "already configured") {
+		t.Errorf("redefining a network: err = %v", err)
+	}
+}
+
+func TestExpandValues(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "token"), []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DHCPETERD_TEST_DNS", "10.0.0.53")
+	t.Setenv("DHCPETERD_TEST_SITE", "nyc")
+
+	conf := Config{
+		HTTPListen: "literal $${HOME}",
+		APITokens:  []APIToken{{Token: "@file:token"}},
+		Webhook:    &Webhook{URL: "https://${DHCPETERD_TEST_SITE}.example.com/hook"},
+		Tracing:    &Tracing{Headers: map[string]string{"x-site": "${DHCPETERD_TEST_SITE}"}},
+		Networks:   []Network{{DNSServers: []string{"${DHCPETERD_TEST_DNS}", "1.1.1.1"}}},
+	}
+	if err := expandValues(&conf, dir); err != nil {
+		t.Fatal(err)
+	}
+	if conf.HTTPListen != "literal ${HOME}" {
+		t.Errorf("escaped value = %q", conf.HTTPListen)
+	}
+	if conf.APITokens[0].Token != "s3cret" {
+		t.Errorf("file value = %q", conf.APITokens[0].Token)
+	}
+	if want := filepath.Join(dir, "token"); len(conf.ValueFiles) != 1 || conf.ValueFiles[0] != want {
+		t.Errorf("value files = %q, want [%q]", conf.ValueFiles, want)
+	}
+	if conf.Webhook.URL != "https://nyc.example.com/hook" || conf.Tracing.Headers["x-site"] != "nyc" {
+		t.Errorf("env values = %q, %q", conf.Webhook.URL, conf.Tracing.Headers["x-site"])
+	}
+	if dns := conf.Networks[0].DNSServers; dns[0] != "10.0.0.53" || dns[1] != "1.1.1.1" {
+		t.Errorf("dns servers = %q", dns)
+	}
+
+	conf = Config{LeaseFile: "${DHCPETERD_TEST_UNSET}"}
+	if err := expandValues(&conf, dir); err == nil {
+		t.Error("expanding an unset variable succeeded")
+	}
+}
@@ -0,0 +1,116 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// expandValues expands references in every string value of conf:
+// "${NAME}" is replaced by the environment variable NAME and a value of the
+// form "@file:path" by the contents of path, without trailing newlines.
+// Relative paths are relative to dir. "$${" is a literal "${". The files
+// read are added to conf.ValueFiles.
+func expandValues(conf *Config, dir string) error {
+	e := expander{dir: dir}
+	if err := e.value(reflect.ValueOf(conf).Elem()); err != nil {
+		return err
+	}
+	conf.ValueFiles = append(conf.ValueFiles, e.files...)
+	return nil
+}
+
+// expander expands the values of a config loaded from dir.
+type expander struct {
+	dir   string
+	files []string
+}
+
+func (e *expander) value(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.String:
+		s, err := e.string(v.String())
+		if err != nil {
+			return err
+		}
+		v.SetString(s)
+	case reflect.Pointer:
+		if !v.IsNil() {
+			return e.value(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if err := e.value(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := e.value(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			// Map values are not addressable, so expand a copy.
+			elem := reflect.New(iter.Value().Type()).Elem()
+			elem.Set(iter.Value())
+			if err := e.value(elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(iter.Key(), elem)
+		}
+	}
+	return nil
+}
+
+func (e *expander) string(s string) (string, error) {
+	if path, ok := strings.CutPrefix(s, "@file:"); ok {
+		path, err := e.string(path)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(e.dir, path)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		e.files = append(e.files, path)
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			b.WriteString(s[:i-1])
+			b.WriteString("${")
+			s = s[i+2:]
+			continue
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated ${ in %q", s)
+		}
+		name := s[i+2 : i+end]
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		b.WriteString(s[:i])
+		b.WriteString(val)
+		s = s[i+end+1:]
+	}
+}
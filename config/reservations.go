@@ -0,0 +1,84 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Reservations is the format of the reservations file, which holds static
+// leases created at runtime. It uses the same layout as the networks
+// section of the main config.
+type Reservations struct {
+	Networks []ReservedNetwork `toml:"networks"`
+}
+
+type ReservedNetwork struct {
+	Interface    string        `toml:"interface"`
+	StaticLeases []StaticLease `toml:"static_leases"`
+}
+
+// LoadReservations reads the reservations file at path. A missing file is
+// not an error.
+func LoadReservations(path string) (*Reservations, error) {
+	var r Reservations
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &r, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := toml.Unmarshal(b, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// ForInterface returns the reservations for iface.
+func (r *Reservations) ForInterface(iface string) []StaticLease {
+	var leases []StaticLease
+	for _, n := range r.Networks {
+		if n.Interface == iface {
+			leases = append(leases, n.StaticLeases...)
+		}
+	}
+	return leases
+}
+
+// Add appends sl to the reservations for iface.
+func (r *Reservations) Add(iface string, sl StaticLease) {
+	for i := range r.Networks {
+		if r.Networks[i].Interface == iface {
+			r.Networks[i].StaticLeases = append(r.Networks[i].StaticLeases, sl)
+			return
+		}
+	}
+	r.Networks = append(r.Networks, ReservedNetwork{
+		Interface:    iface,
+		StaticLeases: []StaticLease{sl},
+	})
+}
+
+// Write atomically replaces the file at path with r.
+func (r *Reservations) Write(path string) error {
+	var buf bytes.Buffer
+	buf.WriteString("# Static leases created at runtime by dhcpeterd.\n\n")
+	if err := toml.NewEncoder(&buf).Encode(r); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".reservations")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,442 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseYAML parses the subset of YAML used for configs: block mappings and
+// sequences, flow sequences and mappings, quoted and plain scalars, and
+// comments. Anchors, tags and multi-line scalars are not supported.
+func parseYAML(b []byte) (map[string]any, error) {
+	p := &yamlParser{}
+	for i, raw := range strings.Split(string(b), "\n") {
+		text := strings.TrimRight(stripYAMLComment(strings.TrimRight(raw, "\r")), " \t")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("yaml line %d: tabs are not allowed for indentation", i+1)
+		}
+		if trimmed == "..." {
+			break
+		}
+		p.lines = append(p.lines, yamlLine{num: i + 1, indent: len(text) - len(trimmed), text: trimmed})
+	}
+	if len(p.lines) == 0 {
+		return map[string]any{}, nil
+	}
+
+	v, err := p.block(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, p.errorf("unexpected indentation")
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("yaml: top level must be a mapping")
+	}
+	return m, nil
+}
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func (p *yamlParser) errorf(format string, args ...any) error {
+	line := p.lines[len(p.lines)-1].num
+	if p.pos < len(p.lines) {
+		line = p.lines[p.pos].num
+	}
+	return fmt.Errorf("yaml line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+// block parses the mapping or sequence starting at the current line, whose
+// entries are indented by indent.
+func (p *yamlParser) block(indent int) (any, error) {
+	if isYAMLSeqItem(p.lines[p.pos].text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+// nested parses the value of a key or sequence item that is written on the
+// following lines, which must be indented more than indent. A sequence may
+// also be written at the same indentation as its key when allowSeq is set.
+func (p *yamlParser) nested(indent int, allowSeq bool) (any, error) {
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	next := p.lines[p.pos]
+	switch {
+	case next.indent > indent:
+		return p.block(next.indent)
+	case next.indent == indent && allowSeq && isYAMLSeqItem(next.text):
+		return p.sequence(indent)
+	}
+	return nil, nil
+}
+
+func (p *yamlParser) mapping(indent int) (map[string]any, error) {
+	m := make(map[string]any)
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, p.errorf("unexpected indentation")
+		}
+		if isYAMLSeqItem(l.text) {
+			return nil, p.errorf("unexpected sequence item in mapping")
+		}
+		k, rest, ok := splitYAMLKey(l.text)
+		if !ok {
+			return nil, p.errorf("expected key: value, got %q", l.text)
+		}
+		key, err := yamlKey(k)
+		if err != nil {
+			return nil, p.errorf("%s", err)
+		}
+		if _, dup := m[key]; dup {
+			return nil, p.errorf("duplicate key %q", key)
+		}
+
+		var v any
+		if rest == "" {
+			p.pos++
+			v, err = p.nested(indent, true)
+		} else {
+			v, err = parseYAMLValue(rest)
+			if err != nil {
+				err = p.errorf("%s", err)
+			}
+			p.pos++
+		}
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+func (p *yamlParser) sequence(indent int) ([]any, error) {
+	var seq []any
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent || (l.indent == indent && !isYAMLSeqItem(l.text)) {
+			break
+		}
+		if l.indent > indent {
+			return nil, p.errorf("unexpected indentation")
+		}
+		rest := strings.TrimLeft(l.text[1:], " ")
+		if rest == "" {
+			p.pos++
+			v, err := p.nested(indent, false)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+			continue
+		}
+
+		if _, _, ok := splitYAMLKey(rest); ok || isYAMLSeqItem(rest) {
+			// A mapping or sequence starting on the same line as the
+			// dash; its entries are aligned with the first one.
+			p.lines[p.pos] = yamlLine{num: l.num, indent: indent + len(l.text) - len(rest), text: rest}
+			v, err := p.block(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+			continue
+		}
+
+		v, err := parseYAMLValue(rest)
+		if err != nil {
+			return nil, p.errorf("%s", err)
+		}
+		seq = append(seq, v)
+		p.pos++
+	}
+	return seq, nil
+}
+
+func isYAMLSeqItem(s string) bool {
+	return s == "-" || strings.HasPrefix(s, "- ")
+}
+
+// splitYAMLKey splits "key: value" at the first colon outside quotes and
+// flow collections that is followed by a space or ends the line.
+func splitYAMLKey(s string) (key, value string, ok bool) {
+	if s == "" || s[0] == '[' || s[0] == '{' {
+		return "", "", false
+	}
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && i == 0:
+			quote = c
+		case c == ':' && (i+1 == len(s) || s[i+1] == ' '):
+			return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+func yamlKey(s string) (string, error) {
+	v, err := parseYAMLValue(s)
+	if err != nil {
+		return "", err
+	}
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case map[string]any, []any:
+		return "", fmt.Errorf("unsupported key %q", s)
+	default:
+		return s, nil
+	}
+}
+
+// stripYAMLComment removes a trailing comment from s. Comments start with a
+// '#' at the start of the line or after whitespace, outside quotes.
+func stripYAMLComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || strings.ContainsRune(" \t:[{,-", rune(s[i-1])) {
+				quote = c
+			}
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// parseYAMLValue parses a value written on a single line.
+func parseYAMLValue(s string) (any, error) {
+	f := &yamlFlow{s: s}
+	v, err := f.value(false)
+	if err != nil {
+		return nil, err
+	}
+	f.skipSpace()
+	if f.pos < len(f.s) {
+		return nil, fmt.Errorf("unexpected %q after value", f.s[f.pos:])
+	}
+	return v, nil
+}
+
+// yamlFlow scans scalars and flow collections.
+type yamlFlow struct {
+	s   string
+	pos int
+}
+
+func (f *yamlFlow) skipSpace() {
+	for f.pos < len(f.s) && (f.s[f.pos] == ' ' || f.s[f.pos] == '\t') {
+		f.pos++
+	}
+}
+
+// value parses the value at the current position. Within a flow collection
+// plain scalars end at ',', ']', '}' and, for keys, ':'.
+func (f *yamlFlow) value(inFlow bool) (any, error) {
+	f.skipSpace()
+	if f.pos >= len(f.s) {
+		return nil, nil
+	}
+	switch f.s[f.pos] {
+	case '[':
+		return f.sequence()
+	case '{':
+		return f.mapping()
+	case '"', '\'':
+		return f.quoted()
+	case '&', '*', '!', '|', '>':
+		return nil, fmt.Errorf("unsupported yaml syntax %q", f.s[f.pos:])
+	}
+	start := f.pos
+	if inFlow {
+		for f.pos < len(f.s) && !strings.ContainsRune(",]}", rune(f.s[f.pos])) {
+			if f.s[f.pos] == ':' && (f.pos+1 == len(f.s) || strings.ContainsRune(" ,]}", rune(f.s[f.pos+1]))) {
+				break
+			}
+			f.pos++
+		}
+	} else {
+		f.pos = len(f.s)
+	}
+	return yamlScalar(strings.TrimSpace(f.s[start:f.pos])), nil
+}
+
+func (f *yamlFlow) quoted() (string, error) {
+	q := f.s[f.pos]
+	var b strings.Builder
+	for i := f.pos + 1; i < len(f.s); i++ {
+		c := f.s[i]
+		switch {
+		case q == '\'' && c == '\'':
+			if i+1 < len(f.s) && f.s[i+1] == '\'' {
+				b.WriteByte('\'')
+				i++
+				continue
+			}
+			f.pos = i + 1
+			return b.String(), nil
+		case q == '"' && c == '\\':
+			if i+1 == len(f.s) {
+				return "", fmt.Errorf("unterminated string %s", f.s[f.pos:])
+			}
+			i++
+			switch e := f.s[i]; e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '0':
+				b.WriteByte(0)
+			case '"', '\\', '/':
+				b.WriteByte(e)
+			default:
+				return "", fmt.Errorf("unsupported escape \\%c", e)
+			}
+		case q == '"' && c == '"':
+			f.pos = i + 1
+			return b.String(), nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated string %s", f.s[f.pos:])
+}
+
+func (f *yamlFlow) sequence() ([]any, error) {
+	f.pos++ // [
+	seq := []any{}
+	for {
+		f.skipSpace()
+		if f.pos < len(f.s) && f.s[f.pos] == ']' {
+			f.pos++
+			return seq, nil
+		}
+		v, err := f.value(true)
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, v)
+		if err := f.separator(']'); err != nil {
+			return nil, err
+		}
+		if f.s[f.pos-1] == ']' {
+			return seq, nil
+		}
+	}
+}
+
+func (f *yamlFlow) mapping() (map[string]any, error) {
+	f.pos++ // {
+	m := make(map[string]any)
+	for {
+		f.skipSpace()
+		if f.pos < len(f.s) && f.s[f.pos] == '}' {
+			f.pos++
+			return m, nil
+		}
+		k, err := f.value(true)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			key = fmt.Sprint(k)
+		}
+		f.skipSpace()
+		if f.pos >= len(f.s) || f.s[f.pos] != ':' {
+			return nil, fmt.Errorf("expected ':' after key %q", key)
+		}
+		f.pos++
+		v, err := f.value(true)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+		if err := f.separator('}'); err != nil {
+			return nil, err
+		}
+		if f.s[f.pos-1] == '}' {
+			return m, nil
+		}
+	}
+}
+
+// separator consumes the ',' between flow entries or the closing bracket.
+func (f *yamlFlow) separator(end byte) error {
+	f.skipSpace()
+	if f.pos >= len(f.s) {
+		return fmt.Errorf("missing %q", end)
+	}
+	if c := f.s[f.pos]; c != ',' && c != end {
+		return fmt.Errorf("expected ',' or %q, got %q", end, f.s[f.pos:])
+	}
+	f.pos++
+	return nil
+}
+
+// yamlScalar resolves the type of a plain scalar.
+func yamlScalar(s string) any {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n
+	}
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0o") {
+		if n, err := strconv.ParseInt(s, 0, 64); err == nil {
+			return n
+		}
+	}
+	if strings.ContainsAny(s, "0123456789") {
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	}
+	return s
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	doc := `
+# dhcpeterd config
+lease_file: /var/lib/dhcpeterd/leases.json
+http_listen: "127.0.0.1:8067"
+tags:
+- tag: printers
+  mac_prefix: "00:1b:a9"
+networks:
+  - interface: eth0 # lan
+    start_ip: 192.168.1.100
+    range: 100
+    lease_duration: 12h
+    dns_servers: [1.1.1.1, '8.8.8.8']
+    dynamic: true
+    pool_warning_threshold: 90.5
+    static_leases:
+      - {mac: "aa:bb:cc:dd:ee:ff", name: nas, ip: 192.168.1.10}
+    rate_limit:
+      rate: 2
+      burst:
+`
+	got, err := parseYAML([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"lease_file":  "/var/lib/dhcpeterd/leases.json",
+		"http_listen": "127.0.0.1:8067",
+		"tags": []any{
+			map[string]any{"tag": "printers", "mac_prefix": "00:1b:a9"},
+		},
+		"networks": []any{
+			map[string]any{
+				"interface":              "eth0",
+				"start_ip":               "192.168.1.100",
+				"range":                  int64(100),
+				"lease_duration":         "12h",
+				"dns_servers":            []any{"1.1.1.1", "8.8.8.8"},
+				"dynamic":                true,
+				"pool_warning_threshold": 90.5,
+				"static_leases": []any{
+					map[string]any{"mac": "aa:bb:cc:dd:ee:ff", "name": "nas", "ip": "192.168.1.10"},
+				},
+				"rate_limit": map[string]any{"rate": int64(2), "burst": nil},
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %#v\nwant %#v", got, want)
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	for _, doc := range []string{
+		"a: 1\n  b: 2\n",
+		"a: 1\na: 2\n",
+		"a: [1, 2\n",
+		"a: \"open\n",
+		"a: &anchor 1\n",
+		"- 1\n- 2\n",
+		"just text\n",
+	} {
+		if _, err := parseYAML([]byte(doc)); err == nil {
+			t.Errorf("parseYAML(%q) succeeded, want error", doc)
+		}
+	}
+}
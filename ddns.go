@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+	"github.com/psanford/dhcpeterd/internal/dns"
+)
+
+// errDDNSConflict is returned when a name is registered by another client.
+var errDDNSConflict = errors.New("name is registered by another client")
+
+// ddnsUpdater registers the hostnames of leases in DNS with dynamic
+// updates. Updates are sent one at a time in the order the events occurred.
+type ddnsUpdater struct {
+	conf   config.DDNS
+	server string
+	key    *dns.TSIG
+	events chan ifaceEvent
+
+	// registered are the records added for each hardware address.
+	registered map[string]ddnsRecord
+}
+
+type ddnsRecord struct {
+	name    string
+	ip      net.IP
+	dhcid   []byte
+	forward bool // the A record is ours to update, not the client's
+}
+
+func newDDNSUpdater(conf *config.DDNS) (*ddnsUpdater, error) {
+	if conf.Server == "" || conf.ForwardZone == "" {
+		return nil, fmt.Errorf("ddns requires server and forward_zone")
+	}
+	u := &ddnsUpdater{
+		conf:       *conf,
+		server:     conf.Server,
+		events:     make(chan ifaceEvent, 128),
+		registered: make(map[string]ddnsRecord),
+	}
+	if _, _, err := net.SplitHostPort(u.server); err != nil {
+		u.server = net.JoinHostPort(u.server, "53")
+	}
+	if u.conf.TTL == 0 {
+		u.conf.TTL = 5 * time.Minute
+	}
+	if conf.KeyName != "" {
+		secret, err := base64.StdEncoding.DecodeString(conf.KeySecret)
+		if err != nil {
+			return nil, fmt.Errorf("ddns key_secret: %w", err)
+		}
+		u.key = &dns.TSIG{Name: conf.KeyName, Algorithm: conf.KeyAlgorithm, Secret: secret}
+		if u.key.Algorithm == "" {
+			u.key.Algorithm = "hmac-sha256"
+		}
+		if err := u.key.Check(); err != nil {
+			return nil, fmt.Errorf("ddns: %w", err)
+		}
+	}
+	return u, nil
+}
+
+func (u *ddnsUpdater) send(iface string, ev dhcp4d.Event) {
+	switch ev.Type {
+	case dhcp4d.EventAdd, dhcp4d.EventOld, dhcp4d.EventRelease, dhcp4d.EventExpire:
+	default:
+		return
+	}
+	select {
+	case u.events <- ifaceEvent{iface: iface, ev: ev}:
+	default:
+		slog.Error("ddns queue full, dropping event", "type", ev.Type, "hw", ev.Lease.HardwareAddr)
+	}
+}
+
+func (u *ddnsUpdater) loop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-u.events:
+			u.apply(ctx, e.ev)
+		}
+	}
+}
+
+func (u *ddnsUpdater) apply(ctx context.Context, ev dhcp4d.Event) {
+	l := ev.Lease
+	prev, registered := u.registered[l.HardwareAddr]
+	rec, ok := u.record(l)
+	switch ev.Type {
+	case dhcp4d.EventAdd, dhcp4d.EventOld:
+		if registered && ok && prev.name == rec.name && prev.ip.Equal(rec.ip) && prev.forward == rec.forward {
+			return
+		}
+		if registered {
+			u.remove(ctx, prev)
+			delete(u.registered, l.HardwareAddr)
+		}
+		if !ok {
+			return
+		}
+		if err := u.add(ctx, rec); err != nil {
+			slog.Error("ddns update err", "name", rec.name, "ip", rec.ip, "hw", l.HardwareAddr, "err", err)
+			return
+		}
+		u.registered[l.HardwareAddr] = rec
+		slog.Info("ddns registered", "name", rec.name, "ip", rec.ip, "hw", l.HardwareAddr)
+
+	case dhcp4d.EventRelease, dhcp4d.EventExpire:
+		if registered && prev.ip.Equal(l.Addr) {
+			rec, ok = prev, true
+			delete(u.registered, l.HardwareAddr)
+		}
+		if ok {
+			// Records registered before a restart are removed too; the
+			// DHCID prerequisite keeps other clients' names intact.
+			u.remove(ctx, rec)
+		}
+	}
+}
+
+// record returns the records of l, if it has a usable hostname and did not
+// ask for no updates with the Client FQDN option. Clients that update their
+// own A record only get a PTR record, for the name they sent.
+func (u *ddnsUpdater) record(l dhcp4d.Lease) (ddnsRecord, bool) {
+	if l.DNSUpdate == dhcp4d.DNSUpdateNone || l.Addr.To4() == nil {
+		return ddnsRecord{}, false
+	}
+	if l.DNSUpdate == dhcp4d.DNSUpdateClient && l.FQDN != "" {
+		return ddnsRecord{name: l.FQDN, ip: l.Addr.To4()}, true
+	}
+	host := strings.ToLower(l.Hostname)
+	if !validLabel(host) {
+		return ddnsRecord{}, false
+	}
+	name := host + "." + strings.TrimSuffix(u.conf.ForwardZone, ".")
+	return ddnsRecord{name: name, ip: l.Addr.To4(), dhcid: dhcid(l, name), forward: true}, true
+}
+
+// add registers the records of rec.
+func (u *ddnsUpdater) add(ctx context.Context, rec ddnsRecord) error {
+	ttl := uint32(u.conf.TTL / time.Second)
+	if rec.forward {
+		if err := u.addForward(ctx, rec, ttl); err != nil {
+			return err
+		}
+	}
+
+	ptr, ok := u.ptrName(rec.ip)
+	if !ok {
+		return nil
+	}
+	data, err := dns.NameData(rec.name)
+	if err != nil {
+		return err
+	}
+	rcode, err := u.update(ctx, u.conf.ReverseZone, nil, []dns.RR{
+		{Name: ptr, Type: dns.TypePTR, Class: dns.ClassANY},
+		{Name: ptr, Type: dns.TypePTR, Class: dns.ClassINET, TTL: ttl, Data: data},
+	})
+	if err != nil {
+		return err
+	}
+	if rcode != dns.RCodeSuccess {
+		return fmt.Errorf("reverse update: %s", dns.RCodeString(rcode))
+	}
+	return nil
+}
+
+// addForward registers the A record of rec following RFC 4703: the name is
+// claimed if unused, or updated if its DHCID shows that it belongs to the
+// same client.
+func (u *ddnsUpdater) addForward(ctx context.Context, rec ddnsRecord, ttl uint32) error {
+	a := dns.RR{Name: rec.name, Type: dns.TypeA, Class: dns.ClassINET, TTL: ttl, Data: rec.ip}
+	id := dns.RR{Name: rec.name, Type: dns.TypeDHCID, Class: dns.ClassINET, TTL: ttl, Data: rec.dhcid}
+
+	rcode, err := u.update(ctx, u.conf.ForwardZone,
+		[]dns.RR{{Name: rec.name, Type: dns.TypeANY, Class: dns.ClassNONE}},
+		[]dns.RR{a, id})
+	if err != nil {
+		return err
+	}
+	if rcode == dns.RCodeYXDomain {
+		rcode, err = u.update(ctx, u.conf.ForwardZone,
+			[]dns.RR{{Name: rec.name, Type: dns.TypeDHCID, Class: dns.ClassINET, Data: rec.dhcid}},
+			[]dns.RR{{Name: rec.name, Type: dns.TypeA, Class: dns.ClassANY}, a})
+		if err != nil {
+			return err
+		}
+		if rcode == dns.RCodeNXRRSet {
+			return errDDNSConflict
+		}
+	}
+	if rcode != dns.RCodeSuccess {
+		return fmt.Errorf("forward update: %s", dns.RCodeString(rcode))
+	}
+	return nil
+}
+
+// remove removes the records of rec. The A record is only removed if the
+// name still belongs to its client.
+func (u *ddnsUpdater) remove(ctx context.Context, rec ddnsRecord) {
+	if rec.forward {
+		u.removeForward(ctx, rec)
+	}
+
+	ptr, ok := u.ptrName(rec.ip)
+	if !ok {
+		return
+	}
+	data, err := dns.NameData(rec.name)
+	if err != nil {
+		return
+	}
+	// Only the PTR record pointing at the name.
+	rcode, err := u.update(ctx, u.conf.ReverseZone, nil, []dns.RR{
+		{Name: ptr, Type: dns.TypePTR, Class: dns.ClassNONE, Data: data},
+	})
+	if err != nil || rcode != dns.RCodeSuccess {
+		slog.Error("ddns remove ptr err", "ptr", ptr, "err", err, "rcode", dns.RCodeString(rcode))
+	}
+}
+
+func (u *ddnsUpdater) removeForward(ctx context.Context, rec ddnsRecord) {
+	rcode, err := u.update(ctx, u.conf.ForwardZone,
+		[]dns.RR{{Name: rec.name, Type: dns.TypeDHCID, Class: dns.ClassINET, Data: rec.dhcid}},
+		[]dns.RR{
+			{Name: rec.name, Type: dns.TypeA, Class: dns.ClassANY},
+			{Name: rec.name, Type: dns.TypeDHCID, Class: dns.ClassANY},
+		})
+	switch {
+	case err != nil:
+		slog.Error("ddns remove err", "name", rec.name, "ip", rec.ip, "err", err)
+	case rcode == dns.RCodeSuccess:
+		slog.Info("ddns removed", "name", rec.name, "ip", rec.ip)
+	case rcode == dns.RCodeNXRRSet || rcode == dns.RCodeNXDomain:
+		slog.Debug("ddns name not registered by client", "name", rec.name)
+	default:
+		slog.Error("ddns remove err", "name", rec.name, "ip", rec.ip, "err", dns.RCodeString(rcode))
+	}
+}
+
+// ptrName returns the reverse name of ip if it is in the reverse zone.
+func (u *ddnsUpdater) ptrName(ip net.IP) (string, bool) {
+	name := dns.ReverseName(ip)
+	return name, u.conf.ReverseZone != "" && dns.InZone(name, u.conf.ReverseZone)
+}
+
+// update sends an update of zone and returns the response code.
+func (u *ddnsUpdater) update(ctx context.Context, zone string, prereqs, updates []dns.RR) (int, error) {
+	m := &dns.Message{
+		Header:      dns.Header{ID: uint16(rand.Intn(1 << 16)), Opcode: dns.OpcodeUpdate},
+		Questions:   []dns.Question{{Name: zone, Type: dns.TypeSOA, Class: dns.ClassINET}},
+		Answers:     prereqs,
+		Authorities: updates,
+	}
+	msg, err := m.Pack()
+	if err != nil {
+		return 0, err
+	}
+	var mac []byte
+	if u.key != nil {
+		if msg, mac, err = u.key.Sign(msg, time.Now()); err != nil {
+			return 0, err
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	b, err := dns.Exchange(ctx, u.server, msg)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := dns.Unpack(b)
+	if err != nil {
+		return 0, err
+	}
+	if u.key != nil {
+		if err := u.key.Verify(b, mac, time.Now()); err != nil {
+			return 0, fmt.Errorf("%s: %w", dns.RCodeString(resp.RCode), err)
+		}
+	}
+	return resp.RCode, nil
+}
+
+// dhcid returns the RDATA of the DHCID record (RFC 4701) identifying the
+// client of l as the owner of name.
+func dhcid(l dhcp4d.Lease, name string) []byte {
+	var idType uint16
+	var id []byte
+	if cid, err := hex.DecodeString(l.ClientID); err == nil && len(cid) > 0 {
+		idType, id = 1, cid
+	} else if hw, err := net.ParseMAC(l.HardwareAddr); err == nil {
+		id = append([]byte{1}, hw...) // htype Ethernet
+	}
+	wire, _ := dns.AppendName(nil, strings.ToLower(name))
+	sum := sha256.Sum256(append(id, wire...))
+	b := binary.BigEndian.AppendUint16(nil, idType)
+	b = append(b, 1) // SHA-256
+	return append(b, sum[:]...)
+}
+
+// validLabel reports whether s is a valid hostname label.
+func validLabel(s string) bool {
+	if s == "" || len(s) > 63 || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
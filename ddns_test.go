@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+	"github.com/psanford/dhcpeterd/internal/dns"
+)
+
+// dnsRecorder is a DNS server that accepts every update and passes it on.
+func dnsRecorder(t *testing.T) (addr string, updates <-chan *dns.Message) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	ch := make(chan *dns.Message, 16)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			m, err := dns.Unpack(buf[:n])
+			if err != nil {
+				continue
+			}
+			ch <- m
+			resp := &dns.Message{
+				Header:    dns.Header{ID: m.ID, Response: true, Opcode: m.Opcode},
+				Questions: m.Questions,
+			}
+			b, err := resp.Pack()
+			if err != nil {
+				continue
+			}
+			pc.WriteTo(b, from)
+		}
+	}()
+	return pc.LocalAddr().String(), ch
+}
+
+func TestDDNSLeaseExpiry(t *testing.T) {
+	server, updates := dnsRecorder(t)
+	u, err := newDDNSUpdater(&config.DDNS{Server: server, ForwardZone: "lan.example."})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iface := &net.Interface{HardwareAddr: net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}}
+	const leasePeriod = 500 * time.Millisecond
+	h, err := dhcp4d.NewHandler(iface, net.IPv4(192, 168, 42, 1), net.IPv4(192, 168, 42, 2), net.IP{255, 255, 255, 0}, 100, leasePeriod, nil, nil, dhcp4d.WithUDP())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Events = func(ev dhcp4d.Event) { u.send("eth0", ev) }
+	ctx := context.Background()
+	// apply applies the next event of h, which must be of type want.
+	apply := func(want dhcp4d.EventType) {
+		t.Helper()
+		select {
+		case e := <-u.events:
+			if e.ev.Type != want {
+				t.Fatalf("got %s event, want %s", e.ev.Type, want)
+			}
+			u.apply(ctx, e.ev)
+		default:
+			t.Fatalf("no %s event", want)
+		}
+	}
+	// update returns the next update received by the server.
+	update := func() *dns.Message {
+		t.Helper()
+		select {
+		case m := <-updates:
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatal("no update received")
+			return nil
+		}
+	}
+
+	addr := net.IP{192, 168, 42, 10}
+	p := dhcp4.RequestPacket(dhcp4.Request, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}, addr, []byte{1, 2, 3, 4}, false, []dhcp4.Option{
+		{Code: dhcp4.OptionHostName, Value: []byte("laptop")},
+	})
+	reply := h.ServeDHCP(p, dhcp4.Request, p.ParseOptions())
+	if reply == nil || reply.ParseOptions()[dhcp4.OptionDHCPMessageType][0] != byte(dhcp4.ACK) {
+		t.Fatal("DHCPREQUEST was not acknowledged")
+	}
+	apply(dhcp4d.EventAdd)
+	if m := update(); len(m.Authorities) == 0 || m.Authorities[0].Name != "laptop.lan.example" || m.Authorities[0].Type != dns.TypeA {
+		t.Fatalf("add update %+v, want the A record of laptop.lan.example", m.Authorities)
+	}
+
+	// The client leaves without releasing its lease.
+	h.ExpireLeases()
+	if len(u.events) != 0 {
+		t.Fatal("event before the lease expired")
+	}
+	time.Sleep(leasePeriod + 100*time.Millisecond)
+	h.ExpireLeases()
+	apply(dhcp4d.EventExpire)
+	m := update()
+	if len(m.Authorities) == 0 || m.Authorities[0].Type != dns.TypeA || m.Authorities[0].Class != dns.ClassANY {
+		t.Fatalf("expiry update %+v, want the A record deleted", m.Authorities)
+	}
+	if _, ok := u.registered["aa:bb:cc:dd:ee:ff"]; ok {
+		t.Error("expired lease is still registered")
+	}
+}
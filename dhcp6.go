@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp6d"
+)
+
+// newDHCP6Handler returns the DHCPv6 handler of conf, identified by the
+// DUID-LL of the interface's hardware address hw.
+func newDHCP6Handler(conf *config.DHCPv6, hw net.HardwareAddr) (*dhcp6d.Handler, error) {
+	var dnsServers []net.IP
+	for _, s := range conf.DNSServers {
+		ip := net.ParseIP(s)
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("dhcpv6: invalid dns server %q", s)
+		}
+		dnsServers = append(dnsServers, ip)
+	}
+	opts := []dhcp6d.HandlerOption{}
+	if len(dnsServers) > 0 || len(conf.DomainSearch) > 0 {
+		opts = append(opts, dhcp6d.WithDNS(dnsServers, conf.DomainSearch))
+	}
+	if conf.Stateless {
+		if len(opts) == 0 {
+			return nil, fmt.Errorf("dhcpv6: stateless mode requires dns_servers or domain_search")
+		}
+		if len(conf.StaticLeases) > 0 || conf.LeaseFile != "" {
+			return nil, fmt.Errorf("dhcpv6: stateless mode assigns no addresses; remove static_leases and lease_file")
+		}
+		return dhcp6d.NewStatelessHandler(dhcp6d.DUIDLL(hw), opts...), nil
+	}
+
+	_, prefix, err := net.ParseCIDR(conf.Prefix)
+	if err != nil || prefix.IP.To4() != nil {
+		return nil, fmt.Errorf("dhcpv6: invalid prefix %q", conf.Prefix)
+	}
+	startIP := net.ParseIP(conf.StartIP)
+	if startIP == nil {
+		return nil, fmt.Errorf("dhcpv6: invalid start_ip %q", conf.StartIP)
+	}
+	if conf.PreferredLifetime != 0 || conf.ValidLifetime != 0 {
+		preferred, valid := conf.PreferredLifetime, conf.ValidLifetime
+		if preferred == 0 {
+			preferred = valid / 2
+		}
+		if valid == 0 {
+			valid = 2 * preferred
+		}
+		opts = append(opts, dhcp6d.WithLifetimes(preferred, valid))
+	}
+	if conf.RapidCommit {
+		opts = append(opts, dhcp6d.WithRapidCommit())
+	}
+	var static []dhcp6d.StaticLease
+	for _, sl := range conf.StaticLeases {
+		duid, err := dhcp6d.ParseDUID(sl.DUID)
+		if err != nil {
+			return nil, fmt.Errorf("dhcpv6: %v", err)
+		}
+		ip := net.ParseIP(sl.IP)
+		if ip == nil {
+			return nil, fmt.Errorf("dhcpv6: static lease %s: invalid ip %q", sl.DUID, sl.IP)
+		}
+		static = append(static, dhcp6d.StaticLease{DUID: dhcp6d.FormatDUID(duid), Addr: ip, Hostname: sl.Name})
+	}
+	if len(static) > 0 {
+		opts = append(opts, dhcp6d.WithStaticLeases(static...))
+	}
+
+	h, err := dhcp6d.NewHandler(dhcp6d.DUIDLL(hw), prefix, startIP, conf.Range, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("dhcpv6: %v", err)
+	}
+	return h, nil
+}
+
+// dhcp6Server serves the DHCPv6 clients of one interface.
+type dhcp6Server struct {
+	iface     string
+	leaseFile string
+	handler   *dhcp6d.Handler
+	conn      net.PacketConn
+}
+
+// startDHCP6 returns a server for conf on iface, with the leases of its
+// lease file. It should be served, and closed with the network.
+func startDHCP6(iface string, conf *config.DHCPv6) (*dhcp6Server, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	handler, err := newDHCP6Handler(conf, ifi.HardwareAddr)
+	if err != nil {
+		return nil, err
+	}
+	s := &dhcp6Server{iface: iface, leaseFile: conf.LeaseFile, handler: handler}
+	if s.leaseFile != "" {
+		b, err := os.ReadFile(s.leaseFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if len(b) > 0 {
+			var leases []dhcp6d.Lease
+			if err := json.Unmarshal(b, &leases); err != nil {
+				return nil, fmt.Errorf("%s: %v", s.leaseFile, err)
+			}
+			handler.SetLeases(leases)
+		}
+		handler.Leases = s.saveLeases
+	}
+	s.conn, err = newUDP6MulticastListener(ifi, dhcp6d.AllServers, dhcp6d.ServerPort)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *dhcp6Server) saveLeases(leases []dhcp6d.Lease) {
+	b, err := json.Marshal(leases)
+	if err != nil {
+		slog.Error("marshal dhcpv6 leases err", "iface", s.iface, "err", err)
+		return
+	}
+	if err := writeFileAtomic(s.leaseFile, b, 0644); err != nil {
+		slog.Error("write dhcpv6 leases err", "iface", s.iface, "path", s.leaseFile, "err", err)
+	}
+}
+
+// serve answers clients until the server is closed.
+func (s *dhcp6Server) serve() error {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		m, err := dhcp6d.Parse(buf[:n])
+		if err != nil {
+			slog.Debug("dhcpv6 parse err", "iface", s.iface, "from", from, "err", err)
+			continue
+		}
+		reply := s.handler.ServeDHCP(m)
+		if reply == nil {
+			continue
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, err := s.conn.WriteTo(reply.Marshal(), from); err != nil {
+			slog.Error("dhcpv6 write err", "iface", s.iface, "to", from, "err", err)
+		}
+	}
+}
+
+func (s *dhcp6Server) close() error {
+	return s.conn.Close()
+}
+
+// newUDP6MulticastListener returns a socket on port of ifi that has joined
+// group, unless it is nil.
+func newUDP6MulticastListener(ifi *net.Interface, group net.IP, port int) (pc net.PacketConn, e error) {
+	s, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { // clean up if something goes wrong
+		if e != nil {
+			syscall.Close(s)
+		}
+	}()
+
+	if err := syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return nil, err
+	}
+	if err := syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 1); err != nil {
+		return nil, err
+	}
+	if err := syscall.SetsockoptString(s, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, ifi.Name); err != nil {
+		return nil, err
+	}
+	if group != nil {
+		mreq := &syscall.IPv6Mreq{Interface: uint32(ifi.Index)}
+		copy(mreq.Multiaddr[:], group.To16())
+		if err := syscall.SetsockoptIPv6Mreq(s, syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := syscall.Bind(s, &syscall.SockaddrInet6{Port: port}); err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(s), "")
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
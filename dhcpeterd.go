@@ -8,16 +8,40 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"reflect"
+	"slices"
+	"sync"
 	"syscall"
+	"time"
 
-	"github.com/krolaw/dhcp4"
 	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
 	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+	"github.com/psanford/dhcpeterd/internal/fingerprint"
+	"github.com/psanford/dhcpeterd/internal/oui"
 )
 
-var confPath = flag.String("config", "dhcpeterd.toml", "Config path")
+var (
+	confPath = flag.String("config", "dhcpeterd.toml", "Config path")
+	logLevel = flag.String("log-level", "", "Log level (debug, info, warn, error); overrides log_level")
+	dryRun   = flag.Bool("dry-run", false, "Log replies instead of sending them and never write the lease file")
+	learn    = flag.Bool("learn", false, "Never reply; record the leases other servers hand out instead")
+)
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check":
+			os.Exit(runCheck(os.Args[2:]))
+		case "import-leases":
+			os.Exit(runImportLeases(os.Args[2:]))
+		case "restore-leases":
+			os.Exit(runRestoreLeases(os.Args[2:]))
+		case "leases":
+			os.Exit(runLeases(os.Args[2:]))
+		}
+	}
+
 	flag.Parse()
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -31,88 +55,806 @@ func main() {
 		os.Exit(1)
 	}
 
-	lm := newLeaseManager(conf.LeaseFile)
-	go lm.updateLeaseFileLoop(ctx)
+	if err := setupLogging(conf, *logLevel); err != nil {
+		slog.Error("setup logging err", "err", err)
+		os.Exit(1)
+	}
 
-	for _, network := range conf.Networks {
-		n := network
-		go func() {
-			err := run(n, lm)
+	metrics := newMetricsRegistry()
+	if conf.Redis != nil && conf.Etcd != nil {
+		slog.Error("load config err", "err", "redis and etcd cannot both be configured")
+		os.Exit(1)
+	}
+	if conf.Seccomp && (conf.OnLeaseScript != "" || len(conf.FirewallSets) > 0 || (conf.NewDevice != nil && len(conf.NewDevice.Command) > 0)) {
+		slog.Error("load config err", "err", "seccomp cannot be used with settings that run commands")
+		os.Exit(1)
+	}
+	var lm *leaseManager
+	var newStore func(path string) (LeaseStore, error)
+	if conf.Redis != nil {
+		newStore = func(path string) (LeaseStore, error) {
+			local, err := lm.fileStore(path)
+			if err != nil {
+				return nil, err
+			}
+			return newRedisStore(*conf.Redis, path, local), nil
+		}
+	}
+	if conf.Etcd != nil {
+		newStore = func(path string) (LeaseStore, error) {
+			local, err := lm.fileStore(path)
+			if err != nil {
+				return nil, err
+			}
+			return newEtcdStore(*conf.Etcd, path, local), nil
+		}
+	}
+	lm = newLeaseManager(conf.LeaseFile, newStore)
+	lm.metrics = metrics
+	lm.readOnly = *dryRun
+	lm.writeInterval = conf.LeaseWriteInterval
+	lm.backups = conf.LeaseFileBackups
+	lm.dnsmasqPath = conf.DnsmasqLeaseFile
+	lm.hostsPath = conf.HostsFile
+	lm.hostsDomain = conf.HostsDomain
+	lm.hostsDir = conf.HostsDir
+	if *dryRun {
+		slog.Warn("dry run: replies are logged instead of sent and the lease file is not written")
+	}
+	if *learn {
+		slog.Warn("learning: not replying, recording the leases of other servers")
+	}
+	if err := lm.open(""); err != nil {
+		slog.Error("open lease file err", "err", err)
+		os.Exit(1)
+	}
+
+	newDevice, err := newNotifier(conf.NewDevice)
+	if err != nil {
+		slog.Error("load config err", "err", err)
+		os.Exit(1)
+	}
+	if newDevice != nil {
+		lm.newDevice = func(iface string, l dhcp4d.Lease) {
+			newDevice.newDevice(newNewDeviceEvent(iface, l))
+		}
+	}
+	var (
+		haActive   chan bool
+		primary    *haPrimary
+		haListener net.Listener
+	)
+	if conf.HA != nil {
+		if err := checkHA(conf.HA); err != nil {
+			slog.Error("load config err", "err", err)
+			os.Exit(1)
+		}
+		if conf.HA.Role == "primary" {
+			primary = newHAPrimary(*conf.HA, lm)
+			lm.replicate = primary.replicate
+			haListener, err = net.Listen("tcp", conf.HA.Listen)
 			if err != nil {
-				slog.Error("run error", "iface", n.Interface, "err", err)
+				slog.Error("ha listen err", "err", err)
+				os.Exit(1)
+			}
+		} else {
+			haActive = make(chan bool)
+			go newHAStandby(*conf.HA, lm, haActive).loop(ctx)
+		}
+	}
+	var vrrpMaster chan bool
+	if conf.Keepalived != nil {
+		if conf.Keepalived.FIFO == "" {
+			slog.Error("load config err", "err", "keepalived requires fifo")
+			os.Exit(1)
+		}
+		vrrpMaster = make(chan bool)
+		go func() {
+			if err := watchKeepalived(ctx, *conf.Keepalived, vrrpMaster); err != nil {
+				slog.Error("keepalived fifo err", "err", err)
 				os.Exit(1)
 			}
 		}()
 	}
+	go lm.updateLeaseFileLoop(ctx)
 
-	<-c
-}
+	tagRules, err := newTagRules(conf.Tags)
+	if err != nil {
+		slog.Error("load config err", "err", err)
+		os.Exit(1)
+	}
 
-func run(conf config.Network, lm *leaseManager) error {
-	iface, err := net.InterfaceByName(conf.Interface)
+	var ouiDB *oui.DB
+	if conf.OUIDatabase != "" {
+		ouiDB, err = oui.Load(conf.OUIDatabase)
+		if err != nil {
+			slog.Error("load oui database err", "err", err)
+			os.Exit(1)
+		}
+	} else {
+		ouiDB, err = oui.LoadDefault()
+		if err != nil {
+			slog.Info("vendor lookup disabled", "err", err)
+		}
+	}
+
+	fingerprints := fingerprint.New()
+	if conf.FingerprintDatabase != "" {
+		fingerprints, err = fingerprint.Load(conf.FingerprintDatabase)
+		if err != nil {
+			slog.Error("load fingerprint database err", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	d := &daemon{
+		tagRules:     tagRules,
+		ouiDB:        ouiDB,
+		fingerprints: fingerprints,
+		lm:           lm,
+		handlers:     make(map[string]*dhcp4d.Handler),
+		loops:        make(map[string]*serveLoop),
+		networks:     make(map[string]*network),
+		metrics:      metrics,
+		conf:         *conf,
+		done:         make(chan struct{}),
+		mdns:         newMDNSPublisher(),
+	}
+	d.conf.Networks = nil
+	go d.mdns.loop(ctx)
+	d.sinks = append(d.sinks, d.mdns.send)
+
+	d.leaseQueryAllow, err = parseLeaseQueryAllow(conf.LeaseQueryAllow)
 	if err != nil {
-		return err
+		slog.Error("load config err", "err", err)
+		os.Exit(1)
+	}
+
+	if conf.ReservationsFile != "" {
+		d.reservations, err = newReservationStore(conf.ReservationsFile)
+		if err != nil {
+			slog.Error("load reservations err", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if conf.HostnameFallback != nil {
+		d.hostnames, err = newHostnameFallback(conf.HostnameFallback)
+		if err != nil {
+			slog.Error("load config err", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if conf.OnLeaseScript != "" {
+		script := newLeaseScript(conf.OnLeaseScript)
+		go script.loop(ctx)
+		d.sinks = append(d.sinks, script.queue)
+	}
+	if conf.Webhook != nil {
+		hook, err := newWebhook(conf.Webhook)
+		if err != nil {
+			slog.Error("load config err", "err", err)
+			os.Exit(1)
+		}
+		go hook.loop(ctx)
+		d.sinks = append(d.sinks, hook.send)
+	}
+	if conf.MQTT != nil {
+		if conf.MQTT.Broker == "" {
+			slog.Error("load config err", "err", "mqtt requires broker")
+			os.Exit(1)
+		}
+		pub := newMQTTPublisher(*conf.MQTT)
+		go pub.loop(ctx)
+		d.sinks = append(d.sinks, pub.send)
+	}
+	if conf.DDNS != nil {
+		ddns, err := newDDNSUpdater(conf.DDNS)
+		if err != nil {
+			slog.Error("load config err", "err", err)
+			os.Exit(1)
+		}
+		go ddns.loop(ctx)
+		d.sinks = append(d.sinks, ddns.send)
+	}
+	var firewall *firewallSets
+	if len(conf.FirewallSets) > 0 {
+		firewall, err = newFirewallSets(conf.FirewallSets)
+		if err != nil {
+			slog.Error("load config err", "err", err)
+			os.Exit(1)
+		}
+		d.sinks = append(d.sinks, firewall.send)
+	}
+	if conf.PrefixDelegation != nil {
+		d.pd, err = newPrefixDelegation(conf.PrefixDelegation)
+		if err != nil {
+			slog.Error("load config err", "err", err)
+			os.Exit(1)
+		}
+	}
+	var reverse *reverseZones
+	if conf.ReverseZones != nil {
+		reverse, err = newReverseZones(conf.ReverseZones)
+		if err != nil {
+			slog.Error("load config err", "err", err)
+			os.Exit(1)
+		}
+		d.sinks = append(d.sinks, reverse.send)
+	}
+	if conf.AuditLog != nil {
+		audit, err := newAuditLog(conf.AuditLog)
+		if err != nil {
+			slog.Error("load config err", "err", err)
+			os.Exit(1)
+		}
+		go audit.loop(ctx)
+		d.sinks = append(d.sinks, audit.send)
+	}
+	if conf.LeaseHistory != nil {
+		d.history, err = newLeaseHistory(conf.LeaseHistory)
+		if err != nil {
+			slog.Error("load config err", "err", err)
+			os.Exit(1)
+		}
+		go d.history.loop(ctx)
+		d.sinks = append(d.sinks, d.history.send)
+	}
+	if conf.Failover != nil {
+		if conf.Failover.Peer == "" {
+			slog.Error("load config err", "err", "failover requires peer")
+			os.Exit(1)
+		}
+		d.failover = newFailoverPeer(*conf.Failover, d)
+		// Failing to listen is not fatal: the peer can still be dialed.
+		l, err := net.Listen("tcp", conf.Failover.Listen)
+		if err != nil {
+			slog.Error("failover listen err", "err", err)
+		}
+		go d.failover.loop(ctx, l)
+		d.sinks = append(d.sinks, d.failover.send)
+	}
+	if conf.Tracing != nil {
+		d.tracer, err = newOTLPExporter(conf.Tracing)
+		if err != nil {
+			slog.Error("load config err", "err", err)
+			os.Exit(1)
+		}
+		go d.tracer.loop(ctx)
 	}
 
-	addrs, err := iface.Addrs()
+	if conf.HTTPListen != "" || conf.GRPCListen != "" || conf.Tailscale != nil || conf.ControlSocket != "" {
+		hub := newEventHub()
+		d.sinks = append(d.sinks, hub.send)
+		api := newAPIServer(d, hub)
+		var auth *apiAuth
+		if conf.HTTPListen != "" || conf.GRPCListen != "" || conf.Tailscale != nil {
+			auth, err = newAPIAuth(conf)
+			if err != nil {
+				slog.Error("load config err", "err", err)
+				os.Exit(1)
+			}
+		}
+		if conf.HTTPListen != "" {
+			l, err := net.Listen("tcp", conf.HTTPListen)
+			if err != nil {
+				slog.Error("http server error", "err", err)
+				os.Exit(1)
+			}
+			go func() {
+				err := api.serve(ctx, l, auth)
+				if err != nil {
+					slog.Error("http server error", "err", err)
+					os.Exit(1)
+				}
+			}()
+		}
+		if conf.Tailscale != nil {
+			if conf.Tailscale.StateDir == "" {
+				slog.Error("load config err", "err", "tailscale requires state_dir")
+				os.Exit(1)
+			}
+			ts, l, err := listenTailscale(conf.Tailscale)
+			if err != nil {
+				slog.Error("http server error", "err", err)
+				os.Exit(1)
+			}
+			go func() {
+				err := api.serve(ctx, l, auth)
+				ts.Close()
+				if err != nil {
+					slog.Error("http server error", "err", err)
+					os.Exit(1)
+				}
+			}()
+		}
+		if conf.GRPCListen != "" {
+			l, err := net.Listen("tcp", conf.GRPCListen)
+			if err != nil {
+				slog.Error("grpc server error", "err", err)
+				os.Exit(1)
+			}
+			go func() {
+				err := newGRPCServer(api, hub).serve(ctx, l, auth)
+				if err != nil {
+					slog.Error("grpc server error", "err", err)
+					os.Exit(1)
+				}
+			}()
+		}
+		if conf.ControlSocket != "" {
+			l, err := listenUnix(conf.ControlSocket)
+			if err != nil {
+				slog.Error("control socket error", "err", err)
+				os.Exit(1)
+			}
+			go func() {
+				err := api.serveUnix(ctx, l)
+				if err != nil {
+					slog.Error("control socket error", "err", err)
+					os.Exit(1)
+				}
+			}()
+		}
+	}
+
+	d.configured = conf.Networks
+	d.passive = haActive != nil
+	d.vrrpBackup = vrrpMaster != nil
+	networks, err := expandNetworks(conf.Networks)
 	if err != nil {
-		return err
+		slog.Error("load config err", "err", err)
+		os.Exit(1)
+	}
+	for _, n := range networks {
+		if err := lm.open(n.LeaseFile); err != nil {
+			slog.Error("open lease file err", "iface", n.Interface, "err", err)
+			os.Exit(1)
+		}
+	}
+	if d.passive {
+		slog.Info("ha standby: not serving until the primary is unreachable")
+	}
+	if d.vrrpBackup {
+		slog.Info("keepalived: not serving until this instance is the master")
+	}
+	if conf.SharedSocket {
+		d.shared, err = listenShared()
+		if err != nil {
+			slog.Error("listen err", "err", err)
+			os.Exit(1)
+		}
+		go func() {
+			err := d.shared.serve()
+			slog.Debug("shared socket stopped", "err", err)
+		}()
+	}
+	for _, n := range d.servable(networks) {
+		d.startNetwork(n, true)
 	}
 
-	startIP := net.ParseIP(conf.StartIP)
-	if startIP == nil {
-		return fmt.Errorf("parse start_ip on %s error invalid: %s", conf.Interface, conf.StartIP)
+	go func() {
+		d.bound.Wait()
+		if err := sdNotify("READY=1"); err != nil {
+			slog.Error("sd_notify err", "err", err)
+		}
+	}()
+	if primary != nil {
+		// Standbys are served once the networks are running, into which
+		// their leases are merged.
+		primary.handler = d.handler
+		go func() {
+			d.bound.Wait()
+			if err := primary.serve(ctx, haListener); err != nil {
+				slog.Error("ha listen err", "err", err)
+				os.Exit(1)
+			}
+		}()
+	}
+	go d.reapLoop(ctx)
+	go d.expireLoop(ctx)
+	for _, c := range conf.Hostapd {
+		m := &hostapdMonitor{conf: c, d: d}
+		go m.loop(ctx)
+	}
+	if firewall != nil {
+		go firewall.loop(ctx, d)
+	}
+	if reverse != nil && !*dryRun {
+		go reverse.loop(ctx, d)
+	}
+	var prefixChanges <-chan struct{}
+	if d.pd != nil && !*dryRun {
+		prefixChanges = d.pd.changed
+		go d.pd.loop(ctx)
+	}
+	if conf.InventoryInterval > 0 {
+		go d.inventoryLoop(ctx, conf.InventoryInterval)
+	}
+	if timeout := watchdogInterval(); timeout > 0 {
+		go d.watchdog(ctx, timeout)
 	}
 
-	var matchIPNet *net.IPNet
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
-	for _, addr := range addrs {
-		ipnet, ok := addr.(*net.IPNet)
-		if !ok {
-			continue
+	// Interface changes usually come in bursts, so resync once they settle.
+	linkChanges := make(chan struct{}, 1)
+	go func() {
+		if err := watchLinks(ctx, linkChanges); err != nil {
+			slog.Error("watch interfaces err", "err", err)
 		}
+	}()
+	// Installed last so that startup is not restricted. All listeners are
+	// open by now; only network sockets are created later.
+	if conf.Sandbox {
+		paths := sandboxPaths(conf, *confPath)
+		if err := installSandbox(paths, conf.SandboxChroot); err != nil {
+			slog.Error("sandbox err", "err", err)
+		} else {
+			d.sandbox = paths
+		}
+	}
+	if conf.Seccomp {
+		if err := installSeccomp(); err != nil {
+			slog.Error("seccomp err", "err", err)
+		}
+	}
 
-		if ipnet.Contains(startIP) {
-			matchIPNet = ipnet
-			break
+	var resync <-chan time.Time
+	for {
+		select {
+		case <-linkChanges:
+			if resync == nil {
+				resync = time.After(time.Second)
+			}
+		case <-resync:
+			resync = nil
+			d.resync()
+		case <-prefixChanges:
+			d.resync()
+		case active := <-haActive:
+			d.passive = !active
+			d.resync()
+		case master := <-vrrpMaster:
+			d.vrrpBackup = !master
+			d.resync()
+		case <-usr1:
+			d.dumpLeases(conf.LeaseDumpFile)
+		case <-hup:
+			if err := d.reload(*confPath); err != nil {
+				slog.Error("reload config err", "err", err)
+			}
+		case <-c:
+			slog.Info("shutting down")
+			d.shutdown()
+			cancel()
+			<-lm.done
+			if d.history != nil {
+				<-d.history.done
+			}
+			return
 		}
 	}
+}
+
+// eventSink receives lease events from the handler of interface iface. It
+// is called with the handler's leases lock held and must not block.
+type eventSink func(iface string, ev dhcp4d.Event)
+
+// daemon holds the state shared by all networks.
+type daemon struct {
+	tagRules        []dhcp4d.TagRule
+	ouiDB           *oui.DB
+	fingerprints    *fingerprint.DB
+	lm              *leaseManager
+	sinks           []eventSink
+	reservations    *reservationStore // nil if no reservations file is configured
+	hostnames       *hostnameFallback // nil if no hostname fallback is configured
+	metrics         *metricsRegistry
+	tracer          *otlpExporter // nil if tracing is not configured
+	history         *leaseHistory // nil if lease history is not configured
+	failover        *failoverPeer // nil if failover is not configured
+	leaseQueryAllow []*net.IPNet  // networks allowed to send leasequeries
+	mdns            *mdnsPublisher
+	shared          *sharedSocket     // nil unless shared_socket is set
+	pd              *prefixDelegation // nil if prefix delegation is not configured
+	conf            config.Config     // as loaded at startup, without networks
+	sandbox         []sandboxPath     // nil unless the sandbox is installed
+
+	// configured are the networks of the current config, before
+	// expanding interface patterns. Only used by the main goroutine.
+	configured []config.Network
+
+	// passive is set while this instance is an HA standby whose primary
+	// is up, so that no network is served. Only used by the main
+	// goroutine.
+	passive bool
+
+	// vrrpBackup is set while keepalived does not report this instance
+	// as the VRRP master. Only used by the main goroutine.
+	vrrpBackup bool
 
-	if matchIPNet == nil {
-		return fmt.Errorf("failed to find network %s on %s", conf.StartIP, conf.Interface)
+	bound   sync.WaitGroup // done once each network's socket is bound
+	serving sync.WaitGroup // done once each network's serve loop has returned
+
+	mu       sync.Mutex
+	handlers map[string]*dhcp4d.Handler // by interface name
+	loops    map[string]*serveLoop      // by interface name
+	networks map[string]*network        // by interface name
+	stopping bool                       // shutdown has begun
+	done     chan struct{}              // closed when shutdown begins
+}
+
+// interfacesLocked returns the interfaces of the configured networks in
+// order. d.mu must be held.
+func (d *daemon) interfacesLocked() []string {
+	ifaces := make([]string, 0, len(d.networks))
+	for iface := range d.networks {
+		ifaces = append(ifaces, iface)
 	}
+	slices.Sort(ifaces)
+	return ifaces
+}
+
+// network is a network being served. A new one is created each time a
+// network is started so that a run superseded by a restart can tell.
+type network struct {
+	conf config.Network // guarded by daemon.mu
+	err  error          // the last failure, guarded by daemon.mu
+}
+
+// startNetwork serves n in a new supervised goroutine. At startup the daemon
+// is ready once every network's socket is bound or has failed to bind.
+func (d *daemon) startNetwork(n config.Network, startup bool) {
+	nw := &network{conf: n}
+	d.mu.Lock()
+	d.networks[n.Interface] = nw
+	d.mu.Unlock()
+
+	ready := func() {}
+	if startup {
+		d.bound.Add(1)
+		var once sync.Once
+		ready = func() { once.Do(d.bound.Done) }
+	}
+	d.serving.Add(1)
+	go func() {
+		defer d.serving.Done()
+		d.supervise(nw, ready)
+	}()
+}
+
+// handler returns the running handler for iface.
+func (d *daemon) handler(iface string) (*dhcp4d.Handler, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h, ok := d.handlers[iface]
+	return h, ok
+}
+
+// allHandlers returns a copy of the running handlers by interface name.
+func (d *daemon) allHandlers() map[string]*dhcp4d.Handler {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	handlers := make(map[string]*dhcp4d.Handler, len(d.handlers))
+	for iface, h := range d.handlers {
+		handlers[iface] = h
+	}
+	return handlers
+}
+
+// newHandler builds the handler for conf, wired to the daemon's lease
+// manager and event sinks.
+func (d *daemon) newHandler(conf config.Network) (*dhcp4d.Handler, error) {
+	var h *dhcp4d.Handler
+	err := inNetns(conf.Netns, func() error {
+		iface, serverIP, err := interfaceAddr(conf)
+		if err != nil {
+			return err
+		}
+		h, err = d.newHandlerOn(conf, iface, serverIP)
+		return err
+	})
+	return h, err
+}
+
+// newHandlerOn builds the handler for conf serving from serverIP on iface,
+// with extra options.
+func (d *daemon) newHandlerOn(conf config.Network, iface *net.Interface, serverIP net.IP, extra ...dhcp4d.Option) (*dhcp4d.Handler, error) {
+	startIP := net.ParseIP(conf.StartIP)
 
 	netmask := net.ParseIP(conf.NetMask)
 	if netmask == nil {
-		return fmt.Errorf("parse netmask on %s error invalid: %s", conf.Interface, conf.NetMask)
+		return nil, fmt.Errorf("parse netmask on %s error invalid: %s", conf.Interface, conf.NetMask)
 	}
-	serverIP := matchIPNet.IP
 
-	staticLeases := make([]dhcp4d.StaticLease, 0, len(conf.StaticLeases))
-	for _, sl := range conf.StaticLeases {
+	configured := conf.StaticLeases
+	if d.reservations != nil {
+		configured = slices.Concat(configured, d.reservations.forInterface(conf.Interface))
+	}
+	staticLeases := make([]dhcp4d.StaticLease, 0, len(configured))
+	for _, sl := range configured {
 		ip := net.ParseIP(sl.IP)
 		if ip == nil {
 			slog.Error("invalid static ip", "ip", sl.IP)
 			continue
 		}
 
+		opts, err := encodeOptionBlock(sl.DNSServers, nil)
+		if err != nil {
+			return nil, fmt.Errorf("static lease %s on %s: %w", sl.Name, conf.Interface, err)
+		}
 		staticLeases = append(staticLeases, dhcp4d.StaticLease{
 			Addr:         ip.To4(),
 			HardwareAddr: sl.MacAddress,
 			Hostname:     sl.Name,
+			Permanent:    sl.Permanent,
+			Options:      opts,
 		})
 	}
 
-	handler, err := dhcp4d.NewHandler(iface, serverIP, startIP, netmask, conf.Range, conf.LeaseDuration, conf.DNSServers, staticLeases)
+	classes, err := newClasses(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	optionSets, err := newOptionSets(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	macFilter, err := newMACFilter(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	networkOpts, err := networkOptions(conf, serverIP)
+	if err != nil {
+		return nil, fmt.Errorf("network %s: %w", conf.Interface, err)
+	}
+
+	opts := []dhcp4d.Option{
+		dhcp4d.WithDeviceClassifier(func(fp dhcp4d.Fingerprint) string {
+			return d.fingerprints.Match(fp.ParameterRequestList, fp.VendorClass, fp.OptionOrder)
+		}),
+		dhcp4d.WithClasses(classes...),
+		dhcp4d.WithTagRules(d.tagRules...),
+		dhcp4d.WithOptionSets(optionSets...),
+		dhcp4d.WithNetworkOptions(networkOpts),
+		dhcp4d.WithMACFilter(macFilter),
+		dhcp4d.WithMetrics(handlerMetrics{r: d.metrics, iface: conf.Interface}),
+	}
+
+	if d.ouiDB != nil {
+		opts = append(opts, dhcp4d.WithVendorLookup(d.ouiDB.Lookup))
+	}
+
+	if conf.GroupRandomizedMACs {
+		opts = append(opts, dhcp4d.WithDeviceGrouping())
+	}
+
+	if d.tracer != nil {
+		opts = append(opts, dhcp4d.WithTracer(d.tracer))
+	}
+
+	if *dryRun {
+		opts = append(opts, dhcp4d.WithDryRun())
+	}
+
+	if *learn {
+		opts = append(opts, dhcp4d.WithLearning())
+	}
 
-	existingLeases := lm.lf.LeaseByInterface[conf.Interface]
-	if len(existingLeases) > 0 {
-		leases := make([]*dhcp4d.Lease, len(existingLeases))
-		for i, l := range existingLeases {
-			l := l
-			leases[i] = &l
+	if rl := conf.RateLimit; rl != nil {
+		if rl.Rate <= 0 {
+			return nil, fmt.Errorf("rate_limit requires a positive rate")
 		}
-		handler.SetLeases(leases)
+		opts = append(opts, dhcp4d.WithRateLimit(dhcp4d.RateLimit{Rate: rl.Rate, Burst: rl.Burst}))
+	}
+
+	if fd := conf.FlapDetection; fd != nil {
+		if fd.Threshold <= 0 {
+			return nil, fmt.Errorf("flap_detection requires a positive threshold")
+		}
+		window := fd.Window
+		if window == 0 {
+			window = 5 * time.Minute
+		}
+		opts = append(opts, dhcp4d.WithFlapDetection(dhcp4d.FlapDetection{Threshold: fd.Threshold, Window: window}))
+	}
+
+	if conf.ClientFQDN != "" {
+		policy, err := parseFQDNPolicy(conf.ClientFQDN)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, dhcp4d.WithClientFQDN(policy))
+	}
+	if conf.SanitizeHostnames {
+		opts = append(opts, dhcp4d.WithHostnameSanitizing())
+	}
+	if conf.DuplicateHostnames != "" {
+		policy, err := parseDuplicatePolicy(conf.DuplicateHostnames)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, dhcp4d.WithDuplicateHostnames(policy))
+	}
+	if conf.Allocation != "" {
+		allocation, err := parseAllocation(conf.Allocation)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, dhcp4d.WithAllocation(allocation))
+	}
+	if conf.MinSecs != 0 {
+		if conf.MinSecs < 0 || conf.MinSecs > 65535 {
+			return nil, fmt.Errorf("min_secs must be between 0 and 65535")
+		}
+		opts = append(opts, dhcp4d.WithMinSecs(conf.MinSecs))
+	}
+	if conf.AlwaysBroadcast {
+		opts = append(opts, dhcp4d.WithAlwaysBroadcast())
+	}
+
+	if conf.PoolWarningThreshold > 0 {
+		opts = append(opts, dhcp4d.WithPoolWarning(conf.PoolWarningThreshold))
+	}
+
+	if conf.Failover {
+		if d.failover == nil {
+			return nil, fmt.Errorf("network %s: failover requires the failover section", conf.Interface)
+		}
+		opts = append(opts, dhcp4d.WithAllocatable(d.failover.allocatable), dhcp4d.WithLeaseLimit(d.failover.leaseLimit))
+		if lb := d.failover.loadBalancing(); lb != nil {
+			opts = append(opts, dhcp4d.WithLoadBalancing(*lb))
+		}
+	}
+
+	if conf.SplitScope != nil {
+		lb, err := newLoadBalancing(conf)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, dhcp4d.WithLoadBalancing(lb))
+	}
+
+	if conf.DeviceLeaseDurations != nil {
+		periods, err := newDeviceLeasePeriods(conf)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, dhcp4d.WithDeviceLeasePeriods(periods...))
+	}
+
+	if conf.Quarantine != nil {
+		q := *conf.Quarantine
+		if q.Name == "" {
+			q.Name = "quarantine"
+		}
+		quarantine, err := newClass(q, conf.Interface)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, dhcp4d.WithQuarantine(quarantine))
+	}
+
+	opts = append(opts, extra...)
+	if conf.UDPOnly {
+		opts = append(opts, dhcp4d.WithUDP())
+	}
+	handler, err := dhcp4d.NewHandler(iface, serverIP, startIP, netmask, conf.Range, conf.LeaseDuration, conf.DNSServers, staticLeases, opts...)
+	if err != nil && !conf.UDPOnly && packetSocketDenied(err) {
+		slog.Warn("packet socket unavailable, replying over udp", "iface", conf.Interface, "err", err)
+		opts = append(opts, dhcp4d.WithUDP())
+		handler, err = dhcp4d.NewHandler(iface, serverIP, startIP, netmask, conf.Range, conf.LeaseDuration, conf.DNSServers, staticLeases, opts...)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	handler.Leases = func(newLeases []*dhcp4d.Lease, latest *dhcp4d.Lease) {
@@ -122,18 +864,388 @@ func run(conf config.Network, lm *leaseManager) error {
 			leases[i] = *l
 		}
 
-		lm.leaseUpdate <- LeaseUpdate{
+		var l *dhcp4d.Lease
+		if latest != nil {
+			copied := *latest
+			l = &copied
+		}
+
+		d.lm.leaseUpdate <- LeaseUpdate{
 			IfaceName: conf.Interface,
+			File:      conf.LeaseFile,
 			Leases:    leases,
+			Latest:    l,
+		}
+	}
+
+	if len(d.sinks) > 0 {
+		handler.Events = func(ev dhcp4d.Event) {
+			for _, sink := range d.sinks {
+				sink(conf.Interface, ev)
+			}
+		}
+	}
+
+	handler.HostnameOverrides = func(overrides map[string]string) {
+		d.lm.hostnameUpdate <- HostnameUpdate{
+			IfaceName: conf.Interface,
+			File:      conf.LeaseFile,
+			Overrides: overrides,
+		}
+	}
+
+	if d.hostnames != nil {
+		handler.HostnameFallback = func(hwaddr string, ip net.IP) string {
+			return d.hostnames.lookup(hwaddr, ip, handler.FillHostname)
+		}
+	}
+
+	handler.Approvals = func(approved []string) {
+		d.lm.approvedUpdate <- ApprovedUpdate{
+			IfaceName: conf.Interface,
+			File:      conf.LeaseFile,
+			Approved:  approved,
 		}
 	}
 
-	conn, err := newUDP4BoundListener(conf.Interface, ":67")
+	return handler, nil
+}
+
+// run serves the network nw until its listener is closed by shutdown or
+// because the network was stopped. ready is called once the listener is
+// bound.
+func (d *daemon) run(nw *network, ready func()) error {
+	handler, conf, err := d.waitHandler(nw)
 	if err != nil {
 		return err
 	}
-	slog.Info("listen", "iface", conf.Interface, "server_ip", serverIP, "iface2", iface.Name, "start_ip", conf.StartIP)
-	return dhcp4.Serve(conn, handler)
+	if handler == nil {
+		ready()
+		return nil // stopped while waiting
+	}
+	if err := d.lm.open(conf.LeaseFile); err != nil {
+		handler.Close()
+		return err
+	}
+
+	d.restoreState(handler, conf)
+	if *learn {
+		go func() {
+			err := handler.Learn()
+			slog.Debug("learning stopped", "iface", conf.Interface, "err", err)
+		}()
+	}
+
+	var conn net.PacketConn
+	if d.shared != nil && conf.Netns == "" {
+		conn, err = d.shared.listen(handler.Interface().Index)
+	} else {
+		conn, err = newUDP4BoundListener(conf.Interface, ":67")
+	}
+	if err != nil {
+		handler.Close()
+		return err
+	}
+	loop := &serveLoop{handler: handler, conn: conn}
+	d.mu.Lock()
+	// The network may have been stopped, or reloaded, while binding.
+	stopping := d.stopping || d.networks[conf.Interface] != nw
+	changed := !stopping && !reflect.DeepEqual(nw.conf, conf)
+	if !stopping && !changed {
+		d.handlers[conf.Interface] = handler
+		d.loops[conf.Interface] = loop
+		nw.err = nil
+	}
+	d.mu.Unlock()
+	if changed {
+		handler.Close()
+		conn.Close()
+		return d.run(nw, ready)
+	}
+	ready()
+	if stopping {
+		handler.Close()
+		return conn.Close()
+	}
+
+	slog.Info("listen", "iface", conf.Interface, "start_ip", conf.StartIP)
+	if conf.MDNS && !*dryRun {
+		if r, err := d.mdns.listen(conf.Interface, loop); err != nil {
+			slog.Error("mdns listen err", "iface", conf.Interface, "err", err)
+		} else {
+			defer d.mdns.stop(r)
+			go func() {
+				err := r.serve()
+				slog.Debug("mdns stopped", "iface", conf.Interface, "err", err)
+			}()
+		}
+	}
+	if conf.DHCPv6 != nil && !*dryRun {
+		if s, err := startDHCP6(conf.Interface, conf.DHCPv6); err != nil {
+			slog.Error("dhcpv6 listen err", "iface", conf.Interface, "err", err)
+		} else {
+			defer s.close()
+			go func() {
+				err := s.serve()
+				slog.Debug("dhcpv6 stopped", "iface", conf.Interface, "err", err)
+			}()
+		}
+	}
+	if conf.RouterAdvertisement != nil && !*dryRun {
+		if s, err := startRA(conf); err != nil {
+			slog.Error("router advertisement err", "iface", conf.Interface, "err", err)
+		} else {
+			defer s.stop()
+		}
+	}
+	if len(conf.VLANs) > 0 {
+		if s, err := d.startVLANs(conf); err != nil {
+			slog.Error("vlan listen err", "iface", conf.Interface, "err", err)
+		} else {
+			defer d.stopVLANs(s)
+			go func() {
+				err := dhcp4d.ServeVLANs(s.conn, s.handlers)
+				slog.Debug("vlans stopped", "iface", conf.Interface, "err", err)
+			}()
+		}
+	}
+	replies := newReplyConn(conn, handler.Interface().Index, loop)
+	var serveConn dhcp4.ServeConn = replies
+	if len(d.leaseQueryAllow) > 0 {
+		serveConn = &leaseQueryConn{PacketConn: replies, d: d, loop: loop, allow: d.leaseQueryAllow}
+	}
+	err = dhcp4.Serve(serveConn, loop)
+	d.mu.Lock()
+	current := !d.stopping && d.loops[conf.Interface] == loop
+	if current {
+		delete(d.loops, conf.Interface)
+		delete(d.handlers, conf.Interface)
+	}
+	d.mu.Unlock()
+	if !current {
+		return nil
+	}
+	conn.Close()
+	loop.current().Close()
+	return err
+}
+
+// restoreState loads the stored leases, approvals and hostname overrides
+// of the network conf into handler.
+func (d *daemon) restoreState(handler *dhcp4d.Handler, conf config.Network) {
+	leases, approved, overrides := d.lm.interfaceState(conf.Interface, conf.LeaseFile)
+	handler.SetHostnameOverrides(overrides)
+	if len(leases) > 0 {
+		handler.SetLeases(leases)
+	}
+	handler.SetApproved(approved)
+}
+
+func newClasses(conf config.Network) ([]dhcp4d.Class, error) {
+	classes := make([]dhcp4d.Class, 0, len(conf.Classes))
+	for _, c := range conf.Classes {
+		class, err := newClass(c, conf.Interface)
+		if err != nil {
+			return nil, err
+		}
+		classes = append(classes, class)
+	}
+	return classes, nil
+}
+
+func newClass(c config.Class, ifaceName string) (dhcp4d.Class, error) {
+	class := dhcp4d.Class{
+		Name:        c.Name,
+		VendorClass: c.VendorClass,
+		UserClass:   c.UserClass,
+		RequireTags: c.RequireTags,
+		ExcludeTags: c.ExcludeTags,
+		LeaseRange:  c.Range,
+		LeasePeriod: c.LeaseDuration,
+	}
+
+	if c.Range > 0 {
+		class.StartIP = net.ParseIP(c.StartIP).To4()
+		if class.StartIP == nil {
+			return class, fmt.Errorf("parse start_ip for class %s on %s error invalid: %s", c.Name, ifaceName, c.StartIP)
+		}
+	}
+
+	opts, err := encodeOptionBlock(c.DNSServers, c.Options)
+	if err != nil {
+		return class, fmt.Errorf("class %s on %s: %w", c.Name, ifaceName, err)
+	}
+	class.Options = opts
+
+	return class, nil
+}
+
+func newOptionSets(conf config.Network) ([]dhcp4d.OptionSet, error) {
+	sets := make([]dhcp4d.OptionSet, 0, len(conf.OptionSets))
+	for i, s := range conf.OptionSets {
+		opts, err := encodeOptionBlock(s.DNSServers, s.Options)
+		if err != nil {
+			return nil, fmt.Errorf("option_sets[%d] on %s: %w", i, conf.Interface, err)
+		}
+		sets = append(sets, dhcp4d.OptionSet{
+			RequireTags: s.RequireTags,
+			ExcludeTags: s.ExcludeTags,
+			Options:     opts,
+		})
+	}
+	return sets, nil
+}
+
+func newMACFilter(conf config.Network) (dhcp4d.MACFilter, error) {
+	var filter dhcp4d.MACFilter
+	for _, s := range conf.AllowMACs {
+		prefix, err := parseMACPrefix(s)
+		if err != nil {
+			return filter, fmt.Errorf("allow_macs on %s: %w", conf.Interface, err)
+		}
+		filter.Allow = append(filter.Allow, prefix)
+	}
+	for _, s := range conf.DenyMACs {
+		prefix, err := parseMACPrefix(s)
+		if err != nil {
+			return filter, fmt.Errorf("deny_macs on %s: %w", conf.Interface, err)
+		}
+		filter.Deny = append(filter.Deny, prefix)
+	}
+	for _, s := range conf.Ignore {
+		prefix, err := parseMACPrefix(s)
+		if err != nil {
+			return filter, fmt.Errorf("ignore on %s: %w", conf.Interface, err)
+		}
+		filter.Ignore = append(filter.Ignore, prefix)
+	}
+	if conf.Dynamic != nil && !*conf.Dynamic {
+		filter.StaticOnly = true
+	}
+	switch conf.DenyAction {
+	case "", "ignore":
+	case "nak":
+		filter.NAK = true
+	default:
+		return filter, fmt.Errorf("invalid deny_action on %s: %s", conf.Interface, conf.DenyAction)
+	}
+	return filter, nil
+}
+
+func newDeviceLeasePeriods(conf config.Network) ([]dhcp4d.DeviceLeasePeriod, error) {
+	periods := make([]dhcp4d.DeviceLeasePeriod, 0, len(conf.DeviceLeaseDurations))
+	for _, d := range conf.DeviceLeaseDurations {
+		var prefixes []net.HardwareAddr
+		switch d.Profile {
+		case "":
+		case "nintendo":
+			prefixes = dhcp4d.NintendoMACPrefixes()
+		default:
+			return nil, fmt.Errorf("unknown device_lease_durations profile on %s: %s", conf.Interface, d.Profile)
+		}
+		for _, s := range d.MACPrefixes {
+			prefix, err := parseMACPrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("device_lease_durations on %s: %w", conf.Interface, err)
+			}
+			prefixes = append(prefixes, prefix)
+		}
+		if d.LeaseDuration <= 0 {
+			return nil, fmt.Errorf("device_lease_durations on %s: lease_duration must be positive", conf.Interface)
+		}
+		periods = append(periods, dhcp4d.DeviceLeasePeriod{
+			Prefixes:    prefixes,
+			LeasePeriod: d.LeaseDuration,
+		})
+	}
+	return periods, nil
+}
+
+func newLoadBalancing(conf config.Network) (dhcp4d.LoadBalancing, error) {
+	ss := conf.SplitScope
+	split := ss.Split
+	if split == 0 {
+		split = 128
+	}
+	if split < 1 || split > 255 {
+		return dhcp4d.LoadBalancing{}, fmt.Errorf("split_scope on %s: split must be between 1 and 255", conf.Interface)
+	}
+	lb := dhcp4d.LoadBalancing{SecsThreshold: int(ss.FailoverAfter / time.Second)}
+	switch ss.Role {
+	case "primary":
+		lb.First, lb.Last = 0, split-1
+	case "secondary":
+		lb.First, lb.Last = split, 255
+	default:
+		return dhcp4d.LoadBalancing{}, fmt.Errorf("split_scope on %s: role must be primary or secondary", conf.Interface)
+	}
+	return lb, nil
+}
+
+// parseFQDNPolicy parses the client_fqdn setting of a network.
+func parseFQDNPolicy(s string) (dhcp4d.FQDNPolicy, error) {
+	switch s {
+	case "", "honor":
+		return dhcp4d.FQDNHonor, nil
+	case "server":
+		return dhcp4d.FQDNServer, nil
+	case "ignore":
+		return dhcp4d.FQDNIgnore, nil
+	}
+	return 0, fmt.Errorf("client_fqdn must be honor, server or ignore")
+}
+
+// parseDuplicatePolicy parses the duplicate_hostnames setting of a network.
+func parseDuplicatePolicy(s string) (dhcp4d.DuplicatePolicy, error) {
+	switch s {
+	case "", "allow":
+		return dhcp4d.DuplicateAllow, nil
+	case "number":
+		return dhcp4d.DuplicateNumber, nil
+	case "mac":
+		return dhcp4d.DuplicateMAC, nil
+	}
+	return 0, fmt.Errorf("duplicate_hostnames must be allow, number or mac")
+}
+
+// parseAllocation parses the allocation setting of a network.
+func parseAllocation(s string) (dhcp4d.Allocation, error) {
+	switch s {
+	case "", "random":
+		return dhcp4d.AllocateRandom, nil
+	case "sequential":
+		return dhcp4d.AllocateSequential, nil
+	}
+	return 0, fmt.Errorf("allocation must be random or sequential")
+}
+
+func newTagRules(rules []config.TagRule) ([]dhcp4d.TagRule, error) {
+	tagRules := make([]dhcp4d.TagRule, 0, len(rules))
+	for _, r := range rules {
+		if r.Tag == "" {
+			return nil, fmt.Errorf("tag rule missing tag name")
+		}
+		var prefix net.HardwareAddr
+		if r.MACPrefix != "" {
+			var err error
+			prefix, err = parseMACPrefix(r.MACPrefix)
+			if err != nil {
+				return nil, fmt.Errorf("tag %s: %w", r.Tag, err)
+			}
+		}
+		if r.HasOption < 0 || r.HasOption > 255 {
+			return nil, fmt.Errorf("tag %s: invalid option code %d", r.Tag, r.HasOption)
+		}
+		tagRules = append(tagRules, dhcp4d.TagRule{
+			Tag:         r.Tag,
+			MACPrefix:   prefix,
+			VendorClass: r.VendorClass,
+			UserClass:   r.UserClass,
+			Interface:   r.Interface,
+			HasOption:   dhcp4.OptionCode(r.HasOption),
+		})
+	}
+	return tagRules, nil
 }
 
 func newUDP4BoundListener(interfaceName, laddr string) (pc net.PacketConn, e error) {
@@ -158,8 +1270,10 @@ func newUDP4BoundListener(interfaceName, laddr string) (pc net.PacketConn, e err
 	if err := syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1); err != nil {
 		return nil, err
 	}
-	if err := syscall.SetsockoptString(s, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, interfaceName); err != nil {
-		return nil, err
+	if interfaceName != "" {
+		if err := syscall.SetsockoptString(s, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, interfaceName); err != nil {
+			return nil, err
+		}
 	}
 
 	lsa := syscall.SockaddrInet4{Port: addr.Port}
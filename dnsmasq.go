@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+// dnsmasqLeases formats the unexpired leases like dnsmasq's lease file: one
+// "<expiry> <mac> <ip> <hostname> <client-id>" line per lease, with "*" for
+// a missing hostname or client id.
+func dnsmasqLeases(leases []dhcp4d.Lease, now time.Time) []byte {
+	var b bytes.Buffer
+	for _, l := range leases {
+		if !l.Expiry.After(now) {
+			continue
+		}
+		hostname := l.HostnameOverride
+		if hostname == "" {
+			hostname = l.Hostname
+		}
+		if hostname == "" || strings.ContainsAny(hostname, " \t\n") {
+			hostname = "*"
+		}
+		fmt.Fprintf(&b, "%d %s %s %s %s\n", l.Expiry.Unix(), l.HardwareAddr, l.Addr, hostname, dnsmasqClientID(l.ClientID))
+	}
+	return b.Bytes()
+}
+
+// dnsmasqClientID converts a hex encoded client id to dnsmasq's
+// colon-separated form.
+func dnsmasqClientID(id string) string {
+	if id == "" || len(id)%2 != 0 {
+		return "*"
+	}
+	parts := make([]string, 0, len(id)/2)
+	for i := 0; i < len(id); i += 2 {
+		parts = append(parts, id[i:i+2])
+	}
+	return strings.Join(parts, ":")
+}
+
+// writeDnsmasq writes the leases of every lease file to lm.dnsmasqPath.
+func (lm *leaseManager) writeDnsmasq() error {
+	b := dnsmasqLeases(lm.allLeases(), time.Now())
+	if bytes.Equal(b, lm.dnsmasqLast) {
+		return nil
+	}
+	if err := writeFileAtomic(lm.dnsmasqPath, b, 0644); err != nil {
+		return err
+	}
+	lm.dnsmasqLast = b
+	return nil
+}
+
+// allLeases returns the leases of every lease file, ordered by lease file
+// path and interface.
+func (lm *leaseManager) allLeases() []dhcp4d.Lease {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	paths := make([]string, 0, len(lm.files))
+	for p := range lm.files {
+		paths = append(paths, p)
+	}
+	slices.Sort(paths)
+	var leases []dhcp4d.Lease
+	for _, p := range paths {
+		lf := lm.files[p]
+		ifaces := make([]string, 0, len(lf.LeaseByInterface))
+		for iface := range lf.LeaseByInterface {
+			ifaces = append(ifaces, iface)
+		}
+		slices.Sort(ifaces)
+		for _, iface := range ifaces {
+			leases = append(leases, lf.LeaseByInterface[iface]...)
+		}
+	}
+	return leases
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+// dumpLeases writes the lease table of every interface to path, or to the
+// log if path is empty.
+func (d *daemon) dumpLeases(path string) {
+	handlers := d.allHandlers()
+	ifaces := make([]string, 0, len(handlers))
+	for iface := range handlers {
+		ifaces = append(ifaces, iface)
+	}
+	sort.Strings(ifaces)
+
+	if path == "" {
+		for _, iface := range ifaces {
+			for _, s := range handlers[iface].DumpLeases() {
+				slog.Info("lease table",
+					"iface", iface,
+					"offset", s.Num,
+					"ip", s.Addr,
+					"hw", s.HardwareAddr,
+					"hostname", s.Hostname,
+					"expiry", s.Expiry,
+					"last_ack", s.LastACK,
+					"flags", leaseFlags(s))
+			}
+		}
+		return
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		slog.Error("dump leases err", "err", err)
+		return
+	}
+	defer f.Close()
+	for _, iface := range ifaces {
+		writeLeaseTable(f, iface, handlers[iface].DumpLeases())
+	}
+	slog.Info("dumped lease table", "path", path)
+}
+
+func writeLeaseTable(w io.Writer, iface string, states []dhcp4d.LeaseState) {
+	fmt.Fprintf(w, "# %s (%d entries)\n", iface, len(states))
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "OFFSET\tIP\tHW\tHOSTNAME\tEXPIRY\tLAST ACK\tFLAGS")
+	for _, s := range states {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			s.Num, s.Addr, s.HardwareAddr, s.Hostname,
+			formatDumpTime(s.Expiry), formatDumpTime(s.LastACK), leaseFlags(s))
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+}
+
+func formatDumpTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func leaseFlags(s dhcp4d.LeaseState) string {
+	var flags []string
+	if s.Dangling {
+		return "dangling"
+	}
+	if s.Expired(time.Now()) {
+		flags = append(flags, "expired")
+	}
+	if s.Static {
+		flags = append(flags, "static")
+	}
+	if s.Reserved {
+		flags = append(flags, "reserved")
+	}
+	if s.Revoked {
+		flags = append(flags, "revoked")
+	}
+	if !s.Indexed {
+		flags = append(flags, "unindexed")
+	}
+	if len(flags) == 0 {
+		return "-"
+	}
+	return strings.Join(flags, ",")
+}
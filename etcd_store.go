@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+	"github.com/psanford/dhcpeterd/internal/etcd"
+)
+
+// etcdRetryInterval is how long etcd is not tried after it was unreachable.
+const etcdRetryInterval = 10 * time.Second
+
+// etcdStore is a LeaseStore that keeps a lease file's leases in etcd, for
+// replicas that share their state through an etcd cluster. Every lease is
+// its own key, attached to an etcd lease that expires KeepExpired after the
+// DHCP lease, and is updated with a transaction on its mod revision so that
+// a replica never replaces a more recently acknowledged lease. Like
+// redisStore it keeps the local lease file as a cache for when etcd is
+// unreachable.
+type etcdStore struct {
+	conf   config.Etcd
+	prefix string // of this lease file's keys
+	local  *fileStore
+	c      *etcd.Client
+
+	// etcd is written from q's goroutine, which alone uses the fields
+	// below once the leases are loaded.
+	q      *remoteQueue
+	down   time.Time         // when etcd was last unreachable
+	synced map[string]string // value last written by key
+	revs   map[string]int64  // mod revision of the keys as last seen
+}
+
+func newEtcdStore(conf config.Etcd, path string, local *fileStore) *etcdStore {
+	if conf.KeyPrefix == "" {
+		conf.KeyPrefix = "/dhcpeterd/"
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = 5 * time.Second
+	}
+	if conf.KeepExpired == 0 {
+		conf.KeepExpired = 24 * time.Hour
+	}
+	s := &etcdStore{
+		conf:   conf,
+		prefix: conf.KeyPrefix + filepath.Base(path) + "/",
+		local:  local,
+		c:      etcd.New(conf.Endpoints, conf.Username, conf.Password, conf.Timeout),
+		synced: make(map[string]string),
+		revs:   make(map[string]int64),
+	}
+	s.q = newRemoteQueue("etcd", s.saveLease, s.saveAll)
+	return s
+}
+
+func (s *etcdStore) leaseKey(iface, hw string) string {
+	return s.prefix + "lease/" + iface + "/" + hw
+}
+
+// available reports whether etcd should be tried, which it is not for a
+// while after it was unreachable.
+func (s *etcdStore) available() bool {
+	return time.Since(s.down) >= etcdRetryInterval
+}
+
+// fail notes that etcd was unreachable unless err was returned by etcd
+// itself. Everything is written again once it is back.
+func (s *etcdStore) fail(err error) {
+	if _, ok := err.(*etcd.Error); ok {
+		return
+	}
+	if s.available() {
+		slog.Warn("etcd unreachable, using local lease file", "err", err)
+	}
+	s.down = time.Now()
+	clear(s.synced)
+}
+
+func (s *etcdStore) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 2*s.conf.Timeout)
+}
+
+// Load returns the leases stored in etcd, or those of the local lease file
+// if etcd is unreachable or has none yet.
+func (s *etcdStore) Load() (*LeaseFile, error) {
+	local, err := s.local.Load()
+	if err != nil {
+		slog.Error("load lease file err", "path", s.local.path, "err", err)
+		local = newLeaseFile()
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	kvs, err := s.c.Range(ctx, s.prefix)
+	if err != nil {
+		s.fail(err)
+		slog.Warn("load leases from etcd err, using local lease file", "err", err)
+		return local, nil
+	}
+	if len(kvs) == 0 {
+		return local, nil
+	}
+
+	lf := newLeaseFile()
+	for _, kv := range kvs {
+		s.revs[kv.Key] = kv.ModRevision
+		if kv.Key == s.prefix+"state" {
+			var stored LeaseFile
+			if err := json.Unmarshal([]byte(kv.Value), &stored); err != nil {
+				return nil, fmt.Errorf("parse %s: %w", kv.Key, err)
+			}
+			if stored.ApprovedByInterface != nil {
+				lf.ApprovedByInterface = stored.ApprovedByInterface
+			}
+			if stored.HostnamesByInterface != nil {
+				lf.HostnamesByInterface = stored.HostnamesByInterface
+			}
+			if stored.Seen != nil {
+				lf.Seen = stored.Seen
+			}
+			s.synced[kv.Key] = kv.Value
+			continue
+		}
+		rest, ok := strings.CutPrefix(kv.Key, s.prefix+"lease/")
+		if !ok {
+			continue
+		}
+		var l dhcp4d.Lease
+		if err := json.Unmarshal([]byte(kv.Value), &l); err != nil {
+			slog.Error("parse etcd lease err", "key", kv.Key, "err", err)
+			continue
+		}
+		iface, _, _ := strings.Cut(rest, "/")
+		lf.LeaseByInterface[iface] = append(lf.LeaseByInterface[iface], l)
+		s.synced[kv.Key] = kv.Value
+	}
+	return lf, nil
+}
+
+// SaveLease queues l to be written to etcd right away, so that the other
+// replicas see it even if the lease file is written less often.
+func (s *etcdStore) SaveLease(iface string, l dhcp4d.Lease) error {
+	s.q.lease(iface, l)
+	return nil
+}
+
+func (s *etcdStore) saveLease(iface string, l dhcp4d.Lease) error {
+	if !s.available() {
+		return nil // written by SaveAll once etcd is back
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	if err := s.setLease(ctx, iface, l); err != nil {
+		s.fail(err)
+		return err
+	}
+	return nil
+}
+
+// setLease stores l unless etcd has a more recently acknowledged lease for
+// the same client, retrying if the key changes while it is being written.
+func (s *etcdStore) setLease(ctx context.Context, iface string, l dhcp4d.Lease) error {
+	key := s.leaseKey(iface, l.HardwareAddr)
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	if s.synced[key] == string(b) {
+		return nil
+	}
+
+	var leaseID int64
+	if !l.Expiry.IsZero() {
+		ttl := time.Until(l.Expiry) + s.conf.KeepExpired
+		if ttl <= 0 {
+			return s.deleteKey(ctx, key) // would expire right away
+		}
+		leaseID, err = s.c.Grant(ctx, ttl)
+		if err != nil {
+			return err
+		}
+	}
+
+	for attempt := 0; attempt < 3; attempt++ {
+		ok, rev, err := s.c.PutIfModRevision(ctx, key, string(b), leaseID, s.revs[key])
+		if err != nil {
+			return err
+		}
+		if ok {
+			s.revs[key] = rev
+			s.synced[key] = string(b)
+			return nil
+		}
+
+		// Changed by another replica.
+		kv, found, err := s.c.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if !found {
+			s.revs[key] = 0
+			continue
+		}
+		s.revs[key] = kv.ModRevision
+		var stored dhcp4d.Lease
+		if json.Unmarshal([]byte(kv.Value), &stored) == nil && stored.LastACK.After(l.LastACK) {
+			s.synced[key] = kv.Value
+			return nil
+		}
+	}
+	return fmt.Errorf("lease %s kept changing while being written", key)
+}
+
+func (s *etcdStore) deleteKey(ctx context.Context, key string) error {
+	if err := s.c.Delete(ctx, key); err != nil {
+		return err
+	}
+	delete(s.synced, key)
+	delete(s.revs, key)
+	return nil
+}
+
+// SaveAll writes lf to the local lease file and queues bringing etcd up to
+// date with it: changed leases are written and removed leases deleted.
+func (s *etcdStore) SaveAll(lf *LeaseFile) error {
+	if err := s.local.SaveAll(lf); err != nil {
+		return err
+	}
+	s.q.database(lf)
+	return nil
+}
+
+func (s *etcdStore) saveAll(lf *LeaseFile) error {
+	if !s.available() {
+		return nil
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	if err := s.sync(ctx, lf); err != nil {
+		s.fail(err)
+		return fmt.Errorf("etcd: %w", err)
+	}
+	return nil
+}
+
+func (s *etcdStore) sync(ctx context.Context, lf *LeaseFile) error {
+	current := make(map[string]bool)
+	for iface, leases := range lf.LeaseByInterface {
+		for _, l := range leases {
+			current[s.leaseKey(iface, l.HardwareAddr)] = true
+			if err := s.setLease(ctx, iface, l); err != nil {
+				return err
+			}
+		}
+	}
+	for key := range s.revs {
+		if strings.HasPrefix(key, s.prefix+"lease/") && !current[key] {
+			if err := s.deleteKey(ctx, key); err != nil {
+				return err
+			}
+		}
+	}
+
+	state := &LeaseFile{
+		ApprovedByInterface:  lf.ApprovedByInterface,
+		HostnamesByInterface: lf.HostnamesByInterface,
+		Seen:                 lf.Seen,
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	key := s.prefix + "state"
+	if s.synced[key] != string(b) {
+		if err := s.c.Put(ctx, key, string(b), 0); err != nil {
+			return err
+		}
+		s.synced[key] = string(b)
+	}
+	return nil
+}
+
+func (s *etcdStore) Close() error {
+	s.q.close()
+	return s.local.Close()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+// leaseEvent is the JSON representation of a lease event sent to webhooks
+// and other subscribers.
+type leaseEvent struct {
+	Event     string        `json:"event"` // offer, ack, nak, expire, release, flap, pool_warning or pool_exhausted
+	Interface string        `json:"interface"`
+	Time      time.Time     `json:"time"`
+	Lease     dhcp4d.Lease  `json:"lease"`
+	Pool      *dhcp4d.Stats `json:"pool,omitempty"`
+}
+
+func newLeaseEvent(iface string, ev dhcp4d.Event) leaseEvent {
+	return leaseEvent{
+		Event:     eventName(ev.Type),
+		Interface: iface,
+		Time:      time.Now(),
+		Lease:     ev.Lease,
+		Pool:      ev.Pool,
+	}
+}
+
+// eventName maps handler events onto the vocabulary used by subscribers,
+// which reports both new and renewed leases as "ack".
+func eventName(t dhcp4d.EventType) string {
+	switch t {
+	case dhcp4d.EventAdd, dhcp4d.EventOld:
+		return "ack"
+	default:
+		return string(t)
+	}
+}
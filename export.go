@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+// exportedLease is a row of "dhcpeterd leases export".
+type exportedLease struct {
+	Interface    string `json:"interface"`
+	IP           string `json:"ip"`
+	HardwareAddr string `json:"hardware_addr"`
+	Vendor       string `json:"vendor"`
+	Hostname     string `json:"hostname"`
+	Expiry       string `json:"expiry"` // RFC 3339, empty if the lease never expires
+}
+
+// runLeases implements "dhcpeterd leases", which currently only has the
+// export subcommand.
+func runLeases(args []string) int {
+	if len(args) == 0 || args[0] != "export" {
+		fmt.Fprintf(os.Stderr, "usage: dhcpeterd leases export [flags]\n")
+		return 2
+	}
+	return runExportLeases(args[1:])
+}
+
+// runExportLeases implements "dhcpeterd leases export": it prints every
+// lease as CSV or JSON. Leases are read from the running daemon over the
+// control socket if one is configured, and otherwise from the lease files.
+func runExportLeases(args []string) int {
+	fs := flag.NewFlagSet("leases export", flag.ExitOnError)
+	confPath := fs.String("config", "dhcpeterd.toml", "Config path")
+	format := fs.String("format", "csv", "Output format (csv or json)")
+	fromFile := fs.Bool("from-file", false, "Read the lease files even if the daemon's control socket is configured")
+	fs.Parse(args)
+	if fs.NArg() != 0 || (*format != "csv" && *format != "json") {
+		fs.Usage()
+		return 2
+	}
+
+	conf, err := config.Load(*confPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *confPath, err)
+		return 1
+	}
+
+	var leases map[string][]dhcp4d.Lease
+	if conf.ControlSocket != "" && !*fromFile {
+		leases, err = liveLeases(conf.ControlSocket)
+	} else {
+		leases, err = storedLeases(conf)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	rows := exportRows(leases)
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(rows)
+	} else {
+		err = writeLeasesCSV(os.Stdout, rows)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// liveLeases fetches the leases of the daemon listening on the control
+// socket at path.
+func liveLeases(path string) (map[string][]dhcp4d.Lease, error) {
+	hc := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+	resp, err := hc.Get("http://dhcpeterd/leases")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("list leases: unexpected status: %s", resp.Status)
+	}
+	var leases map[string][]dhcp4d.Lease
+	if err := json.NewDecoder(resp.Body).Decode(&leases); err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+// storedLeases reads the leases of the configured networks from their lease
+// files. The files are read without locking, as the daemon may be running.
+func storedLeases(conf *config.Config) (map[string][]dhcp4d.Lease, error) {
+	paths := []string{conf.LeaseFile}
+	for _, n := range conf.Networks {
+		if n.LeaseFile != "" && !slices.Contains(paths, n.LeaseFile) {
+			paths = append(paths, n.LeaseFile)
+		}
+	}
+	leases := make(map[string][]dhcp4d.Lease)
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		store, err := newFileStore(p, false)
+		if err != nil {
+			return nil, err
+		}
+		lf, err := store.Load()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		for iface, l := range lf.LeaseByInterface {
+			leases[iface] = append(leases[iface], l...)
+		}
+	}
+	return leases, nil
+}
+
+// exportRows flattens leases, ordered by interface and address.
+func exportRows(leases map[string][]dhcp4d.Lease) []exportedLease {
+	ifaces := make([]string, 0, len(leases))
+	for iface := range leases {
+		ifaces = append(ifaces, iface)
+	}
+	slices.Sort(ifaces)
+
+	rows := []exportedLease{}
+	for _, iface := range ifaces {
+		ls := slices.Clone(leases[iface])
+		slices.SortFunc(ls, func(a, b dhcp4d.Lease) int {
+			return strings.Compare(string(a.Addr.To16()), string(b.Addr.To16()))
+		})
+		for _, l := range ls {
+			hostname := l.HostnameOverride
+			if hostname == "" {
+				hostname = l.Hostname
+			}
+			var expiry string
+			if !l.Expiry.IsZero() {
+				expiry = l.Expiry.Format(time.RFC3339)
+			}
+			rows = append(rows, exportedLease{
+				Interface:    iface,
+				IP:           l.Addr.String(),
+				HardwareAddr: l.HardwareAddr,
+				Vendor:       l.Vendor,
+				Hostname:     hostname,
+				Expiry:       expiry,
+			})
+		}
+	}
+	return rows
+}
+
+func writeLeasesCSV(w io.Writer, rows []exportedLease) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"interface", "ip", "mac", "vendor", "hostname", "expiry"})
+	for _, r := range rows {
+		cw.Write([]string{r.Interface, r.IP, r.HardwareAddr, r.Vendor, r.Hostname, r.Expiry})
+	}
+	cw.Flush()
+	return cw.Error()
+}
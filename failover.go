@@ -0,0 +1,801 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+	"github.com/psanford/dhcpeterd/internal/failover"
+)
+
+const (
+	// failoverReceiveTimer is how long the partner may be silent before the
+	// connection is considered lost. It is sent to the partner, which
+	// keeps the connection alive with CONTACT messages.
+	failoverReceiveTimer = 60 * time.Second
+
+	// failoverMaxUnacked is the number of BNDUPDs the partner may send
+	// before waiting for BNDACKs.
+	failoverMaxUnacked = 10
+
+	failoverRedial = 5 * time.Second
+)
+
+func failoverDefaults(conf config.Failover) config.Failover {
+	if conf.Listen == "" {
+		conf.Listen = ":" + strconv.Itoa(failover.DefaultPort)
+	}
+	if _, _, err := net.SplitHostPort(conf.Peer); err != nil {
+		conf.Peer = net.JoinHostPort(conf.Peer, strconv.Itoa(failover.DefaultPort))
+	}
+	if conf.MCLT == 0 {
+		conf.MCLT = time.Hour
+	}
+	if conf.LoadBalanceMaxSeconds == 0 {
+		conf.LoadBalanceMaxSeconds = 3
+	}
+	return conf
+}
+
+// failoverBinding is what the failover partner knows about an address.
+type failoverBinding struct {
+	status failover.BindingStatus
+	hw     string
+	expiry time.Time // lease expiration time
+
+	// acked is the potential expiration time the partner has
+	// acknowledged, which leases may be extended to.
+	acked time.Time
+
+	// seq counts local changes; pending is set until the partner has
+	// acknowledged the latest one.
+	seq     int
+	pending bool
+}
+
+// failoverUpdate is a BNDUPD waiting for its BNDACK.
+type failoverUpdate struct {
+	ip        string
+	seq       int
+	potential time.Time
+}
+
+// failoverPeer is the secondary of an ISC dhcpd failover relationship. It
+// applies the primary's binding updates to the handlers of the networks
+// that take part, sends back the leases they grant and restricts them to
+// the addresses and lease periods allowed by the protocol.
+type failoverPeer struct {
+	conf  config.Failover
+	d     *daemon
+	queue chan dhcp4d.Event
+
+	// Only used by the loop goroutine.
+	partnerState failover.ServerState
+	maxUnacked   int
+	contact      time.Duration
+	outgoing     []string // addresses with pending updates, in order
+	unacked      map[uint32]failoverUpdate
+	xid          uint32
+	updDone      bool // send UPDDONE once all updates are acknowledged
+	recoverWait  <-chan time.Time
+
+	mu       sync.Mutex
+	bindings map[string]*failoverBinding // by address
+	state    failover.ServerState
+	mclt     time.Duration
+	hba      []byte // hash buckets served by the primary
+}
+
+func newFailoverPeer(conf config.Failover, d *daemon) *failoverPeer {
+	conf = failoverDefaults(conf)
+	return &failoverPeer{
+		conf:     conf,
+		d:        d,
+		queue:    make(chan dhcp4d.Event, 1024),
+		bindings: make(map[string]*failoverBinding),
+		state:    failover.Recover,
+		mclt:     conf.MCLT,
+	}
+}
+
+// send is the event sink recording the leases granted by the handlers.
+func (p *failoverPeer) send(iface string, ev dhcp4d.Event) {
+	switch ev.Type {
+	case dhcp4d.EventAdd, dhcp4d.EventOld, dhcp4d.EventRelease, dhcp4d.EventExpire:
+	default:
+		return
+	}
+	select {
+	case p.queue <- ev:
+	default:
+		slog.Warn("failover queue full, dropping lease update", "ip", ev.Lease.Addr)
+	}
+}
+
+// allocatable reports whether ip may be given to a new client: only
+// addresses the primary has handed over for backup may.
+func (p *failoverPeer) allocatable(ip net.IP) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b, ok := p.bindings[ip.String()]
+	return ok && b.status == failover.Backup
+}
+
+// leaseLimit returns the longest lease period that may be granted for ip:
+// up to the potential expiration time acknowledged by the partner, and no
+// more than MCLT beyond it otherwise.
+func (p *failoverPeer) leaseLimit(ip net.IP) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	limit := p.mclt
+	if b, ok := p.bindings[ip.String()]; ok {
+		limit = max(limit, time.Until(b.acked))
+	}
+	return limit
+}
+
+// loadBalancing returns the load balancing of the current state: the
+// buckets not served by the primary while in the normal state, none
+// otherwise.
+func (p *failoverPeer) loadBalancing() *dhcp4d.LoadBalancing {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state != failover.Normal || p.hba == nil {
+		return nil
+	}
+	lb, err := hbaLoadBalancing(p.hba, p.conf.LoadBalanceMaxSeconds)
+	if err != nil {
+		slog.Warn("failover: ignoring hash bucket assignment", "err", err)
+		return nil
+	}
+	return lb
+}
+
+// hbaLoadBalancing returns the load balancing serving the buckets that are
+// not set in hba, the buckets of the primary. They must be contiguous, as
+// they are for the split of ISC dhcpd.
+func hbaLoadBalancing(hba []byte, secs int) (*dhcp4d.LoadBalancing, error) {
+	if len(hba) != 32 {
+		return nil, fmt.Errorf("hash bucket assignment of %d bytes", len(hba))
+	}
+	first, last := -1, -1
+	for i := 0; i < 256; i++ {
+		if hba[i/8]&(1<<(i%8)) != 0 {
+			continue
+		}
+		if first < 0 {
+			first = i
+		} else if last != i-1 {
+			return nil, errors.New("buckets are not contiguous")
+		}
+		last = i
+	}
+	if first < 0 {
+		// The primary serves every client; still answer those it leaves
+		// waiting.
+		return &dhcp4d.LoadBalancing{First: 256, Last: 256, SecsThreshold: secs}, nil
+	}
+	return &dhcp4d.LoadBalancing{First: first, Last: last, SecsThreshold: secs}, nil
+}
+
+// handlerForIP returns the handler of the failover network containing ip.
+func (d *daemon) handlerForIP(ip net.IP) *dhcp4d.Handler {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for iface, nw := range d.networks {
+		if !nw.conf.Failover {
+			continue
+		}
+		mask := parseNetMask(nw.conf.NetMask)
+		start := net.ParseIP(nw.conf.StartIP).To4()
+		if mask == nil || start == nil {
+			continue
+		}
+		subnet := net.IPNet{IP: start.Mask(mask), Mask: mask}
+		if subnet.Contains(ip) {
+			return d.handlers[iface]
+		}
+	}
+	return nil
+}
+
+// failoverHandlers returns the handlers of the failover networks.
+func (d *daemon) failoverHandlers() []*dhcp4d.Handler {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var handlers []*dhcp4d.Handler
+	for iface, nw := range d.networks {
+		if h, ok := d.handlers[iface]; ok && nw.conf.Failover {
+			handlers = append(handlers, h)
+		}
+	}
+	return handlers
+}
+
+type failoverConn struct {
+	net.Conn
+	dialed bool
+}
+
+func (p *failoverPeer) loop(ctx context.Context, l net.Listener) {
+	conns := make(chan failoverConn)
+	var connected sync.Mutex // held while a connection is in use
+	if l != nil {
+		go p.accept(ctx, l, conns)
+	}
+	go p.dial(ctx, conns, &connected)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-p.queue:
+			p.record(ev)
+		case conn := <-conns:
+			connected.Lock()
+			err := p.session(ctx, conn, conns)
+			conn.Close()
+			connected.Unlock()
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("failover peer disconnected", "addr", conn.RemoteAddr(), "err", err)
+			p.disconnected()
+		}
+	}
+}
+
+func (p *failoverPeer) accept(ctx context.Context, l net.Listener, conns chan<- failoverConn) {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	slog.Info("failover listen", "addr", p.conf.Listen)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("failover accept err", "err", err)
+			}
+			return
+		}
+		select {
+		case conns <- failoverConn{Conn: conn}:
+		case <-ctx.Done():
+			conn.Close()
+			return
+		}
+	}
+}
+
+// dial connects to the partner whenever there is no connection.
+func (p *failoverPeer) dial(ctx context.Context, conns chan<- failoverConn, connected *sync.Mutex) {
+	d := net.Dialer{Timeout: 10 * time.Second}
+	for {
+		if connected.TryLock() {
+			connected.Unlock()
+			conn, err := d.DialContext(ctx, "tcp", p.conf.Peer)
+			if err == nil {
+				select {
+				case conns <- failoverConn{Conn: conn, dialed: true}:
+				case <-ctx.Done():
+					conn.Close()
+					return
+				}
+			} else if ctx.Err() == nil {
+				slog.Debug("failover dial err", "peer", p.conf.Peer, "err", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(failoverRedial):
+		}
+	}
+}
+
+// session runs the protocol on conn until it fails. Connections made
+// meanwhile are refused.
+func (p *failoverPeer) session(ctx context.Context, conn failoverConn, conns <-chan failoverConn) error {
+	conn.SetDeadline(time.Now().Add(failoverReceiveTimer))
+	if err := p.connect(conn); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	slog.Info("failover peer connected", "addr", conn.RemoteAddr(), "state", p.currentState())
+
+	msgs := make(chan *failover.Message)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			conn.SetReadDeadline(time.Now().Add(failoverReceiveTimer))
+			m, err := failover.ReadMessage(conn)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case msgs <- m:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	p.unacked = make(map[uint32]failoverUpdate)
+	p.updDone = false
+	p.outgoing = p.pendingAddrs()
+	if err := p.startSync(conn); err != nil {
+		return err
+	}
+	contact := time.NewTicker(p.contact)
+	defer contact.Stop()
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			m := p.message(failover.Disconnect)
+			m.AddByte(failover.OptionRejectReason, failover.RejectUnknown)
+			m.Add(failover.OptionMessage, []byte("shutting down"))
+			p.write(conn, m)
+			return nil
+		case err := <-readErr:
+			return err
+		case other := <-conns:
+			other.Close()
+		case <-contact.C:
+			err = p.write(conn, p.message(failover.Contact))
+		case <-p.recoverWait:
+			p.recoverWait = nil
+			err = p.setState(conn, failover.RecoverDone)
+		case ev := <-p.queue:
+			p.record(ev)
+			err = p.pump(conn)
+		case m := <-msgs:
+			err = p.handle(conn, m)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (p *failoverPeer) message(t failover.MessageType) *failover.Message {
+	p.xid++
+	return &failover.Message{Type: t, Time: time.Now(), XID: p.xid}
+}
+
+func (p *failoverPeer) write(conn net.Conn, m *failover.Message) error {
+	b, err := m.Encode()
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(failoverReceiveTimer))
+	_, err = conn.Write(b)
+	return err
+}
+
+func (p *failoverPeer) currentState() failover.ServerState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state
+}
+
+// connect exchanges CONNECT and CONNECTACK; the side that made the TCP
+// connection sends the CONNECT.
+func (p *failoverPeer) connect(conn failoverConn) error {
+	if conn.dialed {
+		m := p.message(failover.Connect)
+		m.Add(failover.OptionRelationshipName, []byte(p.conf.Name))
+		m.AddUint32(failover.OptionMaxUnackedBndUpd, failoverMaxUnacked)
+		m.AddUint32(failover.OptionReceiveTimer, uint32(failoverReceiveTimer/time.Second))
+		m.Add(failover.OptionVendorClass, []byte("dhcpeterd"))
+		m.AddByte(failover.OptionProtocolVersion, failover.Version)
+		m.Add(failover.OptionTLSRequest, []byte{0, 0})
+		if err := p.write(conn, m); err != nil {
+			return err
+		}
+		ack, err := failover.ReadMessage(conn)
+		if err != nil {
+			return err
+		}
+		if ack.Type != failover.ConnectAck {
+			return fmt.Errorf("got %v instead of CONNECTACK", ack.Type)
+		}
+		if reason, ok := ack.Byte(failover.OptionRejectReason); ok {
+			msg, _ := ack.Get(failover.OptionMessage)
+			return fmt.Errorf("connection rejected: reason %d: %s", reason, msg)
+		}
+		return p.connected(ack)
+	}
+
+	m, err := failover.ReadMessage(conn)
+	if err != nil {
+		return err
+	}
+	if m.Type != failover.Connect {
+		return fmt.Errorf("got %v instead of CONNECT", m.Type)
+	}
+	ack := p.message(failover.ConnectAck)
+	ack.XID = m.XID
+	ack.AddUint32(failover.OptionMaxUnackedBndUpd, failoverMaxUnacked)
+	ack.AddUint32(failover.OptionReceiveTimer, uint32(failoverReceiveTimer/time.Second))
+	ack.Add(failover.OptionVendorClass, []byte("dhcpeterd"))
+	ack.AddByte(failover.OptionProtocolVersion, failover.Version)
+	ack.Add(failover.OptionTLSReply, []byte{0})
+	if name, ok := m.Get(failover.OptionRelationshipName); ok && string(name) != p.conf.Name {
+		ack.AddByte(failover.OptionRejectReason, failover.RejectInvalidPartner)
+		p.write(conn, ack)
+		return fmt.Errorf("connection from unknown relationship %q", name)
+	}
+	if v, ok := m.Byte(failover.OptionProtocolVersion); ok && v != failover.Version {
+		ack.AddByte(failover.OptionRejectReason, failover.RejectVersionMismatch)
+		p.write(conn, ack)
+		return fmt.Errorf("unsupported protocol version %d", v)
+	}
+	if err := p.write(conn, ack); err != nil {
+		return err
+	}
+	return p.connected(m)
+}
+
+// connected applies the parameters of the partner's CONNECT or
+// CONNECTACK.
+func (p *failoverPeer) connected(m *failover.Message) error {
+	p.maxUnacked = failoverMaxUnacked
+	if n, ok := m.Uint32(failover.OptionMaxUnackedBndUpd); ok && n > 0 {
+		p.maxUnacked = int(n)
+	}
+	// Send CONTACTs well within the partner's receive timer.
+	p.contact = failoverReceiveTimer / 3
+	if secs, ok := m.Uint32(failover.OptionReceiveTimer); ok && secs > 0 {
+		p.contact = time.Duration(secs) * time.Second / 3
+	}
+	p.partnerState = 0
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if secs, ok := m.Uint32(failover.OptionMCLT); ok && secs > 0 {
+		p.mclt = time.Duration(secs) * time.Second
+	}
+	if hba, ok := m.Get(failover.OptionHashBucketAssignment); ok {
+		p.hba = append([]byte(nil), hba...)
+	}
+	return nil
+}
+
+// startSync announces the state and asks for the bindings missed while
+// disconnected: all of them when recovering.
+func (p *failoverPeer) startSync(conn net.Conn) error {
+	p.mu.Lock()
+	state := p.state
+	if state != failover.CommunicationsInterrupted {
+		state = failover.Recover
+	}
+	p.mu.Unlock()
+	if err := p.setState(conn, state); err != nil {
+		return err
+	}
+	req := failover.UpdReq
+	if state == failover.Recover {
+		req = failover.UpdReqAll
+	}
+	if err := p.write(conn, p.message(req)); err != nil {
+		return err
+	}
+	return p.pump(conn)
+}
+
+// setState changes the state and tells the partner.
+func (p *failoverPeer) setState(conn net.Conn, state failover.ServerState) error {
+	p.mu.Lock()
+	prev := p.state
+	p.state = state
+	p.mu.Unlock()
+	if prev != state {
+		slog.Info("failover state", "state", state, "prev", prev)
+		p.applyLoadBalancing()
+	}
+	if conn == nil {
+		return nil
+	}
+	m := p.message(failover.State)
+	m.AddByte(failover.OptionServerState, byte(state))
+	m.AddByte(failover.OptionServerFlags, 0)
+	m.AddTimestamp(failover.OptionStartTimeOfState, time.Now())
+	return p.write(conn, m)
+}
+
+func (p *failoverPeer) applyLoadBalancing() {
+	lb := p.loadBalancing()
+	for _, h := range p.d.failoverHandlers() {
+		h.SetLoadBalancing(lb)
+	}
+}
+
+func (p *failoverPeer) disconnected() {
+	if p.currentState() == failover.Normal {
+		p.setState(nil, failover.CommunicationsInterrupted)
+	}
+	p.recoverWait = nil
+}
+
+func (p *failoverPeer) handle(conn net.Conn, m *failover.Message) error {
+	switch m.Type {
+	case failover.BndUpd:
+		return p.write(conn, p.bindingUpdate(m))
+	case failover.BndAck:
+		p.bindingAck(m)
+		return p.pump(conn)
+	case failover.UpdReqAll:
+		p.queueAll()
+		p.updDone = true
+		return p.pump(conn)
+	case failover.UpdReq:
+		p.updDone = true
+		return p.pump(conn)
+	case failover.UpdDone:
+		switch p.currentState() {
+		case failover.Recover:
+			// Wait for the leases the partner granted before it knew
+			// of this server's to run out.
+			p.recoverWait = time.After(p.mclt)
+			return p.setState(conn, failover.RecoverWait)
+		case failover.CommunicationsInterrupted:
+			return p.normal(conn)
+		}
+	case failover.State:
+		s, _ := m.Byte(failover.OptionServerState)
+		p.partnerState = failover.ServerState(s)
+		slog.Info("failover partner state", "state", p.partnerState)
+		if p.partnerState == failover.Normal && p.currentState() == failover.RecoverDone {
+			return p.normal(conn)
+		}
+	case failover.PoolResp:
+		n, _ := m.Uint32(failover.OptionAddressesTransferred)
+		slog.Info("failover pool response", "addresses", n)
+	case failover.Contact:
+	case failover.Disconnect:
+		msg, _ := m.Get(failover.OptionMessage)
+		return fmt.Errorf("partner disconnected: %s", msg)
+	default:
+		slog.Debug("failover: ignoring message", "type", m.Type)
+	}
+	return nil
+}
+
+// normal enters the normal state and asks the primary for addresses to
+// allocate from.
+func (p *failoverPeer) normal(conn net.Conn) error {
+	if err := p.setState(conn, failover.Normal); err != nil {
+		return err
+	}
+	return p.write(conn, p.message(failover.PoolReq))
+}
+
+// bindingUpdate applies a BNDUPD from the partner and returns the BNDACK.
+func (p *failoverPeer) bindingUpdate(m *failover.Message) *failover.Message {
+	ack := p.message(failover.BndAck)
+	ack.XID = m.XID
+	for _, o := range m.Options {
+		if o.Code != failover.OptionMessageDigest {
+			ack.Options = append(ack.Options, o)
+		}
+	}
+	reject := func(reason byte) *failover.Message {
+		ack.AddByte(failover.OptionRejectReason, reason)
+		return ack
+	}
+
+	ip, ok := m.IP(failover.OptionAssignedIPAddress)
+	if !ok {
+		return reject(failover.RejectMissingBindInfo)
+	}
+	h := p.d.handlerForIP(ip)
+	if h == nil {
+		return reject(failover.RejectIllegalIPAddr)
+	}
+	s, _ := m.Byte(failover.OptionBindingStatus)
+	status := failover.BindingStatus(s)
+	hw, _ := m.HardwareAddr()
+	expiry, _ := m.Timestamp(failover.OptionLeaseExpirationTime)
+	potential, _ := m.Timestamp(failover.OptionPotentialExpirationTime)
+	cltt, _ := m.Timestamp(failover.OptionClientLastTransactionTime)
+	if status == failover.Active && hw == nil {
+		return reject(failover.RejectMissingBindInfo)
+	}
+
+	p.mu.Lock()
+	b, ok := p.bindings[ip.String()]
+	if !ok {
+		b = &failoverBinding{}
+		p.bindings[ip.String()] = b
+	}
+	b.status = status
+	b.expiry = expiry
+	b.acked = potential
+	if expiry.After(potential) {
+		b.acked = expiry
+	}
+	if hw != nil {
+		b.hw = hw.String()
+	}
+	b.pending = false
+	p.mu.Unlock()
+
+	if status == failover.Active {
+		l := dhcp4d.Lease{Addr: ip, HardwareAddr: hw.String(), Expiry: expiry, LastACK: cltt}
+		if id, ok := m.Get(failover.OptionClientIdentifier); ok {
+			l.ClientID = hex.EncodeToString(id)
+		}
+		h.PutLease(l)
+		return ack
+	}
+	// The address is no longer leased.
+	if l, ok := h.LeaseByIP(ip); ok && !l.Expired(time.Now()) {
+		l.Expiry = time.Now()
+		h.PutLease(l)
+	}
+	return ack
+}
+
+func (p *failoverPeer) bindingAck(m *failover.Message) {
+	u, ok := p.unacked[m.XID]
+	if !ok {
+		return
+	}
+	delete(p.unacked, m.XID)
+	if reason, ok := m.Byte(failover.OptionRejectReason); ok {
+		msg, _ := m.Get(failover.OptionMessage)
+		slog.Warn("failover partner rejected binding update", "ip", u.ip, "reason", reason, "msg", string(msg))
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if b, ok := p.bindings[u.ip]; ok {
+		b.acked = u.potential
+		if b.seq == u.seq {
+			b.pending = false
+		}
+	}
+}
+
+// record notes a change to a lease granted by this server.
+func (p *failoverPeer) record(ev dhcp4d.Event) {
+	l := ev.Lease
+	if l.Addr.To4() == nil || p.d.handlerForIP(l.Addr) == nil {
+		return
+	}
+	status := failover.Active
+	switch ev.Type {
+	case dhcp4d.EventRelease:
+		status = failover.Released
+	case dhcp4d.EventExpire:
+		status = failover.Expired
+	}
+	p.recordLease(l, status)
+}
+
+func (p *failoverPeer) recordLease(l dhcp4d.Lease, status failover.BindingStatus) {
+	ip := l.Addr.String()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b, ok := p.bindings[ip]
+	if !ok {
+		b = &failoverBinding{}
+		p.bindings[ip] = b
+	}
+	b.status = status
+	b.hw = l.HardwareAddr
+	b.expiry = l.Expiry
+	b.seq++
+	if !b.pending {
+		b.pending = true
+		p.outgoing = append(p.outgoing, ip)
+	}
+}
+
+// pendingAddrs returns the addresses whose updates have not been
+// acknowledged, to be sent again on a new connection.
+func (p *failoverPeer) pendingAddrs() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var addrs []string
+	for ip, b := range p.bindings {
+		if b.pending {
+			addrs = append(addrs, ip)
+		}
+	}
+	return addrs
+}
+
+// queueAll queues an update for every lease of the failover networks.
+func (p *failoverPeer) queueAll() {
+	now := time.Now()
+	for _, h := range p.d.failoverHandlers() {
+		for _, l := range h.ListLeases() {
+			status := failover.Active
+			if l.Expired(now) {
+				status = failover.Expired
+			}
+			p.recordLease(l, status)
+		}
+	}
+}
+
+// pump sends pending binding updates while the partner accepts more, and
+// UPDDONE once all requested updates have been acknowledged.
+func (p *failoverPeer) pump(conn net.Conn) error {
+	for len(p.unacked) < p.maxUnacked && len(p.outgoing) > 0 {
+		ip := p.outgoing[0]
+		p.outgoing = p.outgoing[1:]
+		m, u, ok := p.bindingMessage(ip)
+		if !ok {
+			continue
+		}
+		p.unacked[m.XID] = u
+		if err := p.write(conn, m); err != nil {
+			return err
+		}
+	}
+	if p.updDone && len(p.unacked) == 0 && len(p.outgoing) == 0 {
+		p.updDone = false
+		return p.write(conn, p.message(failover.UpdDone))
+	}
+	return nil
+}
+
+// bindingMessage returns the BNDUPD for the binding of ip, if it is still
+// pending.
+func (p *failoverPeer) bindingMessage(ip string) (*failover.Message, failoverUpdate, bool) {
+	addr := net.ParseIP(ip).To4()
+	var (
+		lease    dhcp4d.Lease
+		hasLease bool
+		period   time.Duration
+	)
+	if h := p.d.handlerForIP(addr); h != nil {
+		lease, hasLease = h.LeaseByIP(addr)
+		period = h.LeasePeriod
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b, ok := p.bindings[ip]
+	if !ok || !b.pending {
+		return nil, failoverUpdate{}, false
+	}
+	m := p.message(failover.BndUpd)
+	m.Add(failover.OptionAssignedIPAddress, addr)
+	m.AddByte(failover.OptionBindingStatus, byte(b.status))
+	if hw, err := net.ParseMAC(b.hw); err == nil {
+		m.AddHardwareAddr(hw)
+	}
+	u := failoverUpdate{ip: ip, seq: b.seq, potential: b.expiry}
+	if b.status == failover.Active {
+		m.AddTimestamp(failover.OptionLeaseExpirationTime, b.expiry)
+		if hasLease && lease.HardwareAddr == b.hw {
+			// Ask for enough to renew the lease for a full period once
+			// the client renews halfway through it, as ISC dhcpd does.
+			granted := lease.Expiry.Sub(lease.LastACK)
+			if full := lease.LastACK.Add(period + granted/2); full.After(u.potential) {
+				u.potential = full
+			}
+			m.AddTimestamp(failover.OptionClientLastTransactionTime, lease.LastACK)
+			if id, err := hex.DecodeString(lease.ClientID); err == nil && len(id) > 0 {
+				m.Add(failover.OptionClientIdentifier, id)
+			}
+		}
+		if !b.expiry.IsZero() {
+			m.AddTimestamp(failover.OptionPotentialExpirationTime, u.potential)
+		}
+	}
+	return m, u, true
+}
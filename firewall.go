@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+// firewallSets keeps the addresses of active leases in the configured
+// nftables sets and ipsets. Commands are run one at a time in the order the
+// events occurred.
+type firewallSets struct {
+	sets   []*firewallSet
+	events chan ifaceEvent
+}
+
+type firewallSet struct {
+	conf    config.FirewallSet
+	nft     []string        // family, table and set name, for nft
+	members map[string]bool // addresses added to the set
+}
+
+func newFirewallSets(conf []config.FirewallSet) (*firewallSets, error) {
+	f := &firewallSets{events: make(chan ifaceEvent, 128)}
+	for _, c := range conf {
+		s := &firewallSet{conf: c, members: make(map[string]bool)}
+		switch c.Backend {
+		case "", "nft":
+			s.nft = strings.Fields(c.Set)
+			if len(s.nft) != 3 {
+				return nil, fmt.Errorf("firewall set %q: nft sets are given as \"family table set\"", c.Set)
+			}
+		case "ipset":
+			if c.Set == "" {
+				return nil, fmt.Errorf("firewall set requires set")
+			}
+		default:
+			return nil, fmt.Errorf("firewall set %q: unknown backend %q", c.Set, c.Backend)
+		}
+		f.sets = append(f.sets, s)
+	}
+	return f, nil
+}
+
+func (f *firewallSets) send(iface string, ev dhcp4d.Event) {
+	switch ev.Type {
+	case dhcp4d.EventAdd, dhcp4d.EventOld, dhcp4d.EventRelease, dhcp4d.EventExpire:
+	default:
+		return
+	}
+	select {
+	case f.events <- ifaceEvent{iface: iface, ev: ev}:
+	default:
+		slog.Error("firewall set queue full, dropping event", "type", ev.Type, "hw", ev.Lease.HardwareAddr)
+	}
+}
+
+// loop populates the sets with the active leases of the networks of d, which
+// should have been started, and then applies lease events until ctx is done.
+func (f *firewallSets) loop(ctx context.Context, d *daemon) {
+	ready := make(chan struct{})
+	go func() {
+		d.bound.Wait()
+		close(ready)
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ready:
+			ready = nil
+			f.sync(ctx, d.allHandlers())
+		case e := <-f.events:
+			f.apply(ctx, e.ev)
+		}
+	}
+}
+
+// sync replaces the contents of the sets with the matching active leases
+// of handlers.
+func (f *firewallSets) sync(ctx context.Context, handlers map[string]*dhcp4d.Handler) {
+	now := time.Now()
+	for _, s := range f.sets {
+		if err := s.flush(ctx); err != nil {
+			continue
+		}
+		clear(s.members)
+		for _, h := range handlers {
+			for _, l := range h.ListLeases() {
+				if !l.Unknown && !l.Expired(now) && s.matches(l) {
+					s.add(ctx, l.Addr.String())
+				}
+			}
+		}
+	}
+}
+
+func (f *firewallSets) apply(ctx context.Context, ev dhcp4d.Event) {
+	ip := ev.Lease.Addr.String()
+	for _, s := range f.sets {
+		switch {
+		case (ev.Type == dhcp4d.EventAdd || ev.Type == dhcp4d.EventOld) && s.matches(ev.Lease):
+			if !s.members[ip] {
+				s.add(ctx, ip)
+			}
+		case s.members[ip]:
+			// Released, expired, or no longer of the set's class or tag.
+			s.remove(ctx, ip)
+		}
+	}
+}
+
+func (s *firewallSet) matches(l dhcp4d.Lease) bool {
+	return (s.conf.Class == "" || l.Class == s.conf.Class) &&
+		(s.conf.Tag == "" || slices.Contains(l.Tags, s.conf.Tag))
+}
+
+func (s *firewallSet) add(ctx context.Context, ip string) {
+	args := []string{"-exist", "add", s.conf.Set, ip}
+	if s.nft != nil {
+		args = append([]string{"add", "element"}, append(s.nft, "{ "+ip+" }")...)
+	}
+	if s.run(ctx, args...) == nil {
+		s.members[ip] = true
+	}
+}
+
+func (s *firewallSet) remove(ctx context.Context, ip string) {
+	args := []string{"-exist", "del", s.conf.Set, ip}
+	if s.nft != nil {
+		args = append([]string{"delete", "element"}, append(s.nft, "{ "+ip+" }")...)
+	}
+	s.run(ctx, args...)
+	delete(s.members, ip)
+}
+
+func (s *firewallSet) flush(ctx context.Context) error {
+	args := []string{"flush", s.conf.Set}
+	if s.nft != nil {
+		args = append([]string{"flush", "set"}, s.nft...)
+	}
+	return s.run(ctx, args...)
+}
+
+// run runs the set's backend command with args.
+func (s *firewallSet) run(ctx context.Context, args ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+	name := "ipset"
+	if s.nft != nil {
+		name = "nft"
+	}
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		slog.Error("firewall set err", "set", s.conf.Set, "args", args, "err", err, "output", strings.TrimSpace(string(out)))
+	}
+	return err
+}
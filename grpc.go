@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+	pb "github.com/psanford/dhcpeterd/proto/dhcpeterd/v1"
+)
+
+// grpcServer serves the Admin service of proto/dhcpeterd/v1 with the same
+// handlers and events as the HTTP API.
+type grpcServer struct {
+	pb.UnimplementedAdminServer
+	api    *apiServer
+	events *eventHub
+}
+
+func newGRPCServer(api *apiServer, events *eventHub) *grpcServer {
+	return &grpcServer{api: api, events: events}
+}
+
+// grpcScopes is the scope needed by each method. Methods not listed need
+// write scope.
+var grpcScopes = map[string]scope{
+	pb.Admin_ListLeases_FullMethodName:  scopeRead,
+	pb.Admin_GetLease_FullMethodName:    scopeRead,
+	pb.Admin_WatchEvents_FullMethodName: scopeRead,
+}
+
+// serve serves the service on l, authorized by auth like the HTTP API:
+// with its TLS settings, client certificates and bearer tokens sent in the
+// authorization metadata.
+func (s *grpcServer) serve(ctx context.Context, l net.Listener, auth *apiAuth) error {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := auth.authorizeRPC(ctx, info.FullMethod); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := auth.authorizeRPC(ss.Context(), info.FullMethod); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	}
+	if auth.tlsEnabled {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(auth.tlsConfig)))
+	}
+	if !auth.enabled() {
+		slog.Warn("grpc api has no authentication configured", "addr", l.Addr())
+	}
+	srv := grpc.NewServer(opts...)
+	pb.RegisterAdminServer(srv, s)
+	go func() {
+		<-ctx.Done()
+		srv.Stop()
+	}()
+	slog.Info("grpc listen", "addr", l.Addr(), "tls", auth.tlsEnabled)
+	return srv.Serve(l)
+}
+
+// authorizeRPC returns an error unless the caller of method has the scope
+// it needs.
+func (a *apiAuth) authorizeRPC(ctx context.Context, method string) error {
+	if !a.enabled() {
+		return nil
+	}
+	need, ok := grpcScopes[method]
+	if !ok {
+		need = scopeWrite
+	}
+	got := scopeNone
+	if p, ok := peer.FromContext(ctx); ok && a.clientCA {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+			got = a.certScope
+		}
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		if token, ok := strings.CutPrefix(v, "Bearer "); ok {
+			got = max(got, a.tokenScope(token))
+		}
+	}
+	switch {
+	case got >= need:
+		return nil
+	case got == scopeNone:
+		return status.Error(codes.Unauthenticated, "unauthorized")
+	default:
+		return status.Error(codes.PermissionDenied, "insufficient scope")
+	}
+}
+
+func (s *grpcServer) ListLeases(ctx context.Context, req *pb.ListLeasesRequest) (*pb.ListLeasesResponse, error) {
+	handlers := s.api.d.allHandlers()
+	if req.Interface != "" {
+		h, ok := handlers[req.Interface]
+		if !ok {
+			return nil, status.Error(codes.NotFound, "unknown interface")
+		}
+		handlers = map[string]*dhcp4d.Handler{req.Interface: h}
+	}
+	resp := &pb.ListLeasesResponse{}
+	for iface, h := range handlers {
+		for _, l := range h.ListLeases() {
+			resp.Leases = append(resp.Leases, &pb.InterfaceLease{Interface: iface, Lease: leaseProto(l)})
+		}
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) GetLease(ctx context.Context, req *pb.GetLeaseRequest) (*pb.InterfaceLease, error) {
+	hw, err := rpcMAC(req.HardwareAddr)
+	if err != nil {
+		return nil, err
+	}
+	iface, l, ok := s.api.findLease(hw)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "no lease for "+hw)
+	}
+	return &pb.InterfaceLease{Interface: iface, Lease: leaseProto(l)}, nil
+}
+
+func (s *grpcServer) DeleteLease(ctx context.Context, req *pb.DeleteLeaseRequest) (*pb.DeleteLeaseResponse, error) {
+	hw, err := rpcMAC(req.HardwareAddr)
+	if err != nil {
+		return nil, err
+	}
+	iface, _, ok := s.api.findLease(hw)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "no lease for "+hw)
+	}
+	h, ok := s.api.d.handler(iface)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "no lease for "+hw)
+	}
+	h.DeleteLease(hw)
+	slog.Info("deleted lease", "iface", iface, "hw", hw)
+	return &pb.DeleteLeaseResponse{}, nil
+}
+
+func (s *grpcServer) SetHostname(ctx context.Context, req *pb.SetHostnameRequest) (*pb.InterfaceLease, error) {
+	hw, err := rpcMAC(req.HardwareAddr)
+	if err != nil {
+		return nil, err
+	}
+	iface, _, ok := s.api.findLease(hw)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "no lease for "+hw)
+	}
+	h, ok := s.api.d.handler(iface)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "no lease for "+hw)
+	}
+	if err := h.SetHostname(hw, req.Hostname); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	l, _ := h.Lease(hw)
+	return &pb.InterfaceLease{Interface: iface, Lease: leaseProto(l)}, nil
+}
+
+func (s *grpcServer) WatchEvents(req *pb.WatchEventsRequest, stream pb.Admin_WatchEventsServer) error {
+	sub := s.events.subscribe()
+	defer s.events.unsubscribe(sub)
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case ev := <-sub:
+			if req.Interface != "" && ev.Interface != req.Interface {
+				continue
+			}
+			err := stream.Send(&pb.LeaseEvent{
+				Event:     ev.Event,
+				Interface: ev.Interface,
+				Time:      timestamppb.New(ev.Time),
+				Lease:     leaseProto(ev.Lease),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// rpcMAC returns the normalized hardware address hw.
+func rpcMAC(hw string) (string, error) {
+	mac, err := net.ParseMAC(hw)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, "invalid mac address")
+	}
+	return mac.String(), nil
+}
+
+func leaseProto(l dhcp4d.Lease) *pb.Lease {
+	p := &pb.Lease{
+		Num:              int32(l.Num),
+		HardwareAddr:     l.HardwareAddr,
+		Hostname:         l.Hostname,
+		HostnameOverride: l.HostnameOverride,
+		Class:            l.Class,
+		Tags:             l.Tags,
+		Vendor:           l.Vendor,
+		DeviceType:       l.DeviceType,
+		ClientHostname:   l.ClientHostname,
+		ClientId:         l.ClientID,
+		Randomized:       l.Randomized,
+		DeviceId:         l.DeviceID,
+	}
+	if l.Addr != nil {
+		p.Addr = l.Addr.String()
+	}
+	if !l.Expiry.IsZero() {
+		p.Expiry = timestamppb.New(l.Expiry)
+	}
+	if !l.LastACK.IsZero() {
+		p.LastAck = timestamppb.New(l.LastACK)
+	}
+	return p
+}
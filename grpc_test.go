@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/psanford/dhcpeterd/proto/dhcpeterd/v1"
+)
+
+func TestAuthorizeRPC(t *testing.T) {
+	a := &apiAuth{tokens: map[string]scope{"reader": scopeRead, "writer": scopeWrite}}
+
+	for _, tt := range []struct {
+		method, token string
+		want          codes.Code
+	}{
+		{method: pb.Admin_ListLeases_FullMethodName, want: codes.Unauthenticated},
+		{method: pb.Admin_ListLeases_FullMethodName, token: "wrong", want: codes.Unauthenticated},
+		{method: pb.Admin_ListLeases_FullMethodName, token: "reader", want: codes.OK},
+		{method: pb.Admin_WatchEvents_FullMethodName, token: "reader", want: codes.OK},
+		{method: pb.Admin_DeleteLease_FullMethodName, token: "reader", want: codes.PermissionDenied},
+		{method: pb.Admin_DeleteLease_FullMethodName, token: "writer", want: codes.OK},
+		{method: pb.Admin_SetHostname_FullMethodName, token: "writer", want: codes.OK},
+	} {
+		ctx := context.Background()
+		if tt.token != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+tt.token))
+		}
+		if got := status.Code(a.authorizeRPC(ctx, tt.method)); got != tt.want {
+			t.Errorf("%s with %q: %v, want %v", tt.method, tt.token, got, tt.want)
+		}
+	}
+
+	if err := (&apiAuth{}).authorizeRPC(context.Background(), pb.Admin_DeleteLease_FullMethodName); err != nil {
+		t.Errorf("without authentication configured: %v", err)
+	}
+}
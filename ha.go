@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+// haMessage is a message between the primary and the standby.
+type haMessage struct {
+	Type      string            `json:"type"` // heartbeat, leases, approved, hostnames or synced
+	Interface string            `json:"interface,omitempty"`
+	File      string            `json:"file,omitempty"`
+	Leases    []dhcp4d.Lease    `json:"leases,omitempty"`
+	Approved  []string          `json:"approved,omitempty"`
+	Hostnames map[string]string `json:"hostnames,omitempty"`
+}
+
+func newHAMessage(update any) haMessage {
+	switch u := update.(type) {
+	case LeaseUpdate:
+		return haMessage{Type: "leases", Interface: u.IfaceName, File: u.File, Leases: u.Leases}
+	case ApprovedUpdate:
+		return haMessage{Type: "approved", Interface: u.IfaceName, File: u.File, Approved: u.Approved}
+	case HostnameUpdate:
+		return haMessage{Type: "hostnames", Interface: u.IfaceName, File: u.File, Hostnames: u.Overrides}
+	}
+	return haMessage{Type: "heartbeat"}
+}
+
+func haDefaults(conf config.HA) config.HA {
+	if conf.HeartbeatInterval == 0 {
+		conf.HeartbeatInterval = time.Second
+	}
+	if conf.FailoverTimeout == 0 {
+		conf.FailoverTimeout = 5 * time.Second
+	}
+	return conf
+}
+
+// haConn is an authenticated connection between the primary and the
+// standby. After a challenge-response handshake proving that both sides
+// know the shared secret, every message is a line of the form
+// "<mac> <json>", where mac is an HMAC-SHA256 of the message, its sender
+// and its sequence number in that direction under a key derived from the
+// secret and both challenges.
+type haConn struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	key      []byte
+	primary  bool
+	sent     uint64
+	received uint64
+}
+
+func haMAC(key []byte, parts ...string) string {
+	m := hmac.New(sha256.New, key)
+	for _, p := range parts {
+		m.Write([]byte(p))
+		m.Write([]byte{0})
+	}
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+func haNonce() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (c *haConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	return strings.TrimSuffix(line, "\n"), err
+}
+
+// handshake authenticates the connection. The primary sends a challenge,
+// the standby answers with its own challenge and proof, and the primary
+// proves itself in turn.
+func (c *haConn) handshake(secret string, primary bool) error {
+	c.r = bufio.NewReader(c.conn)
+	c.primary = primary
+	var n1, n2 string
+	var err error
+	if primary {
+		if n1, err = haNonce(); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.conn, "%s\n", n1)
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		var proof string
+		n2, proof, _ = strings.Cut(line, " ")
+		if !hmac.Equal([]byte(proof), []byte(haMAC([]byte(secret), "standby", n1, n2))) {
+			return errors.New("standby failed to authenticate")
+		}
+		fmt.Fprintf(c.conn, "%s\n", haMAC([]byte(secret), "primary", n1, n2))
+	} else {
+		if n1, err = c.readLine(); err != nil {
+			return err
+		}
+		if n2, err = haNonce(); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.conn, "%s %s\n", n2, haMAC([]byte(secret), "standby", n1, n2))
+		proof, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		if !hmac.Equal([]byte(proof), []byte(haMAC([]byte(secret), "primary", n1, n2))) {
+			return errors.New("primary failed to authenticate")
+		}
+	}
+	key, _ := hex.DecodeString(haMAC([]byte(secret), "session", n1, n2))
+	c.key = key
+	return nil
+}
+
+// role returns the name of the sender of messages: this side if local,
+// the peer otherwise.
+func (c *haConn) role(local bool) string {
+	if c.primary == local {
+		return "primary"
+	}
+	return "standby"
+}
+
+func (c *haConn) send(msg haMessage) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.sent++
+	_, err = fmt.Fprintf(c.conn, "%s %s\n", haMAC(c.key, c.role(true), fmt.Sprint(c.sent), string(b)), b)
+	return err
+}
+
+func (c *haConn) receive() (haMessage, error) {
+	var msg haMessage
+	line, err := c.readLine()
+	if err != nil {
+		return msg, err
+	}
+	mac, body, _ := strings.Cut(line, " ")
+	c.received++
+	if !hmac.Equal([]byte(mac), []byte(haMAC(c.key, c.role(false), fmt.Sprint(c.received), body))) {
+		return msg, errors.New("message failed authentication")
+	}
+	return msg, json.Unmarshal([]byte(body), &msg)
+}
+
+// haPrimary streams lease updates to the standbys connected to it. When a
+// standby connects it first sends the leases it knows, which are merged
+// into the primary's, so that the leases it handed out while the primary
+// was down survive the failback.
+type haPrimary struct {
+	conf    config.HA
+	lm      *leaseManager
+	handler func(iface string) (*dhcp4d.Handler, bool) // of running networks
+
+	mu    sync.Mutex
+	peers map[chan haMessage]bool
+}
+
+func newHAPrimary(conf config.HA, lm *leaseManager) *haPrimary {
+	return &haPrimary{
+		conf:  haDefaults(conf),
+		lm:    lm,
+		peers: make(map[chan haMessage]bool),
+	}
+}
+
+// replicate queues update for every standby. It is the lease manager's
+// replicate hook.
+func (p *haPrimary) replicate(update any) {
+	msg := newHAMessage(update)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for q := range p.peers {
+		select {
+		case q <- msg:
+		default:
+			// The standby is too slow; it resynchronizes when it reconnects.
+			close(q)
+			delete(p.peers, q)
+		}
+	}
+}
+
+func (p *haPrimary) serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	slog.Info("ha primary listen", "addr", p.conf.Listen)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			err := p.handle(ctx, conn)
+			slog.Warn("ha standby disconnected", "addr", conn.RemoteAddr(), "err", err)
+		}()
+	}
+}
+
+func (p *haPrimary) handle(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+	c := &haConn{conn: conn}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := c.handshake(p.conf.Secret, true); err != nil {
+		return err
+	}
+	slog.Info("ha standby connected", "addr", conn.RemoteAddr())
+
+	merged := 0
+	for {
+		conn.SetDeadline(time.Now().Add(p.conf.FailoverTimeout))
+		msg, err := c.receive()
+		if err != nil {
+			return err
+		}
+		if msg.Type == "synced" {
+			break
+		}
+		if msg.Type == "leases" {
+			merged += p.merge(msg.Interface, msg.File, msg.Leases)
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	if merged > 0 {
+		slog.Info("ha merged standby leases", "addr", conn.RemoteAddr(), "leases", merged)
+	}
+
+	// Register before taking the snapshot so that no update is missed;
+	// updates that are also in the snapshot are applied twice, harmlessly.
+	q := make(chan haMessage, 1024)
+	p.mu.Lock()
+	p.peers[q] = true
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		if p.peers[q] {
+			delete(p.peers, q)
+			close(q)
+		}
+		p.mu.Unlock()
+	}()
+
+	for _, update := range p.lm.snapshot() {
+		if err := c.send(newHAMessage(update)); err != nil {
+			return err
+		}
+	}
+
+	heartbeat := time.NewTicker(p.conf.HeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		var msg haMessage
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-heartbeat.C:
+			msg = haMessage{Type: "heartbeat"}
+		case m, ok := <-q:
+			if !ok {
+				return errors.New("standby fell behind")
+			}
+			msg = m
+		}
+		conn.SetWriteDeadline(time.Now().Add(p.conf.FailoverTimeout))
+		if err := c.send(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// merge records the leases of the standby for iface that are newer than
+// the primary's and returns how many were. Leases of networks that are not
+// running are merged into the lease file, from which they are loaded.
+func (p *haPrimary) merge(iface, file string, leases []dhcp4d.Lease) int {
+	n := 0
+	if h, ok := p.handler(iface); ok {
+		for _, l := range leases {
+			if h.MergeLease(l) {
+				n++
+			}
+		}
+		return n
+	}
+	stored, _, _ := p.lm.interfaceState(iface, file)
+	own := make([]dhcp4d.Lease, len(stored))
+	for i, l := range stored {
+		own[i] = *l
+	}
+	newer := newerLeases(own, leases)
+	if len(newer) > 0 {
+		p.lm.leaseUpdate <- LeaseUpdate{IfaceName: iface, File: file, Leases: mergeLeases(own, newer)}
+	}
+	return len(newer)
+}
+
+// newerLeases returns the leases of theirs that were acknowledged later
+// than the leases of own for the same client or address, deciding like
+// Handler.MergeLease.
+func newerLeases(own, theirs []dhcp4d.Lease) []dhcp4d.Lease {
+	lastACK := func(l dhcp4d.Lease) time.Time {
+		if l.LastACK.IsZero() {
+			return l.Expiry
+		}
+		return l.LastACK
+	}
+	var newer []dhcp4d.Lease
+	for _, l := range theirs {
+		if l.Addr.To4() == nil {
+			continue
+		}
+		if !slices.ContainsFunc(own, func(m dhcp4d.Lease) bool {
+			return (m.HardwareAddr == l.HardwareAddr || m.Addr.Equal(l.Addr)) && !lastACK(m).Before(lastACK(l))
+		}) {
+			newer = append(newer, l)
+		}
+	}
+	return newer
+}
+
+// haStandby follows the primary and reports on active whether this
+// instance should serve: true once the primary's heartbeat has been missing
+// for the failover timeout, false again once it is back.
+type haStandby struct {
+	conf   config.HA
+	lm     *leaseManager
+	active chan<- bool
+}
+
+func newHAStandby(conf config.HA, lm *leaseManager, active chan<- bool) *haStandby {
+	return &haStandby{conf: haDefaults(conf), lm: lm, active: active}
+}
+
+func (s *haStandby) loop(ctx context.Context) {
+	// Until the primary has been heard from, it may be down already.
+	serving := false
+	lastHeard := time.Now()
+	backoff := time.Second
+	for {
+		err := s.follow(ctx, func() {
+			lastHeard = time.Now()
+			backoff = time.Second
+			if serving {
+				slog.Info("ha primary is back, standing by")
+				serving = false
+				s.active <- false
+			}
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("ha primary unreachable", "peer", s.conf.Peer, "err", err)
+		if !serving && time.Since(lastHeard) >= s.conf.FailoverTimeout {
+			slog.Warn("ha primary heartbeat lost, taking over")
+			serving = true
+			s.active <- true
+		}
+
+		wait := backoff
+		if !serving {
+			wait = min(backoff, time.Until(lastHeard.Add(s.conf.FailoverTimeout)))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(max(wait, 100*time.Millisecond)):
+		}
+		backoff = min(2*backoff, 10*time.Second)
+	}
+}
+
+// follow connects to the primary, sends it the leases known here, and
+// applies its updates until the connection fails or a heartbeat is missed.
+// heard is called for every message.
+func (s *haStandby) follow(ctx context.Context, heard func()) error {
+	d := net.Dialer{Timeout: s.conf.FailoverTimeout}
+	conn, err := d.DialContext(ctx, "tcp", s.conf.Peer)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	c := &haConn{conn: conn}
+	conn.SetDeadline(time.Now().Add(s.conf.FailoverTimeout))
+	if err := c.handshake(s.conf.Secret, false); err != nil {
+		return err
+	}
+	for _, update := range s.lm.snapshot() {
+		if u, ok := update.(LeaseUpdate); ok {
+			if err := c.send(newHAMessage(u)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := c.send(haMessage{Type: "synced"}); err != nil {
+		return err
+	}
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.conf.FailoverTimeout))
+		msg, err := c.receive()
+		if err != nil {
+			return err
+		}
+		heard()
+		switch msg.Type {
+		case "leases":
+			s.lm.leaseUpdate <- LeaseUpdate{IfaceName: msg.Interface, File: msg.File, Leases: msg.Leases}
+		case "approved":
+			s.lm.approvedUpdate <- ApprovedUpdate{IfaceName: msg.Interface, File: msg.File, Approved: msg.Approved}
+		case "hostnames":
+			s.lm.hostnameUpdate <- HostnameUpdate{IfaceName: msg.Interface, File: msg.File, Overrides: msg.Hostnames}
+		}
+	}
+}
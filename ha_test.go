@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+// haPipe returns both ends of a connection after the handshake, with the
+// secrets of the primary and the standby.
+func haPipe(t *testing.T, primarySecret, standbySecret string) (primary, standby *haConn, primaryErr, standbyErr error) {
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	primary, standby = &haConn{conn: a}, &haConn{conn: b}
+	done := make(chan error)
+	go func() {
+		err := standby.handshake(standbySecret, false)
+		if err != nil {
+			b.Close()
+		}
+		done <- err
+	}()
+	primaryErr = primary.handshake(primarySecret, true)
+	if primaryErr != nil {
+		a.Close()
+	}
+	standbyErr = <-done
+	return primary, standby, primaryErr, standbyErr
+}
+
+func TestHAHandshake(t *testing.T) {
+	primary, standby, perr, serr := haPipe(t, "secret", "secret")
+	if perr != nil || serr != nil {
+		t.Fatalf("handshake: primary %v, standby %v", perr, serr)
+	}
+
+	// Messages flow both ways, with a sequence number in each direction.
+	for i := 0; i < 3; i++ {
+		go standby.send(haMessage{Type: "leases", Interface: fmt.Sprint("eth", i)})
+		msg, err := primary.receive()
+		if err != nil || msg.Interface != fmt.Sprint("eth", i) {
+			t.Fatalf("standby message %d: %+v, %v", i, msg, err)
+		}
+		go primary.send(haMessage{Type: "heartbeat"})
+		if msg, err := standby.receive(); err != nil || msg.Type != "heartbeat" {
+			t.Fatalf("primary message %d: %+v, %v", i, msg, err)
+		}
+	}
+
+	_, _, perr, _ = haPipe(t, "secret", "other")
+	if perr == nil || !strings.Contains(perr.Error(), "standby failed to authenticate") {
+		t.Errorf("wrong standby secret: %v", perr)
+	}
+}
+
+func TestHAMessageAuth(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		line func(c *haConn) string // written by the primary
+	}{
+		{"tampered", func(c *haConn) string {
+			return haMAC(c.key, "primary", "1", `{"type":"heartbeat"}`) + ` {"type":"leases"}`
+		}},
+		{"replayed", func(c *haConn) string {
+			line := haMAC(c.key, "primary", "1", `{"type":"heartbeat"}`) + ` {"type":"heartbeat"}`
+			return line + "\n" + line
+		}},
+		{"reflected", func(c *haConn) string {
+			return haMAC(c.key, "standby", "1", `{"type":"heartbeat"}`) + ` {"type":"heartbeat"}`
+		}},
+	} {
+		primary, standby, perr, serr := haPipe(t, "secret", "secret")
+		if perr != nil || serr != nil {
+			t.Fatalf("handshake: primary %v, standby %v", perr, serr)
+		}
+		go primary.conn.Write([]byte(tt.line(primary) + "\n"))
+		var err error
+		for i := 0; i < 2 && err == nil; i++ {
+			_, err = standby.receive()
+			if tt.name != "replayed" {
+				break
+			}
+		}
+		if err == nil || !strings.Contains(err.Error(), "failed authentication") {
+			t.Errorf("%s: %v, want an authentication failure", tt.name, err)
+		}
+	}
+}
+
+func TestNewerLeases(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	own := []dhcp4d.Lease{
+		{Addr: net.IP{192, 168, 42, 2}, HardwareAddr: "aa:00:00:00:00:01", LastACK: now},
+		{Addr: net.IP{192, 168, 42, 3}, HardwareAddr: "aa:00:00:00:00:02", Expiry: now},
+	}
+	theirs := []dhcp4d.Lease{
+		{Addr: net.IP{192, 168, 42, 2}, HardwareAddr: "aa:00:00:00:00:01", LastACK: now.Add(-time.Minute)},
+		{Addr: net.IP{192, 168, 42, 3}, HardwareAddr: "aa:00:00:00:00:03", LastACK: now.Add(time.Minute)},
+		{Addr: net.IP{192, 168, 42, 4}, HardwareAddr: "aa:00:00:00:00:04", LastACK: now},
+	}
+	newer := newerLeases(own, theirs)
+	var got []string
+	for _, l := range newer {
+		got = append(got, l.HardwareAddr)
+	}
+	if want := []string{"aa:00:00:00:00:03", "aa:00:00:00:00:04"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("newerLeases = %q, want %q", got, want)
+	}
+}
+
+// haNode is the lease manager of an HA instance and a handler of eth0. The
+// lease manager's loop is not started.
+type haNode struct {
+	lm *leaseManager
+	h  *dhcp4d.Handler
+}
+
+func newHANode(t *testing.T, stored map[string][]dhcp4d.Lease) *haNode {
+	store := &memStore{lf: newLeaseFile()}
+	for iface, leases := range stored {
+		store.lf.LeaseByInterface[iface] = leases
+	}
+	lm := newLeaseManager("/var/lib/dhcpeterd/leases.json", func(string) (LeaseStore, error) {
+		return store, nil
+	})
+	if err := lm.open(""); err != nil {
+		t.Fatal(err)
+	}
+	iface := &net.Interface{Index: 1, HardwareAddr: net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}}
+	h, err := dhcp4d.NewHandler(iface, net.IP{192, 168, 42, 1}, net.IP{192, 168, 42, 2}, net.IP{255, 255, 255, 0}, 10, time.Hour, nil, nil, dhcp4d.WithUDP())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Leases = func(newLeases []*dhcp4d.Lease, _ *dhcp4d.Lease) {
+		leases := make([]dhcp4d.Lease, len(newLeases))
+		for i, l := range newLeases {
+			leases[i] = *l
+		}
+		lm.leaseUpdate <- LeaseUpdate{IfaceName: "eth0", Leases: leases}
+	}
+	return &haNode{lm: lm, h: h}
+}
+
+// waitLease waits for the lease of hw on iface in lm.
+func waitLease(t *testing.T, lm *leaseManager, iface, hw string) dhcp4d.Lease {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		leases, _, _ := lm.interfaceState(iface, "")
+		for _, l := range leases {
+			if l.HardwareAddr == hw {
+				return *l
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no lease of %s on %s", hw, iface)
+	return dhcp4d.Lease{}
+}
+
+func TestHAFailback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now().Truncate(time.Second)
+	primaryLease := dhcp4d.Lease{Addr: net.IP{192, 168, 42, 2}, HardwareAddr: "aa:00:00:00:00:01", LastACK: now, Expiry: now.Add(time.Hour)}
+	// Handed out by the standby while the primary was down.
+	standbyLease := dhcp4d.Lease{Addr: net.IP{192, 168, 42, 3}, HardwareAddr: "aa:00:00:00:00:02", LastACK: now, Expiry: now.Add(time.Hour)}
+	stale := primaryLease
+	stale.Addr = net.IP{192, 168, 42, 4}
+	stale.LastACK = now.Add(-time.Hour)
+	standbyOnly := dhcp4d.Lease{Addr: net.IP{10, 0, 0, 2}, HardwareAddr: "aa:00:00:00:00:03", LastACK: now, Expiry: now.Add(time.Hour)}
+
+	p := newHANode(t, nil)
+	s := newHANode(t, map[string][]dhcp4d.Lease{
+		"eth0": {standbyLease, stale},
+		"eth1": {standbyOnly},
+	})
+	go s.lm.updateLeaseFileLoop(ctx)
+
+	// The primary is down at first; reserve its address.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	conf := config.HA{Listen: addr, Peer: addr, Secret: "secret", HeartbeatInterval: 50 * time.Millisecond, FailoverTimeout: 300 * time.Millisecond}
+	active := make(chan bool)
+	go newHAStandby(conf, s.lm, active).loop(ctx)
+	select {
+	case a := <-active:
+		if !a {
+			t.Fatal("standby reported inactive first")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("standby did not take over")
+	}
+
+	primary := newHAPrimary(conf, p.lm)
+	primary.handler = func(iface string) (*dhcp4d.Handler, bool) {
+		return p.h, iface == "eth0"
+	}
+	p.lm.replicate = primary.replicate
+	go p.lm.updateLeaseFileLoop(ctx)
+	p.h.PutLease(primaryLease)
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go primary.serve(ctx, l)
+	select {
+	case a := <-active:
+		if a {
+			t.Fatal("standby reported active again")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("standby did not stand down")
+	}
+
+	if got, ok := p.h.Lease(standbyLease.HardwareAddr); !ok || !got.Addr.Equal(standbyLease.Addr) {
+		t.Errorf("primary lease of %s: %+v, want the standby's", standbyLease.HardwareAddr, got)
+	}
+	if got, ok := p.h.Lease(primaryLease.HardwareAddr); !ok || !got.Addr.Equal(primaryLease.Addr) {
+		t.Errorf("primary lease of %s: %+v, want its own, not the stale one", primaryLease.HardwareAddr, got)
+	}
+	// Networks that are not running are merged into the lease file.
+	if got := waitLease(t, p.lm, "eth1", standbyOnly.HardwareAddr); !got.Addr.Equal(standbyOnly.Addr) {
+		t.Errorf("primary lease file: %+v, want the standby's", got)
+	}
+
+	// Updates of the primary are replicated to the standby.
+	p.h.PutLease(dhcp4d.Lease{Addr: net.IP{192, 168, 42, 5}, HardwareAddr: "aa:00:00:00:00:04", LastACK: now, Expiry: now.Add(time.Hour)})
+	if got := waitLease(t, s.lm, "eth0", "aa:00:00:00:00:04"); !got.Addr.Equal(net.IP{192, 168, 42, 5}) {
+		t.Errorf("standby lease: %+v, want the primary's", got)
+	}
+}
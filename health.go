@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// healthCheck is the result of one check reported by /healthz.
+type healthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// health checks that a handler is serving every configured interface with
+// an open raw socket, and that the lease files are writable.
+func (d *daemon) health() (bool, []healthCheck) {
+	var checks []healthCheck
+	healthy := true
+	add := func(name string, err error) {
+		c := healthCheck{Name: name, OK: err == nil}
+		if err != nil {
+			c.Error = err.Error()
+			healthy = false
+		}
+		checks = append(checks, c)
+	}
+
+	d.mu.Lock()
+	ifaces := d.interfacesLocked()
+	failures := make(map[string]error)
+	for iface, nw := range d.networks {
+		failures[iface] = nw.err
+	}
+	d.mu.Unlock()
+	handlers := d.allHandlers()
+	for _, iface := range ifaces {
+		h, ok := handlers[iface]
+		if !ok {
+			err := fmt.Errorf("handler not running")
+			if failures[iface] != nil {
+				err = fmt.Errorf("handler not running: %w", failures[iface])
+			}
+			add("network "+iface, err)
+			continue
+		}
+		add("network "+iface, h.CheckConn())
+	}
+	for _, p := range d.lm.paths() {
+		add("lease file "+p, checkWritable(p))
+	}
+	return healthy, checks
+}
+
+// checkWritable returns an error if path cannot be written, either because
+// the existing file is not writable or because a file cannot be created in
+// its directory.
+func checkWritable(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err == nil {
+		return f.Close()
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	f, err = os.CreateTemp(filepath.Dir(path), ".healthz")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// healthz reports the health checks, or only whether they passed to
+// clients without read scope: the checks name lease files and carry raw
+// errors.
+func (s *apiServer) healthz(w http.ResponseWriter, r *http.Request) {
+	ok, checks := s.d.health()
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusServiceUnavailable
+	}
+	if requestScope(r) < scopeRead {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		if ok {
+			fmt.Fprintln(w, "ok")
+		} else {
+			fmt.Fprintln(w, "fail")
+		}
+		return
+	}
+	writeJSON(w, status, map[string]any{
+		"ok":     ok,
+		"checks": checks,
+	})
+}
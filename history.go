@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+// historyWriteInterval is the minimum time between writes of the history
+// file. Renewals only move LastSeen, so there is no need to write each one.
+const historyWriteInterval = time.Minute
+
+// historyEntry is a period during which a device held an address under a
+// hostname.
+type historyEntry struct {
+	Interface string    `json:"interface"`
+	IP        net.IP    `json:"ip"`
+	Hostname  string    `json:"hostname,omitempty"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// historyRecord is a history entry along with its device, as returned by
+// the API.
+type historyRecord struct {
+	HardwareAddr string `json:"hardware_addr"`
+	historyEntry
+}
+
+type historyEvent struct {
+	hw    string
+	entry historyEntry
+}
+
+// leaseHistory keeps, per hardware address, the most recent addresses and
+// hostnames it was granted, and persists them to their own file.
+type leaseHistory struct {
+	conf  config.LeaseHistory
+	queue chan historyEvent
+
+	// done is closed once the history has been written on shutdown.
+	done chan struct{}
+
+	mu      sync.Mutex
+	devices map[string][]historyEntry // oldest first
+	dirty   bool
+}
+
+func newLeaseHistory(conf *config.LeaseHistory) (*leaseHistory, error) {
+	if conf.Path == "" {
+		return nil, fmt.Errorf("lease_history requires path")
+	}
+	h := &leaseHistory{
+		conf:    *conf,
+		queue:   make(chan historyEvent, 256),
+		done:    make(chan struct{}),
+		devices: make(map[string][]historyEntry),
+	}
+	if h.conf.MaxEntries == 0 {
+		h.conf.MaxEntries = 20
+	}
+	b, err := os.ReadFile(conf.Path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &h.devices); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", conf.Path, err)
+	}
+	return h, nil
+}
+
+func (h *leaseHistory) send(iface string, ev dhcp4d.Event) {
+	if ev.Type != dhcp4d.EventAdd && ev.Type != dhcp4d.EventOld {
+		return
+	}
+	l := ev.Lease
+	hostname := l.HostnameOverride
+	if hostname == "" {
+		hostname = l.Hostname
+	}
+	now := time.Now()
+	hev := historyEvent{
+		hw: l.HardwareAddr,
+		entry: historyEntry{
+			Interface: iface,
+			IP:        l.Addr,
+			Hostname:  hostname,
+			FirstSeen: now,
+			LastSeen:  now,
+		},
+	}
+	select {
+	case h.queue <- hev:
+	default:
+		slog.Error("lease history queue full, dropping event", "hw", l.HardwareAddr)
+	}
+}
+
+func (h *leaseHistory) loop(ctx context.Context) {
+	defer close(h.done)
+	var flush <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			h.write()
+			return
+		case <-flush:
+			flush = nil
+			h.write()
+		case ev := <-h.queue:
+			h.record(ev.hw, ev.entry)
+			if flush == nil {
+				flush = time.After(historyWriteInterval)
+			}
+		}
+	}
+}
+
+// record extends the latest entry of hw if e continues it and otherwise
+// starts a new entry, dropping entries beyond MaxEntries or older than
+// MaxAge.
+func (h *leaseHistory) record(hw string, e historyEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dirty = true
+	entries := h.devices[hw]
+	if n := len(entries); n > 0 {
+		last := &entries[n-1]
+		if last.Interface == e.Interface && last.IP.Equal(e.IP) && last.Hostname == e.Hostname {
+			last.LastSeen = e.LastSeen
+			return
+		}
+	}
+	entries = append(entries, e)
+	if len(entries) > h.conf.MaxEntries {
+		entries = slices.Delete(entries, 0, len(entries)-h.conf.MaxEntries)
+	}
+	h.devices[hw] = entries
+	if h.conf.MaxAge > 0 {
+		h.pruneLocked(e.LastSeen.Add(-h.conf.MaxAge))
+	}
+}
+
+// pruneLocked drops entries last seen before cutoff. h.mu must be held.
+func (h *leaseHistory) pruneLocked(cutoff time.Time) {
+	for hw, entries := range h.devices {
+		entries = slices.DeleteFunc(entries, func(e historyEntry) bool {
+			return e.LastSeen.Before(cutoff)
+		})
+		if len(entries) == 0 {
+			delete(h.devices, hw)
+		} else {
+			h.devices[hw] = entries
+		}
+	}
+}
+
+// write replaces the history file if the history changed since the last
+// write.
+func (h *leaseHistory) write() {
+	h.mu.Lock()
+	if !h.dirty {
+		h.mu.Unlock()
+		return
+	}
+	b, err := json.Marshal(h.devices)
+	h.dirty = false
+	h.mu.Unlock()
+	if err == nil {
+		err = writeFileAtomic(h.conf.Path, b, 0600)
+	}
+	if err != nil {
+		slog.Error("write lease history err", "path", h.conf.Path, "err", err)
+	}
+}
+
+// query returns the entries of hw (if set) for ip (if set) that overlap
+// [since, until], ordered by FirstSeen. Zero times are unbounded.
+func (h *leaseHistory) query(hw string, ip net.IP, since, until time.Time) []historyRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var records []historyRecord
+	for dev, entries := range h.devices {
+		if hw != "" && dev != hw {
+			continue
+		}
+		for _, e := range entries {
+			if ip != nil && !e.IP.Equal(ip) {
+				continue
+			}
+			if (!since.IsZero() && e.LastSeen.Before(since)) || (!until.IsZero() && e.FirstSeen.After(until)) {
+				continue
+			}
+			records = append(records, historyRecord{HardwareAddr: dev, historyEntry: e})
+		}
+	}
+	slices.SortFunc(records, func(a, b historyRecord) int {
+		return a.FirstSeen.Compare(b.FirstSeen)
+	})
+	return records
+}
+
+// writeFileAtomic replaces the file at path with b, so that readers never
+// see a partial file.
+func writeFileAtomic(path string, b []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
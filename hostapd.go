@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+	"github.com/psanford/dhcpeterd/internal/hostapd"
+)
+
+// hostapdPingInterval is how often a hostapd connection is checked, as
+// hostapd forgets attached clients when it restarts.
+const hostapdPingInterval = 30 * time.Second
+
+// hostapdMonitor records the Wi-Fi network of the stations of a hostapd
+// interface in their leases.
+type hostapdMonitor struct {
+	conf config.Hostapd
+	d    *daemon
+}
+
+func (m *hostapdMonitor) loop(ctx context.Context) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := m.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Error("hostapd err", "socket", m.conf.Socket, "err", err)
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, time.Minute)
+	}
+}
+
+// session follows the station events of hostapd until the connection
+// fails or ctx is done.
+func (m *hostapdMonitor) session(ctx context.Context) error {
+	ctrl, err := hostapd.Dial(m.conf.Socket)
+	if err != nil {
+		return err
+	}
+	defer ctrl.Close()
+	events, err := hostapd.Dial(m.conf.Socket)
+	if err != nil {
+		return err
+	}
+	defer events.Close()
+	if err := events.Attach(); err != nil {
+		return err
+	}
+	st, err := m.station(ctrl)
+	if err != nil {
+		return err
+	}
+	slog.Info("hostapd attached", "socket", m.conf.Socket, "ssid", st.SSID, "bssid", st.BSSID)
+
+	// Stations that associated before we attached.
+	reply, err := ctrl.Request("STA-FIRST")
+	for err == nil && reply != "" && !strings.HasPrefix(reply, "FAIL") {
+		hw, _, _ := strings.Cut(reply, "\n")
+		m.connected(hw, st)
+		reply, err = ctrl.Request("STA-NEXT " + hw)
+	}
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		t := time.NewTicker(hostapdPingInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+			case <-done:
+				return
+			case <-t.C:
+				if reply, err := ctrl.Request("PING"); err == nil && reply == "PONG\n" {
+					continue
+				}
+			}
+			// Interrupt ReadEvent.
+			events.Close()
+			return
+		}
+	}()
+
+	for {
+		ev, err := events.ReadEvent()
+		if err != nil {
+			return err
+		}
+		if len(ev.Args) == 0 {
+			continue
+		}
+		switch ev.Type {
+		case hostapd.StaConnected:
+			m.connected(ev.Args[0], st)
+		case hostapd.StaDisconnected:
+			m.disconnected(ev.Args[0], st)
+		}
+	}
+}
+
+// station returns the SSID and BSSID of the interface of the control socket.
+func (m *hostapdMonitor) station(ctrl *hostapd.Conn) (dhcp4d.Station, error) {
+	status, err := ctrl.Status()
+	if err != nil {
+		return dhcp4d.Station{}, err
+	}
+	// A radio's status lists all of its BSSes.
+	iface := filepath.Base(m.conf.Socket)
+	i := 0
+	for j := 0; status[fmt.Sprintf("bss[%d]", j)] != ""; j++ {
+		if status[fmt.Sprintf("bss[%d]", j)] == iface {
+			i = j
+		}
+	}
+	st := dhcp4d.Station{
+		SSID:  status[fmt.Sprintf("ssid[%d]", i)],
+		BSSID: status[fmt.Sprintf("bssid[%d]", i)],
+	}
+	if st.BSSID == "" {
+		return st, fmt.Errorf("no bssid in status")
+	}
+	return st, nil
+}
+
+func (m *hostapdMonitor) connected(mac string, st dhcp4d.Station) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return
+	}
+	slog.Debug("station connected", "hw", hw, "ssid", st.SSID, "bssid", st.BSSID)
+	for _, h := range m.d.allHandlers() {
+		h.SetStation(hw.String(), st)
+	}
+}
+
+func (m *hostapdMonitor) disconnected(mac string, st dhcp4d.Station) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return
+	}
+	slog.Debug("station disconnected", "hw", hw, "ssid", st.SSID, "bssid", st.BSSID)
+	for iface, h := range m.d.allHandlers() {
+		if !h.ClearStation(hw.String(), st.BSSID) || !m.conf.ExpireOnDisconnect {
+			continue
+		}
+		if l, ok := h.Lease(hw.String()); ok && !l.Expired(time.Now()) {
+			h.RevokeLease(hw.String(), false)
+			slog.Info("expired lease of disconnected station", "iface", iface, "hw", hw, "ip", l.Addr, "ssid", st.SSID)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/psanford/dhcpeterd/config"
+)
+
+const (
+	ptrCacheTTL      = time.Hour        // how long PTR lookup results are reused
+	ptrLookupWait    = 10 * time.Second // before a lookup is retried for a client
+	ptrLookupTimeout = 5 * time.Second
+)
+
+// hostnameFallback names the leases of clients that send no hostname, from
+// a file in /etc/ethers format and, optionally, from PTR lookups of their
+// address.
+type hostnameFallback struct {
+	path string
+	ptr  bool
+
+	mu       sync.Mutex
+	modTime  time.Time            // of the file when names was read
+	names    map[string]string    // by hardware or IP address, from path
+	ptrNames map[string]ptrResult // by IP address
+}
+
+type ptrResult struct {
+	name    string // "" if there is none or the lookup is in progress
+	expires time.Time
+}
+
+func newHostnameFallback(conf *config.HostnameFallback) (*hostnameFallback, error) {
+	if conf.File == "" && !conf.PTR {
+		return nil, fmt.Errorf("hostname_fallback requires file or ptr")
+	}
+	f := &hostnameFallback{path: conf.File, ptr: conf.PTR, ptrNames: make(map[string]ptrResult)}
+	if f.path != "" {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if err := f.loadLocked(); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// loadLocked reads the file if it changed since it was last read. Lines
+// hold a hardware or IP address and a name; "#" starts a comment.
+func (f *hostnameFallback) loadLocked() error {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(f.modTime) && f.names != nil {
+		return nil
+	}
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	names := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: want an address and a name", f.path, lineNum)
+		}
+		if hw, err := net.ParseMAC(fields[0]); err == nil {
+			names[hw.String()] = fields[1]
+		} else if ip := net.ParseIP(fields[0]).To4(); ip != nil {
+			names[ip.String()] = fields[1]
+		} else {
+			return fmt.Errorf("%s:%d: invalid address %q", f.path, lineNum, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	f.names = names
+	f.modTime = fi.ModTime()
+	return nil
+}
+
+// lookup returns the name of the client hwaddr at ip from the file, or else
+// from a previous PTR lookup. If there was none it starts one in the
+// background, which names the lease with fill once it succeeds.
+func (f *hostnameFallback) lookup(hwaddr string, ip net.IP, fill func(hwaddr, hostname string) bool) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.path != "" {
+		if err := f.loadLocked(); err != nil {
+			slog.Error("load hostname fallback file err", "path", f.path, "err", err)
+		}
+		if name, ok := f.names[strings.ToLower(hwaddr)]; ok {
+			return name
+		}
+		if name, ok := f.names[ip.String()]; ok {
+			return name
+		}
+	}
+	if !f.ptr {
+		return ""
+	}
+
+	now := time.Now()
+	key := ip.String()
+	if r, ok := f.ptrNames[key]; ok && now.Before(r.expires) {
+		return r.name
+	}
+	for k, r := range f.ptrNames {
+		if !now.Before(r.expires) {
+			delete(f.ptrNames, k)
+		}
+	}
+	f.ptrNames[key] = ptrResult{expires: now.Add(ptrLookupWait)}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), ptrLookupTimeout)
+		defer cancel()
+		var name string
+		names, err := net.DefaultResolver.LookupAddr(ctx, key)
+		if err != nil {
+			slog.Debug("ptr lookup err", "ip", key, "err", err)
+		} else if len(names) > 0 {
+			name, _, _ = strings.Cut(names[0], ".")
+		}
+		f.mu.Lock()
+		f.ptrNames[key] = ptrResult{name: name, expires: time.Now().Add(ptrCacheTTL)}
+		f.mu.Unlock()
+		if name != "" && fill(hwaddr, name) {
+			slog.Info("named lease by ptr lookup", "hw", hwaddr, "ip", key, "name", name)
+		}
+	}()
+	return ""
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+// hostsEntry is the /etc/hosts line of a lease.
+type hostsEntry struct {
+	hw   string
+	line string
+}
+
+// hostsEntries returns the /etc/hosts lines of the unexpired leases that have
+// a valid hostname: "<ip> [<hostname>.<domain>] <hostname>". Later leases
+// for a hostname already listed are skipped.
+func hostsEntries(leases []dhcp4d.Lease, domain string, now time.Time) []hostsEntry {
+	domain = strings.Trim(domain, ".")
+	seen := make(map[string]bool)
+	var entries []hostsEntry
+	for _, l := range leases {
+		if l.Expired(now) || l.Unknown {
+			continue
+		}
+		hostname := leaseHostname(l)
+		if hostname == "" || seen[hostname] {
+			continue
+		}
+		seen[hostname] = true
+		line := fmt.Sprintf("%s\t%s\n", l.Addr, hostname)
+		if domain != "" {
+			line = fmt.Sprintf("%s\t%s.%s %s\n", l.Addr, hostname, domain, hostname)
+		}
+		entries = append(entries, hostsEntry{hw: l.HardwareAddr, line: line})
+	}
+	return entries
+}
+
+// leaseHostname returns the lowercased hostname of l, preferring its
+// override, or "" if it has none that is a valid DNS label.
+func leaseHostname(l dhcp4d.Lease) string {
+	hostname := l.HostnameOverride
+	if hostname == "" {
+		hostname = l.Hostname
+	}
+	hostname = strings.ToLower(hostname)
+	if !validLabel(hostname) {
+		return ""
+	}
+	return hostname
+}
+
+// writeHosts writes the hostnames of the leases of every lease file to
+// lm.hostsPath.
+func (lm *leaseManager) writeHosts() error {
+	var b bytes.Buffer
+	for _, e := range hostsEntries(lm.allLeases(), lm.hostsDomain, time.Now()) {
+		b.WriteString(e.line)
+	}
+	if bytes.Equal(b.Bytes(), lm.hostsLast) {
+		return nil
+	}
+	if err := writeFileAtomic(lm.hostsPath, b.Bytes(), 0644); err != nil {
+		return err
+	}
+	lm.hostsLast = b.Bytes()
+	return nil
+}
+
+// writeHostsDir maintains a hosts file per lease in lm.hostsDir, named
+// after the client's hardware address (e.g. "aa-bb-cc-dd-ee-ff"), in the
+// style of dnsmasq's hostsdir. Files of leases that are gone are removed,
+// including those left behind by a previous run.
+func (lm *leaseManager) writeHostsDir() error {
+	files := make(map[string]string)
+	for _, e := range hostsEntries(lm.allLeases(), lm.hostsDomain, time.Now()) {
+		files[strings.ReplaceAll(e.hw, ":", "-")] = e.line
+	}
+	if lm.hostsDirLast == nil {
+		lm.hostsDirLast = make(map[string]string)
+		dir, err := os.ReadDir(lm.hostsDir)
+		if err != nil {
+			return err
+		}
+		for _, f := range dir {
+			if _, err := net.ParseMAC(f.Name()); err == nil {
+				lm.hostsDirLast[f.Name()] = ""
+			}
+		}
+	}
+
+	var errs []error
+	for name, line := range files {
+		if last, ok := lm.hostsDirLast[name]; ok && last == line {
+			continue
+		}
+		if err := writeFileAtomic(filepath.Join(lm.hostsDir, name), []byte(line), 0644); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		lm.hostsDirLast[name] = line
+	}
+	for name := range maps.Clone(lm.hostsDirLast) {
+		if _, ok := files[name]; ok {
+			continue
+		}
+		if err := os.Remove(filepath.Join(lm.hostsDir, name)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+			continue
+		}
+		delete(lm.hostsDirLast, name)
+	}
+	return errors.Join(errs...)
+}
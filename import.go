@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+// runImportLeases implements "dhcpeterd import-leases": it adds the active
+// leases of another DHCP server's lease database to the lease files of the
+// networks they belong to. It fails while the daemon is running, since the
+// daemon holds the lease files.
+func runImportLeases(args []string) int {
+	fs := flag.NewFlagSet("import-leases", flag.ExitOnError)
+	path := fs.String("config", "dhcpeterd.toml", "Config path")
+	from := fs.String("from", "isc", "Format of the lease database (isc)")
+	ifaceName := fs.String("interface", "", "Import every lease into this network instead of the one containing its address")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: dhcpeterd import-leases [flags] <lease file>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	if *from != "isc" {
+		fmt.Fprintf(os.Stderr, "unsupported lease format: %s\n", *from)
+		return 2
+	}
+
+	conf, err := config.Load(*path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *path, err)
+		return 1
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	leases, err := parseISCLeases(f, time.Now())
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", fs.Arg(0), err)
+		return 1
+	}
+
+	// Group the leases by lease file and interface.
+	imported := make(map[string]map[string][]dhcp4d.Lease)
+	for _, l := range leases {
+		n, ok := importNetwork(conf.Networks, *ifaceName, l.Addr)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "skipping %s (%s): not in a configured network\n", l.Addr, l.HardwareAddr)
+			continue
+		}
+		p := n.LeaseFile
+		if p == "" {
+			p = conf.LeaseFile
+		}
+		if p == "" {
+			fmt.Fprintf(os.Stderr, "network %s has no lease file\n", n.Interface)
+			return 1
+		}
+		if imported[p] == nil {
+			imported[p] = make(map[string][]dhcp4d.Lease)
+		}
+		imported[p][n.Interface] = append(imported[p][n.Interface], l)
+	}
+
+	for p, byIface := range imported {
+		store, err := newFileStore(p, true)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 1
+		}
+		defer store.Close()
+		lf, err := store.Load()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", p, err)
+			return 1
+		}
+		var count int
+		for iface, leases := range byIface {
+			lf.LeaseByInterface[iface] = mergeLeases(lf.LeaseByInterface[iface], leases)
+			for _, l := range leases {
+				if _, ok := lf.Seen[l.HardwareAddr]; !ok {
+					lf.Seen[l.HardwareAddr] = l.LastACK
+				}
+			}
+			count += len(leases)
+		}
+		if err := store.SaveAll(lf); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", p, err)
+			return 1
+		}
+		fmt.Printf("%s: imported %d leases\n", p, count)
+	}
+	return 0
+}
+
+// importNetwork returns the network a lease for ip belongs to: the network
+// of iface if set, else the one whose subnet contains ip. Networks whose
+// interface is a pattern are never matched by address.
+func importNetwork(networks []config.Network, iface string, ip net.IP) (config.Network, bool) {
+	for _, n := range networks {
+		if iface != "" {
+			if n.Interface == iface {
+				return n, true
+			}
+			continue
+		}
+		if isInterfacePattern(n.Interface) {
+			continue
+		}
+		startIP := net.ParseIP(n.StartIP).To4()
+		mask := parseNetMask(n.NetMask)
+		if startIP == nil || mask == nil {
+			continue
+		}
+		subnet := net.IPNet{IP: startIP.Mask(mask), Mask: mask}
+		if subnet.Contains(ip) {
+			return n, true
+		}
+	}
+	return config.Network{}, false
+}
+
+// mergeLeases adds imported to existing, replacing existing leases with the
+// same address or hardware address.
+func mergeLeases(existing, imported []dhcp4d.Lease) []dhcp4d.Lease {
+	replaced := make(map[string]bool)
+	for _, l := range imported {
+		replaced[l.Addr.String()] = true
+		replaced[l.HardwareAddr] = true
+	}
+	merged := make([]dhcp4d.Lease, 0, len(existing)+len(imported))
+	for _, l := range existing {
+		if !replaced[l.Addr.String()] && !replaced[l.HardwareAddr] {
+			merged = append(merged, l)
+		}
+	}
+	return append(merged, imported...)
+}
+
+// parseISCLeases returns the leases of an ISC dhcpd.leases database that
+// are active and unexpired at now. Later entries for an address replace
+// earlier ones, as in dhcpd.
+func parseISCLeases(r io.Reader, now time.Time) ([]dhcp4d.Lease, error) {
+	toks, err := iscTokens(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var order []string
+	byAddr := make(map[string]*iscLease)
+	for len(toks) > 0 {
+		if toks[0] != "lease" {
+			toks, err = iscSkipStatement(toks)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if len(toks) < 3 || toks[2] != "{" {
+			return nil, fmt.Errorf("malformed lease declaration")
+		}
+		ip := net.ParseIP(toks[1]).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid lease address %q", toks[1])
+		}
+		l := &iscLease{addr: ip, state: "active"}
+		toks = toks[3:]
+		for {
+			if len(toks) == 0 {
+				return nil, fmt.Errorf("lease %s: unexpected end of file", ip)
+			}
+			if toks[0] == "}" {
+				toks = toks[1:]
+				break
+			}
+			var stmt []string
+			stmt, toks, err = iscStatement(toks)
+			if err != nil {
+				return nil, fmt.Errorf("lease %s: %w", ip, err)
+			}
+			if err := l.set(stmt); err != nil {
+				return nil, fmt.Errorf("lease %s: %w", ip, err)
+			}
+		}
+		if _, ok := byAddr[ip.String()]; !ok {
+			order = append(order, ip.String())
+		}
+		byAddr[ip.String()] = l
+	}
+
+	var leases []dhcp4d.Lease
+	for _, addr := range order {
+		l := byAddr[addr]
+		if l.state != "active" || l.hw == "" || (!l.ends.IsZero() && !l.ends.After(now)) {
+			continue
+		}
+		expiry := l.ends
+		if expiry.IsZero() {
+			expiry = now.AddDate(100, 0, 0) // never
+		}
+		lastACK := l.cltt
+		if lastACK.IsZero() {
+			lastACK = l.starts
+		}
+		leases = append(leases, dhcp4d.Lease{
+			Addr:           l.addr,
+			HardwareAddr:   l.hw,
+			Hostname:       l.hostname,
+			ClientHostname: l.hostname,
+			ClientID:       l.clientID,
+			Expiry:         expiry,
+			LastACK:        lastACK,
+		})
+	}
+	return leases, nil
+}
+
+type iscLease struct {
+	addr         net.IP
+	starts, ends time.Time
+	cltt         time.Time
+	state        string
+	hw           string
+	hostname     string
+	clientID     string
+}
+
+func (l *iscLease) set(stmt []string) error {
+	var err error
+	switch stmt[0] {
+	case "starts":
+		l.starts, err = iscTime(stmt[1:])
+	case "ends":
+		l.ends, err = iscTime(stmt[1:])
+	case "cltt":
+		l.cltt, err = iscTime(stmt[1:])
+	case "binding":
+		if len(stmt) != 3 || stmt[1] != "state" {
+			return fmt.Errorf("malformed binding statement")
+		}
+		l.state = stmt[2]
+	case "hardware":
+		if len(stmt) != 3 {
+			return fmt.Errorf("malformed hardware statement")
+		}
+		hw, err := net.ParseMAC(stmt[2])
+		if err != nil {
+			return err
+		}
+		l.hw = hw.String()
+	case "client-hostname":
+		if len(stmt) != 2 {
+			return fmt.Errorf("malformed client-hostname statement")
+		}
+		l.hostname = strings.TrimPrefix(stmt[1], `"`)
+	case "uid":
+		if len(stmt) != 2 {
+			return fmt.Errorf("malformed uid statement")
+		}
+		l.clientID, err = iscClientID(stmt[1])
+	}
+	return err
+}
+
+// iscTime parses the time of a starts, ends or cltt statement:
+// "<weekday> YYYY/MM/DD HH:MM:SS" in UTC, "epoch <seconds>" or "never"
+// (the zero time).
+func iscTime(args []string) (time.Time, error) {
+	switch {
+	case len(args) == 1 && args[0] == "never":
+		return time.Time{}, nil
+	case len(args) == 2 && args[0] == "epoch":
+		secs, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time %q", args[1])
+		}
+		return time.Unix(secs, 0), nil
+	case len(args) == 3:
+		return time.Parse("2006/01/02 15:04:05", args[1]+" "+args[2])
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", strings.Join(args, " "))
+}
+
+// iscClientID returns the hex encoding of a uid, which is either a quoted
+// string or colon-separated hex octets.
+func iscClientID(uid string) (string, error) {
+	if s, ok := strings.CutPrefix(uid, `"`); ok {
+		return hex.EncodeToString([]byte(s)), nil
+	}
+	var b []byte
+	for _, part := range strings.Split(uid, ":") {
+		v, err := strconv.ParseUint(part, 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid uid %q", uid)
+		}
+		b = append(b, byte(v))
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// iscStatement splits off the statement at the start of toks, without its
+// terminating semicolon.
+func iscStatement(toks []string) (stmt, rest []string, err error) {
+	for i, t := range toks {
+		switch t {
+		case ";":
+			if i == 0 {
+				return nil, nil, fmt.Errorf("empty statement")
+			}
+			return toks[:i], toks[i+1:], nil
+		case "{", "}":
+			return nil, nil, fmt.Errorf("unexpected %q", t)
+		}
+	}
+	return nil, nil, fmt.Errorf("unexpected end of file")
+}
+
+// iscSkipStatement skips a statement or block declaration other than a
+// lease, such as server-duid or failover peer state.
+func iscSkipStatement(toks []string) ([]string, error) {
+	depth := 0
+	for i, t := range toks {
+		switch t {
+		case "{":
+			depth++
+		case "}":
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("unexpected }")
+			}
+			if depth == 0 {
+				return toks[i+1:], nil
+			}
+		case ";":
+			if depth == 0 {
+				return toks[i+1:], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("unexpected end of file")
+}
+
+// iscTokens splits a dhcpd.leases file into words, quoted strings and the
+// punctuation ";", "{" and "}". Quoted strings keep their opening quote, to
+// tell them apart from words and punctuation, and have escapes resolved.
+// Comments are dropped.
+func iscTokens(r io.Reader) ([]string, error) {
+	br := bufio.NewReader(r)
+	var toks []string
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			toks = append(toks, word.String())
+			word.Reset()
+		}
+	}
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			flush()
+			return toks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case c == '#':
+			flush()
+			if _, err := br.ReadString('\n'); err != nil && err != io.EOF {
+				return nil, err
+			}
+		case c == ';' || c == '{' || c == '}':
+			flush()
+			toks = append(toks, string(c))
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			flush()
+		case c == '"':
+			flush()
+			s, err := iscString(br)
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, s)
+		default:
+			word.WriteByte(c)
+		}
+	}
+}
+
+// iscString reads the rest of a quoted string, returning it with its opening
+// quote and resolving backslash escapes
+// including octal ones such as "\001".
+func iscString(br *bufio.Reader) (string, error) {
+	b := []byte{'"'}
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return "", errors.New("unterminated string")
+		}
+		switch c {
+		case '"':
+			return string(b), nil
+		case '\\':
+			c, err = br.ReadByte()
+			if err != nil {
+				return "", errors.New("unterminated string")
+			}
+			if c < '0' || c > '7' {
+				switch c {
+				case 'n':
+					c = '\n'
+				case 't':
+					c = '\t'
+				}
+				b = append(b, c)
+				continue
+			}
+			v := int(c - '0')
+			for i := 0; i < 2; i++ {
+				next, err := br.Peek(1)
+				if err != nil || next[0] < '0' || next[0] > '7' {
+					break
+				}
+				br.ReadByte()
+				v = v*8 + int(next[0]-'0')
+			}
+			b = append(b, byte(v))
+		default:
+			b = append(b, c)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+func TestParseISCLeases(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	cltt := time.Date(2024, 6, 1, 11, 0, 0, 0, time.UTC)
+	ends := time.Date(2024, 6, 1, 13, 0, 0, 0, time.UTC)
+	laptop := dhcp4d.Lease{
+		Addr:           net.IP{192, 168, 1, 10},
+		HardwareAddr:   "aa:bb:cc:dd:ee:01",
+		Hostname:       "laptop",
+		ClientHostname: "laptop",
+		Expiry:         ends,
+		LastACK:        cltt,
+	}
+
+	for _, tt := range []struct {
+		name string
+		in   string
+		want []dhcp4d.Lease
+		err  string
+	}{
+		{
+			name: "active lease",
+			in: `
+lease 192.168.1.10 {
+  starts 6 2024/06/01 11:00:00;
+  ends 6 2024/06/01 13:00:00;
+  cltt 6 2024/06/01 11:00:00;
+  binding state active;
+  next binding state free;
+  rewind binding state free;
+  hardware ethernet aa:bb:cc:dd:ee:01;
+  uid "\001\252\273\314\335\356\001";
+  set vendor-class-identifier = "MSFT 5.0";
+  client-hostname "laptop";
+}`,
+			want: []dhcp4d.Lease{{
+				Addr:           net.IP{192, 168, 1, 10},
+				HardwareAddr:   "aa:bb:cc:dd:ee:01",
+				Hostname:       "laptop",
+				ClientHostname: "laptop",
+				ClientID:       "01aabbccddee01",
+				Expiry:         ends,
+				LastACK:        cltt,
+			}},
+		},
+		{
+			name: "inactive and expired leases",
+			in: `
+lease 192.168.1.11 {
+  starts 6 2024/06/01 09:00:00;
+  ends 6 2024/06/01 10:00:00;
+  binding state active;
+  hardware ethernet aa:bb:cc:dd:ee:02;
+}
+lease 192.168.1.12 {
+  ends 6 2024/06/01 13:00:00;
+  binding state free;
+  hardware ethernet aa:bb:cc:dd:ee:03;
+}
+lease 192.168.1.13 {
+  ends 6 2024/06/01 13:00:00;
+  binding state active;
+}`,
+		},
+		{
+			name: "ends never",
+			in: `
+lease 192.168.1.10 {
+  starts epoch 1717239600; # 2024/06/01 11:00:00
+  ends never;
+  hardware ethernet aa:bb:cc:dd:ee:01;
+}`,
+			want: []dhcp4d.Lease{{
+				Addr:         net.IP{192, 168, 1, 10},
+				HardwareAddr: "aa:bb:cc:dd:ee:01",
+				Expiry:       now.AddDate(100, 0, 0),
+				LastACK:      time.Unix(1717239600, 0),
+			}},
+		},
+		{
+			name: "later entry replaces earlier",
+			in: `
+lease 192.168.1.10 {
+  ends 6 2024/06/01 12:30:00;
+  hardware ethernet aa:bb:cc:dd:ee:09;
+}
+lease 192.168.1.10 {
+  ends 6 2024/06/01 13:00:00;
+  cltt 6 2024/06/01 11:00:00;
+  hardware ethernet aa:bb:cc:dd:ee:01;
+  client-hostname "laptop";
+}`,
+			want: []dhcp4d.Lease{laptop},
+		},
+		{
+			name: "quoted strings with separators",
+			in: `
+lease 192.168.1.10 {
+  ends 6 2024/06/01 13:00:00;
+  hardware ethernet aa:bb:cc:dd:ee:01;
+  set note = "a; b { c } # d";
+  client-hostname "lap;top";
+}`,
+			want: []dhcp4d.Lease{{
+				Addr:           net.IP{192, 168, 1, 10},
+				HardwareAddr:   "aa:bb:cc:dd:ee:01",
+				Hostname:       "lap;top",
+				ClientHostname: "lap;top",
+				Expiry:         ends,
+			}},
+		},
+		{
+			name: "comments and other declarations",
+			in: `
+# The format of this file is documented in the dhcpd.leases(5) manual page.
+# This lease file was written by isc-dhcp-4.4.3
+
+# authoring-byte-order entry is generated, DO NOT DELETE
+authoring-byte-order little-endian;
+
+server-duid "\000\001\000\001";
+
+host printer {
+  dynamic;
+  hardware ethernet aa:bb:cc:dd:ee:0f;
+  fixed-address 192.168.1.5;
+}
+
+lease 192.168.1.10 { # the laptop
+  ends 6 2024/06/01 13:00:00; # one hour
+  cltt 6 2024/06/01 11:00:00;
+  hardware ethernet aa:bb:cc:dd:ee:01;
+  client-hostname "laptop";
+}
+
+failover peer "peer" state {
+  my state normal at 4 2024/05/30 10:00:00;
+  partner state normal at 4 2024/05/30 10:00:00;
+}`,
+			want: []dhcp4d.Lease{laptop},
+		},
+		{
+			name: "empty",
+			in:   "# nothing yet\n",
+		},
+		{
+			name: "truncated lease",
+			in: `
+lease 192.168.1.10 {
+  ends 6 2024/06/01 13:00:00;
+  hardware ethernet aa:bb:cc:dd:ee:01;
+lease 192.168.1.11 {
+  ends 6 2024/06/01 13:00:00;
+  hardware ethernet aa:bb:cc:dd:ee:02;
+}`,
+			err: `unexpected "{"`,
+		},
+		{
+			name: "truncated file",
+			in: `
+lease 192.168.1.10 {
+  ends 6 2024/06/01 13:00:00;
+  hardware ethernet aa:bb:cc:dd:ee:01;
+}
+lease 192.168.1.11 {
+  ends 6 2024/06/01 13:00:00;
+  hardware ethernet aa:bb:cc:dd:ee:02;
+  client-host`,
+			err: "unexpected end of file",
+		},
+		{
+			name: "truncated statement",
+			in: `
+lease 192.168.1.10 {
+  ends 6 2024/06/01 13:00:00;
+  hardware ethernet aa:bb:cc:dd:ee:01;
+}
+lease 192.168.1.11 {
+  ends 6 2024/06/01 13:`,
+			err: "unexpected end of file",
+		},
+		{
+			name: "truncated declaration",
+			in:   "lease 192.168.1.10",
+			err:  "malformed lease declaration",
+		},
+		{
+			name: "truncated host",
+			in: `
+host printer {
+  hardware ethernet aa:bb:cc:dd:ee:0f;`,
+			err: "unexpected end of file",
+		},
+		{
+			name: "unterminated string",
+			in: `
+lease 192.168.1.10 {
+  client-hostname "lap`,
+			err: "unterminated string",
+		},
+		{
+			name: "unbalanced brace",
+			in: `
+lease 192.168.1.10 {
+  hardware ethernet aa:bb:cc:dd:ee:01;
+}
+}`,
+			err: "unexpected }",
+		},
+		{
+			name: "invalid address",
+			in:   "lease 192.168.1 {\n}",
+			err:  "invalid lease address",
+		},
+		{
+			name: "invalid time",
+			in:   "lease 192.168.1.10 {\n  ends 6 2024/06/01;\n}",
+			err:  "invalid time",
+		},
+		{
+			name: "invalid hardware address",
+			in:   "lease 192.168.1.10 {\n  hardware ethernet aa:bb:cc;\n}",
+			err:  "invalid MAC address",
+		},
+		{
+			name: "malformed binding state",
+			in:   "lease 192.168.1.10 {\n  binding active;\n}",
+			err:  "malformed binding statement",
+		},
+		{
+			name: "malformed client-hostname",
+			in:   "lease 192.168.1.10 {\n  client-hostname;\n}",
+			err:  "malformed client-hostname statement",
+		},
+		{
+			name: "invalid uid",
+			in:   "lease 192.168.1.10 {\n  uid 01:zz;\n}",
+			err:  "invalid uid",
+		},
+		{
+			name: "empty statement",
+			in:   "lease 192.168.1.10 {\n  ;\n}",
+			err:  "empty statement",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseISCLeases(strings.NewReader(tt.in), now)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("parseISCLeases() = %v, %v, want error %q", got, err, tt.err)
+				}
+				if got != nil {
+					t.Errorf("parseISCLeases() returned %d leases with error %v", len(got), err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseISCLeases() =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
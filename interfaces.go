@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+// errInterfaceNotReady is returned by newHandler if the interface does not
+// exist or has no address in the network yet.
+var errInterfaceNotReady = errors.New("interface not ready")
+
+// interfaceAddr returns the interface of conf and the server's address on it:
+// the virtual IP if it is present, else the configured server_id, else the
+// one in the same network as the pool.
+func interfaceAddr(conf config.Network) (*net.Interface, net.IP, error) {
+	iface, err := net.InterfaceByName(conf.Interface)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", errInterfaceNotReady, err)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	startIP := net.ParseIP(conf.StartIP)
+	if startIP == nil {
+		return nil, nil, fmt.Errorf("parse start_ip on %s error invalid: %s", conf.Interface, conf.StartIP)
+	}
+
+	if vip := net.ParseIP(conf.VirtualIP); vip != nil {
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(vip) {
+				return iface, ipnet.IP, nil
+			}
+		}
+	}
+	if sid := net.ParseIP(conf.ServerID); sid != nil {
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(sid) {
+				return iface, ipnet.IP, nil
+			}
+		}
+		return nil, nil, fmt.Errorf("%w: server_id %s is not on %s", errInterfaceNotReady, conf.ServerID, conf.Interface)
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if ok && ipnet.Contains(startIP) {
+			return iface, ipnet.IP, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("%w: failed to find network %s on %s", errInterfaceNotReady, conf.StartIP, conf.Interface)
+}
+
+// interfaceAddrs returns the addresses of the interface of n, in its
+// namespace.
+func interfaceAddrs(n config.Network) ([]net.Addr, error) {
+	var addrs []net.Addr
+	err := inNetns(n.Netns, func() error {
+		iface, err := net.InterfaceByName(n.Interface)
+		if err != nil {
+			return err
+		}
+		addrs, err = iface.Addrs()
+		return err
+	})
+	return addrs, err
+}
+
+// isInterfacePattern reports whether the interface of a network is a glob
+// pattern rather than a name.
+func isInterfacePattern(iface string) bool {
+	return strings.ContainsAny(iface, "*?[")
+}
+
+// expandNetworks replaces networks whose interface is a pattern with a copy
+// per matching interface of this host. Matches for interfaces that are
+// configured explicitly, or by an earlier pattern, are skipped.
+func expandNetworks(networks []config.Network) ([]config.Network, error) {
+	var patterns bool
+	explicit := make(map[string]bool)
+	for _, n := range networks {
+		if isInterfacePattern(n.Interface) {
+			patterns = true
+		} else {
+			explicit[n.Interface] = true
+		}
+	}
+	if !patterns {
+		return networks, nil
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	expanded := make([]config.Network, 0, len(networks))
+	matched := make(map[string]bool)
+	for _, n := range networks {
+		if !isInterfacePattern(n.Interface) {
+			expanded = append(expanded, n)
+			continue
+		}
+		var found bool
+		for _, iface := range ifaces {
+			ok, err := path.Match(n.Interface, iface.Name)
+			if err != nil {
+				return nil, fmt.Errorf("interface pattern %q: %w", n.Interface, err)
+			}
+			if !ok || explicit[iface.Name] || matched[iface.Name] {
+				continue
+			}
+			matched[iface.Name] = true
+			found = true
+			m := n
+			m.Interface = iface.Name
+			expanded = append(expanded, m)
+		}
+		if !found {
+			slog.Warn("no interfaces match pattern", "pattern", n.Interface)
+		}
+	}
+	return expanded, nil
+}
+
+// waitHandler builds the handler for the config of nw, retrying with backoff
+// while its interface is not ready, for up to the configured interface wait
+// timeout. Each attempt uses the latest config, which reload may change, and
+// the one the handler was built for is returned. It returns a nil handler if
+// the daemon shuts down or the network is stopped while waiting.
+func (d *daemon) waitHandler(nw *network) (*dhcp4d.Handler, config.Network, error) {
+	timeout := d.conf.InterfaceWaitTimeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+	deadline := time.Now().Add(timeout)
+	backoff := 100 * time.Millisecond
+	waited := false
+	for {
+		d.mu.Lock()
+		conf := nw.conf
+		d.mu.Unlock()
+		h, err := d.newHandler(conf)
+		if err == nil && waited {
+			slog.Info("interface ready", "iface", conf.Interface)
+		}
+		if err == nil || !errors.Is(err, errInterfaceNotReady) || time.Now().After(deadline) {
+			return h, conf, err
+		}
+		if !waited {
+			slog.Warn("waiting for interface", "iface", conf.Interface, "timeout", timeout, "err", err)
+			waited = true
+		}
+
+		select {
+		case <-d.done:
+			return nil, conf, nil
+		case <-time.After(backoff):
+		}
+		d.mu.Lock()
+		current := d.networks[conf.Interface] == nw
+		d.mu.Unlock()
+		if !current {
+			return nil, conf, nil
+		}
+		backoff = min(2*backoff, 5*time.Second)
+	}
+}
@@ -0,0 +1,83 @@
+package dhcp4
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestLongOption(t *testing.T) {
+	v := bytes.Repeat([]byte{'a'}, 300)
+	p := NewPacket(BootReply)
+	p.AddOption(OptionDomainSearch, v)
+	if n := bytes.Count(p.Options(), []byte{byte(OptionDomainSearch), 255}); n != 1 {
+		t.Fatalf("got %d options of 255 bytes, want 1", n)
+	}
+	if got := p.ParseOptions()[OptionDomainSearch]; !bytes.Equal(got, v) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(v))
+	}
+}
+
+func TestDomainSearch(t *testing.T) {
+	domains := []string{"eng.example.com", "example.com", "corp.example.com", "example.org"}
+	b, err := EncodeDomainSearch(domains)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The suffix example.com is written once.
+	if n := bytes.Count(b, []byte("example")); n != 2 {
+		t.Fatalf("example written %d times, want 2: %q", n, b)
+	}
+	got, err := DecodeDomainSearch(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, domains) {
+		t.Fatalf("got %q, want %q", got, domains)
+	}
+
+	if _, err := DecodeDomainSearch([]byte{0xc0, 0}); err == nil {
+		t.Fatal("pointer loop decoded")
+	}
+	if _, err := EncodeDomainSearch([]string{"a..b"}); err == nil {
+		t.Fatal("empty label encoded")
+	}
+}
+
+func TestClasslessRoutes(t *testing.T) {
+	_, dest, _ := net.ParseCIDR("10.17.0.0/16")
+	routes := []Route{
+		{Dest: &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}, Router: net.IPv4(192, 168, 1, 1).To4()},
+		{Dest: dest, Router: net.IPv4(192, 168, 1, 2).To4()},
+	}
+	b := EncodeClasslessRoutes(routes)
+	want := []byte{0, 192, 168, 1, 1, 16, 10, 17, 192, 168, 1, 2}
+	if !bytes.Equal(b, want) {
+		t.Fatalf("got %v, want %v", b, want)
+	}
+	got, err := DecodeClasslessRoutes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[1].Dest.String() != "10.17.0.0/16" || !got[1].Router.Equal(routes[1].Router) {
+		t.Fatalf("got %v", got)
+	}
+	if _, err := DecodeClasslessRoutes(b[:len(b)-1]); err == nil {
+		t.Fatal("truncated routes decoded")
+	}
+}
+
+func TestRelayAgentInfo(t *testing.T) {
+	sub := map[byte][]byte{AgentCircuitID: []byte("eth0:12"), AgentRemoteID: {1, 2, 3}}
+	got, err := DecodeRelayAgentInfo(EncodeRelayAgentInfo(sub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, sub) {
+		t.Fatalf("got %v, want %v", got, sub)
+	}
+	if _, err := DecodeRelayAgentInfo([]byte{AgentCircuitID, 5, 'x'}); err == nil {
+		t.Fatal("truncated sub-option decoded")
+	}
+}
@@ -0,0 +1,34 @@
+package dhcp4
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// IPRange returns the number of addresses from start to stop, inclusive.
+func IPRange(start, stop net.IP) int {
+	return int(binary.BigEndian.Uint32(stop.To4())) - int(binary.BigEndian.Uint32(start.To4())) + 1
+}
+
+// IPAdd returns the address add addresses after start.
+func IPAdd(start net.IP, add int) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(start.To4())+uint32(add))
+	return ip
+}
+
+// IPLess reports whether a sorts before b.
+func IPLess(a, b net.IP) bool {
+	b = b.To4()
+	for i, ai := range a.To4() {
+		if ai != b[i] {
+			return ai < b[i]
+		}
+	}
+	return false
+}
+
+// IPInRange reports whether ip is from start to stop, inclusive.
+func IPInRange(start, stop, ip net.IP) bool {
+	return !(IPLess(ip, start) || IPLess(stop, ip))
+}
@@ -0,0 +1,298 @@
+package dhcp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+)
+
+// OptionCode is the code of a DHCP option, RFC 2132.
+type OptionCode byte
+
+const (
+	End                                              OptionCode = 255
+	Pad                                              OptionCode = 0
+	OptionSubnetMask                                 OptionCode = 1
+	OptionTimeOffset                                 OptionCode = 2
+	OptionRouter                                     OptionCode = 3
+	OptionTimeServer                                 OptionCode = 4
+	OptionNameServer                                 OptionCode = 5
+	OptionDomainNameServer                           OptionCode = 6
+	OptionLogServer                                  OptionCode = 7
+	OptionCookieServer                               OptionCode = 8
+	OptionLPRServer                                  OptionCode = 9
+	OptionImpressServer                              OptionCode = 10
+	OptionResourceLocationServer                     OptionCode = 11
+	OptionHostName                                   OptionCode = 12
+	OptionBootFileSize                               OptionCode = 13
+	OptionMeritDumpFile                              OptionCode = 14
+	OptionDomainName                                 OptionCode = 15
+	OptionSwapServer                                 OptionCode = 16
+	OptionRootPath                                   OptionCode = 17
+	OptionExtensionsPath                             OptionCode = 18
+	OptionIPForwardingEnableDisable                  OptionCode = 19
+	OptionNonLocalSourceRoutingEnableDisable         OptionCode = 20
+	OptionPolicyFilter                               OptionCode = 21
+	OptionMaximumDatagramReassemblySize              OptionCode = 22
+	OptionDefaultIPTimeToLive                        OptionCode = 23
+	OptionPathMTUAgingTimeout                        OptionCode = 24
+	OptionPathMTUPlateauTable                        OptionCode = 25
+	OptionInterfaceMTU                               OptionCode = 26
+	OptionAllSubnetsAreLocal                         OptionCode = 27
+	OptionBroadcastAddress                           OptionCode = 28
+	OptionPerformMaskDiscovery                       OptionCode = 29
+	OptionMaskSupplier                               OptionCode = 30
+	OptionPerformRouterDiscovery                     OptionCode = 31
+	OptionRouterSolicitationAddress                  OptionCode = 32
+	OptionStaticRoute                                OptionCode = 33
+	OptionTrailerEncapsulation                       OptionCode = 34
+	OptionARPCacheTimeout                            OptionCode = 35
+	OptionEthernetEncapsulation                      OptionCode = 36
+	OptionTCPDefaultTTL                              OptionCode = 37
+	OptionTCPKeepaliveInterval                       OptionCode = 38
+	OptionTCPKeepaliveGarbage                        OptionCode = 39
+	OptionNetworkInformationServiceDomain            OptionCode = 40
+	OptionNetworkInformationServers                  OptionCode = 41
+	OptionNetworkTimeProtocolServers                 OptionCode = 42
+	OptionVendorSpecificInformation                  OptionCode = 43
+	OptionNetBIOSOverTCPIPNameServer                 OptionCode = 44
+	OptionNetBIOSOverTCPIPDatagramDistributionServer OptionCode = 45
+	OptionNetBIOSOverTCPIPNodeType                   OptionCode = 46
+	OptionNetBIOSOverTCPIPScope                      OptionCode = 47
+	OptionXWindowSystemFontServer                    OptionCode = 48
+	OptionXWindowSystemDisplayManager                OptionCode = 49
+	OptionRequestedIPAddress                         OptionCode = 50
+	OptionIPAddressLeaseTime                         OptionCode = 51
+	OptionOverload                                   OptionCode = 52
+	OptionDHCPMessageType                            OptionCode = 53
+	OptionServerIdentifier                           OptionCode = 54
+	OptionParameterRequestList                       OptionCode = 55
+	OptionMessage                                    OptionCode = 56
+	OptionMaximumDHCPMessageSize                     OptionCode = 57
+	OptionRenewalTimeValue                           OptionCode = 58
+	OptionRebindingTimeValue                         OptionCode = 59
+	OptionVendorClassIdentifier                      OptionCode = 60
+	OptionClientIdentifier                           OptionCode = 61
+	OptionNetworkInformationServicePlusDomain        OptionCode = 64
+	OptionNetworkInformationServicePlusServers       OptionCode = 65
+	OptionTFTPServerName                             OptionCode = 66
+	OptionBootFileName                               OptionCode = 67
+	OptionMobileIPHomeAgent                          OptionCode = 68
+	OptionSimpleMailTransportProtocol                OptionCode = 69
+	OptionPostOfficeProtocolServer                   OptionCode = 70
+	OptionNetworkNewsTransportProtocol               OptionCode = 71
+	OptionDefaultWorldWideWebServer                  OptionCode = 72
+	OptionDefaultFingerServer                        OptionCode = 73
+	OptionDefaultInternetRelayChatServer             OptionCode = 74
+	OptionStreetTalkServer                           OptionCode = 75
+	OptionStreetTalkDirectoryAssistance              OptionCode = 76
+	OptionUserClass                                  OptionCode = 77
+	OptionClientFQDN                                 OptionCode = 81
+	OptionRelayAgentInformation                      OptionCode = 82
+	OptionClientArchitecture                         OptionCode = 93
+	OptionTZPOSIXString                              OptionCode = 100
+	OptionTZDatabaseString                           OptionCode = 101
+	OptionDomainSearch                               OptionCode = 119
+	OptionClasslessRouteFormat                       OptionCode = 121
+)
+
+var optionNames = map[OptionCode]string{
+	End:                                              "End",
+	Pad:                                              "Pad",
+	OptionSubnetMask:                                 "OptionSubnetMask",
+	OptionTimeOffset:                                 "OptionTimeOffset",
+	OptionRouter:                                     "OptionRouter",
+	OptionTimeServer:                                 "OptionTimeServer",
+	OptionNameServer:                                 "OptionNameServer",
+	OptionDomainNameServer:                           "OptionDomainNameServer",
+	OptionLogServer:                                  "OptionLogServer",
+	OptionCookieServer:                               "OptionCookieServer",
+	OptionLPRServer:                                  "OptionLPRServer",
+	OptionImpressServer:                              "OptionImpressServer",
+	OptionResourceLocationServer:                     "OptionResourceLocationServer",
+	OptionHostName:                                   "OptionHostName",
+	OptionBootFileSize:                               "OptionBootFileSize",
+	OptionMeritDumpFile:                              "OptionMeritDumpFile",
+	OptionDomainName:                                 "OptionDomainName",
+	OptionSwapServer:                                 "OptionSwapServer",
+	OptionRootPath:                                   "OptionRootPath",
+	OptionExtensionsPath:                             "OptionExtensionsPath",
+	OptionIPForwardingEnableDisable:                  "OptionIPForwardingEnableDisable",
+	OptionNonLocalSourceRoutingEnableDisable:         "OptionNonLocalSourceRoutingEnableDisable",
+	OptionPolicyFilter:                               "OptionPolicyFilter",
+	OptionMaximumDatagramReassemblySize:              "OptionMaximumDatagramReassemblySize",
+	OptionDefaultIPTimeToLive:                        "OptionDefaultIPTimeToLive",
+	OptionPathMTUAgingTimeout:                        "OptionPathMTUAgingTimeout",
+	OptionPathMTUPlateauTable:                        "OptionPathMTUPlateauTable",
+	OptionInterfaceMTU:                               "OptionInterfaceMTU",
+	OptionAllSubnetsAreLocal:                         "OptionAllSubnetsAreLocal",
+	OptionBroadcastAddress:                           "OptionBroadcastAddress",
+	OptionPerformMaskDiscovery:                       "OptionPerformMaskDiscovery",
+	OptionMaskSupplier:                               "OptionMaskSupplier",
+	OptionPerformRouterDiscovery:                     "OptionPerformRouterDiscovery",
+	OptionRouterSolicitationAddress:                  "OptionRouterSolicitationAddress",
+	OptionStaticRoute:                                "OptionStaticRoute",
+	OptionTrailerEncapsulation:                       "OptionTrailerEncapsulation",
+	OptionARPCacheTimeout:                            "OptionARPCacheTimeout",
+	OptionEthernetEncapsulation:                      "OptionEthernetEncapsulation",
+	OptionTCPDefaultTTL:                              "OptionTCPDefaultTTL",
+	OptionTCPKeepaliveInterval:                       "OptionTCPKeepaliveInterval",
+	OptionTCPKeepaliveGarbage:                        "OptionTCPKeepaliveGarbage",
+	OptionNetworkInformationServiceDomain:            "OptionNetworkInformationServiceDomain",
+	OptionNetworkInformationServers:                  "OptionNetworkInformationServers",
+	OptionNetworkTimeProtocolServers:                 "OptionNetworkTimeProtocolServers",
+	OptionVendorSpecificInformation:                  "OptionVendorSpecificInformation",
+	OptionNetBIOSOverTCPIPNameServer:                 "OptionNetBIOSOverTCPIPNameServer",
+	OptionNetBIOSOverTCPIPDatagramDistributionServer: "OptionNetBIOSOverTCPIPDatagramDistributionServer",
+	OptionNetBIOSOverTCPIPNodeType:                   "OptionNetBIOSOverTCPIPNodeType",
+	OptionNetBIOSOverTCPIPScope:                      "OptionNetBIOSOverTCPIPScope",
+	OptionXWindowSystemFontServer:                    "OptionXWindowSystemFontServer",
+	OptionXWindowSystemDisplayManager:                "OptionXWindowSystemDisplayManager",
+	OptionRequestedIPAddress:                         "OptionRequestedIPAddress",
+	OptionIPAddressLeaseTime:                         "OptionIPAddressLeaseTime",
+	OptionOverload:                                   "OptionOverload",
+	OptionDHCPMessageType:                            "OptionDHCPMessageType",
+	OptionServerIdentifier:                           "OptionServerIdentifier",
+	OptionParameterRequestList:                       "OptionParameterRequestList",
+	OptionMessage:                                    "OptionMessage",
+	OptionMaximumDHCPMessageSize:                     "OptionMaximumDHCPMessageSize",
+	OptionRenewalTimeValue:                           "OptionRenewalTimeValue",
+	OptionRebindingTimeValue:                         "OptionRebindingTimeValue",
+	OptionVendorClassIdentifier:                      "OptionVendorClassIdentifier",
+	OptionClientIdentifier:                           "OptionClientIdentifier",
+	OptionNetworkInformationServicePlusDomain:        "OptionNetworkInformationServicePlusDomain",
+	OptionNetworkInformationServicePlusServers:       "OptionNetworkInformationServicePlusServers",
+	OptionTFTPServerName:                             "OptionTFTPServerName",
+	OptionBootFileName:                               "OptionBootFileName",
+	OptionMobileIPHomeAgent:                          "OptionMobileIPHomeAgent",
+	OptionSimpleMailTransportProtocol:                "OptionSimpleMailTransportProtocol",
+	OptionPostOfficeProtocolServer:                   "OptionPostOfficeProtocolServer",
+	OptionNetworkNewsTransportProtocol:               "OptionNetworkNewsTransportProtocol",
+	OptionDefaultWorldWideWebServer:                  "OptionDefaultWorldWideWebServer",
+	OptionDefaultFingerServer:                        "OptionDefaultFingerServer",
+	OptionDefaultInternetRelayChatServer:             "OptionDefaultInternetRelayChatServer",
+	OptionStreetTalkServer:                           "OptionStreetTalkServer",
+	OptionStreetTalkDirectoryAssistance:              "OptionStreetTalkDirectoryAssistance",
+	OptionUserClass:                                  "OptionUserClass",
+	OptionClientFQDN:                                 "OptionFQDN",
+	OptionRelayAgentInformation:                      "OptionRelayAgentInformation",
+	OptionClientArchitecture:                         "OptionClientArchitecture",
+	OptionTZPOSIXString:                              "OptionTZPOSIXString",
+	OptionTZDatabaseString:                           "OptionTZDatabaseString",
+	OptionDomainSearch:                               "OptionDomainSearch",
+	OptionClasslessRouteFormat:                       "OptionClasslessRouteFormat",
+}
+
+func (c OptionCode) String() string {
+	if name, ok := optionNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("OptionCode(%d)", byte(c))
+}
+
+// Option is an option of a message.
+type Option struct {
+	Code  OptionCode
+	Value []byte
+}
+
+// Options are the options of a message by code.
+type Options map[OptionCode][]byte
+
+// SelectOrder returns the options with the codes of order, usually the
+// parameter request list, in that order.
+func (o Options) SelectOrder(order []byte) []Option {
+	opts := make([]Option, 0, len(order))
+	for _, c := range order {
+		if v, ok := o[OptionCode(c)]; ok {
+			opts = append(opts, Option{Code: OptionCode(c), Value: v})
+		}
+	}
+	return opts
+}
+
+// SelectOrderOrAll is like SelectOrder, but returns all options, in code
+// order, if order is nil.
+func (o Options) SelectOrderOrAll(order []byte) []Option {
+	if order != nil {
+		return o.SelectOrder(order)
+	}
+	opts := make([]Option, 0, len(o))
+	for c, v := range o {
+		opts = append(opts, Option{Code: c, Value: v})
+	}
+	slices.SortFunc(opts, func(a, b Option) int { return int(a.Code) - int(b.Code) })
+	return opts
+}
+
+// IP returns the address of option code, or nil if it is not a single IPv4
+// address.
+func (o Options) IP(code OptionCode) net.IP {
+	if v := o[code]; len(v) == net.IPv4len {
+		return net.IP(v)
+	}
+	return nil
+}
+
+// IPs returns the addresses of option code, or nil if it is not a list of
+// IPv4 addresses.
+func (o Options) IPs(code OptionCode) []net.IP {
+	v := o[code]
+	if len(v) == 0 || len(v)%net.IPv4len != 0 {
+		return nil
+	}
+	ips := make([]net.IP, 0, len(v)/net.IPv4len)
+	for ; len(v) > 0; v = v[net.IPv4len:] {
+		ips = append(ips, net.IP(v[:net.IPv4len]))
+	}
+	return ips
+}
+
+// Uint16 returns the value of option code if it is a 16 bit integer.
+func (o Options) Uint16(code OptionCode) (uint16, bool) {
+	if v := o[code]; len(v) == 2 {
+		return binary.BigEndian.Uint16(v), true
+	}
+	return 0, false
+}
+
+// Uint32 returns the value of option code if it is a 32 bit integer.
+func (o Options) Uint32(code OptionCode) (uint32, bool) {
+	if v := o[code]; len(v) == 4 {
+		return binary.BigEndian.Uint32(v), true
+	}
+	return 0, false
+}
+
+// Duration returns the value of option code if it is a time in seconds,
+// like the lease time.
+func (o Options) Duration(code OptionCode) (time.Duration, bool) {
+	s, ok := o.Uint32(code)
+	return time.Duration(s) * time.Second, ok
+}
+
+// JoinIPs encodes ips as a list of IPv4 addresses, as in OptionRouter.
+func JoinIPs(ips []net.IP) []byte {
+	b := make([]byte, 0, len(ips)*net.IPv4len)
+	for _, ip := range ips {
+		b = append(b, ip.To4()...)
+	}
+	return b
+}
+
+// EncodeUint16 encodes v as a 16 bit integer option value.
+func EncodeUint16(v uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, v)
+}
+
+// EncodeUint32 encodes v as a 32 bit integer option value.
+func EncodeUint32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+// OptionsLeaseTime encodes d in seconds, as in OptionIPAddressLeaseTime.
+func OptionsLeaseTime(d time.Duration) []byte {
+	return EncodeUint32(uint32(d / time.Second))
+}
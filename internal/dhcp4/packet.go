@@ -0,0 +1,251 @@
+// Package dhcp4 encodes and decodes DHCPv4 messages (RFC 2131) and their
+// options (RFC 2132), and serves them over a connection.
+package dhcp4
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+// OpCode is the op field of a message.
+type OpCode byte
+
+const (
+	BootRequest OpCode = 1 // from a client
+	BootReply   OpCode = 2 // from a server
+)
+
+func (o OpCode) String() string {
+	switch o {
+	case BootRequest:
+		return "BootRequest"
+	case BootReply:
+		return "BootReply"
+	}
+	return "OpCode(" + strconv.Itoa(int(o)) + ")"
+}
+
+// MessageType is the value of OptionDHCPMessageType.
+type MessageType byte
+
+const (
+	Discover MessageType = 1
+	Offer    MessageType = 2
+	Request  MessageType = 3
+	Decline  MessageType = 4
+	ACK      MessageType = 5
+	NAK      MessageType = 6
+	Release  MessageType = 7
+	Inform   MessageType = 8
+)
+
+var messageTypeNames = [...]string{"", "Discover", "Offer", "Request", "Decline", "ACK", "NAK", "Release", "Inform"}
+
+func (t MessageType) String() string {
+	if t >= Discover && t <= Inform {
+		return messageTypeNames[t]
+	}
+	return "MessageType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// magicCookie starts the options field.
+var magicCookie = []byte{99, 130, 83, 99}
+
+// Packet is a DHCP message. The fixed fields are 240 bytes, including the
+// magic cookie, followed by the options.
+type Packet []byte
+
+func (p Packet) OpCode() OpCode { return OpCode(p[0]) }
+func (p Packet) HType() byte    { return p[1] }
+func (p Packet) HLen() byte     { return p[2] }
+func (p Packet) Hops() byte     { return p[3] }
+func (p Packet) XId() []byte    { return p[4:8] }
+func (p Packet) Secs() []byte   { return p[8:10] }
+func (p Packet) Flags() []byte  { return p[10:12] }
+func (p Packet) CIAddr() net.IP { return net.IP(p[12:16]) }
+func (p Packet) YIAddr() net.IP { return net.IP(p[16:20]) }
+func (p Packet) SIAddr() net.IP { return net.IP(p[20:24]) }
+func (p Packet) GIAddr() net.IP { return net.IP(p[24:28]) }
+func (p Packet) Cookie() []byte { return p[236:240] }
+
+// CHAddr returns the client hardware address, of at most the 16 bytes of
+// the field.
+func (p Packet) CHAddr() net.HardwareAddr {
+	return net.HardwareAddr(p[28 : 28+min(int(p.HLen()), 16)])
+}
+
+// SName returns the server host name field, up to its first NUL.
+func (p Packet) SName() []byte { return trimNull(p[44:108]) }
+
+// File returns the boot file name field, up to its first NUL.
+func (p Packet) File() []byte { return trimNull(p[108:236]) }
+
+func trimNull(b []byte) []byte {
+	for i, c := range b {
+		if c == 0 {
+			return b[:i]
+		}
+	}
+	return b
+}
+
+// Options returns the options field, after the magic cookie.
+func (p Packet) Options() []byte {
+	if len(p) > 240 {
+		return p[240:]
+	}
+	return nil
+}
+
+// Broadcast reports whether the client asked for broadcast replies.
+func (p Packet) Broadcast() bool { return p[10]&0x80 != 0 }
+
+func (p Packet) SetBroadcast(broadcast bool) {
+	if broadcast {
+		p[10] |= 0x80
+	} else {
+		p[10] &^= 0x80
+	}
+}
+
+func (p Packet) SetOpCode(c OpCode)      { p[0] = byte(c) }
+func (p Packet) SetHType(hType byte)     { p[1] = hType }
+func (p Packet) SetHops(hops byte)       { p[3] = hops }
+func (p Packet) SetXId(xid []byte)       { copy(p.XId(), xid) }
+func (p Packet) SetSecs(secs []byte)     { copy(p.Secs(), secs) }
+func (p Packet) SetFlags(flags []byte)   { copy(p.Flags(), flags) }
+func (p Packet) SetCIAddr(ip net.IP)     { copy(p.CIAddr(), ip.To4()) }
+func (p Packet) SetYIAddr(ip net.IP)     { copy(p.YIAddr(), ip.To4()) }
+func (p Packet) SetSIAddr(ip net.IP)     { copy(p.SIAddr(), ip.To4()) }
+func (p Packet) SetGIAddr(ip net.IP)     { copy(p.GIAddr(), ip.To4()) }
+func (p Packet) SetCookie(cookie []byte) { copy(p.Cookie(), cookie) }
+
+// SetCHAddr sets the client hardware address and its length.
+func (p Packet) SetCHAddr(a net.HardwareAddr) {
+	clear(p[28:44])
+	p[2] = byte(copy(p[28:44], a))
+}
+
+// SetSName sets the server host name field, NUL terminated if it fits.
+func (p Packet) SetSName(sname []byte) { setField(p[44:108], sname) }
+
+// SetFile sets the boot file name field, NUL terminated if it fits.
+func (p Packet) SetFile(file []byte) { setField(p[108:236], file) }
+
+func setField(field, v []byte) {
+	clear(field)
+	copy(field, v)
+}
+
+// ParseOptions returns the options of the options field. Options that
+// appear more than once are concatenated, as RFC 3396 splits long options.
+func (p Packet) ParseOptions() Options {
+	return ParseOptionField(p.Options())
+}
+
+// ParseOptionField returns the options of an encoded option field, such as
+// the options field of a message or, if they are overloaded, its file and
+// sname fields. Parsing stops at the end option or at a truncated option.
+func ParseOptionField(b []byte) Options {
+	options := make(Options, 10)
+	for len(b) >= 1 && OptionCode(b[0]) != End {
+		if OptionCode(b[0]) == Pad {
+			b = b[1:]
+			continue
+		}
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			break
+		}
+		code, v := OptionCode(b[0]), b[2:2+int(b[1])]
+		if prev, ok := options[code]; ok {
+			v = append(prev[:len(prev):len(prev)], v...)
+		}
+		options[code] = v
+		b = b[2+int(b[1]):]
+	}
+	return options
+}
+
+// NewPacket returns a message without options.
+func NewPacket(op OpCode) Packet {
+	p := make(Packet, 241)
+	p.SetOpCode(op)
+	p.SetHType(1) // Ethernet
+	p.SetCookie(magicCookie)
+	p[240] = byte(End)
+	return p
+}
+
+// AddOption appends an option. Values longer than 255 bytes are split
+// into several options, per RFC 3396.
+func (p *Packet) AddOption(code OptionCode, value []byte) {
+	*p = (*p)[:len(*p)-1] // the end option
+	for {
+		n := min(len(value), 255)
+		*p = append(*p, byte(code), byte(n))
+		*p = append(*p, value[:n]...)
+		value = value[n:]
+		if len(value) == 0 {
+			break
+		}
+	}
+	*p = append(*p, byte(End))
+}
+
+// StripOptions removes all options.
+func (p *Packet) StripOptions() {
+	*p = append((*p)[:240], byte(End))
+}
+
+// PadToMinSize pads the message to 272 bytes, so that with the UDP header
+// it is 300 bytes, the minimum of BOOTP that old clients expect.
+func (p *Packet) PadToMinSize() {
+	if n := len(*p); n < 272 {
+		*p = append(*p, make([]byte, 272-n)...)
+	}
+}
+
+// RequestPacket returns a client message of type mt.
+func RequestPacket(mt MessageType, chaddr net.HardwareAddr, ciaddr net.IP, xid []byte, broadcast bool, options []Option) Packet {
+	p := NewPacket(BootRequest)
+	p.SetCHAddr(chaddr)
+	p.SetXId(xid)
+	if ciaddr != nil {
+		p.SetCIAddr(ciaddr)
+	}
+	p.SetBroadcast(broadcast)
+	p.AddOption(OptionDHCPMessageType, []byte{byte(mt)})
+	for _, o := range options {
+		p.AddOption(o.Code, o.Value)
+	}
+	p.PadToMinSize()
+	return p
+}
+
+// ReplyPacket returns the reply of type mt to req from the server
+// serverID, assigning yiaddr for leaseDuration if it is positive. The relay
+// agent information of req is echoed as the last option, RFC 3046.
+func ReplyPacket(req Packet, mt MessageType, serverID, yiaddr net.IP, leaseDuration time.Duration, options []Option) Packet {
+	p := NewPacket(BootReply)
+	p.SetXId(req.XId())
+	p.SetFlags(req.Flags())
+	p.SetYIAddr(yiaddr)
+	p.SetGIAddr(req.GIAddr())
+	p.SetCHAddr(req.CHAddr())
+	p.AddOption(OptionDHCPMessageType, []byte{byte(mt)})
+	p.AddOption(OptionServerIdentifier, serverID.To4())
+	if leaseDuration > 0 {
+		p.AddOption(OptionIPAddressLeaseTime, OptionsLeaseTime(leaseDuration))
+	}
+	for _, o := range options {
+		if o.Code != OptionRelayAgentInformation {
+			p.AddOption(o.Code, o.Value)
+		}
+	}
+	if v, ok := req.ParseOptions()[OptionRelayAgentInformation]; ok {
+		p.AddOption(OptionRelayAgentInformation, v)
+	}
+	p.PadToMinSize()
+	return p
+}
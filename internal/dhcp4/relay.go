@@ -0,0 +1,37 @@
+package dhcp4
+
+import "errors"
+
+// Sub-options of OptionRelayAgentInformation, RFC 3046 and RFC 3527.
+const (
+	AgentCircuitID     = 1
+	AgentRemoteID      = 2
+	AgentLinkSelection = 5
+)
+
+// DecodeRelayAgentInfo decodes the sub-options of
+// OptionRelayAgentInformation by code.
+func DecodeRelayAgentInfo(b []byte) (map[byte][]byte, error) {
+	sub := make(map[byte][]byte)
+	for len(b) > 0 {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, errors.New("invalid relay agent information")
+		}
+		sub[b[0]] = b[2 : 2+int(b[1])]
+		b = b[2+int(b[1]):]
+	}
+	return sub, nil
+}
+
+// EncodeRelayAgentInfo encodes the sub-options of
+// OptionRelayAgentInformation, in code order.
+func EncodeRelayAgentInfo(sub map[byte][]byte) []byte {
+	var b []byte
+	for code := 0; code < 256; code++ {
+		if v, ok := sub[byte(code)]; ok {
+			b = append(b, byte(code), byte(len(v)))
+			b = append(b, v...)
+		}
+	}
+	return b
+}
@@ -0,0 +1,46 @@
+package dhcp4
+
+import (
+	"errors"
+	"net"
+)
+
+// Route is a route of OptionClasslessRouteFormat.
+type Route struct {
+	Dest   *net.IPNet
+	Router net.IP
+}
+
+// EncodeClasslessRoutes encodes routes as the value of
+// OptionClasslessRouteFormat, RFC 3442.
+func EncodeClasslessRoutes(routes []Route) []byte {
+	var b []byte
+	for _, r := range routes {
+		ones, _ := r.Dest.Mask.Size()
+		b = append(b, byte(ones))
+		b = append(b, r.Dest.IP.To4()[:(ones+7)/8]...)
+		b = append(b, r.Router.To4()...)
+	}
+	return b
+}
+
+// DecodeClasslessRoutes decodes the value of OptionClasslessRouteFormat.
+func DecodeClasslessRoutes(b []byte) ([]Route, error) {
+	var routes []Route
+	for len(b) > 0 {
+		ones := int(b[0])
+		n := (ones + 7) / 8
+		if ones > 32 || len(b) < 1+n+4 {
+			return nil, errors.New("invalid classless static routes")
+		}
+		dest := make(net.IP, net.IPv4len)
+		copy(dest, b[1:1+n])
+		mask := net.CIDRMask(ones, 32)
+		routes = append(routes, Route{
+			Dest:   &net.IPNet{IP: dest.Mask(mask), Mask: mask},
+			Router: net.IP(b[1+n : 1+n+4]),
+		})
+		b = b[1+n+4:]
+	}
+	return routes, nil
+}
@@ -0,0 +1,92 @@
+package dhcp4
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errInvalidName = errors.New("invalid domain name")
+
+// EncodeDomainSearch encodes domains as the value of OptionDomainSearch,
+// RFC 3397, compressing repeated suffixes. Values over 255 bytes are split
+// by AddOption.
+func EncodeDomainSearch(domains []string) ([]byte, error) {
+	var b []byte
+	offsets := make(map[string]int) // of the names written, by suffix
+	for _, domain := range domains {
+		labels := strings.Split(strings.TrimSuffix(domain, "."), ".")
+		i := 0
+		for ; i < len(labels); i++ {
+			suffix := strings.ToLower(strings.Join(labels[i:], "."))
+			if off, ok := offsets[suffix]; ok {
+				b = append(b, 0xc0|byte(off>>8), byte(off))
+				break
+			}
+			if l := len(labels[i]); l == 0 || l > 63 {
+				return nil, fmt.Errorf("%w: %q", errInvalidName, domain)
+			}
+			if len(b) < 0x4000 {
+				offsets[suffix] = len(b)
+			}
+			b = append(b, byte(len(labels[i])))
+			b = append(b, labels[i]...)
+		}
+		if i == len(labels) {
+			b = append(b, 0)
+		}
+	}
+	return b, nil
+}
+
+// DecodeDomainSearch decodes the value of OptionDomainSearch.
+func DecodeDomainSearch(b []byte) ([]string, error) {
+	var domains []string
+	for i := 0; i < len(b); {
+		name, next, err := decodeName(b, i)
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, name)
+		i = next
+	}
+	return domains, nil
+}
+
+// decodeName returns the name at offset i of b, following compression
+// pointers, and the offset after it.
+func decodeName(b []byte, i int) (string, int, error) {
+	var labels []string
+	next := -1
+	for {
+		if i >= len(b) {
+			return "", 0, errInvalidName
+		}
+		n := int(b[i])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = i + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case n&0xc0 == 0xc0:
+			if i+1 >= len(b) {
+				return "", 0, errInvalidName
+			}
+			if next < 0 {
+				next = i + 2
+			}
+			// Only pointers to earlier names, so there are no loops.
+			ptr := (n&0x3f)<<8 | int(b[i+1])
+			if ptr >= i {
+				return "", 0, errInvalidName
+			}
+			i = ptr
+		case n&0xc0 != 0 || i+1+n > len(b):
+			return "", 0, errInvalidName
+		default:
+			labels = append(labels, string(b[i+1:i+1+n]))
+			i += 1 + n
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package dhcp4
+
+import "net"
+
+// Handler handles the messages of Serve.
+type Handler interface {
+	// ServeDHCP returns the reply to req, of type msgType with options,
+	// or nil.
+	ServeDHCP(req Packet, msgType MessageType, options Options) Packet
+}
+
+// ServeConn is the connection of Serve, such as a net.PacketConn.
+type ServeConn interface {
+	ReadFrom(b []byte) (n int, addr net.Addr, err error)
+	WriteTo(b []byte, addr net.Addr) (n int, err error)
+}
+
+// Serve passes the requests read from conn to handler and sends the
+// replies back, until reading or writing fails. Replies are broadcast to
+// clients without an address and those that set the broadcast flag.
+// Messages that are not valid requests are ignored.
+func Serve(conn ServeConn, handler Handler) error {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if n < 240 {
+			continue
+		}
+		req := Packet(buf[:n])
+		if req.HLen() > 16 {
+			continue
+		}
+		options := req.ParseOptions()
+		t := options[OptionDHCPMessageType]
+		if len(t) != 1 || MessageType(t[0]) < Discover || MessageType(t[0]) > Inform {
+			continue
+		}
+		reply := handler.ServeDHCP(req, MessageType(t[0]), options)
+		if reply == nil {
+			continue
+		}
+		to, ok := addr.(*net.UDPAddr)
+		if !ok {
+			host, port, err := net.SplitHostPort(addr.String())
+			if err != nil {
+				return err
+			}
+			to, err = net.ResolveUDPAddr("udp4", net.JoinHostPort(host, port))
+			if err != nil {
+				return err
+			}
+		}
+		if to.IP.Equal(net.IPv4zero) || req.Broadcast() {
+			to = &net.UDPAddr{IP: net.IPv4bcast, Port: to.Port}
+		}
+		if _, err := conn.WriteTo(reply, to); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package dhcp4d
+
+import (
+	"bytes"
+	"net"
+)
+
+// MACFilter restricts which clients are served. Entries are hardware address
+// prefixes, so both full addresses and OUIs can be listed.
+type MACFilter struct {
+	// Allow, if non-empty, is the list of clients that are served. Clients
+	// with a static lease are always allowed.
+	Allow []net.HardwareAddr
+	// Deny lists clients that are never served. It takes precedence over
+	// Allow and static leases.
+	Deny []net.HardwareAddr
+	// NAK makes the server answer refused DHCPREQUESTs with a DHCPNAK
+	// instead of silently ignoring them.
+	NAK bool
+	// Ignore lists clients whose packets are dropped before any processing,
+	// e.g. because another DHCP server is responsible for them.
+	Ignore []net.HardwareAddr
+	// StaticOnly disables dynamic allocation: only clients with a static
+	// lease are served, and only with their static address.
+	StaticOnly bool
+}
+
+func matchMACPrefix(prefixes []net.HardwareAddr, hwAddr net.HardwareAddr) bool {
+	for _, p := range prefixes {
+		if bytes.HasPrefix(hwAddr, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether the filter permits serving hwAddr.
+func (f *MACFilter) allowed(hwAddr net.HardwareAddr, static bool) bool {
+	if matchMACPrefix(f.Deny, hwAddr) {
+		return false
+	}
+	if f.StaticOnly {
+		return static
+	}
+	if len(f.Allow) == 0 || static {
+		return true
+	}
+	return matchMACPrefix(f.Allow, hwAddr)
+}
@@ -0,0 +1,72 @@
+package dhcp4d
+
+import "math/bits"
+
+// bitmap is a set of lease numbers. It grows as numbers are added, so it
+// takes a bit per address up to the highest one in use, and finding a
+// number not in the set takes a word per 64 addresses.
+type bitmap []uint64
+
+func (b *bitmap) set(i int) {
+	if i < 0 {
+		return
+	}
+	w := i / 64
+	if w >= len(*b) {
+		*b = append(*b, make([]uint64, w-len(*b)+1)...)
+	}
+	(*b)[w] |= 1 << (i % 64)
+}
+
+func (b bitmap) clear(i int) {
+	if i < 0 || i/64 >= len(b) {
+		return
+	}
+	b[i/64] &^= 1 << (i % 64)
+}
+
+func (b bitmap) has(i int) bool {
+	return i >= 0 && i/64 < len(b) && b[i/64]&(1<<(i%64)) != 0
+}
+
+// nextClear returns the lowest number in [from, to) that is not in the
+// set, or -1.
+func (b bitmap) nextClear(from, to int) int {
+	if from < 0 {
+		from = 0
+	}
+	for i := from; i < to; {
+		w := i / 64
+		if w >= len(b) {
+			return i
+		}
+		// Bits below i in the first word count as taken.
+		free := ^b[w] &^ (1<<(i%64) - 1)
+		if free != 0 {
+			if n := w*64 + bits.TrailingZeros64(free); n < to {
+				return n
+			}
+			return -1
+		}
+		i = (w + 1) * 64
+	}
+	return -1
+}
+
+// nextSet returns the lowest number in [from, to) that is in the set, or -1.
+func (b bitmap) nextSet(from, to int) int {
+	if from < 0 {
+		from = 0
+	}
+	for i := from; i < to && i/64 < len(b); {
+		w := i / 64
+		if set := b[w] &^ (1<<(i%64) - 1); set != 0 {
+			if n := w*64 + bits.TrailingZeros64(set); n < to {
+				return n
+			}
+			return -1
+		}
+		i = (w + 1) * 64
+	}
+	return -1
+}
@@ -0,0 +1,152 @@
+package dhcp4d
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
+)
+
+// Class overrides the pool, lease period and options handed out to clients
+// whose vendor class identifier (option 60) starts with VendorClass, whose
+// user class (option 77) contains UserClass, and which have all of
+// RequireTags and none of ExcludeTags. All criteria that are set must match;
+// a class without any criteria never matches.
+type Class struct {
+	Name        string
+	VendorClass string
+	UserClass   string
+	RequireTags []string
+	ExcludeTags []string
+
+	// StartIP and LeaseRange select a separate pool for the class. If
+	// LeaseRange is 0 the network's pool is used.
+	StartIP    net.IP
+	LeaseRange int
+
+	// LeasePeriod overrides the network lease period if non-zero.
+	LeasePeriod time.Duration
+
+	// Options are merged over the network options.
+	Options dhcp4.Options
+}
+
+func (c *Class) match(options dhcp4.Options, t tagSet) bool {
+	if c.VendorClass == "" && c.UserClass == "" && len(c.RequireTags) == 0 && len(c.ExcludeTags) == 0 {
+		return false
+	}
+	if c.VendorClass != "" {
+		vc, ok := options[dhcp4.OptionVendorClassIdentifier]
+		if !ok || !strings.HasPrefix(string(vc), c.VendorClass) {
+			return false
+		}
+	}
+	if c.UserClass != "" && !hasUserClass(options, c.UserClass) {
+		return false
+	}
+	return t.satisfy(c.RequireTags, c.ExcludeTags)
+}
+
+func hasUserClass(options dhcp4.Options, class string) bool {
+	for _, uc := range userClasses(options[dhcp4.OptionUserClass]) {
+		if uc == class {
+			return true
+		}
+	}
+	return false
+}
+
+// userClasses decodes the user class option. RFC 3004 encodes it as a list
+// of length-prefixed strings, but many clients (iPXE, Windows) send a single
+// plain string instead, so the raw value is always included as well.
+func userClasses(b []byte) []string {
+	if len(b) == 0 {
+		return nil
+	}
+	classes := []string{string(b)}
+	var rfc []string
+	for rest := b; len(rest) > 0; {
+		n := int(rest[0])
+		if n == 0 || len(rest) < 1+n {
+			return classes
+		}
+		rfc = append(rfc, string(rest[1:1+n]))
+		rest = rest[1+n:]
+	}
+	return append(classes, rfc...)
+}
+
+// classify returns the first class matching the client, or nil.
+func (h *Handler) classify(options dhcp4.Options, t tagSet) *Class {
+	for i := range h.classes {
+		if h.classes[i].match(options, t) {
+			return &h.classes[i]
+		}
+	}
+	return nil
+}
+
+// poolFor returns the pool addresses for clients of class c are allocated from.
+func (h *Handler) poolFor(c *Class) pool {
+	if c == nil || c.LeaseRange == 0 {
+		return h.pool
+	}
+	return pool{first: h.offset(c.StartIP), size: c.LeaseRange}
+}
+
+func (h *Handler) leasePeriodFor(hwAddr string, c *Class) time.Duration {
+	if c != nil && c.LeasePeriod > 0 {
+		return c.LeasePeriod
+	}
+	return h.leasePeriodForDevice(hwAddr)
+}
+
+// leasePeriodAt returns leasePeriodFor capped by the lease limit of ip.
+func (h *Handler) leasePeriodAt(hwAddr string, c *Class, ip net.IP) time.Duration {
+	period := h.leasePeriodFor(hwAddr, c)
+	if h.leaseLimit != nil {
+		if limit := h.leaseLimit(ip); limit > 0 && limit < period {
+			period = limit
+		}
+	}
+	return period
+}
+
+// optionsFor returns the network options with the class options, any
+// option sets matching t and the client's own options merged over them.
+func (h *Handler) optionsFor(c *Class, t tagSet, client dhcp4.Options) dhcp4.Options {
+	layers := make([]dhcp4.Options, 0, 2+len(h.optionSets))
+	if c != nil && len(c.Options) > 0 {
+		layers = append(layers, c.Options)
+	}
+	for _, set := range h.optionSets {
+		if t.satisfy(set.RequireTags, set.ExcludeTags) {
+			layers = append(layers, set.Options)
+		}
+	}
+	if len(client) > 0 {
+		layers = append(layers, client)
+	}
+	if len(layers) == 0 {
+		return h.options
+	}
+
+	merged := make(dhcp4.Options, len(h.options))
+	for code, v := range h.options {
+		merged[code] = v
+	}
+	for _, layer := range layers {
+		for code, v := range layer {
+			merged[code] = v
+		}
+	}
+	return merged
+}
+
+func className(c *Class) string {
+	if c == nil {
+		return ""
+	}
+	return c.Name
+}
@@ -16,22 +16,23 @@
 package dhcp4d
 
 import (
-	"bytes"
-	"encoding/hex"
+	"encoding/binary"
 	"fmt"
 	"log/slog"
+	"math"
 	"math/rand"
 	"net"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/krolaw/dhcp4"
 	"github.com/mdlayher/packet"
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
 )
 
 type Lease struct {
@@ -42,12 +43,36 @@ type Lease struct {
 	HostnameOverride string    `json:"hostname_override"`
 	Expiry           time.Time `json:"expiry"`
 	LastACK          time.Time `json:"last_ack"`
+	Class            string    `json:"class,omitempty"`
+	Tags             []string  `json:"tags,omitempty"`
+	Vendor           string    `json:"vendor,omitempty"`
+
+	Fingerprint *Fingerprint `json:"fingerprint,omitempty"`
+	DeviceType  string       `json:"device_type,omitempty"`
+
+	ClientHostname string `json:"client_hostname,omitempty"` // option 12 as sent by the client
+	ClientID       string `json:"client_id,omitempty"`       // option 61, hex encoded
+	Randomized     bool   `json:"randomized,omitempty"`      // locally administered address
+	DeviceID       string `json:"device_id,omitempty"`       // stable identity across randomized addresses
+	Unknown        bool   `json:"unknown,omitempty"`         // seen on the network without requesting a lease
+	SSID           string `json:"ssid,omitempty"`            // Wi-Fi network the client is associated with
+	BSSID          string `json:"bssid,omitempty"`
+	FQDN           string `json:"fqdn,omitempty"`       // option 81, completed with the domain name
+	DNSUpdate      string `json:"dns_update,omitempty"` // which DNS records the server should not update
 }
 
 type StaticLease struct {
 	Addr         net.IP
 	HardwareAddr string
 	Hostname     string
+
+	// Permanent leases are handed out with an infinite lease time and
+	// never expire.
+	Permanent bool
+
+	// Options are merged over all other options in replies to the
+	// client.
+	Options dhcp4.Options
 }
 
 func (l *Lease) Expired(at time.Time) bool {
@@ -58,38 +83,108 @@ func (l *Lease) Active(at time.Time) bool {
 	return !l.LastACK.IsZero() && at.Before(l.LastACK.Add(leasePeriod))
 }
 
+// pool is a contiguous range of lease numbers (offsets relative to
+// Handler.start) that addresses can be allocated from.
+type pool struct {
+	first int
+	size  int
+}
+
+func (p pool) contains(num int) bool {
+	return num >= p.first && num < p.first+p.size
+}
+
 type Handler struct {
 	serverIP    net.IP
-	start       net.IP // first IP address to hand out
-	leaseRange  int    // number of IP addresses to hand out
+	start       net.IP // lowest IP address of any pool; lease numbers are relative to it
+	pool        pool   // default pool
 	LeasePeriod time.Duration
 	options     dhcp4.Options
-	rawConn     net.PacketConn
+	rawConn     net.PacketConn // nil if replying over UDP
 	iface       *net.Interface
 
 	timeNow func() time.Time
 
 	staticLeases    map[string]StaticLease
 	reservedOffsets map[int]struct{}
+	classes         []Class
+	tagRules        []TagRule
+	optionSets      []OptionSet
+	macFilter       MACFilter
+	quarantine      *Class
+
+	deviceLeasePeriods []DeviceLeasePeriod
+	vendorLookup       func(net.HardwareAddr) string
+	classifyDevice     func(Fingerprint) string
+	groupDevices       bool
+	metrics            Metrics
+	tracer             Tracer
+	limiter            *rateLimiter
+	flap               *FlapDetection
+	poolWarning        float64 // utilization percentage, 0 if disabled
+	dryRun             bool
+	loadBalancing      atomic.Pointer[LoadBalancing]
+	allocatable        func(net.IP) bool
+	leaseLimit         func(net.IP) time.Duration
+	learning           bool
+	fqdnPolicy         FQDNPolicy
+	sanitizeHostnames  bool
+	duplicates         DuplicatePolicy
+	allocation         Allocation
+	minSecs            int
+	alwaysBroadcast    bool
+	vlan               int // tag of replies, if not 0
 
 	// Leases is called whenever a new lease is handed out
 	Leases func([]*Lease, *Lease)
 
+	// Events is called for every lease change. Like Leases it is called
+	// with the leases lock held, so it must not block for long.
+	Events func(Event)
+
+	// Approvals is called whenever the set of approved clients changes
+	Approvals func([]string)
+
+	// HostnameOverrides is called whenever a hostname override changes
+	HostnameOverrides func(map[string]string)
+
+	// HostnameFallback, if set, names the leases of clients that send no
+	// hostname. It is called while handling the request, so it must not
+	// block; slower lookups can complete later with FillHostname.
+	HostnameFallback func(hwaddr string, ip net.IP) string
+
 	leasesMu sync.Mutex
 	leasesHW map[string]int // points into leasesIP
 	leasesIP map[int]*Lease
+	used     bitmap // lease numbers in leasesIP
+	expiries expiryQueue
+	expired  bitmap // lease numbers of expired leases, see nextExpiredLocked
+	approved map[string]bool
+	revoked  map[string]bool // clients to NAK on their next request
+	flaps    map[string]*flapState
+
+	poolWarned bool // utilization is above poolWarning
+
+	// hostnameOverrides are set by SetHostname and outlive the lease.
+	hostnameOverrides map[string]string
+
+	// stations are the Wi-Fi networks of clients, set by SetStation.
+	stations map[string]Station
 }
 
 func NewHandler(iface *net.Interface, serverIP, startIP net.IP, netMask net.IP, leaseRange int, leasePeriod time.Duration, dnsServers []string, staticLeases []StaticLease, opts ...Option) (*Handler, error) {
 	var err error
 
-	var options options
+	options := options{
+		deviceLeasePeriods: DefaultDeviceLeasePeriods(),
+		metrics:            noopMetrics{},
+	}
 	for _, opt := range opts {
 		opt.set(&options)
 	}
 
 	conn := options.conn
-	if conn == nil {
+	if conn == nil && !options.udp {
 		conn, err = packet.Listen(iface, packet.Raw, syscall.ETH_P_ALL, nil)
 		if err != nil {
 			return nil, err
@@ -109,13 +204,31 @@ func NewHandler(iface *net.Interface, serverIP, startIP net.IP, netMask net.IP,
 		dnsServerIPs = append(dnsServerIPs, dnsIP.To4()...)
 	}
 
+	// Lease numbers are relative to the lowest address of all pools and
+	// static leases so that none of them get negative numbers.
+	baseIP := startIP
+	for _, sl := range staticLeases {
+		if dhcp4.IPLess(sl.Addr, baseIP) {
+			baseIP = sl.Addr.To4()
+		}
+	}
+	pools := options.classes
+	if options.quarantine != nil {
+		pools = append(pools[:len(pools):len(pools)], *options.quarantine)
+	}
+	for _, c := range pools {
+		if c.LeaseRange > 0 && dhcp4.IPLess(c.StartIP, baseIP) {
+			baseIP = c.StartIP.To4()
+		}
+	}
+
 	reservedOffsets := make(map[int]struct{})
 
 	staticLeaseMap := make(map[string]StaticLease)
 	for _, sl := range staticLeases {
 		staticLeaseMap[strings.ToLower(sl.HardwareAddr)] = sl
 
-		i := dhcp4.IPRange(startIP, sl.Addr)
+		i := dhcp4.IPRange(baseIP, sl.Addr) - 1
 		reservedOffsets[i] = struct{}{}
 	}
 
@@ -126,12 +239,40 @@ func NewHandler(iface *net.Interface, serverIP, startIP net.IP, netMask net.IP,
 		iface:           iface,
 		leasesHW:        make(map[string]int),
 		leasesIP:        make(map[int]*Lease),
+		approved:        make(map[string]bool),
+		revoked:         make(map[string]bool),
 		staticLeases:    staticLeaseMap,
 		serverIP:        serverIP,
-		start:           startIP,
-		leaseRange:      leaseRange,
+		start:           baseIP,
+		pool:            pool{first: dhcp4.IPRange(baseIP, startIP) - 1, size: leaseRange},
 		LeasePeriod:     leasePeriod,
 		reservedOffsets: reservedOffsets,
+		classes:         options.classes,
+		tagRules:        options.tagRules,
+		optionSets:      options.optionSets,
+		macFilter:       options.macFilter,
+		quarantine:      options.quarantine,
+
+		deviceLeasePeriods: options.deviceLeasePeriods,
+		vendorLookup:       options.vendorLookup,
+		classifyDevice:     options.classifyDevice,
+		groupDevices:       options.groupDevices,
+		hostnameOverrides:  make(map[string]string),
+		stations:           make(map[string]Station),
+		metrics:            options.metrics,
+		tracer:             options.tracer,
+		poolWarning:        options.poolWarning,
+		dryRun:             options.dryRun,
+		allocatable:        options.allocatable,
+		leaseLimit:         options.leaseLimit,
+		learning:           options.learning,
+		fqdnPolicy:         options.fqdnPolicy,
+		sanitizeHostnames:  options.sanitizeHostnames,
+		duplicates:         options.duplicates,
+		allocation:         options.allocation,
+		minSecs:            options.minSecs,
+		alwaysBroadcast:    options.alwaysBroadcast,
+		vlan:               options.vlan,
 		options: dhcp4.Options{
 			// dhcp4.OptionSubnetMask: []byte{255, 255, 255, 0},
 			// XXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXX
@@ -142,8 +283,17 @@ func NewHandler(iface *net.Interface, serverIP, startIP net.IP, netMask net.IP,
 		},
 		timeNow: time.Now,
 	}
-
-	slog.Info("new handler", "h", h)
+	for code, v := range options.network {
+		h.options[code] = v
+	}
+	if options.rateLimit != nil {
+		h.limiter = newRateLimiter(*options.rateLimit)
+	}
+	if options.flap != nil {
+		h.flap = options.flap
+		h.flaps = make(map[string]*flapState)
+	}
+	h.loadBalancing.Store(options.loadBalancing)
 
 	return &h, nil
 }
@@ -154,6 +304,10 @@ func NewHandler(iface *net.Interface, serverIP, startIP net.IP, netMask net.IP,
 // we should try increasing it to 1 hour.
 const leasePeriod = 20 * time.Minute
 
+// infiniteLease is the lease time of permanent leases, which RFC 2131
+// section 3.3 encodes as 0xffffffff.
+const infiniteLease = math.MaxUint32 * time.Second
+
 // SetLeases overwrites the leases database with the specified leases, typically
 // loaded from persistent storage. There is no locking, so SetLeases must be
 // called before Serve.
@@ -162,12 +316,27 @@ func (h *Handler) SetLeases(leases []*Lease) {
 	defer h.leasesMu.Unlock()
 	h.leasesHW = make(map[string]int)
 	h.leasesIP = make(map[int]*Lease)
+	h.used = nil
+	h.expiries = nil
+	h.expired = nil
 	for _, l := range leases {
 		if l.LastACK.IsZero() {
 			l.LastACK = l.Expiry
 		}
+		if l.Addr.To4() != nil {
+			// Recompute in case the pool layout changed since the lease was stored.
+			l.Num = h.offset(l.Addr)
+		}
+		if l.Vendor == "" {
+			l.Vendor = h.vendor(l.HardwareAddr)
+		}
+		if l.HostnameOverride != "" {
+			if _, ok := h.hostnameOverrides[l.HardwareAddr]; !ok {
+				h.hostnameOverrides[l.HardwareAddr] = l.HostnameOverride
+			}
+		}
 		h.leasesHW[l.HardwareAddr] = l.Num
-		h.leasesIP[l.Num] = l
+		h.putLocked(l.Num, l)
 	}
 }
 
@@ -182,54 +351,172 @@ func (h *Handler) callLeasesLocked(lease *Lease) {
 	h.Leases(leases, lease)
 }
 
-func (h *Handler) SetHostname(hwaddr, hostname string) error {
+// ListLeases returns a copy of all leases, including expired ones, ordered
+// by address.
+func (h *Handler) ListLeases() []Lease {
 	h.leasesMu.Lock()
 	defer h.leasesMu.Unlock()
-	leaseNum := h.leasesHW[hwaddr]
-	lease := h.leasesIP[leaseNum]
-	if lease.HardwareAddr != hwaddr || lease.Expired(h.timeNow()) {
-		return fmt.Errorf("hwaddr %v does not have a valid lease", hwaddr)
-	}
-	lease.Hostname = hostname
-	lease.HostnameOverride = hostname
-	h.callLeasesLocked(lease)
-	return nil
+	leases := make([]Lease, 0, len(h.leasesIP))
+	for _, l := range h.leasesIP {
+		leases = append(leases, *l)
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].Num < leases[j].Num
+	})
+	return leases
 }
 
-func (h *Handler) findLease() int {
+// Lease returns a copy of the lease for hwaddr.
+func (h *Handler) Lease(hwaddr string) (Lease, bool) {
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	l, ok := h.leaseHWLocked(hwaddr)
+	if !ok {
+		return Lease{}, false
+	}
+	return *l, true
+}
+
+// LeaseByIP returns a copy of the lease for ip.
+func (h *Handler) LeaseByIP(ip net.IP) (Lease, bool) {
+	num := h.offset(ip)
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	l, ok := h.leasesIP[num]
+	if !ok || !l.Addr.Equal(ip) {
+		return Lease{}, false
+	}
+	return *l, true
+}
+
+// RevokeLease expires the lease for hwaddr immediately. If nak is true the
+// client's next DHCPREQUEST is answered with a DHCPNAK, forcing it to
+// restart configuration instead of renewing. It reports whether there was
+// a lease to revoke.
+func (h *Handler) RevokeLease(hwaddr string, nak bool) bool {
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	l, ok := h.leaseHWLocked(hwaddr)
+	if !ok {
+		return false
+	}
+	l.Expiry = h.timeNow()
+	h.expired.set(l.Num)
+	if nak {
+		h.revoked[hwaddr] = true
+	}
+	h.eventLocked(EventExpire, l)
+	h.callLeasesLocked(l)
+	return true
+}
+
+// takeRevoked reports whether hwAddr should be sent a DHCPNAK and clears
+// the flag.
+func (h *Handler) takeRevoked(hwAddr string) bool {
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	if !h.revoked[hwAddr] {
+		return false
+	}
+	delete(h.revoked, hwAddr)
+	return true
+}
+
+// DeleteLease removes the lease for hwaddr from the database, making its
+// address available again. It reports whether there was a lease to delete.
+func (h *Handler) DeleteLease(hwaddr string) bool {
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	l, ok := h.leaseHWLocked(hwaddr)
+	if !ok {
+		return false
+	}
+	delete(h.leasesIP, l.Num)
+	h.used.clear(l.Num)
+	delete(h.leasesHW, hwaddr)
+	delete(h.revoked, hwaddr)
+	h.eventLocked(EventRelease, l)
+	h.callLeasesLocked(nil)
+	return true
+}
+
+// offset returns the lease number of ip.
+func (h *Handler) offset(ip net.IP) int {
+	return dhcp4.IPRange(h.start, ip) - 1
+}
+
+// Allocation is how a handler picks the address of a new lease.
+type Allocation int
+
+const (
+	// AllocateRandom picks a random free address of the pool.
+	AllocateRandom Allocation = iota
+	// AllocateSequential picks the lowest free address of the pool.
+	AllocateSequential
+)
+
+func (h *Handler) findLease(pl pool) int {
 	h.leasesMu.Lock()
 	defer h.leasesMu.Unlock()
 	now := h.timeNow()
 
-	if len(h.leasesIP) < h.leaseRange {
-		// TODO: hash the hwaddr like dnsmasq
-		i := rand.Intn(h.leaseRange)
+	if pl.size <= 0 {
+		return -1
+	}
 
-		if _, reserved := h.reservedOffsets[i]; reserved {
-		}
+	if h.allocation == AllocateRandom {
+		// TODO: hash the hwaddr like dnsmasq
+		i := pl.first + rand.Intn(pl.size)
 
-		if l, ok := h.leasesIP[i]; !ok || l.Expired(now) {
-			if _, reserved := h.reservedOffsets[i]; !reserved {
+		if !h.used.has(i) {
+			if _, reserved := h.reservedOffsets[i]; !reserved && h.allocatableNum(i) {
 				return i
 			}
 		}
-		for i := 0; i < h.leaseRange; i++ {
-			if l, ok := h.leasesIP[i]; !ok || l.Expired(now) {
-				if _, reserved := h.reservedOffsets[i]; !reserved {
-					return i
-				}
-			}
+	}
+	// Addresses that were never leased come first, so that expired leases
+	// stay available to their clients for as long as possible.
+	end := pl.first + pl.size
+	for i := h.used.nextClear(pl.first, end); i >= 0; i = h.used.nextClear(i+1, end) {
+		if _, reserved := h.reservedOffsets[i]; !reserved && h.allocatableNum(i) {
+			return i
+		}
+	}
+	for i := h.nextExpiredLocked(pl.first, end, now); i >= 0; i = h.nextExpiredLocked(i+1, end, now) {
+		if _, reserved := h.reservedOffsets[i]; !reserved && h.allocatableNum(i) {
+			return i
 		}
 	}
 	return -1
 }
 
-func (h *Handler) canLease(reqIP net.IP, hwaddr string) int {
+// expiredLease returns the lease number of the expired lease of hwaddr in
+// pl if its address is still free, or -1.
+func (h *Handler) expiredLease(hwaddr string, pl pool) int {
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	l, ok := h.leaseHWLocked(hwaddr)
+	if !ok || !l.Expired(h.timeNow()) || !pl.contains(l.Num) {
+		return -1
+	}
+	if _, reserved := h.reservedOffsets[l.Num]; reserved || !h.allocatableNum(l.Num) {
+		return -1
+	}
+	return l.Num
+}
+
+// allocatableNum reports whether the free address of lease number num may be
+// handed out.
+func (h *Handler) allocatableNum(num int) bool {
+	return h.allocatable == nil || h.allocatable(dhcp4.IPAdd(h.start, num))
+}
+
+func (h *Handler) canLease(reqIP net.IP, hwaddr string, pl pool) int {
 	if len(reqIP) != 4 || reqIP.Equal(net.IPv4zero) {
 		return -1
 	}
 
-	leaseNum := dhcp4.IPRange(h.start, reqIP) - 1
+	leaseNum := h.offset(reqIP)
 	if leaseNum < 0 {
 		return -1
 	}
@@ -238,22 +525,22 @@ func (h *Handler) canLease(reqIP net.IP, hwaddr string) int {
 	defer h.leasesMu.Unlock()
 	l, ok := h.leasesIP[leaseNum]
 	if !ok {
-		if leaseNum >= h.leaseRange {
+		if !pl.contains(leaseNum) || !h.allocatableNum(leaseNum) {
 			return -1
 		}
 
 		return leaseNum // lease available
 	}
 
-	if l.HardwareAddr == hwaddr {
+	if l.HardwareAddr == hwaddr && (pl.contains(leaseNum) || l.Expiry.IsZero()) {
 		return leaseNum // lease already owned by requestor
 	}
 
-	if leaseNum >= h.leaseRange {
+	if !pl.contains(leaseNum) {
 		return -1
 	}
 
-	if l.Expired(h.timeNow()) {
+	if l.Expired(h.timeNow()) && h.allocatableNum(leaseNum) {
 		return leaseNum // lease expired
 	}
 
@@ -261,11 +548,25 @@ func (h *Handler) canLease(reqIP net.IP, hwaddr string) int {
 }
 
 // ServeDHCP is always called from the same goroutine, so no locking is required.
+// Replies are written to the raw socket, except by handlers created WithUDP,
+// which return them.
 func (h *Handler) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options dhcp4.Options) dhcp4.Packet {
-	slog.Info("got dhcp packet", "iface", h.iface.Name, "type", msgType)
+	start := h.timeNow()
+	log := h.txLogger(p)
+	log.Debug("got dhcp packet", "type", msgType)
+	h.metrics.PacketReceived(msgType)
+	if h.learning {
+		log.Debug("learning, not replying", "type", msgType)
+		return nil
+	}
+	if h.throttled(p, options, log) {
+		return nil
+	}
 	reply := h.serveDHCP(p, msgType, options)
 	if reply == nil {
-		slog.Info("no reply unsupported request", "iface", h.iface.Name, "type", msgType)
+		log.Debug("no reply unsupported request", "type", msgType)
+		h.metrics.HandleDuration(msgType, h.timeNow().Sub(start))
+		h.traceSpan(start, p, msgType, nil, nil)
 		return nil // unsupported request
 	}
 	buf := gopacket.NewSerializeBuffer()
@@ -273,11 +574,19 @@ func (h *Handler) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options d
 		ComputeChecksums: true,
 		FixLengths:       true,
 	}
-	destMAC := p.CHAddr()
-	destIP := reply.YIAddr()
-	if p.Broadcast() {
-		destMAC = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
-		destIP = net.IPv4bcast
+	destMAC, destIP := h.replyDest(p, reply)
+	if h.dryRun {
+		log.Info("dry run: not sending reply", "type", replyType(reply), "yiaddr", reply.YIAddr(), "dst_mac", destMAC, "dst_ip", destIP)
+		h.metrics.HandleDuration(msgType, h.timeNow().Sub(start))
+		h.traceSpan(start, p, msgType, reply, nil)
+		return nil
+	}
+	if h.rawConn == nil {
+		// Replying over UDP: the caller sends the reply.
+		h.metrics.ReplySent(replyType(reply))
+		h.metrics.HandleDuration(msgType, h.timeNow().Sub(start))
+		h.traceSpan(start, p, msgType, reply, nil)
+		return reply
 	}
 	ethernet := &layers.Ethernet{
 		DstMAC:       destMAC,
@@ -298,22 +607,85 @@ func (h *Handler) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options d
 		DstPort: 68,
 	}
 	udp.SetNetworkLayerForChecksum(ip)
-	gopacket.SerializeLayers(buf, opts,
-		ethernet,
-		ip,
-		udp,
-		gopacket.Payload(reply))
+	frame := []gopacket.SerializableLayer{ethernet, ip, udp, gopacket.Payload(reply)}
+	if h.vlan != 0 {
+		ethernet.EthernetType = layers.EthernetTypeDot1Q
+		frame = []gopacket.SerializableLayer{ethernet, &layers.Dot1Q{
+			VLANIdentifier: uint16(h.vlan),
+			Type:           layers.EthernetTypeIPv4,
+		}, ip, udp, gopacket.Payload(reply)}
+	}
+	gopacket.SerializeLayers(buf, opts, frame...)
 
-	if _, err := h.rawConn.WriteTo(buf.Bytes(), &packet.Addr{HardwareAddr: destMAC}); err != nil {
-		slog.Error("WriteTo err", "err", err)
+	_, err := h.rawConn.WriteTo(buf.Bytes(), &packet.Addr{HardwareAddr: destMAC})
+	if err != nil {
+		log.Error("WriteTo err", "err", err)
+		h.metrics.WriteFailed(err)
+	} else {
+		h.metrics.ReplySent(replyType(reply))
 	}
+	h.metrics.HandleDuration(msgType, h.timeNow().Sub(start))
+	h.traceSpan(start, p, msgType, reply, err)
 
 	return nil
 }
 
+// replyDest returns where to send reply to request p, following RFC 2131
+// section 4.1: NAKs are broadcast, replies to clients that have an address
+// are unicast to it, and the rest are broadcast if the client asks for it.
+func (h *Handler) replyDest(p, reply dhcp4.Packet) (net.HardwareAddr, net.IP) {
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	if h.alwaysBroadcast || replyType(reply) == dhcp4.NAK {
+		return broadcast, net.IPv4bcast
+	}
+	if ciaddr := net.IP(p.CIAddr()); !ciaddr.Equal(net.IPv4zero) {
+		return p.CHAddr(), ciaddr
+	}
+	if p.Broadcast() {
+		return broadcast, net.IPv4bcast
+	}
+	return p.CHAddr(), reply.YIAddr()
+}
+
+// ReplyAddr returns where a handler created WithUDP should send reply to
+// request p: to the relay agent of relayed requests, and otherwise where
+// replyDest would, except that replies to clients without an address are
+// broadcast, as they cannot be unicast without a packet socket.
+func (h *Handler) ReplyAddr(p, reply dhcp4.Packet) *net.UDPAddr {
+	if giaddr := net.IP(p.GIAddr()); !giaddr.Equal(net.IPv4zero) {
+		return &net.UDPAddr{IP: giaddr, Port: 67}
+	}
+	_, ip := h.replyDest(p, reply)
+	if net.IP(p.CIAddr()).Equal(net.IPv4zero) {
+		ip = net.IPv4bcast
+	}
+	return &net.UDPAddr{IP: ip, Port: 68}
+}
+
+func (h *Handler) vendor(hwAddr string) string {
+	if h.vendorLookup == nil {
+		return ""
+	}
+	hw, err := net.ParseMAC(hwAddr)
+	if err != nil {
+		return ""
+	}
+	return h.vendorLookup(hw)
+}
+
+// staticPool returns a single-address pool for a static lease, which may be
+// outside of the dynamic pools.
+func (h *Handler) staticPool(sl StaticLease) pool {
+	return pool{first: h.offset(sl.Addr), size: 1}
+}
+
 func (h *Handler) leaseHW(hwAddr string) (*Lease, bool) {
 	h.leasesMu.Lock()
 	defer h.leasesMu.Unlock()
+	return h.leaseHWLocked(hwAddr)
+}
+
+func (h *Handler) leaseHWLocked(hwAddr string) (*Lease, bool) {
 	num, ok := h.leasesHW[hwAddr]
 	if !ok {
 		return nil, false
@@ -323,129 +695,278 @@ func (h *Handler) leaseHW(hwAddr string) (*Lease, bool) {
 }
 
 func (h *Handler) leasePeriodForDevice(hwAddr string) time.Duration {
-	hwAddrPrefix, err := hex.DecodeString(strings.ReplaceAll(hwAddr, ":", ""))
-	if err != nil {
-		return h.LeasePeriod
-	}
-	if len(hwAddrPrefix) != 6 {
+	hw, err := net.ParseMAC(hwAddr)
+	if err != nil || len(hw) != 6 {
 		// Invalid MAC address
 		return h.LeasePeriod
 	}
-	hwAddrPrefix = hwAddrPrefix[:3]
-	i := sort.Search(len(nintendoMacPrefixes), func(i int) bool {
-		return bytes.Compare(nintendoMacPrefixes[i][:], hwAddrPrefix) >= 0
-	})
-	if i < len(nintendoMacPrefixes) && bytes.Equal(nintendoMacPrefixes[i][:], hwAddrPrefix) {
-		return 1 * time.Hour
+	for _, d := range h.deviceLeasePeriods {
+		if matchMACPrefix(d.Prefixes, hw) {
+			return d.LeasePeriod
+		}
 	}
 	return h.LeasePeriod
 }
 
 // TODO: is ServeDHCP always run from the same goroutine, or do we need locking?
 func (h *Handler) serveDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options dhcp4.Options) dhcp4.Packet {
+	if matchMACPrefix(h.macFilter.Ignore, p.CHAddr()) {
+		return nil
+	}
+
+	options = overloadedOptions(p, options)
+	log := h.txLogger(p)
+	if info, ok := options[dhcp4.OptionRelayAgentInformation]; ok {
+		log = log.With(relayAgentAttrs(info)...)
+	}
+	logOptions(log, msgType, options)
+
 	reqIP := net.IP(options[dhcp4.OptionRequestedIPAddress])
 	if reqIP == nil {
 		reqIP = net.IP(p.CIAddr())
 	}
 	hwAddr := p.CHAddr().String()
+	tags := h.tagsFor(p.CHAddr(), options)
+	class := h.classify(options, tags)
+	sl, hasStatic := h.staticLease(hwAddr)
+	if h.quarantine != nil && !h.known(hwAddr, hasStatic) {
+		class = h.quarantine
+	}
+	pl := h.poolFor(class)
+	if h.macFilter.StaticOnly && hasStatic {
+		pl = h.staticPool(sl)
+	}
+
+	if (msgType == dhcp4.Discover || msgType == dhcp4.Request) && !h.macFilter.allowed(p.CHAddr(), hasStatic) {
+		log.Info("client refused by mac filter", "type", msgType)
+		if msgType == dhcp4.Request && h.macFilter.NAK {
+			return h.nak(p, reqIP, options)
+		}
+		return nil
+	}
+	if msgType == dhcp4.Discover && int(binary.BigEndian.Uint16(p.Secs())) < h.minSecs {
+		log.Debug("client left to primary server", "secs", binary.BigEndian.Uint16(p.Secs()))
+		return nil
+	}
+	if h.loadBalanced(p, msgType, options) {
+		log.Debug("client left to split scope peer", "type", msgType)
+		return nil
+	}
 
 	switch msgType {
 	case dhcp4.Discover:
 		free := -1
 
 		// offer static lease if configured
-		if sl, found := h.staticLeases[strings.ToLower(hwAddr)]; found {
-			free = h.canLease(sl.Addr, hwAddr)
+		if hasStatic {
+			free = h.canLease(sl.Addr, hwAddr, h.staticPool(sl))
 		}
 
 		// try to offer the requested IP, if any and available
 		if free < 0 && !reqIP.To4().Equal(net.IPv4zero) {
-			free = h.canLease(reqIP, hwAddr)
+			free = h.canLease(reqIP, hwAddr, pl)
 			// log.Printf("canLease(%v, %s) = %d", reqIP, hwAddr, free)
 		}
 
 		// offer previous lease for this HardwareAddr, if any
-		if lease, ok := h.leaseHW(hwAddr); ok && !lease.Expired(h.timeNow()) {
+		if lease, ok := h.leaseHW(hwAddr); ok && !lease.Expired(h.timeNow()) && (hasStatic || pl.contains(lease.Num)) {
 			free = lease.Num
 			// log.Printf("h.leasesHW[%s] = %d", hwAddr, free)
 		}
 
+		// offer the address of an expired previous lease if no other
+		// client has taken it since, so returning clients keep it
+		if free == -1 {
+			free = h.expiredLease(hwAddr, pl)
+		}
+
 		if free == -1 {
-			free = h.findLease()
+			free = h.findLease(pl)
 			// log.Printf("findLease = %d", free)
 		}
 
 		if free == -1 {
-			slog.Error("cannot reply with DHCPOFFER: no more leases available")
+			log.Error("cannot reply with DHCPOFFER: no more leases available")
+			h.metrics.Error("pool_exhausted")
+			h.leasesMu.Lock()
+			h.poolEventLocked(EventPoolExhausted, &Lease{
+				HardwareAddr: hwAddr,
+				Hostname:     string(options[dhcp4.OptionHostName]),
+				Class:        className(class),
+			}, h.statsLocked())
+			h.leasesMu.Unlock()
 			return nil // no free leases
 		}
 
-		slog.Info("dhcp discover", "hw", hwAddr, "name", options[dhcp4.OptionHostName], "ip", dhcp4.IPAdd(h.start, free))
+		log.Debug("dhcp discover", "name", options[dhcp4.OptionHostName], "ip", dhcp4.IPAdd(h.start, free), "class", className(class), "tags", tags.list())
+		period := h.leasePeriodAt(hwAddr, class, dhcp4.IPAdd(h.start, free))
+		if sl.permanentFor(hasStatic, dhcp4.IPAdd(h.start, free)) {
+			period = infiniteLease
+		}
 
+		h.leasesMu.Lock()
+		h.eventLocked(EventOffer, &Lease{
+			Num:          free,
+			Addr:         dhcp4.IPAdd(h.start, free),
+			HardwareAddr: hwAddr,
+			Hostname:     string(options[dhcp4.OptionHostName]),
+			Expiry:       h.timeNow().Add(period),
+			Class:        className(class),
+			Tags:         tags.list(),
+			Vendor:       h.vendor(hwAddr),
+		})
+		h.leasesMu.Unlock()
+
+		replyOptions := h.optionsFor(class, tags, sl.Options)
+		reply := replyOptions.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList])
+		if fqdn, ok := h.clientFQDN(options, replyOptions); ok {
+			reply = append(reply, fqdn.option())
+		}
 		return dhcp4.ReplyPacket(p,
 			dhcp4.Offer,
 			h.serverIP,
 			dhcp4.IPAdd(h.start, free),
-			h.leasePeriodForDevice(hwAddr),
-			h.options.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList]))
+			period,
+			reply)
 
 	case dhcp4.Request:
 		if server, ok := options[dhcp4.OptionServerIdentifier]; ok && !net.IP(server).Equal(h.serverIP) {
 			return nil // message not for this dhcp server
 		}
-		leaseNum := h.canLease(reqIP, hwAddr)
+		h.recordFlap(hwAddr, log)
+		if h.takeRevoked(hwAddr) {
+			log.Info("NAK revoked lease", "ip", reqIP)
+			return h.nak(p, reqIP, options)
+		}
+		if hasStatic && reqIP.Equal(sl.Addr) {
+			pl = h.staticPool(sl)
+		}
+		leaseNum := h.canLease(reqIP, hwAddr, pl)
 		if leaseNum == -1 {
-			return dhcp4.ReplyPacket(p, dhcp4.NAK, h.serverIP, nil, 0, nil)
+			return h.nak(p, reqIP, options)
 		}
 
+		period := h.leasePeriodAt(hwAddr, class, reqIP)
 		lease := &Lease{
-			Num:          leaseNum,
-			Addr:         make([]byte, 4),
-			HardwareAddr: hwAddr,
-			Expiry:       h.timeNow().Add(h.leasePeriodForDevice(hwAddr)),
-			Hostname:     string(options[dhcp4.OptionHostName]),
-			LastACK:      h.timeNow(),
+			Num:            leaseNum,
+			Addr:           make([]byte, 4),
+			HardwareAddr:   hwAddr,
+			Expiry:         h.timeNow().Add(period),
+			Hostname:       string(options[dhcp4.OptionHostName]),
+			LastACK:        h.timeNow(),
+			Class:          className(class),
+			Tags:           tags.list(),
+			Vendor:         h.vendor(hwAddr),
+			ClientHostname: string(options[dhcp4.OptionHostName]),
+			ClientID:       clientID(p.CHAddr(), options),
+			Randomized:     locallyAdministered(p.CHAddr()),
 		}
 		copy(lease.Addr, reqIP.To4())
+		if sl.permanentFor(hasStatic, reqIP) {
+			period = infiniteLease
+			lease.Expiry = time.Time{}
+		}
+		replyOptions := h.optionsFor(class, tags, sl.Options)
+		fqdn, hasFQDN := h.clientFQDN(options, replyOptions)
+		if hasFQDN {
+			lease.FQDN, lease.DNSUpdate = fqdn.name, fqdn.dnsUpdate
+			if lease.Hostname == "" {
+				lease.Hostname = fqdn.hostname()
+			}
+		}
+		if lease.Hostname == "" && h.HostnameFallback != nil {
+			lease.Hostname = h.HostnameFallback(lease.HardwareAddr, lease.Addr)
+		}
+		if h.sanitizeHostnames {
+			lease.Hostname = sanitizeHostname(lease.Hostname)
+		}
 
-		if l, ok := h.leaseHW(lease.HardwareAddr); ok {
+		fp := fingerprint(p, options)
+		lease.Fingerprint = &fp
+		if h.classifyDevice != nil {
+			lease.DeviceType = h.classifyDevice(fp)
+		}
+
+		prev, hadLease := h.leaseHW(lease.HardwareAddr)
+		if l := prev; hadLease {
 			if l.Expiry.IsZero() {
 				// Retain permanent lease properties
 				lease.Expiry = time.Time{}
 				lease.Hostname = l.Hostname
 			}
-			if l.HostnameOverride != "" {
-				lease.Hostname = l.HostnameOverride
-				lease.HostnameOverride = l.HostnameOverride
-			}
 
 			// Release any old leases for this client
 			h.leasesMu.Lock()
 			delete(h.leasesIP, l.Num)
+			h.used.clear(l.Num)
 			h.leasesMu.Unlock()
 		}
 
 		h.leasesMu.Lock()
 		defer h.leasesMu.Unlock()
-		h.leasesIP[leaseNum] = lease
+		if name, ok := h.hostnameOverrides[lease.HardwareAddr]; ok {
+			lease.Hostname = name
+			lease.HostnameOverride = name
+		}
+		lease.Hostname = h.uniqueHostnameLocked(lease, prev)
+		if st, ok := h.stations[lease.HardwareAddr]; ok {
+			lease.SSID, lease.BSSID = st.SSID, st.BSSID
+		}
+		if h.groupDevices {
+			h.groupDeviceLocked(lease)
+		}
+		if other, ok := h.leasesIP[leaseNum]; ok && other.HardwareAddr != lease.HardwareAddr {
+			h.removeLocked(other, h.timeNow())
+		}
+		h.putLocked(leaseNum, lease)
 		h.leasesHW[lease.HardwareAddr] = leaseNum
+		switch {
+		case hadLease && prev.Num == leaseNum && !prev.Expired(h.timeNow()):
+			h.eventLocked(EventOld, lease)
+		case hadLease && prev.Num != leaseNum:
+			h.eventLocked(EventRelease, prev)
+			h.eventLocked(EventAdd, lease)
+		default:
+			h.eventLocked(EventAdd, lease)
+		}
 		h.callLeasesLocked(lease)
+		h.checkUtilizationLocked(lease, log)
 
-		slog.Info("dhcp reply", "hw", hwAddr, "name", options[dhcp4.OptionHostName], "ip", reqIP)
+		log.Info("dhcp reply", "name", options[dhcp4.OptionHostName], "ip", reqIP)
 
+		reply := replyOptions.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList])
+		if hasFQDN {
+			reply = append(reply, fqdn.option())
+		}
 		return dhcp4.ReplyPacket(
 			p,
 			dhcp4.ACK,
 			h.serverIP,
 			reqIP,
-			h.leasePeriodForDevice(hwAddr),
-			h.options.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList]))
+			period,
+			reply)
 	case dhcp4.Decline:
+		h.recordFlap(hwAddr, log)
 		if h.expireLease(hwAddr) {
-			slog.Info("expired lease DHCPDECLINE", "hw", hwAddr)
+			log.Info("expired lease DHCPDECLINE")
+			// Keep the declined address from being offered to the
+			// client again as its previous address.
+			h.leasesMu.Lock()
+			delete(h.leasesHW, hwAddr)
+			h.leasesMu.Unlock()
 		}
 		// Decline does not expect an ACK response.
 		return nil
+	case dhcp4.Release:
+		if server, ok := options[dhcp4.OptionServerIdentifier]; ok && !net.IP(server).Equal(h.serverIP) {
+			return nil // message not for this dhcp server
+		}
+		h.recordFlap(hwAddr, log)
+		if h.expireLease(hwAddr) {
+			log.Info("expired lease DHCPRELEASE")
+		}
+		// Release does not expect a response.
+		return nil
 	}
 	return nil
 }
@@ -469,6 +990,8 @@ func (h *Handler) expireLease(hwAddr string) bool {
 	if l.HardwareAddr != hwAddr {
 		return false
 	}
-	l.Expiry = time.Now()
+	l.Expiry = h.timeNow()
+	h.expired.set(l.Num)
+	h.eventLocked(EventRelease, l)
 	return true
 }
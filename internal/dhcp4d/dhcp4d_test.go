@@ -15,12 +15,18 @@
 package dhcp4d
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
 	"net"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
-	"github.com/krolaw/dhcp4"
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
 )
 
 func messageType(p dhcp4.Packet) dhcp4.MessageType {
@@ -69,7 +75,7 @@ func testHandler(t *testing.T) (_ *Handler, cleanup func()) {
 	serverIP := net.IPv4(192, 168, 42, 1)
 	startIP := net.IPv4(192, 168, 42, 2)
 
-	handler, err := NewHandler(iface, serverIP, startIP, net.IPMask{255, 255, 255, 0}, 230, 20*time.Minute, []string{"1.1.1.1"}, nil, WithConn(&noopSink{}))
+	handler, err := NewHandler(iface, serverIP, startIP, net.IP{255, 255, 255, 0}, 230, 20*time.Minute, []string{"1.1.1.1"}, nil, WithConn(&noopSink{}))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -530,3 +536,2202 @@ func TestClientDecline(t *testing.T) {
 		}
 	})
 }
+
+func TestOptionOverload(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	var (
+		addr         = net.IP{192, 168, 42, 23}
+		hardwareAddr = net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+		hostname     = "esp"
+	)
+
+	var got string
+	handler.Leases = func(leases []*Lease, latest *Lease) {
+		got = latest.Hostname
+	}
+
+	p := request(addr, hardwareAddr, dhcp4.Option{
+		Code:  dhcp4.OptionOverload,
+		Value: []byte{overloadSName},
+	})
+	sname := append([]byte{byte(dhcp4.OptionHostName), byte(len(hostname))}, hostname...)
+	sname = append(sname, byte(dhcp4.End))
+	p.SetSName(sname)
+
+	resp := handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+	if got, want := messageType(resp), dhcp4.ACK; got != want {
+		t.Fatalf("DHCPREQUEST resulted in unexpected message type: got %v, want %v", got, want)
+	}
+	if want := hostname; got != want {
+		t.Errorf("unexpected lease.Hostname: got %q, want %q", got, want)
+	}
+}
+
+func TestVendorClass(t *testing.T) {
+	iface := &net.Interface{
+		HardwareAddr: net.HardwareAddr([]byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}),
+	}
+	serverIP := net.IPv4(192, 168, 42, 1)
+	startIP := net.IPv4(192, 168, 42, 100)
+
+	voip := Class{
+		Name:        "voip",
+		VendorClass: "Polycom",
+		StartIP:     net.IP{192, 168, 42, 10},
+		LeaseRange:  10,
+		LeasePeriod: 12 * time.Hour,
+		Options: dhcp4.Options{
+			dhcp4.OptionTFTPServerName: []byte("tftp.example"),
+		},
+	}
+	handler, err := NewHandler(iface, serverIP, startIP, net.IP{255, 255, 255, 0}, 50, 20*time.Minute, []string{"1.1.1.1"}, nil, WithConn(&noopSink{}), WithClasses(voip))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	phone := net.HardwareAddr{0x00, 0x04, 0xf2, 0x01, 0x02, 0x03}
+	vendorClass := dhcp4.Option{
+		Code:  dhcp4.OptionVendorClassIdentifier,
+		Value: []byte("Polycom-SoundPoint"),
+	}
+
+	t.Run("class pool", func(t *testing.T) {
+		p := discover(net.IPv4zero, phone, vendorClass)
+		resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+		if got := resp.YIAddr(); !dhcp4.IPInRange(net.IP{192, 168, 42, 10}, net.IP{192, 168, 42, 19}, got) {
+			t.Errorf("DHCPOFFER outside class pool: got %v", got)
+		}
+		opts := resp.ParseOptions()
+		if got, want := string(opts[dhcp4.OptionTFTPServerName]), "tftp.example"; got != want {
+			t.Errorf("unexpected tftp server option: got %q, want %q", got, want)
+		}
+		leaseTime := binary.BigEndian.Uint32(opts[dhcp4.OptionIPAddressLeaseTime])
+		if got, want := leaseTime, uint32((12 * time.Hour).Seconds()); got != want {
+			t.Errorf("unexpected lease time: got %d, want %d", got, want)
+		}
+	})
+
+	t.Run("class client outside class pool", func(t *testing.T) {
+		p := request(net.IP{192, 168, 42, 110}, phone, vendorClass)
+		resp := handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+		if got, want := messageType(resp), dhcp4.NAK; got != want {
+			t.Errorf("DHCPREQUEST resulted in unexpected message type: got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("unclassified client", func(t *testing.T) {
+		laptop := net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+		p := discover(net.IPv4zero, laptop)
+		resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+		if got := resp.YIAddr(); !dhcp4.IPInRange(net.IP{192, 168, 42, 100}, net.IP{192, 168, 42, 149}, got) {
+			t.Errorf("DHCPOFFER outside default pool: got %v", got)
+		}
+		if _, ok := resp.ParseOptions()[dhcp4.OptionTFTPServerName]; ok {
+			t.Errorf("unclassified client got class option")
+		}
+	})
+}
+
+func TestUserClass(t *testing.T) {
+	iface := &net.Interface{
+		HardwareAddr: net.HardwareAddr([]byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}),
+	}
+	serverIP := net.IPv4(192, 168, 42, 1)
+	startIP := net.IPv4(192, 168, 42, 2)
+
+	provisioning := Class{
+		Name:        "provisioning",
+		UserClass:   "provision",
+		LeasePeriod: 5 * time.Minute,
+		Options: dhcp4.Options{
+			dhcp4.OptionBootFileName: []byte("provision.ipxe"),
+		},
+	}
+	handler, err := NewHandler(iface, serverIP, startIP, net.IP{255, 255, 255, 0}, 230, 20*time.Minute, []string{"1.1.1.1"}, nil, WithConn(&noopSink{}), WithClasses(provisioning))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hardwareAddr := net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+
+	for _, tt := range []struct {
+		name      string
+		userClass []byte
+		wantMatch bool
+	}{
+		{name: "plain string", userClass: []byte("provision"), wantMatch: true},
+		{name: "rfc 3004", userClass: []byte("\x04iPXE\x09provision"), wantMatch: true},
+		{name: "other class", userClass: []byte("iPXE"), wantMatch: false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := discover(net.IPv4zero, hardwareAddr, dhcp4.Option{
+				Code:  dhcp4.OptionUserClass,
+				Value: tt.userClass,
+			})
+			resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+			opts := resp.ParseOptions()
+			_, gotMatch := opts[dhcp4.OptionBootFileName]
+			if gotMatch != tt.wantMatch {
+				t.Errorf("bootfile option present = %v, want %v", gotMatch, tt.wantMatch)
+			}
+			wantLease := 20 * time.Minute
+			if tt.wantMatch {
+				wantLease = 5 * time.Minute
+			}
+			leaseTime := binary.BigEndian.Uint32(opts[dhcp4.OptionIPAddressLeaseTime])
+			if got, want := leaseTime, uint32(wantLease.Seconds()); got != want {
+				t.Errorf("unexpected lease time: got %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestTags(t *testing.T) {
+	iface := &net.Interface{
+		Name:         "lan0",
+		HardwareAddr: net.HardwareAddr([]byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}),
+	}
+	serverIP := net.IPv4(192, 168, 42, 1)
+	startIP := net.IPv4(192, 168, 42, 100)
+
+	rules := []TagRule{
+		{Tag: "phone", MACPrefix: net.HardwareAddr{0x00, 0x04, 0xf2}},
+		{Tag: "lan", Interface: "lan0"},
+		{Tag: "wan", Interface: "wan0"},
+		{Tag: "pxe", HasOption: dhcp4.OptionClientArchitecture},
+	}
+	classes := []Class{
+		{
+			Name:        "phones",
+			RequireTags: []string{"phone", "lan"},
+			StartIP:     net.IP{192, 168, 42, 10},
+			LeaseRange:  10,
+		},
+	}
+	sets := []OptionSet{
+		{
+			RequireTags: []string{"pxe"},
+			Options:     dhcp4.Options{dhcp4.OptionBootFileName: []byte("undionly.kpxe")},
+		},
+		{
+			ExcludeTags: []string{"phone"},
+			Options:     dhcp4.Options{dhcp4.OptionDomainNameServer: []byte{9, 9, 9, 9}},
+		},
+	}
+	handler, err := NewHandler(iface, serverIP, startIP, net.IP{255, 255, 255, 0}, 50, 20*time.Minute, []string{"1.1.1.1"}, nil,
+		WithConn(&noopSink{}), WithTagRules(rules...), WithClasses(classes...), WithOptionSets(sets...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("tagged phone", func(t *testing.T) {
+		phone := net.HardwareAddr{0x00, 0x04, 0xf2, 0x01, 0x02, 0x03}
+		p := discover(net.IPv4zero, phone)
+		resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+		if got := resp.YIAddr(); !dhcp4.IPInRange(net.IP{192, 168, 42, 10}, net.IP{192, 168, 42, 19}, got) {
+			t.Errorf("DHCPOFFER outside class pool: got %v", got)
+		}
+		opts := resp.ParseOptions()
+		if got, want := net.IP(opts[dhcp4.OptionDomainNameServer]), (net.IP{1, 1, 1, 1}); !got.Equal(want) {
+			t.Errorf("unexpected dns server: got %v, want %v", got, want)
+		}
+		if _, ok := opts[dhcp4.OptionBootFileName]; ok {
+			t.Errorf("untagged client got pxe option")
+		}
+	})
+
+	t.Run("pxe client", func(t *testing.T) {
+		laptop := net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+		p := discover(net.IPv4zero, laptop, dhcp4.Option{
+			Code:  dhcp4.OptionClientArchitecture,
+			Value: []byte{0, 0},
+		})
+		resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+		if got := resp.YIAddr(); !dhcp4.IPInRange(net.IP{192, 168, 42, 100}, net.IP{192, 168, 42, 149}, got) {
+			t.Errorf("DHCPOFFER outside default pool: got %v", got)
+		}
+		opts := resp.ParseOptions()
+		if got, want := string(opts[dhcp4.OptionBootFileName]), "undionly.kpxe"; got != want {
+			t.Errorf("unexpected bootfile: got %q, want %q", got, want)
+		}
+		if got, want := net.IP(opts[dhcp4.OptionDomainNameServer]), (net.IP{9, 9, 9, 9}); !got.Equal(want) {
+			t.Errorf("unexpected dns server: got %v, want %v", got, want)
+		}
+	})
+}
+
+func TestMACFilter(t *testing.T) {
+	iface := &net.Interface{
+		HardwareAddr: net.HardwareAddr([]byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}),
+	}
+	serverIP := net.IPv4(192, 168, 42, 1)
+	startIP := net.IPv4(192, 168, 42, 2)
+
+	var (
+		addr    = net.IP{192, 168, 42, 23}
+		allowed = net.HardwareAddr{0x00, 0x04, 0xf2, 0x01, 0x02, 0x03}
+		banned  = net.HardwareAddr{0x00, 0x04, 0xf2, 0xff, 0xff, 0xff}
+		unknown = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+		static  = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0x00, 0x00, 0x01}
+	)
+
+	filter := MACFilter{
+		Allow: []net.HardwareAddr{{0x00, 0x04, 0xf2}},
+		Deny:  []net.HardwareAddr{banned},
+	}
+	staticLeases := []StaticLease{
+		{Addr: net.IP{192, 168, 42, 50}, HardwareAddr: static.String()},
+	}
+
+	for _, nak := range []bool{false, true} {
+		filter.NAK = nak
+		handler, err := NewHandler(iface, serverIP, startIP, net.IP{255, 255, 255, 0}, 230, 20*time.Minute, []string{"1.1.1.1"}, staticLeases, WithConn(&noopSink{}), WithMACFilter(filter))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, hw := range []net.HardwareAddr{allowed, static} {
+			p := discover(net.IPv4zero, hw)
+			if resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions()); resp == nil {
+				t.Errorf("DHCPDISCOVER(%v) unexpectedly ignored", hw)
+			}
+		}
+
+		for _, hw := range []net.HardwareAddr{banned, unknown} {
+			p := discover(net.IPv4zero, hw)
+			if resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions()); resp != nil {
+				t.Errorf("DHCPDISCOVER(%v) resulted in unexpected offer of %v", hw, resp.YIAddr())
+			}
+
+			p = request(addr, hw)
+			resp := handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+			if !nak {
+				if resp != nil {
+					t.Errorf("DHCPREQUEST(%v) unexpectedly answered: %v", hw, messageType(resp))
+				}
+				continue
+			}
+			if resp == nil {
+				t.Fatalf("DHCPREQUEST(%v) = nil, want NAK", hw)
+			}
+			if got, want := messageType(resp), dhcp4.NAK; got != want {
+				t.Errorf("DHCPREQUEST resulted in unexpected message type: got %v, want %v", got, want)
+			}
+		}
+	}
+}
+
+func TestLoadBalancing(t *testing.T) {
+	iface := &net.Interface{
+		HardwareAddr: net.HardwareAddr([]byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}),
+	}
+	newHandler := func(lb LoadBalancing) *Handler {
+		handler, err := NewHandler(iface, net.IPv4(192, 168, 42, 1), net.IPv4(192, 168, 42, 2), net.IP{255, 255, 255, 0}, 230, 20*time.Minute, nil, nil, WithConn(&noopSink{}), WithLoadBalancing(lb))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handler
+	}
+	primary := newHandler(LoadBalancing{First: 0, Last: 127, SecsThreshold: 10})
+	secondary := newHandler(LoadBalancing{First: 128, Last: 255})
+
+	// Every client is served by exactly one of the servers.
+	counts := make(map[*Handler]int)
+	for i := 0; i < 64; i++ {
+		hw := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, byte(i)}
+		var served []*Handler
+		for _, h := range []*Handler{primary, secondary} {
+			p := discover(net.IPv4zero, hw)
+			if h.serveDHCP(p, dhcp4.Discover, p.ParseOptions()) != nil {
+				served = append(served, h)
+				counts[h]++
+			}
+		}
+		if len(served) != 1 {
+			t.Errorf("DHCPDISCOVER(%v) answered by %d servers, want 1", hw, len(served))
+		}
+	}
+	if counts[primary] == 0 || counts[secondary] == 0 {
+		t.Errorf("clients were not split: primary %d, secondary %d", counts[primary], counts[secondary])
+	}
+
+	var hw net.HardwareAddr
+	for i := 0; hw == nil; i++ {
+		c := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, byte(i)}
+		if loadBalanceHash(c) >= 128 {
+			hw = c
+		}
+	}
+	p := discover(net.IPv4zero, hw)
+	if resp := primary.serveDHCP(p, dhcp4.Discover, p.ParseOptions()); resp != nil {
+		t.Fatalf("DHCPDISCOVER(%v) unexpectedly answered by primary", hw)
+	}
+	// The primary takes over clients that the secondary leaves waiting.
+	binary.BigEndian.PutUint16(p.Secs(), 10)
+	if resp := primary.serveDHCP(p, dhcp4.Discover, p.ParseOptions()); resp == nil {
+		t.Errorf("DHCPDISCOVER(%v) with secs 10 ignored by primary", hw)
+	}
+
+	// Renewals go to the server holding the lease.
+	p = request(net.IP{192, 168, 42, 2}, hw)
+	p.SetCIAddr(net.IP{192, 168, 42, 2})
+	if resp := primary.serveDHCP(p, dhcp4.Request, p.ParseOptions()); resp == nil {
+		t.Errorf("renewing DHCPREQUEST(%v) ignored by primary", hw)
+	}
+}
+
+func TestFailoverConstraints(t *testing.T) {
+	iface := &net.Interface{
+		HardwareAddr: net.HardwareAddr([]byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}),
+	}
+	backup := net.IP{192, 168, 42, 5}
+	handler, err := NewHandler(iface, net.IPv4(192, 168, 42, 1), net.IPv4(192, 168, 42, 2), net.IP{255, 255, 255, 0}, 10, 20*time.Minute, nil, nil,
+		WithConn(&noopSink{}),
+		WithAllocatable(func(ip net.IP) bool { return ip.Equal(backup) }),
+		WithLeaseLimit(func(ip net.IP) time.Duration { return 5 * time.Minute }))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A lease granted by the partner is kept, but not announced.
+	handler.Leases = func(leases []*Lease, latest *Lease) {
+		if latest != nil {
+			t.Errorf("Leases called with latest lease %v", latest.Addr)
+		}
+	}
+	partner := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0x00, 0x00, 0x01}
+	handler.PutLease(Lease{Addr: net.IP{192, 168, 42, 3}, HardwareAddr: partner.String(), Expiry: time.Now().Add(time.Hour)})
+	if l, ok := handler.LeaseByIP(net.IP{192, 168, 42, 3}); !ok || l.HardwareAddr != partner.String() {
+		t.Errorf("LeaseByIP after PutLease = %+v, %v", l, ok)
+	}
+	handler.Leases = nil
+
+	hw := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	p := discover(net.IP{192, 168, 42, 2}, hw)
+	resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if resp == nil {
+		t.Fatal("DHCPDISCOVER unexpectedly ignored")
+	}
+	if got := resp.YIAddr().To4(); !got.Equal(backup) {
+		t.Errorf("DHCPOFFER for %v, want %v", got, backup)
+	}
+
+	p = request(backup, hw)
+	resp = handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+	if got, want := messageType(resp), dhcp4.ACK; got != want {
+		t.Fatalf("DHCPREQUEST resulted in unexpected message type: got %v, want %v", got, want)
+	}
+	opts := resp.ParseOptions()
+	if got, want := binary.BigEndian.Uint32(opts[dhcp4.OptionIPAddressLeaseTime]), uint32(300); got != want {
+		t.Errorf("lease time = %ds, want %ds", got, want)
+	}
+
+	// Only the backup address may be allocated.
+	p = request(net.IP{192, 168, 42, 4}, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x00})
+	if got, want := messageType(handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())), dhcp4.NAK; got != want {
+		t.Errorf("DHCPREQUEST for a non-backup address: got %v, want %v", got, want)
+	}
+}
+
+func TestLeaseQuery(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	addr := net.IP{192, 168, 42, 23}
+	hw := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	p := request(addr, hw)
+	if got, want := messageType(handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())), dhcp4.ACK; got != want {
+		t.Fatalf("DHCPREQUEST resulted in unexpected message type: got %v, want %v", got, want)
+	}
+
+	query := func(ip net.IP, hw net.HardwareAddr) (dhcp4.Packet, bool) {
+		q := dhcp4.NewPacket(dhcp4.BootRequest)
+		q.SetXId([]byte{1, 2, 3, 4})
+		q.SetGIAddr(net.IP{10, 0, 0, 1})
+		q.SetCIAddr(ip)
+		q.SetCHAddr(hw)
+		q.AddOption(dhcp4.OptionDHCPMessageType, []byte{byte(LeaseQuery)})
+		q.PadToMinSize()
+		return handler.AnswerLeaseQuery(q, q.ParseOptions())
+	}
+
+	for _, tt := range []struct {
+		name   string
+		ip     net.IP
+		hw     net.HardwareAddr
+		want   dhcp4.MessageType
+		wantOK bool
+	}{
+		{"active by address", addr, nil, LeaseActive, true},
+		{"active by hardware address", net.IPv4zero, hw, LeaseActive, true},
+		{"unassigned address", net.IP{192, 168, 42, 24}, nil, LeaseUnassigned, true},
+		{"address of another network", net.IP{10, 0, 0, 5}, nil, 0, false},
+		{"unknown client", net.IPv4zero, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0x00, 0x00, 0x01}, 0, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			reply, ok := query(tt.ip, tt.hw)
+			if ok != tt.wantOK {
+				t.Fatalf("AnswerLeaseQuery ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if got := messageType(reply); got != tt.want {
+				t.Errorf("reply type = %v, want %v", got, tt.want)
+			}
+			if tt.want != LeaseActive {
+				return
+			}
+			if got := net.IP(reply.CIAddr()); !got.Equal(addr) {
+				t.Errorf("ciaddr = %v, want %v", got, addr)
+			}
+			if got := reply.CHAddr(); got.String() != hw.String() {
+				t.Errorf("chaddr = %v, want %v", got, hw)
+			}
+			if got := net.IP(reply.GIAddr()); !got.Equal(net.IP{10, 0, 0, 1}) {
+				t.Errorf("giaddr = %v", got)
+			}
+		})
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	iface := &net.Interface{
+		HardwareAddr: net.HardwareAddr([]byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}),
+	}
+	serverIP := net.IPv4(192, 168, 42, 1)
+	startIP := net.IPv4(192, 168, 42, 2)
+
+	var (
+		addr         = net.IP{192, 168, 42, 23}
+		hardwareAddr = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	)
+
+	handler, err := NewHandler(iface, serverIP, startIP, net.IP{255, 255, 255, 0}, 230, 20*time.Minute, []string{"1.1.1.1"}, nil,
+		WithConn(&noopSink{}), WithMACFilter(MACFilter{Ignore: []net.HardwareAddr{hardwareAddr}, NAK: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.Leases = func(leases []*Lease, latest *Lease) {
+		t.Errorf("unexpected lease for ignored client: %+v", latest)
+	}
+
+	for _, mt := range []dhcp4.MessageType{dhcp4.Discover, dhcp4.Request, dhcp4.Decline} {
+		p := newPacket(mt, addr, hardwareAddr, nil)
+		if resp := handler.serveDHCP(p, mt, p.ParseOptions()); resp != nil {
+			t.Errorf("%v from ignored client unexpectedly answered: %v", mt, messageType(resp))
+		}
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	iface := &net.Interface{
+		HardwareAddr: net.HardwareAddr([]byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}),
+	}
+	serverIP := net.IPv4(192, 168, 42, 1)
+	startIP := net.IPv4(192, 168, 42, 100)
+
+	quarantine := Class{
+		Name:       "quarantine",
+		StartIP:    net.IP{192, 168, 42, 200},
+		LeaseRange: 50,
+	}
+	staticLeases := []StaticLease{
+		{Addr: net.IP{192, 168, 42, 50}, HardwareAddr: "aa:bb:cc:00:00:01"},
+	}
+	handler, err := NewHandler(iface, serverIP, startIP, net.IP{255, 255, 255, 0}, 50, 20*time.Minute, []string{"1.1.1.1"}, staticLeases, WithConn(&noopSink{}), WithQuarantine(quarantine))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var approvals []string
+	handler.Approvals = func(approved []string) {
+		approvals = approved
+	}
+
+	var (
+		inQuarantine = func(ip net.IP) bool {
+			return dhcp4.IPInRange(net.IP{192, 168, 42, 200}, net.IP{192, 168, 42, 249}, ip)
+		}
+		unknown = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+		static  = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0x00, 0x00, 0x01}
+	)
+
+	p := discover(net.IPv4zero, unknown)
+	resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+	quarantineAddr := resp.YIAddr()
+	if !inQuarantine(quarantineAddr) {
+		t.Errorf("unknown client offered %v, want quarantine pool", quarantineAddr)
+	}
+	p = request(quarantineAddr, unknown)
+	resp = handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+	if got, want := messageType(resp), dhcp4.ACK; got != want {
+		t.Fatalf("DHCPREQUEST resulted in unexpected message type: got %v, want %v", got, want)
+	}
+
+	p = discover(net.IPv4zero, static)
+	resp = handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if got, want := resp.YIAddr().To4(), (net.IP{192, 168, 42, 50}); !got.Equal(want) {
+		t.Errorf("static client offered %v, want %v", got, want)
+	}
+
+	handler.Approve(unknown.String())
+	if got, want := len(approvals), 1; got != want {
+		t.Fatalf("unexpected number of approvals: got %d, want %d", got, want)
+	}
+
+	// The quarantine lease must not be renewed once the client is approved.
+	p = request(quarantineAddr, unknown)
+	resp = handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+	if got, want := messageType(resp), dhcp4.NAK; got != want {
+		t.Errorf("DHCPREQUEST resulted in unexpected message type: got %v, want %v", got, want)
+	}
+
+	p = discover(net.IPv4zero, unknown)
+	resp = handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if got := resp.YIAddr(); inQuarantine(got) {
+		t.Errorf("approved client offered quarantine address %v", got)
+	}
+}
+
+func TestStaticOnly(t *testing.T) {
+	iface := &net.Interface{
+		HardwareAddr: net.HardwareAddr([]byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}),
+	}
+	serverIP := net.IPv4(192, 168, 42, 1)
+	startIP := net.IPv4(192, 168, 42, 2)
+
+	var (
+		staticAddr = net.IP{192, 168, 42, 50}
+		static     = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0x00, 0x00, 0x01}
+		unknown    = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	)
+	staticLeases := []StaticLease{
+		{Addr: staticAddr, HardwareAddr: static.String()},
+	}
+	handler, err := NewHandler(iface, serverIP, startIP, net.IP{255, 255, 255, 0}, 230, 20*time.Minute, []string{"1.1.1.1"}, staticLeases,
+		WithConn(&noopSink{}), WithMACFilter(MACFilter{StaticOnly: true, NAK: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := discover(net.IPv4zero, static)
+	resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if got, want := resp.YIAddr().To4(), staticAddr; !got.Equal(want) {
+		t.Errorf("static client offered %v, want %v", got, want)
+	}
+
+	p = request(net.IP{192, 168, 42, 23}, static)
+	resp = handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+	if got, want := messageType(resp), dhcp4.NAK; got != want {
+		t.Errorf("DHCPREQUEST for non-static address resulted in unexpected message type: got %v, want %v", got, want)
+	}
+
+	p = discover(net.IPv4zero, unknown)
+	if resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions()); resp != nil {
+		t.Errorf("DHCPDISCOVER(%v) resulted in unexpected offer of %v", unknown, resp.YIAddr())
+	}
+
+	p = request(net.IP{192, 168, 42, 23}, unknown)
+	resp = handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+	if got, want := messageType(resp), dhcp4.NAK; got != want {
+		t.Errorf("DHCPREQUEST resulted in unexpected message type: got %v, want %v", got, want)
+	}
+}
+
+func TestDeviceLeasePeriods(t *testing.T) {
+	iface := &net.Interface{
+		HardwareAddr: net.HardwareAddr([]byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}),
+	}
+	serverIP := net.IPv4(192, 168, 42, 1)
+	startIP := net.IPv4(192, 168, 42, 2)
+
+	handler, err := NewHandler(iface, serverIP, startIP, net.IP{255, 255, 255, 0}, 230, 20*time.Minute, []string{"1.1.1.1"}, nil,
+		WithConn(&noopSink{}), WithDeviceLeasePeriods(DeviceLeasePeriod{
+			Prefixes:    []net.HardwareAddr{{0x24, 0x0a, 0xc4}},
+			LeasePeriod: 24 * time.Hour,
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		hwaddr        string
+		wantLeaseTime time.Duration
+	}{
+		{"24:0a:c4:11:22:33", 24 * time.Hour},
+		// The built-in Nintendo profile is replaced.
+		{"7c:bb:8a:11:22:33", 20 * time.Minute},
+		{"11:22:33:44:55:66", 20 * time.Minute},
+	} {
+		if got, want := handler.leasePeriodForDevice(tt.hwaddr), tt.wantLeaseTime; got != want {
+			t.Errorf("leasePeriodForDevice(%s) = %v, want %v", tt.hwaddr, got, want)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+	handler.classifyDevice = func(fp Fingerprint) string {
+		if fp.ParameterRequestList == "1,3,6,15" {
+			return "printer"
+		}
+		return ""
+	}
+
+	var got *Lease
+	handler.Leases = func(leases []*Lease, latest *Lease) {
+		got = latest
+	}
+
+	p := request(net.IP{192, 168, 42, 23}, net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66},
+		dhcp4.Option{Code: dhcp4.OptionVendorClassIdentifier, Value: []byte("HP")},
+		dhcp4.Option{Code: dhcp4.OptionParameterRequestList, Value: []byte{1, 3, 6, 15}},
+	)
+	handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+	if got == nil {
+		t.Fatalf("leased callback not called")
+	}
+	want := Fingerprint{
+		ParameterRequestList: "1,3,6,15",
+		VendorClass:          "HP",
+		OptionOrder:          "53,60,55",
+	}
+	if *got.Fingerprint != want {
+		t.Errorf("unexpected fingerprint: got %+v, want %+v", *got.Fingerprint, want)
+	}
+	if got, want := got.DeviceType, "printer"; got != want {
+		t.Errorf("unexpected device type: got %q, want %q", got, want)
+	}
+}
+
+func TestDeviceGrouping(t *testing.T) {
+	iface := &net.Interface{
+		HardwareAddr: net.HardwareAddr([]byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}),
+	}
+	serverIP := net.IPv4(192, 168, 42, 1)
+	startIP := net.IPv4(192, 168, 42, 2)
+
+	handler, err := NewHandler(iface, serverIP, startIP, net.IP{255, 255, 255, 0}, 230, 20*time.Minute, []string{"1.1.1.1"}, nil, WithConn(&noopSink{}), WithDeviceGrouping())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var leases []*Lease
+	handler.Leases = func(l []*Lease, latest *Lease) {
+		leases = l
+	}
+
+	phoneOpts := []dhcp4.Option{
+		{Code: dhcp4.OptionHostName, Value: []byte("pixel")},
+		{Code: dhcp4.OptionParameterRequestList, Value: []byte{1, 3, 6, 15, 26, 28, 51, 58, 59, 43}},
+	}
+
+	first := net.HardwareAddr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}
+	p := request(net.IP{192, 168, 42, 23}, first, phoneOpts...)
+	handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+	if err := handler.SetHostname(first.String(), "kids-phone"); err != nil {
+		t.Fatal(err)
+	}
+
+	second := net.HardwareAddr{0x06, 0xaa, 0xbb, 0xcc, 0xdd, 0xee}
+	p = request(net.IP{192, 168, 42, 42}, second, phoneOpts...)
+	handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+
+	if got, want := len(leases), 1; got != want {
+		t.Fatalf("unexpected number of leases: got %d, want %d", got, want)
+	}
+	l := leases[0]
+	if got, want := l.HardwareAddr, second.String(); got != want {
+		t.Errorf("unexpected lease.HardwareAddr: got %q, want %q", got, want)
+	}
+	if got, want := l.DeviceID, first.String(); got != want {
+		t.Errorf("unexpected lease.DeviceID: got %q, want %q", got, want)
+	}
+	if got, want := l.Hostname, "kids-phone"; got != want {
+		t.Errorf("unexpected lease.Hostname: got %q, want %q", got, want)
+	}
+
+	// A globally unique address is never grouped.
+	laptop := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	p = request(net.IP{192, 168, 42, 50}, laptop, phoneOpts...)
+	handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+	if got, want := len(leases), 2; got != want {
+		t.Fatalf("unexpected number of leases: got %d, want %d", got, want)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	var got []string
+	handler.Events = func(ev Event) {
+		got = append(got, fmt.Sprintf("%s %s %s", ev.Type, ev.Lease.HardwareAddr, ev.Lease.Addr))
+	}
+
+	hardwareAddr := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	addr1 := net.IP{192, 168, 42, 23}
+	addr2 := net.IP{192, 168, 42, 42}
+
+	p := discover(addr1, hardwareAddr)
+	handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+	for _, addr := range []net.IP{addr1, addr1, addr2} {
+		p := request(addr, hardwareAddr)
+		if resp := handler.serveDHCP(p, dhcp4.Request, p.ParseOptions()); messageType(resp) != dhcp4.ACK {
+			t.Fatalf("DHCPREQUEST for %v resulted in unexpected message type: %v", addr, messageType(resp))
+		}
+	}
+	p = decline(addr2, hardwareAddr)
+	handler.serveDHCP(p, dhcp4.Decline, p.ParseOptions())
+	p = request(net.IP{10, 0, 0, 5}, hardwareAddr)
+	if resp := handler.serveDHCP(p, dhcp4.Request, p.ParseOptions()); messageType(resp) != dhcp4.NAK {
+		t.Fatalf("DHCPREQUEST outside the network resulted in unexpected message type: %v", messageType(resp))
+	}
+
+	want := []string{
+		"offer aa:bb:cc:dd:ee:ff 192.168.42.23",
+		"add aa:bb:cc:dd:ee:ff 192.168.42.23",
+		"old aa:bb:cc:dd:ee:ff 192.168.42.23",
+		"release aa:bb:cc:dd:ee:ff 192.168.42.23",
+		"add aa:bb:cc:dd:ee:ff 192.168.42.42",
+		"release aa:bb:cc:dd:ee:ff 192.168.42.42",
+		"nak aa:bb:cc:dd:ee:ff 10.0.0.5",
+	}
+	if got, want := strings.Join(got, "\n"), strings.Join(want, "\n"); got != want {
+		t.Errorf("unexpected events: got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestLeaseAccessors(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	var persisted int
+	handler.Leases = func(leases []*Lease, latest *Lease) {
+		persisted = len(leases)
+	}
+
+	hardwareAddr := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	addr := net.IP{192, 168, 42, 23}
+	p := request(addr, hardwareAddr)
+	handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+
+	leases := handler.ListLeases()
+	if len(leases) != 1 || !leases[0].Addr.Equal(addr) {
+		t.Fatalf("ListLeases() = %+v, want one lease for %v", leases, addr)
+	}
+
+	if err := handler.SetHostname(hardwareAddr.String(), "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	l, ok := handler.Lease(hardwareAddr.String())
+	if !ok || l.Hostname != "laptop" {
+		t.Fatalf("Lease() = %+v, %v; want hostname laptop", l, ok)
+	}
+
+	if err := handler.SetHostname("00:11:22:33:44:55", "nope"); err == nil {
+		t.Errorf("SetHostname for unknown client unexpectedly succeeded")
+	}
+
+	if !handler.DeleteLease(hardwareAddr.String()) {
+		t.Fatalf("DeleteLease() = false, want true")
+	}
+	if _, ok := handler.Lease(hardwareAddr.String()); ok {
+		t.Errorf("lease still present after DeleteLease")
+	}
+	if persisted != 0 {
+		t.Errorf("Leases callback got %d leases after delete, want 0", persisted)
+	}
+
+	// The address is available again.
+	p = request(addr, net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55})
+	if resp := handler.serveDHCP(p, dhcp4.Request, p.ParseOptions()); messageType(resp) != dhcp4.ACK {
+		t.Errorf("DHCPREQUEST for deleted lease address resulted in %v, want ACK", messageType(resp))
+	}
+}
+
+func TestPromoteLease(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	hardwareAddr := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	addr := net.IP{192, 168, 42, 23}
+	p := request(addr, hardwareAddr)
+	handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+
+	if _, err := handler.PromoteLease("00:11:22:33:44:55", false); err == nil {
+		t.Errorf("PromoteLease for client without lease unexpectedly succeeded")
+	}
+	sl, err := handler.PromoteLease(hardwareAddr.String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sl.Addr.Equal(addr) {
+		t.Errorf("static lease address: got %v, want %v", sl.Addr, addr)
+	}
+	if _, err := handler.PromoteLease(hardwareAddr.String(), false); err == nil {
+		t.Errorf("second PromoteLease unexpectedly succeeded")
+	}
+
+	// The reserved address is kept for the client after its lease expires.
+	handler.DeleteLease(hardwareAddr.String())
+	for i := 0; i < 300; i++ {
+		hw := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, byte(i >> 8), byte(i)}
+		p := discover(net.IPv4zero, hw)
+		if resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions()); resp != nil && resp.YIAddr().Equal(addr) {
+			t.Fatalf("reserved address %v offered to %v", addr, hw)
+		}
+	}
+	p = discover(net.IPv4zero, hardwareAddr)
+	if resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions()); !resp.YIAddr().Equal(addr) {
+		t.Errorf("DHCPOFFER for promoted client: got %v, want %v", resp.YIAddr(), addr)
+	}
+}
+
+func TestRevokeLease(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	hardwareAddr := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	addr := net.IP{192, 168, 42, 23}
+	p := request(addr, hardwareAddr)
+	handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+
+	l, ok := handler.LeaseByIP(addr)
+	if !ok || l.HardwareAddr != hardwareAddr.String() {
+		t.Fatalf("LeaseByIP(%v) = %+v, %v", addr, l, ok)
+	}
+
+	if !handler.RevokeLease(hardwareAddr.String(), true) {
+		t.Fatalf("RevokeLease() = false, want true")
+	}
+	if l, _ := handler.Lease(hardwareAddr.String()); !l.Expired(time.Now().Add(time.Second)) {
+		t.Errorf("lease not expired after RevokeLease: %+v", l)
+	}
+
+	p = request(addr, hardwareAddr)
+	if got, want := messageType(handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())), dhcp4.NAK; got != want {
+		t.Errorf("DHCPREQUEST after revocation resulted in %v, want %v", got, want)
+	}
+	// Only the next request is NAKed.
+	p = request(addr, hardwareAddr)
+	if got, want := messageType(handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())), dhcp4.ACK; got != want {
+		t.Errorf("second DHCPREQUEST after revocation resulted in %v, want %v", got, want)
+	}
+}
+
+func TestExpireLeases(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	now := time.Now()
+	handler.timeNow = func() time.Time { return now }
+	var expired []string
+	handler.Events = func(ev Event) {
+		if ev.Type == EventExpire {
+			expired = append(expired, ev.Lease.HardwareAddr)
+		}
+	}
+
+	idle := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	revoked := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02}
+	for i, hw := range []net.HardwareAddr{idle, revoked} {
+		p := request(net.IP{192, 168, 42, byte(10 + i)}, hw)
+		if reply := handler.serveDHCP(p, dhcp4.Request, p.ParseOptions()); messageType(reply) != dhcp4.ACK {
+			t.Fatal("DHCPREQUEST was not acknowledged")
+		}
+	}
+	handler.RevokeLease(revoked.String(), false)
+	expired = nil
+
+	handler.ExpireLeases()
+	if len(expired) != 0 {
+		t.Fatalf("expire events for %v before the lease expired", expired)
+	}
+	now = now.Add(time.Hour)
+	handler.ExpireLeases()
+	handler.ExpireLeases()
+	handler.ReapExpired(0)
+	if len(expired) != 1 || expired[0] != idle.String() {
+		t.Errorf("expire events for %v, want one for %v", expired, idle)
+	}
+}
+
+func TestReapExpired(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	now := time.Now()
+	handler.timeNow = func() time.Time { return now }
+
+	var persisted []*Lease
+	handler.Leases = func(leases []*Lease, _ *Lease) { persisted = leases }
+	var expired []string
+	handler.Events = func(ev Event) {
+		if ev.Type == EventExpire {
+			expired = append(expired, ev.Lease.HardwareAddr)
+		}
+	}
+
+	stale := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	fresh := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02}
+	p := request(net.IP{192, 168, 42, 10}, stale)
+	handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+
+	now = now.Add(time.Hour)
+	p = request(net.IP{192, 168, 42, 11}, fresh)
+	handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+
+	// The stale lease expired 40 minutes ago.
+	if n := handler.ReapExpired(time.Hour); n != 0 {
+		t.Errorf("ReapExpired(1h) = %d, want 0", n)
+	}
+	if n := handler.ReapExpired(30 * time.Minute); n != 1 {
+		t.Errorf("ReapExpired(30m) = %d, want 1", n)
+	}
+	if _, ok := handler.Lease(stale.String()); ok {
+		t.Errorf("stale lease still present after ReapExpired")
+	}
+	if _, ok := handler.Lease(fresh.String()); !ok {
+		t.Errorf("fresh lease removed by ReapExpired")
+	}
+	if len(persisted) != 1 || persisted[0].HardwareAddr != fresh.String() {
+		t.Errorf("Leases called with %v, want only the fresh lease", persisted)
+	}
+	if len(expired) != 1 || expired[0] != stale.String() {
+		t.Errorf("expire events for %v, want [%v]", expired, stale)
+	}
+}
+
+func TestHostnameOverride(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	var overrides map[string]string
+	handler.HostnameOverrides = func(o map[string]string) {
+		overrides = o
+	}
+
+	hardwareAddr := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	hostname := dhcp4.Option{Code: dhcp4.OptionHostName, Value: []byte("android-8f2c1")}
+	p := request(net.IP{192, 168, 42, 23}, hardwareAddr, hostname)
+	handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+
+	if err := handler.SetHostname(hardwareAddr.String(), "kids-tablet"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := overrides[hardwareAddr.String()], "kids-tablet"; got != want {
+		t.Errorf("persisted override: got %q, want %q", got, want)
+	}
+
+	// The override survives the lease being removed and a new address
+	// being handed out.
+	handler.DeleteLease(hardwareAddr.String())
+	p = request(net.IP{192, 168, 42, 42}, hardwareAddr, hostname)
+	handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+	if l, _ := handler.Lease(hardwareAddr.String()); l.Hostname != "kids-tablet" {
+		t.Errorf("hostname after new lease: got %q, want %q", l.Hostname, "kids-tablet")
+	}
+
+	if err := handler.SetHostname(hardwareAddr.String(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := handler.Lease(hardwareAddr.String()); l.Hostname != "android-8f2c1" || l.HostnameOverride != "" {
+		t.Errorf("hostname after clearing override: got %q (override %q), want %q", l.Hostname, l.HostnameOverride, "android-8f2c1")
+	}
+	if len(overrides) != 0 {
+		t.Errorf("persisted overrides after clearing: %v", overrides)
+	}
+}
+
+func TestMagicPacket(t *testing.T) {
+	hw := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	p := magicPacket(hw)
+	if len(p) != 102 {
+		t.Fatalf("magic packet length: got %d, want 102", len(p))
+	}
+	for i := 0; i < 6; i++ {
+		if p[i] != 0xff {
+			t.Fatalf("magic packet byte %d: got %#x, want 0xff", i, p[i])
+		}
+	}
+	for i := 6; i < len(p); i += 6 {
+		if !bytes.Equal(p[i:i+6], hw) {
+			t.Fatalf("magic packet repetition at %d: got %v, want %v", i, net.HardwareAddr(p[i:i+6]), hw)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	now := time.Now()
+	handler.timeNow = func() time.Time { return now }
+
+	for i, addr := range []net.IP{{192, 168, 42, 23}, {192, 168, 42, 24}} {
+		p := request(addr, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, byte(i)})
+		handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+	}
+	handler.RevokeLease("aa:bb:cc:dd:ee:01", false)
+	now = now.Add(time.Second)
+
+	got := handler.Stats()
+	want := Stats{
+		PoolSize:    230,
+		Active:      1,
+		Expired:     1,
+		Utilization: 100.0 / 230,
+	}
+	if got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+}
+
+type countingMetrics struct {
+	received map[dhcp4.MessageType]int
+	sent     map[dhcp4.MessageType]int
+	errors   map[string]int
+	handled  map[dhcp4.MessageType]int
+	writes   int
+}
+
+func (m *countingMetrics) PacketReceived(t dhcp4.MessageType) { m.received[t]++ }
+func (m *countingMetrics) ReplySent(t dhcp4.MessageType)      { m.sent[t]++ }
+func (m *countingMetrics) Error(kind string)                  { m.errors[kind]++ }
+func (m *countingMetrics) WriteFailed(error)                  { m.writes++ }
+
+func (m *countingMetrics) HandleDuration(t dhcp4.MessageType, _ time.Duration) { m.handled[t]++ }
+
+func TestMetrics(t *testing.T) {
+	m := &countingMetrics{
+		received: make(map[dhcp4.MessageType]int),
+		sent:     make(map[dhcp4.MessageType]int),
+		errors:   make(map[string]int),
+		handled:  make(map[dhcp4.MessageType]int),
+	}
+	iface := &net.Interface{Name: "lo0", HardwareAddr: net.HardwareAddr{0x00, 0x1f, 0x6b, 0x09, 0x8b, 0x2a}}
+	handler, err := NewHandler(iface, net.IP{192, 168, 42, 1}, net.IP{192, 168, 42, 2}, net.IP{255, 255, 255, 0}, 1, 20*time.Minute, nil, nil, WithConn(&noopSink{}), WithMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := request(net.IP{192, 168, 42, 2}, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff})
+	handler.ServeDHCP(p, dhcp4.Request, p.ParseOptions())
+	p = discover(net.IPv4zero, net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55})
+	handler.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+
+	if m.received[dhcp4.Request] != 1 || m.received[dhcp4.Discover] != 1 {
+		t.Errorf("received: got %v, want one request and one discover", m.received)
+	}
+	if m.sent[dhcp4.ACK] != 1 || len(m.sent) != 1 {
+		t.Errorf("sent: got %v, want one ACK", m.sent)
+	}
+	if m.errors["pool_exhausted"] != 1 {
+		t.Errorf("errors: got %v, want one pool_exhausted", m.errors)
+	}
+	if m.handled[dhcp4.Request] != 1 || m.handled[dhcp4.Discover] != 1 {
+		t.Errorf("handled: got %v, want one request and one discover", m.handled)
+	}
+	if m.writes != 0 {
+		t.Errorf("write failures: got %d, want 0", m.writes)
+	}
+}
+
+type spanRecorder []Span
+
+func (r *spanRecorder) Span(s Span) { *r = append(*r, s) }
+
+func TestTracer(t *testing.T) {
+	var spans spanRecorder
+	iface := &net.Interface{Name: "lo0", HardwareAddr: net.HardwareAddr{0x00, 0x1f, 0x6b, 0x09, 0x8b, 0x2a}}
+	handler, err := NewHandler(iface, net.IP{192, 168, 42, 1}, net.IP{192, 168, 42, 2}, net.IP{255, 255, 255, 0}, 1, 20*time.Minute, nil, nil, WithConn(&noopSink{}), WithTracer(&spans))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hw := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	p := discover(net.IPv4zero, hw)
+	handler.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	p = request(net.IP{192, 168, 42, 2}, hw)
+	handler.ServeDHCP(p, dhcp4.Request, p.ParseOptions())
+
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	for i, want := range []struct{ msg, reply dhcp4.MessageType }{{dhcp4.Discover, dhcp4.Offer}, {dhcp4.Request, dhcp4.ACK}} {
+		s := spans[i]
+		if s.MessageType != want.msg || s.Reply != want.reply {
+			t.Errorf("span %d: got %v/%v, want %v/%v", i, s.MessageType, s.Reply, want.msg, want.reply)
+		}
+		if !s.YourIP.Equal(net.IP{192, 168, 42, 2}) {
+			t.Errorf("span %d: your ip = %v, want 192.168.42.2", i, s.YourIP)
+		}
+		if s.HardwareAddr.String() != hw.String() || s.End.Before(s.Start) {
+			t.Errorf("span %d: unexpected %+v", i, s)
+		}
+	}
+}
+
+func TestFormatOptions(t *testing.T) {
+	got := formatOptions(dhcp4.Options{
+		dhcp4.OptionDHCPMessageType:      []byte{byte(dhcp4.Request)},
+		dhcp4.OptionHostName:             []byte("laptop"),
+		dhcp4.OptionParameterRequestList: []byte{1, 3, 6},
+		dhcp4.OptionClientIdentifier:     []byte{0x01, 0xaa, 0xbb},
+	})
+	want := `12(HostName)="laptop" 53(DHCPMessageType)=Request 55(ParameterRequestList)=1,3,6 61(ClientIdentifier)=01aabb`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestDumpLeases(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	hardwareAddr := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	p := request(net.IP{192, 168, 42, 23}, hardwareAddr)
+	handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+	handler.RevokeLease(hardwareAddr.String(), true)
+	handler.leasesHW["11:22:33:44:55:66"] = 99
+
+	got := handler.DumpLeases()
+	if len(got) != 2 {
+		t.Fatalf("got %d entries, want 2: %+v", len(got), got)
+	}
+	if s := got[0]; s.Num != 21 || !s.Revoked || !s.Indexed || s.Dangling {
+		t.Errorf("unexpected lease entry: %+v", s)
+	}
+	if s := got[1]; s.Num != 99 || s.HardwareAddr != "11:22:33:44:55:66" || !s.Dangling {
+		t.Errorf("unexpected dangling entry: %+v", s)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	m := &countingMetrics{
+		received: make(map[dhcp4.MessageType]int),
+		sent:     make(map[dhcp4.MessageType]int),
+		errors:   make(map[string]int),
+		handled:  make(map[dhcp4.MessageType]int),
+	}
+	iface := &net.Interface{Name: "lo0", HardwareAddr: net.HardwareAddr{0x00, 0x1f, 0x6b, 0x09, 0x8b, 0x2a}}
+	handler, err := NewHandler(iface, net.IP{192, 168, 42, 1}, net.IP{192, 168, 42, 2}, net.IP{255, 255, 255, 0}, 10, 20*time.Minute, nil, nil, WithConn(&noopSink{}), WithMetrics(m), WithRateLimit(RateLimit{Rate: 1, Burst: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	handler.timeNow = func() time.Time { return now }
+
+	noisy := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	quiet := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	for _, hw := range []net.HardwareAddr{noisy, noisy, noisy, noisy, quiet} {
+		p := discover(net.IPv4zero, hw)
+		handler.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	}
+	if got, want := m.sent[dhcp4.Offer], 3; got != want {
+		t.Errorf("offers: got %d, want %d", got, want)
+	}
+	if got, want := m.errors["rate_limited"], 2; got != want {
+		t.Errorf("rate limited: got %d, want %d", got, want)
+	}
+
+	now = now.Add(time.Second)
+	p := discover(net.IPv4zero, noisy)
+	handler.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if got, want := m.sent[dhcp4.Offer], 4; got != want {
+		t.Errorf("offers after refill: got %d, want %d", got, want)
+	}
+}
+
+func TestFlapDetection(t *testing.T) {
+	iface := &net.Interface{Name: "lo0", HardwareAddr: net.HardwareAddr{0x00, 0x1f, 0x6b, 0x09, 0x8b, 0x2a}}
+	handler, err := NewHandler(iface, net.IP{192, 168, 42, 1}, net.IP{192, 168, 42, 2}, net.IP{255, 255, 255, 0}, 10, 20*time.Minute, nil, nil, WithConn(&noopSink{}), WithFlapDetection(FlapDetection{Threshold: 2, Window: time.Minute}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	handler.timeNow = func() time.Time { return now }
+	var flaps int
+	handler.Events = func(ev Event) {
+		if ev.Type == EventFlap {
+			flaps++
+		}
+	}
+
+	hardwareAddr := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	addr := net.IP{192, 168, 42, 4}
+	cycle := func() {
+		p := request(addr, hardwareAddr)
+		handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+		p = newPacket(dhcp4.Release, addr, hardwareAddr, nil)
+		handler.serveDHCP(p, dhcp4.Release, p.ParseOptions())
+	}
+
+	cycle()
+	if flaps != 0 {
+		t.Fatalf("got %d flap events after one cycle, want 0", flaps)
+	}
+	if l, _ := handler.Lease(hardwareAddr.String()); !l.Expiry.Equal(now) {
+		t.Errorf("released lease expiry = %v, want %v", l.Expiry, now)
+	}
+	cycle()
+	cycle()
+	if flaps != 1 {
+		t.Fatalf("got %d flap events after three cycles, want 1", flaps)
+	}
+
+	now = now.Add(2 * time.Minute)
+	cycle()
+	cycle()
+	if flaps != 2 {
+		t.Fatalf("got %d flap events after the window passed, want 2", flaps)
+	}
+}
+
+func TestPoolWarning(t *testing.T) {
+	iface := &net.Interface{Name: "lo0", HardwareAddr: net.HardwareAddr{0x00, 0x1f, 0x6b, 0x09, 0x8b, 0x2a}}
+	handler, err := NewHandler(iface, net.IP{192, 168, 42, 1}, net.IP{192, 168, 42, 2}, net.IP{255, 255, 255, 0}, 4, 20*time.Minute, nil, nil, WithConn(&noopSink{}), WithPoolWarning(50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	handler.Events = func(ev Event) {
+		if ev.Pool != nil {
+			got = append(got, fmt.Sprintf("%s %s %.0f", ev.Type, ev.Lease.HardwareAddr, ev.Pool.Utilization))
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		hw := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, byte(i)}
+		p := request(net.IP{192, 168, 42, byte(2 + i)}, hw)
+		if resp := handler.serveDHCP(p, dhcp4.Request, p.ParseOptions()); messageType(resp) != dhcp4.ACK {
+			t.Fatalf("DHCPREQUEST %d resulted in unexpected message type: %v", i, messageType(resp))
+		}
+	}
+	p := discover(net.IPv4zero, net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55})
+	if resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions()); resp != nil {
+		t.Fatalf("DHCPDISCOVER on a full pool resulted in a reply: %v", messageType(resp))
+	}
+
+	want := []string{
+		"pool_warning aa:bb:cc:dd:ee:01 50",
+		"pool_exhausted 00:11:22:33:44:55 100",
+	}
+	if got, want := strings.Join(got, "\n"), strings.Join(want, "\n"); got != want {
+		t.Errorf("unexpected events: got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCopyStateFrom(t *testing.T) {
+	old, cleanup := testHandler(t)
+	defer cleanup()
+
+	hardwareAddr := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	addr := net.IP{192, 168, 42, 23}
+	p := request(addr, hardwareAddr)
+	if resp := old.serveDHCP(p, dhcp4.Request, p.ParseOptions()); messageType(resp) != dhcp4.ACK {
+		t.Fatalf("DHCPREQUEST resulted in unexpected message type: %v", messageType(resp))
+	}
+	if err := old.SetHostname(hardwareAddr.String(), "desk"); err != nil {
+		t.Fatal(err)
+	}
+	old.SetApproved([]string{"00:11:22:33:44:55"})
+
+	// The new pool starts lower, so lease numbers shift.
+	iface := &net.Interface{HardwareAddr: net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}}
+	handler, err := NewHandler(iface, net.IPv4(192, 168, 42, 1), net.IPv4(192, 168, 42, 10), net.IP{255, 255, 255, 0}, 50, 20*time.Minute, nil, nil, WithConn(&noopSink{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.CopyStateFrom(old)
+
+	l, ok := handler.LeaseByIP(addr)
+	if !ok || l.HardwareAddr != hardwareAddr.String() || l.Hostname != "desk" {
+		t.Fatalf("LeaseByIP(%v) = %+v, %v; want lease for %v named desk", addr, l, ok, hardwareAddr)
+	}
+	if got, want := l.Num, 13; got != want {
+		t.Errorf("lease number: got %d, want %d", got, want)
+	}
+	if got := handler.Approved(); len(got) != 1 || got[0] != "00:11:22:33:44:55" {
+		t.Errorf("approved: got %v", got)
+	}
+
+	// The renewal is served from the copied lease.
+	p = request(addr, hardwareAddr)
+	if resp := handler.serveDHCP(p, dhcp4.Request, p.ParseOptions()); messageType(resp) != dhcp4.ACK {
+		t.Fatalf("DHCPREQUEST after copy resulted in unexpected message type: %v", messageType(resp))
+	}
+}
+
+type countingSink struct {
+	noopSink
+	writes int
+}
+
+func (c *countingSink) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.writes++
+	return len(b), nil
+}
+
+func TestDryRun(t *testing.T) {
+	var conn countingSink
+	iface := &net.Interface{Name: "lo0", HardwareAddr: net.HardwareAddr{0x00, 0x1f, 0x6b, 0x09, 0x8b, 0x2a}}
+	handler, err := NewHandler(iface, net.IP{192, 168, 42, 1}, net.IP{192, 168, 42, 2}, net.IP{255, 255, 255, 0}, 1, 20*time.Minute, nil, nil, WithConn(&conn), WithDryRun())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hw := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	p := discover(net.IPv4zero, hw)
+	handler.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	p = request(net.IP{192, 168, 42, 2}, hw)
+	handler.ServeDHCP(p, dhcp4.Request, p.ParseOptions())
+
+	if conn.writes != 0 {
+		t.Errorf("dry run sent %d packets, want 0", conn.writes)
+	}
+	// Leases are still tracked so that later messages are handled as if
+	// the replies had been sent.
+	if l, ok := handler.Lease(hw.String()); !ok || !l.Addr.Equal(net.IP{192, 168, 42, 2}) {
+		t.Errorf("lease after dry run request = %+v, %v", l, ok)
+	}
+}
+
+// frameConn returns its frames from ReadFrom, then io.EOF.
+type frameConn struct {
+	noopSink
+	frames [][]byte
+}
+
+func (c *frameConn) ReadFrom(buf []byte) (int, net.Addr, error) {
+	if len(c.frames) == 0 {
+		return 0, nil, io.EOF
+	}
+	n := copy(buf, c.frames[0])
+	c.frames = c.frames[1:]
+	return n, nil, nil
+}
+
+// udpFrame returns an Ethernet frame carrying payload in an IPv4 UDP
+// datagram.
+func udpFrame(srcPort, dstPort uint16, payload []byte) []byte {
+	frame := make([]byte, 14+20+8)
+	binary.BigEndian.PutUint16(frame[12:], 0x0800)
+	ip := frame[14:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+8+len(payload)))
+	ip[8] = 64
+	ip[9] = 17
+	udp := ip[20:]
+	binary.BigEndian.PutUint16(udp, srcPort)
+	binary.BigEndian.PutUint16(udp[2:], dstPort)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+	return append(frame, payload...)
+}
+
+func TestLearn(t *testing.T) {
+	hw := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	addr := net.IP{192, 168, 42, 99}
+	req := request(addr, hw, dhcp4.Option{Code: dhcp4.OptionHostName, Value: []byte("laptop")})
+	ack := dhcp4.ReplyPacket(req, dhcp4.ACK, net.IP{192, 168, 42, 254}, addr, time.Hour, []dhcp4.Option{
+		{Code: dhcp4.OptionSubnetMask, Value: []byte{255, 255, 255, 0}},
+	})
+	otherHW := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0x00, 0x00, 0x01}
+	other := request(net.IP{10, 0, 0, 5}, otherHW)
+	other.SetXId([]byte{1, 2, 3, 4})
+	otherACK := dhcp4.ReplyPacket(other, dhcp4.ACK, net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 5}, time.Hour, nil)
+
+	conn := &frameConn{frames: [][]byte{
+		udpFrame(68, 67, req),
+		udpFrame(67, 68, otherACK),
+		udpFrame(67, 68, ack),
+	}}
+	iface := &net.Interface{HardwareAddr: net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}}
+	handler, err := NewHandler(iface, net.IP{192, 168, 42, 1}, net.IP{192, 168, 42, 2}, net.IP{255, 255, 255, 0}, 230, 20*time.Minute, nil, nil, WithConn(conn), WithLearning())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	handler.timeNow = func() time.Time { return now }
+
+	p := discover(net.IPv4zero, hw)
+	if reply := handler.ServeDHCP(p, dhcp4.Discover, p.ParseOptions()); reply != nil {
+		t.Errorf("learning handler replied to DHCPDISCOVER")
+	}
+
+	if err := handler.Learn(); err != io.EOF {
+		t.Fatalf("Learn = %v, want io.EOF", err)
+	}
+	l, ok := handler.Lease(hw.String())
+	if !ok {
+		t.Fatalf("no lease learned for %v", hw)
+	}
+	if !l.Addr.Equal(addr) {
+		t.Errorf("learned lease addr = %v, want %v", l.Addr, addr)
+	}
+	if got, want := l.Hostname, "laptop"; got != want {
+		t.Errorf("learned lease hostname = %q, want %q", got, want)
+	}
+	if got, want := l.Expiry, now.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("learned lease expiry = %v, want %v", got, want)
+	}
+	if _, ok := handler.Lease(otherHW.String()); ok {
+		t.Errorf("lease of another network was learned")
+	}
+}
+
+func TestRecordNeighbors(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+	now := time.Now()
+	handler.timeNow = func() time.Time { return now }
+
+	client := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	p := request(net.IP{192, 168, 42, 23}, client)
+	if got, want := messageType(handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())), dhcp4.ACK; got != want {
+		t.Fatalf("DHCPREQUEST resulted in unexpected message type: got %v, want %v", got, want)
+	}
+
+	printer := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0x00, 0x00, 0x01}
+	n := handler.RecordNeighbors([]Neighbor{
+		{Addr: net.IP{192, 168, 42, 23}, HardwareAddr: client},
+		{Addr: net.IP{192, 168, 42, 50}, HardwareAddr: printer},
+		{Addr: net.IP{10, 0, 0, 5}, HardwareAddr: net.HardwareAddr{0xaa, 0xbb, 0xcc, 0x00, 0x00, 0x02}},
+		{Addr: net.IP{192, 168, 42, 23}, HardwareAddr: net.HardwareAddr{0xaa, 0xbb, 0xcc, 0x00, 0x00, 0x03}},
+	})
+	if n != 1 {
+		t.Errorf("RecordNeighbors = %d, want 1", n)
+	}
+	if l, _ := handler.Lease(client.String()); l.Unknown {
+		t.Errorf("lease of a DHCP client marked unknown")
+	}
+	l, ok := handler.Lease(printer.String())
+	if !ok || !l.Unknown || !l.Addr.Equal(net.IP{192, 168, 42, 50}) {
+		t.Fatalf("printer lease = %+v, %v", l, ok)
+	}
+	if got, want := len(handler.ListLeases()), 2; got != want {
+		t.Errorf("got %d leases, want %d", got, want)
+	}
+
+	// Its address is not offered to others.
+	if free := handler.canLease(net.IP{192, 168, 42, 50}, client.String(), handler.pool); free != -1 {
+		t.Errorf("canLease of an unknown device's address = %d, want -1", free)
+	}
+
+	// Once the device requests a lease it is no longer unknown.
+	p = request(net.IP{192, 168, 42, 50}, printer)
+	if got, want := messageType(handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())), dhcp4.ACK; got != want {
+		t.Fatalf("DHCPREQUEST resulted in unexpected message type: got %v, want %v", got, want)
+	}
+	if l, _ := handler.Lease(printer.String()); l.Unknown {
+		t.Errorf("lease still unknown after DHCPREQUEST")
+	}
+}
+
+func TestStation(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	hw := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	guest := Station{SSID: "guest", BSSID: "02:00:00:00:01:01"}
+	home := Station{SSID: "home", BSSID: "02:00:00:00:01:00"}
+
+	// Stations usually associate before requesting a lease.
+	if handler.SetStation(hw.String(), guest) {
+		t.Errorf("SetStation reported a lease before DHCPREQUEST")
+	}
+	p := request(net.IP{192, 168, 42, 23}, hw)
+	if got, want := messageType(handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())), dhcp4.ACK; got != want {
+		t.Fatalf("DHCPREQUEST resulted in unexpected message type: got %v, want %v", got, want)
+	}
+	if l, _ := handler.Lease(hw.String()); l.SSID != "guest" || l.BSSID != guest.BSSID {
+		t.Errorf("lease station = %q %q, want %q %q", l.SSID, l.BSSID, guest.SSID, guest.BSSID)
+	}
+
+	// Roaming to another network before the old one reports the
+	// disassociation.
+	handler.SetStation(hw.String(), home)
+	if handler.ClearStation(hw.String(), guest.BSSID) {
+		t.Errorf("ClearStation of a previous network succeeded")
+	}
+	if l, _ := handler.Lease(hw.String()); l.SSID != "home" {
+		t.Errorf("lease ssid = %q, want %q", l.SSID, "home")
+	}
+	if !handler.ClearStation(hw.String(), home.BSSID) {
+		t.Errorf("ClearStation of the current network failed")
+	}
+	if l, _ := handler.Lease(hw.String()); l.SSID != "" || l.BSSID != "" {
+		t.Errorf("lease station after disassociation = %q %q", l.SSID, l.BSSID)
+	}
+}
+
+func TestClientFQDN(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		policy     FQDNPolicy
+		option     []byte
+		wantFlags  byte
+		wantName   string
+		wantUpdate string
+	}{
+		{
+			name:       "client updates A",
+			option:     append([]byte{fqdnE, 0, 0}, "\x06laptop\x00"...),
+			wantFlags:  fqdnE,
+			wantName:   "laptop",
+			wantUpdate: DNSUpdateClient,
+		},
+		{
+			name:      "server updates A",
+			option:    append([]byte{fqdnS, 0, 0}, "laptop.corp.example."...),
+			wantFlags: fqdnS,
+			wantName:  "laptop.corp.example",
+		},
+		{
+			name:      "server overrides",
+			policy:    FQDNServer,
+			option:    append([]byte{fqdnE, 0, 0}, "\x06laptop\x00"...),
+			wantFlags: fqdnE | fqdnS | fqdnO,
+			wantName:  "laptop",
+		},
+		{
+			name:       "no updates",
+			option:     append([]byte{fqdnN, 0, 0}, "laptop"...),
+			wantFlags:  fqdnN,
+			wantName:   "laptop",
+			wantUpdate: DNSUpdateNone,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, cleanup := testHandler(t)
+			defer cleanup()
+			handler.fqdnPolicy = tt.policy
+
+			hw := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+			p := request(net.IP{192, 168, 42, 23}, hw, dhcp4.Option{Code: optionClientFQDN, Value: tt.option})
+			reply := handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+			if got, want := messageType(reply), dhcp4.ACK; got != want {
+				t.Fatalf("DHCPREQUEST resulted in unexpected message type: got %v, want %v", got, want)
+			}
+			opt := reply.ParseOptions()[optionClientFQDN]
+			if len(opt) < 3 {
+				t.Fatalf("reply has no client fqdn option")
+			}
+			if opt[0] != tt.wantFlags || opt[1] != 255 || opt[2] != 255 {
+				t.Errorf("reply flags = %#x %d %d, want %#x 255 255", opt[0], opt[1], opt[2], tt.wantFlags)
+			}
+			l, _ := handler.Lease(hw.String())
+			if l.FQDN != tt.wantName || l.DNSUpdate != tt.wantUpdate {
+				t.Errorf("lease fqdn = %q %q, want %q %q", l.FQDN, l.DNSUpdate, tt.wantName, tt.wantUpdate)
+			}
+			if got, want := l.Hostname, "laptop"; got != want {
+				t.Errorf("lease hostname = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestSanitizeHostname(t *testing.T) {
+	for _, tt := range []struct{ in, want string }{
+		{"laptop", "laptop"},
+		{"Bob's iPhone", "bob-s-iphone"},
+		{"--weird__name--", "weird-name"},
+		{"émile", "mile"},
+		{strings.Repeat("a", 70), strings.Repeat("a", 63)},
+		{"???", ""},
+	} {
+		if got := sanitizeHostname(tt.in); got != tt.want {
+			t.Errorf("sanitizeHostname(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDuplicateHostnames(t *testing.T) {
+	for _, tt := range []struct {
+		policy DuplicatePolicy
+		want   []string
+	}{
+		{DuplicateAllow, []string{"printer", "printer", "printer"}},
+		{DuplicateNumber, []string{"printer", "printer-2", "printer-3"}},
+		{DuplicateMAC, []string{"printer", "printer-ddee02", "printer-ddee03"}},
+	} {
+		handler, cleanup := testHandler(t)
+		handler.sanitizeHostnames = true
+		handler.duplicates = tt.policy
+		for i, want := range tt.want {
+			hw := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, byte(i + 1)}
+			p := request(net.IP{192, 168, 42, byte(23 + i)}, hw, dhcp4.Option{Code: dhcp4.OptionHostName, Value: []byte("Printer")})
+			if reply := handler.serveDHCP(p, dhcp4.Request, p.ParseOptions()); messageType(reply) != dhcp4.ACK {
+				t.Fatalf("DHCPREQUEST %d was not acknowledged", i)
+			}
+			l, _ := handler.Lease(hw.String())
+			if l.Hostname != want || l.ClientHostname != "Printer" {
+				t.Errorf("policy %d: lease %d hostname = %q (%q), want %q", tt.policy, i, l.Hostname, l.ClientHostname, want)
+			}
+		}
+
+		// Renewing keeps the name.
+		hw := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 2}
+		p := request(net.IP{192, 168, 42, 24}, hw, dhcp4.Option{Code: dhcp4.OptionHostName, Value: []byte("Printer")})
+		handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+		if l, _ := handler.Lease(hw.String()); l.Hostname != tt.want[1] {
+			t.Errorf("policy %d: renewed hostname = %q, want %q", tt.policy, l.Hostname, tt.want[1])
+		}
+		cleanup()
+	}
+}
+
+func TestHostnameFallback(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+	handler.HostnameFallback = func(hwaddr string, ip net.IP) string {
+		if hwaddr == "aa:bb:cc:dd:ee:01" && ip.Equal(net.IP{192, 168, 42, 23}) {
+			return "printer"
+		}
+		return ""
+	}
+
+	named := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}
+	p := request(net.IP{192, 168, 42, 23}, named)
+	handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+	if l, _ := handler.Lease(named.String()); l.Hostname != "printer" {
+		t.Errorf("fallback hostname = %q, want %q", l.Hostname, "printer")
+	}
+
+	// A hostname sent by the client wins.
+	p = request(net.IP{192, 168, 42, 23}, named, dhcp4.Option{Code: dhcp4.OptionHostName, Value: []byte("laser")})
+	handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+	if l, _ := handler.Lease(named.String()); l.Hostname != "laser" {
+		t.Errorf("client hostname = %q, want %q", l.Hostname, "laser")
+	}
+
+	unnamed := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x02}
+	p = request(net.IP{192, 168, 42, 24}, unnamed)
+	handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+	if !handler.FillHostname(unnamed.String(), "camera") {
+		t.Fatal("FillHostname of an unnamed lease failed")
+	}
+	if handler.FillHostname(unnamed.String(), "other") {
+		t.Error("FillHostname replaced a hostname")
+	}
+	if l, _ := handler.Lease(unnamed.String()); l.Hostname != "camera" {
+		t.Errorf("filled hostname = %q, want %q", l.Hostname, "camera")
+	}
+}
+
+func TestStaticLeaseOptions(t *testing.T) {
+	iface := &net.Interface{
+		HardwareAddr: net.HardwareAddr([]byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}),
+	}
+	serverIP := net.IPv4(192, 168, 42, 1)
+	startIP := net.IPv4(192, 168, 42, 2)
+
+	var (
+		staticAddr = net.IP{192, 168, 42, 50}
+		kid        = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0x00, 0x00, 0x01}
+		other      = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+		filtered   = []byte{10, 0, 0, 53}
+	)
+	staticLeases := []StaticLease{{
+		Addr:         staticAddr,
+		HardwareAddr: kid.String(),
+		Options:      dhcp4.Options{dhcp4.OptionDomainNameServer: filtered},
+	}}
+	handler, err := NewHandler(iface, serverIP, startIP, net.IP{255, 255, 255, 0}, 230, 20*time.Minute, []string{"1.1.1.1"}, staticLeases,
+		WithConn(&noopSink{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := discover(net.IPv4zero, kid)
+	resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if got := resp.ParseOptions()[dhcp4.OptionDomainNameServer]; !bytes.Equal(got, filtered) {
+		t.Errorf("offer dns servers = %v, want %v", net.IP(got), net.IP(filtered))
+	}
+	p = request(staticAddr, kid)
+	resp = handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+	if got := resp.ParseOptions()[dhcp4.OptionDomainNameServer]; !bytes.Equal(got, filtered) {
+		t.Errorf("ack dns servers = %v, want %v", net.IP(got), net.IP(filtered))
+	}
+
+	p = request(net.IP{192, 168, 42, 23}, other)
+	resp = handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+	if got, want := resp.ParseOptions()[dhcp4.OptionDomainNameServer], []byte{1, 1, 1, 1}; !bytes.Equal(got, want) {
+		t.Errorf("other client dns servers = %v, want %v", net.IP(got), net.IP(want))
+	}
+}
+
+func TestSequentialAllocation(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+	handler.allocation = AllocateSequential
+	for i := 0; i < 3; i++ {
+		hw := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, byte(i + 1)}
+		p := discover(net.IPv4zero, hw)
+		offer := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+		want := net.IP{192, 168, 42, byte(2 + i)}
+		if got := offer.YIAddr().To4(); !got.Equal(want) {
+			t.Fatalf("client %d offered %v, want %v", i, got, want)
+		}
+		p = request(want, hw)
+		if reply := handler.serveDHCP(p, dhcp4.Request, p.ParseOptions()); messageType(reply) != dhcp4.ACK {
+			t.Fatalf("DHCPREQUEST %d was not acknowledged", i)
+		}
+	}
+
+	// A released address is the next one handed out.
+	handler.DeleteLease(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 1}.String())
+	p := discover(net.IPv4zero, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 9})
+	offer := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if got, want := offer.YIAddr().To4(), (net.IP{192, 168, 42, 2}); !got.Equal(want) {
+		t.Errorf("offered %v, want released %v", got, want)
+	}
+}
+
+func TestExpiredLeaseSticky(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+	now := time.Now()
+	handler.timeNow = func() time.Time { return now }
+
+	var (
+		addr  = net.IP{192, 168, 42, 100}
+		hw    = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 1}
+		other = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 2}
+	)
+	p := request(addr, hw)
+	if reply := handler.serveDHCP(p, dhcp4.Request, p.ParseOptions()); messageType(reply) != dhcp4.ACK {
+		t.Fatal("DHCPREQUEST was not acknowledged")
+	}
+
+	now = now.Add(time.Hour) // the lease expired
+	p = discover(net.IPv4zero, hw)
+	offer := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if got := offer.YIAddr().To4(); !got.Equal(addr) {
+		t.Fatalf("returning client offered %v, want its old %v", got, addr)
+	}
+
+	// Once another client has taken the address it is not offered.
+	p = request(addr, other)
+	if reply := handler.serveDHCP(p, dhcp4.Request, p.ParseOptions()); messageType(reply) != dhcp4.ACK {
+		t.Fatal("DHCPREQUEST for the expired address was not acknowledged")
+	}
+	p = discover(net.IPv4zero, hw)
+	offer = handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if got := offer.YIAddr().To4(); got.Equal(addr) {
+		t.Errorf("returning client offered %v, which is leased to another client", got)
+	}
+}
+
+func TestBitmap(t *testing.T) {
+	var b bitmap
+	for _, i := range []int{0, 1, 2, 63, 64, 200} {
+		b.set(i)
+	}
+	for _, tc := range []struct{ from, to, want int }{
+		{0, 10, 3},
+		{63, 70, 65},
+		{64, 65, -1},
+		{200, 201, -1},
+		{200, 300, 201},
+		{1000, 1001, 1000},
+	} {
+		if got := b.nextClear(tc.from, tc.to); got != tc.want {
+			t.Errorf("nextClear(%d, %d) = %d, want %d", tc.from, tc.to, got, tc.want)
+		}
+	}
+	b.clear(64)
+	if b.has(64) || !b.has(63) {
+		t.Errorf("clear(64) left the wrong bits set")
+	}
+	for _, tc := range []struct{ from, to, want int }{
+		{3, 70, 63},
+		{64, 200, -1},
+		{64, 201, 200},
+		{201, 1000, -1},
+	} {
+		if got := b.nextSet(tc.from, tc.to); got != tc.want {
+			t.Errorf("nextSet(%d, %d) = %d, want %d", tc.from, tc.to, got, tc.want)
+		}
+	}
+}
+
+func TestLargePool(t *testing.T) {
+	iface := &net.Interface{
+		HardwareAddr: net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66},
+	}
+	const size = 1<<16 - 3
+	handler, err := NewHandler(iface, net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), net.IP{255, 255, 0, 0}, size, 20*time.Minute, nil, nil, WithConn(&noopSink{}), WithAllocation(AllocateSequential))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	handler.timeNow = func() time.Time { return now }
+
+	// Fill all but one address, with one lease expired.
+	leases := make([]*Lease, 0, size)
+	for i := 0; i < size; i++ {
+		if i == 40000 {
+			continue
+		}
+		l := &Lease{
+			Addr:         dhcp4.IPAdd(net.IPv4(10, 0, 0, 2), i),
+			HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, byte(i >> 8), byte(i)}.String(),
+			Expiry:       now.Add(time.Hour),
+		}
+		if i == 50000 {
+			l.Expiry = now.Add(-time.Hour)
+		}
+		leases = append(leases, l)
+	}
+	handler.SetLeases(leases)
+
+	want := handler.offset(dhcp4.IPAdd(net.IPv4(10, 0, 0, 2), 40000))
+	if got := handler.findLease(handler.pool); got != want {
+		t.Fatalf("findLease = %d, want the free address %d", got, want)
+	}
+	handler.SetLeases(append(leases, &Lease{
+		Addr:         dhcp4.IPAdd(net.IPv4(10, 0, 0, 2), 40000),
+		HardwareAddr: "02:00:00:01:00:00",
+		Expiry:       now.Add(time.Hour),
+	}))
+	want = handler.offset(dhcp4.IPAdd(net.IPv4(10, 0, 0, 2), 50000))
+	if got := handler.findLease(handler.pool); got != want {
+		t.Fatalf("findLease = %d, want the expired lease %d", got, want)
+	}
+
+	// Once its client renews it, the pool is full.
+	p := request(leases[49999].Addr, net.HardwareAddr{0x02, 0, 0, 0, 50000 >> 8, 50000 & 0xff})
+	if reply := handler.serveDHCP(p, dhcp4.Request, p.ParseOptions()); messageType(reply) != dhcp4.ACK {
+		t.Fatal("renewal of the expired lease was not acknowledged")
+	}
+	if got := handler.findLease(handler.pool); got != -1 {
+		t.Fatalf("findLease = %d after renewal, want -1", got)
+	}
+
+	handler.DeleteLease(leases[0].HardwareAddr)
+	if got, want := handler.findLease(handler.pool), leases[0].Num; got != want {
+		t.Errorf("findLease = %d, want the deleted lease %d", got, want)
+	}
+}
+
+func TestPermanentStaticLease(t *testing.T) {
+	iface := &net.Interface{
+		HardwareAddr: net.HardwareAddr([]byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}),
+	}
+	serverIP := net.IPv4(192, 168, 42, 1)
+	startIP := net.IPv4(192, 168, 42, 2)
+
+	var (
+		staticAddr = net.IP{192, 168, 42, 50}
+		static     = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0x00, 0x00, 0x01}
+	)
+	staticLeases := []StaticLease{
+		{Addr: staticAddr, HardwareAddr: static.String(), Permanent: true},
+	}
+	handler, err := NewHandler(iface, serverIP, startIP, net.IP{255, 255, 255, 0}, 230, 20*time.Minute, []string{"1.1.1.1"}, staticLeases, WithConn(&noopSink{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	handler.timeNow = func() time.Time { return now }
+
+	for _, tc := range []struct {
+		mt dhcp4.MessageType
+		p  dhcp4.Packet
+	}{
+		{dhcp4.Discover, discover(net.IPv4zero, static)},
+		{dhcp4.Request, request(staticAddr, static)},
+	} {
+		resp := handler.serveDHCP(tc.p, tc.mt, tc.p.ParseOptions())
+		opts := resp.ParseOptions()
+		if got, want := binary.BigEndian.Uint32(opts[dhcp4.OptionIPAddressLeaseTime]), uint32(math.MaxUint32); got != want {
+			t.Errorf("%v lease time: got %d, want infinite", messageType(resp), got)
+		}
+	}
+
+	now = now.Add(365 * 24 * time.Hour)
+	if n := handler.ReapExpired(0); n != 0 {
+		t.Errorf("ReapExpired reaped %d leases, want the permanent lease kept", n)
+	}
+	l, ok := handler.Lease(static.String())
+	if !ok || l.Expired(now) {
+		t.Errorf("permanent lease expired")
+	}
+}
+
+func TestPromotePermanent(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+	now := time.Now()
+	handler.timeNow = func() time.Time { return now }
+
+	hardwareAddr := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	addr := net.IP{192, 168, 42, 23}
+	p := request(addr, hardwareAddr)
+	handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+
+	sl, err := handler.PromoteLease(hardwareAddr.String(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sl.Permanent {
+		t.Errorf("promoted static lease is not permanent")
+	}
+	now = now.Add(time.Hour)
+	if l, ok := handler.Lease(hardwareAddr.String()); !ok || l.Expired(now) {
+		t.Errorf("promoted lease expired")
+	}
+}
+
+func TestMinSecs(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+	handler.minSecs = 5
+
+	p := discover(net.IPv4zero, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff})
+	p.SetSecs([]byte{0, 4})
+	if resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions()); resp != nil {
+		t.Errorf("DHCPDISCOVER after 4s answered, want it left to the primary server")
+	}
+	p.SetSecs([]byte{0, 5})
+	if resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions()); resp == nil || messageType(resp) != dhcp4.Offer {
+		t.Errorf("DHCPDISCOVER after 5s not answered")
+	}
+}
+
+func TestReplyDest(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	var (
+		hw        = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+		addr      = net.IP{192, 168, 42, 23}
+		broadcast = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	)
+	renew := request(addr, hw)
+	renew.SetCIAddr(addr)
+	flagged := discover(net.IPv4zero, hw)
+	flagged.SetBroadcast(true)
+	for _, tc := range []struct {
+		name            string
+		p               dhcp4.Packet
+		mt              dhcp4.MessageType
+		alwaysBroadcast bool
+		wantMAC         net.HardwareAddr
+		wantIP          net.IP
+	}{
+		{"offer", discover(net.IPv4zero, hw), dhcp4.Offer, false, hw, addr},
+		{"broadcast flag", flagged, dhcp4.Offer, false, broadcast, net.IPv4bcast},
+		{"renewal", renew, dhcp4.ACK, false, hw, addr},
+		{"nak", renew, dhcp4.NAK, false, broadcast, net.IPv4bcast},
+		{"always broadcast", discover(net.IPv4zero, hw), dhcp4.Offer, true, broadcast, net.IPv4bcast},
+	} {
+		handler.alwaysBroadcast = tc.alwaysBroadcast
+		reply := dhcp4.ReplyPacket(tc.p, tc.mt, handler.serverIP, addr, time.Minute, nil)
+		mac, ip := handler.replyDest(tc.p, reply)
+		if !bytes.Equal(mac, tc.wantMAC) || !ip.Equal(tc.wantIP) {
+			t.Errorf("%s: sent to %v %v, want %v %v", tc.name, mac, ip, tc.wantMAC, tc.wantIP)
+		}
+	}
+}
+
+func TestReplyAddr(t *testing.T) {
+	iface := &net.Interface{HardwareAddr: net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}}
+	handler, err := NewHandler(iface, net.IP{192, 168, 42, 1}, net.IP{192, 168, 42, 2}, net.IP{255, 255, 255, 0}, 230, 20*time.Minute, nil, nil, WithUDP())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		hw   = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+		addr = net.IP{192, 168, 42, 23}
+	)
+	renew := request(addr, hw)
+	renew.SetCIAddr(addr)
+	relayed := discover(net.IPv4zero, hw)
+	relayed.SetGIAddr(net.IP{10, 0, 0, 1})
+	for _, tc := range []struct {
+		name            string
+		p               dhcp4.Packet
+		mt              dhcp4.MessageType
+		alwaysBroadcast bool
+		want            string
+	}{
+		{"offer", discover(net.IPv4zero, hw), dhcp4.Offer, false, "255.255.255.255:68"},
+		{"renewal", renew, dhcp4.ACK, false, "192.168.42.23:68"},
+		{"nak", renew, dhcp4.NAK, false, "255.255.255.255:68"},
+		{"always broadcast", renew, dhcp4.ACK, true, "255.255.255.255:68"},
+		{"relayed", relayed, dhcp4.Offer, false, "10.0.0.1:67"},
+	} {
+		handler.alwaysBroadcast = tc.alwaysBroadcast
+		reply := dhcp4.ReplyPacket(tc.p, tc.mt, handler.serverIP, addr, time.Minute, nil)
+		if got := handler.ReplyAddr(tc.p, reply).String(); got != tc.want {
+			t.Errorf("%s: sent to %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+// writeSink records the frames written to it.
+type writeSink struct {
+	noopSink
+	frames [][]byte
+}
+
+func (c *writeSink) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.frames = append(c.frames, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+// tagged returns frame with an 802.1Q tag for vlan.
+func tagged(vlan int, frame []byte) []byte {
+	tag := []byte{0x81, 0x00, byte(vlan >> 8), byte(vlan)}
+	return slices.Concat(frame[:12], tag, frame[12:])
+}
+
+func TestServeVLANs(t *testing.T) {
+	iface := &net.Interface{HardwareAddr: net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}}
+	var sink writeSink
+	handler, err := NewHandler(iface, net.IP{10, 100, 0, 1}, net.IP{10, 100, 0, 10}, net.IP{255, 255, 255, 0}, 10, 20*time.Minute, nil, nil, WithConn(&sink), WithVLAN(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := discover(net.IPv4zero, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff})
+	conn := &frameConn{frames: [][]byte{
+		udpFrame(68, 67, p),
+		tagged(200, udpFrame(68, 67, p)),
+		tagged(100, udpFrame(68, 67, p)),
+	}}
+	if err := ServeVLANs(conn, map[int]*Handler{100: handler}); err != io.EOF {
+		t.Fatalf("ServeVLANs = %v, want io.EOF", err)
+	}
+	if got, want := len(sink.frames), 1; got != want {
+		t.Fatalf("%d replies sent, want %d for VLAN 100 only", got, want)
+	}
+	reply := sink.frames[0]
+	if got, want := reply[12:16], []byte{0x81, 0x00, 0, 100}; !bytes.Equal(got, want) {
+		t.Errorf("reply tag = %x, want %x", got, want)
+	}
+}
+
+func TestUDP(t *testing.T) {
+	iface := &net.Interface{HardwareAddr: net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}}
+	handler, err := NewHandler(iface, net.IP{192, 168, 42, 1}, net.IP{192, 168, 42, 2}, net.IP{255, 255, 255, 0}, 230, 20*time.Minute, nil, nil, WithUDP())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := discover(net.IPv4zero, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff})
+	reply := handler.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if reply == nil || messageType(reply) != dhcp4.Offer {
+		t.Fatalf("ServeDHCP did not return the DHCPOFFER to send")
+	}
+	if err := handler.CheckConn(); err != nil {
+		t.Errorf("CheckConn = %v", err)
+	}
+	if err := handler.Wake(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}); err == nil {
+		t.Errorf("Wake without a packet socket unexpectedly succeeded")
+	}
+	if err := handler.Close(); err != nil {
+		t.Errorf("Close = %v", err)
+	}
+}
+
+func TestNetworkOptions(t *testing.T) {
+	iface := &net.Interface{
+		HardwareAddr: net.HardwareAddr([]byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}),
+	}
+	search, err := dhcp4.EncodeDomainSearch([]string{"lan.example.com", "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, dest, _ := net.ParseCIDR("10.8.0.0/16")
+	routes := dhcp4.EncodeClasslessRoutes([]dhcp4.Route{{Dest: dest, Router: net.IP{192, 168, 42, 254}}})
+	handler, err := NewHandler(iface, net.IPv4(192, 168, 42, 1), net.IPv4(192, 168, 42, 2), net.IP{255, 255, 255, 0}, 230, 20*time.Minute, []string{"1.1.1.1"}, nil,
+		WithConn(&noopSink{}),
+		WithNetworkOptions(dhcp4.Options{
+			dhcp4.OptionDomainSearch:         search,
+			dhcp4.OptionClasslessRouteFormat: routes,
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prl := dhcp4.Option{
+		Code:  dhcp4.OptionParameterRequestList,
+		Value: []byte{byte(dhcp4.OptionSubnetMask), byte(dhcp4.OptionClasslessRouteFormat), byte(dhcp4.OptionDomainSearch)},
+	}
+	p := discover(net.IPv4zero, net.HardwareAddr{0x22, 0x22, 0x33, 0x44, 0x55, 0x66}, prl)
+	opts := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions()).ParseOptions()
+	domains, err := dhcp4.DecodeDomainSearch(opts[dhcp4.OptionDomainSearch])
+	if err != nil || !slices.Equal(domains, []string{"lan.example.com", "example.com"}) {
+		t.Errorf("domain search = %q, %v", domains, err)
+	}
+	got, err := dhcp4.DecodeClasslessRoutes(opts[dhcp4.OptionClasslessRouteFormat])
+	if err != nil || len(got) != 1 || got[0].Dest.String() != "10.8.0.0/16" || !got[0].Router.Equal(net.IP{192, 168, 42, 254}) {
+		t.Errorf("classless routes = %v, %v", got, err)
+	}
+
+	// Options the client did not ask for are not sent.
+	p = discover(net.IPv4zero, net.HardwareAddr{0x22, 0x22, 0x33, 0x44, 0x55, 0x67}, dhcp4.Option{
+		Code:  dhcp4.OptionParameterRequestList,
+		Value: []byte{byte(dhcp4.OptionSubnetMask)},
+	})
+	opts = handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions()).ParseOptions()
+	if _, ok := opts[dhcp4.OptionDomainSearch]; ok {
+		t.Errorf("domain search sent without being requested")
+	}
+}
+
+// lastOption returns the code of the last option of p.
+func lastOption(p dhcp4.Packet) dhcp4.OptionCode {
+	var last dhcp4.OptionCode
+	for b := p.Options(); len(b) >= 2 && dhcp4.OptionCode(b[0]) != dhcp4.End; b = b[2+int(b[1]):] {
+		last = dhcp4.OptionCode(b[0])
+	}
+	return last
+}
+
+func TestRelayAgentInfo(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+	info := dhcp4.EncodeRelayAgentInfo(map[byte][]byte{
+		dhcp4.AgentCircuitID: []byte("ge-0/0/12"),
+		dhcp4.AgentRemoteID:  {0x00, 0x1b, 0x21, 0x3c, 0x4d, 0x5e},
+	})
+	relayed := func(p dhcp4.Packet) dhcp4.Packet {
+		p.SetGIAddr(net.IP{10, 0, 0, 1})
+		return p
+	}
+	hw := net.HardwareAddr{0x22, 0x22, 0x33, 0x44, 0x55, 0x66}
+	agent := dhcp4.Option{Code: dhcp4.OptionRelayAgentInformation, Value: info}
+
+	for _, tt := range []struct {
+		name string
+		p    dhcp4.Packet
+		want dhcp4.MessageType
+	}{
+		{"offer", relayed(discover(net.IPv4zero, hw, agent)), dhcp4.Offer},
+		{"nak", relayed(request(net.IP{10, 0, 0, 9}, hw, agent)), dhcp4.NAK},
+	} {
+		mt := dhcp4.MessageType(tt.p.ParseOptions()[dhcp4.OptionDHCPMessageType][0])
+		resp := handler.serveDHCP(tt.p, mt, tt.p.ParseOptions())
+		if got := messageType(resp); got != tt.want {
+			t.Fatalf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		if got := resp.ParseOptions()[dhcp4.OptionRelayAgentInformation]; !bytes.Equal(got, info) {
+			t.Errorf("%s: relay agent information %x, want %x", tt.name, got, info)
+		}
+		if got := lastOption(resp); got != dhcp4.OptionRelayAgentInformation {
+			t.Errorf("%s: last option %v, want the relay agent information", tt.name, got)
+		}
+	}
+
+	if attrs := relayAgentAttrs(info); fmt.Sprint(attrs) != "[circuit_id ge-0/0/12 remote_id 001b213c4d5e]" {
+		t.Errorf("relayAgentAttrs = %v", attrs)
+	}
+}
@@ -0,0 +1,52 @@
+package dhcp4d
+
+import "sort"
+
+// LeaseState is a lease table entry together with the handler's
+// bookkeeping about it, for debugging.
+type LeaseState struct {
+	Lease
+	Static   bool // the client has a static lease
+	Reserved bool // the offset is reserved for a static lease
+	Revoked  bool // the client will be NAKed on its next request
+	Indexed  bool // the hardware address index points at this entry
+	Dangling bool // the hardware address index points at a missing entry
+}
+
+// DumpLeases returns the handler's lease table, ordered by offset,
+// followed by any hardware address index entries without a lease.
+func (h *Handler) DumpLeases() []LeaseState {
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+
+	states := make([]LeaseState, 0, len(h.leasesIP))
+	for num, l := range h.leasesIP {
+		_, static := h.staticLeases[l.HardwareAddr]
+		_, reserved := h.reservedOffsets[num]
+		idx, indexed := h.leasesHW[l.HardwareAddr]
+		states = append(states, LeaseState{
+			Lease:    *l,
+			Static:   static,
+			Reserved: reserved,
+			Revoked:  h.revoked[l.HardwareAddr],
+			Indexed:  indexed && idx == num,
+		})
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Num < states[j].Num
+	})
+
+	var dangling []LeaseState
+	for hw, num := range h.leasesHW {
+		if _, ok := h.leasesIP[num]; !ok {
+			dangling = append(dangling, LeaseState{
+				Lease:    Lease{Num: num, HardwareAddr: hw},
+				Dangling: true,
+			})
+		}
+	}
+	sort.Slice(dangling, func(i, j int) bool {
+		return dangling[i].HardwareAddr < dangling[j].HardwareAddr
+	})
+	return append(states, dangling...)
+}
@@ -0,0 +1,50 @@
+package dhcp4d
+
+import (
+	"net"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
+)
+
+// EventType is the kind of change an Event describes.
+type EventType string
+
+const (
+	EventOffer   EventType = "offer"   // an address was offered; the lease is not stored
+	EventAdd     EventType = "add"     // a client was given a new lease
+	EventOld     EventType = "old"     // an existing lease was renewed
+	EventRelease EventType = "release" // the client released or declined the lease, or moved to another address
+	EventExpire  EventType = "expire"  // the lease expired, was revoked, or was replaced before it expired
+	EventNAK     EventType = "nak"     // a request was refused; the lease is not stored
+	EventFlap    EventType = "flap"    // the client is cycling through requests, declines and releases
+
+	// Pool events carry the pool statistics in Event.Pool.
+	EventPoolWarning   EventType = "pool_warning"   // utilization crossed the warning threshold
+	EventPoolExhausted EventType = "pool_exhausted" // no address was available for the client
+)
+
+// Event describes a change to a single lease.
+type Event struct {
+	Type  EventType
+	Lease Lease
+	Pool  *Stats // set for pool events
+}
+
+func (h *Handler) eventLocked(t EventType, l *Lease) {
+	if h.Events == nil {
+		return
+	}
+	h.Events(Event{Type: t, Lease: *l})
+}
+
+// nak emits EventNAK for the refused request and returns the NAK reply.
+func (h *Handler) nak(p dhcp4.Packet, reqIP net.IP, options dhcp4.Options) dhcp4.Packet {
+	h.leasesMu.Lock()
+	h.eventLocked(EventNAK, &Lease{
+		Addr:         append(net.IP(nil), reqIP.To4()...),
+		HardwareAddr: p.CHAddr().String(),
+		Hostname:     string(options[dhcp4.OptionHostName]),
+	})
+	h.leasesMu.Unlock()
+	return dhcp4.ReplyPacket(p, dhcp4.NAK, h.serverIP, nil, 0, nil)
+}
@@ -0,0 +1,85 @@
+package dhcp4d
+
+import (
+	"container/heap"
+	"time"
+)
+
+// expiryQueue is a min-heap of lease expiry times. Entries are not removed
+// when their lease is renewed or removed, but skipped once they no longer
+// match it.
+type expiryQueue []expiryEntry
+
+type expiryEntry struct {
+	at  time.Time
+	num int
+}
+
+func (q expiryQueue) Len() int           { return len(q) }
+func (q expiryQueue) Less(i, j int) bool { return q[i].at.Before(q[j].at) }
+func (q expiryQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *expiryQueue) Push(x any)        { *q = append(*q, x.(expiryEntry)) }
+
+func (q *expiryQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+// putLocked stores l as lease number num and queues its expiry.
+func (h *Handler) putLocked(num int, l *Lease) {
+	h.leasesIP[num] = l
+	h.used.set(num)
+	if !l.Expiry.IsZero() {
+		heap.Push(&h.expiries, expiryEntry{at: l.Expiry, num: num})
+	}
+}
+
+// ExpireLeases emits an EventExpire for every lease that expired since the
+// last call, as most clients never release their leases.
+func (h *Handler) ExpireLeases() {
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	h.expireLocked(h.timeNow())
+}
+
+// expireLocked adds the leases that expired by now to h.expired and
+// announces them. Afterwards every expired lease has been announced with an
+// EventExpire, or an EventRelease if it was released.
+func (h *Handler) expireLocked(now time.Time) {
+	for len(h.expiries) > 0 && now.After(h.expiries[0].at) {
+		e := heap.Pop(&h.expiries).(expiryEntry)
+		l, ok := h.leasesIP[e.num]
+		if !ok || !l.Expiry.Equal(e.at) {
+			continue
+		}
+		h.expired.set(e.num)
+		if !l.Unknown {
+			h.eventLocked(EventExpire, l)
+		}
+	}
+}
+
+// removeLocked emits an EventExpire for l, which is being removed or
+// replaced, unless its expiry was announced already.
+func (h *Handler) removeLocked(l *Lease, now time.Time) {
+	h.expireLocked(now)
+	if !l.Expired(now) {
+		h.eventLocked(EventExpire, l)
+	}
+}
+
+// nextExpiredLocked returns the lowest number in [from, to) of an expired
+// lease, or -1. Numbers whose lease was renewed or removed since it expired
+// are dropped from h.expired on the way.
+func (h *Handler) nextExpiredLocked(from, to int, now time.Time) int {
+	h.expireLocked(now)
+	for i := h.expired.nextSet(from, to); i >= 0; i = h.expired.nextSet(i+1, to) {
+		if l, ok := h.leasesIP[i]; ok && l.Expired(now) {
+			return i
+		}
+		h.expired.clear(i)
+	}
+	return -1
+}
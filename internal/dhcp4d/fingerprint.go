@@ -0,0 +1,51 @@
+package dhcp4d
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
+)
+
+// Fingerprint describes how a client's DHCP stack behaves, which is often
+// enough to tell what kind of device it is.
+type Fingerprint struct {
+	// ParameterRequestList is option 55 as comma separated decimal codes,
+	// in the format used by fingerbank.
+	ParameterRequestList string `json:"prl,omitempty"`
+	VendorClass          string `json:"vendor_class,omitempty"`
+	// OptionOrder lists the option codes in the order the client sent them.
+	OptionOrder string `json:"option_order,omitempty"`
+}
+
+func joinCodes(codes []byte) string {
+	s := make([]string, len(codes))
+	for i, c := range codes {
+		s[i] = strconv.Itoa(int(c))
+	}
+	return strings.Join(s, ",")
+}
+
+func fingerprint(p dhcp4.Packet, options dhcp4.Options) Fingerprint {
+	var order []byte
+	if len(p) > 240 {
+		opts := p.Options()
+		for len(opts) >= 2 && dhcp4.OptionCode(opts[0]) != dhcp4.End {
+			if dhcp4.OptionCode(opts[0]) == dhcp4.Pad {
+				opts = opts[1:]
+				continue
+			}
+			size := int(opts[1])
+			if len(opts) < 2+size {
+				break
+			}
+			order = append(order, opts[0])
+			opts = opts[2+size:]
+		}
+	}
+	return Fingerprint{
+		ParameterRequestList: joinCodes(options[dhcp4.OptionParameterRequestList]),
+		VendorClass:          string(options[dhcp4.OptionVendorClassIdentifier]),
+		OptionOrder:          joinCodes(order),
+	}
+}
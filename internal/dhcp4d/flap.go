@@ -0,0 +1,71 @@
+package dhcp4d
+
+import (
+	"log/slog"
+	"time"
+)
+
+// FlapDetection raises EventFlap when a client sends more than Threshold
+// requests, declines and releases within Window.
+type FlapDetection struct {
+	Threshold int
+	Window    time.Duration
+}
+
+type flapState struct {
+	times   []time.Time
+	alarmed bool
+}
+
+// recordFlap notes a request, decline or release from hwAddr and emits
+// EventFlap once when the client crosses the threshold. The alarm is
+// re-armed once the client has calmed down.
+func (h *Handler) recordFlap(hwAddr string, log *slog.Logger) {
+	if h.flap == nil {
+		return
+	}
+	now := h.timeNow()
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+
+	st := h.flaps[hwAddr]
+	if st == nil {
+		st = &flapState{}
+		h.flaps[hwAddr] = st
+	}
+	cutoff := now.Add(-h.flap.Window)
+	i := 0
+	for i < len(st.times) && !st.times[i].After(cutoff) {
+		i++
+	}
+	st.times = append(st.times[i:], now)
+	if len(st.times) <= h.flap.Threshold {
+		st.alarmed = false
+		h.pruneFlapsLocked(cutoff)
+		return
+	}
+	if st.alarmed {
+		return
+	}
+	st.alarmed = true
+	log.Warn("client is flapping", "count", len(st.times), "window", h.flap.Window)
+	h.metrics.Error("flapping")
+	l, ok := h.leaseHWLocked(hwAddr)
+	if !ok {
+		l = &Lease{HardwareAddr: hwAddr}
+	}
+	h.eventLocked(EventFlap, l)
+}
+
+// pruneFlapsLocked forgets clients without activity since cutoff, so the
+// table does not grow without bound.
+func (h *Handler) pruneFlapsLocked(cutoff time.Time) {
+	if len(h.flaps) < 1024 {
+		return
+	}
+	for hw, st := range h.flaps {
+		if len(st.times) == 0 || !st.times[len(st.times)-1].After(cutoff) {
+			delete(h.flaps, hw)
+		}
+	}
+}
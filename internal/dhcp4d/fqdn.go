@@ -0,0 +1,131 @@
+package dhcp4d
+
+import (
+	"strings"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
+)
+
+// optionClientFQDN is the Client FQDN option (RFC 4702).
+const optionClientFQDN dhcp4.OptionCode = 81
+
+// Flags of the Client FQDN option.
+const (
+	fqdnS = 0x01 // the server updates the A record
+	fqdnO = 0x02 // the server overrode the client's S flag
+	fqdnE = 0x04 // the name is in DNS wire format
+	fqdnN = 0x08 // the server updates no records
+)
+
+// Values of Lease.DNSUpdate. By default the server updates both the A and
+// the PTR record.
+const (
+	DNSUpdateClient = "client" // the client updates its A record
+	DNSUpdateNone   = "none"   // the client asked for no updates
+)
+
+// FQDNPolicy is how a handler answers the Client FQDN option.
+type FQDNPolicy int
+
+const (
+	// FQDNHonor follows the client's flags: clients that update their
+	// own A record leave only the PTR record to the server, and clients
+	// may ask for no updates at all.
+	FQDNHonor FQDNPolicy = iota
+	// FQDNServer has the server update both records regardless of the
+	// client's flags.
+	FQDNServer
+	// FQDNIgnore ignores the option.
+	FQDNIgnore
+)
+
+// clientFQDN is a Client FQDN option and the server's answer to it.
+type clientFQDN struct {
+	name      string // fully qualified, without the trailing dot
+	encoded   bool   // the client used the DNS wire format
+	flags     byte   // as sent by the client
+	dnsUpdate string // see Lease.DNSUpdate
+}
+
+// clientFQDN parses the Client FQDN option of a request, completing partial
+// names with the domain name option of the reply.
+func (h *Handler) clientFQDN(options, reply dhcp4.Options) (clientFQDN, bool) {
+	b := options[optionClientFQDN]
+	if h.fqdnPolicy == FQDNIgnore || len(b) < 3 {
+		return clientFQDN{}, false
+	}
+	f := clientFQDN{flags: b[0], encoded: b[0]&fqdnE != 0}
+	var qualified bool
+	if f.encoded {
+		f.name, qualified = parseWireName(b[3:])
+	} else {
+		f.name = string(b[3:])
+		qualified = strings.HasSuffix(f.name, ".")
+	}
+	f.name = strings.ToLower(strings.TrimSuffix(f.name, "."))
+	if domain := strings.TrimSuffix(string(reply[dhcp4.OptionDomainName]), "."); !qualified && f.name != "" && domain != "" {
+		f.name += "." + strings.ToLower(domain)
+	}
+	if h.fqdnPolicy == FQDNHonor {
+		switch {
+		case f.flags&fqdnN != 0:
+			f.dnsUpdate = DNSUpdateNone
+		case f.flags&fqdnS == 0:
+			f.dnsUpdate = DNSUpdateClient
+		}
+	}
+	return f, true
+}
+
+// hostname returns the first label of the name.
+func (f clientFQDN) hostname() string {
+	host, _, _ := strings.Cut(f.name, ".")
+	return host
+}
+
+// option returns the option answering the client.
+func (f clientFQDN) option() dhcp4.Option {
+	var flags byte
+	switch f.dnsUpdate {
+	case DNSUpdateNone:
+		flags = fqdnN
+	case "":
+		flags = fqdnS
+	}
+	if flags&fqdnS != f.flags&fqdnS {
+		flags |= fqdnO
+	}
+	// RCODE1 and RCODE2 are deprecated and always 255 in replies.
+	v := []byte{flags, 255, 255}
+	if f.encoded {
+		v[0] |= fqdnE
+		for _, label := range strings.Split(f.name, ".") {
+			if label != "" && len(label) < 64 {
+				v = append(v, byte(len(label)))
+				v = append(v, label...)
+			}
+		}
+		v = append(v, 0)
+	} else {
+		v = append(v, f.name...)
+	}
+	return dhcp4.Option{Code: optionClientFQDN, Value: v}
+}
+
+// parseWireName parses an uncompressed name in DNS wire format and reports
+// whether it is fully qualified, i.e. ends with the root label.
+func parseWireName(b []byte) (string, bool) {
+	var labels []string
+	for len(b) > 0 {
+		n := int(b[0])
+		if n == 0 {
+			return strings.Join(labels, "."), true
+		}
+		if n > 63 || 1+n > len(b) {
+			break
+		}
+		labels = append(labels, string(b[1:1+n]))
+		b = b[1+n:]
+	}
+	return strings.Join(labels, "."), false
+}
@@ -0,0 +1,40 @@
+package dhcp4d
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// CheckConn returns an error if the handler's raw socket is no longer
+// usable.
+func (h *Handler) CheckConn() error {
+	if h.rawConn == nil {
+		return nil // replying over UDP
+	}
+	// Setting a deadline fails once the socket has been closed.
+	if err := h.rawConn.SetWriteDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("raw socket: %w", err)
+	}
+	return nil
+}
+
+// Close closes the handler's raw socket. The handler must not serve any
+// further messages.
+func (h *Handler) Close() error {
+	if h.rawConn == nil {
+		return nil
+	}
+	return h.rawConn.Close()
+}
+
+// Interface returns the interface the handler serves, as it was when the
+// handler was created.
+func (h *Handler) Interface() *net.Interface {
+	return h.iface
+}
+
+// ServerIP returns the handler's own address on the network.
+func (h *Handler) ServerIP() net.IP {
+	return h.serverIP
+}
@@ -0,0 +1,73 @@
+package dhcp4d
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SetHostname overrides the hostname of hwaddr, which must have a lease.
+// The override is kept across renewals and new leases until it is cleared
+// by setting an empty hostname, which reverts to the client's own name.
+func (h *Handler) SetHostname(hwaddr, hostname string) error {
+	hwaddr = strings.ToLower(hwaddr)
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	lease, ok := h.leaseHWLocked(hwaddr)
+	if !ok {
+		return fmt.Errorf("hwaddr %v does not have a lease", hwaddr)
+	}
+	if hostname == "" {
+		delete(h.hostnameOverrides, hwaddr)
+		lease.Hostname = lease.ClientHostname
+	} else {
+		h.hostnameOverrides[hwaddr] = hostname
+		lease.Hostname = hostname
+	}
+	lease.HostnameOverride = hostname
+	h.callLeasesLocked(lease)
+	h.callHostnameOverridesLocked()
+	return nil
+}
+
+// FillHostname sets the hostname of the lease of hwaddr if it has none, such
+// as once a lookup started by HostnameFallback completes. It reports whether
+// the lease was named.
+func (h *Handler) FillHostname(hwaddr, hostname string) bool {
+	hwaddr = strings.ToLower(hwaddr)
+	if h.sanitizeHostnames {
+		hostname = sanitizeHostname(hostname)
+	}
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	lease, ok := h.leaseHWLocked(hwaddr)
+	if !ok || lease.Hostname != "" || hostname == "" {
+		return false
+	}
+	lease.Hostname = hostname
+	lease.Hostname = h.uniqueHostnameLocked(lease, nil)
+	h.callLeasesLocked(lease)
+	return true
+}
+
+// SetHostnameOverrides overwrites the hostname overrides by hardware
+// address, typically loaded from persistent storage. It must be called
+// before SetLeases, which adds the overrides recorded on leases.
+func (h *Handler) SetHostnameOverrides(overrides map[string]string) {
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	h.hostnameOverrides = make(map[string]string, len(overrides))
+	for hw, name := range overrides {
+		h.hostnameOverrides[strings.ToLower(hw)] = name
+	}
+}
+
+func (h *Handler) callHostnameOverridesLocked() {
+	if h.HostnameOverrides == nil {
+		return
+	}
+	overrides := make(map[string]string, len(h.hostnameOverrides))
+	for hw, name := range h.hostnameOverrides {
+		overrides[hw] = name
+	}
+	h.HostnameOverrides(overrides)
+}
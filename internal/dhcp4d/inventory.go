@@ -0,0 +1,78 @@
+package dhcp4d
+
+import (
+	"net"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
+)
+
+// Neighbor is a device seen on the network, such as in the kernel's
+// neighbor table.
+type Neighbor struct {
+	Addr         net.IP
+	HardwareAddr net.HardwareAddr
+}
+
+// RecordNeighbors records the devices among neighbors that are on the
+// handler's network but never requested a lease, as unknown leases that
+// expire a lease period after the device was last seen. This keeps their
+// addresses from being handed out while they are in use and lists them with
+// the other leases. Clients with a lease or static lease, and addresses
+// leased to other clients, are ignored. A device that later requests a
+// lease loses its unknown flag. Leases is called if anything changed; no
+// events are emitted. It returns the number of newly recorded devices.
+func (h *Handler) RecordNeighbors(neighbors []Neighbor) int {
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	mask := net.IPMask(h.options[dhcp4.OptionSubnetMask])
+	now := h.timeNow()
+	var recorded int
+	changed := false
+	for _, n := range neighbors {
+		ip := n.Addr.To4()
+		hw := n.HardwareAddr.String()
+		if ip == nil || ip.Equal(h.serverIP) || !ip.Mask(mask).Equal(h.serverIP.Mask(mask)) {
+			continue
+		}
+		num := h.offset(ip)
+		if _, static := h.staticLeases[hw]; static || num < 0 {
+			continue
+		}
+		if _, reserved := h.reservedOffsets[num]; reserved {
+			continue
+		}
+		prev, hadLease := h.leaseHWLocked(hw)
+		if hadLease && !prev.Unknown {
+			continue
+		}
+		if other, ok := h.leasesIP[num]; ok && other.HardwareAddr != hw {
+			if !other.Expired(now) {
+				continue
+			}
+			if h.leasesHW[other.HardwareAddr] == num {
+				delete(h.leasesHW, other.HardwareAddr)
+			}
+		}
+		if hadLease && prev.Num != num {
+			delete(h.leasesIP, prev.Num)
+			h.used.clear(prev.Num)
+		}
+		if !hadLease || prev.Num != num {
+			recorded++
+		}
+		h.putLocked(num, &Lease{
+			Num:          num,
+			Addr:         ip,
+			HardwareAddr: hw,
+			Expiry:       now.Add(h.LeasePeriod),
+			Vendor:       h.vendor(hw),
+			Unknown:      true,
+		})
+		h.leasesHW[hw] = num
+		changed = true
+	}
+	if changed {
+		h.callLeasesLocked(nil)
+	}
+	return recorded
+}
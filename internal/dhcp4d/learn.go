@@ -0,0 +1,108 @@
+package dhcp4d
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
+)
+
+// Learn records the leases another DHCP server on the network hands out, as
+// seen in the DHCPACKs on the raw socket, until the socket is closed. It is
+// meant for handlers created WithLearning, to build up the lease database
+// before taking over from the other server. Only ACKs that are broadcast or
+// otherwise reach this host can be seen.
+func (h *Handler) Learn() error {
+	if h.rawConn == nil {
+		return errors.New("learning requires a packet socket")
+	}
+	// Hostnames and client identifiers of the requests being answered,
+	// by transaction ID.
+	requests := make(map[uint32]*Lease)
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := h.rawConn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		srcPort, dstPort, payload, ok := udp4Payload(buf[:n])
+		if !ok || len(payload) < 240 {
+			continue
+		}
+		p := dhcp4.Packet(payload)
+		options := p.ParseOptions()
+		t := options[dhcp4.OptionDHCPMessageType]
+		if len(t) != 1 {
+			continue
+		}
+		xid := binary.BigEndian.Uint32(p.XId())
+		switch {
+		case srcPort == 68 && dstPort == 67 && dhcp4.MessageType(t[0]) == dhcp4.Request:
+			if len(requests) >= 1024 {
+				clear(requests)
+			}
+			requests[xid] = &Lease{
+				HardwareAddr:   p.CHAddr().String(),
+				ClientHostname: string(options[dhcp4.OptionHostName]),
+				ClientID:       clientID(p.CHAddr(), options),
+			}
+		case srcPort == 67 && dstPort == 68 && dhcp4.MessageType(t[0]) == dhcp4.ACK:
+			req := requests[xid]
+			delete(requests, xid)
+			h.learnACK(p, options, req)
+		}
+	}
+}
+
+func (h *Handler) learnACK(p dhcp4.Packet, options dhcp4.Options, req *Lease) {
+	ip := net.IP(p.YIAddr()).To4()
+	mask := net.IPMask(h.options[dhcp4.OptionSubnetMask])
+	if ip.Equal(net.IPv4zero) || !ip.Mask(mask).Equal(h.serverIP.Mask(mask)) {
+		return // DHCPINFORM or another network
+	}
+	now := h.timeNow()
+	l := Lease{
+		Addr:         ip,
+		HardwareAddr: p.CHAddr().String(),
+		LastACK:      now,
+	}
+	if secs := options[dhcp4.OptionIPAddressLeaseTime]; len(secs) == 4 {
+		if v := binary.BigEndian.Uint32(secs); v != ^uint32(0) {
+			l.Expiry = now.Add(time.Duration(v) * time.Second)
+		}
+	}
+	if req != nil && req.HardwareAddr == l.HardwareAddr {
+		l.ClientHostname = req.ClientHostname
+		l.Hostname = req.ClientHostname
+		l.ClientID = req.ClientID
+	}
+	if name := options[dhcp4.OptionHostName]; len(name) > 0 {
+		l.Hostname = string(name)
+	}
+	h.txLogger(p).Info("learned lease", "ip", ip, "expiry", l.Expiry, "server", net.IP(options[dhcp4.OptionServerIdentifier]))
+	h.PutLease(l)
+}
+
+// udp4Payload returns the UDP ports and payload of an Ethernet frame carrying
+// an unfragmented IPv4 UDP datagram.
+func udp4Payload(frame []byte) (srcPort, dstPort uint16, payload []byte, ok bool) {
+	if len(frame) < 14 || binary.BigEndian.Uint16(frame[12:]) != 0x0800 {
+		return 0, 0, nil, false
+	}
+	ip := frame[14:]
+	if len(ip) < 20 || ip[0]>>4 != 4 || ip[9] != 17 {
+		return 0, 0, nil, false
+	}
+	if binary.BigEndian.Uint16(ip[6:])&0x3fff != 0 {
+		return 0, 0, nil, false // fragment
+	}
+	ihl := int(ip[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(ip[2:]))
+	if ihl < 20 || total < ihl+8 || total > len(ip) {
+		return 0, 0, nil, false
+	}
+	udp := ip[ihl:total]
+	return binary.BigEndian.Uint16(udp), binary.BigEndian.Uint16(udp[2:]), udp[8:], true
+}
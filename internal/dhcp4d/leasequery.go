@@ -0,0 +1,123 @@
+package dhcp4d
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
+)
+
+// Message types of RFC 4388 leasequery.
+const (
+	LeaseQuery      dhcp4.MessageType = 10
+	LeaseUnassigned dhcp4.MessageType = 11
+	LeaseUnknown    dhcp4.MessageType = 12
+	LeaseActive     dhcp4.MessageType = 13
+)
+
+const (
+	optionClientLastTransactionTime dhcp4.OptionCode = 91
+	optionAssociatedIP              dhcp4.OptionCode = 92
+)
+
+// AnswerLeaseQuery answers an RFC 4388 DHCPLEASEQUERY about the leases of
+// h. The query is by address (ciaddr), else by client identifier (option
+// 61), else by hardware address. It reports false if the query is about an
+// address outside h's network or a client h has no lease for, so that
+// another handler may answer it; see LeaseUnknownReply. Malformed queries
+// get a nil reply.
+func (h *Handler) AnswerLeaseQuery(p dhcp4.Packet, options dhcp4.Options) (dhcp4.Packet, bool) {
+	now := h.timeNow()
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+
+	if ip := net.IP(p.CIAddr()).To4(); !ip.Equal(net.IPv4zero) {
+		mask := net.IPMask(h.options[dhcp4.OptionSubnetMask])
+		if !ip.Mask(mask).Equal(h.serverIP.Mask(mask)) {
+			return nil, false
+		}
+		l, ok := h.leasesIP[h.offset(ip)]
+		if !ok || l.Expired(now) || !l.Addr.Equal(ip) {
+			reply := dhcp4.ReplyPacket(p, LeaseUnassigned, h.serverIP, nil, 0, nil)
+			reply.SetCIAddr(ip)
+			return reply, true
+		}
+		return h.leaseActiveReply(p, l, []*Lease{l}, now), true
+	}
+
+	var match func(*Lease) bool
+	if id := options[dhcp4.OptionClientIdentifier]; len(id) > 0 {
+		hexID := hex.EncodeToString(id)
+		match = func(l *Lease) bool {
+			if l.ClientID != "" {
+				return l.ClientID == hexID
+			}
+			// Identifiers derived from the hardware address are not
+			// stored.
+			hw, err := net.ParseMAC(l.HardwareAddr)
+			return err == nil && id[0] == 1 && bytes.Equal(id[1:], hw)
+		}
+	} else if hw := p.CHAddr(); len(hw) > 0 && !bytes.Equal(hw, make([]byte, len(hw))) {
+		match = func(l *Lease) bool { return l.HardwareAddr == hw.String() }
+	} else {
+		return nil, true
+	}
+
+	var leases []*Lease
+	for _, l := range h.leasesIP {
+		if !l.Expired(now) && match(l) {
+			leases = append(leases, l)
+		}
+	}
+	if len(leases) == 0 {
+		return nil, false
+	}
+	// The most recently renewed lease is reported, the others as
+	// associated addresses.
+	sort.Slice(leases, func(i, j int) bool { return leases[i].LastACK.After(leases[j].LastACK) })
+	return h.leaseActiveReply(p, leases[0], leases, now), true
+}
+
+func (h *Handler) leaseActiveReply(p dhcp4.Packet, l *Lease, all []*Lease, now time.Time) dhcp4.Packet {
+	remaining := uint32(math.MaxUint32)
+	if !l.Expiry.IsZero() {
+		remaining = uint32(l.Expiry.Sub(now) / time.Second)
+	}
+	options := []dhcp4.Option{
+		{Code: dhcp4.OptionIPAddressLeaseTime, Value: binary.BigEndian.AppendUint32(nil, remaining)},
+	}
+	if !l.LastACK.IsZero() {
+		options = append(options, dhcp4.Option{
+			Code:  optionClientLastTransactionTime,
+			Value: binary.BigEndian.AppendUint32(nil, uint32(max(now.Sub(l.LastACK), 0)/time.Second)),
+		})
+	}
+	if id, err := hex.DecodeString(l.ClientID); err == nil && len(id) > 0 {
+		options = append(options, dhcp4.Option{Code: dhcp4.OptionClientIdentifier, Value: id})
+	}
+	if len(all) > 1 {
+		var ips []byte
+		for _, a := range all {
+			ips = append(ips, a.Addr.To4()...)
+		}
+		options = append(options, dhcp4.Option{Code: optionAssociatedIP, Value: ips})
+	}
+	reply := dhcp4.ReplyPacket(p, LeaseActive, h.serverIP, nil, 0, options)
+	reply.SetCIAddr(l.Addr)
+	if hw, err := net.ParseMAC(l.HardwareAddr); err == nil {
+		reply.SetHType(1)
+		reply.SetCHAddr(hw)
+	}
+	return reply
+}
+
+// LeaseUnknownReply returns the DHCPLEASEUNKNOWN answer to a leasequery that
+// no handler knows about.
+func LeaseUnknownReply(p dhcp4.Packet, serverIP net.IP) dhcp4.Packet {
+	return dhcp4.ReplyPacket(p, LeaseUnknown, serverIP.To4(), nil, 0, nil)
+}
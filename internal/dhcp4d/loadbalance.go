@@ -0,0 +1,89 @@
+package dhcp4d
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
+)
+
+// LoadBalancing restricts the handler to the clients whose RFC 3074 hash
+// bucket is within [First, Last] (0-255), so that two servers with
+// separate pools can share a network, each answering its share of the
+// clients. Clients that have been trying for at least SecsThreshold
+// seconds (per the secs field) are answered regardless, in case the other
+// server is down. A zero SecsThreshold disables this.
+type LoadBalancing struct {
+	First, Last   int
+	SecsThreshold int
+}
+
+// loadBalanceMixTable is the permutation of RFC 3074 section 6.
+var loadBalanceMixTable = [256]byte{
+	251, 175, 119, 215, 81, 14, 79, 191, 103, 49, 181, 143, 186, 157, 0,
+	232, 31, 32, 55, 60, 152, 58, 17, 237, 174, 70, 160, 144, 220, 90, 57,
+	223, 59, 3, 18, 140, 111, 166, 203, 196, 134, 243, 124, 95, 222, 179,
+	197, 65, 180, 48, 36, 15, 107, 46, 233, 130, 165, 30, 123, 161, 209, 23,
+	97, 16, 40, 91, 219, 61, 100, 10, 210, 109, 250, 127, 22, 138, 29, 108,
+	244, 67, 207, 9, 178, 204, 74, 98, 126, 249, 167, 116, 34, 77, 193,
+	200, 121, 5, 20, 113, 71, 35, 128, 13, 182, 94, 25, 226, 227, 199, 75,
+	27, 41, 245, 230, 224, 43, 225, 177, 26, 155, 150, 212, 142, 218, 115,
+	241, 73, 88, 105, 39, 114, 62, 255, 192, 201, 145, 214, 168, 158, 221,
+	148, 154, 122, 12, 84, 82, 163, 44, 139, 228, 236, 205, 242, 217, 11,
+	187, 146, 159, 64, 86, 239, 195, 42, 106, 198, 118, 112, 184, 172, 87,
+	2, 173, 117, 176, 229, 247, 253, 137, 185, 99, 164, 102, 147, 45, 66,
+	231, 52, 141, 211, 194, 206, 246, 238, 56, 110, 78, 248, 63, 240, 189,
+	93, 92, 51, 53, 183, 19, 171, 72, 50, 33, 104, 101, 69, 8, 252, 83, 120,
+	76, 135, 85, 54, 202, 125, 188, 213, 96, 235, 136, 208, 162, 129, 190,
+	132, 156, 38, 47, 1, 7, 254, 24, 4, 216, 131, 89, 21, 28, 133, 37, 153,
+	149, 80, 170, 68, 6, 169, 234, 151,
+}
+
+// loadBalanceHash returns the RFC 3074 hash bucket of key.
+func loadBalanceHash(key []byte) int {
+	hash := byte(len(key))
+	for i := len(key) - 1; i >= 0; i-- {
+		hash = loadBalanceMixTable[hash^key[i]]
+	}
+	return int(hash)
+}
+
+// loadBalanceKey returns what a client is hashed by: its client identifier
+// if it sent one, else its hardware address.
+func loadBalanceKey(hwAddr net.HardwareAddr, options dhcp4.Options) []byte {
+	if id := options[dhcp4.OptionClientIdentifier]; len(id) > 0 {
+		return id
+	}
+	return hwAddr
+}
+
+// loadBalanced reports whether a message of msgType from a client is left
+// to the other server. Only messages that any server may answer are
+// balanced: DHCPDISCOVERs and DHCPREQUESTs in the INIT-REBOOT state.
+// Requests selecting a server or renewing a lease go to that server.
+func (h *Handler) loadBalanced(p dhcp4.Packet, msgType dhcp4.MessageType, options dhcp4.Options) bool {
+	lb := h.loadBalancing.Load()
+	if lb == nil {
+		return false
+	}
+	switch msgType {
+	case dhcp4.Discover:
+	case dhcp4.Request:
+		if options[dhcp4.OptionServerIdentifier] != nil || !net.IP(p.CIAddr()).Equal(net.IPv4zero) {
+			return false
+		}
+	default:
+		return false
+	}
+	if lb.SecsThreshold > 0 && int(binary.BigEndian.Uint16(p.Secs())) >= lb.SecsThreshold {
+		return false
+	}
+	bucket := loadBalanceHash(loadBalanceKey(p.CHAddr(), options))
+	return bucket < lb.First || bucket > lb.Last
+}
+
+// SetLoadBalancing replaces the load balancing configured with
+// WithLoadBalancing. A nil lb serves all clients.
+func (h *Handler) SetLoadBalancing(lb *LoadBalancing) {
+	h.loadBalancing.Store(lb)
+}
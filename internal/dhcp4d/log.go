@@ -0,0 +1,107 @@
+package dhcp4d
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
+)
+
+// txLogger returns a logger annotated with the interface, transaction ID
+// and client hardware address of p, so all lines for one exchange can be
+// correlated.
+func (h *Handler) txLogger(p dhcp4.Packet) *slog.Logger {
+	return slog.With(
+		"iface", h.iface.Name,
+		"xid", hex.EncodeToString(p.XId()),
+		"hw", p.CHAddr().String())
+}
+
+// relayAgentAttrs returns the circuit and remote IDs of the relay agent
+// information option (82) as log attributes, so clients behind a relay can
+// be located by switch port.
+func relayAgentAttrs(info []byte) []any {
+	sub, err := dhcp4.DecodeRelayAgentInfo(info)
+	if err != nil {
+		return []any{"relay_agent_info", hex.EncodeToString(info)}
+	}
+	var attrs []any
+	for _, id := range []struct {
+		key  string
+		code byte
+	}{
+		{"circuit_id", dhcp4.AgentCircuitID},
+		{"remote_id", dhcp4.AgentRemoteID},
+	} {
+		if v, ok := sub[id.code]; ok {
+			if printable(v) {
+				attrs = append(attrs, id.key, string(v))
+			} else {
+				attrs = append(attrs, id.key, hex.EncodeToString(v))
+			}
+		}
+	}
+	return attrs
+}
+
+// logOptions logs the decoded options of a message at debug level.
+func logOptions(log *slog.Logger, msgType dhcp4.MessageType, options dhcp4.Options) {
+	if !log.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	log.Debug("dhcp options", "type", msgType, "options", formatOptions(options))
+}
+
+// formatOptions renders options in code order, with values shown as text
+// when printable and as hex otherwise.
+func formatOptions(options dhcp4.Options) string {
+	codes := make([]int, 0, len(options))
+	for code := range options {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+
+	parts := make([]string, 0, len(codes))
+	for _, c := range codes {
+		code := dhcp4.OptionCode(c)
+		v := options[code]
+		var s string
+		switch code {
+		case dhcp4.OptionDHCPMessageType:
+			if len(v) == 1 {
+				s = dhcp4.MessageType(v[0]).String()
+			}
+		case dhcp4.OptionParameterRequestList:
+			codes := make([]string, len(v))
+			for i, b := range v {
+				codes[i] = fmt.Sprint(b)
+			}
+			s = strings.Join(codes, ",")
+		}
+		if s == "" {
+			if printable(v) {
+				s = fmt.Sprintf("%q", v)
+			} else {
+				s = hex.EncodeToString(v)
+			}
+		}
+		parts = append(parts, fmt.Sprintf("%d(%s)=%s", c, strings.TrimPrefix(code.String(), "Option"), s))
+	}
+	return strings.Join(parts, " ")
+}
+
+func printable(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
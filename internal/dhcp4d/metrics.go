@@ -0,0 +1,41 @@
+package dhcp4d
+
+import (
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
+)
+
+// Metrics receives instrumentation events from a Handler. Implementations
+// must be safe for concurrent use.
+type Metrics interface {
+	// PacketReceived is called for every DHCP message handled.
+	PacketReceived(msgType dhcp4.MessageType)
+	// ReplySent is called for every reply (offer, ack, nak) written.
+	ReplySent(msgType dhcp4.MessageType)
+	// HandleDuration is called with the time taken to handle each message,
+	// including writing the reply.
+	HandleDuration(msgType dhcp4.MessageType, d time.Duration)
+	// WriteFailed is called when a reply could not be written to the raw
+	// socket.
+	WriteFailed(err error)
+	// Error is called when handling fails for reasons other than the
+	// write; kind is a short identifier such as "pool_exhausted".
+	Error(kind string)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) PacketReceived(dhcp4.MessageType)                {}
+func (noopMetrics) ReplySent(dhcp4.MessageType)                     {}
+func (noopMetrics) HandleDuration(dhcp4.MessageType, time.Duration) {}
+func (noopMetrics) WriteFailed(error)                               {}
+func (noopMetrics) Error(string)                                    {}
+
+// replyType returns the DHCP message type of reply p, or 0 if it has none.
+func replyType(p dhcp4.Packet) dhcp4.MessageType {
+	if t := p.ParseOptions()[dhcp4.OptionDHCPMessageType]; len(t) == 1 {
+		return dhcp4.MessageType(t[0])
+	}
+	return 0
+}
@@ -1,9 +1,43 @@
 package dhcp4d
 
-import "net"
+import (
+	"net"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
+)
 
 type options struct {
-	conn net.PacketConn
+	conn       net.PacketConn
+	classes    []Class
+	tagRules   []TagRule
+	optionSets []OptionSet
+	network    dhcp4.Options
+	macFilter  MACFilter
+	quarantine *Class
+
+	deviceLeasePeriods []DeviceLeasePeriod
+	vendorLookup       func(net.HardwareAddr) string
+	classifyDevice     func(Fingerprint) string
+	groupDevices       bool
+	metrics            Metrics
+	tracer             Tracer
+	rateLimit          *RateLimit
+	flap               *FlapDetection
+	poolWarning        float64
+	dryRun             bool
+	loadBalancing      *LoadBalancing
+	allocatable        func(net.IP) bool
+	leaseLimit         func(net.IP) time.Duration
+	learning           bool
+	fqdnPolicy         FQDNPolicy
+	sanitizeHostnames  bool
+	duplicates         DuplicatePolicy
+	allocation         Allocation
+	minSecs            int
+	alwaysBroadcast    bool
+	vlan               int
+	udp                bool
 }
 
 type Option interface {
@@ -21,3 +55,382 @@ func (c *connOption) set(o *options) {
 func WithConn(conn net.PacketConn) Option {
 	return &connOption{conn: conn}
 }
+
+type classesOption struct {
+	classes []Class
+}
+
+func (c *classesOption) set(o *options) {
+	o.classes = c.classes
+}
+
+// WithClasses configures client classes. Classes are matched in order and the
+// first match wins.
+func WithClasses(classes ...Class) Option {
+	return &classesOption{classes: classes}
+}
+
+type tagRulesOption struct {
+	rules []TagRule
+}
+
+func (t *tagRulesOption) set(o *options) {
+	o.tagRules = t.rules
+}
+
+// WithTagRules configures the rules used to tag clients.
+func WithTagRules(rules ...TagRule) Option {
+	return &tagRulesOption{rules: rules}
+}
+
+type optionSetsOption struct {
+	sets []OptionSet
+}
+
+func (s *optionSetsOption) set(o *options) {
+	o.optionSets = s.sets
+}
+
+// WithOptionSets configures option blocks that are conditional on tags.
+func WithOptionSets(sets ...OptionSet) Option {
+	return &optionSetsOption{sets: sets}
+}
+
+type networkOptionsOption struct {
+	options dhcp4.Options
+}
+
+func (n *networkOptionsOption) set(o *options) {
+	o.network = n.options
+}
+
+// WithNetworkOptions adds options sent to every client, such as the domain
+// search list. Classes, option sets and static leases override them.
+func WithNetworkOptions(opts dhcp4.Options) Option {
+	return &networkOptionsOption{options: opts}
+}
+
+type macFilterOption struct {
+	filter MACFilter
+}
+
+func (m *macFilterOption) set(o *options) {
+	o.macFilter = m.filter
+}
+
+// WithMACFilter restricts the clients that are served.
+func WithMACFilter(filter MACFilter) Option {
+	return &macFilterOption{filter: filter}
+}
+
+type quarantineOption struct {
+	class Class
+}
+
+func (q *quarantineOption) set(o *options) {
+	o.quarantine = &q.class
+}
+
+// WithQuarantine puts clients that neither have a static lease nor have been
+// approved (see Handler.Approve) into class, regardless of other classes.
+func WithQuarantine(class Class) Option {
+	return &quarantineOption{class: class}
+}
+
+type deviceLeasePeriodsOption struct {
+	periods []DeviceLeasePeriod
+}
+
+func (d *deviceLeasePeriodsOption) set(o *options) {
+	o.deviceLeasePeriods = d.periods
+}
+
+// WithDeviceLeasePeriods replaces DefaultDeviceLeasePeriods. The first entry
+// matching a client wins.
+func WithDeviceLeasePeriods(periods ...DeviceLeasePeriod) Option {
+	return &deviceLeasePeriodsOption{periods: periods}
+}
+
+type vendorLookupOption struct {
+	lookup func(net.HardwareAddr) string
+}
+
+func (v *vendorLookupOption) set(o *options) {
+	o.vendorLookup = v.lookup
+}
+
+// WithVendorLookup annotates leases with the vendor returned by lookup.
+func WithVendorLookup(lookup func(net.HardwareAddr) string) Option {
+	return &vendorLookupOption{lookup: lookup}
+}
+
+type classifyDeviceOption struct {
+	classify func(Fingerprint) string
+}
+
+func (c *classifyDeviceOption) set(o *options) {
+	o.classifyDevice = c.classify
+}
+
+// WithDeviceClassifier annotates leases with the device type classify
+// guesses from the client's fingerprint.
+func WithDeviceClassifier(classify func(Fingerprint) string) Option {
+	return &classifyDeviceOption{classify: classify}
+}
+
+type groupDevicesOption struct{}
+
+func (*groupDevicesOption) set(o *options) {
+	o.groupDevices = true
+}
+
+// WithDeviceGrouping correlates randomized hardware addresses by client
+// identifier, hostname and fingerprint, and keeps a single lease per device.
+func WithDeviceGrouping() Option {
+	return &groupDevicesOption{}
+}
+
+type metricsOption struct {
+	metrics Metrics
+}
+
+func (m *metricsOption) set(o *options) {
+	o.metrics = m.metrics
+}
+
+// WithMetrics reports packet, reply and error counts to m.
+func WithMetrics(m Metrics) Option {
+	return &metricsOption{metrics: m}
+}
+
+type tracerOption struct {
+	tracer Tracer
+}
+
+func (t *tracerOption) set(o *options) {
+	o.tracer = t.tracer
+}
+
+// WithTracer reports a Span for every message handled to t.
+func WithTracer(t Tracer) Option {
+	return &tracerOption{tracer: t}
+}
+
+type rateLimitOption struct {
+	limit RateLimit
+}
+
+func (r *rateLimitOption) set(o *options) {
+	o.rateLimit = &r.limit
+}
+
+// WithRateLimit drops messages from clients exceeding limit.
+func WithRateLimit(limit RateLimit) Option {
+	return &rateLimitOption{limit: limit}
+}
+
+type flapDetectionOption struct {
+	flap FlapDetection
+}
+
+func (f *flapDetectionOption) set(o *options) {
+	o.flap = &f.flap
+}
+
+// WithFlapDetection emits EventFlap for clients cycling through requests,
+// declines and releases faster than flap allows.
+func WithFlapDetection(flap FlapDetection) Option {
+	return &flapDetectionOption{flap: flap}
+}
+
+type poolWarningOption struct {
+	threshold float64
+}
+
+func (p *poolWarningOption) set(o *options) {
+	o.poolWarning = p.threshold
+}
+
+// WithPoolWarning emits EventPoolWarning when the default pool's
+// utilization reaches threshold percent.
+func WithPoolWarning(threshold float64) Option {
+	return &poolWarningOption{threshold: threshold}
+}
+
+type dryRunOption struct{}
+
+func (dryRunOption) set(o *options) {
+	o.dryRun = true
+}
+
+// WithDryRun makes the handler log the replies it would send instead of
+// sending them. Leases are still tracked in memory.
+func WithDryRun() Option {
+	return dryRunOption{}
+}
+
+type loadBalancingOption struct {
+	lb LoadBalancing
+}
+
+func (l *loadBalancingOption) set(o *options) {
+	o.loadBalancing = &l.lb
+}
+
+// WithLoadBalancing makes the handler serve only the clients hashing into
+// the buckets of lb, leaving the others to a peer server.
+func WithLoadBalancing(lb LoadBalancing) Option {
+	return &loadBalancingOption{lb: lb}
+}
+
+type allocatableOption struct {
+	allocatable func(net.IP) bool
+}
+
+func (a *allocatableOption) set(o *options) {
+	o.allocatable = a.allocatable
+}
+
+// WithAllocatable restricts the free addresses handed out to those for which
+// allocatable returns true, such as the share of a failover partner.
+// Clients keep the addresses they already have.
+func WithAllocatable(allocatable func(ip net.IP) bool) Option {
+	return &allocatableOption{allocatable: allocatable}
+}
+
+type leaseLimitOption struct {
+	limit func(net.IP) time.Duration
+}
+
+func (l *leaseLimitOption) set(o *options) {
+	o.leaseLimit = l.limit
+}
+
+// WithLeaseLimit caps the lease period granted for an address at what limit
+// returns for it, unless that is zero.
+func WithLeaseLimit(limit func(ip net.IP) time.Duration) Option {
+	return &leaseLimitOption{limit: limit}
+}
+
+type learningOption struct{}
+
+func (learningOption) set(o *options) {
+	o.learning = true
+}
+
+// WithLearning makes the handler ignore all messages, never replying, so
+// that it can learn the leases of another server with Learn.
+func WithLearning() Option {
+	return learningOption{}
+}
+
+type fqdnPolicyOption struct {
+	policy FQDNPolicy
+}
+
+func (f *fqdnPolicyOption) set(o *options) {
+	o.fqdnPolicy = f.policy
+}
+
+// WithClientFQDN sets how the Client FQDN option is answered. The default is
+// FQDNHonor.
+func WithClientFQDN(policy FQDNPolicy) Option {
+	return &fqdnPolicyOption{policy: policy}
+}
+
+type sanitizeHostnamesOption struct{}
+
+func (sanitizeHostnamesOption) set(o *options) {
+	o.sanitizeHostnames = true
+}
+
+// WithHostnameSanitizing makes client hostnames valid DNS labels before they
+// are stored. Lease.ClientHostname keeps the name as sent.
+func WithHostnameSanitizing() Option {
+	return sanitizeHostnamesOption{}
+}
+
+type duplicatesOption struct {
+	policy DuplicatePolicy
+}
+
+func (d *duplicatesOption) set(o *options) {
+	o.duplicates = d.policy
+}
+
+// WithDuplicateHostnames sets what happens when a client asks for the
+// hostname of another active lease. The default is DuplicateAllow.
+// Hostname overrides are never changed.
+func WithDuplicateHostnames(policy DuplicatePolicy) Option {
+	return &duplicatesOption{policy: policy}
+}
+
+type allocationOption struct {
+	allocation Allocation
+}
+
+func (a *allocationOption) set(o *options) {
+	o.allocation = a.allocation
+}
+
+// WithAllocation sets how the address of a new lease is picked. The default
+// is AllocateRandom.
+func WithAllocation(allocation Allocation) Option {
+	return &allocationOption{allocation: allocation}
+}
+
+type minSecsOption struct {
+	secs int
+}
+
+func (m *minSecsOption) set(o *options) {
+	o.minSecs = m.secs
+}
+
+// WithMinSecs ignores DHCPDISCOVERs until the client has been trying for
+// secs seconds, according to their secs field, so that the handler only
+// answers clients that another server failed to serve.
+func WithMinSecs(secs int) Option {
+	return &minSecsOption{secs: secs}
+}
+
+type alwaysBroadcastOption struct{}
+
+func (alwaysBroadcastOption) set(o *options) {
+	o.alwaysBroadcast = true
+}
+
+// WithAlwaysBroadcast broadcasts all replies, for clients that cannot
+// receive unicast replies before they are configured but do not set the
+// broadcast flag.
+func WithAlwaysBroadcast() Option {
+	return alwaysBroadcastOption{}
+}
+
+type vlanOption struct {
+	id int
+}
+
+func (v *vlanOption) set(o *options) {
+	o.vlan = v.id
+}
+
+// WithVLAN makes the handler serve the 802.1Q VLAN id of its interface,
+// which is a trunk: replies are sent with the VLAN tag. See ServeVLANs.
+func WithVLAN(id int) Option {
+	return &vlanOption{id: id}
+}
+
+type udpOption struct{}
+
+func (udpOption) set(o *options) {
+	o.udp = true
+}
+
+// WithUDP makes the handler return its replies from ServeDHCP, for the
+// caller to send over its UDP socket, instead of writing them to a packet
+// socket, which is then not opened. The caller sends them to ReplyAddr.
+// Learn and Wake are not available.
+func WithUDP() Option {
+	return udpOption{}
+}
@@ -0,0 +1,46 @@
+package dhcp4d
+
+import "github.com/psanford/dhcpeterd/internal/dhcp4"
+
+// Values of the option overload option (52), RFC 2132 section 9.3.
+const (
+	overloadFile  = 1
+	overloadSName = 2
+	overloadBoth  = 3
+)
+
+// overloadedOptions returns options merged with any options that the client
+// packed into the file and/or sname fields, as indicated by option 52.
+// Options from the options field take precedence over overloaded ones.
+func overloadedOptions(p dhcp4.Packet, options dhcp4.Options) dhcp4.Options {
+	ov, ok := options[dhcp4.OptionOverload]
+	if !ok || len(ov) != 1 || len(p) < 240 {
+		return options
+	}
+
+	// RFC 2131 section 4.1: the file field is interpreted before sname.
+	var fields [][]byte
+	switch ov[0] {
+	case overloadFile:
+		fields = [][]byte{p[108:236]}
+	case overloadSName:
+		fields = [][]byte{p[44:108]}
+	case overloadBoth:
+		fields = [][]byte{p[108:236], p[44:108]}
+	default:
+		return options
+	}
+
+	merged := make(dhcp4.Options, len(options))
+	for code, v := range options {
+		merged[code] = v
+	}
+	for _, field := range fields {
+		for code, v := range dhcp4.ParseOptionField(field) {
+			if _, exists := merged[code]; !exists {
+				merged[code] = v
+			}
+		}
+	}
+	return merged
+}
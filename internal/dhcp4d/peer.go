@@ -0,0 +1,68 @@
+package dhcp4d
+
+// PutLease records a lease handed out by another server, such as a failover
+// partner, replacing the lease of its address and the client's previous
+// lease. Details the handler knows about the client, like its hostname, are
+// kept. No events are emitted and Leases is called with a nil latest lease,
+// so the lease is persisted but not announced as the handler's own.
+func (h *Handler) PutLease(l Lease) {
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	h.putLeaseLocked(l)
+}
+
+// MergeLease is like PutLease, but keeps the leases of the client and of
+// the address if they were acknowledged no earlier than l, so that merging
+// the leases of a partner that served in the meantime is idempotent. It
+// reports whether l was recorded.
+func (h *Handler) MergeLease(l Lease) bool {
+	if l.Addr.To4() == nil {
+		return false
+	}
+	if l.LastACK.IsZero() {
+		l.LastACK = l.Expiry
+	}
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	if num, ok := h.leasesHW[l.HardwareAddr]; ok {
+		if prev, ok := h.leasesIP[num]; ok && prev.HardwareAddr == l.HardwareAddr && !prev.LastACK.Before(l.LastACK) {
+			return false
+		}
+	}
+	if prev, ok := h.leasesIP[h.offset(l.Addr)]; ok && !prev.LastACK.Before(l.LastACK) {
+		return false
+	}
+	h.putLeaseLocked(l)
+	return true
+}
+
+func (h *Handler) putLeaseLocked(l Lease) {
+	l.Addr = l.Addr.To4()
+	l.Num = h.offset(l.Addr)
+	if num, ok := h.leasesHW[l.HardwareAddr]; ok {
+		if prev, ok := h.leasesIP[num]; ok && prev.HardwareAddr == l.HardwareAddr {
+			if l.Hostname == "" {
+				l.Hostname = prev.Hostname
+				l.HostnameOverride = prev.HostnameOverride
+			}
+			if l.ClientHostname == "" {
+				l.ClientHostname = prev.ClientHostname
+			}
+			if l.Fingerprint == nil {
+				l.Fingerprint = prev.Fingerprint
+				l.DeviceType = prev.DeviceType
+			}
+			delete(h.leasesIP, num)
+			h.used.clear(num)
+		}
+	}
+	if other, ok := h.leasesIP[l.Num]; ok && h.leasesHW[other.HardwareAddr] == l.Num {
+		delete(h.leasesHW, other.HardwareAddr)
+	}
+	if l.Vendor == "" {
+		l.Vendor = h.vendor(l.HardwareAddr)
+	}
+	h.putLocked(l.Num, &l)
+	h.leasesHW[l.HardwareAddr] = l.Num
+	h.callLeasesLocked(nil)
+}
@@ -0,0 +1,70 @@
+package dhcp4d
+
+import (
+	"sort"
+	"strings"
+)
+
+// known reports whether hwAddr has a static lease or has been approved. Only
+// meaningful if a quarantine class is configured.
+func (h *Handler) known(hwAddr string, static bool) bool {
+	if static {
+		return true
+	}
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	return h.approved[strings.ToLower(hwAddr)]
+}
+
+// SetApproved overwrites the set of approved clients, typically loaded from
+// persistent storage. Approved clients are allocated from the regular pools
+// instead of the quarantine pool.
+func (h *Handler) SetApproved(hwAddrs []string) {
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	h.approved = make(map[string]bool)
+	for _, hw := range hwAddrs {
+		h.approved[strings.ToLower(hw)] = true
+	}
+}
+
+// Approve marks hwAddr as a known client. Its quarantine lease (if any) is
+// NAKed on the next renewal so that it moves to the regular pool.
+func (h *Handler) Approve(hwAddr string) {
+	h.setApproval(hwAddr, true)
+}
+
+// Unapprove reverts Approve.
+func (h *Handler) Unapprove(hwAddr string) {
+	h.setApproval(hwAddr, false)
+}
+
+func (h *Handler) setApproval(hwAddr string, approved bool) {
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	hwAddr = strings.ToLower(hwAddr)
+	if approved {
+		h.approved[hwAddr] = true
+	} else {
+		delete(h.approved, hwAddr)
+	}
+	if h.Approvals != nil {
+		h.Approvals(h.approvedLocked())
+	}
+}
+
+// Approved returns the sorted list of approved clients.
+func (h *Handler) Approved() []string {
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	return h.approvedLocked()
+}
+
+func (h *Handler) approvedLocked() []string {
+	approved := make([]string, 0, len(h.approved))
+	for hw := range h.approved {
+		approved = append(approved, hw)
+	}
+	sort.Strings(approved)
+	return approved
+}
@@ -1,5 +1,38 @@
 package dhcp4d
 
+import (
+	"net"
+	"time"
+)
+
+// DeviceLeasePeriod overrides the lease period for clients whose hardware
+// address starts with one of Prefixes.
+type DeviceLeasePeriod struct {
+	Prefixes    []net.HardwareAddr
+	LeasePeriod time.Duration
+}
+
+// DefaultDeviceLeasePeriods are the device lease periods used unless
+// overridden with WithDeviceLeasePeriods.
+func DefaultDeviceLeasePeriods() []DeviceLeasePeriod {
+	return []DeviceLeasePeriod{
+		{
+			// The Nintendo Switch needs a lease time of at least 1 hour.
+			Prefixes:    NintendoMACPrefixes(),
+			LeasePeriod: 1 * time.Hour,
+		},
+	}
+}
+
+// NintendoMACPrefixes returns the MAC address prefixes assigned to Nintendo.
+func NintendoMACPrefixes() []net.HardwareAddr {
+	prefixes := make([]net.HardwareAddr, len(nintendoMacPrefixes))
+	for i, p := range nintendoMacPrefixes {
+		prefixes[i] = net.HardwareAddr{p[0], p[1], p[2]}
+	}
+	return prefixes
+}
+
 // Sorted list of MAC address prefixes assigned to Nintendo.
 // From the IEEE MA-L (MAC Address Block Large, formerly known as OUI) database.
 var nintendoMacPrefixes = [...][3]byte{
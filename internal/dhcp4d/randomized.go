@@ -0,0 +1,72 @@
+package dhcp4d
+
+import (
+	"bytes"
+	"encoding/hex"
+	"log/slog"
+	"net"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
+)
+
+// locallyAdministered reports whether hw has the locally administered bit
+// set, which is what phones and laptops use for randomized addresses.
+func locallyAdministered(hw net.HardwareAddr) bool {
+	return len(hw) > 0 && hw[0]&0x02 != 0
+}
+
+// clientID returns option 61 hex encoded, unless it merely repeats the
+// hardware address, in which case it carries no additional identity.
+func clientID(hw net.HardwareAddr, options dhcp4.Options) string {
+	id := options[dhcp4.OptionClientIdentifier]
+	if len(id) == 0 || (len(id) == 1+len(hw) && id[0] == 1 && bytes.Equal(id[1:], hw)) {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// sameDevice reports whether a and b appear to be the same physical device
+// using different (randomized) hardware addresses.
+func sameDevice(a, b *Lease) bool {
+	if a.ClientID != "" && a.ClientID == b.ClientID {
+		return true
+	}
+	if a.ClientHostname == "" || a.ClientHostname != b.ClientHostname || a.Fingerprint == nil || b.Fingerprint == nil {
+		return false
+	}
+	return a.Fingerprint.ParameterRequestList == b.Fingerprint.ParameterRequestList &&
+		a.Fingerprint.VendorClass == b.Fingerprint.VendorClass
+}
+
+// groupDeviceLocked assigns lease a stable DeviceID. If lease uses a
+// randomized address and matches a lease of another address, it inherits
+// that lease's identity and hostname override, and the stale lease is
+// removed so that a device rotating its address occupies a single entry.
+func (h *Handler) groupDeviceLocked(lease *Lease) {
+	if lease.DeviceID == "" {
+		lease.DeviceID = lease.HardwareAddr
+	}
+	if !lease.Randomized {
+		return
+	}
+	for num, l := range h.leasesIP {
+		if l.HardwareAddr == lease.HardwareAddr || !l.Randomized || !sameDevice(lease, l) {
+			continue
+		}
+		if l.DeviceID != "" {
+			lease.DeviceID = l.DeviceID
+		}
+		if lease.HostnameOverride == "" && l.HostnameOverride != "" {
+			lease.HostnameOverride = l.HostnameOverride
+			lease.Hostname = l.HostnameOverride
+			h.hostnameOverrides[lease.HardwareAddr] = l.HostnameOverride
+		}
+		slog.Info("grouped randomized address", "hw", lease.HardwareAddr, "previous_hw", l.HardwareAddr, "device", lease.DeviceID)
+		h.removeLocked(l, h.timeNow())
+		delete(h.leasesIP, num)
+		h.used.clear(num)
+		if h.leasesHW[l.HardwareAddr] == num {
+			delete(h.leasesHW, l.HardwareAddr)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package dhcp4d
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
+)
+
+// RateLimit limits the messages each client, identified by its client
+// identifier or else its hardware address, may send: up to Burst at once,
+// refilled at Rate per second.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// rateLimiter is a set of token buckets keyed by client.
+type rateLimiter struct {
+	RateLimit
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+type bucket struct {
+	tokens    float64
+	last      time.Time
+	throttled bool
+}
+
+func newRateLimiter(rl RateLimit) *rateLimiter {
+	if rl.Burst < 1 {
+		rl.Burst = 1
+	}
+	return &rateLimiter{
+		RateLimit: rl,
+		buckets:   make(map[string]*bucket),
+	}
+}
+
+// allow reports whether key may send another message at now, and whether
+// this message is the first to be refused since the client was last
+// allowed through.
+func (r *rateLimiter) allow(key string, now time.Time) (ok, started bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pruneLocked(now)
+
+	b, found := r.buckets[key]
+	if !found {
+		b = &bucket{tokens: float64(r.Burst), last: now}
+		r.buckets[key] = b
+	}
+	b.tokens = min(float64(r.Burst), b.tokens+now.Sub(b.last).Seconds()*r.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		b.throttled = false
+		return true, false
+	}
+	started = !b.throttled
+	b.throttled = true
+	return false, started
+}
+
+// pruneLocked drops buckets that have refilled completely, at most once a
+// minute.
+func (r *rateLimiter) pruneLocked(now time.Time) {
+	if now.Sub(r.lastPrune) < time.Minute {
+		return
+	}
+	r.lastPrune = now
+	for key, b := range r.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*r.Rate >= float64(r.Burst) {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// throttled reports whether the client sending p has exceeded its rate
+// limit.
+func (h *Handler) throttled(p dhcp4.Packet, options dhcp4.Options, log *slog.Logger) bool {
+	if h.limiter == nil {
+		return false
+	}
+	key := clientID(p.CHAddr(), options)
+	if key == "" {
+		key = p.CHAddr().String()
+	}
+	ok, started := h.limiter.allow(key, h.timeNow())
+	if ok {
+		return false
+	}
+	if started {
+		log.Warn("client exceeded rate limit, throttling", "client", key)
+	}
+	h.metrics.Error("rate_limited")
+	return true
+}
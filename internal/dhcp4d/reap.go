@@ -0,0 +1,34 @@
+package dhcp4d
+
+import "time"
+
+// ReapExpired removes leases that expired more than retention ago, so that
+// the lease database does not grow without bound on networks with many
+// short-lived clients. Until then a returning client is offered its old
+// address. The removed leases were announced when they expired, see
+// ExpireLeases. Leases is called if any were removed. It returns the number
+// of removed leases.
+func (h *Handler) ReapExpired(retention time.Duration) int {
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	now := h.timeNow()
+	h.expireLocked(now)
+	cutoff := now.Add(-retention)
+	var reaped int
+	for num, l := range h.leasesIP {
+		if !l.Expired(cutoff) {
+			continue
+		}
+		delete(h.leasesIP, num)
+		h.used.clear(num)
+		if h.leasesHW[l.HardwareAddr] == num {
+			delete(h.leasesHW, l.HardwareAddr)
+			delete(h.revoked, l.HardwareAddr)
+		}
+		reaped++
+	}
+	if reaped > 0 {
+		h.callLeasesLocked(nil)
+	}
+	return reaped
+}
@@ -0,0 +1,31 @@
+package dhcp4d
+
+// CopyStateFrom replaces h's leases, approvals, hostname overrides and
+// pending revocations with those of old, typically when a handler is rebuilt
+// after a configuration change. Lease numbers are recomputed for h's pool
+// layout. Neither handler may be serving messages during the copy.
+func (h *Handler) CopyStateFrom(old *Handler) {
+	old.leasesMu.Lock()
+	leases := make([]*Lease, 0, len(old.leasesIP))
+	for _, l := range old.leasesIP {
+		copied := *l
+		leases = append(leases, &copied)
+	}
+	approved := old.approvedLocked()
+	overrides := make(map[string]string, len(old.hostnameOverrides))
+	for hw, name := range old.hostnameOverrides {
+		overrides[hw] = name
+	}
+	revoked := make(map[string]bool, len(old.revoked))
+	for hw := range old.revoked {
+		revoked[hw] = true
+	}
+	old.leasesMu.Unlock()
+
+	h.SetHostnameOverrides(overrides)
+	h.SetLeases(leases)
+	h.SetApproved(approved)
+	h.leasesMu.Lock()
+	h.revoked = revoked
+	h.leasesMu.Unlock()
+}
@@ -0,0 +1,91 @@
+package dhcp4d
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxLabelLen is the maximum length of a DNS label.
+const maxLabelLen = 63
+
+// DuplicatePolicy is what a handler does when a client asks for the hostname
+// of another active lease.
+type DuplicatePolicy int
+
+const (
+	// DuplicateAllow keeps the hostname.
+	DuplicateAllow DuplicatePolicy = iota
+	// DuplicateNumber appends the lowest free suffix of -2, -3 and so on.
+	DuplicateNumber
+	// DuplicateMAC appends the last three octets of the client's hardware
+	// address, e.g. "-ddeeff", falling back to a number if that is taken
+	// too.
+	DuplicateMAC
+)
+
+// sanitizeHostname returns s as a valid DNS label: lowercased, with runs of
+// other characters than letters, digits and hyphens replaced by a hyphen,
+// without leading or trailing hyphens and truncated to 63 characters.
+func sanitizeHostname(s string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(s) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			b.WriteRune(r)
+			hyphen = false
+		} else if !hyphen && b.Len() > 0 {
+			b.WriteByte('-')
+			hyphen = true
+		}
+		if b.Len() >= maxLabelLen {
+			break
+		}
+	}
+	return strings.TrimRight(b.String(), "-")
+}
+
+// uniqueHostnameLocked returns the hostname for lease under h.duplicates.
+// A client keeps the name of its previous lease prev (which may be nil) if
+// it asked for the same hostname and the name is still free. h.leasesMu
+// must be held.
+func (h *Handler) uniqueHostnameLocked(lease *Lease, prev *Lease) string {
+	name := lease.Hostname
+	if h.duplicates == DuplicateAllow || name == "" || lease.HostnameOverride != "" {
+		return name
+	}
+	taken := make(map[string]bool)
+	now := h.timeNow()
+	for _, l := range h.leasesIP {
+		if l.HardwareAddr != lease.HardwareAddr && !l.Expired(now) && l.Hostname != "" {
+			taken[strings.ToLower(l.Hostname)] = true
+		}
+	}
+	if !taken[strings.ToLower(name)] {
+		return name
+	}
+	if prev != nil && prev.HardwareAddr == lease.HardwareAddr && prev.ClientHostname == lease.ClientHostname && prev.Hostname != "" && !taken[strings.ToLower(prev.Hostname)] {
+		return prev.Hostname
+	}
+	if h.duplicates == DuplicateMAC {
+		hw := strings.ReplaceAll(lease.HardwareAddr, ":", "")
+		if len(hw) >= 6 {
+			if unique := withSuffix(name, "-"+hw[len(hw)-6:]); !taken[strings.ToLower(unique)] {
+				return unique
+			}
+		}
+	}
+	for n := 2; ; n++ {
+		if unique := withSuffix(name, fmt.Sprintf("-%d", n)); !taken[strings.ToLower(unique)] {
+			return unique
+		}
+	}
+}
+
+// withSuffix appends suffix to name, shortening name so that the result
+// fits in a DNS label.
+func withSuffix(name, suffix string) string {
+	if len(name)+len(suffix) > maxLabelLen {
+		name = strings.TrimRight(name[:max(maxLabelLen-len(suffix), 0)], "-")
+	}
+	return name + suffix
+}
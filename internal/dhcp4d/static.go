@@ -0,0 +1,87 @@
+package dhcp4d
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+func (h *Handler) staticLease(hwAddr string) (StaticLease, bool) {
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	sl, ok := h.staticLeases[strings.ToLower(hwAddr)]
+	return sl, ok
+}
+
+// permanentFor reports whether a lease of ip to the client of sl, if it
+// has one, is permanent.
+func (sl StaticLease) permanentFor(hasStatic bool, ip net.IP) bool {
+	return hasStatic && sl.Permanent && ip.Equal(sl.Addr)
+}
+
+// StaticLeases returns the static leases, including those added at runtime.
+func (h *Handler) StaticLeases() []StaticLease {
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	leases := make([]StaticLease, 0, len(h.staticLeases))
+	for _, sl := range h.staticLeases {
+		leases = append(leases, sl)
+	}
+	return leases
+}
+
+// PromoteLease turns the current lease of hwaddr into a static lease for
+// the same address and hostname and returns it. A permanent lease no
+// longer expires and is renewed with an infinite lease time.
+func (h *Handler) PromoteLease(hwaddr string, permanent bool) (StaticLease, error) {
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	l, ok := h.leaseHWLocked(hwaddr)
+	if !ok || l.Expired(h.timeNow()) {
+		return StaticLease{}, fmt.Errorf("hwaddr %v does not have a valid lease", hwaddr)
+	}
+	sl := StaticLease{
+		Addr:         l.Addr.To4(),
+		HardwareAddr: l.HardwareAddr,
+		Hostname:     l.Hostname,
+		Permanent:    permanent,
+	}
+	if err := h.addStaticLeaseLocked(sl); err != nil {
+		return StaticLease{}, err
+	}
+	if permanent {
+		l.Expiry = time.Time{}
+		h.callLeasesLocked(nil)
+	}
+	return sl, nil
+}
+
+// AddStaticLease adds a static lease at runtime. The address must not be
+// below the lowest address of the handler's pools and static leases.
+func (h *Handler) AddStaticLease(sl StaticLease) error {
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	return h.addStaticLeaseLocked(sl)
+}
+
+func (h *Handler) addStaticLeaseLocked(sl StaticLease) error {
+	hw := strings.ToLower(sl.HardwareAddr)
+	if _, exists := h.staticLeases[hw]; exists {
+		return fmt.Errorf("hwaddr %v already has a static lease", sl.HardwareAddr)
+	}
+	num := h.offset(sl.Addr)
+	if sl.Addr.To4() == nil || num < 0 {
+		return fmt.Errorf("static lease address %v outside of network", sl.Addr)
+	}
+	if _, reserved := h.reservedOffsets[num]; reserved {
+		return fmt.Errorf("address %v is already reserved", sl.Addr)
+	}
+	if l, ok := h.leasesIP[num]; ok && !strings.EqualFold(l.HardwareAddr, hw) && !l.Expired(h.timeNow()) {
+		return fmt.Errorf("address %v is leased to %s", sl.Addr, l.HardwareAddr)
+	}
+
+	h.staticLeases[hw] = sl
+	h.reservedOffsets[num] = struct{}{}
+	return nil
+}
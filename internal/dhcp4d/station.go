@@ -0,0 +1,42 @@
+package dhcp4d
+
+// Station is the Wi-Fi network a client is associated with.
+type Station struct {
+	SSID  string
+	BSSID string
+}
+
+// SetStation records that the client hwaddr associated with st. Its lease,
+// current and future, carries the SSID and BSSID until ClearStation. It
+// reports whether the client has a lease.
+func (h *Handler) SetStation(hwaddr string, st Station) bool {
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	h.stations[hwaddr] = st
+	l, ok := h.leaseHWLocked(hwaddr)
+	if !ok {
+		return false
+	}
+	if l.SSID != st.SSID || l.BSSID != st.BSSID {
+		l.SSID, l.BSSID = st.SSID, st.BSSID
+		h.callLeasesLocked(nil)
+	}
+	return true
+}
+
+// ClearStation records that the client hwaddr disassociated from bssid. It
+// reports whether the client was associated with bssid, rather than having
+// roamed to another network since.
+func (h *Handler) ClearStation(hwaddr, bssid string) bool {
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	if st, ok := h.stations[hwaddr]; !ok || st.BSSID != bssid {
+		return false
+	}
+	delete(h.stations, hwaddr)
+	if l, ok := h.leaseHWLocked(hwaddr); ok && l.BSSID != "" {
+		l.SSID, l.BSSID = "", ""
+		h.callLeasesLocked(nil)
+	}
+	return true
+}
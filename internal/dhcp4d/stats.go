@@ -0,0 +1,79 @@
+package dhcp4d
+
+import "log/slog"
+
+// Stats summarizes the leases of a handler.
+type Stats struct {
+	PoolSize int `json:"pool_size"` // addresses in the default pool
+	Active   int `json:"active"`    // unexpired leases
+	Expired  int `json:"expired"`   // expired leases still in the database
+	Static   int `json:"static"`    // static leases
+
+	// Utilization is the percentage of default pool addresses that are
+	// actively leased or reserved for a static lease.
+	Utilization float64 `json:"utilization"`
+}
+
+// Stats returns lease statistics computed from the handler's state.
+func (h *Handler) Stats() Stats {
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
+	return h.statsLocked()
+}
+
+func (h *Handler) statsLocked() Stats {
+	now := h.timeNow()
+
+	s := Stats{
+		PoolSize: h.pool.size,
+		Static:   len(h.staticLeases),
+	}
+	used := make(map[int]bool)
+	for num, l := range h.leasesIP {
+		if l.Expired(now) {
+			s.Expired++
+			continue
+		}
+		s.Active++
+		if h.pool.contains(num) {
+			used[num] = true
+		}
+	}
+	for num := range h.reservedOffsets {
+		if h.pool.contains(num) {
+			used[num] = true
+		}
+	}
+	if s.PoolSize > 0 {
+		s.Utilization = 100 * float64(len(used)) / float64(s.PoolSize)
+	}
+	return s
+}
+
+// checkUtilizationLocked emits EventPoolWarning, with l as the lease that
+// pushed the pool over the threshold, when the default pool's utilization
+// first reaches it. The warning is re-armed once utilization drops below.
+func (h *Handler) checkUtilizationLocked(l *Lease, log *slog.Logger) {
+	if h.poolWarning <= 0 {
+		return
+	}
+	s := h.statsLocked()
+	if s.Utilization < h.poolWarning {
+		h.poolWarned = false
+		return
+	}
+	if h.poolWarned {
+		return
+	}
+	h.poolWarned = true
+	log.Warn("pool utilization above threshold", "utilization", s.Utilization, "threshold", h.poolWarning, "active", s.Active, "pool_size", s.PoolSize)
+	h.metrics.Error("pool_utilization_high")
+	h.poolEventLocked(EventPoolWarning, l, s)
+}
+
+func (h *Handler) poolEventLocked(t EventType, l *Lease, s Stats) {
+	if h.Events == nil {
+		return
+	}
+	h.Events(Event{Type: t, Lease: *l, Pool: &s})
+}
@@ -0,0 +1,92 @@
+package dhcp4d
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
+)
+
+// TagRule sets Tag on clients matching all of its non-empty criteria, in the
+// spirit of dnsmasq's tag system. Tags can then be required or excluded by
+// classes and option sets.
+type TagRule struct {
+	Tag string
+
+	MACPrefix   net.HardwareAddr // prefix match on the client hardware address
+	VendorClass string           // prefix match on option 60
+	UserClass   string           // match on option 77
+	Interface   string           // name of the interface the request arrived on
+	HasOption   dhcp4.OptionCode // option sent by the client; 0 disables the check
+}
+
+func (r *TagRule) match(iface string, hwAddr net.HardwareAddr, options dhcp4.Options) bool {
+	if len(r.MACPrefix) > 0 && !bytes.HasPrefix(hwAddr, r.MACPrefix) {
+		return false
+	}
+	if r.VendorClass != "" && !strings.HasPrefix(string(options[dhcp4.OptionVendorClassIdentifier]), r.VendorClass) {
+		return false
+	}
+	if r.UserClass != "" && !hasUserClass(options, r.UserClass) {
+		return false
+	}
+	if r.Interface != "" && r.Interface != iface {
+		return false
+	}
+	if r.HasOption != 0 {
+		if _, ok := options[r.HasOption]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// OptionSet is a block of options that is merged into replies for clients
+// that have all of RequireTags and none of ExcludeTags. Option sets are
+// applied in order after the class options, so later sets win.
+type OptionSet struct {
+	RequireTags []string
+	ExcludeTags []string
+	Options     dhcp4.Options
+}
+
+// tagSet is the set of tags assigned to a client.
+type tagSet map[string]bool
+
+func (t tagSet) satisfy(require, exclude []string) bool {
+	for _, tag := range require {
+		if !t[tag] {
+			return false
+		}
+	}
+	for _, tag := range exclude {
+		if t[tag] {
+			return false
+		}
+	}
+	return true
+}
+
+func (t tagSet) list() []string {
+	if len(t) == 0 {
+		return nil
+	}
+	l := make([]string, 0, len(t))
+	for tag := range t {
+		l = append(l, tag)
+	}
+	sort.Strings(l)
+	return l
+}
+
+func (h *Handler) tagsFor(hwAddr net.HardwareAddr, options dhcp4.Options) tagSet {
+	t := make(tagSet)
+	for i := range h.tagRules {
+		if h.tagRules[i].match(h.iface.Name, hwAddr, options) {
+			t[h.tagRules[i].Tag] = true
+		}
+	}
+	return t
+}
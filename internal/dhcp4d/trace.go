@@ -0,0 +1,54 @@
+package dhcp4d
+
+import (
+	"net"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
+)
+
+// Span describes the handling of a single DHCP message. All messages of one
+// exchange (Discover, Offer, Request, Ack) share the client's XID, so a
+// Tracer can group them into one trace.
+type Span struct {
+	Interface    string
+	XID          []byte
+	HardwareAddr net.HardwareAddr
+	MessageType  dhcp4.MessageType
+	// Reply is the type of the reply sent, or 0 if there was none.
+	Reply dhcp4.MessageType
+	// YourIP is the address offered or acknowledged, if any.
+	YourIP net.IP
+	Start  time.Time
+	End    time.Time
+	// Err is set if the reply could not be written.
+	Err error
+}
+
+// Tracer receives a Span for every DHCP message handled. Implementations
+// must be safe for concurrent use.
+type Tracer interface {
+	Span(Span)
+}
+
+func (h *Handler) traceSpan(start time.Time, p dhcp4.Packet, msgType dhcp4.MessageType, reply dhcp4.Packet, err error) {
+	if h.tracer == nil {
+		return
+	}
+	s := Span{
+		Interface:    h.iface.Name,
+		XID:          append([]byte(nil), p.XId()...),
+		HardwareAddr: append(net.HardwareAddr(nil), p.CHAddr()...),
+		MessageType:  msgType,
+		Start:        start,
+		End:          h.timeNow(),
+		Err:          err,
+	}
+	if reply != nil {
+		s.Reply = replyType(reply)
+		if ip := reply.YIAddr(); !ip.Equal(net.IPv4zero) {
+			s.YourIP = append(net.IP(nil), ip...)
+		}
+	}
+	h.tracer.Span(s)
+}
@@ -0,0 +1,130 @@
+package dhcp4d
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/mdlayher/packet"
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
+)
+
+// Linux packet socket constants that package syscall lacks.
+const (
+	packetAuxdata     = 8    // PACKET_AUXDATA
+	tpStatusVLANValid = 0x10 // TP_STATUS_VLAN_VALID
+)
+
+// ListenTrunk returns a packet socket on the trunk interface iface that
+// reports the VLAN tags the kernel strips from received frames, for
+// ServeVLANs and for the handlers of the VLANs to reply on.
+func ListenTrunk(iface *net.Interface) (net.PacketConn, error) {
+	conn, err := packet.Listen(iface, packet.Raw, syscall.ETH_P_ALL, nil)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_PACKET, packetAuxdata, 1)
+	}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if serr != nil {
+		conn.Close()
+		return nil, serr
+	}
+	return conn, nil
+}
+
+// ServeVLANs passes the DHCP requests received on conn, a socket from
+// ListenTrunk, to the handler of their VLAN, until reading from conn fails.
+// Untagged requests and those of other VLANs are ignored. The handlers
+// must be created WithVLAN, typically WithConn(conn) too.
+func ServeVLANs(conn net.PacketConn, handlers map[int]*Handler) error {
+	buf := make([]byte, 1<<16)
+	for {
+		n, vlan, err := readTagged(conn, buf)
+		if err != nil {
+			return err
+		}
+		frame := buf[:n]
+		if v, untagged := untag(frame); v != 0 {
+			vlan, frame = v, untagged
+		}
+		h, ok := handlers[vlan]
+		if !ok {
+			continue
+		}
+		_, dstPort, payload, ok := udp4Payload(frame)
+		if !ok || dstPort != 67 || len(payload) < 240 {
+			continue
+		}
+		p := dhcp4.Packet(payload)
+		options := p.ParseOptions()
+		t := options[dhcp4.OptionDHCPMessageType]
+		if len(t) != 1 || t[0] < 1 || t[0] > 8 {
+			continue
+		}
+		h.ServeDHCP(p, dhcp4.MessageType(t[0]), options)
+	}
+}
+
+// readTagged reads a frame from conn into buf, with the VLAN of the tag
+// the kernel stripped from it, or 0.
+func readTagged(conn net.PacketConn, buf []byte) (n, vlan int, err error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		n, _, err = conn.ReadFrom(buf)
+		return n, 0, err
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	oob := make([]byte, syscall.CmsgSpace(32))
+	var oobn int
+	var rerr error
+	err = rc.Read(func(fd uintptr) bool {
+		n, oobn, _, _, rerr = syscall.Recvmsg(int(fd), buf, oob, 0)
+		return !errors.Is(rerr, syscall.EAGAIN)
+	})
+	if err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return n, 0, nil
+	}
+	for _, m := range msgs {
+		// struct tpacket_auxdata: tp_status, tp_len, tp_snaplen (u32),
+		// tp_mac, tp_net, tp_vlan_tci, tp_vlan_tpid (u16).
+		if m.Header.Level != syscall.SOL_PACKET || m.Header.Type != packetAuxdata || len(m.Data) < 20 {
+			continue
+		}
+		if binary.NativeEndian.Uint32(m.Data)&tpStatusVLANValid != 0 {
+			vlan = int(binary.NativeEndian.Uint16(m.Data[16:]) & 0xfff)
+		}
+	}
+	return n, vlan, nil
+}
+
+// untag returns the VLAN of an 802.1Q tagged frame and the frame with the
+// tag removed, reusing its memory, or 0 and frame if it is not tagged.
+func untag(frame []byte) (int, []byte) {
+	if len(frame) < 18 || binary.BigEndian.Uint16(frame[12:]) != 0x8100 {
+		return 0, frame
+	}
+	vlan := int(binary.BigEndian.Uint16(frame[14:]) & 0xfff)
+	copy(frame[4:16], frame[:12])
+	return vlan, frame[4:]
+}
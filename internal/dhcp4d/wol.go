@@ -0,0 +1,47 @@
+package dhcp4d
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/mdlayher/packet"
+)
+
+// ethernetTypeWakeOnLAN is the EtherType of Wake-on-LAN magic packets.
+const ethernetTypeWakeOnLAN = layers.EthernetType(0x0842)
+
+// Wake broadcasts a Wake-on-LAN magic packet for hwAddr on the handler's
+// interface.
+func (h *Handler) Wake(hwAddr net.HardwareAddr) error {
+	if len(hwAddr) != 6 {
+		return fmt.Errorf("invalid hardware address for wake-on-lan: %v", hwAddr)
+	}
+	if h.rawConn == nil {
+		return fmt.Errorf("wake-on-lan requires a packet socket")
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	ethernet := &layers.Ethernet{
+		DstMAC:       broadcast,
+		SrcMAC:       h.iface.HardwareAddr,
+		EthernetType: ethernetTypeWakeOnLAN,
+	}
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		ethernet,
+		gopacket.Payload(magicPacket(hwAddr)))
+	if err != nil {
+		return err
+	}
+
+	_, err = h.rawConn.WriteTo(buf.Bytes(), &packet.Addr{HardwareAddr: broadcast})
+	return err
+}
+
+// magicPacket returns 6 bytes of 0xff followed by 16 repetitions of hwAddr.
+func magicPacket(hwAddr net.HardwareAddr) []byte {
+	return append(bytes.Repeat([]byte{0xff}, 6), bytes.Repeat(hwAddr, 16)...)
+}
@@ -0,0 +1,306 @@
+package dhcp6d
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	mrand "math/rand"
+	"net"
+	"time"
+)
+
+// Transmission parameters of RFC 8415 section 7.6.
+const (
+	solTimeout = time.Second
+	solMaxRT   = time.Hour
+	reqTimeout = time.Second
+	reqMaxRT   = 30 * time.Second
+	reqMaxRC   = 10
+	renTimeout = 10 * time.Second
+	renMaxRT   = 600 * time.Second
+	rebTimeout = 10 * time.Second
+	rebMaxRT   = 600 * time.Second
+)
+
+var (
+	errTimeout = errors.New("no reply")
+	errRefused = errors.New("prefix delegation refused")
+)
+
+// Delegation is a prefix delegated to a PDClient.
+type Delegation struct {
+	Prefix            *net.IPNet
+	PreferredLifetime time.Duration
+	ValidLifetime     time.Duration
+	T1, T2            time.Duration
+	Server            []byte // DUID of the delegating server
+	Acquired          time.Time
+}
+
+// Subnet returns the n-th /64 of the delegated prefix.
+func (d *Delegation) Subnet(n int) (*net.IPNet, error) {
+	ones, _ := d.Prefix.Mask.Size()
+	if ones > 64 || n < 0 || ones < 64 && uint64(n) >= 1<<(64-ones) || ones == 64 && n > 0 {
+		return nil, fmt.Errorf("%v has no /64 number %d", d.Prefix, n)
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, d.Prefix.IP.To16())
+	binary.BigEndian.PutUint64(ip, binary.BigEndian.Uint64(ip)|uint64(n))
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(64, 128)}, nil
+}
+
+// PDClient acquires and keeps a delegated prefix (RFC 8415 section 6.3)
+// for a single IA_PD.
+type PDClient struct {
+	// Conn is bound to ClientPort on the upstream interface, and Server
+	// is the address to send to, typically AllServers on that interface.
+	Conn   net.PacketConn
+	Server net.Addr
+
+	DUID         []byte
+	IAID         uint32
+	PrefixLength int // to ask for, or 0
+
+	// Changed is called with the delegation whenever it is acquired or
+	// extended, and with nil once it is lost.
+	Changed func(*Delegation)
+}
+
+// Run acquires a prefix, renews and rebinds it, and acquires another once
+// it expires, until ctx is done or reading from Conn fails.
+func (c *PDClient) Run(ctx context.Context) error {
+	for {
+		d, err := c.acquire(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, errTimeout) || errors.Is(err, errRefused) {
+				continue
+			}
+			return err
+		}
+		c.Changed(d)
+
+		for d != nil {
+			t1, t2 := d.Acquired.Add(d.T1), d.Acquired.Add(d.T2)
+			expiry := d.Acquired.Add(d.ValidLifetime)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(time.Until(t1)):
+			}
+			renewed, err := c.extend(ctx, Renew, d, renTimeout, renMaxRT, t2)
+			if errors.Is(err, errTimeout) {
+				renewed, err = c.extend(ctx, Rebind, d, rebTimeout, rebMaxRT, expiry)
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				slog.Warn("prefix delegation lost", "prefix", d.Prefix, "err", err)
+				d = nil
+			} else {
+				d = renewed
+			}
+			c.Changed(d)
+		}
+	}
+}
+
+// acquire solicits servers and requests a prefix from the first to
+// advertise one.
+func (c *PDClient) acquire(ctx context.Context) (*Delegation, error) {
+	solicit := c.message(Solicit, nil, nil)
+	adv, err := c.exchange(ctx, solicit, solTimeout, solMaxRT, 0, time.Time{}, func(m *Message) bool {
+		if m.Type != Advertise {
+			return false
+		}
+		_, err := c.delegation(m)
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	server, _ := adv.Options.Get(OptionServerID)
+	offered, _ := c.delegation(adv)
+	request := c.message(Request, server, offered.Prefix)
+	reply, err := c.exchange(ctx, request, reqTimeout, reqMaxRT, reqMaxRC, time.Time{}, func(m *Message) bool {
+		return m.Type == Reply
+	})
+	if err != nil {
+		return nil, err
+	}
+	d, err := c.delegation(reply)
+	if err != nil {
+		// Start over, without flooding a server that keeps refusing.
+		slog.Warn("prefix delegation refused", "err", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(solMaxRT / 60):
+		}
+		return nil, fmt.Errorf("%w: %v", errRefused, err)
+	}
+	slog.Info("prefix delegated", "prefix", d.Prefix, "valid", d.ValidLifetime, "server", FormatDUID(d.Server))
+	return d, nil
+}
+
+// extend renews (sending to the server of d) or rebinds (sending to any
+// server) d until deadline.
+func (c *PDClient) extend(ctx context.Context, t MessageType, d *Delegation, irt, mrt time.Duration, deadline time.Time) (*Delegation, error) {
+	var server []byte
+	if t == Renew {
+		server = d.Server
+	}
+	reply, err := c.exchange(ctx, c.message(t, server, d.Prefix), irt, mrt, 0, deadline, func(m *Message) bool {
+		return m.Type == Reply
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.delegation(reply)
+}
+
+// message returns a message of type t for the IA_PD, to server if it is
+// not nil, with prefix as a hint if it is not nil.
+func (c *PDClient) message(t MessageType, server []byte, prefix *net.IPNet) *Message {
+	m := &Message{Type: t}
+	rand.Read(m.TransactionID[:])
+	m.Options.Add(OptionClientID, c.DUID)
+	if server != nil {
+		m.Options.Add(OptionServerID, server)
+	}
+	m.Options.Add(OptionElapsedTime, []byte{0, 0})
+	ia := IANA{IAID: c.IAID}
+	if prefix == nil && c.PrefixLength > 0 {
+		prefix = &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(c.PrefixLength, 128)}
+	}
+	if prefix != nil {
+		ia.Options.Add(OptionIAPrefix, IAPrefix{Prefix: prefix}.Marshal())
+	}
+	m.Options.Add(OptionIAPD, ia.Marshal())
+	return m
+}
+
+// delegation returns the prefix delegated for the IA_PD in m.
+func (c *PDClient) delegation(m *Message) (*Delegation, error) {
+	if code, msg := m.Options.Status(); code != StatusSuccess {
+		return nil, fmt.Errorf("status %d: %s", code, msg)
+	}
+	server, ok := m.Options.Get(OptionServerID)
+	if !ok {
+		return nil, errors.New("no server identifier")
+	}
+	for _, o := range m.Options {
+		if o.Code != OptionIAPD {
+			continue
+		}
+		ia, err := ParseIANA(o.Data)
+		if err != nil || ia.IAID != c.IAID {
+			continue
+		}
+		if code, msg := ia.Options.Status(); code != StatusSuccess {
+			return nil, fmt.Errorf("status %d: %s", code, msg)
+		}
+		for _, po := range ia.Options {
+			if po.Code != OptionIAPrefix {
+				continue
+			}
+			p, err := ParseIAPrefix(po.Data)
+			if err != nil || p.ValidLifetime == 0 || p.PreferredLifetime > p.ValidLifetime {
+				continue
+			}
+			d := &Delegation{
+				Prefix:            p.Prefix,
+				PreferredLifetime: p.PreferredLifetime,
+				ValidLifetime:     p.ValidLifetime,
+				T1:                ia.T1,
+				T2:                ia.T2,
+				Server:            server,
+				Acquired:          time.Now(),
+			}
+			// Zero times are left to the client (RFC 8415 section
+			// 21.21).
+			if d.T1 == 0 || d.T2 == 0 || d.T1 > d.T2 {
+				d.T1 = d.PreferredLifetime / 2
+				d.T2 = d.PreferredLifetime * 4 / 5
+			}
+			return d, nil
+		}
+	}
+	return nil, errors.New("no prefix delegated")
+}
+
+// exchange sends m until a reply with its transaction ID is accepted,
+// retransmitting with exponential backoff from irt up to mrt, for at most
+// mrc transmissions (if not 0) and until deadline (if not zero).
+func (c *PDClient) exchange(ctx context.Context, m *Message, irt, mrt time.Duration, mrc int, deadline time.Time, accept func(*Message) bool) (*Message, error) {
+	start := time.Now()
+	rt := jitter(irt)
+	buf := make([]byte, 1500)
+	for n := 1; ; n++ {
+		elapsed := min(time.Since(start)/(10*time.Millisecond), math.MaxUint16)
+		for i, o := range m.Options {
+			if o.Code == OptionElapsedTime {
+				m.Options[i].Data = binary.BigEndian.AppendUint16(nil, uint16(elapsed))
+			}
+		}
+		if _, err := c.Conn.WriteTo(m.Marshal(), c.Server); err != nil {
+			slog.Debug("dhcpv6 client write err", "type", m.Type, "err", err)
+		}
+
+		wait := time.Now().Add(rt)
+		if !deadline.IsZero() && deadline.Before(wait) {
+			wait = deadline
+		}
+		for {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			// Wake up now and then to notice ctx being done.
+			c.Conn.SetReadDeadline(minTime(wait, time.Now().Add(time.Second)))
+			nr, _, err := c.Conn.ReadFrom(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					if time.Now().Before(wait) {
+						continue
+					}
+					break
+				}
+				return nil, err
+			}
+			reply, err := Parse(buf[:nr])
+			if err != nil || reply.TransactionID != m.TransactionID {
+				continue
+			}
+			if clientID, _ := reply.Options.Get(OptionClientID); string(clientID) != string(c.DUID) {
+				continue
+			}
+			if accept(reply) {
+				return reply, nil
+			}
+		}
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) || mrc > 0 && n >= mrc {
+			return nil, errTimeout
+		}
+		rt = min(2*rt, jitter(mrt))
+	}
+}
+
+// jitter returns d randomized by up to ±10%.
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration(mrand.Int63n(int64(d)/5+1)) - d/10
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,480 @@
+// Package dhcp6d implements a stateful DHCPv6 server (RFC 8415) that
+// assigns addresses from a pool with IA_NA to clients on the local link.
+package dhcp6d
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Lease is the binding of an address to an IA_NA of a client.
+type Lease struct {
+	Addr         net.IP    `json:"addr"`
+	DUID         string    `json:"duid"` // as formatted by FormatDUID
+	IAID         uint32    `json:"iaid"`
+	HardwareAddr string    `json:"hardware_addr,omitempty"` // from the DUID, if it has one
+	Hostname     string    `json:"hostname,omitempty"`      // from the Client FQDN option
+	Expiry       time.Time `json:"expiry"`
+}
+
+// Expired reports whether the lease is no longer valid at t.
+func (l *Lease) Expired(at time.Time) bool {
+	return at.After(l.Expiry)
+}
+
+// StaticLease assigns a fixed address to the first IA_NA of a client.
+type StaticLease struct {
+	DUID     string // as formatted by FormatDUID
+	Addr     net.IP
+	Hostname string
+}
+
+type bindingKey struct {
+	duid string
+	iaid uint32
+}
+
+// Handler answers the messages of clients on one link.
+type Handler struct {
+	serverDUID   []byte
+	prefix       *net.IPNet
+	start        net.IP // first address of the pool
+	size         int
+	preferred    time.Duration
+	valid        time.Duration
+	dnsServers   []net.IP
+	domainSearch []string
+	rapidCommit  bool
+	stateless    bool
+	static       map[string]StaticLease // by DUID
+	staticAddrs  map[string]string      // DUIDs by address
+
+	// Leases is called with all leases whenever a binding changes.
+	Leases func([]Lease)
+
+	mu       sync.Mutex
+	leases   map[string]*Lease // by address
+	bindings map[bindingKey]*Lease
+	declined map[string]time.Time // addresses declined by clients, until
+
+	timeNow func() time.Time
+}
+
+// NewHandler returns a handler identified by serverDUID that assigns the
+// leaseRange addresses from startIP, all in the on-link prefix.
+func NewHandler(serverDUID []byte, prefix *net.IPNet, startIP net.IP, leaseRange int, opts ...HandlerOption) (*Handler, error) {
+	options := options{
+		preferred: time.Hour,
+		valid:     2 * time.Hour,
+	}
+	for _, opt := range opts {
+		opt.set(&options)
+	}
+	if startIP.To4() != nil || startIP.To16() == nil || !prefix.Contains(startIP) {
+		return nil, fmt.Errorf("start address %v is not in %v", startIP, prefix)
+	}
+	if leaseRange <= 0 {
+		return nil, fmt.Errorf("range must be positive")
+	}
+	if options.valid < options.preferred {
+		return nil, fmt.Errorf("valid lifetime %v is shorter than the preferred lifetime %v", options.valid, options.preferred)
+	}
+	h := &Handler{
+		serverDUID:   serverDUID,
+		prefix:       prefix,
+		start:        startIP.To16(),
+		size:         leaseRange,
+		preferred:    options.preferred,
+		valid:        options.valid,
+		dnsServers:   options.dnsServers,
+		domainSearch: options.domainSearch,
+		rapidCommit:  options.rapidCommit,
+		static:       make(map[string]StaticLease),
+		staticAddrs:  make(map[string]string),
+		leases:       make(map[string]*Lease),
+		bindings:     make(map[bindingKey]*Lease),
+		declined:     make(map[string]time.Time),
+		timeNow:      time.Now,
+	}
+	if !prefix.Contains(h.addr(leaseRange - 1)) {
+		return nil, fmt.Errorf("%d addresses from %v overflow %v", leaseRange, startIP, prefix)
+	}
+	for _, sl := range options.staticLeases {
+		if !prefix.Contains(sl.Addr) || sl.Addr.To4() != nil {
+			return nil, fmt.Errorf("static lease %s: address %v is not in %v", sl.DUID, sl.Addr, prefix)
+		}
+		if other, dup := h.staticAddrs[sl.Addr.String()]; dup {
+			return nil, fmt.Errorf("static leases %s and %s have the same address %v", other, sl.DUID, sl.Addr)
+		}
+		h.static[sl.DUID] = sl
+		h.staticAddrs[sl.Addr.String()] = sl.DUID
+	}
+	return h, nil
+}
+
+// NewStatelessHandler returns a handler identified by serverDUID that only
+// answers INFORMATION-REQUEST messages, for links whose hosts configure
+// their addresses with SLAAC. It keeps no state.
+func NewStatelessHandler(serverDUID []byte, opts ...HandlerOption) *Handler {
+	var options options
+	for _, opt := range opts {
+		opt.set(&options)
+	}
+	return &Handler{
+		serverDUID:   serverDUID,
+		dnsServers:   options.dnsServers,
+		domainSearch: options.domainSearch,
+		stateless:    true,
+		timeNow:      time.Now,
+	}
+}
+
+// SetLeases overwrites the leases with leases, typically loaded from
+// persistent storage. Leases outside the prefix are dropped.
+func (h *Handler) SetLeases(leases []Lease) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.leases = make(map[string]*Lease)
+	h.bindings = make(map[bindingKey]*Lease)
+	for _, l := range leases {
+		if !h.prefix.Contains(l.Addr) {
+			continue
+		}
+		l := l
+		h.leases[l.Addr.String()] = &l
+		h.bindings[bindingKey{l.DUID, l.IAID}] = &l
+	}
+}
+
+// ListLeases returns the leases ordered by address.
+func (h *Handler) ListLeases() []Lease {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.listLeasesLocked()
+}
+
+func (h *Handler) listLeasesLocked() []Lease {
+	leases := make([]Lease, 0, len(h.leases))
+	for _, l := range h.leases {
+		leases = append(leases, *l)
+	}
+	slices.SortFunc(leases, func(a, b Lease) int {
+		return bytes.Compare(a.Addr.To16(), b.Addr.To16())
+	})
+	return leases
+}
+
+// ServeDHCP returns the reply to m, or nil if it should not be answered.
+func (h *Handler) ServeDHCP(m *Message) *Message {
+	if h.stateless && m.Type != InformationRequest {
+		return nil
+	}
+	clientID, hasClient := m.Options.Get(OptionClientID)
+	serverID, hasServer := m.Options.Get(OptionServerID)
+	switch m.Type {
+	case Solicit, Rebind, Confirm:
+		if !hasClient || hasServer {
+			return nil
+		}
+	case Request, Renew, Release, Decline:
+		if !hasClient || !bytes.Equal(serverID, h.serverDUID) {
+			return nil
+		}
+	case InformationRequest:
+		if hasServer && !bytes.Equal(serverID, h.serverDUID) {
+			return nil
+		}
+		if _, ok := m.Options.Get(OptionIANA); ok {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	reply := &Message{Type: Reply, TransactionID: m.TransactionID}
+	reply.Options.Add(OptionServerID, h.serverDUID)
+	if hasClient {
+		reply.Options.Add(OptionClientID, clientID)
+	}
+
+	h.mu.Lock()
+	changed := false
+	switch m.Type {
+	case Solicit:
+		if _, ok := m.Options.Get(OptionRapidCommit); ok && h.rapidCommit {
+			reply.Options.Add(OptionRapidCommit, nil)
+			changed = h.assignLocked(m, reply, clientID, true)
+		} else {
+			reply.Type = Advertise
+			h.assignLocked(m, reply, clientID, false)
+		}
+	case Request, Renew, Rebind:
+		changed = h.assignLocked(m, reply, clientID, true)
+	case Release:
+		changed = h.releaseLocked(m, clientID)
+		reply.Options.Add(OptionStatusCode, StatusCode(StatusSuccess, "released"))
+	case Decline:
+		changed = h.declineLocked(m, clientID)
+		reply.Options.Add(OptionStatusCode, StatusCode(StatusSuccess, "declined"))
+	case Confirm:
+		status, ok := h.confirm(m)
+		if !ok {
+			h.mu.Unlock()
+			return nil
+		}
+		reply.Options.Add(OptionStatusCode, status)
+	}
+	var leases []Lease
+	if changed {
+		leases = h.listLeasesLocked()
+	}
+	h.mu.Unlock()
+
+	if changed && h.Leases != nil {
+		h.Leases(leases)
+	}
+	h.addConfigOptions(m, reply)
+	slog.Debug("dhcpv6 reply", "type", m.Type, "reply", reply.Type, "client", FormatDUID(clientID))
+	return reply
+}
+
+// addConfigOptions adds the configuration options requested in m.
+func (h *Handler) addConfigOptions(m, reply *Message) {
+	if len(h.dnsServers) > 0 && m.Options.Requested(OptionDNSServers) {
+		var b []byte
+		for _, ip := range h.dnsServers {
+			b = append(b, ip.To16()...)
+		}
+		reply.Options.Add(OptionDNSServers, b)
+	}
+	if len(h.domainSearch) > 0 && m.Options.Requested(OptionDomainList) {
+		reply.Options.Add(OptionDomainList, AppendDomainNames(nil, h.domainSearch...))
+	}
+}
+
+// assignLocked adds an address to reply for every IA_NA of m, binding them
+// if commit is set. It reports whether a binding changed.
+func (h *Handler) assignLocked(m, reply *Message, clientID []byte, commit bool) bool {
+	duid := FormatDUID(clientID)
+	now := h.timeNow()
+	var hostname string
+	if fqdn, ok := m.Options.Get(OptionClientFQDN); ok {
+		hostname = fqdnHostname(fqdn)
+	}
+	changed := false
+	for _, o := range m.Options {
+		if o.Code != OptionIANA {
+			continue
+		}
+		ia, err := ParseIANA(o.Data)
+		if err != nil {
+			continue
+		}
+		var hints []net.IP
+		for _, ao := range ia.Options {
+			if ao.Code != OptionIAAddr {
+				continue
+			}
+			if a, err := ParseIAAddr(ao.Data); err == nil {
+				hints = append(hints, a.Addr)
+			}
+		}
+
+		answer := IANA{IAID: ia.IAID}
+		addr := h.allocateLocked(duid, ia.IAID, hints, now)
+		if addr == nil {
+			answer.Options.Add(OptionStatusCode, StatusCode(StatusNoAddrsAvail, "no addresses available"))
+			reply.Options.Add(OptionIANA, answer.Marshal())
+			continue
+		}
+		if commit {
+			h.bindLocked(duid, ia.IAID, addr, hostname, now)
+			changed = true
+		}
+		answer.T1 = h.preferred / 2
+		answer.T2 = h.preferred * 4 / 5
+		answer.Options.Add(OptionIAAddr, IAAddr{Addr: addr, PreferredLifetime: h.preferred, ValidLifetime: h.valid}.Marshal())
+		// Addresses the client has that it cannot keep.
+		if m.Type == Renew || m.Type == Rebind {
+			for _, hint := range hints {
+				if !hint.Equal(addr) {
+					answer.Options.Add(OptionIAAddr, IAAddr{Addr: hint}.Marshal())
+				}
+			}
+		}
+		reply.Options.Add(OptionIANA, answer.Marshal())
+	}
+	return changed
+}
+
+// allocateLocked returns the address for the IA iaid of the client duid: its
+// static address, its current one, one it asked for or else a free one, or
+// nil if the pool is exhausted.
+func (h *Handler) allocateLocked(duid string, iaid uint32, hints []net.IP, now time.Time) net.IP {
+	if sl, ok := h.static[duid]; ok {
+		if l, ok := h.leases[sl.Addr.String()]; !ok || l.DUID != duid || l.IAID == iaid || l.Expired(now) {
+			return sl.Addr
+		}
+	}
+	if l, ok := h.bindings[bindingKey{duid, iaid}]; ok && h.freeLocked(l.Addr, duid, iaid, now) {
+		return l.Addr
+	}
+	for _, hint := range hints {
+		if h.offset(hint) >= 0 && h.freeLocked(hint, duid, iaid, now) {
+			return hint
+		}
+	}
+	// Start from a position derived from the client so that clients tend
+	// to get the same address even if their binding was lost.
+	f := fnv.New32a()
+	fmt.Fprintf(f, "%s/%d", duid, iaid)
+	first := int(f.Sum32() % uint32(h.size))
+	for i := 0; i < h.size; i++ {
+		addr := h.addr((first + i) % h.size)
+		if h.freeLocked(addr, duid, iaid, now) {
+			return addr
+		}
+	}
+	return nil
+}
+
+// freeLocked reports whether addr may be bound to the IA iaid of duid.
+func (h *Handler) freeLocked(addr net.IP, duid string, iaid uint32, now time.Time) bool {
+	if owner, ok := h.staticAddrs[addr.String()]; ok && owner != duid {
+		return false
+	}
+	if until, ok := h.declined[addr.String()]; ok {
+		if now.Before(until) {
+			return false
+		}
+		delete(h.declined, addr.String())
+	}
+	l, ok := h.leases[addr.String()]
+	return !ok || l.Expired(now) || l.DUID == duid && l.IAID == iaid
+}
+
+func (h *Handler) bindLocked(duid string, iaid uint32, addr net.IP, hostname string, now time.Time) {
+	key := bindingKey{duid, iaid}
+	if old, ok := h.bindings[key]; ok && !old.Addr.Equal(addr) {
+		delete(h.leases, old.Addr.String())
+	}
+	if other, ok := h.leases[addr.String()]; ok {
+		delete(h.bindings, bindingKey{other.DUID, other.IAID})
+	}
+	l := &Lease{
+		Addr:     addr,
+		DUID:     duid,
+		IAID:     iaid,
+		Hostname: hostname,
+		Expiry:   now.Add(h.valid),
+	}
+	if sl, ok := h.static[duid]; ok && sl.Addr.Equal(addr) && sl.Hostname != "" {
+		l.Hostname = sl.Hostname
+	}
+	if duidBytes, err := ParseDUID(duid); err == nil {
+		if hw, ok := DUIDHardwareAddr(duidBytes); ok {
+			l.HardwareAddr = hw.String()
+		}
+	}
+	h.leases[addr.String()] = l
+	h.bindings[key] = l
+}
+
+// releaseLocked removes the bindings of the IAs of m.
+func (h *Handler) releaseLocked(m *Message, clientID []byte) bool {
+	duid := FormatDUID(clientID)
+	changed := false
+	for _, o := range m.Options {
+		if o.Code != OptionIANA {
+			continue
+		}
+		ia, err := ParseIANA(o.Data)
+		if err != nil {
+			continue
+		}
+		key := bindingKey{duid, ia.IAID}
+		if l, ok := h.bindings[key]; ok {
+			delete(h.bindings, key)
+			delete(h.leases, l.Addr.String())
+			changed = true
+		}
+	}
+	return changed
+}
+
+// declineLocked removes the bindings of the addresses declined in m and
+// keeps the addresses from being assigned for the valid lifetime.
+func (h *Handler) declineLocked(m *Message, clientID []byte) bool {
+	changed := h.releaseLocked(m, clientID)
+	until := h.timeNow().Add(h.valid)
+	for _, o := range m.Options {
+		if o.Code != OptionIANA {
+			continue
+		}
+		ia, err := ParseIANA(o.Data)
+		if err != nil {
+			continue
+		}
+		for _, ao := range ia.Options {
+			if a, err := ParseIAAddr(ao.Data); ao.Code == OptionIAAddr && err == nil {
+				slog.Warn("dhcpv6 address declined", "ip", a.Addr, "client", FormatDUID(clientID))
+				h.declined[a.Addr.String()] = until
+			}
+		}
+	}
+	return changed
+}
+
+// confirm returns the status of a CONFIRM: whether the client's addresses
+// are on the link. It reports false if the message holds no addresses.
+func (h *Handler) confirm(m *Message) ([]byte, bool) {
+	found := false
+	for _, o := range m.Options {
+		if o.Code != OptionIANA {
+			continue
+		}
+		ia, err := ParseIANA(o.Data)
+		if err != nil {
+			continue
+		}
+		for _, ao := range ia.Options {
+			a, err := ParseIAAddr(ao.Data)
+			if ao.Code != OptionIAAddr || err != nil {
+				continue
+			}
+			if !h.prefix.Contains(a.Addr) {
+				return StatusCode(StatusNotOnLink, "not on link"), true
+			}
+			found = true
+		}
+	}
+	return StatusCode(StatusSuccess, "on link"), found
+}
+
+// addr returns the n-th address of the pool.
+func (h *Handler) addr(n int) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, h.start)
+	binary.BigEndian.PutUint64(ip[8:], binary.BigEndian.Uint64(h.start[8:])+uint64(n))
+	return ip
+}
+
+// offset returns the position of ip in the pool, or -1.
+func (h *Handler) offset(ip net.IP) int {
+	ip = ip.To16()
+	if ip == nil || ip.To4() != nil || !bytes.Equal(ip[:8], h.start[:8]) {
+		return -1
+	}
+	n := binary.BigEndian.Uint64(ip[8:]) - binary.BigEndian.Uint64(h.start[8:])
+	if n >= uint64(h.size) {
+		return -1
+	}
+	return int(n)
+}
@@ -0,0 +1,241 @@
+package dhcp6d
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	serverDUID = DUIDLL(net.HardwareAddr{0x02, 0, 0, 0, 0, 1})
+	clientDUID = DUIDLL(net.HardwareAddr{0x22, 0x33, 0x44, 0x55, 0x66, 0x77})
+)
+
+func testHandler(t *testing.T, opts ...HandlerOption) *Handler {
+	t.Helper()
+	_, prefix, _ := net.ParseCIDR("fd00::/64")
+	h, err := NewHandler(serverDUID, prefix, net.ParseIP("fd00::100"), 10, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func clientMessage(t MessageType, server []byte, ias ...IANA) *Message {
+	m := &Message{Type: t, TransactionID: [3]byte{1, 2, 3}}
+	m.Options.Add(OptionClientID, clientDUID)
+	if server != nil {
+		m.Options.Add(OptionServerID, server)
+	}
+	m.Options.Add(OptionORO, binary.BigEndian.AppendUint16(nil, uint16(OptionDNSServers)))
+	for _, ia := range ias {
+		m.Options.Add(OptionIANA, ia.Marshal())
+	}
+	return m
+}
+
+// replyAddr returns the address of the first IA_NA of m.
+func replyAddr(t *testing.T, m *Message) net.IP {
+	t.Helper()
+	b, ok := m.Options.Get(OptionIANA)
+	if !ok {
+		t.Fatalf("%v has no IA_NA", m.Type)
+	}
+	ia, err := ParseIANA(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, ok = ia.Options.Get(OptionIAAddr)
+	if !ok {
+		t.Fatalf("IA_NA has no address: %v", ia.Options)
+	}
+	a, err := ParseIAAddr(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a.Addr
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	m := clientMessage(Request, serverDUID, IANA{IAID: 7, T1: time.Minute, T2: 2 * time.Minute})
+	got, err := Parse(m.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != Request || got.TransactionID != m.TransactionID || len(got.Options) != len(m.Options) {
+		t.Fatalf("Parse(Marshal()) = %+v, want %+v", got, m)
+	}
+	b, _ := got.Options.Get(OptionIANA)
+	ia, err := ParseIANA(b)
+	if err != nil || ia.IAID != 7 || ia.T2 != 2*time.Minute {
+		t.Errorf("IA_NA = %+v, %v", ia, err)
+	}
+	if hw, ok := DUIDHardwareAddr(clientDUID); !ok || hw.String() != "22:33:44:55:66:77" {
+		t.Errorf("DUIDHardwareAddr = %v, %v", hw, ok)
+	}
+}
+
+func TestSolicitRequest(t *testing.T) {
+	var saved []Lease
+	h := testHandler(t, WithDNS([]net.IP{net.ParseIP("fd00::1")}, nil))
+	h.Leases = func(leases []Lease) { saved = leases }
+
+	adv := h.ServeDHCP(clientMessage(Solicit, nil, IANA{IAID: 1}))
+	if adv == nil || adv.Type != Advertise {
+		t.Fatalf("SOLICIT reply = %+v, want ADVERTISE", adv)
+	}
+	if dns, _ := adv.Options.Get(OptionDNSServers); !bytes.Equal(dns, net.ParseIP("fd00::1")) {
+		t.Errorf("DNS servers = %x", dns)
+	}
+	addr := replyAddr(t, adv)
+	if h.offset(addr) < 0 {
+		t.Fatalf("advertised %v outside the pool", addr)
+	}
+	if len(saved) != 0 {
+		t.Fatalf("ADVERTISE committed leases: %v", saved)
+	}
+
+	if reply := h.ServeDHCP(clientMessage(Request, []byte("other server"), IANA{IAID: 1})); reply != nil {
+		t.Fatalf("answered a REQUEST for another server: %+v", reply)
+	}
+	reply := h.ServeDHCP(clientMessage(Request, serverDUID, IANA{IAID: 1}))
+	if reply == nil || reply.Type != Reply {
+		t.Fatalf("REQUEST reply = %+v, want REPLY", reply)
+	}
+	if got := replyAddr(t, reply); !got.Equal(addr) {
+		t.Errorf("REQUEST got %v, want advertised %v", got, addr)
+	}
+	if len(saved) != 1 || !saved[0].Addr.Equal(addr) || saved[0].HardwareAddr != "22:33:44:55:66:77" {
+		t.Fatalf("leases = %+v", saved)
+	}
+
+	// Another IA of the same client gets another address.
+	reply = h.ServeDHCP(clientMessage(Request, serverDUID, IANA{IAID: 2}))
+	if got := replyAddr(t, reply); got.Equal(addr) {
+		t.Errorf("second IA got the same address %v", got)
+	}
+
+	h.ServeDHCP(clientMessage(Release, serverDUID, IANA{IAID: 1}, IANA{IAID: 2}))
+	if len(saved) != 0 {
+		t.Errorf("leases after RELEASE = %+v", saved)
+	}
+}
+
+func TestStaticLease(t *testing.T) {
+	static := net.ParseIP("fd00::53")
+	h := testHandler(t, WithStaticLeases(StaticLease{DUID: FormatDUID(clientDUID), Addr: static, Hostname: "printer"}))
+	reply := h.ServeDHCP(clientMessage(Request, serverDUID, IANA{IAID: 1}))
+	if got := replyAddr(t, reply); !got.Equal(static) {
+		t.Fatalf("got %v, want static %v", got, static)
+	}
+	if leases := h.ListLeases(); len(leases) != 1 || leases[0].Hostname != "printer" {
+		t.Errorf("leases = %+v", leases)
+	}
+}
+
+func TestPoolExhausted(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("fd00::/64")
+	h, err := NewHandler(serverDUID, prefix, net.ParseIP("fd00::100"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.ServeDHCP(clientMessage(Request, serverDUID, IANA{IAID: 1}))
+	reply := h.ServeDHCP(clientMessage(Request, serverDUID, IANA{IAID: 2}))
+	b, _ := reply.Options.Get(OptionIANA)
+	ia, err := ParseIANA(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, ok := ia.Options.Get(OptionStatusCode)
+	if !ok || binary.BigEndian.Uint16(status) != StatusNoAddrsAvail {
+		t.Errorf("IA_NA options = %+v, want NoAddrsAvail", ia.Options)
+	}
+}
+
+func TestStateless(t *testing.T) {
+	h := NewStatelessHandler(serverDUID, WithDNS([]net.IP{net.ParseIP("fd00::1")}, nil))
+	if reply := h.ServeDHCP(clientMessage(Solicit, nil, IANA{IAID: 1})); reply != nil {
+		t.Fatalf("stateless handler answered SOLICIT: %+v", reply)
+	}
+	reply := h.ServeDHCP(clientMessage(InformationRequest, nil))
+	if reply == nil || reply.Type != Reply {
+		t.Fatalf("INFORMATION-REQUEST reply = %+v, want REPLY", reply)
+	}
+	if dns, _ := reply.Options.Get(OptionDNSServers); !bytes.Equal(dns, net.ParseIP("fd00::1")) {
+		t.Errorf("DNS servers = %x", dns)
+	}
+	if _, ok := reply.Options.Get(OptionIANA); ok {
+		t.Error("reply has an IA_NA")
+	}
+}
+
+func TestPDClient(t *testing.T) {
+	serverConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	clientConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	_, delegated, _ := net.ParseCIDR("2001:db8:0:100::/56")
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := serverConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			m, err := Parse(buf[:n])
+			if err != nil {
+				continue
+			}
+			reply := &Message{Type: Reply, TransactionID: m.TransactionID}
+			if m.Type == Solicit {
+				reply.Type = Advertise
+			}
+			clientID, _ := m.Options.Get(OptionClientID)
+			reply.Options.Add(OptionClientID, clientID)
+			reply.Options.Add(OptionServerID, serverDUID)
+			ia := IANA{IAID: 1, T1: time.Hour, T2: 2 * time.Hour}
+			ia.Options.Add(OptionIAPrefix, IAPrefix{Prefix: delegated, PreferredLifetime: 3 * time.Hour, ValidLifetime: 4 * time.Hour}.Marshal())
+			reply.Options.Add(OptionIAPD, ia.Marshal())
+			serverConn.WriteTo(reply.Marshal(), from)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan *Delegation, 1)
+	c := &PDClient{
+		Conn:         clientConn,
+		Server:       serverConn.LocalAddr(),
+		DUID:         clientDUID,
+		IAID:         1,
+		PrefixLength: 56,
+		Changed:      func(d *Delegation) { got <- d },
+	}
+	go c.Run(ctx)
+	var d *Delegation
+	select {
+	case d = <-got:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no prefix delegated")
+	}
+	if d.Prefix.String() != delegated.String() || d.T1 != time.Hour || !bytes.Equal(d.Server, serverDUID) {
+		t.Errorf("delegation = %+v", d)
+	}
+	subnet, err := d.Subnet(1)
+	if err != nil || subnet.String() != "2001:db8:0:101::/64" {
+		t.Errorf("Subnet(1) = %v, %v", subnet, err)
+	}
+	if _, err := d.Subnet(256); err == nil {
+		t.Error("Subnet(256) of a /56 succeeded")
+	}
+}
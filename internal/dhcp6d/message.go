@@ -0,0 +1,370 @@
+package dhcp6d
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// MessageType is the type of a DHCPv6 message (RFC 8415 section 7.3).
+type MessageType byte
+
+const (
+	Solicit MessageType = 1 + iota
+	Advertise
+	Request
+	Confirm
+	Renew
+	Rebind
+	Reply
+	Release
+	Decline
+	Reconfigure
+	InformationRequest
+	RelayForw
+	RelayRepl
+)
+
+var messageTypeNames = []string{"", "SOLICIT", "ADVERTISE", "REQUEST", "CONFIRM", "RENEW", "REBIND", "REPLY", "RELEASE", "DECLINE", "RECONFIGURE", "INFORMATION-REQUEST", "RELAY-FORW", "RELAY-REPL"}
+
+func (t MessageType) String() string {
+	if int(t) < len(messageTypeNames) && t > 0 {
+		return messageTypeNames[t]
+	}
+	return fmt.Sprintf("MessageType(%d)", t)
+}
+
+// OptionCode identifies an option.
+type OptionCode uint16
+
+const (
+	OptionClientID     OptionCode = 1
+	OptionServerID     OptionCode = 2
+	OptionIANA         OptionCode = 3
+	OptionIAAddr       OptionCode = 5
+	OptionORO          OptionCode = 6
+	OptionPreference   OptionCode = 7
+	OptionElapsedTime  OptionCode = 8
+	OptionStatusCode   OptionCode = 13
+	OptionRapidCommit  OptionCode = 14
+	OptionDNSServers   OptionCode = 23
+	OptionDomainList   OptionCode = 24
+	OptionIAPD         OptionCode = 25
+	OptionIAPrefix     OptionCode = 26
+	OptionInfRefreshTm OptionCode = 32
+	OptionClientFQDN   OptionCode = 39
+)
+
+// Status codes.
+const (
+	StatusSuccess       = 0
+	StatusUnspecFail    = 1
+	StatusNoAddrsAvail  = 2
+	StatusNoBinding     = 3
+	StatusNotOnLink     = 4
+	StatusUseMulticast  = 5
+	StatusNoPrefixAvail = 6
+)
+
+// Ports of clients and servers.
+const (
+	ClientPort = 546
+	ServerPort = 547
+)
+
+// AllServers is the All_DHCP_Relay_Agents_and_Servers group that clients
+// send to.
+var AllServers = net.ParseIP("ff02::1:2")
+
+// Option is an option of a message.
+type Option struct {
+	Code OptionCode
+	Data []byte
+}
+
+// Options is a list of options, in which some codes may repeat.
+type Options []Option
+
+// Get returns the data of the first option with code.
+func (o Options) Get(code OptionCode) ([]byte, bool) {
+	for _, opt := range o {
+		if opt.Code == code {
+			return opt.Data, true
+		}
+	}
+	return nil, false
+}
+
+// Add appends an option.
+func (o *Options) Add(code OptionCode, data []byte) {
+	*o = append(*o, Option{Code: code, Data: data})
+}
+
+// Requested reports whether the option request option of o lists code.
+func (o Options) Requested(code OptionCode) bool {
+	oro, _ := o.Get(OptionORO)
+	for ; len(oro) >= 2; oro = oro[2:] {
+		if OptionCode(binary.BigEndian.Uint16(oro)) == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Message is a client or server message. Relay messages are not supported.
+type Message struct {
+	Type          MessageType
+	TransactionID [3]byte
+	Options       Options
+}
+
+// Parse parses the message b.
+func Parse(b []byte) (*Message, error) {
+	if len(b) < 4 {
+		return nil, errors.New("short message")
+	}
+	m := &Message{Type: MessageType(b[0])}
+	if m.Type == RelayForw || m.Type == RelayRepl {
+		return nil, fmt.Errorf("unsupported message type %v", m.Type)
+	}
+	copy(m.TransactionID[:], b[1:4])
+	opts, err := parseOptions(b[4:])
+	if err != nil {
+		return nil, err
+	}
+	m.Options = opts
+	return m, nil
+}
+
+func parseOptions(b []byte) (Options, error) {
+	var opts Options
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, errors.New("truncated option")
+		}
+		code := OptionCode(binary.BigEndian.Uint16(b))
+		n := int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+n {
+			return nil, fmt.Errorf("truncated option %d", code)
+		}
+		opts = append(opts, Option{Code: code, Data: b[4 : 4+n]})
+		b = b[4+n:]
+	}
+	return opts, nil
+}
+
+func appendOptions(b []byte, opts Options) []byte {
+	for _, o := range opts {
+		b = binary.BigEndian.AppendUint16(b, uint16(o.Code))
+		b = binary.BigEndian.AppendUint16(b, uint16(len(o.Data)))
+		b = append(b, o.Data...)
+	}
+	return b
+}
+
+// Marshal returns the wire format of m.
+func (m *Message) Marshal() []byte {
+	b := append([]byte{byte(m.Type)}, m.TransactionID[:]...)
+	return appendOptions(b, m.Options)
+}
+
+// IANA is an Identity Association for Non-temporary Addresses.
+type IANA struct {
+	IAID    uint32
+	T1, T2  time.Duration
+	Options Options
+}
+
+// ParseIANA parses the data of an IA_NA option, or of an IA_PD option,
+// which has the same layout.
+func ParseIANA(b []byte) (IANA, error) {
+	if len(b) < 12 {
+		return IANA{}, errors.New("short IA_NA")
+	}
+	opts, err := parseOptions(b[12:])
+	if err != nil {
+		return IANA{}, err
+	}
+	return IANA{
+		IAID:    binary.BigEndian.Uint32(b),
+		T1:      time.Duration(binary.BigEndian.Uint32(b[4:])) * time.Second,
+		T2:      time.Duration(binary.BigEndian.Uint32(b[8:])) * time.Second,
+		Options: opts,
+	}, nil
+}
+
+// Marshal returns the data of the IA_NA option.
+func (ia IANA) Marshal() []byte {
+	b := binary.BigEndian.AppendUint32(nil, ia.IAID)
+	b = binary.BigEndian.AppendUint32(b, seconds(ia.T1))
+	b = binary.BigEndian.AppendUint32(b, seconds(ia.T2))
+	return appendOptions(b, ia.Options)
+}
+
+// IAAddr is an address of an IA_NA.
+type IAAddr struct {
+	Addr              net.IP
+	PreferredLifetime time.Duration
+	ValidLifetime     time.Duration
+	Options           Options
+}
+
+// ParseIAAddr parses the data of an IAADDR option.
+func ParseIAAddr(b []byte) (IAAddr, error) {
+	if len(b) < 24 {
+		return IAAddr{}, errors.New("short IAADDR")
+	}
+	opts, err := parseOptions(b[24:])
+	if err != nil {
+		return IAAddr{}, err
+	}
+	return IAAddr{
+		Addr:              net.IP(b[:16]),
+		PreferredLifetime: time.Duration(binary.BigEndian.Uint32(b[16:])) * time.Second,
+		ValidLifetime:     time.Duration(binary.BigEndian.Uint32(b[20:])) * time.Second,
+		Options:           opts,
+	}, nil
+}
+
+// Marshal returns the data of the IAADDR option.
+func (a IAAddr) Marshal() []byte {
+	b := append([]byte(nil), a.Addr.To16()...)
+	b = binary.BigEndian.AppendUint32(b, seconds(a.PreferredLifetime))
+	b = binary.BigEndian.AppendUint32(b, seconds(a.ValidLifetime))
+	return appendOptions(b, a.Options)
+}
+
+// IAPrefix is a prefix of an IA_PD (RFC 8415 section 21.22).
+type IAPrefix struct {
+	PreferredLifetime time.Duration
+	ValidLifetime     time.Duration
+	Prefix            *net.IPNet
+	Options           Options
+}
+
+// ParseIAPrefix parses the data of an IAPREFIX option.
+func ParseIAPrefix(b []byte) (IAPrefix, error) {
+	if len(b) < 25 || b[8] > 128 {
+		return IAPrefix{}, errors.New("short IAPREFIX")
+	}
+	opts, err := parseOptions(b[25:])
+	if err != nil {
+		return IAPrefix{}, err
+	}
+	ip := net.IP(append([]byte(nil), b[9:25]...))
+	mask := net.CIDRMask(int(b[8]), 128)
+	return IAPrefix{
+		PreferredLifetime: time.Duration(binary.BigEndian.Uint32(b)) * time.Second,
+		ValidLifetime:     time.Duration(binary.BigEndian.Uint32(b[4:])) * time.Second,
+		Prefix:            &net.IPNet{IP: ip.Mask(mask), Mask: mask},
+		Options:           opts,
+	}, nil
+}
+
+// Marshal returns the data of the IAPREFIX option.
+func (p IAPrefix) Marshal() []byte {
+	b := binary.BigEndian.AppendUint32(nil, seconds(p.PreferredLifetime))
+	b = binary.BigEndian.AppendUint32(b, seconds(p.ValidLifetime))
+	ones, _ := p.Prefix.Mask.Size()
+	b = append(b, byte(ones))
+	b = append(b, p.Prefix.IP.To16()...)
+	return appendOptions(b, p.Options)
+}
+
+// Status returns the code and message of the status code option in o,
+// which is success if there is none.
+func (o Options) Status() (uint16, string) {
+	b, ok := o.Get(OptionStatusCode)
+	if !ok || len(b) < 2 {
+		return StatusSuccess, ""
+	}
+	return binary.BigEndian.Uint16(b), string(b[2:])
+}
+
+// StatusCode returns the data of a status code option.
+func StatusCode(code uint16, msg string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, code), msg...)
+}
+
+// DUIDLL returns the DUID-LL (type 3) of an Ethernet address.
+func DUIDLL(hw net.HardwareAddr) []byte {
+	return append([]byte{0, 3, 0, 1}, hw...)
+}
+
+// DUIDHardwareAddr returns the link-layer address of a DUID-LLT or DUID-LL
+// of an Ethernet interface.
+func DUIDHardwareAddr(duid []byte) (net.HardwareAddr, bool) {
+	if len(duid) < 4 || binary.BigEndian.Uint16(duid[2:]) != 1 {
+		return nil, false
+	}
+	var hw []byte
+	switch binary.BigEndian.Uint16(duid) {
+	case 1: // DUID-LLT
+		if len(duid) != 14 {
+			return nil, false
+		}
+		hw = duid[8:]
+	case 3: // DUID-LL
+		if len(duid) != 10 {
+			return nil, false
+		}
+		hw = duid[4:]
+	default:
+		return nil, false
+	}
+	return net.HardwareAddr(append([]byte(nil), hw...)), true
+}
+
+// FormatDUID returns duid as colon-separated hex, the format of the
+// configuration and lease file.
+func FormatDUID(duid []byte) string {
+	return net.HardwareAddr(duid).String()
+}
+
+// ParseDUID parses a DUID in hex, optionally colon-separated.
+func ParseDUID(s string) ([]byte, error) {
+	duid, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil || len(duid) < 2 {
+		return nil, fmt.Errorf("invalid duid %q", s)
+	}
+	return duid, nil
+}
+
+// AppendDomainNames appends names in the uncompressed DNS wire format used
+// by the domain list and FQDN options.
+func AppendDomainNames(b []byte, names ...string) []byte {
+	for _, name := range names {
+		for _, label := range strings.Split(strings.Trim(name, "."), ".") {
+			if label == "" || len(label) > 63 {
+				continue
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+		b = append(b, 0)
+	}
+	return b
+}
+
+// fqdnHostname returns the first label of the name of a Client FQDN option
+// (RFC 4704).
+func fqdnHostname(b []byte) string {
+	if len(b) < 2 || int(b[1]) > len(b)-2 {
+		return ""
+	}
+	return string(b[2 : 2+b[1]])
+}
+
+func seconds(d time.Duration) uint32 {
+	if d < 0 {
+		return 0
+	}
+	if s := d / time.Second; s < 0xffffffff {
+		return uint32(s)
+	}
+	return 0xffffffff
+}
@@ -0,0 +1,75 @@
+package dhcp6d
+
+import (
+	"net"
+	"time"
+)
+
+type options struct {
+	preferred    time.Duration
+	valid        time.Duration
+	dnsServers   []net.IP
+	domainSearch []string
+	rapidCommit  bool
+	staticLeases []StaticLease
+}
+
+type HandlerOption interface {
+	set(*options)
+}
+
+type lifetimesOption struct {
+	preferred, valid time.Duration
+}
+
+func (l *lifetimesOption) set(o *options) {
+	o.preferred = l.preferred
+	o.valid = l.valid
+}
+
+// WithLifetimes sets the preferred and valid lifetimes of addresses. The
+// default is one and two hours.
+func WithLifetimes(preferred, valid time.Duration) HandlerOption {
+	return &lifetimesOption{preferred: preferred, valid: valid}
+}
+
+type dnsOption struct {
+	servers []net.IP
+	search  []string
+}
+
+func (d *dnsOption) set(o *options) {
+	o.dnsServers = d.servers
+	o.domainSearch = d.search
+}
+
+// WithDNS configures the DNS servers and search list sent to clients that
+// request them.
+func WithDNS(servers []net.IP, search []string) HandlerOption {
+	return &dnsOption{servers: servers, search: search}
+}
+
+type rapidCommitOption struct{}
+
+func (rapidCommitOption) set(o *options) {
+	o.rapidCommit = true
+}
+
+// WithRapidCommit assigns addresses in reply to a SOLICIT from clients that
+// ask for a rapid commit, without an ADVERTISE and REQUEST.
+func WithRapidCommit() HandlerOption {
+	return rapidCommitOption{}
+}
+
+type staticLeasesOption struct {
+	leases []StaticLease
+}
+
+func (s *staticLeasesOption) set(o *options) {
+	o.staticLeases = s.leases
+}
+
+// WithStaticLeases configures addresses assigned to clients by DUID.
+func WithStaticLeases(leases ...StaticLease) HandlerOption {
+	return &staticLeasesOption{leases: leases}
+}
@@ -0,0 +1,335 @@
+// Package dns implements just enough of the DNS wire format (RFC 1035) for
+// dynamic updates (RFC 2136) signed with TSIG (RFC 8945) and for multicast
+// DNS responses.
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Resource record types.
+const (
+	TypeA     uint16 = 1
+	TypeSOA   uint16 = 6
+	TypePTR   uint16 = 12
+	TypeTXT   uint16 = 16
+	TypeAAAA  uint16 = 28
+	TypeDHCID uint16 = 49
+	TypeTSIG  uint16 = 250
+	TypeANY   uint16 = 255
+)
+
+// Classes. NONE and ANY have special meanings in updates.
+const (
+	ClassINET uint16 = 1
+	ClassNONE uint16 = 254
+	ClassANY  uint16 = 255
+)
+
+// Opcodes.
+const (
+	OpcodeQuery  = 0
+	OpcodeUpdate = 5
+)
+
+// Response codes.
+const (
+	RCodeSuccess  = 0
+	RCodeFormErr  = 1
+	RCodeServFail = 2
+	RCodeNXDomain = 3
+	RCodeNotImp   = 4
+	RCodeRefused  = 5
+	RCodeYXDomain = 6
+	RCodeYXRRSet  = 7
+	RCodeNXRRSet  = 8
+	RCodeNotAuth  = 9
+	RCodeNotZone  = 10
+	RCodeBadSig   = 16
+	RCodeBadKey   = 17
+	RCodeBadTime  = 18
+)
+
+var rcodeNames = map[int]string{
+	RCodeSuccess:  "NOERROR",
+	RCodeFormErr:  "FORMERR",
+	RCodeServFail: "SERVFAIL",
+	RCodeNXDomain: "NXDOMAIN",
+	RCodeNotImp:   "NOTIMP",
+	RCodeRefused:  "REFUSED",
+	RCodeYXDomain: "YXDOMAIN",
+	RCodeYXRRSet:  "YXRRSET",
+	RCodeNXRRSet:  "NXRRSET",
+	RCodeNotAuth:  "NOTAUTH",
+	RCodeNotZone:  "NOTZONE",
+	RCodeBadSig:   "BADSIG",
+	RCodeBadKey:   "BADKEY",
+	RCodeBadTime:  "BADTIME",
+}
+
+// RCodeString returns the mnemonic of a response code.
+func RCodeString(rcode int) string {
+	if name, ok := rcodeNames[rcode]; ok {
+		return name
+	}
+	return "RCODE" + strconv.Itoa(rcode)
+}
+
+const headerLen = 12
+
+// Header is the header of a message.
+type Header struct {
+	ID               uint16
+	Response         bool
+	Opcode           int
+	Authoritative    bool
+	Truncated        bool
+	RecursionDesired bool
+	RCode            int
+}
+
+// Question is an entry of the question section, which is the zone section
+// of updates.
+type Question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// RR is a resource record. Data is the wire format of its RDATA; names in
+// it are not compressed.
+type RR struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+// Message is a DNS message. In updates the answer section holds the
+// prerequisites and the authority section the updates.
+type Message struct {
+	Header
+	Questions   []Question
+	Answers     []RR
+	Authorities []RR
+	Additionals []RR
+}
+
+// Pack returns the wire format of m. Names are not compressed.
+func (m *Message) Pack() ([]byte, error) {
+	b := make([]byte, headerLen, 512)
+	binary.BigEndian.PutUint16(b, m.ID)
+	var flags uint16
+	if m.Response {
+		flags |= 1 << 15
+	}
+	flags |= uint16(m.Opcode&0xf) << 11
+	if m.Authoritative {
+		flags |= 1 << 10
+	}
+	if m.Truncated {
+		flags |= 1 << 9
+	}
+	if m.RecursionDesired {
+		flags |= 1 << 8
+	}
+	flags |= uint16(m.RCode & 0xf)
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.Answers)))
+	binary.BigEndian.PutUint16(b[8:], uint16(len(m.Authorities)))
+	binary.BigEndian.PutUint16(b[10:], uint16(len(m.Additionals)))
+
+	var err error
+	for _, q := range m.Questions {
+		if b, err = AppendName(b, q.Name); err != nil {
+			return nil, err
+		}
+		b = binary.BigEndian.AppendUint16(b, q.Type)
+		b = binary.BigEndian.AppendUint16(b, q.Class)
+	}
+	for _, section := range [][]RR{m.Answers, m.Authorities, m.Additionals} {
+		for _, rr := range section {
+			if b, err = appendRR(b, rr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b, nil
+}
+
+func appendRR(b []byte, rr RR) ([]byte, error) {
+	b, err := AppendName(b, rr.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(rr.Data) > 0xffff {
+		return nil, errors.New("rdata too long")
+	}
+	b = binary.BigEndian.AppendUint16(b, rr.Type)
+	b = binary.BigEndian.AppendUint16(b, rr.Class)
+	b = binary.BigEndian.AppendUint32(b, rr.TTL)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rr.Data)))
+	return append(b, rr.Data...), nil
+}
+
+// Unpack parses the message b.
+func Unpack(b []byte) (*Message, error) {
+	m, _, err := unpack(b)
+	return m, err
+}
+
+// unpack parses b and also returns the offset of its last record.
+func unpack(b []byte) (*Message, int, error) {
+	if len(b) < headerLen {
+		return nil, 0, errors.New("short message")
+	}
+	flags := binary.BigEndian.Uint16(b[2:])
+	m := &Message{Header: Header{
+		ID:               binary.BigEndian.Uint16(b),
+		Response:         flags&(1<<15) != 0,
+		Opcode:           int(flags>>11) & 0xf,
+		Authoritative:    flags&(1<<10) != 0,
+		Truncated:        flags&(1<<9) != 0,
+		RecursionDesired: flags&(1<<8) != 0,
+		RCode:            int(flags & 0xf),
+	}}
+	off := headerLen
+	for n := binary.BigEndian.Uint16(b[4:]); n > 0; n-- {
+		name, next, err := readName(b, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		if next+4 > len(b) {
+			return nil, 0, errors.New("truncated question")
+		}
+		m.Questions = append(m.Questions, Question{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[next:]),
+			Class: binary.BigEndian.Uint16(b[next+2:]),
+		})
+		off = next + 4
+	}
+	last := off
+	for i, section := range []*[]RR{&m.Answers, &m.Authorities, &m.Additionals} {
+		for n := binary.BigEndian.Uint16(b[6+2*i:]); n > 0; n-- {
+			last = off
+			name, next, err := readName(b, off)
+			if err != nil {
+				return nil, 0, err
+			}
+			if next+10 > len(b) {
+				return nil, 0, errors.New("truncated record")
+			}
+			rr := RR{
+				Name:  name,
+				Type:  binary.BigEndian.Uint16(b[next:]),
+				Class: binary.BigEndian.Uint16(b[next+2:]),
+				TTL:   binary.BigEndian.Uint32(b[next+4:]),
+			}
+			n := int(binary.BigEndian.Uint16(b[next+8:]))
+			off = next + 10
+			if off+n > len(b) {
+				return nil, 0, errors.New("truncated rdata")
+			}
+			rr.Data = b[off : off+n]
+			off += n
+			*section = append(*section, rr)
+		}
+	}
+	return m, last, nil
+}
+
+// AppendName appends the uncompressed wire format of name, which may end
+// in a dot.
+func AppendName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		return nil, fmt.Errorf("name %q too long", name)
+	}
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if label == "" || len(label) > 63 {
+				return nil, fmt.Errorf("invalid name %q", name)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+// readName reads the possibly compressed name at off in msg and returns it,
+// without a trailing dot, and the offset following it.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("truncated name")
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errors.New("truncated name")
+			}
+			if jumps++; jumps > 32 {
+				return "", 0, errors.New("name compression loop")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		case n&0xc0 != 0:
+			return "", 0, fmt.Errorf("invalid label type %#x", n&0xc0)
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errors.New("truncated name")
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+// ReverseName returns the in-addr.arpa or ip6.arpa name of ip.
+func ReverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	const hex = "0123456789abcdef"
+	var b strings.Builder
+	for i := len(ip) - 1; i >= 0; i-- {
+		b.WriteByte(hex[ip[i]&0xf])
+		b.WriteByte('.')
+		b.WriteByte(hex[ip[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa")
+	return b.String()
+}
+
+// InZone reports whether name is zone or a name below it, ignoring case.
+func InZone(name, zone string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	zone = strings.ToLower(strings.TrimSuffix(zone, "."))
+	return zone == "" || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// NameData returns the RDATA of a record holding a single name, such as a
+// PTR record.
+func NameData(name string) ([]byte, error) {
+	return AppendName(nil, name)
+}
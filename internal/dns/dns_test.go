@@ -0,0 +1,107 @@
+package dns
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPackUnpack(t *testing.T) {
+	ptr, err := NameData("host.lan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Message{
+		Header:      Header{ID: 0x1234, Opcode: OpcodeUpdate},
+		Questions:   []Question{{Name: "42.168.192.in-addr.arpa.", Type: TypeSOA, Class: ClassINET}},
+		Answers:     []RR{{Name: "23.42.168.192.in-addr.arpa", Type: TypeANY, Class: ClassNONE}},
+		Authorities: []RR{{Name: "23.42.168.192.in-addr.arpa", Type: TypePTR, Class: ClassINET, TTL: 300, Data: ptr}},
+	}
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Unpack(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != 0x1234 || got.Opcode != OpcodeUpdate || got.Response {
+		t.Errorf("header = %+v", got.Header)
+	}
+	if len(got.Questions) != 1 || got.Questions[0].Name != "42.168.192.in-addr.arpa" {
+		t.Errorf("questions = %+v", got.Questions)
+	}
+	if len(got.Authorities) != 1 || got.Authorities[0].TTL != 300 || !bytes.Equal(got.Authorities[0].Data, ptr) {
+		t.Errorf("authorities = %+v", got.Authorities)
+	}
+}
+
+func TestReadNameCompressed(t *testing.T) {
+	// "lan" at 12, "host" pointing to it at 17.
+	msg := make([]byte, 12)
+	msg = append(msg, 3, 'l', 'a', 'n', 0)
+	msg = append(msg, 4, 'h', 'o', 's', 't', 0xc0, 12)
+	name, next, err := readName(msg, 17)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "host.lan" || next != len(msg) {
+		t.Errorf("readName = %q, %d", name, next)
+	}
+	// A pointer to itself.
+	if _, _, err := readName(append(msg[:12:12], 0xc0, 12), 12); err == nil {
+		t.Error("readName of a compression loop succeeded")
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	if got, want := ReverseName(net.IP{192, 168, 42, 23}), "23.42.168.192.in-addr.arpa"; got != want {
+		t.Errorf("ReverseName = %q, want %q", got, want)
+	}
+	if got, want := ReverseName(net.ParseIP("2001:db8::1")), "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"; got != want {
+		t.Errorf("ReverseName = %q, want %q", got, want)
+	}
+}
+
+func TestTSIG(t *testing.T) {
+	key := &TSIG{Name: "dhcp-key.", Algorithm: "hmac-sha256", Secret: []byte("0123456789abcdef")}
+	now := time.Unix(1700000000, 0)
+	req, err := (&Message{Header: Header{ID: 7, Opcode: OpcodeUpdate}}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, reqMAC, err := key.Sign(req, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := Unpack(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Additionals) != 1 || m.Additionals[0].Type != TypeTSIG || m.Additionals[0].Name != "dhcp-key" {
+		t.Fatalf("additionals = %+v", m.Additionals)
+	}
+
+	resp, err := (&Message{Header: Header{ID: 7, Opcode: OpcodeUpdate, Response: true}}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedResp, _, err := key.sign(resp, reqMAC, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.Verify(signedResp, reqMAC, now.Add(time.Minute)); err != nil {
+		t.Errorf("Verify = %v", err)
+	}
+	if err := key.Verify(signedResp, reqMAC, now.Add(time.Hour)); err == nil {
+		t.Error("Verify of a stale response succeeded")
+	}
+	other := &TSIG{Name: "dhcp-key", Algorithm: "hmac-sha256", Secret: []byte("wrong")}
+	if err := other.Verify(signedResp, reqMAC, now); err == nil {
+		t.Error("Verify with the wrong secret succeeded")
+	}
+	if err := key.Verify(resp, reqMAC, now); err == nil {
+		t.Error("Verify of an unsigned response succeeded")
+	}
+}
@@ -0,0 +1,181 @@
+package dns
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+)
+
+// DefaultFudge is the permitted clock skew of signed messages.
+const DefaultFudge = 300
+
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-md5.sig-alg.reg.int": md5.New,
+	"hmac-sha1":                sha1.New,
+	"hmac-sha224":              sha256.New224,
+	"hmac-sha256":              sha256.New,
+	"hmac-sha384":              sha512.New384,
+	"hmac-sha512":              sha512.New,
+}
+
+// TSIG is a key for signing messages.
+type TSIG struct {
+	Name      string // key name
+	Algorithm string // e.g. "hmac-sha256"
+	Secret    []byte
+}
+
+// Check returns an error if the key's algorithm is not supported.
+func (k *TSIG) Check() error {
+	if _, ok := tsigAlgorithms[k.algorithm()]; !ok {
+		return fmt.Errorf("unsupported tsig algorithm %q", k.Algorithm)
+	}
+	if k.Name == "" || len(k.Secret) == 0 {
+		return errors.New("tsig requires a key name and secret")
+	}
+	return nil
+}
+
+func (k *TSIG) algorithm() string {
+	alg := strings.ToLower(strings.TrimSuffix(k.Algorithm, "."))
+	if alg == "hmac-md5" {
+		alg = "hmac-md5.sig-alg.reg.int"
+	}
+	return alg
+}
+
+// Sign appends a TSIG record to the packed message msg and returns the
+// signed message and its MAC, which is needed to verify the response.
+func (k *TSIG) Sign(msg []byte, now time.Time) ([]byte, []byte, error) {
+	return k.sign(msg, nil, now)
+}
+
+// sign signs msg, which is a response if requestMAC is not nil.
+func (k *TSIG) sign(msg, requestMAC []byte, now time.Time) ([]byte, []byte, error) {
+	if err := k.Check(); err != nil {
+		return nil, nil, err
+	}
+	if len(msg) < headerLen {
+		return nil, nil, errors.New("short message")
+	}
+	signed := uint64(now.Unix())
+	vars, err := k.variables(signed, DefaultFudge, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	sum := k.mac(requestMAC, msg, vars)
+
+	rdata, err := AppendName(nil, k.algorithm())
+	if err != nil {
+		return nil, nil, err
+	}
+	rdata = appendUint48(rdata, signed)
+	rdata = binary.BigEndian.AppendUint16(rdata, DefaultFudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = append(rdata, msg[0:2]...) // original ID
+	rdata = binary.BigEndian.AppendUint16(rdata, 0)
+	rdata = binary.BigEndian.AppendUint16(rdata, 0)
+
+	out := append([]byte(nil), msg...)
+	binary.BigEndian.PutUint16(out[10:], binary.BigEndian.Uint16(out[10:])+1)
+	out, err = appendRR(out, RR{Name: strings.ToLower(k.Name), Type: TypeTSIG, Class: ClassANY, Data: rdata})
+	if err != nil {
+		return nil, nil, err
+	}
+	return out, sum, nil
+}
+
+// Verify checks the TSIG record of resp, the response to a request signed
+// with the MAC requestMAC.
+func (k *TSIG) Verify(resp, requestMAC []byte, now time.Time) error {
+	m, last, err := unpack(resp)
+	if err != nil {
+		return err
+	}
+	if len(m.Additionals) == 0 || m.Additionals[len(m.Additionals)-1].Type != TypeTSIG {
+		return errors.New("response is not signed")
+	}
+	rr := m.Additionals[len(m.Additionals)-1]
+	alg, off, err := readName(rr.Data, 0)
+	if err != nil {
+		return err
+	}
+	d := rr.Data[off:]
+	if len(d) < 10 {
+		return errors.New("truncated tsig")
+	}
+	signed := uint64(binary.BigEndian.Uint16(d))<<32 | uint64(binary.BigEndian.Uint32(d[2:]))
+	fudge := binary.BigEndian.Uint16(d[6:])
+	n := int(binary.BigEndian.Uint16(d[8:]))
+	if len(d) < 10+n+6 {
+		return errors.New("truncated tsig")
+	}
+	sum := d[10 : 10+n]
+	origID := d[10+n : 12+n]
+	tsigErr := int(binary.BigEndian.Uint16(d[12+n:]))
+	if tsigErr != 0 {
+		return fmt.Errorf("tsig error %s", RCodeString(tsigErr))
+	}
+	if !strings.EqualFold(alg, k.algorithm()) || !strings.EqualFold(rr.Name, strings.TrimSuffix(k.Name, ".")) {
+		return errors.New("response signed with another key")
+	}
+
+	stripped := append([]byte(nil), resp[:last]...)
+	copy(stripped, origID)
+	binary.BigEndian.PutUint16(stripped[10:], uint16(len(m.Additionals)-1))
+	vars, err := k.variables(signed, fudge, 0)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(k.mac(requestMAC, stripped, vars), sum) {
+		return errors.New("invalid tsig signature")
+	}
+	if delta := now.Unix() - int64(signed); delta > int64(fudge) || -delta > int64(fudge) {
+		return errors.New("tsig time outside of fudge")
+	}
+	return nil
+}
+
+// mac returns the MAC of msg, preceded by the MAC of the request if msg is
+// a response.
+func (k *TSIG) mac(requestMAC, msg, vars []byte) []byte {
+	mac := hmac.New(tsigAlgorithms[k.algorithm()], k.Secret)
+	if requestMAC != nil {
+		mac.Write(binary.BigEndian.AppendUint16(nil, uint16(len(requestMAC))))
+		mac.Write(requestMAC)
+	}
+	mac.Write(msg)
+	mac.Write(vars)
+	return mac.Sum(nil)
+}
+
+// variables returns the TSIG variables covered by the MAC.
+func (k *TSIG) variables(signed uint64, fudge uint16, tsigErr uint16) ([]byte, error) {
+	b, err := AppendName(nil, strings.ToLower(k.Name))
+	if err != nil {
+		return nil, err
+	}
+	b = binary.BigEndian.AppendUint16(b, ClassANY)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	if b, err = AppendName(b, k.algorithm()); err != nil {
+		return nil, err
+	}
+	b = appendUint48(b, signed)
+	b = binary.BigEndian.AppendUint16(b, fudge)
+	b = binary.BigEndian.AppendUint16(b, tsigErr)
+	return binary.BigEndian.AppendUint16(b, 0), nil // no other data
+}
+
+func appendUint48(b []byte, v uint64) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(v>>32))
+	return binary.BigEndian.AppendUint32(b, uint32(v))
+}
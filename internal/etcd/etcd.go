@@ -0,0 +1,299 @@
+// Package etcd implements a minimal etcd v3 client on top of the JSON
+// gateway (the /v3/ HTTP API). It is just enough to store leases.
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// KeyValue is a key as stored by etcd.
+type KeyValue struct {
+	Key         string
+	Value       string
+	ModRevision int64
+}
+
+// Client sends requests to the first reachable endpoint of a cluster.
+type Client struct {
+	endpoints          []string
+	username, password string
+	hc                 *http.Client
+
+	mu    sync.Mutex
+	token string // auth token, if authenticated
+}
+
+// New returns a client of the cluster at endpoints, such as
+// "http://127.0.0.1:2379". If username is set the client authenticates
+// before its first request. Each request fails if it takes longer than
+// timeout.
+func New(endpoints []string, username, password string, timeout time.Duration) *Client {
+	return &Client{
+		endpoints: endpoints,
+		username:  username,
+		password:  password,
+		hc:        &http.Client{Timeout: timeout},
+	}
+}
+
+// int64s are encoded as strings in the JSON mapping of etcd's protobufs.
+type int64String int64
+
+func (n int64String) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatInt(int64(n), 10))
+}
+
+func (n *int64String) UnmarshalJSON(b []byte) error {
+	s := string(bytes.Trim(b, `"`))
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	*n = int64String(v)
+	return nil
+}
+
+type header struct {
+	Revision int64String `json:"revision"`
+}
+
+type kv struct {
+	Key         []byte      `json:"key"` // base64 encoded by encoding/json
+	Value       []byte      `json:"value"`
+	ModRevision int64String `json:"mod_revision"`
+}
+
+type putRequest struct {
+	Key   []byte      `json:"key"`
+	Value []byte      `json:"value"`
+	Lease int64String `json:"lease,omitempty"`
+}
+
+// Range returns the keys starting with prefix.
+func (c *Client) Range(ctx context.Context, prefix string) ([]KeyValue, error) {
+	var resp struct {
+		Kvs []kv `json:"kvs"`
+	}
+	err := c.call(ctx, "/v3/kv/range", map[string][]byte{
+		"key":       []byte(prefix),
+		"range_end": prefixEnd(prefix),
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	kvs := make([]KeyValue, len(resp.Kvs))
+	for i, kv := range resp.Kvs {
+		kvs[i] = KeyValue{Key: string(kv.Key), Value: string(kv.Value), ModRevision: int64(kv.ModRevision)}
+	}
+	return kvs, nil
+}
+
+// Get returns the key, or false if it does not exist.
+func (c *Client) Get(ctx context.Context, key string) (KeyValue, bool, error) {
+	var resp struct {
+		Kvs []kv `json:"kvs"`
+	}
+	if err := c.call(ctx, "/v3/kv/range", map[string][]byte{"key": []byte(key)}, &resp); err != nil {
+		return KeyValue{}, false, err
+	}
+	if len(resp.Kvs) == 0 {
+		return KeyValue{}, false, nil
+	}
+	kv := resp.Kvs[0]
+	return KeyValue{Key: key, Value: string(kv.Value), ModRevision: int64(kv.ModRevision)}, true, nil
+}
+
+// Put sets key to value, attached to lease if it is not zero.
+func (c *Client) Put(ctx context.Context, key, value string, lease int64) error {
+	return c.call(ctx, "/v3/kv/put", putRequest{Key: []byte(key), Value: []byte(value), Lease: int64String(lease)}, nil)
+}
+
+// PutIfModRevision sets key to value, attached to lease if it is not zero,
+// if the key was last modified at revision rev (zero if it must not exist).
+// It reports whether the key was set and the revision of the change.
+func (c *Client) PutIfModRevision(ctx context.Context, key, value string, lease, rev int64) (bool, int64, error) {
+	type compare struct {
+		Key         []byte      `json:"key"`
+		Target      string      `json:"target"`
+		Result      string      `json:"result"`
+		ModRevision int64String `json:"mod_revision"`
+	}
+	type requestOp struct {
+		RequestPut putRequest `json:"request_put"`
+	}
+	req := struct {
+		Compare []compare   `json:"compare"`
+		Success []requestOp `json:"success"`
+	}{
+		Compare: []compare{{Key: []byte(key), Target: "MOD", Result: "EQUAL", ModRevision: int64String(rev)}},
+		Success: []requestOp{{RequestPut: putRequest{Key: []byte(key), Value: []byte(value), Lease: int64String(lease)}}},
+	}
+	var resp struct {
+		Header    header `json:"header"`
+		Succeeded bool   `json:"succeeded"`
+	}
+	if err := c.call(ctx, "/v3/kv/txn", req, &resp); err != nil {
+		return false, 0, err
+	}
+	return resp.Succeeded, int64(resp.Header.Revision), nil
+}
+
+// Delete removes key.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.call(ctx, "/v3/kv/deleterange", map[string][]byte{"key": []byte(key)}, nil)
+}
+
+// Grant creates a lease that expires after ttl and returns its ID.
+func (c *Client) Grant(ctx context.Context, ttl time.Duration) (int64, error) {
+	var resp struct {
+		ID int64String `json:"ID"`
+	}
+	secs := max(int64(ttl/time.Second), 1)
+	if err := c.call(ctx, "/v3/lease/grant", map[string]int64String{"TTL": int64String(secs)}, &resp); err != nil {
+		return 0, err
+	}
+	return int64(resp.ID), nil
+}
+
+// prefixEnd returns the range end of the keys starting with prefix.
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0} // all keys
+}
+
+// Error is an error returned by the server.
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("etcd: %s (status %d)", e.Message, e.Status)
+}
+
+// call posts req to path on the first endpoint that answers and decodes
+// the response into resp, if not nil.
+func (c *Client) call(ctx context.Context, path string, req, resp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, ep := range c.endpoints {
+		b, err := c.post(ctx, ep, path, body, true)
+		if err != nil {
+			var eerr *Error
+			if errors.As(err, &eerr) {
+				return err
+			}
+			lastErr = err
+			continue
+		}
+		if resp == nil {
+			return nil
+		}
+		return json.Unmarshal(b, resp)
+	}
+	if lastErr == nil {
+		lastErr = errors.New("etcd: no endpoints")
+	}
+	return lastErr
+}
+
+func (c *Client) post(ctx context.Context, ep, path string, body []byte, retryAuth bool) ([]byte, error) {
+	token, err := c.authToken(ctx, ep)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", ep+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return b, nil
+	}
+	var e struct {
+		Message string `json:"message"`
+		Error   string `json:"error"`
+	}
+	json.Unmarshal(b, &e)
+	if e.Message == "" {
+		e.Message = e.Error
+	}
+	if e.Message == "" {
+		e.Message = resp.Status
+	}
+	if retryAuth && token != "" && resp.StatusCode == http.StatusUnauthorized {
+		// The token expired; authenticate again.
+		c.mu.Lock()
+		c.token = ""
+		c.mu.Unlock()
+		return c.post(ctx, ep, path, body, false)
+	}
+	return nil, &Error{Status: resp.StatusCode, Message: e.Message}
+}
+
+// authToken returns the auth token, authenticating against ep if needed.
+func (c *Client) authToken(ctx context.Context, ep string) (string, error) {
+	if c.username == "" {
+		return "", nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" {
+		return c.token, nil
+	}
+	body, err := json.Marshal(map[string]string{"name": c.username, "password": c.password})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", ep+"/v3/auth/authenticate", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", &Error{Status: resp.StatusCode, Message: "authentication failed"}
+	}
+	var auth struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return "", err
+	}
+	c.token = auth.Token
+	return c.token, nil
+}
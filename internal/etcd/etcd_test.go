@@ -0,0 +1,72 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+	var puts []map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		json.NewDecoder(r.Body).Decode(&req)
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			// "a/" to "a0", base64 encoded.
+			if req["key"] != "YS8=" || req["range_end"] != "YTA=" {
+				t.Errorf("range request = %v", req)
+			}
+			w.Write([]byte(`{"header":{"revision":"7"},"kvs":[{"key":"YS94","value":"MQ==","mod_revision":"5"}],"count":"1"}`))
+		case "/v3/lease/grant":
+			if req["TTL"] != "60" {
+				t.Errorf("grant TTL = %v, want \"60\"", req["TTL"])
+			}
+			w.Write([]byte(`{"ID":"42","TTL":"60"}`))
+		case "/v3/kv/txn":
+			puts = append(puts, req)
+			w.Write([]byte(`{"header":{"revision":"8"},"succeeded":true}`))
+		default:
+			http.Error(w, `{"error":"unknown","message":"unknown"}`, http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	// The first endpoint is unreachable.
+	c := New([]string{"http://127.0.0.1:1", srv.URL}, "", "", 5*time.Second)
+
+	kvs, err := c.Range(ctx, "a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 1 || kvs[0] != (KeyValue{Key: "a/x", Value: "1", ModRevision: 5}) {
+		t.Errorf("Range = %+v", kvs)
+	}
+
+	id, err := c.Grant(ctx, time.Minute)
+	if err != nil || id != 42 {
+		t.Fatalf("Grant = %d, %v", id, err)
+	}
+
+	ok, rev, err := c.PutIfModRevision(ctx, "a/x", "2", id, 5)
+	if err != nil || !ok || rev != 8 {
+		t.Fatalf("PutIfModRevision = %v, %d, %v", ok, rev, err)
+	}
+	b, _ := json.Marshal(puts)
+	for _, want := range []string{`"mod_revision":"5"`, `"target":"MOD"`, `"lease":"42"`} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("txn request %s is missing %s", b, want)
+		}
+	}
+
+	if err := c.Delete(ctx, "a/x"); err == nil {
+		t.Errorf("Delete on unknown path succeeded")
+	} else if e, ok := err.(*Error); !ok || e.Status != http.StatusNotFound {
+		t.Errorf("Delete error = %v, want a 404 Error", err)
+	}
+}
@@ -0,0 +1,338 @@
+// Package failover implements the message format of the DHCP failover
+// protocol (draft-ietf-dhc-failover-12) as spoken by ISC dhcpd.
+package failover
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// DefaultPort is the port ISC dhcpd conventionally uses for failover.
+const DefaultPort = 647
+
+// Version is the protocol version sent in CONNECT messages.
+const Version = 1
+
+const headerLen = 12
+
+// MessageType is the type of a failover message.
+type MessageType byte
+
+const (
+	PoolReq MessageType = 1 + iota
+	PoolResp
+	BndUpd
+	BndAck
+	Connect
+	ConnectAck
+	UpdReqAll
+	UpdDone
+	UpdReq
+	State
+	Contact
+	Disconnect
+)
+
+var messageTypeNames = []string{"", "POOLREQ", "POOLRESP", "BNDUPD", "BNDACK", "CONNECT", "CONNECTACK", "UPDREQALL", "UPDDONE", "UPDREQ", "STATE", "CONTACT", "DISCONNECT"}
+
+func (t MessageType) String() string {
+	if int(t) < len(messageTypeNames) && t > 0 {
+		return messageTypeNames[t]
+	}
+	return fmt.Sprintf("MessageType(%d)", t)
+}
+
+// OptionCode identifies an option of a failover message.
+type OptionCode uint16
+
+const (
+	OptionAddressesTransferred OptionCode = 1 + iota
+	OptionAssignedIPAddress
+	OptionBindingStatus
+	OptionClientIdentifier
+	OptionClientHardwareAddress
+	OptionClientLastTransactionTime
+	OptionClientReplyOptions
+	OptionClientRequestOptions
+	OptionDDNS
+	OptionDelayedService
+	OptionHashBucketAssignment
+	OptionIPFlags
+	OptionLeaseExpirationTime
+	OptionMaxUnackedBndUpd
+	OptionMCLT
+	OptionMessage
+	OptionMessageDigest
+	OptionPotentialExpirationTime
+	OptionReceiveTimer
+	OptionProtocolVersion
+	OptionRejectReason
+	OptionRelationshipName
+	OptionServerFlags
+	OptionServerState
+	OptionStartTimeOfState
+	OptionTLSReply
+	OptionTLSRequest
+	OptionVendorClass
+	OptionVendorOptions
+)
+
+// BindingStatus is the state of an address.
+type BindingStatus byte
+
+const (
+	Free BindingStatus = 1 + iota
+	Active
+	Expired
+	Released
+	Abandoned
+	Reset
+	Backup
+)
+
+var bindingStatusNames = []string{"", "free", "active", "expired", "released", "abandoned", "reset", "backup"}
+
+func (s BindingStatus) String() string {
+	if int(s) < len(bindingStatusNames) && s > 0 {
+		return bindingStatusNames[s]
+	}
+	return fmt.Sprintf("BindingStatus(%d)", s)
+}
+
+// ServerState is the failover state of a server.
+type ServerState byte
+
+const (
+	Startup ServerState = 1 + iota
+	Normal
+	CommunicationsInterrupted
+	PartnerDown
+	PotentialConflict
+	Recover
+	Paused
+	Shutdown
+	RecoverDone
+	ResolutionInterrupted
+	ConflictDone
+	RecoverWait ServerState = 254
+)
+
+var serverStateNames = map[ServerState]string{
+	Startup:                   "startup",
+	Normal:                    "normal",
+	CommunicationsInterrupted: "communications-interrupted",
+	PartnerDown:               "partner-down",
+	PotentialConflict:         "potential-conflict",
+	Recover:                   "recover",
+	Paused:                    "paused",
+	Shutdown:                  "shutdown",
+	RecoverDone:               "recover-done",
+	ResolutionInterrupted:     "resolution-interrupted",
+	ConflictDone:              "conflict-done",
+	RecoverWait:               "recover-wait",
+}
+
+func (s ServerState) String() string {
+	if name, ok := serverStateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("ServerState(%d)", s)
+}
+
+// Reject reasons of BNDACK and CONNECTACK messages.
+const (
+	RejectIllegalIPAddr       = 1
+	RejectFatalConflict       = 2
+	RejectMissingBindInfo     = 3
+	RejectConnRejected        = 4
+	RejectTimeMismatch        = 5
+	RejectInvalidMCLT         = 6
+	RejectUnknownInfo         = 7
+	RejectInvalidPartner      = 8
+	RejectTLSUnsupported      = 9
+	RejectTLSUnconfigured     = 10
+	RejectTLSRequired         = 11
+	RejectDigestUnsupported   = 12
+	RejectDigestUnconfigured  = 13
+	RejectVersionMismatch     = 14
+	RejectOutdatedBindInfo    = 15
+	RejectLessCriticalBinding = 16
+	RejectNoTrafficTimeout    = 17
+	RejectHBAConflict         = 18
+	RejectIPNotReserved       = 19
+	RejectIPNotAvailable      = 20
+	RejectUnknown             = 254
+)
+
+// Option is an option of a message.
+type Option struct {
+	Code OptionCode
+	Data []byte
+}
+
+// Message is a failover protocol message.
+type Message struct {
+	Type    MessageType
+	Time    time.Time
+	XID     uint32
+	Options []Option
+}
+
+// Get returns the data of the first option with code.
+func (m *Message) Get(code OptionCode) ([]byte, bool) {
+	for _, o := range m.Options {
+		if o.Code == code {
+			return o.Data, true
+		}
+	}
+	return nil, false
+}
+
+// Byte returns the value of a one byte option.
+func (m *Message) Byte(code OptionCode) (byte, bool) {
+	b, ok := m.Get(code)
+	if !ok || len(b) != 1 {
+		return 0, false
+	}
+	return b[0], true
+}
+
+// Uint32 returns the value of a four byte option.
+func (m *Message) Uint32(code OptionCode) (uint32, bool) {
+	b, ok := m.Get(code)
+	if !ok || len(b) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(b), true
+}
+
+// Timestamp returns the value of a time option. Times are seconds since the
+// Unix epoch; a zero time means "never" or "infinite" and is returned as the
+// zero time.Time.
+func (m *Message) Timestamp(code OptionCode) (time.Time, bool) {
+	v, ok := m.Uint32(code)
+	if !ok {
+		return time.Time{}, false
+	}
+	if v == 0 || v == ^uint32(0) {
+		return time.Time{}, true
+	}
+	return time.Unix(int64(v), 0), true
+}
+
+// IP returns the value of an IPv4 address option.
+func (m *Message) IP(code OptionCode) (net.IP, bool) {
+	b, ok := m.Get(code)
+	if !ok || len(b) != 4 {
+		return nil, false
+	}
+	return net.IP(b).To4(), true
+}
+
+// HardwareAddr returns the address of the client-hardware-address option,
+// which is prefixed by its hardware type.
+func (m *Message) HardwareAddr() (net.HardwareAddr, bool) {
+	b, ok := m.Get(OptionClientHardwareAddress)
+	if !ok || len(b) < 2 {
+		return nil, false
+	}
+	return net.HardwareAddr(b[1:]), true
+}
+
+// Add appends an option.
+func (m *Message) Add(code OptionCode, data []byte) {
+	m.Options = append(m.Options, Option{Code: code, Data: data})
+}
+
+// AddByte appends a one byte option.
+func (m *Message) AddByte(code OptionCode, v byte) {
+	m.Add(code, []byte{v})
+}
+
+// AddUint32 appends a four byte option.
+func (m *Message) AddUint32(code OptionCode, v uint32) {
+	m.Add(code, binary.BigEndian.AppendUint32(nil, v))
+}
+
+// AddTimestamp appends a time option. The zero time is sent as infinite.
+func (m *Message) AddTimestamp(code OptionCode, t time.Time) {
+	if t.IsZero() {
+		m.AddUint32(code, ^uint32(0))
+		return
+	}
+	m.AddUint32(code, uint32(t.Unix()))
+}
+
+// AddHardwareAddr appends an Ethernet client-hardware-address option.
+func (m *Message) AddHardwareAddr(hw net.HardwareAddr) {
+	m.Add(OptionClientHardwareAddress, append([]byte{1}, hw...))
+}
+
+// Encode returns the wire format of m.
+func (m *Message) Encode() ([]byte, error) {
+	b := make([]byte, headerLen, 256)
+	b[2] = byte(m.Type)
+	b[3] = headerLen
+	binary.BigEndian.PutUint32(b[4:], uint32(m.Time.Unix()))
+	binary.BigEndian.PutUint32(b[8:], m.XID)
+	for _, o := range m.Options {
+		if len(o.Data) > 0xffff {
+			return nil, fmt.Errorf("option %d too long", o.Code)
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(o.Code))
+		b = binary.BigEndian.AppendUint16(b, uint16(len(o.Data)))
+		b = append(b, o.Data...)
+	}
+	if len(b) > 0xffff {
+		return nil, errors.New("message too long")
+	}
+	binary.BigEndian.PutUint16(b, uint16(len(b)))
+	return b, nil
+}
+
+// ReadMessage reads a message from r.
+func ReadMessage(r io.Reader) (*Message, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	if n < headerLen {
+		return nil, fmt.Errorf("short message of %d bytes", n)
+	}
+	b := make([]byte, n)
+	copy(b, hdr[:])
+	if _, err := io.ReadFull(r, b[2:]); err != nil {
+		return nil, err
+	}
+	return parseMessage(b)
+}
+
+func parseMessage(b []byte) (*Message, error) {
+	offset := int(b[3])
+	if offset < headerLen || offset > len(b) {
+		return nil, fmt.Errorf("invalid payload offset %d", offset)
+	}
+	m := &Message{
+		Type: MessageType(b[2]),
+		Time: time.Unix(int64(binary.BigEndian.Uint32(b[4:])), 0),
+		XID:  binary.BigEndian.Uint32(b[8:]),
+	}
+	for p := b[offset:]; len(p) > 0; {
+		if len(p) < 4 {
+			return nil, errors.New("truncated option")
+		}
+		code := OptionCode(binary.BigEndian.Uint16(p))
+		n := int(binary.BigEndian.Uint16(p[2:]))
+		if len(p) < 4+n {
+			return nil, fmt.Errorf("truncated option %d", code)
+		}
+		m.Options = append(m.Options, Option{Code: code, Data: p[4 : 4+n]})
+		p = p[4+n:]
+	}
+	return m, nil
+}
@@ -0,0 +1,59 @@
+package failover
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	expiry := time.Unix(1700000000, 0)
+	m := &Message{Type: BndUpd, Time: time.Unix(1690000000, 0), XID: 42}
+	m.Add(OptionAssignedIPAddress, net.IP{192, 168, 42, 23})
+	m.AddByte(OptionBindingStatus, byte(Active))
+	m.AddHardwareAddr(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff})
+	m.AddTimestamp(OptionLeaseExpirationTime, expiry)
+	m.AddTimestamp(OptionPotentialExpirationTime, time.Time{})
+
+	b, err := m.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != BndUpd || got.XID != 42 || !got.Time.Equal(m.Time) {
+		t.Errorf("header = %v %d %v", got.Type, got.XID, got.Time)
+	}
+	if ip, _ := got.IP(OptionAssignedIPAddress); !ip.Equal(net.IP{192, 168, 42, 23}) {
+		t.Errorf("assigned ip = %v", ip)
+	}
+	if s, _ := got.Byte(OptionBindingStatus); BindingStatus(s) != Active {
+		t.Errorf("binding status = %v", BindingStatus(s))
+	}
+	if hw, _ := got.HardwareAddr(); hw.String() != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("hardware addr = %v", hw)
+	}
+	if e, _ := got.Timestamp(OptionLeaseExpirationTime); !e.Equal(expiry) {
+		t.Errorf("lease expiration = %v, want %v", e, expiry)
+	}
+	if e, ok := got.Timestamp(OptionPotentialExpirationTime); !ok || !e.IsZero() {
+		t.Errorf("potential expiration = %v, %v, want infinite", e, ok)
+	}
+}
+
+func TestReadMessageTruncated(t *testing.T) {
+	m := &Message{Type: Contact, Time: time.Unix(1690000000, 0)}
+	m.AddUint32(OptionReceiveTimer, 60)
+	b, err := m.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Claim a longer option than the message holds.
+	b[len(b)-5] = 0xff
+	if _, err := ReadMessage(bytes.NewReader(b)); err == nil {
+		t.Error("ReadMessage of a truncated option succeeded")
+	}
+}
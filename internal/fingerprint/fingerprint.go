@@ -0,0 +1,82 @@
+// Package fingerprint guesses device types from DHCP fingerprints.
+package fingerprint
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// Rule maps a fingerprint to a device type. All non-empty fields must match:
+// ParameterRequestList and OptionOrder exactly, VendorClass as a prefix.
+type Rule struct {
+	Device               string `json:"device"`
+	ParameterRequestList string `json:"prl,omitempty"`
+	VendorClass          string `json:"vendor_class,omitempty"`
+	OptionOrder          string `json:"option_order,omitempty"`
+}
+
+// builtinRules only cover vendor classes that unambiguously identify the
+// client's DHCP implementation. Anything finer grained should come from a
+// database file.
+var builtinRules = []Rule{
+	{Device: "Windows", VendorClass: "MSFT"},
+	{Device: "Android", VendorClass: "android-dhcp"},
+	{Device: "Linux (dhcpcd)", VendorClass: "dhcpcd"},
+	{Device: "Embedded Linux (udhcp)", VendorClass: "udhcp"},
+	{Device: "PXE client", VendorClass: "PXEClient"},
+	{Device: "Cisco device", VendorClass: "Cisco"},
+	{Device: "Polycom phone", VendorClass: "Polycom"},
+}
+
+type DB struct {
+	rules []Rule
+}
+
+// New returns a database with the given rules, which are consulted before
+// the built-in rules.
+func New(rules ...Rule) *DB {
+	all := make([]Rule, 0, len(rules)+len(builtinRules))
+	all = append(all, rules...)
+	all = append(all, builtinRules...)
+	return &DB{rules: all}
+}
+
+// Load reads a JSON array of rules from path.
+func Load(path string) (*DB, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, err
+	}
+	return New(rules...), nil
+}
+
+func (r *Rule) match(prl, vendorClass, optionOrder string) bool {
+	if r.ParameterRequestList == "" && r.VendorClass == "" && r.OptionOrder == "" {
+		return false
+	}
+	if r.ParameterRequestList != "" && r.ParameterRequestList != prl {
+		return false
+	}
+	if r.VendorClass != "" && !strings.HasPrefix(vendorClass, r.VendorClass) {
+		return false
+	}
+	if r.OptionOrder != "" && r.OptionOrder != optionOrder {
+		return false
+	}
+	return true
+}
+
+// Match returns the device type of the first matching rule, or "".
+func (db *DB) Match(prl, vendorClass, optionOrder string) string {
+	for i := range db.rules {
+		if db.rules[i].match(prl, vendorClass, optionOrder) {
+			return db.rules[i].Device
+		}
+	}
+	return ""
+}
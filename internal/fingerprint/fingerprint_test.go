@@ -0,0 +1,26 @@
+package fingerprint
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	db := New(
+		Rule{Device: "HP printer", ParameterRequestList: "1,3,6,15,44,47"},
+		Rule{Device: "Windows 10", ParameterRequestList: "1,3,6,15,31,33,43,44,46,47,119,121,249,252", VendorClass: "MSFT 5.0"},
+	)
+
+	for _, tt := range []struct {
+		prl, vendorClass string
+		want             string
+	}{
+		{"1,3,6,15,44,47", "", "HP printer"},
+		{"1,3,6,15,31,33,43,44,46,47,119,121,249,252", "MSFT 5.0", "Windows 10"},
+		// falls back to the built-in vendor class rules
+		{"1,3,6", "MSFT 5.0", "Windows"},
+		{"1,3,6", "android-dhcp-13", "Android"},
+		{"1,3,6", "", ""},
+	} {
+		if got := db.Match(tt.prl, tt.vendorClass, ""); got != tt.want {
+			t.Errorf("Match(%q, %q) = %q, want %q", tt.prl, tt.vendorClass, got, tt.want)
+		}
+	}
+}
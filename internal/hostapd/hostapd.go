@@ -0,0 +1,139 @@
+// Package hostapd implements a client of hostapd's control interface, a unix
+// datagram socket per interface (e.g. /var/run/hostapd/wlan0).
+package hostapd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Station events.
+const (
+	StaConnected    = "AP-STA-CONNECTED"
+	StaDisconnected = "AP-STA-DISCONNECTED"
+)
+
+// requestTimeout bounds how long hostapd may take to reply to a request.
+const requestTimeout = 5 * time.Second
+
+var sockets atomic.Int64
+
+// Conn is a connection to a control socket.
+type Conn struct {
+	conn  *net.UnixConn
+	local string // path of our end, removed on Close
+}
+
+// Dial connects to the control socket at path.
+func Dial(path string) (*Conn, error) {
+	local := filepath.Join(os.TempDir(), fmt.Sprintf("dhcpeterd-hostapd-%d-%d", os.Getpid(), sockets.Add(1)))
+	os.Remove(local)
+	conn, err := net.DialUnix("unixgram", &net.UnixAddr{Name: local, Net: "unixgram"}, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{conn: conn, local: local}, nil
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	err := c.conn.Close()
+	os.Remove(c.local)
+	return err
+}
+
+// Request sends cmd and returns the reply. Events received in the meantime
+// are discarded.
+func (c *Conn) Request(cmd string) (string, error) {
+	c.conn.SetDeadline(time.Now().Add(requestTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+	if _, err := c.conn.Write([]byte(cmd)); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		if reply := string(buf[:n]); !strings.HasPrefix(reply, "<") {
+			return reply, nil
+		}
+	}
+}
+
+// Attach subscribes the connection to events, which are then read with
+// ReadEvent.
+func (c *Conn) Attach() error {
+	reply, err := c.Request("ATTACH")
+	if err != nil {
+		return err
+	}
+	if reply != "OK\n" {
+		return fmt.Errorf("attach: %q", strings.TrimSpace(reply))
+	}
+	return nil
+}
+
+// Status returns the key=value lines of the reply to STATUS.
+func (c *Conn) Status() (map[string]string, error) {
+	reply, err := c.Request("STATUS")
+	if err != nil {
+		return nil, err
+	}
+	status := make(map[string]string)
+	for _, line := range strings.Split(reply, "\n") {
+		if k, v, ok := strings.Cut(line, "="); ok {
+			status[k] = v
+		}
+	}
+	return status, nil
+}
+
+// Event is an unsolicited message, such as "<3>AP-STA-CONNECTED
+// aa:bb:cc:dd:ee:ff".
+type Event struct {
+	Level int
+	Type  string
+	Args  []string
+}
+
+// ReadEvent returns the next event of an attached connection.
+func (c *Conn) ReadEvent() (Event, error) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return Event{}, err
+		}
+		if ev, err := parseEvent(string(buf[:n])); err == nil {
+			return ev, nil
+		}
+	}
+}
+
+func parseEvent(msg string) (Event, error) {
+	if !strings.HasPrefix(msg, "<") {
+		return Event{}, errors.New("not an event")
+	}
+	level, rest, ok := strings.Cut(msg[1:], ">")
+	if !ok {
+		return Event{}, errors.New("not an event")
+	}
+	l, err := strconv.Atoi(level)
+	if err != nil {
+		return Event{}, fmt.Errorf("invalid event level %q", level)
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return Event{}, errors.New("empty event")
+	}
+	return Event{Level: l, Type: fields[0], Args: fields[1:]}, nil
+}
@@ -0,0 +1,58 @@
+package hostapd
+
+import (
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConn(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wlan0")
+	server, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := server.ReadFromUnix(buf)
+			if err != nil {
+				return
+			}
+			switch string(buf[:n]) {
+			case "ATTACH":
+				server.WriteToUnix([]byte("<3>CTRL-EVENT-EAP-STARTED aa:bb:cc:dd:ee:ff"), addr)
+				server.WriteToUnix([]byte("OK\n"), addr)
+				server.WriteToUnix([]byte("<3>AP-STA-CONNECTED aa:bb:cc:dd:ee:ff keyid=guest"), addr)
+			case "STATUS":
+				server.WriteToUnix([]byte("state=ENABLED\nbss[0]=wlan0\nbssid[0]=02:00:00:00:01:00\nssid[0]=home\n"), addr)
+			}
+		}
+	}()
+
+	c, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	status, err := c.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := status["ssid[0]"], "home"; got != want {
+		t.Errorf("ssid = %q, want %q", got, want)
+	}
+	if err := c.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	ev, err := c.ReadEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Event{Level: 3, Type: StaConnected, Args: []string{"aa:bb:cc:dd:ee:ff", "keyid=guest"}}
+	if !reflect.DeepEqual(ev, want) {
+		t.Errorf("event = %+v, want %+v", ev, want)
+	}
+}
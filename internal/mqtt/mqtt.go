@@ -0,0 +1,269 @@
+// Package mqtt implements a minimal MQTT 3.1.1 client that can publish
+// messages at QoS 0. It is just enough to push events to a broker.
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	packetConnect    = 1 << 4
+	packetConnAck    = 2 << 4
+	packetPublish    = 3 << 4
+	packetPingReq    = 12 << 4
+	packetPingResp   = 13 << 4
+	packetDisconnect = 14 << 4
+)
+
+// Options configure a connection.
+type Options struct {
+	ClientID string
+	Username string
+	Password string
+
+	// KeepAlive is the interval PINGREQs are sent at. Defaults to 60s.
+	KeepAlive time.Duration
+
+	// Will is published by the broker if the connection is lost.
+	WillTopic   string
+	WillMessage []byte
+	WillRetain  bool
+}
+
+// Client is a connection to an MQTT broker.
+type Client struct {
+	conn net.Conn
+
+	mu  sync.Mutex // serializes writes
+	w   *bufio.Writer
+	err error
+
+	done chan struct{}
+}
+
+// Dial connects to broker, a URL of the form tcp://host:port or
+// tls://host:port. The port defaults to 1883 (8883 for tls).
+func Dial(ctx context.Context, broker string, opts Options) (*Client, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, err
+	}
+
+	var d net.Dialer
+	var conn net.Conn
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		conn, err = d.DialContext(ctx, "tcp", hostPort(u, "1883"))
+	case "tls", "ssl", "mqtts":
+		td := tls.Dialer{NetDialer: &d}
+		conn, err = td.DialContext(ctx, "tcp", hostPort(u, "8883"))
+	default:
+		return nil, fmt.Errorf("unsupported mqtt scheme: %s", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := newClient(conn, opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func hostPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
+
+func newClient(conn net.Conn, opts Options) (*Client, error) {
+	if opts.KeepAlive == 0 {
+		opts.KeepAlive = 60 * time.Second
+	}
+
+	c := &Client{
+		conn: conn,
+		w:    bufio.NewWriter(conn),
+		done: make(chan struct{}),
+	}
+
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := c.write(packetConnect, connectBody(opts)); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	typ, body, err := readPacket(r)
+	if err != nil {
+		return nil, fmt.Errorf("read connack err: %w", err)
+	}
+	if typ&0xf0 != packetConnAck || len(body) != 2 {
+		return nil, fmt.Errorf("unexpected packet type %#x waiting for connack", typ)
+	}
+	if body[1] != 0 {
+		return nil, fmt.Errorf("connection refused: code %d", body[1])
+	}
+	conn.SetDeadline(time.Time{})
+
+	go c.readLoop(r)
+	go c.pingLoop(opts.KeepAlive)
+	return c, nil
+}
+
+func connectBody(opts Options) []byte {
+	var flags byte = 0x02 // clean session
+	if opts.WillTopic != "" {
+		flags |= 0x04
+		if opts.WillRetain {
+			flags |= 0x20
+		}
+	}
+	if opts.Username != "" {
+		flags |= 0x80
+	}
+	if opts.Password != "" {
+		flags |= 0x40
+	}
+
+	b := appendString(nil, "MQTT")
+	b = append(b, 4, flags)
+	b = binary.BigEndian.AppendUint16(b, uint16(opts.KeepAlive/time.Second))
+	b = appendString(b, opts.ClientID)
+	if opts.WillTopic != "" {
+		b = appendString(b, opts.WillTopic)
+		b = appendString(b, string(opts.WillMessage))
+	}
+	if opts.Username != "" {
+		b = appendString(b, opts.Username)
+	}
+	if opts.Password != "" {
+		b = appendString(b, opts.Password)
+	}
+	return b
+}
+
+// Publish sends payload to topic at QoS 0.
+func (c *Client) Publish(topic string, payload []byte, retain bool) error {
+	var typ byte = packetPublish
+	if retain {
+		typ |= 0x01
+	}
+	body := appendString(nil, topic)
+	body = append(body, payload...)
+	return c.write(typ, body)
+}
+
+// Done is closed when the connection is lost.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close disconnects cleanly from the broker.
+func (c *Client) Close() error {
+	c.write(packetDisconnect, nil)
+	return c.conn.Close()
+}
+
+func (c *Client) write(typ byte, body []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.w.WriteByte(typ)
+	c.w.Write(appendLength(nil, len(body)))
+	c.w.Write(body)
+	c.err = c.w.Flush()
+	return c.err
+}
+
+func (c *Client) readLoop(r *bufio.Reader) {
+	defer close(c.done)
+	defer c.conn.Close()
+	for {
+		// At QoS 0 the only packets expected are PINGRESPs; anything else
+		// is ignored.
+		if _, _, err := readPacket(r); err != nil {
+			c.mu.Lock()
+			if c.err == nil {
+				c.err = err
+			}
+			c.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (c *Client) pingLoop(interval time.Duration) {
+	t := time.NewTicker(interval / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+			if err := c.write(packetPingReq, nil); err != nil {
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var n, shift int
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return typ, body, nil
+}
+
+func appendLength(b []byte, n int) []byte {
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		b = append(b, d)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
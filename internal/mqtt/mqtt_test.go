@@ -0,0 +1,73 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPublish(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	published := make(chan []byte, 1)
+	go func() {
+		r := bufio.NewReader(server)
+		typ, body, err := readPacket(r)
+		if err != nil || typ != packetConnect {
+			t.Errorf("expected connect, got %#x %v", typ, err)
+			return
+		}
+		if !bytes.Contains(body, []byte("dhcpeterd/status")) {
+			t.Errorf("connect is missing will topic: %q", body)
+		}
+		server.Write([]byte{packetConnAck, 2, 0, 0})
+
+		typ, body, err = readPacket(r)
+		if err != nil || typ != packetPublish|0x01 {
+			t.Errorf("expected retained publish, got %#x %v", typ, err)
+			return
+		}
+		published <- body
+		io.Copy(io.Discard, server)
+	}()
+
+	c, err := newClient(client, Options{
+		ClientID:    "test",
+		KeepAlive:   time.Minute,
+		WillTopic:   "dhcpeterd/status",
+		WillMessage: []byte("offline"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Publish("a/b", []byte("hello"), true); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0, 3, 'a', '/', 'b', 'h', 'e', 'l', 'l', 'o'}
+	if got := <-published; !bytes.Equal(got, want) {
+		t.Errorf("publish body: got %q, want %q", got, want)
+	}
+}
+
+func TestAppendLength(t *testing.T) {
+	for _, tt := range []struct {
+		n    int
+		want []byte
+	}{
+		{0, []byte{0}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+	} {
+		if got := appendLength(nil, tt.n); !bytes.Equal(got, tt.want) {
+			t.Errorf("appendLength(%d) = %x, want %x", tt.n, got, tt.want)
+		}
+	}
+}
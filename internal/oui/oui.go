@@ -0,0 +1,127 @@
+// Package oui maps hardware addresses to vendor names using the IEEE MA-L
+// (OUI) registry.
+package oui
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// DefaultPaths are the locations distributions commonly install the IEEE
+// registry to.
+var DefaultPaths = []string{
+	"/usr/share/ieee-data/oui.txt",
+	"/usr/share/hwdata/oui.txt",
+	"/usr/share/misc/oui.txt",
+	"/usr/share/ieee-data/oui.csv",
+}
+
+type DB struct {
+	vendors map[[3]byte]string
+}
+
+// Load reads an IEEE registry in either the oui.txt or the oui.csv format.
+func Load(path string) (*DB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if strings.HasSuffix(path, ".csv") {
+		return parseCSV(f)
+	}
+	return parseText(f)
+}
+
+// LoadDefault loads the first registry found in DefaultPaths.
+func LoadDefault() (*DB, error) {
+	for _, p := range DefaultPaths {
+		db, err := Load(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		return db, err
+	}
+	return nil, fmt.Errorf("no oui database found in %s", strings.Join(DefaultPaths, ", "))
+}
+
+// parseText parses lines of the form
+//
+//	00-00-0C   (hex)		Cisco Systems, Inc
+func parseText(r io.Reader) (*DB, error) {
+	db := &DB{vendors: make(map[[3]byte]string)}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		prefix, vendor, ok := strings.Cut(scanner.Text(), "(hex)")
+		if !ok {
+			continue
+		}
+		oui, ok := parseOUI(strings.TrimSpace(prefix))
+		if !ok {
+			continue
+		}
+		db.vendors[oui] = strings.TrimSpace(vendor)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// parseCSV parses the CSV export with the columns
+// Registry,Assignment,Organization Name,Organization Address.
+func parseCSV(r io.Reader) (*DB, error) {
+	db := &DB{vendors: make(map[[3]byte]string)}
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rec) < 3 {
+			continue
+		}
+		oui, ok := parseOUI(rec[1])
+		if !ok {
+			continue
+		}
+		db.vendors[oui] = strings.TrimSpace(rec[2])
+	}
+	return db, nil
+}
+
+func parseOUI(s string) ([3]byte, bool) {
+	var oui [3]byte
+	b, err := hex.DecodeString(strings.NewReplacer("-", "", ":", "").Replace(s))
+	if err != nil || len(b) != 3 {
+		return oui, false
+	}
+	copy(oui[:], b)
+	return oui, true
+}
+
+// Lookup returns the vendor hwAddr is assigned to, or "" if unknown.
+// Locally administered (e.g. randomized) addresses never have a vendor.
+func (db *DB) Lookup(hwAddr net.HardwareAddr) string {
+	if len(hwAddr) < 3 || hwAddr[0]&0x02 != 0 {
+		return ""
+	}
+	return db.vendors[[3]byte{hwAddr[0], hwAddr[1], hwAddr[2]}]
+}
+
+// Len returns the number of registry entries.
+func (db *DB) Len() int {
+	return len(db.vendors)
+}
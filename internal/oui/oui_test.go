@@ -0,0 +1,58 @@
+package oui
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const ouiTxt = `OUI/MA-L                                                    Organization                                 
+company_id                                                  Organization                                 
+                                                            Address                                      
+
+24-0A-C4   (hex)		Espressif Inc.
+240AC4     (base 16)		Espressif Inc.
+				Shanghai  Shanghai  200241
+				CN
+
+00-04-F2   (hex)		Polycom
+0004F2     (base 16)		Polycom
+				Richmond  British Columbia  V6V 2X8
+				CA
+`
+
+const ouiCSV = `Registry,Assignment,Organization Name,Organization Address
+MA-L,240AC4,Espressif Inc.,"Room 204, Building 2, 690 Bibo Rd, Pudong New Area Shanghai Shanghai CN 201203 "
+MA-L,0004F2,Polycom,1565 Barber Lane Milpitas CA US 95035 
+`
+
+func TestLookup(t *testing.T) {
+	text, err := parseText(strings.NewReader(ouiTxt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	csv, err := parseCSV(strings.NewReader(ouiCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, db := range map[string]*DB{"txt": text, "csv": csv} {
+		if got, want := db.Len(), 2; got != want {
+			t.Errorf("%s: unexpected number of entries: got %d, want %d", name, got, want)
+		}
+		for _, tt := range []struct {
+			hwaddr net.HardwareAddr
+			want   string
+		}{
+			{net.HardwareAddr{0x24, 0x0a, 0xc4, 0x11, 0x22, 0x33}, "Espressif Inc."},
+			{net.HardwareAddr{0x00, 0x04, 0xf2, 0x11, 0x22, 0x33}, "Polycom"},
+			{net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}, ""},
+			// locally administered
+			{net.HardwareAddr{0x26, 0x0a, 0xc4, 0x11, 0x22, 0x33}, ""},
+		} {
+			if got := db.Lookup(tt.hwaddr); got != tt.want {
+				t.Errorf("%s: Lookup(%v) = %q, want %q", name, tt.hwaddr, got, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Package ra builds ICMPv6 Router Advertisements (RFC 4861) with the
+// recursive DNS server and DNS search list options of RFC 8106.
+package ra
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dns"
+)
+
+// ICMPv6 message types.
+const (
+	TypeRouterSolicitation  = 133
+	TypeRouterAdvertisement = 134
+)
+
+// Option types.
+const (
+	optSourceLinkLayerAddr = 1
+	optPrefixInformation   = 3
+	optMTU                 = 5
+	optRDNSS               = 25
+	optDNSSL               = 31
+)
+
+// AllNodes is the group that unsolicited advertisements are sent to, and
+// AllRouters the group that solicitations are sent to.
+var (
+	AllNodes   = net.ParseIP("ff02::1")
+	AllRouters = net.ParseIP("ff02::2")
+)
+
+// Prefix is a prefix advertised in a Prefix Information option.
+type Prefix struct {
+	Prefix            *net.IPNet
+	OnLink            bool
+	Autonomous        bool // hosts may configure addresses with SLAAC
+	ValidLifetime     time.Duration
+	PreferredLifetime time.Duration
+}
+
+// RouterAdvertisement is an advertisement of the sending router. Zero
+// values are left unspecified to hosts.
+type RouterAdvertisement struct {
+	HopLimit uint8
+	Managed  bool // addresses are available with DHCPv6
+	Other    bool // other configuration is available with DHCPv6
+
+	// RouterLifetime of zero means the sender is not a default router.
+	RouterLifetime time.Duration
+	ReachableTime  time.Duration
+	RetransTimer   time.Duration
+
+	SourceLinkLayerAddr net.HardwareAddr
+	MTU                 uint32
+	Prefixes            []Prefix
+	DNSServers          []net.IP
+	DomainSearch        []string
+	DNSLifetime         time.Duration // of DNSServers and DomainSearch
+}
+
+// Marshal returns the ICMPv6 message, with a zero checksum for the kernel
+// to fill in.
+func (ra *RouterAdvertisement) Marshal() []byte {
+	var flags byte
+	if ra.Managed {
+		flags |= 0x80
+	}
+	if ra.Other {
+		flags |= 0x40
+	}
+	b := []byte{TypeRouterAdvertisement, 0, 0, 0, ra.HopLimit, flags}
+	b = binary.BigEndian.AppendUint16(b, uint16(min(seconds(ra.RouterLifetime), 9000)))
+	b = binary.BigEndian.AppendUint32(b, uint32(ra.ReachableTime/time.Millisecond))
+	b = binary.BigEndian.AppendUint32(b, uint32(ra.RetransTimer/time.Millisecond))
+
+	if len(ra.SourceLinkLayerAddr) > 0 {
+		b = appendOption(b, optSourceLinkLayerAddr, ra.SourceLinkLayerAddr)
+	}
+	if ra.MTU != 0 {
+		b = appendOption(b, optMTU, binary.BigEndian.AppendUint32([]byte{0, 0}, ra.MTU))
+	}
+	for _, p := range ra.Prefixes {
+		ones, _ := p.Prefix.Mask.Size()
+		var flags byte
+		if p.OnLink {
+			flags |= 0x80
+		}
+		if p.Autonomous {
+			flags |= 0x40
+		}
+		data := []byte{byte(ones), flags}
+		data = binary.BigEndian.AppendUint32(data, seconds(p.ValidLifetime))
+		data = binary.BigEndian.AppendUint32(data, seconds(p.PreferredLifetime))
+		data = append(data, 0, 0, 0, 0)
+		data = append(data, p.Prefix.IP.Mask(p.Prefix.Mask).To16()...)
+		b = appendOption(b, optPrefixInformation, data)
+	}
+	if len(ra.DNSServers) > 0 {
+		data := binary.BigEndian.AppendUint32([]byte{0, 0}, seconds(ra.DNSLifetime))
+		for _, ip := range ra.DNSServers {
+			data = append(data, ip.To16()...)
+		}
+		b = appendOption(b, optRDNSS, data)
+	}
+	if len(ra.DomainSearch) > 0 {
+		data := binary.BigEndian.AppendUint32([]byte{0, 0}, seconds(ra.DNSLifetime))
+		for _, name := range ra.DomainSearch {
+			if n, err := dns.AppendName(data, name); err == nil {
+				data = n
+			}
+		}
+		b = appendOption(b, optDNSSL, data)
+	}
+	return b
+}
+
+// appendOption appends an option, padding data with zeros to a multiple of
+// eight octets.
+func appendOption(b []byte, typ byte, data []byte) []byte {
+	units := (2 + len(data) + 7) / 8
+	b = append(b, typ, byte(units))
+	b = append(b, data...)
+	return append(b, make([]byte, units*8-2-len(data))...)
+}
+
+// IsRouterSolicitation reports whether the ICMPv6 message b is a Router
+// Solicitation.
+func IsRouterSolicitation(b []byte) bool {
+	return len(b) >= 8 && b[0] == TypeRouterSolicitation && b[1] == 0
+}
+
+func seconds(d time.Duration) uint32 {
+	if d < 0 {
+		return 0
+	}
+	if s := d / time.Second; s < 0xffffffff {
+		return uint32(s)
+	}
+	return 0xffffffff
+}
@@ -0,0 +1,58 @@
+package ra
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMarshal(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("fd00:1::/64")
+	ra := &RouterAdvertisement{
+		HopLimit:            64,
+		Managed:             true,
+		RouterLifetime:      30 * time.Minute,
+		SourceLinkLayerAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1},
+		Prefixes:            []Prefix{{Prefix: prefix, OnLink: true, ValidLifetime: time.Hour, PreferredLifetime: time.Minute}},
+		DNSServers:          []net.IP{net.ParseIP("fd00:1::1")},
+		DomainSearch:        []string{"lan"},
+		DNSLifetime:         time.Hour,
+	}
+	b := ra.Marshal()
+	header := []byte{134, 0, 0, 0, 64, 0x80, 0x07, 0x08, 0, 0, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(b[:16], header) {
+		t.Fatalf("header = %x, want %x", b[:16], header)
+	}
+
+	// Walk the options by their lengths.
+	var types []byte
+	for opts := b[16:]; len(opts) > 0; {
+		if len(opts) < 2 || opts[1] == 0 || len(opts) < int(opts[1])*8 {
+			t.Fatalf("malformed options %x", opts)
+		}
+		types = append(types, opts[0])
+		if opts[0] == optPrefixInformation {
+			if opts[2] != 64 || opts[3] != 0x80 || !bytes.Equal(opts[16:32], prefix.IP) {
+				t.Errorf("prefix information = %x", opts[:32])
+			}
+		}
+		if opts[0] == optDNSSL && !bytes.Equal(opts[8:13], []byte{3, 'l', 'a', 'n', 0}) {
+			t.Errorf("dnssl = %x", opts[:opts[1]*8])
+		}
+		opts = opts[int(opts[1])*8:]
+	}
+	want := []byte{optSourceLinkLayerAddr, optPrefixInformation, optRDNSS, optDNSSL}
+	if !bytes.Equal(types, want) {
+		t.Errorf("option types = %v, want %v", types, want)
+	}
+}
+
+func TestIsRouterSolicitation(t *testing.T) {
+	if !IsRouterSolicitation([]byte{133, 0, 0, 0, 0, 0, 0, 0}) {
+		t.Error("solicitation not recognized")
+	}
+	if IsRouterSolicitation([]byte{134, 0, 0, 0, 0, 0, 0, 0}) {
+		t.Error("advertisement taken for a solicitation")
+	}
+}
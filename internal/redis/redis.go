@@ -0,0 +1,195 @@
+// Package redis implements a minimal Redis client speaking RESP2 over a
+// single connection. It is just enough to store leases.
+package redis
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Error is an error reply from the server.
+type Error string
+
+func (e Error) Error() string {
+	return "redis: " + string(e)
+}
+
+// Client is a connection to a Redis server. Commands are sent one at a
+// time. Transactions (WATCH, MULTI and EXEC) are only meaningful if the
+// client is not shared with other goroutines while they run.
+type Client struct {
+	conn    net.Conn
+	timeout time.Duration
+
+	mu  sync.Mutex // serializes commands
+	r   *bufio.Reader
+	w   *bufio.Writer
+	err error // set once the connection is unusable
+}
+
+// Dial connects to the server at rawURL, of the form
+// redis://[[user]:password@]host[:port][/db] or rediss:// for TLS, and
+// authenticates and selects the database if given. The port defaults to
+// 6379. Each command fails if it takes longer than timeout.
+func Dial(ctx context.Context, rawURL string, timeout time.Duration) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	var d net.Dialer
+	var conn net.Conn
+	switch u.Scheme {
+	case "redis":
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	case "rediss":
+		td := tls.Dialer{NetDialer: &d, Config: &tls.Config{ServerName: u.Hostname()}}
+		conn, err = td.DialContext(ctx, "tcp", addr)
+	default:
+		return nil, fmt.Errorf("unsupported redis scheme: %s", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := newClient(conn, timeout)
+	if password, ok := u.User.Password(); ok {
+		args := []string{"AUTH", password}
+		if user := u.User.Username(); user != "" {
+			args = []string{"AUTH", user, password}
+		}
+		if _, err := c.Do(args...); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if _, err := c.Do("SELECT", db); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func newClient(conn net.Conn, timeout time.Duration) *Client {
+	return &Client{
+		conn:    conn,
+		timeout: timeout,
+		r:       bufio.NewReader(conn),
+		w:       bufio.NewWriter(conn),
+	}
+}
+
+// Do sends a command and returns its reply: a string for simple and bulk
+// strings, an int64 for integers, a []any for arrays and nil for null
+// replies. Error replies are returned as an Error. Any other error means
+// that the connection is no longer usable.
+func (c *Client) Do(args ...string) (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if err := c.w.Flush(); err != nil {
+		c.err = err
+		return nil, err
+	}
+	v, err := readReply(c.r)
+	if err != nil {
+		var rerr Error
+		if !errors.As(err, &rerr) {
+			c.err = err
+		}
+		return nil, err
+	}
+	return v, nil
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	typ, line := line[0], line[1:len(line)-2]
+	switch typ {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, Error(line)
+	case ':':
+		n, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed integer %q", line)
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed bulk length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed array length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		// Errors of elements (such as of commands in EXEC) are returned
+		// as Error values rather than failing the whole reply.
+		a := make([]any, n)
+		for i := range a {
+			v, err := readReply(r)
+			var rerr Error
+			if errors.As(err, &rerr) {
+				a[i] = rerr
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			a[i] = v
+		}
+		return a, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", typ)
+}
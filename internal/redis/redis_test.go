@@ -0,0 +1,64 @@
+package redis
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDo(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		r := bufio.NewReader(server)
+		for _, reply := range []string{
+			"+OK\r\n",
+			"$5\r\nhello\r\n",
+			"$-1\r\n",
+			"*3\r\n:1\r\n-ERR wrong type\r\n$0\r\n\r\n",
+			"-ERR unknown command\r\n",
+		} {
+			if _, err := readReply(r); err != nil {
+				t.Errorf("read command: %v", err)
+				return
+			}
+			server.Write([]byte(reply))
+		}
+		io.Copy(io.Discard, server)
+	}()
+
+	c := newClient(client, time.Minute)
+	defer c.Close()
+
+	for _, tt := range []struct {
+		args []string
+		want any
+		err  string
+	}{
+		{args: []string{"SET", "k", "hello"}, want: "OK"},
+		{args: []string{"GET", "k"}, want: "hello"},
+		{args: []string{"GET", "missing"}, want: nil},
+		{args: []string{"EXEC"}, want: []any{int64(1), Error("ERR wrong type"), ""}},
+		{args: []string{"NOPE"}, err: "unknown command"},
+	} {
+		got, err := c.Do(tt.args...)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Do(%q) error = %v, want %q", tt.args, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Do(%q): %v", tt.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Do(%q) = %#v, want %#v", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+// Neighbor table constants (linux/neighbour.h), which package syscall does
+// not define.
+const (
+	ndaDst         = 1
+	ndaLLAddr      = 2
+	nudIncomplete  = 0x01
+	nudFailed      = 0x20
+	nudNoARP       = 0x40
+	ndmsgLen       = 12
+	rtattrHdrLen   = 4
+	ndmStateOffset = 8
+)
+
+// inventoryLoop records the devices in the kernel's neighbor table that
+// never requested a lease every interval, until ctx is done.
+func (d *daemon) inventoryLoop(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		// Each namespace has its own neighbor table and interface indexes.
+		netns := d.handlerNetns()
+		tables := make(map[string]map[int][]dhcp4d.Neighbor)
+		for iface, h := range d.allHandlers() {
+			ns := netns[iface]
+			neighbors, ok := tables[ns]
+			if !ok {
+				err := inNetns(ns, func() (err error) {
+					neighbors, err = readNeighbors()
+					return err
+				})
+				if err != nil {
+					slog.Error("read neighbor table err", "netns", ns, "err", err)
+				}
+				tables[ns] = neighbors
+			}
+			if neighbors == nil {
+				continue
+			}
+			if n := h.RecordNeighbors(neighbors[h.Interface().Index]); n > 0 {
+				slog.Info("recorded devices without leases", "iface", iface, "count", n)
+			}
+		}
+	}
+}
+
+// readNeighbors returns the resolved IPv4 entries of the kernel's neighbor
+// table by interface index.
+func readNeighbors() (map[int][]dhcp4d.Neighbor, error) {
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETNEIGH, syscall.AF_INET)
+	if err != nil {
+		return nil, fmt.Errorf("netlink neighbor dump: %w", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, fmt.Errorf("netlink neighbor dump: %w", err)
+	}
+	neighbors := make(map[int][]dhcp4d.Neighbor)
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWNEIGH || len(m.Data) < ndmsgLen || m.Data[0] != syscall.AF_INET {
+			continue
+		}
+		index := int(int32(binary.NativeEndian.Uint32(m.Data[4:])))
+		state := binary.NativeEndian.Uint16(m.Data[ndmStateOffset:])
+		if state&(nudIncomplete|nudFailed|nudNoARP) != 0 {
+			continue
+		}
+		var n dhcp4d.Neighbor
+		for b := m.Data[ndmsgLen:]; len(b) >= rtattrHdrLen; {
+			l := int(binary.NativeEndian.Uint16(b))
+			if l < rtattrHdrLen || l > len(b) {
+				break
+			}
+			switch binary.NativeEndian.Uint16(b[2:]) {
+			case ndaDst:
+				n.Addr = net.IP(b[rtattrHdrLen:l]).To4()
+			case ndaLLAddr:
+				n.HardwareAddr = net.HardwareAddr(b[rtattrHdrLen:l])
+			}
+			b = b[min(len(b), (l+3)&^3):]
+		}
+		if n.Addr != nil && len(n.HardwareAddr) == 6 {
+			neighbors[index] = append(neighbors[index], n)
+		}
+	}
+	return neighbors, nil
+}
@@ -0,0 +1,137 @@
+//go:build !mips && !mipsle && !mips64 && !mips64le
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// System calls and constants of linux/landlock.h.
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1
+	landlockRulePathBeneath      = 1
+
+	landlockAccessExecute    = 1 << 0
+	landlockAccessWriteFile  = 1 << 1
+	landlockAccessReadFile   = 1 << 2
+	landlockAccessReadDir    = 1 << 3
+	landlockAccessRemoveDir  = 1 << 4
+	landlockAccessRemoveFile = 1 << 5
+	landlockAccessMakeChar   = 1 << 6
+	landlockAccessMakeDir    = 1 << 7
+	landlockAccessMakeReg    = 1 << 8
+	landlockAccessMakeSock   = 1 << 9
+	landlockAccessMakeFifo   = 1 << 10
+	landlockAccessMakeBlock  = 1 << 11
+	landlockAccessMakeSym    = 1 << 12
+	landlockAccessRefer      = 1 << 13 // ABI 2
+	landlockAccessTruncate   = 1 << 14 // ABI 3
+	landlockAccessIoctlDev   = 1 << 15 // ABI 5
+
+	// Rights that apply to files, as opposed to directories.
+	landlockAccessFile = landlockAccessExecute | landlockAccessWriteFile | landlockAccessReadFile |
+		landlockAccessTruncate | landlockAccessIoctlDev
+
+	oPath = 0x200000 // O_PATH
+)
+
+var errLandlockUnsupported = errors.New("landlock is not supported")
+
+// landlockAccess are the rights granted for each sandboxAccess.
+var landlockAccess = map[sandboxAccess]uint64{
+	sandboxRead: landlockAccessReadFile | landlockAccessReadDir,
+	sandboxExec: landlockAccessReadFile | landlockAccessReadDir | landlockAccessExecute,
+	sandboxWrite: landlockAccessReadFile | landlockAccessReadDir | landlockAccessWriteFile |
+		landlockAccessRemoveDir | landlockAccessRemoveFile | landlockAccessMakeDir |
+		landlockAccessMakeReg | landlockAccessMakeFifo | landlockAccessMakeSym |
+		landlockAccessRefer | landlockAccessTruncate,
+	sandboxSocket: landlockAccessRemoveFile | landlockAccessMakeSock,
+}
+
+// landlock restricts the file system access of the process and all of its
+// threads to paths. Paths that do not exist are skipped.
+func landlock(paths []sandboxPath) error {
+	// Landlock applies to the calling thread and the threads it creates
+	// from then on, so every thread of the runtime has to restrict itself,
+	// which the runtime only supports without cgo.
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0)
+	if errno == syscall.ENOTSUP {
+		return fmt.Errorf("%w with cgo", errLandlockUnsupported)
+	}
+	if errno != 0 {
+		return fmt.Errorf("prctl(PR_SET_NO_NEW_PRIVS): %w", errno)
+	}
+
+	abi, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno == syscall.ENOSYS || errno == syscall.EOPNOTSUPP {
+		return errLandlockUnsupported
+	}
+	if errno != 0 {
+		return fmt.Errorf("landlock_create_ruleset: %w", errno)
+	}
+	handled := uint64(landlockAccessMakeSym<<1 - 1)
+	if abi >= 2 {
+		handled |= landlockAccessRefer
+	}
+	if abi >= 3 {
+		handled |= landlockAccessTruncate
+	}
+	if abi >= 5 {
+		handled |= landlockAccessIoctlDev
+	}
+
+	// struct landlock_ruleset_attr, up to handled_access_fs.
+	attr := handled
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock_create_ruleset: %w", errno)
+	}
+	defer syscall.Close(int(fd))
+	for _, p := range paths {
+		if err := landlockAddPath(int(fd), p.path, landlockAccess[p.access]&handled); err != nil {
+			return err
+		}
+	}
+
+	if _, _, errno := syscall.AllThreadsSyscall(sysLandlockRestrictSelf, fd, 0, 0); errno != 0 {
+		return fmt.Errorf("landlock_restrict_self: %w", errno)
+	}
+	return nil
+}
+
+// landlockAddPath allows access beneath path in ruleset.
+func landlockAddPath(ruleset int, path string, access uint64) error {
+	fd, err := syscall.Open(path, oPath|syscall.O_CLOEXEC, 0)
+	if errors.Is(err, syscall.ENOENT) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("landlock %s: %w", path, err)
+	}
+	defer syscall.Close(fd)
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return fmt.Errorf("landlock %s: %w", path, err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		access &= landlockAccessFile
+	}
+
+	// struct landlock_path_beneath_attr is packed: allowed_access (u64)
+	// and parent_fd (s32).
+	var attr [12]byte
+	binary.NativeEndian.PutUint64(attr[:], access)
+	binary.NativeEndian.PutUint32(attr[8:], uint32(fd))
+	if _, _, errno := syscall.Syscall6(sysLandlockAddRule, uintptr(ruleset), landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr)), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("landlock %s: %w", path, errno)
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build mips || mipsle || mips64 || mips64le
+
+package main
+
+import "errors"
+
+var errLandlockUnsupported = errors.New("landlock is not supported")
+
+func landlock(paths []sandboxPath) error {
+	return errLandlockUnsupported
+}
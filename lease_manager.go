@@ -2,77 +2,412 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"log/slog"
-	"os"
+	"maps"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/psanford/dhcpeterd/internal/dhcp4d"
 )
 
+// exportInterval is how often the lease exports are refreshed to drop
+// expired leases.
+const exportInterval = time.Minute
+
 type leaseManager struct {
-	path string
-	lf   *LeaseFile
+	path     string // the default lease file
+	readOnly bool   // never save (dry run)
+
+	// newStore returns the store of a lease file path.
+	newStore func(path string) (LeaseStore, error)
+
+	mu     sync.Mutex            // guards files, which are only modified by the update loop
+	files  map[string]*LeaseFile // loaded lease files by path
+	stores map[string]LeaseStore // by path; the database of an empty path is not persisted
+	dirty  map[string]bool       // files modified since they were last saved
+
+	// dnsmasqPath, if set, receives the leases of all lease files in
+	// dnsmasq's format whenever they are saved.
+	dnsmasqPath string
+	dnsmasqLast []byte // contents last written to dnsmasqPath
+
+	// hostsPath, if set, receives the hostnames of the active leases in
+	// /etc/hosts format, qualified with hostsDomain if set.
+	hostsPath   string
+	hostsDomain string
+	hostsLast   []byte // contents last written to hostsPath
+
+	// hostsDir, if set, receives a hosts file per lease, as hostsPath.
+	hostsDir     string
+	hostsDirLast map[string]string // contents of the files written to hostsDir by name
+
+	// backups is the number of backups kept of each lease file by the
+	// default store.
+	backups int
+
+	// writeInterval is the minimum time between writes. Updates within it
+	// are coalesced into one write.
+	writeInterval time.Duration
+
+	leaseUpdate    chan LeaseUpdate
+	approvedUpdate chan ApprovedUpdate
+	hostnameUpdate chan HostnameUpdate
+
+	metrics *metricsRegistry
+
+	// done is closed once the update loop has written its final state.
+	done chan struct{}
 
-	leaseUpdate chan LeaseUpdate
+	// replicate, if set, is called from the update loop with every
+	// LeaseUpdate, ApprovedUpdate and HostnameUpdate once it is applied.
+	// It must not block.
+	replicate func(update any)
+
+	// newDevice is called (in its own goroutine) the first time a hardware
+	// address receives a lease.
+	newDevice func(iface string, l dhcp4d.Lease)
+}
+
+// newLeaseManager returns a lease manager whose default lease file is p,
+// stored by newStore (a locked JSON file if nil). Lease files are loaded by
+// open.
+func newLeaseManager(p string, newStore func(path string) (LeaseStore, error)) *leaseManager {
+	lm := &leaseManager{
+		path:           p,
+		newStore:       newStore,
+		files:          make(map[string]*LeaseFile),
+		stores:         make(map[string]LeaseStore),
+		dirty:          make(map[string]bool),
+		leaseUpdate:    make(chan LeaseUpdate),
+		approvedUpdate: make(chan ApprovedUpdate),
+		hostnameUpdate: make(chan HostnameUpdate),
+		done:           make(chan struct{}),
+	}
+	if lm.newStore == nil {
+		lm.newStore = func(path string) (LeaseStore, error) {
+			return lm.fileStore(path)
+		}
+	}
+	return lm
 }
 
-func newLeaseManager(p string) *leaseManager {
-	lm := leaseManager{
-		path:        p,
-		leaseUpdate: make(chan LeaseUpdate),
-		lf: &LeaseFile{
-			LeaseByInterface: make(map[string][]dhcp4d.Lease),
-		},
+// fileStore returns the default store of the lease file at path.
+func (lm *leaseManager) fileStore(path string) (*fileStore, error) {
+	// A dry run may run alongside the instance that owns the file.
+	s, err := newFileStore(path, !lm.readOnly)
+	if err != nil {
+		return nil, err
 	}
+	s.backups = lm.backups
+	return s, nil
+}
 
+// resolve returns the path of a network's lease file, which defaults to
+// lm.path.
+func (lm *leaseManager) resolve(p string) string {
 	if p == "" {
-		return &lm
+		return lm.path
 	}
+	return p
+}
 
-	b, err := os.ReadFile(p)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			slog.Error("read lease file err", "err", err)
+// open loads the lease file p (or the default) unless it is already loaded.
+// It fails if the file's store cannot be opened, such as when another
+// instance holds the lease file; a file that cannot be read is logged and
+// replaced by an empty one.
+func (lm *leaseManager) open(p string) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	_, err := lm.openLocked(p)
+	return err
+}
+
+func (lm *leaseManager) openLocked(p string) (*LeaseFile, error) {
+	p = lm.resolve(p)
+	if lf, ok := lm.files[p]; ok {
+		return lf, nil
+	}
+	lf := newLeaseFile()
+	if p != "" {
+		store, err := lm.newStore(p)
+		if err != nil {
+			return nil, err
+		}
+		lm.stores[p] = store
+		loaded, err := store.Load()
+		if err != nil {
+			slog.Error("load lease file err", "path", p, "err", err)
+		} else {
+			lf = loaded
 		}
-		return &lm
 	}
+	lm.files[p] = lf
+	return lf, nil
+}
 
-	var lf LeaseFile
-	err = json.Unmarshal(b, &lf)
+// fileLocked returns the lease file p (or the default), which should have
+// been opened. If it cannot be, its leases are kept in memory only. lm.mu
+// must be held.
+func (lm *leaseManager) fileLocked(p string) *LeaseFile {
+	lf, err := lm.openLocked(p)
 	if err != nil {
-		slog.Error("parse lease file json err", "err", err)
-		return &lm
+		slog.Error("open lease file err", "path", lm.resolve(p), "err", err)
+		lf = newLeaseFile()
+		lm.files[lm.resolve(p)] = lf
 	}
-	lm.lf = &lf
+	return lf
+}
 
-	return &lm
+// seenLocked reports whether hw has been given a lease on any network.
+func (lm *leaseManager) seenLocked(hw string) bool {
+	for _, lf := range lm.files {
+		if _, ok := lf.Seen[hw]; ok {
+			return true
+		}
+	}
+	return false
 }
 
+// updateLeaseFileLoop persists updates until ctx is done, then writes the
+// lease files a final time and closes lm.done.
 func (lm *leaseManager) updateLeaseFileLoop(ctx context.Context) {
+	defer close(lm.done)
+	var flush <-chan time.Time
+	// Exports only list unexpired leases, so they change as leases expire.
+	exports := time.NewTicker(exportInterval)
+	defer exports.Stop()
 	for {
 		select {
 		case <-ctx.Done():
+			lm.write()
+			lm.close()
 			return
+		case <-flush:
+			flush = nil
+			lm.write()
+			continue
+		case <-exports.C:
+			lm.writeExports()
+			continue
 		case update := <-lm.leaseUpdate:
-			lm.lf.LeaseByInterface[update.IfaceName] = update.Leases
-			if lm.path == "" {
-				continue
+			lm.mu.Lock()
+			lf := lm.fileLocked(update.File)
+			lf.LeaseByInterface[update.IfaceName] = update.Leases
+			if l := update.Latest; l != nil && !lm.seenLocked(l.HardwareAddr) {
+				lf.Seen[l.HardwareAddr] = time.Now()
+				slog.Info("new device", "iface", update.IfaceName, "hw", l.HardwareAddr, "name", l.Hostname, "ip", l.Addr)
+				if lm.newDevice != nil {
+					go lm.newDevice(update.IfaceName, *l)
+				}
+			}
+			p := lm.resolve(update.File)
+			lm.dirty[p] = true
+			store := lm.stores[p]
+			lm.mu.Unlock()
+			if l := update.Latest; l != nil && store != nil && !lm.readOnly {
+				if err := store.SaveLease(update.IfaceName, *l); err != nil {
+					slog.Error("save lease err", "path", p, "err", err)
+				}
+			}
+			if lm.replicate != nil {
+				lm.replicate(update)
+			}
+		case update := <-lm.approvedUpdate:
+			lm.mu.Lock()
+			lm.fileLocked(update.File).ApprovedByInterface[update.IfaceName] = update.Approved
+			lm.dirty[lm.resolve(update.File)] = true
+			lm.mu.Unlock()
+			if lm.replicate != nil {
+				lm.replicate(update)
 			}
-			b, err := json.Marshal(lm.lf)
-			if err != nil {
-				slog.Error("marshal lease file err", "err", err)
-				continue
+		case update := <-lm.hostnameUpdate:
+			lm.mu.Lock()
+			lm.fileLocked(update.File).HostnamesByInterface[update.IfaceName] = update.Overrides
+			lm.dirty[lm.resolve(update.File)] = true
+			lm.mu.Unlock()
+			if lm.replicate != nil {
+				lm.replicate(update)
 			}
-			os.WriteFile(lm.path, b, 0600)
+		}
+
+		if lm.writeInterval <= 0 {
+			lm.write()
+		} else if flush == nil {
+			flush = time.After(lm.writeInterval)
 		}
 	}
 }
 
+// write saves the lease files that have been modified.
+func (lm *leaseManager) write() {
+	lm.mu.Lock()
+	changed := len(lm.dirty) > 0
+	pending := make(map[string]*LeaseFile)
+	for p := range lm.dirty {
+		if lm.stores[p] != nil && !lm.readOnly {
+			pending[p] = lm.files[p].clone()
+		}
+	}
+	clear(lm.dirty)
+	stores := maps.Clone(lm.stores)
+	lm.mu.Unlock()
+
+	for p, lf := range pending {
+		if err := stores[p].SaveAll(lf); err != nil {
+			slog.Error("write lease file err", "path", p, "err", err)
+			lm.metrics.leaseFileWriteErrors.inc()
+		}
+	}
+
+	if changed {
+		lm.writeExports()
+	}
+}
+
+// writeExports writes the lease exports, such as the dnsmasq lease file.
+// Files are only replaced if their contents changed.
+func (lm *leaseManager) writeExports() {
+	if lm.readOnly {
+		return
+	}
+	if lm.dnsmasqPath != "" {
+		if err := lm.writeDnsmasq(); err != nil {
+			slog.Error("write dnsmasq lease file err", "path", lm.dnsmasqPath, "err", err)
+			lm.metrics.leaseFileWriteErrors.inc()
+		}
+	}
+	if lm.hostsPath != "" {
+		if err := lm.writeHosts(); err != nil {
+			slog.Error("write hosts file err", "path", lm.hostsPath, "err", err)
+			lm.metrics.leaseFileWriteErrors.inc()
+		}
+	}
+	if lm.hostsDir != "" {
+		if err := lm.writeHostsDir(); err != nil {
+			slog.Error("write hosts dir err", "path", lm.hostsDir, "err", err)
+			lm.metrics.leaseFileWriteErrors.inc()
+		}
+	}
+}
+
+// close closes the stores.
+func (lm *leaseManager) close() {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	for p, store := range lm.stores {
+		if err := store.Close(); err != nil {
+			slog.Error("close lease store err", "path", p, "err", err)
+		}
+	}
+}
+
+// snapshot returns the updates that recreate the current state of every
+// interface.
+func (lm *leaseManager) snapshot() []any {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	var updates []any
+	for p, lf := range lm.files {
+		file := p
+		if p == lm.path {
+			file = ""
+		}
+		for iface, leases := range lf.LeaseByInterface {
+			updates = append(updates, LeaseUpdate{IfaceName: iface, File: file, Leases: leases})
+		}
+		for iface, approved := range lf.ApprovedByInterface {
+			updates = append(updates, ApprovedUpdate{IfaceName: iface, File: file, Approved: approved})
+		}
+		for iface, overrides := range lf.HostnamesByInterface {
+			updates = append(updates, HostnameUpdate{IfaceName: iface, File: file, Overrides: maps.Clone(overrides)})
+		}
+	}
+	return updates
+}
+
+// paths returns the paths of the lease files in use.
+func (lm *leaseManager) paths() []string {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	var paths []string
+	for p := range lm.files {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+// interfaceState returns copies of the persisted leases, approvals and
+// hostname overrides of iface, which are kept in the lease file file (or the
+// default). State of an interface that has just been moved to its own file
+// is taken over from the default file.
+func (lm *leaseManager) interfaceState(iface, file string) ([]*dhcp4d.Lease, []string, map[string]string) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	lf := lm.fileLocked(file)
+	if def := lm.fileLocked(""); lf != def {
+		if _, ok := lf.LeaseByInterface[iface]; !ok {
+			if _, ok := def.LeaseByInterface[iface]; ok {
+				lf.LeaseByInterface[iface] = def.LeaseByInterface[iface]
+				if approved, ok := def.ApprovedByInterface[iface]; ok {
+					lf.ApprovedByInterface[iface] = approved
+				}
+				if overrides, ok := def.HostnamesByInterface[iface]; ok {
+					lf.HostnamesByInterface[iface] = overrides
+				}
+				delete(def.LeaseByInterface, iface)
+				delete(def.ApprovedByInterface, iface)
+				delete(def.HostnamesByInterface, iface)
+				lm.dirty[lm.resolve(file)] = true
+				lm.dirty[lm.path] = true
+			}
+		}
+	}
+
+	stored := lf.LeaseByInterface[iface]
+	leases := make([]*dhcp4d.Lease, len(stored))
+	for i, l := range stored {
+		l := l
+		leases[i] = &l
+	}
+	overrides := make(map[string]string, len(lf.HostnamesByInterface[iface]))
+	for hw, name := range lf.HostnamesByInterface[iface] {
+		overrides[hw] = name
+	}
+	return leases, slices.Clone(lf.ApprovedByInterface[iface]), overrides
+}
+
 type LeaseFile struct {
-	LeaseByInterface map[string][]dhcp4d.Lease `json:"lease_by_interface"`
+	LeaseByInterface    map[string][]dhcp4d.Lease `json:"lease_by_interface"`
+	ApprovedByInterface map[string][]string       `json:"approved_by_interface,omitempty"`
+
+	// HostnamesByInterface holds hostname overrides by hardware address.
+	HostnamesByInterface map[string]map[string]string `json:"hostnames_by_interface,omitempty"`
+
+	// Seen records when each hardware address was first given a lease.
+	Seen map[string]time.Time `json:"seen,omitempty"`
 }
 
+// LeaseUpdate, ApprovedUpdate and HostnameUpdate replace the state of an
+// interface in the lease file File, or the default lease file if empty.
 type LeaseUpdate struct {
 	IfaceName string
+	File      string
 	Leases    []dhcp4d.Lease
+	Latest    *dhcp4d.Lease
+}
+
+type ApprovedUpdate struct {
+	IfaceName string
+	File      string
+	Approved  []string
+}
+
+type HostnameUpdate struct {
+	IfaceName string
+	File      string
+	Overrides map[string]string
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+func TestLeaseManagerCoalesce(t *testing.T) {
+	store := &memStore{lf: newLeaseFile()}
+	lm := newLeaseManager("/var/lib/dhcpeterd/leases.json", func(string) (LeaseStore, error) {
+		return store, nil
+	})
+	const interval = 50 * time.Millisecond
+	lm.writeInterval = interval
+	if err := lm.open(""); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go lm.updateLeaseFileLoop(ctx)
+
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		lm.leaseUpdate <- LeaseUpdate{IfaceName: "eth0", Leases: []dhcp4d.Lease{{Num: i, HardwareAddr: "aa:bb:cc:dd:ee:ff"}}}
+	}
+	if time.Since(start) >= interval {
+		t.Skip("updates took longer than the write interval")
+	}
+	time.Sleep(3 * interval)
+	lf, saves := store.saved()
+	if saves != 1 {
+		t.Errorf("%d writes for 20 updates, want 1", saves)
+	}
+	if l := lf.LeaseByInterface["eth0"]; len(l) != 1 || l[0].Num != 19 {
+		t.Errorf("saved %+v, want the last update", l)
+	}
+
+	// Nothing changed since, so shutdown doesn't write again.
+	cancel()
+	<-lm.done
+	if _, saves := store.saved(); saves != 1 {
+		t.Errorf("%d writes after shutdown, want 1", saves)
+	}
+}
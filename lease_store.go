@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+// LeaseStore persists a lease database. The lease manager calls it from a
+// single goroutine.
+type LeaseStore interface {
+	// Load returns the stored database. A store that does not exist yet
+	// returns an empty database.
+	Load() (*LeaseFile, error)
+
+	// SaveLease is called with every lease granted or renewed on iface,
+	// before the database it belongs to is saved with SaveAll. Stores that
+	// save the whole database at once may ignore it.
+	SaveLease(iface string, l dhcp4d.Lease) error
+
+	// SaveAll replaces the stored database with lf.
+	SaveAll(lf *LeaseFile) error
+
+	Close() error
+}
+
+func newLeaseFile() *LeaseFile {
+	return &LeaseFile{
+		LeaseByInterface:     make(map[string][]dhcp4d.Lease),
+		ApprovedByInterface:  make(map[string][]string),
+		HostnamesByInterface: make(map[string]map[string]string),
+		Seen:                 make(map[string]time.Time),
+	}
+}
+
+// clone returns a copy of lf that can be read while lf is updated. Updates
+// replace the per-interface values, so they are shared.
+func (lf *LeaseFile) clone() *LeaseFile {
+	return &LeaseFile{
+		LeaseByInterface:     maps.Clone(lf.LeaseByInterface),
+		ApprovedByInterface:  maps.Clone(lf.ApprovedByInterface),
+		HostnamesByInterface: maps.Clone(lf.HostnamesByInterface),
+		Seen:                 maps.Clone(lf.Seen),
+	}
+}
+
+// fileStore is the default LeaseStore, a JSON file.
+type fileStore struct {
+	path string
+	last []byte   // the contents as last read or written
+	lock *os.File // holds the lock of path, if locked
+
+	// backups is the number of backups of the file to keep. A backup is
+	// made before the file is first overwritten and then at most every
+	// backupInterval.
+	backups    int
+	lastBackup time.Time
+}
+
+// backupInterval is the minimum time between lease file backups.
+const backupInterval = time.Hour
+
+// newFileStore returns the store of the lease file at path. If lock is
+// true it takes an exclusive lock on path.lock, failing if another process
+// holds it, until the store is closed. The lease file itself is replaced on
+// every write, so it cannot hold the lock.
+func newFileStore(path string, lock bool) (*fileStore, error) {
+	s := &fileStore{path: path}
+	if !lock {
+		return s, nil
+	}
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("lease file %s is locked by another dhcpeterd instance", path)
+		}
+		return nil, fmt.Errorf("lock lease file %s: %w", path, err)
+	}
+	s.lock = f
+	return s, nil
+}
+
+func (s *fileStore) Load() (*LeaseFile, error) {
+	b, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return newLeaseFile(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return newLeaseFile(), nil
+	}
+	// Even a file that fails to parse is backed up before it is replaced.
+	s.last = b
+
+	var lf LeaseFile
+	if err := json.Unmarshal(b, &lf); err != nil {
+		return nil, err
+	}
+	if lf.LeaseByInterface == nil {
+		lf.LeaseByInterface = make(map[string][]dhcp4d.Lease)
+	}
+	if lf.ApprovedByInterface == nil {
+		lf.ApprovedByInterface = make(map[string][]string)
+	}
+	if lf.HostnamesByInterface == nil {
+		lf.HostnamesByInterface = make(map[string]map[string]string)
+	}
+	if lf.Seen == nil {
+		// Lease file predates Seen; don't report every existing client as new.
+		lf.Seen = make(map[string]time.Time)
+		for _, leases := range lf.LeaseByInterface {
+			for _, l := range leases {
+				lf.Seen[l.HardwareAddr] = l.LastACK
+			}
+		}
+	}
+	return &lf, nil
+}
+
+func (s *fileStore) SaveLease(string, dhcp4d.Lease) error {
+	return nil
+}
+
+// SaveAll writes lf unless the file already has the same contents.
+func (s *fileStore) SaveAll(lf *LeaseFile) error {
+	b, err := json.Marshal(lf)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(b, s.last) {
+		return nil
+	}
+	if s.backups > 0 && len(s.last) > 0 && time.Since(s.lastBackup) >= backupInterval {
+		if err := s.backup(); err != nil {
+			slog.Error("back up lease file err", "path", s.path, "err", err)
+		}
+	}
+	// Replace the file rather than rewrite it, so that a crash never
+	// leaves a truncated database.
+	if err := writeFileAtomic(s.path, b, 0600); err != nil {
+		return err
+	}
+	s.last = b
+	return nil
+}
+
+// backup saves the current contents of the file with a timestamp suffix
+// and removes the oldest backups beyond s.backups.
+func (s *fileStore) backup() error {
+	now := time.Now()
+	if err := os.WriteFile(s.path+"."+now.UTC().Format(backupTimeFormat), s.last, 0600); err != nil {
+		return err
+	}
+	s.lastBackup = now
+	backups, err := leaseFileBackups(s.path)
+	if err != nil {
+		return err
+	}
+	for len(backups) > s.backups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// leaseFileBackups returns the backups of the lease file at path, oldest
+// first.
+func leaseFileBackups(path string) ([]string, error) {
+	names, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	backups := filterBackups(path, names)
+	slices.Sort(backups)
+	return backups, nil
+}
+
+func (s *fileStore) Close() error {
+	if s.lock == nil {
+		return nil
+	}
+	return s.lock.Close()
+}
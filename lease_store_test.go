@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "leases.json")
+	s, err := newFileStore(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	lf, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lf.LeaseByInterface) != 0 {
+		t.Fatalf("new store has leases: %+v", lf.LeaseByInterface)
+	}
+
+	lf.LeaseByInterface["eth0"] = []dhcp4d.Lease{{Num: 3, HardwareAddr: "aa:bb:cc:dd:ee:ff", Hostname: "laptop"}}
+	if err := s.SaveAll(lf); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf.LeaseByInterface["eth0"][0].Hostname = "desktop"
+	if err := s.SaveAll(lf); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(before, after) {
+		t.Errorf("lease file was rewritten in place")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != "leases.json" && e.Name() != "leases.json.lock" {
+			t.Errorf("left %s behind", e.Name())
+		}
+	}
+
+	loaded, err := (&fileStore{path: path}).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := loaded.LeaseByInterface["eth0"]; len(l) != 1 || l[0].Hostname != "desktop" {
+		t.Errorf("loaded %+v, want the lease last saved", l)
+	}
+}
+
+func TestFileStoreSeen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	// A lease file from before Seen was recorded.
+	lastACK := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.WriteFile(path, []byte(`{"lease_by_interface":{"eth0":[{"hardware_addr":"aa:bb:cc:dd:ee:ff","last_ack":"2024-05-01T12:00:00Z"}]}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	lf, err := (&fileStore{path: path}).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lf.Seen["aa:bb:cc:dd:ee:ff"]; !got.Equal(lastACK) {
+		t.Errorf("seen = %v, want %v", got, lastACK)
+	}
+}
+
+// memStore is a LeaseStore that keeps the database in memory.
+type memStore struct {
+	mu    sync.Mutex
+	lf    *LeaseFile
+	saves int // calls of SaveAll
+}
+
+func (s *memStore) Load() (*LeaseFile, error)            { return s.lf, nil }
+func (s *memStore) SaveLease(string, dhcp4d.Lease) error { return nil }
+func (s *memStore) Close() error                         { return nil }
+
+func (s *memStore) SaveAll(lf *LeaseFile) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lf = lf
+	s.saves++
+	return nil
+}
+
+func (s *memStore) saved() (*LeaseFile, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lf, s.saves
+}
+
+func TestLeaseManagerStore(t *testing.T) {
+	store := &memStore{lf: newLeaseFile()}
+	store.lf.LeaseByInterface["eth0"] = []dhcp4d.Lease{{Num: 3, HardwareAddr: "aa:bb:cc:dd:ee:ff"}}
+	var opened []string
+	lm := newLeaseManager("/var/lib/dhcpeterd/leases.json", func(path string) (LeaseStore, error) {
+		opened = append(opened, path)
+		return store, nil
+	})
+	if err := lm.open(""); err != nil {
+		t.Fatal(err)
+	}
+	if err := lm.open("/var/lib/dhcpeterd/leases.json"); err != nil {
+		t.Fatal(err)
+	}
+	if len(opened) != 1 || opened[0] != "/var/lib/dhcpeterd/leases.json" {
+		t.Errorf("opened %q, want the default lease file once", opened)
+	}
+	leases, _, _ := lm.interfaceState("eth0", "")
+	if len(leases) != 1 || leases[0].HardwareAddr != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("leases = %+v, want those of the store", leases)
+	}
+}
+
+func TestFileStoreLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	s, err := newFileStore(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newFileStore(path, true); err == nil || !strings.Contains(err.Error(), "locked by another dhcpeterd instance") {
+		t.Errorf("second lock: %v, want locked by another instance", err)
+	}
+	// Dry runs don't lock.
+	dry, err := newFileStore(path, false)
+	if err != nil {
+		t.Errorf("unlocked store: %v", err)
+	}
+	dry.Close()
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = newFileStore(path, true)
+	if err != nil {
+		t.Fatalf("lock after close: %v", err)
+	}
+	s.Close()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+// leaseQueryConn answers RFC 4388 DHCPLEASEQUERY messages from allowed
+// addresses, which dhcp4.Serve would drop, and passes all other messages
+// on to it.
+type leaseQueryConn struct {
+	net.PacketConn
+	d     *daemon
+	loop  *serveLoop
+	allow []*net.IPNet
+}
+
+func (c *leaseQueryConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || n < 240 {
+			return n, addr, err
+		}
+		p := dhcp4.Packet(b[:n])
+		options := p.ParseOptions()
+		if t := options[dhcp4.OptionDHCPMessageType]; len(t) != 1 || dhcp4.MessageType(t[0]) != dhcp4d.LeaseQuery {
+			return n, addr, err
+		}
+		c.answer(p, options, addr)
+	}
+}
+
+func (c *leaseQueryConn) answer(p dhcp4.Packet, options dhcp4.Options, addr net.Addr) {
+	src, ok := addr.(*net.UDPAddr)
+	if !ok || !c.allowed(src.IP) {
+		slog.Debug("leasequery from unauthorized address", "addr", addr)
+		return
+	}
+	reply := c.d.leaseQuery(p, options, c.loop.current())
+	if reply == nil {
+		return
+	}
+	// Replies go to the relay agent or access concentrator that asked.
+	to := addr
+	if giaddr := net.IP(p.GIAddr()); !giaddr.Equal(net.IPv4zero) {
+		to = &net.UDPAddr{IP: giaddr, Port: 67}
+	}
+	if _, err := c.WriteTo(reply, to); err != nil {
+		slog.Error("leasequery reply err", "addr", to, "err", err)
+	}
+}
+
+func (c *leaseQueryConn) allowed(ip net.IP) bool {
+	for _, n := range c.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// leaseQuery answers a leasequery from the leases of all networks.
+// Networks are asked in order, starting with local, the one the query
+// arrived on.
+func (d *daemon) leaseQuery(p dhcp4.Packet, options dhcp4.Options, local *dhcp4d.Handler) dhcp4.Packet {
+	d.mu.Lock()
+	handlers := []*dhcp4d.Handler{local}
+	for _, iface := range d.interfacesLocked() {
+		if h, ok := d.handlers[iface]; ok && h != local {
+			handlers = append(handlers, h)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, h := range handlers {
+		if reply, ok := h.AnswerLeaseQuery(p, options); ok {
+			return reply
+		}
+	}
+	return dhcp4d.LeaseUnknownReply(p, local.ServerIP())
+}
+
+// parseLeaseQueryAllow parses the networks allowed to send leasequeries.
+func parseLeaseQueryAllow(cidrs []string) ([]*net.IPNet, error) {
+	var allow []*net.IPNet
+	for _, s := range cidrs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			if ip := net.ParseIP(s); ip != nil {
+				if ip4 := ip.To4(); ip4 != nil {
+					ip = ip4
+				}
+				n = &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))}
+			} else {
+				return nil, fmt.Errorf("lease_query_allow: invalid network %q", s)
+			}
+		}
+		allow = append(allow, n)
+	}
+	return allow, nil
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/psanford/dhcpeterd/config"
+)
+
+// setupLogging installs the default slog handler according to conf. If
+// level is set it overrides conf.LogLevel.
+func setupLogging(conf *config.Config, level string) error {
+	if level == "" {
+		level = conf.LogLevel
+	}
+	var l slog.Level
+	if level != "" {
+		if err := l.UnmarshalText([]byte(level)); err != nil {
+			return fmt.Errorf("invalid log level: %s", level)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: l}
+
+	var handlers []slog.Handler
+	switch {
+	case conf.Journald:
+		j, err := newJournaldHandler(opts)
+		if err != nil {
+			return err
+		}
+		handlers = append(handlers, j)
+	case conf.LogFormat == "" || conf.LogFormat == "text":
+		handlers = append(handlers, slog.NewTextHandler(os.Stderr, opts))
+	case conf.LogFormat == "json":
+		handlers = append(handlers, slog.NewJSONHandler(os.Stderr, opts))
+	default:
+		return fmt.Errorf("invalid log format: %s", conf.LogFormat)
+	}
+	if conf.Syslog != nil {
+		s, err := newSyslogHandler(conf.Syslog, opts)
+		if err != nil {
+			return err
+		}
+		handlers = append(handlers, s)
+	}
+
+	if len(handlers) == 1 {
+		slog.SetDefault(slog.New(handlers[0]))
+	} else {
+		slog.SetDefault(slog.New(multiHandler(handlers)))
+	}
+	return nil
+}
+
+// multiHandler sends each record to all of its handlers.
+type multiHandler []slog.Handler
+
+func (m multiHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, l) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range m {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(multiHandler, len(m))
+	for i, h := range m {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (m multiHandler) WithGroup(name string) slog.Handler {
+	out := make(multiHandler, len(m))
+	for i, h := range m {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogHandler formats records with a text handler and sends each one as
+// an RFC 5424 message. Attributes are carried in the message text.
+type syslogHandler struct {
+	slog.Handler
+	w *syslogWriter
+}
+
+func newSyslogHandler(conf *config.Syslog, opts *slog.HandlerOptions) (*syslogHandler, error) {
+	addr := conf.Address
+	if addr == "" {
+		addr = "unix:///dev/log"
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("parse syslog address err: %w", err)
+	}
+	w := &syslogWriter{
+		facility: syslogFacilities["daemon"],
+		tag:      conf.Tag,
+		pid:      os.Getpid(),
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		w.network, w.addr = u.Scheme, u.Host
+	case "unix":
+		w.network, w.addr = "unixgram", u.Path
+	default:
+		return nil, fmt.Errorf("invalid syslog address: %s", addr)
+	}
+	if conf.Facility != "" {
+		f, ok := syslogFacilities[conf.Facility]
+		if !ok {
+			return nil, fmt.Errorf("invalid syslog facility: %s", conf.Facility)
+		}
+		w.facility = f
+	}
+	if w.tag == "" {
+		w.tag = "dhcpeterd"
+	}
+	w.hostname, _ = os.Hostname()
+	if w.hostname == "" {
+		w.hostname = "-"
+	}
+
+	textOpts := *opts
+	textOpts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+		// Time and level are part of the syslog header, and the message
+		// is written ahead of the attributes.
+		if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey || a.Key == slog.MessageKey) {
+			return slog.Attr{}
+		}
+		return a
+	}
+	return &syslogHandler{Handler: slog.NewTextHandler(w, &textOpts), w: w}, nil
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.w.mu.Lock()
+	defer h.w.mu.Unlock()
+	h.w.level = r.Level
+	h.w.time = r.Time
+	h.w.msg = r.Message
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{Handler: h.Handler.WithAttrs(attrs), w: h.w}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{Handler: h.Handler.WithGroup(name), w: h.w}
+}
+
+// syslogWriter frames each Write as one syslog message, using the level and
+// time of the record being handled. Callers must hold mu.
+type syslogWriter struct {
+	network  string
+	addr     string
+	facility int
+	tag      string
+	hostname string
+	pid      int
+
+	mu    sync.Mutex
+	conn  net.Conn
+	level slog.Level
+	time  time.Time
+	msg   string
+}
+
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d - - %s",
+		w.facility*8+syslogSeverity(w.level),
+		w.time.Format(time.RFC3339Nano),
+		w.hostname, w.tag, w.pid,
+		strings.TrimSpace(w.msg+" "+string(p)))
+	if w.network == "tcp" {
+		// RFC 6587 octet counting.
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+
+	// Reconnect once if the previous connection has gone away.
+	for attempt := 0; ; attempt++ {
+		if w.conn == nil {
+			conn, err := net.DialTimeout(w.network, w.addr, 5*time.Second)
+			if err != nil {
+				return 0, err
+			}
+			w.conn = conn
+		}
+		_, err := w.conn.Write([]byte(msg))
+		if err == nil {
+			return len(p), nil
+		}
+		w.conn.Close()
+		w.conn = nil
+		if attempt > 0 {
+			return 0, err
+		}
+	}
+}
+
+func syslogSeverity(l slog.Level) int {
+	switch {
+	case l >= slog.LevelError:
+		return 3
+	case l >= slog.LevelWarn:
+		return 4
+	case l >= slog.LevelInfo:
+		return 6
+	default:
+		return 7
+	}
+}
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+// journaldHandler sends records to the systemd journal using its native
+// protocol, with each attribute as an upper-cased field.
+type journaldHandler struct {
+	level  slog.Leveler
+	conn   *net.UnixConn
+	attrs  []byte // pre-encoded fields from WithAttrs
+	prefix string // group prefix for field names
+}
+
+func newJournaldHandler(opts *slog.HandlerOptions) (*journaldHandler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("connect to journald err: %w", err)
+	}
+	return &journaldHandler{level: opts.Level, conn: conn}, nil
+}
+
+func (h *journaldHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+func (h *journaldHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	journalField(&buf, "MESSAGE", r.Message)
+	journalField(&buf, "PRIORITY", fmt.Sprint(syslogSeverity(r.Level)))
+	journalField(&buf, "SYSLOG_IDENTIFIER", "dhcpeterd")
+	buf.Write(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		appendJournalAttr(&buf, h.prefix, a)
+		return true
+	})
+	_, err := h.conn.Write(buf.Bytes())
+	return err
+}
+
+func (h *journaldHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var buf bytes.Buffer
+	buf.Write(h.attrs)
+	for _, a := range attrs {
+		appendJournalAttr(&buf, h.prefix, a)
+	}
+	h2 := *h
+	h2.attrs = buf.Bytes()
+	return &h2
+}
+
+func (h *journaldHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix = h.prefix + name + "_"
+	return &h2
+}
+
+func appendJournalAttr(buf *bytes.Buffer, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "_"
+		}
+		for _, ga := range a.Value.Group() {
+			appendJournalAttr(buf, prefix, ga)
+		}
+		return
+	}
+	journalField(buf, journalFieldName(prefix+a.Key), a.Value.String())
+}
+
+// journalFieldName maps k to a valid journal field name: upper case
+// letters, digits and underscores, not starting with an underscore.
+func journalFieldName(k string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, k)
+	name = strings.TrimLeft(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "X" + name
+	}
+	return name
+}
+
+// journalField appends a field in the journal native format. Values that
+// contain newlines use the length-prefixed binary form.
+func journalField(buf *bytes.Buffer, k, v string) {
+	buf.WriteString(k)
+	if !strings.Contains(v, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(v)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(v)))
+	buf.WriteString(v)
+	buf.WriteByte('\n')
+}
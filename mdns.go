@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+	"github.com/psanford/dhcpeterd/internal/dns"
+)
+
+// mdnsGroup is the multicast DNS group (RFC 6762).
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+const (
+	mdnsTTL       = 120 // seconds, as RFC 6762 recommends for host records
+	mdnsLegacyTTL = 10  // seconds, for queries from ordinary resolvers
+
+	// mdnsCacheFlush is the cache-flush bit of record classes, which is
+	// the unicast-response bit of question classes.
+	mdnsCacheFlush = 1 << 15
+
+	soReusePort = 0xf // SO_REUSEPORT, which package syscall lacks on Linux
+)
+
+// mdnsPublisher answers multicast DNS queries for the hostnames of active
+// leases on the networks that enable mdns, and announces leases as they
+// are granted.
+type mdnsPublisher struct {
+	events chan ifaceEvent
+
+	mu         sync.Mutex
+	responders map[string]*mdnsResponder // by interface
+}
+
+func newMDNSPublisher() *mdnsPublisher {
+	return &mdnsPublisher{
+		events:     make(chan ifaceEvent, 128),
+		responders: make(map[string]*mdnsResponder),
+	}
+}
+
+func (p *mdnsPublisher) send(iface string, ev dhcp4d.Event) {
+	switch ev.Type {
+	case dhcp4d.EventAdd, dhcp4d.EventRelease, dhcp4d.EventExpire:
+	default:
+		return
+	}
+	p.mu.Lock()
+	_, ok := p.responders[iface]
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case p.events <- ifaceEvent{iface: iface, ev: ev}:
+	default:
+		slog.Error("mdns queue full, dropping event", "type", ev.Type, "hw", ev.Lease.HardwareAddr)
+	}
+}
+
+func (p *mdnsPublisher) loop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-p.events:
+			p.mu.Lock()
+			r := p.responders[e.iface]
+			p.mu.Unlock()
+			if r != nil {
+				r.event(e.ev)
+			}
+		}
+	}
+}
+
+// listen starts answering for the leases of loop on iface. The responder
+// should be served, and stopped with the network.
+func (p *mdnsPublisher) listen(iface string, loop *serveLoop) (*mdnsResponder, error) {
+	conn, err := newMDNSListener(iface)
+	if err != nil {
+		return nil, err
+	}
+	r := &mdnsResponder{iface: iface, conn: conn, loop: loop, self: make(map[string]bool)}
+	p.mu.Lock()
+	p.responders[iface] = r
+	p.mu.Unlock()
+	return r, nil
+}
+
+// stop closes r, which makes its serve return.
+func (p *mdnsPublisher) stop(r *mdnsResponder) {
+	p.mu.Lock()
+	if p.responders[r.iface] == r {
+		delete(p.responders, r.iface)
+	}
+	p.mu.Unlock()
+	r.conn.Close()
+}
+
+type mdnsResponder struct {
+	iface string
+	conn  net.PacketConn
+	loop  *serveLoop
+
+	mu   sync.Mutex
+	self map[string]bool // addresses of clients seen answering for themselves
+}
+
+// serve answers queries until the responder is stopped.
+func (r *mdnsResponder) serve() error {
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		m, err := dns.Unpack(buf[:n])
+		src, ok := from.(*net.UDPAddr)
+		if err != nil || !ok || m.Opcode != dns.OpcodeQuery {
+			continue
+		}
+		if m.Response {
+			r.sawResponse(m, src.IP)
+			continue
+		}
+		r.answer(m, src)
+	}
+}
+
+// sawResponse records clients that answer for their own address.
+func (r *mdnsResponder) sawResponse(m *dns.Message, src net.IP) {
+	for _, rr := range m.Answers {
+		if rr.Type == dns.TypeA && net.IP(rr.Data).Equal(src) {
+			r.mu.Lock()
+			if !r.self[src.String()] {
+				slog.Debug("mdns: client answers for itself", "iface", r.iface, "ip", src)
+				r.self[src.String()] = true
+			}
+			r.mu.Unlock()
+			return
+		}
+	}
+}
+
+// answer replies to the query q from src with the records of the leases it
+// asks for, other than those in its known answers.
+func (r *mdnsResponder) answer(q *dns.Message, src *net.UDPAddr) {
+	// Queries not from the mDNS port come from ordinary resolvers, which
+	// expect a unicast reply echoing the query.
+	legacy := src.Port != mdnsGroup.Port
+	unicast := legacy
+	now := time.Now()
+	var answers []dns.RR
+	for _, question := range q.Questions {
+		if question.Class&mdnsCacheFlush != 0 {
+			unicast = true
+		}
+		if class := question.Class &^ mdnsCacheFlush; class != dns.ClassINET && class != dns.ClassANY {
+			continue
+		}
+		for _, l := range r.loop.current().ListLeases() {
+			if l.Expired(now) || l.Unknown {
+				continue
+			}
+			for _, rr := range r.records(l, mdnsTTL) {
+				if (question.Type == rr.Type || question.Type == dns.TypeANY) &&
+					strings.EqualFold(strings.TrimSuffix(question.Name, "."), rr.Name) &&
+					!knownAnswer(q.Answers, rr) {
+					answers = append(answers, rr)
+				}
+			}
+		}
+	}
+	if len(answers) == 0 {
+		return
+	}
+
+	reply := &dns.Message{Header: dns.Header{Response: true, Authoritative: true}, Answers: answers}
+	if legacy {
+		reply.ID = q.ID
+		reply.Questions = q.Questions
+		for i := range reply.Answers {
+			reply.Answers[i].Class &^= mdnsCacheFlush
+			reply.Answers[i].TTL = mdnsLegacyTTL
+		}
+	}
+	to := mdnsGroup
+	if unicast {
+		to = src
+	}
+	r.write(reply, to)
+}
+
+// knownAnswer reports whether the querier listed rr among its known answers
+// with at least half its TTL remaining (RFC 6762 section 7.1).
+func knownAnswer(known []dns.RR, rr dns.RR) bool {
+	for _, k := range known {
+		if k.Type == rr.Type && strings.EqualFold(strings.TrimSuffix(k.Name, "."), rr.Name) &&
+			bytes.Equal(k.Data, rr.Data) && k.TTL >= rr.TTL/2 {
+			return true
+		}
+	}
+	return false
+}
+
+// records returns the A record of l's <hostname>.local and the PTR record
+// of its address, unless it has no valid hostname or answers for itself.
+func (r *mdnsResponder) records(l dhcp4d.Lease, ttl uint32) []dns.RR {
+	hostname := leaseHostname(l)
+	ip := l.Addr.To4()
+	if hostname == "" || ip == nil {
+		return nil
+	}
+	r.mu.Lock()
+	self := r.self[ip.String()]
+	r.mu.Unlock()
+	if self {
+		return nil
+	}
+	name := hostname + ".local"
+	ptr, err := dns.NameData(name)
+	if err != nil {
+		return nil
+	}
+	return []dns.RR{
+		{Name: name, Type: dns.TypeA, Class: dns.ClassINET | mdnsCacheFlush, TTL: ttl, Data: ip},
+		{Name: dns.ReverseName(ip), Type: dns.TypePTR, Class: dns.ClassINET | mdnsCacheFlush, TTL: ttl, Data: ptr},
+	}
+}
+
+// event announces new leases and says goodbye to released and expired
+// ones.
+func (r *mdnsResponder) event(ev dhcp4d.Event) {
+	if ev.Type == dhcp4d.EventAdd {
+		r.announce(ev.Lease, mdnsTTL)
+		// Announcements are repeated after a second (RFC 6762 section
+		// 8.3).
+		time.AfterFunc(time.Second, func() { r.announce(ev.Lease, mdnsTTL) })
+		return
+	}
+	r.announce(ev.Lease, 0)
+	r.mu.Lock()
+	delete(r.self, ev.Lease.Addr.String())
+	r.mu.Unlock()
+}
+
+func (r *mdnsResponder) announce(l dhcp4d.Lease, ttl uint32) {
+	if rrs := r.records(l, ttl); len(rrs) > 0 {
+		r.write(&dns.Message{Header: dns.Header{Response: true, Authoritative: true}, Answers: rrs}, mdnsGroup)
+	}
+}
+
+func (r *mdnsResponder) write(m *dns.Message, to net.Addr) {
+	b, err := m.Pack()
+	if err != nil {
+		slog.Error("mdns pack err", "iface", r.iface, "err", err)
+		return
+	}
+	if _, err := r.conn.WriteTo(b, to); err != nil {
+		slog.Debug("mdns write err", "iface", r.iface, "to", to, "err", err)
+	}
+}
+
+// newMDNSListener returns a socket on the mDNS port of interfaceName that
+// has joined the mDNS group. The port is shared with other responders,
+// such as avahi.
+func newMDNSListener(interfaceName string) (pc net.PacketConn, e error) {
+	iface, err := net.InterfaceByName(interfaceName)
+	if err != nil {
+		return nil, err
+	}
+	s, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { // clean up if something goes wrong
+		if e != nil {
+			syscall.Close(s)
+		}
+	}()
+
+	if err := syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return nil, err
+	}
+	if err := syscall.SetsockoptInt(s, syscall.SOL_SOCKET, soReusePort, 1); err != nil {
+		return nil, err
+	}
+	if err := syscall.SetsockoptString(s, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, interfaceName); err != nil {
+		return nil, err
+	}
+	mreq := &syscall.IPMreqn{Ifindex: int32(iface.Index)}
+	copy(mreq.Multiaddr[:], mdnsGroup.IP.To4())
+	if err := syscall.SetsockoptIPMreqn(s, syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq); err != nil {
+		return nil, err
+	}
+	if err := syscall.SetsockoptIPMreqn(s, syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, mreq); err != nil {
+		return nil, err
+	}
+	if err := syscall.SetsockoptInt(s, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, 255); err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Bind(s, &syscall.SockaddrInet4{Port: mdnsGroup.Port}); err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(s), "")
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
+)
+
+// metricsRegistry holds the daemon's counters and renders them, along with
+// pool gauges computed at scrape time, in the Prometheus text format.
+type metricsRegistry struct {
+	packets              *counterVec
+	replies              *counterVec
+	errors               *counterVec
+	writeErrors          *counterVec
+	leaseFileWriteErrors *counterVec
+	networkRestarts      *counterVec
+	handleDuration       *histogramVec
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		packets:              newCounterVec("dhcpeterd_packets_received_total", "DHCP messages received by message type.", "interface", "type"),
+		replies:              newCounterVec("dhcpeterd_replies_sent_total", "DHCP replies sent by message type.", "interface", "type"),
+		errors:               newCounterVec("dhcpeterd_handler_errors_total", "Errors while handling DHCP messages.", "interface", "kind"),
+		writeErrors:          newCounterVec("dhcpeterd_raw_write_errors_total", "Replies that could not be written to the raw socket.", "interface"),
+		leaseFileWriteErrors: newCounterVec("dhcpeterd_lease_file_write_errors_total", "Failed writes of the lease file."),
+		networkRestarts:      newCounterVec("dhcpeterd_network_restarts_total", "Restarts of networks that failed.", "interface"),
+		handleDuration:       newHistogramVec("dhcpeterd_handle_duration_seconds", "Time taken to handle a DHCP message, by message type.", latencyBuckets, "interface", "type"),
+	}
+}
+
+// handlerMetrics implements dhcp4d.Metrics for one interface.
+type handlerMetrics struct {
+	r     *metricsRegistry
+	iface string
+}
+
+func (m handlerMetrics) PacketReceived(t dhcp4.MessageType) {
+	m.r.packets.inc(m.iface, strings.ToLower(t.String()))
+}
+
+func (m handlerMetrics) ReplySent(t dhcp4.MessageType) {
+	m.r.replies.inc(m.iface, strings.ToLower(t.String()))
+}
+
+func (m handlerMetrics) HandleDuration(t dhcp4.MessageType, d time.Duration) {
+	m.r.handleDuration.observe(d.Seconds(), m.iface, strings.ToLower(t.String()))
+}
+
+func (m handlerMetrics) WriteFailed(error) {
+	m.r.writeErrors.inc(m.iface)
+}
+
+func (m handlerMetrics) Error(kind string) {
+	m.r.errors.inc(m.iface, kind)
+}
+
+func (d *daemon) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m := d.metrics
+	m.packets.write(w)
+	m.replies.write(w)
+	m.errors.write(w)
+	m.writeErrors.write(w)
+	m.leaseFileWriteErrors.write(w)
+	m.networkRestarts.write(w)
+	m.handleDuration.write(w)
+
+	d.mu.Lock()
+	configured := d.interfacesLocked()
+	d.mu.Unlock()
+	handlers := d.allHandlers()
+	fmt.Fprintf(w, "# HELP dhcpeterd_network_up Whether a configured network is being served.\n# TYPE dhcpeterd_network_up gauge\n")
+	for _, iface := range configured {
+		up := 0
+		if _, ok := handlers[iface]; ok {
+			up = 1
+		}
+		fmt.Fprintf(w, "dhcpeterd_network_up{interface=%s} %d\n", labelValue(iface), up)
+	}
+
+	ifaces := make([]string, 0, len(handlers))
+	for iface := range handlers {
+		ifaces = append(ifaces, iface)
+	}
+	sort.Strings(ifaces)
+
+	gauges := []struct{ name, help string }{
+		{"dhcpeterd_pool_size", "Addresses in the default pool."},
+		{"dhcpeterd_leases_active", "Unexpired leases."},
+		{"dhcpeterd_leases_expired", "Expired leases still in the database."},
+		{"dhcpeterd_static_leases", "Static leases."},
+		{"dhcpeterd_pool_utilization_ratio", "Fraction of the default pool that is leased or reserved."},
+	}
+	values := make([][]float64, len(gauges))
+	for _, iface := range ifaces {
+		s := handlers[iface].Stats()
+		for i, v := range []float64{float64(s.PoolSize), float64(s.Active), float64(s.Expired), float64(s.Static), s.Utilization / 100} {
+			values[i] = append(values[i], v)
+		}
+	}
+	for i, g := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		for j, iface := range ifaces {
+			fmt.Fprintf(w, "%s{interface=%s} %g\n", g.name, labelValue(iface), values[i][j])
+		}
+	}
+}
+
+// counterVec is a counter with a fixed set of label names.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64 // by label values joined with \xff
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	if c == nil {
+		return
+	}
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if len(c.labels) == 0 {
+		fmt.Fprintf(w, "%s %g\n", c.name, c.values[""])
+		return
+	}
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		vals := strings.Split(k, "\xff")
+		pairs := make([]string, len(c.labels))
+		for i, l := range c.labels {
+			pairs[i] = l + "=" + labelValue(vals[i])
+		}
+		fmt.Fprintf(w, "%s{%s} %g\n", c.name, strings.Join(pairs, ","), c.values[k])
+	}
+}
+
+// latencyBuckets are the upper bounds, in seconds, of the handle duration
+// histogram.
+var latencyBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+// histogramVec is a histogram with a fixed set of label names.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram // by label values joined with \xff
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative; the last is +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	if h == nil {
+		return
+	}
+	key := strings.Join(labelValues, "\xff")
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist := h.values[key]
+	if hist == nil {
+		hist = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.values[key] = hist
+	}
+	hist.counts[i]++
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		vals := strings.Split(k, "\xff")
+		pairs := make([]string, len(h.labels))
+		for i, l := range h.labels {
+			pairs[i] = l + "=" + labelValue(vals[i])
+		}
+		labels := strings.Join(pairs, ",")
+		hist := h.values[k]
+		var cum uint64
+		for i, b := range h.buckets {
+			cum += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", h.name, labels, b, cum)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.name, labels, hist.count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", h.name, labels, hist.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, labels, hist.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue quotes v as a label value.
+func labelValue(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+	"github.com/psanford/dhcpeterd/internal/mqtt"
+)
+
+// mqttPublisher publishes lease events to <prefix>/event/<event> and
+// retained per-device presence to <prefix>/device/<mac>/{state,attributes}.
+// With Home Assistant discovery enabled each device is announced as a
+// device_tracker entity.
+type mqttPublisher struct {
+	conf      config.MQTT
+	queue     chan leaseEvent
+	announced map[string]bool
+}
+
+func newMQTTPublisher(conf config.MQTT) *mqttPublisher {
+	if conf.TopicPrefix == "" {
+		conf.TopicPrefix = "dhcpeterd"
+	}
+	if conf.DiscoveryPrefix == "" {
+		conf.DiscoveryPrefix = "homeassistant"
+	}
+	if conf.ClientID == "" {
+		conf.ClientID = "dhcpeterd"
+	}
+	return &mqttPublisher{
+		conf:  conf,
+		queue: make(chan leaseEvent, 256),
+	}
+}
+
+func (m *mqttPublisher) statusTopic() string {
+	return m.conf.TopicPrefix + "/status"
+}
+
+func (m *mqttPublisher) send(iface string, ev dhcp4d.Event) {
+	select {
+	case m.queue <- newLeaseEvent(iface, ev):
+	default:
+		slog.Error("mqtt queue full, dropping event", "type", ev.Type, "hw", ev.Lease.HardwareAddr)
+	}
+}
+
+func (m *mqttPublisher) loop(ctx context.Context) {
+	backoff := time.Second
+	for {
+		c, err := mqtt.Dial(ctx, m.conf.Broker, mqtt.Options{
+			ClientID:    m.conf.ClientID,
+			Username:    m.conf.Username,
+			Password:    m.conf.Password,
+			WillTopic:   m.statusTopic(),
+			WillMessage: []byte("offline"),
+			WillRetain:  true,
+		})
+		if err != nil {
+			slog.Error("mqtt connect err", "broker", m.conf.Broker, "err", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, time.Minute)
+			continue
+		}
+		backoff = time.Second
+		slog.Info("mqtt connected", "broker", m.conf.Broker)
+
+		m.serve(ctx, c)
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (m *mqttPublisher) serve(ctx context.Context, c *mqtt.Client) {
+	defer c.Close()
+
+	// Discovery configs are retained, but republish them after reconnecting
+	// in case the broker lost its state.
+	m.announced = make(map[string]bool)
+	if err := c.Publish(m.statusTopic(), []byte("online"), true); err != nil {
+		slog.Error("mqtt publish err", "err", err)
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			c.Publish(m.statusTopic(), []byte("offline"), true)
+			return
+		case <-c.Done():
+			slog.Error("mqtt connection lost", "broker", m.conf.Broker)
+			return
+		case ev := <-m.queue:
+			if err := m.publish(c, ev); err != nil {
+				slog.Error("mqtt publish err", "event", ev.Event, "hw", ev.Lease.HardwareAddr, "err", err)
+				return
+			}
+		}
+	}
+}
+
+func (m *mqttPublisher) publish(c *mqtt.Client, ev leaseEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if err := c.Publish(m.conf.TopicPrefix+"/event/"+ev.Event, b, false); err != nil {
+		return err
+	}
+
+	var state string
+	switch ev.Event {
+	case "ack":
+		state = "home"
+	case "release", "expire":
+		state = "not_home"
+	default:
+		return nil
+	}
+
+	id := strings.ReplaceAll(ev.Lease.HardwareAddr, ":", "")
+	deviceTopic := m.conf.TopicPrefix + "/device/" + id
+
+	if m.conf.HomeAssistant && !m.announced[id] {
+		b, err := json.Marshal(m.discoveryConfig(id, deviceTopic, ev.Lease))
+		if err != nil {
+			return err
+		}
+		topic := m.conf.DiscoveryPrefix + "/device_tracker/dhcpeterd_" + id + "/config"
+		if err := c.Publish(topic, b, true); err != nil {
+			return err
+		}
+		m.announced[id] = true
+	}
+
+	b, err = json.Marshal(deviceAttributes{
+		IP:           ev.Lease.Addr.String(),
+		HardwareAddr: ev.Lease.HardwareAddr,
+		Hostname:     ev.Lease.Hostname,
+		Vendor:       ev.Lease.Vendor,
+		DeviceType:   ev.Lease.DeviceType,
+		Interface:    ev.Interface,
+		Expiry:       ev.Lease.Expiry,
+	})
+	if err != nil {
+		return err
+	}
+	if err := c.Publish(deviceTopic+"/attributes", b, true); err != nil {
+		return err
+	}
+	return c.Publish(deviceTopic+"/state", []byte(state), true)
+}
+
+type deviceAttributes struct {
+	IP           string    `json:"ip"`
+	HardwareAddr string    `json:"mac"`
+	Hostname     string    `json:"host_name,omitempty"`
+	Vendor       string    `json:"vendor,omitempty"`
+	DeviceType   string    `json:"device_type,omitempty"`
+	Interface    string    `json:"interface"`
+	Expiry       time.Time `json:"expiry"`
+}
+
+// haDiscovery is a Home Assistant MQTT discovery payload for a
+// device_tracker.
+type haDiscovery struct {
+	Name                string   `json:"name"`
+	UniqueID            string   `json:"unique_id"`
+	StateTopic          string   `json:"state_topic"`
+	JSONAttributesTopic string   `json:"json_attributes_topic"`
+	AvailabilityTopic   string   `json:"availability_topic"`
+	PayloadHome         string   `json:"payload_home"`
+	PayloadNotHome      string   `json:"payload_not_home"`
+	SourceType          string   `json:"source_type"`
+	Device              haDevice `json:"device"`
+}
+
+type haDevice struct {
+	Identifiers  []string    `json:"identifiers"`
+	Connections  [][2]string `json:"connections"`
+	Name         string      `json:"name"`
+	Manufacturer string      `json:"manufacturer,omitempty"`
+	Model        string      `json:"model,omitempty"`
+}
+
+func (m *mqttPublisher) discoveryConfig(id, deviceTopic string, l dhcp4d.Lease) haDiscovery {
+	name := l.Hostname
+	if name == "" {
+		name = l.HardwareAddr
+	}
+	return haDiscovery{
+		Name:                name,
+		UniqueID:            "dhcpeterd_" + id,
+		StateTopic:          deviceTopic + "/state",
+		JSONAttributesTopic: deviceTopic + "/attributes",
+		AvailabilityTopic:   m.statusTopic(),
+		PayloadHome:         "home",
+		PayloadNotHome:      "not_home",
+		SourceType:          "router",
+		Device: haDevice{
+			Identifiers:  []string{"dhcpeterd_" + id},
+			Connections:  [][2]string{{"mac", l.HardwareAddr}},
+			Name:         name,
+			Manufacturer: l.Vendor,
+			Model:        l.DeviceType,
+		},
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// rtnetlink multicast groups (linux/rtnetlink.h), which package syscall
+// does not define.
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4IfAddr = 0x10
+)
+
+// watchLinks signals changed whenever an interface or IPv4 address is added,
+// removed or changes state, until ctx is done. Signals are dropped while one
+// is pending.
+func watchLinks(ctx context.Context, changed chan<- struct{}) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("netlink socket: %w", err)
+	}
+	sa := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIPv4IfAddr,
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return fmt.Errorf("netlink bind: %w", err)
+	}
+	// A non-blocking fd is managed by the runtime poller, so closing the
+	// file interrupts a pending read.
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	f := os.NewFile(uintptr(fd), "netlink")
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+
+	buf := make([]byte, 1<<16)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, m := range msgs {
+			switch m.Header.Type {
+			case syscall.RTM_NEWLINK, syscall.RTM_DELLINK, syscall.RTM_NEWADDR, syscall.RTM_DELADDR:
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// setAddr6 adds (or replaces) the IPv6 address addr on the interface with
+// index, expiring after the valid lifetime, or removes it if valid is 0.
+func setAddr6(index int, addr *net.IPNet, valid, preferred time.Duration) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("netlink socket: %w", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("netlink bind: %w", err)
+	}
+
+	typ, flags := uint16(syscall.RTM_DELADDR), uint16(syscall.NLM_F_REQUEST|syscall.NLM_F_ACK)
+	if valid > 0 {
+		typ = syscall.RTM_NEWADDR
+		flags |= syscall.NLM_F_CREATE | syscall.NLM_F_REPLACE
+	}
+	ones, _ := addr.Mask.Size()
+	body := []byte{syscall.AF_INET6, byte(ones), 0, syscall.RT_SCOPE_UNIVERSE}
+	body = binary.NativeEndian.AppendUint32(body, uint32(index))
+	body = appendRtattr(body, syscall.IFA_LOCAL, addr.IP.To16())
+	body = appendRtattr(body, syscall.IFA_ADDRESS, addr.IP.To16())
+	if valid > 0 {
+		// struct ifa_cacheinfo: preferred and valid lifetimes in seconds,
+		// then timestamps that the kernel fills in.
+		info := binary.NativeEndian.AppendUint32(nil, uint32(min(preferred, valid)/time.Second))
+		info = binary.NativeEndian.AppendUint32(info, uint32(valid/time.Second))
+		info = append(info, make([]byte, 8)...)
+		body = appendRtattr(body, syscall.IFA_CACHEINFO, info)
+	}
+	msg := binary.NativeEndian.AppendUint32(nil, uint32(syscall.NLMSG_HDRLEN+len(body)))
+	msg = binary.NativeEndian.AppendUint16(msg, typ)
+	msg = binary.NativeEndian.AppendUint16(msg, flags)
+	msg = binary.NativeEndian.AppendUint32(msg, 1) // sequence number
+	msg = binary.NativeEndian.AppendUint32(msg, 0) // port ID
+	msg = append(msg, body...)
+	if err := syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("netlink send: %w", err)
+	}
+
+	buf := make([]byte, 4096)
+	n, _, err := syscall.Recvfrom(fd, buf, 0)
+	if err != nil {
+		return fmt.Errorf("netlink receive: %w", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		if m.Header.Type == syscall.NLMSG_ERROR && len(m.Data) >= 4 {
+			if errno := -int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+				return syscall.Errno(errno)
+			}
+		}
+	}
+	return nil
+}
+
+// appendRtattr appends a route attribute, padded to four bytes.
+func appendRtattr(b []byte, typ uint16, data []byte) []byte {
+	b = binary.NativeEndian.AppendUint16(b, uint16(syscall.SizeofRtAttr+len(data)))
+	b = binary.NativeEndian.AppendUint16(b, typ)
+	b = append(b, data...)
+	for len(b)%syscall.RTA_ALIGNTO != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
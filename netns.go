@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// netnsPath returns the path of the network namespace ns, a name of "ip
+// netns" or a path such as /proc/PID/ns/net.
+func netnsPath(ns string) string {
+	if strings.Contains(ns, "/") {
+		return ns
+	}
+	return filepath.Join("/run/netns", ns)
+}
+
+// inNetns calls f in the network namespace ns, so that the interfaces it
+// looks up and the sockets it opens are those of ns, or directly if ns is
+// empty. Goroutines started by f run outside of ns.
+func inNetns(ns string, f func() error) error {
+	if ns == "" {
+		return f()
+	}
+	errc := make(chan error, 1)
+	go func() {
+		// The thread stays locked so that the runtime discards it when the
+		// goroutine exits, instead of reusing it in ns.
+		runtime.LockOSThread()
+		fd, err := syscall.Open(netnsPath(ns), syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			errc <- fmt.Errorf("netns %s: %w", ns, err)
+			return
+		}
+		_, _, errno := syscall.RawSyscall(sysSetns, uintptr(fd), syscall.CLONE_NEWNET, 0)
+		syscall.Close(fd)
+		if errno != 0 {
+			errc <- fmt.Errorf("netns %s: setns: %w", ns, errno)
+			return
+		}
+		errc <- f()
+	}()
+	return <-errc
+}
+
+// handlerNetns returns the namespaces of the handlers, by name, that are
+// not in the daemon's own: those of networks with netns and their VLANs.
+func (d *daemon) handlerNetns() map[string]string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	netns := make(map[string]string)
+	for iface, nw := range d.networks {
+		if nw.conf.Netns == "" {
+			continue
+		}
+		netns[iface] = nw.conf.Netns
+		for _, v := range nw.conf.VLANs {
+			netns[vlanNetwork(nw.conf, v).Interface] = nw.conf.Netns
+		}
+	}
+	return netns
+}
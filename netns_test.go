@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/psanford/dhcpeterd/config"
+)
+
+func TestNetnsPath(t *testing.T) {
+	for _, tt := range []struct {
+		ns, want string
+	}{
+		{"lab1", "/run/netns/lab1"},
+		{"/proc/42/ns/net", "/proc/42/ns/net"},
+	} {
+		if got := netnsPath(tt.ns); got != tt.want {
+			t.Errorf("netnsPath(%q) = %q, want %q", tt.ns, got, tt.want)
+		}
+	}
+}
+
+func TestInNetns(t *testing.T) {
+	called := false
+	err := inNetns("dhcpeterd-test-missing", func() error {
+		called = true
+		return nil
+	})
+	if err == nil || called {
+		t.Errorf("missing namespace: err %v, called %v", err, called)
+	}
+
+	// A new namespace, kept by a thread that is never unlocked.
+	created := make(chan string)
+	release := make(chan struct{})
+	defer close(release)
+	go func() {
+		runtime.LockOSThread()
+		if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+			created <- ""
+			return
+		}
+		created <- fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), syscall.Gettid())
+		<-release
+	}()
+	ns := <-created
+	if ns == "" {
+		t.Skip("creating a network namespace needs CAP_SYS_ADMIN")
+	}
+
+	var inside []net.Interface
+	err = inNetns(ns, func() (err error) {
+		inside, err = net.Interfaces()
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inside) != 1 || inside[0].Name != "lo" {
+		t.Errorf("interfaces in the new namespace: %v, want only lo", inside)
+	}
+}
+
+func TestHandlerNetns(t *testing.T) {
+	d := &daemon{networks: map[string]*network{
+		"eth0": {conf: config.Network{Interface: "eth0"}},
+		"eth1": {conf: config.Network{Interface: "eth1", Netns: "lab1", VLANs: []config.VLAN{{ID: 10}}}},
+	}}
+	got := d.handlerNetns()
+	want := map[string]string{"eth1": "lab1", "eth1.10": "lab1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("handlerNetns() = %v, want %v", got, want)
+	}
+}
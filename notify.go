@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+// newDeviceEvent is sent when a hardware address receives its first lease.
+type newDeviceEvent struct {
+	Interface    string `json:"interface"`
+	HardwareAddr string `json:"hardware_addr"`
+	Hostname     string `json:"hostname"`
+	IP           string `json:"ip"`
+	Vendor       string `json:"vendor,omitempty"`
+	DeviceType   string `json:"device_type,omitempty"`
+}
+
+func newNewDeviceEvent(iface string, l dhcp4d.Lease) newDeviceEvent {
+	return newDeviceEvent{
+		Interface:    iface,
+		HardwareAddr: l.HardwareAddr,
+		Hostname:     l.Hostname,
+		IP:           l.Addr.String(),
+		Vendor:       l.Vendor,
+		DeviceType:   l.DeviceType,
+	}
+}
+
+// hookTimeout bounds how long a single notification may take.
+const hookTimeout = 30 * time.Second
+
+// notifier runs a command and/or POSTs JSON to a URL for each event.
+type notifier struct {
+	command []string
+	url     string
+	client  *http.Client
+}
+
+func newNotifier(conf *config.Notify) (*notifier, error) {
+	if conf == nil {
+		return nil, nil
+	}
+	if len(conf.Command) == 0 && conf.URL == "" {
+		return nil, fmt.Errorf("notify requires command or url")
+	}
+	return &notifier{
+		command: conf.Command,
+		url:     conf.URL,
+		client:  &http.Client{Timeout: hookTimeout},
+	}, nil
+}
+
+func (n *notifier) newDevice(ev newDeviceEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	if len(n.command) > 0 {
+		cmd := exec.CommandContext(ctx, n.command[0], n.command[1:]...)
+		cmd.Env = append(os.Environ(),
+			"DHCPETERD_INTERFACE="+ev.Interface,
+			"DHCPETERD_MAC="+ev.HardwareAddr,
+			"DHCPETERD_HOSTNAME="+ev.Hostname,
+			"DHCPETERD_IP="+ev.IP,
+			"DHCPETERD_VENDOR="+ev.Vendor,
+			"DHCPETERD_DEVICE_TYPE="+ev.DeviceType,
+		)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			slog.Error("new device command err", "hw", ev.HardwareAddr, "err", err, "output", string(out))
+		}
+	}
+
+	if n.url != "" {
+		body, err := json.Marshal(ev)
+		if err != nil {
+			slog.Error("marshal new device event err", "err", err)
+			return
+		}
+		req, err := http.NewRequestWithContext(ctx, "POST", n.url, bytes.NewReader(body))
+		if err != nil {
+			slog.Error("new device request err", "err", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := n.client.Do(req)
+		if err != nil {
+			slog.Error("new device post err", "hw", ev.HardwareAddr, "err", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			slog.Error("new device post err", "hw", ev.HardwareAddr, "status", resp.Status)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
+)
+
+// encodeOptions converts raw config options into their wire encoding.
+func encodeOptions(opts []config.Option) (dhcp4.Options, error) {
+	encoded := make(dhcp4.Options)
+	for _, o := range opts {
+		if o.Code <= int(dhcp4.Pad) || o.Code >= int(dhcp4.End) {
+			return nil, fmt.Errorf("invalid option code %d", o.Code)
+		}
+
+		var v []byte
+		switch {
+		case len(o.IPs) > 0:
+			ips, err := parseIPv4s(o.IPs)
+			if err != nil {
+				return nil, fmt.Errorf("option %d: %w", o.Code, err)
+			}
+			v = dhcp4.JoinIPs(ips)
+		case o.Hex != "":
+			b, err := hex.DecodeString(strings.ReplaceAll(o.Hex, ":", ""))
+			if err != nil {
+				return nil, fmt.Errorf("option %d: parse hex err: %w", o.Code, err)
+			}
+			v = b
+		default:
+			v = []byte(o.Value)
+		}
+		if len(v) > 255 {
+			return nil, fmt.Errorf("option %d: value too long (%d bytes)", o.Code, len(v))
+		}
+		encoded[dhcp4.OptionCode(o.Code)] = v
+	}
+	return encoded, nil
+}
+
+// encodeOptionBlock encodes opts, with dnsServers (if any) as option 6.
+func encodeOptionBlock(dnsServers []string, opts []config.Option) (dhcp4.Options, error) {
+	encoded, err := encodeOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(dnsServers) > 0 {
+		ips, err := parseIPv4s(dnsServers)
+		if err != nil {
+			return nil, fmt.Errorf("dns_servers: %w", err)
+		}
+		encoded[dhcp4.OptionDomainNameServer] = dhcp4.JoinIPs(ips)
+	}
+	return encoded, nil
+}
+
+// networkOptions encodes the domain search list (option 119) and classless
+// static routes (option 121) of conf. serverIP is the router of the
+// default route added to the routes.
+func networkOptions(conf config.Network, serverIP net.IP) (dhcp4.Options, error) {
+	encoded := make(dhcp4.Options)
+	if len(conf.DomainSearch) > 0 {
+		v, err := dhcp4.EncodeDomainSearch(conf.DomainSearch)
+		if err != nil {
+			return nil, fmt.Errorf("domain_search: %w", err)
+		}
+		encoded[dhcp4.OptionDomainSearch] = v
+	}
+	if len(conf.Routes) > 0 {
+		routes := make([]dhcp4.Route, 0, len(conf.Routes)+1)
+		hasDefault := false
+		for _, r := range conf.Routes {
+			_, dest, err := net.ParseCIDR(r.Destination)
+			if err != nil || dest.IP.To4() == nil {
+				return nil, fmt.Errorf("routes: parse destination error invalid: %s", r.Destination)
+			}
+			gw := net.ParseIP(r.Gateway).To4()
+			if gw == nil {
+				return nil, fmt.Errorf("routes: parse gateway error invalid: %s", r.Gateway)
+			}
+			if ones, _ := dest.Mask.Size(); ones == 0 {
+				hasDefault = true
+			}
+			routes = append(routes, dhcp4.Route{Dest: dest, Router: gw})
+		}
+		if !hasDefault {
+			routes = append(routes, dhcp4.Route{
+				Dest:   &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+				Router: serverIP,
+			})
+		}
+		encoded[dhcp4.OptionClasslessRouteFormat] = dhcp4.EncodeClasslessRoutes(routes)
+	}
+	return encoded, nil
+}
+
+// parseMACPrefix parses a full or partial hardware address such as
+// "00:04:f2", "00-04-F2" or "0004f2".
+func parseMACPrefix(s string) (net.HardwareAddr, error) {
+	clean := strings.NewReplacer(":", "", "-", "", ".", "").Replace(s)
+	b, err := hex.DecodeString(clean)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("parse mac prefix error invalid: %s", s)
+	}
+	return net.HardwareAddr(b), nil
+}
+
+func parseIPv4s(ss []string) ([]net.IP, error) {
+	ips := make([]net.IP, 0, len(ss))
+	for _, s := range ss {
+		ip := net.ParseIP(s).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("parse ip error invalid: %s", s)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
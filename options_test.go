@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
+)
+
+func TestNetworkOptions(t *testing.T) {
+	serverIP := net.IP{192, 168, 42, 1}
+	for _, tt := range []struct {
+		name   string
+		routes []config.Route
+		want   []string // destination via router
+	}{
+		{
+			name:   "default route added",
+			routes: []config.Route{{Destination: "10.8.0.0/16", Gateway: "192.168.42.254"}},
+			want:   []string{"10.8.0.0/16 via 192.168.42.254", "0.0.0.0/0 via 192.168.42.1"},
+		},
+		{
+			name: "configured default route",
+			routes: []config.Route{
+				{Destination: "10.8.0.0/16", Gateway: "192.168.42.254"},
+				{Destination: "0.0.0.0/0", Gateway: "192.168.42.253"},
+			},
+			want: []string{"10.8.0.0/16 via 192.168.42.254", "0.0.0.0/0 via 192.168.42.253"},
+		},
+	} {
+		opts, err := networkOptions(config.Network{Routes: tt.routes}, serverIP)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		routes, err := dhcp4.DecodeClasslessRoutes(opts[dhcp4.OptionClasslessRouteFormat])
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var got []string
+		for _, r := range routes {
+			got = append(got, r.Dest.String()+" via "+r.Router.String())
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: routes %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	for _, conf := range []config.Network{
+		{DomainSearch: []string{"a..example.com"}},
+		{Routes: []config.Route{{Destination: "10.8.0.0", Gateway: "192.168.42.254"}}},
+		{Routes: []config.Route{{Destination: "2001:db8::/32", Gateway: "192.168.42.254"}}},
+		{Routes: []config.Route{{Destination: "10.8.0.0/16", Gateway: "router"}}},
+	} {
+		if _, err := networkOptions(conf, serverIP); err == nil {
+			t.Errorf("networkOptions(%+v) succeeded, want an error", conf)
+		}
+	}
+
+	opts, err := networkOptions(config.Network{}, serverIP)
+	if err != nil || len(opts) != 0 {
+		t.Errorf("no settings: %v, %v, want no options", opts, err)
+	}
+}
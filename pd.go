@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp6d"
+)
+
+// pdRetryInterval is how long the client waits before starting over when
+// the upstream interface is missing or its socket fails.
+const pdRetryInterval = 30 * time.Second
+
+// prefixDelegation acquires a prefix with a DHCPv6-PD client on the upstream
+// interface and numbers the configured networks from it.
+type prefixDelegation struct {
+	conf    *config.PrefixDelegation
+	changed chan struct{} // signalled when the delegated prefix changes
+
+	mu        sync.Mutex
+	current   *dhcp6d.Delegation    // nil while no prefix is delegated
+	addresses map[string]*net.IPNet // assigned router addresses, by interface
+}
+
+func newPrefixDelegation(conf *config.PrefixDelegation) (*prefixDelegation, error) {
+	if conf.Interface == "" {
+		return nil, fmt.Errorf("prefix_delegation requires interface")
+	}
+	if conf.PrefixLength < 0 || conf.PrefixLength > 64 {
+		return nil, fmt.Errorf("prefix_delegation: prefix_length must be between 1 and 64")
+	}
+	if len(conf.Networks) == 0 {
+		return nil, fmt.Errorf("prefix_delegation requires networks")
+	}
+	for i, iface := range conf.Networks {
+		if slices.Index(conf.Networks, iface) != i {
+			return nil, fmt.Errorf("prefix_delegation: duplicate network %s", iface)
+		}
+		if iface == conf.Interface {
+			return nil, fmt.Errorf("prefix_delegation: network %s is the upstream interface", iface)
+		}
+	}
+	return &prefixDelegation{
+		conf:      conf,
+		changed:   make(chan struct{}, 1),
+		addresses: make(map[string]*net.IPNet),
+	}, nil
+}
+
+// loop runs the client until ctx is done.
+func (p *prefixDelegation) loop(ctx context.Context) {
+	for {
+		err := p.run(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Error("prefix delegation err", "iface", p.conf.Interface, "err", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pdRetryInterval):
+		}
+	}
+}
+
+func (p *prefixDelegation) run(ctx context.Context) error {
+	ifi, err := net.InterfaceByName(p.conf.Interface)
+	if err != nil {
+		return err
+	}
+	conn, err := newUDP6MulticastListener(ifi, nil, dhcp6d.ClientPort)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	c := &dhcp6d.PDClient{
+		Conn:         conn,
+		Server:       &net.UDPAddr{IP: dhcp6d.AllServers, Port: dhcp6d.ServerPort, Zone: ifi.Name},
+		DUID:         dhcp6d.DUIDLL(ifi.HardwareAddr),
+		IAID:         uint32(ifi.Index),
+		PrefixLength: p.conf.PrefixLength,
+		Changed:      p.update,
+	}
+	return c.Run(ctx)
+}
+
+// update records the delegation d, which is nil once it is lost, refreshes
+// the router addresses and signals changed if the prefix changed.
+func (p *prefixDelegation) update(d *dhcp6d.Delegation) {
+	p.mu.Lock()
+	prev := p.current
+	p.current = d
+	p.mu.Unlock()
+	if p.conf.AssignAddresses == nil || *p.conf.AssignAddresses {
+		p.setAddresses(d)
+	}
+	if prev != nil && d != nil && prev.Prefix.String() == d.Prefix.String() {
+		return
+	}
+	if d == nil {
+		slog.Warn("delegated prefix lost", "prefix", prev.Prefix)
+	}
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+// setAddresses assigns the first address of their /64 of d to the
+// interfaces of the networks, with the lifetimes of d, and removes
+// addresses from a previous prefix.
+func (p *prefixDelegation) setAddresses(d *dhcp6d.Delegation) {
+	for i, iface := range p.conf.Networks {
+		var want *net.IPNet
+		if d != nil {
+			if subnet, err := d.Subnet(i); err == nil {
+				want = &net.IPNet{IP: withInterfaceID(subnet, "::1"), Mask: subnet.Mask}
+			}
+		}
+		ifi, err := net.InterfaceByName(iface)
+		if err != nil {
+			slog.Debug("prefix delegation: no interface", "iface", iface, "err", err)
+			continue
+		}
+		if old := p.addresses[iface]; old != nil && (want == nil || old.String() != want.String()) {
+			if err := setAddr6(ifi.Index, old, 0, 0); err != nil {
+				slog.Error("remove address err", "iface", iface, "addr", old, "err", err)
+			}
+			delete(p.addresses, iface)
+		}
+		if want == nil {
+			continue
+		}
+		if err := setAddr6(ifi.Index, want, d.ValidLifetime, d.PreferredLifetime); err != nil {
+			slog.Error("add address err", "iface", iface, "addr", want, "err", err)
+			continue
+		}
+		p.addresses[iface] = want
+	}
+}
+
+// apply returns n numbered from the delegated prefix, if it is one of the
+// networks. p may be nil.
+func (p *prefixDelegation) apply(n config.Network) config.Network {
+	if p == nil {
+		return n
+	}
+	i := slices.Index(p.conf.Networks, n.Interface)
+	if i < 0 {
+		return n
+	}
+	p.mu.Lock()
+	d := p.current
+	p.mu.Unlock()
+	if d == nil {
+		return delegatedNetwork(n, nil, 0, 0)
+	}
+	subnet, err := d.Subnet(i)
+	if err != nil {
+		slog.Warn("delegated prefix too small", "iface", n.Interface, "err", err)
+	}
+	return delegatedNetwork(n, subnet, d.ValidLifetime, d.PreferredLifetime)
+}
+
+// delegatedNetwork returns n with subnet as its dhcpv6 prefix and among its
+// advertised prefixes, whose lifetimes are capped at valid and preferred
+// (if not 0). Without a subnet its stateful DHCPv6 server is disabled.
+func delegatedNetwork(n config.Network, subnet *net.IPNet, valid, preferred time.Duration) config.Network {
+	if n.DHCPv6 != nil && !n.DHCPv6.Stateless {
+		if subnet == nil {
+			n.DHCPv6 = nil
+		} else {
+			v6 := *n.DHCPv6
+			v6.Prefix = subnet.String()
+			if ip := withInterfaceID(subnet, v6.StartIP); ip != nil {
+				v6.StartIP = ip.String()
+			}
+			v6.StaticLeases = slices.Clone(v6.StaticLeases)
+			for i, sl := range v6.StaticLeases {
+				if ip := withInterfaceID(subnet, sl.IP); ip != nil {
+					v6.StaticLeases[i].IP = ip.String()
+				}
+			}
+			n.DHCPv6 = &v6
+		}
+	}
+	if n.RouterAdvertisement != nil && subnet != nil {
+		ra := *n.RouterAdvertisement
+		ra.Prefixes = append(slices.Clip(ra.Prefixes), subnet.String())
+		if valid > 0 && (ra.PrefixValidLifetime == 0 || ra.PrefixValidLifetime > valid) {
+			ra.PrefixValidLifetime = valid
+		}
+		if preferred > 0 && (ra.PrefixPreferredLifetime == 0 || ra.PrefixPreferredLifetime > preferred) {
+			ra.PrefixPreferredLifetime = preferred
+		}
+		n.RouterAdvertisement = &ra
+	}
+	return n
+}
+
+// withInterfaceID returns the address in subnet with the interface
+// identifier (the low 64 bits) of the address s, or nil if s is not one.
+func withInterfaceID(subnet *net.IPNet, s string) net.IP {
+	ip := net.ParseIP(s).To16()
+	if ip == nil || ip.To4() != nil {
+		return nil
+	}
+	out := make(net.IP, net.IPv6len)
+	copy(out, subnet.IP.To16()[:8])
+	copy(out[8:], ip[8:])
+	return out
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/ra"
+)
+
+// Protocol constants of RFC 4861 section 10.
+const (
+	raMaxInitialInterval       = 16 * time.Second
+	raMaxInitialAdvertisements = 3
+	raMinDelayBetween          = 3 * time.Second
+	raMaxResponseDelay         = 500 * time.Millisecond
+)
+
+// raSender sends the Router Advertisements of a network, periodically and
+// in response to Router Solicitations.
+type raSender struct {
+	iface       string
+	ad          *ra.RouterAdvertisement
+	minInterval time.Duration
+	maxInterval time.Duration
+
+	conn      net.PacketConn
+	solicited chan struct{}
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+// newRASender returns the sender of the advertisements of n from an
+// interface with hardware address hw. It must be started to send any.
+func newRASender(n config.Network, hw net.HardwareAddr) (*raSender, error) {
+	conf := n.RouterAdvertisement
+	s := &raSender{
+		iface:       n.Interface,
+		maxInterval: conf.MaxInterval,
+		minInterval: conf.MinInterval,
+	}
+	if s.maxInterval == 0 {
+		s.maxInterval = 600 * time.Second
+	}
+	if s.minInterval == 0 {
+		s.minInterval = max(s.maxInterval/3, 3*time.Second)
+	}
+	if s.maxInterval < 4*time.Second || s.maxInterval > 1800*time.Second {
+		return nil, fmt.Errorf("router_advertisement: max_interval must be between 4s and 1800s")
+	}
+	if s.minInterval < 3*time.Second || s.minInterval > s.maxInterval*3/4 {
+		return nil, fmt.Errorf("router_advertisement: min_interval must be between 3s and 3/4 of max_interval")
+	}
+
+	ad := &ra.RouterAdvertisement{
+		HopLimit:            64,
+		Managed:             conf.Managed,
+		Other:               conf.Other || n.DHCPv6 != nil && n.DHCPv6.Stateless,
+		RouterLifetime:      3 * s.maxInterval,
+		SourceLinkLayerAddr: hw,
+		DomainSearch:        conf.DomainSearch,
+		DNSLifetime:         conf.DNSLifetime,
+	}
+	if conf.HopLimit != 0 {
+		if conf.HopLimit < 0 || conf.HopLimit > 255 {
+			return nil, fmt.Errorf("router_advertisement: invalid hop_limit %d", conf.HopLimit)
+		}
+		ad.HopLimit = uint8(conf.HopLimit)
+	}
+	if conf.RouterLifetime != nil {
+		if *conf.RouterLifetime < 0 || *conf.RouterLifetime > 9000*time.Second {
+			return nil, fmt.Errorf("router_advertisement: router_lifetime must be between 0s and 9000s")
+		}
+		ad.RouterLifetime = *conf.RouterLifetime
+	}
+	if conf.MTU != 0 {
+		if conf.MTU < 1280 {
+			return nil, fmt.Errorf("router_advertisement: mtu %d is below the IPv6 minimum of 1280", conf.MTU)
+		}
+		ad.MTU = uint32(conf.MTU)
+	}
+	if ad.DNSLifetime == 0 {
+		ad.DNSLifetime = 3 * s.maxInterval
+	}
+
+	prefixes := conf.Prefixes
+	if len(prefixes) == 0 && n.DHCPv6 != nil && n.DHCPv6.Prefix != "" {
+		prefixes = []string{n.DHCPv6.Prefix}
+	}
+	if len(prefixes) == 0 && ad.RouterLifetime == 0 && len(conf.DNSServers) == 0 {
+		return nil, fmt.Errorf("router_advertisement: nothing to advertise")
+	}
+	autonomous := !conf.Managed
+	if conf.Autonomous != nil {
+		autonomous = *conf.Autonomous
+	}
+	valid, preferred := conf.PrefixValidLifetime, conf.PrefixPreferredLifetime
+	if valid == 0 {
+		valid = 30 * 24 * time.Hour
+	}
+	if preferred == 0 {
+		preferred = min(7*24*time.Hour, valid)
+	}
+	if preferred > valid {
+		return nil, fmt.Errorf("router_advertisement: prefix_preferred_lifetime exceeds prefix_valid_lifetime")
+	}
+	for _, p := range prefixes {
+		_, prefix, err := net.ParseCIDR(p)
+		if err != nil || prefix.IP.To4() != nil {
+			return nil, fmt.Errorf("router_advertisement: invalid prefix %q", p)
+		}
+		if ones, _ := prefix.Mask.Size(); autonomous && ones != 64 {
+			slog.Warn("router_advertisement: SLAAC requires a /64 prefix", "iface", n.Interface, "prefix", p)
+		}
+		ad.Prefixes = append(ad.Prefixes, ra.Prefix{
+			Prefix:            prefix,
+			OnLink:            true,
+			Autonomous:        autonomous,
+			ValidLifetime:     valid,
+			PreferredLifetime: preferred,
+		})
+	}
+	for _, d := range conf.DNSServers {
+		ip := net.ParseIP(d)
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("router_advertisement: invalid dns server %q", d)
+		}
+		ad.DNSServers = append(ad.DNSServers, ip)
+	}
+	s.ad = ad
+	return s, nil
+}
+
+// startRA starts advertising the router on the interface of n until the
+// returned sender is stopped.
+func startRA(n config.Network) (*raSender, error) {
+	ifi, err := net.InterfaceByName(n.Interface)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newRASender(n, ifi.HardwareAddr)
+	if err != nil {
+		return nil, err
+	}
+	s.conn, err = newICMP6Listener(ifi)
+	if err != nil {
+		return nil, err
+	}
+	s.solicited = make(chan struct{}, 1)
+	s.done = make(chan struct{})
+	s.stopped = make(chan struct{})
+	go s.serve()
+	go s.loop()
+	return s, nil
+}
+
+// stop sends a final advertisement that withdraws the router as a default
+// router, then closes the socket.
+func (s *raSender) stop() {
+	close(s.done)
+	<-s.stopped
+	final := *s.ad
+	final.RouterLifetime = 0
+	s.send(&final)
+	s.conn.Close()
+}
+
+// serve notes the solicitations of hosts until the socket is closed.
+func (s *raSender) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			slog.Debug("router advertisement stopped", "iface", s.iface, "err", err)
+			return
+		}
+		if ra.IsRouterSolicitation(buf[:n]) {
+			select {
+			case s.solicited <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// loop sends advertisements at random intervals between the minimum and
+// maximum, more often at first, and shortly after solicitations, but no
+// more often than every three seconds.
+func (s *raSender) loop() {
+	defer close(s.stopped)
+	initial := raMaxInitialAdvertisements
+	var last time.Time
+	next := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.solicited:
+			at := time.Now().Add(time.Duration(rand.Int63n(int64(raMaxResponseDelay))))
+			if earliest := last.Add(raMinDelayBetween); at.Before(earliest) {
+				at = earliest
+			}
+			if at.Before(next) {
+				next = at
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(time.Until(next))
+			}
+		case <-timer.C:
+			s.send(s.ad)
+			last = time.Now()
+			interval := s.minInterval + time.Duration(rand.Int63n(int64(s.maxInterval-s.minInterval)+1))
+			if initial > 0 {
+				initial--
+				interval = min(interval, raMaxInitialInterval)
+			}
+			next = last.Add(interval)
+			timer.Reset(interval)
+		}
+	}
+}
+
+func (s *raSender) send(ad *ra.RouterAdvertisement) {
+	to := &net.IPAddr{IP: ra.AllNodes, Zone: s.iface}
+	if _, err := s.conn.WriteTo(ad.Marshal(), to); err != nil {
+		slog.Error("router advertisement write err", "iface", s.iface, "err", err)
+	}
+}
+
+// newICMP6Listener returns a raw ICMPv6 socket on ifi that has joined the
+// all-routers group, with the hop limit of 255 that neighbor discovery
+// requires.
+func newICMP6Listener(ifi *net.Interface) (pc net.PacketConn, e error) {
+	s, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_ICMPV6)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { // clean up if something goes wrong
+		if e != nil {
+			syscall.Close(s)
+		}
+	}()
+
+	if err := syscall.SetsockoptString(s, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, ifi.Name); err != nil {
+		return nil, err
+	}
+	for _, opt := range []int{syscall.IPV6_MULTICAST_HOPS, syscall.IPV6_UNICAST_HOPS} {
+		if err := syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, opt, 255); err != nil {
+			return nil, err
+		}
+	}
+	if err := syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, ifi.Index); err != nil {
+		return nil, err
+	}
+	if err := syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_LOOP, 0); err != nil {
+		return nil, err
+	}
+	mreq := &syscall.IPv6Mreq{Interface: uint32(ifi.Index)}
+	copy(mreq.Multiaddr[:], ra.AllRouters.To16())
+	if err := syscall.SetsockoptIPv6Mreq(s, syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq); err != nil {
+		return nil, err
+	}
+
+	f := os.NewFile(uintptr(s), "")
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// reapInterval is how often expired leases are checked for removal.
+const reapInterval = time.Minute
+
+// expireInterval is how often the handlers announce expired leases.
+const expireInterval = 10 * time.Second
+
+// expireLoop periodically has the handlers emit the EventExpire of leases
+// that ran out, so that sinks like the firewall sets and DNS updates drop
+// clients that left without releasing their lease.
+func (d *daemon) expireLoop(ctx context.Context) {
+	t := time.NewTicker(expireInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		for _, h := range d.allHandlers() {
+			h.ExpireLeases()
+		}
+	}
+}
+
+// reapLoop periodically removes leases that have been expired for longer
+// than their network's expired_lease_retention. Removal is persisted by the
+// handlers' Leases callback like any other lease change.
+func (d *daemon) reapLoop(ctx context.Context) {
+	t := time.NewTicker(reapInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		d.mu.Lock()
+		retention := make(map[string]time.Duration, len(d.networks))
+		for iface, nw := range d.networks {
+			if r := nw.conf.ExpiredLeaseRetention; r > 0 {
+				retention[iface] = r
+			}
+		}
+		d.mu.Unlock()
+
+		for iface, h := range d.allHandlers() {
+			r, ok := retention[iface]
+			if !ok {
+				continue
+			}
+			if n := h.ReapExpired(r); n > 0 {
+				slog.Info("removed expired leases", "iface", iface, "count", n)
+			}
+		}
+	}
+}
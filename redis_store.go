@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+	"github.com/psanford/dhcpeterd/internal/redis"
+)
+
+// redisReconnectInterval is the minimum time between attempts to reach an
+// unreachable Redis server.
+const redisReconnectInterval = 10 * time.Second
+
+// redisStore is a LeaseStore that keeps a lease file's leases in Redis so
+// that instances on redundant routers share them: each instance sees the
+// leases of the other when it loads them, such as when it takes over. Every
+// lease is its own key, updated with optimistic locking so that an instance
+// never replaces a more recently acknowledged lease. The local lease file
+// is kept as a cache and used while Redis is unreachable; everything is
+// written to Redis again once it is back.
+type redisStore struct {
+	conf   config.Redis
+	prefix string // of this lease file's keys
+	local  *fileStore
+
+	// Redis is written from q's goroutine, which alone uses the fields
+	// below once the leases are loaded.
+	q        *remoteQueue
+	c        *redis.Client // nil while disconnected
+	lastDial time.Time
+	synced   map[string]string // value last written by key, cleared on reconnect
+}
+
+func newRedisStore(conf config.Redis, path string, local *fileStore) *redisStore {
+	if conf.KeyPrefix == "" {
+		conf.KeyPrefix = "dhcpeterd:"
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = 5 * time.Second
+	}
+	s := &redisStore{
+		conf:   conf,
+		prefix: conf.KeyPrefix + filepath.Base(path) + ":",
+		local:  local,
+		synced: make(map[string]string),
+	}
+	s.q = newRemoteQueue("redis", s.saveLease, s.saveAll)
+	return s
+}
+
+func (s *redisStore) leaseKey(iface, hw string) string {
+	return s.prefix + "lease:" + iface + ":" + hw
+}
+
+// client returns the connection to Redis, connecting if needed and not
+// attempted recently. It returns nil if Redis is unreachable.
+func (s *redisStore) client() *redis.Client {
+	if s.c != nil {
+		return s.c
+	}
+	if time.Since(s.lastDial) < redisReconnectInterval {
+		return nil
+	}
+	s.lastDial = time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), s.conf.Timeout)
+	defer cancel()
+	c, err := redis.Dial(ctx, s.conf.URL, s.conf.Timeout)
+	if err != nil {
+		slog.Warn("redis unreachable, using local lease file", "err", err)
+		return nil
+	}
+	slog.Info("connected to redis", "prefix", s.prefix)
+	s.c = c
+	clear(s.synced)
+	return c
+}
+
+// fail drops the connection after err unless it is an error reply.
+func (s *redisStore) fail(err error) {
+	if _, ok := err.(redis.Error); ok || s.c == nil {
+		return
+	}
+	slog.Warn("redis connection lost, using local lease file", "err", err)
+	s.c.Close()
+	s.c = nil
+}
+
+// Load returns the leases stored in Redis, or those of the local lease file
+// if Redis is unreachable or has none yet.
+func (s *redisStore) Load() (*LeaseFile, error) {
+	local, err := s.local.Load()
+	if err != nil {
+		slog.Error("load lease file err", "path", s.local.path, "err", err)
+		local = newLeaseFile()
+	}
+	c := s.client()
+	if c == nil {
+		return local, nil
+	}
+	lf, err := s.load(c)
+	if err != nil {
+		s.fail(err)
+		slog.Warn("load leases from redis err, using local lease file", "err", err)
+		return local, nil
+	}
+	if lf == nil {
+		return local, nil
+	}
+	return lf, nil
+}
+
+// load reads the lease file from Redis, returning nil if it has no state.
+func (s *redisStore) load(c *redis.Client) (*LeaseFile, error) {
+	state, err := c.Do("GET", s.prefix+"state")
+	if err != nil {
+		return nil, err
+	}
+	lf := newLeaseFile()
+	if state != nil {
+		str, _ := state.(string)
+		var stored LeaseFile
+		if err := json.Unmarshal([]byte(str), &stored); err != nil {
+			return nil, fmt.Errorf("parse %sstate: %w", s.prefix, err)
+		}
+		if stored.ApprovedByInterface != nil {
+			lf.ApprovedByInterface = stored.ApprovedByInterface
+		}
+		if stored.HostnamesByInterface != nil {
+			lf.HostnamesByInterface = stored.HostnamesByInterface
+		}
+		if stored.Seen != nil {
+			lf.Seen = stored.Seen
+		}
+		s.synced[s.prefix+"state"] = str
+	}
+
+	var found bool
+	cursor := "0"
+	for {
+		v, err := c.Do("SCAN", cursor, "MATCH", s.prefix+"lease:*", "COUNT", "1000")
+		if err != nil {
+			return nil, err
+		}
+		reply, ok := v.([]any)
+		if !ok || len(reply) != 2 {
+			return nil, fmt.Errorf("unexpected SCAN reply %v", v)
+		}
+		cursor, _ = reply[0].(string)
+		keys, _ := reply[1].([]any)
+		for _, k := range keys {
+			key, _ := k.(string)
+			v, err := c.Do("GET", key)
+			if err != nil {
+				return nil, err
+			}
+			str, ok := v.(string)
+			if !ok {
+				continue // removed since the scan
+			}
+			var l dhcp4d.Lease
+			if err := json.Unmarshal([]byte(str), &l); err != nil {
+				slog.Error("parse redis lease err", "key", key, "err", err)
+				continue
+			}
+			iface, _, _ := strings.Cut(strings.TrimPrefix(key, s.prefix+"lease:"), ":")
+			lf.LeaseByInterface[iface] = append(lf.LeaseByInterface[iface], l)
+			s.synced[key] = str
+			found = true
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	if state == nil && !found {
+		return nil, nil
+	}
+	return lf, nil
+}
+
+// SaveLease queues l to be written to Redis right away, so that the other
+// instances see it even if the lease file is written less often.
+func (s *redisStore) SaveLease(iface string, l dhcp4d.Lease) error {
+	s.q.lease(iface, l)
+	return nil
+}
+
+func (s *redisStore) saveLease(iface string, l dhcp4d.Lease) error {
+	c := s.client()
+	if c == nil {
+		return nil // written by SaveAll once Redis is back
+	}
+	if err := s.setLease(c, iface, l); err != nil {
+		s.fail(err)
+		return err
+	}
+	return nil
+}
+
+// setLease stores l unless Redis has a more recently acknowledged lease for
+// the same client, retrying if the key changes while it is being written.
+func (s *redisStore) setLease(c *redis.Client, iface string, l dhcp4d.Lease) error {
+	key := s.leaseKey(iface, l.HardwareAddr)
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	if s.synced[key] == string(b) {
+		return nil
+	}
+	for attempt := 0; attempt < 3; attempt++ {
+		if _, err := c.Do("WATCH", key); err != nil {
+			return err
+		}
+		v, err := c.Do("GET", key)
+		if err != nil {
+			return err
+		}
+		if str, ok := v.(string); ok && str != s.synced[key] {
+			var stored dhcp4d.Lease
+			if json.Unmarshal([]byte(str), &stored) == nil && stored.LastACK.After(l.LastACK) {
+				// Another instance renewed the lease since.
+				s.synced[key] = str
+				_, err := c.Do("UNWATCH")
+				return err
+			}
+		}
+		if _, err := c.Do("MULTI"); err != nil {
+			return err
+		}
+		if _, err := c.Do("SET", key, string(b)); err != nil {
+			c.Do("DISCARD")
+			return err
+		}
+		v, err = c.Do("EXEC")
+		if err != nil {
+			return err
+		}
+		if v != nil {
+			s.synced[key] = string(b)
+			return nil
+		}
+		// The key changed after WATCH; check it again.
+	}
+	return fmt.Errorf("lease %s kept changing while being written", key)
+}
+
+// SaveAll writes lf to the local lease file and queues bringing Redis up to
+// date with it: changed leases are written and removed leases deleted.
+func (s *redisStore) SaveAll(lf *LeaseFile) error {
+	if err := s.local.SaveAll(lf); err != nil {
+		return err
+	}
+	s.q.database(lf)
+	return nil
+}
+
+func (s *redisStore) saveAll(lf *LeaseFile) error {
+	c := s.client()
+	if c == nil {
+		return nil
+	}
+	if err := s.sync(c, lf); err != nil {
+		s.fail(err)
+		return fmt.Errorf("redis: %w", err)
+	}
+	return nil
+}
+
+func (s *redisStore) sync(c *redis.Client, lf *LeaseFile) error {
+	current := make(map[string]bool)
+	for iface, leases := range lf.LeaseByInterface {
+		for _, l := range leases {
+			current[s.leaseKey(iface, l.HardwareAddr)] = true
+			if err := s.setLease(c, iface, l); err != nil {
+				return err
+			}
+		}
+	}
+	for key := range s.synced {
+		if strings.HasPrefix(key, s.prefix+"lease:") && !current[key] {
+			if _, err := c.Do("DEL", key); err != nil {
+				return err
+			}
+			delete(s.synced, key)
+		}
+	}
+
+	state := &LeaseFile{
+		ApprovedByInterface:  lf.ApprovedByInterface,
+		HostnamesByInterface: lf.HostnamesByInterface,
+		Seen:                 lf.Seen,
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	key := s.prefix + "state"
+	if s.synced[key] != string(b) {
+		if _, err := c.Do("SET", key, string(b)); err != nil {
+			return err
+		}
+		s.synced[key] = string(b)
+	}
+	return nil
+}
+
+func (s *redisStore) Close() error {
+	s.q.close()
+	if s.c != nil {
+		s.c.Close()
+	}
+	return s.local.Close()
+}
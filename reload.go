@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"reflect"
+	"strings"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+// reload applies the networks of the config at path: changed networks get a
+// new handler that takes over the leases of the old one, then removed
+// networks are stopped and added ones started. Other settings only take
+// effect on restart.
+func (d *daemon) reload(path string) error {
+	conf, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+	if d.sandbox != nil {
+		if missing := sandboxMissing(d.sandbox, sandboxPaths(conf, path)); len(missing) > 0 {
+			return fmt.Errorf("restart to allow the sandbox access to %s", strings.Join(missing, ", "))
+		}
+	}
+	expanded, err := expandNetworks(conf.Networks)
+	if err != nil {
+		return err
+	}
+	networks := make(map[string]config.Network, len(expanded))
+	for _, n := range expanded {
+		if _, dup := networks[n.Interface]; dup {
+			return fmt.Errorf("duplicate network for interface %s", n.Interface)
+		}
+		networks[n.Interface] = d.pd.apply(n)
+	}
+
+	base := *conf
+	base.Networks = nil
+	if !reflect.DeepEqual(base, d.conf) {
+		slog.Warn("reload: only network changes are applied; restart to apply other settings")
+	}
+
+	d.mu.Lock()
+	old := make(map[string]*network, len(d.networks))
+	for iface, nw := range d.networks {
+		old[iface] = nw
+	}
+	loops := make(map[string]*serveLoop, len(d.loops))
+	for iface, l := range d.loops {
+		loops[iface] = l
+	}
+	d.mu.Unlock()
+
+	// Build the handlers of changed networks first so that a bad network
+	// leaves the running configuration untouched.
+	replaced := make(map[string]*dhcp4d.Handler)
+	pending := make(map[string]config.Network)
+	for iface, n := range networks {
+		prev, ok := old[iface]
+		if !ok || reflect.DeepEqual(prev.conf, n) {
+			continue
+		}
+		_, running := loops[iface]
+		h, err := d.newHandler(n)
+		if !running && errors.Is(err, errInterfaceNotReady) {
+			// Its supervisor is waiting for the interface.
+			err = nil
+		}
+		if err == nil && n.DHCPv6 != nil {
+			_, err = newDHCP6Handler(n.DHCPv6, nil)
+		}
+		if err == nil && n.RouterAdvertisement != nil {
+			_, err = newRASender(n, nil)
+		}
+		for _, v := range n.VLANs {
+			if err == nil {
+				err = checkVLAN(n, v)
+			}
+		}
+		if err != nil {
+			for _, h := range replaced {
+				h.Close()
+			}
+			return fmt.Errorf("network %s: %w", iface, err)
+		}
+		if !running {
+			// Networks that are starting, waiting for their interface or
+			// backing off after a failure are started with the new config
+			// by their supervisor.
+			if h != nil {
+				h.Close()
+			}
+			pending[iface] = n
+			continue
+		}
+		replaced[iface] = h
+	}
+
+	// The listeners of mdns, DHCPv6, router advertisements and VLANs live
+	// as long as the network, so networks that change them, or move to
+	// another namespace, are restarted. VLANs inherit the settings of
+	// their network, so any change does.
+	for iface, h := range replaced {
+		prev, n := old[iface].conf, networks[iface]
+		if prev.Netns == n.Netns && prev.MDNS == n.MDNS && reflect.DeepEqual(prev.DHCPv6, n.DHCPv6) &&
+			reflect.DeepEqual(prev.RouterAdvertisement, n.RouterAdvertisement) &&
+			len(prev.VLANs) == 0 && len(n.VLANs) == 0 {
+			continue
+		}
+		h.Close()
+		delete(replaced, iface)
+		slog.Info("reload: restarting network", "iface", iface)
+		d.stopNetwork(iface)
+		d.startNetwork(n, false)
+	}
+
+	for iface, n := range pending {
+		d.mu.Lock()
+		netns := old[iface].conf.Netns
+		old[iface].conf = n
+		_, started := d.loops[iface]
+		d.mu.Unlock()
+		// The supervisor enters the namespace before starting the network.
+		if started || n.Netns != netns {
+			slog.Info("reload: restarting network", "iface", iface)
+			d.stopNetwork(iface)
+			d.startNetwork(n, false)
+			continue
+		}
+		slog.Info("reload: updated network, applied when it starts", "iface", iface)
+	}
+
+	for iface, h := range replaced {
+		prev := loops[iface].replace(h)
+		d.mu.Lock()
+		old[iface].conf = networks[iface]
+		d.handlers[iface] = h
+		d.mu.Unlock()
+		if err := prev.Close(); err != nil {
+			slog.Error("close raw socket err", "iface", iface, "err", err)
+		}
+		slog.Info("reload: updated network", "iface", iface)
+	}
+
+	d.configured = conf.Networks
+	d.resync()
+	return nil
+}
+
+// resync starts and stops networks so that every configured network whose
+// interface exists, and has the network's virtual IP, is served (none while
+// an HA standby is passive or keepalived reports a backup), such as after a
+// reload or when interfaces and addresses come and go. Networks whose
+// interface was recreated or renumbered, or whose delegated prefix changed,
+// are restarted.
+func (d *daemon) resync() {
+	expanded, err := expandNetworks(d.configured)
+	if err != nil {
+		slog.Error("expand networks err", "err", err)
+		return
+	}
+	networks := make(map[string]config.Network, len(expanded))
+	for _, n := range d.servable(expanded) {
+		networks[n.Interface] = n
+	}
+
+	d.mu.Lock()
+	running := make(map[string]bool, len(d.networks))
+	for iface := range d.networks {
+		running[iface] = true
+	}
+	confs := make(map[string]config.Network, len(d.networks))
+	for iface, nw := range d.networks {
+		confs[iface] = nw.conf
+	}
+	loops := make(map[string]*serveLoop, len(d.loops))
+	for iface, l := range d.loops {
+		loops[iface] = l
+	}
+	d.mu.Unlock()
+
+	for iface := range running {
+		if _, ok := networks[iface]; !ok {
+			slog.Info("removing network", "iface", iface)
+			d.stopNetwork(iface)
+		}
+	}
+	for iface, n := range networks {
+		if !running[iface] {
+			slog.Info("adding network", "iface", iface)
+			d.startNetwork(n, false)
+			continue
+		}
+		l, ok := loops[iface]
+		if !ok {
+			continue // still starting
+		}
+		if linkChanged(n, l.current()) {
+			slog.Info("interface changed, restarting network", "iface", iface)
+			d.stopNetwork(iface)
+			d.startNetwork(n, false)
+		} else if prev := confs[iface]; !reflect.DeepEqual(prev.DHCPv6, n.DHCPv6) ||
+			!reflect.DeepEqual(prev.RouterAdvertisement, n.RouterAdvertisement) {
+			slog.Info("delegated prefix changed, restarting network", "iface", iface)
+			d.stopNetwork(iface)
+			d.startNetwork(n, false)
+		}
+	}
+}
+
+// servable returns the networks that should be served now.
+func (d *daemon) servable(networks []config.Network) []config.Network {
+	if d.passive || d.vrrpBackup {
+		return nil
+	}
+	var servable []config.Network
+	for _, n := range networks {
+		if vipPresent(n) {
+			servable = append(servable, d.pd.apply(n))
+		} else {
+			slog.Debug("virtual ip absent, not serving", "iface", n.Interface, "vip", n.VirtualIP)
+		}
+	}
+	return servable
+}
+
+// linkChanged reports whether the interface of n is no longer the one h was
+// created for, or no longer has h's address.
+func linkChanged(n config.Network, h *dhcp4d.Handler) bool {
+	var iface *net.Interface
+	var serverIP net.IP
+	err := inNetns(n.Netns, func() (err error) {
+		iface, serverIP, err = interfaceAddr(n)
+		return err
+	})
+	if err != nil {
+		return true
+	}
+	return iface.Index != h.Interface().Index || !serverIP.Equal(h.ServerIP())
+}
+
+// stopNetwork stops serving iface and closes its handler.
+func (d *daemon) stopNetwork(iface string) {
+	d.mu.Lock()
+	l := d.loops[iface]
+	h := d.handlers[iface]
+	delete(d.networks, iface)
+	delete(d.loops, iface)
+	delete(d.handlers, iface)
+	d.mu.Unlock()
+
+	if l != nil {
+		if err := l.conn.Close(); err != nil {
+			slog.Error("close listener err", "iface", iface, "err", err)
+		}
+		// Wait for a message being handled to finish before closing the
+		// raw socket it may be replying on.
+		l.mu.Lock()
+		defer l.mu.Unlock()
+	}
+	if h != nil {
+		if err := h.Close(); err != nil {
+			slog.Error("close raw socket err", "iface", iface, "err", err)
+		}
+	}
+}
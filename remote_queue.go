@@ -0,0 +1,114 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+// maxQueuedLeases is the number of leases that may wait to be written to a
+// remote store. Leases beyond it are written with the next database.
+const maxQueuedLeases = 1024
+
+type queuedLeaseKey struct{ iface, hw string }
+
+// remoteQueue writes to a remote store, such as Redis, on its own goroutine
+// so that saving leases never waits on the network. Writes of the same
+// lease that are still queued are replaced by the latest one, and a queued
+// database by a newer database along with the leases queued before it.
+type remoteQueue struct {
+	name      string // of the store, for logging
+	saveLease func(iface string, l dhcp4d.Lease) error
+	saveAll   func(lf *LeaseFile) error
+
+	mu     sync.Mutex
+	all    *LeaseFile
+	leases map[queuedLeaseKey]dhcp4d.Lease
+	closed bool
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+func newRemoteQueue(name string, saveLease func(string, dhcp4d.Lease) error, saveAll func(*LeaseFile) error) *remoteQueue {
+	q := &remoteQueue{
+		name:      name,
+		saveLease: saveLease,
+		saveAll:   saveAll,
+		leases:    make(map[queuedLeaseKey]dhcp4d.Lease),
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// lease queues l to be written.
+func (q *remoteQueue) lease(iface string, l dhcp4d.Lease) {
+	k := queuedLeaseKey{iface, l.HardwareAddr}
+	q.mu.Lock()
+	if _, ok := q.leases[k]; !ok && len(q.leases) >= maxQueuedLeases {
+		q.mu.Unlock()
+		slog.Warn("lease write queue full, lease is written with the lease file", "store", q.name, "iface", iface, "hw", l.HardwareAddr)
+		return
+	}
+	q.leases[k] = l
+	q.mu.Unlock()
+	q.signal()
+}
+
+// database queues lf to be written. It includes every lease queued so far.
+func (q *remoteQueue) database(lf *LeaseFile) {
+	q.mu.Lock()
+	q.all = lf
+	clear(q.leases)
+	q.mu.Unlock()
+	q.signal()
+}
+
+func (q *remoteQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *remoteQueue) run() {
+	defer close(q.done)
+	for {
+		q.mu.Lock()
+		all, leases, closed := q.all, q.leases, q.closed
+		q.all = nil
+		if len(leases) > 0 {
+			q.leases = make(map[queuedLeaseKey]dhcp4d.Lease)
+		} else {
+			leases = nil
+		}
+		q.mu.Unlock()
+
+		if all != nil {
+			if err := q.saveAll(all); err != nil {
+				slog.Error("write leases err", "store", q.name, "err", err)
+			}
+		}
+		for k, l := range leases {
+			if err := q.saveLease(k.iface, l); err != nil {
+				slog.Error("save lease err", "store", q.name, "iface", k.iface, "hw", k.hw, "err", err)
+			}
+		}
+		if closed {
+			return
+		}
+		<-q.wake
+	}
+}
+
+// close writes what is queued and stops the queue.
+func (q *remoteQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.signal()
+	<-q.done
+}
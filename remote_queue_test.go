@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+func TestRemoteQueue(t *testing.T) {
+	started := make(chan struct{}, 16)
+	unblock := make(chan struct{})
+	saved := make(chan dhcp4d.Lease, 16)
+	var all []*LeaseFile
+	q := newRemoteQueue("test", func(iface string, l dhcp4d.Lease) error {
+		started <- struct{}{}
+		<-unblock
+		saved <- l
+		return nil
+	}, func(lf *LeaseFile) error {
+		all = append(all, lf)
+		return nil
+	})
+
+	// The first write blocks as if the store were unreachable.
+	q.lease("eth0", dhcp4d.Lease{HardwareAddr: "aa:bb:cc:dd:ee:01", Hostname: "first"})
+	<-started
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			q.lease("eth0", dhcp4d.Lease{HardwareAddr: "aa:bb:cc:dd:ee:02", Hostname: "second", Num: i})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queueing a lease waited for the store")
+	}
+	close(unblock)
+	q.close()
+
+	close(saved)
+	var got []dhcp4d.Lease
+	for l := range saved {
+		got = append(got, l)
+	}
+	if len(got) != 2 || got[0].Hostname != "first" || got[1].Hostname != "second" || got[1].Num != 9 {
+		t.Errorf("saved %+v, want first and the last write of second", got)
+	}
+
+	q = newRemoteQueue("test", func(string, dhcp4d.Lease) error {
+		t.Error("lease written separately from the database including it")
+		return nil
+	}, func(lf *LeaseFile) error {
+		all = append(all, lf)
+		return nil
+	})
+	q.mu.Lock()
+	q.leases[queuedLeaseKey{"eth0", "aa:bb:cc:dd:ee:01"}] = dhcp4d.Lease{}
+	q.all = newLeaseFile()
+	q.mu.Unlock()
+	q.database(newLeaseFile())
+	q.close()
+	if len(all) != 1 {
+		t.Errorf("wrote %d databases, want 1", len(all))
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+// reservationStore persists static leases created at runtime to the
+// reservations file.
+type reservationStore struct {
+	path string
+
+	mu sync.Mutex
+	r  *config.Reservations
+}
+
+func newReservationStore(path string) (*reservationStore, error) {
+	r, err := config.LoadReservations(path)
+	if err != nil {
+		return nil, err
+	}
+	return &reservationStore{
+		path: path,
+		r:    r,
+	}, nil
+}
+
+func (s *reservationStore) forInterface(iface string) []config.StaticLease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.r.ForInterface(iface)
+}
+
+func (s *reservationStore) add(iface string, sl dhcp4d.StaticLease) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.r.Add(iface, config.StaticLease{
+		MacAddress: sl.HardwareAddr,
+		Name:       sl.Hostname,
+		IP:         sl.Addr.String(),
+		Permanent:  sl.Permanent,
+	})
+	return s.r.Write(s.path)
+}
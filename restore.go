@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/psanford/dhcpeterd/config"
+)
+
+// runRestoreLeases implements "dhcpeterd restore-leases": it lists the
+// backups of a lease file or replaces the lease file with one of them. The
+// replaced contents are kept as another backup. It fails while the daemon
+// is running, since the daemon holds the lease file.
+func runRestoreLeases(args []string) int {
+	fs := flag.NewFlagSet("restore-leases", flag.ExitOnError)
+	confPath := fs.String("config", "dhcpeterd.toml", "Config path")
+	leaseFile := fs.String("lease-file", "", "Lease file to restore (default: the config's lease_file)")
+	list := fs.Bool("list", false, "List the backups instead of restoring one")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: dhcpeterd restore-leases [flags] [backup]\n\nRestores the given backup, or the newest one.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+
+	path := *leaseFile
+	if path == "" {
+		conf, err := config.Load(*confPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", *confPath, err)
+			return 1
+		}
+		path = conf.LeaseFile
+	}
+	if path == "" {
+		fmt.Fprintf(os.Stderr, "no lease file configured\n")
+		return 1
+	}
+
+	backups, err := leaseFileBackups(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	if *list {
+		for _, b := range backups {
+			fi, err := os.Stat(b)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				return 1
+			}
+			fmt.Printf("%s\t%d bytes\n", b, fi.Size())
+		}
+		return 0
+	}
+
+	var backup string
+	switch {
+	case fs.NArg() == 1:
+		backup = fs.Arg(0)
+		if !strings.ContainsRune(backup, filepath.Separator) {
+			// Just the timestamp suffix, or the name of a backup next to
+			// the lease file.
+			if _, err := time.Parse(backupTimeFormat, backup); err == nil {
+				backup = path + "." + backup
+			} else {
+				backup = filepath.Join(filepath.Dir(path), backup)
+			}
+		}
+	case len(backups) > 0:
+		backup = backups[len(backups)-1]
+	default:
+		fmt.Fprintf(os.Stderr, "%s has no backups\n", path)
+		return 1
+	}
+
+	b, err := os.ReadFile(backup)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	var lf LeaseFile
+	if err := json.Unmarshal(b, &lf); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: not a valid lease file: %s\n", backup, err)
+		return 1
+	}
+
+	store, err := newFileStore(path, true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	defer store.Close()
+	current, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	if len(current) > 0 {
+		saved := path + "." + time.Now().UTC().Format(backupTimeFormat)
+		if err := os.WriteFile(saved, current, 0600); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 1
+		}
+		fmt.Printf("saved the current lease file as %s\n", saved)
+	}
+	if err := writeFileAtomic(path, b, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	fmt.Printf("restored %s from %s\n", path, backup)
+	return 0
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+	"github.com/psanford/dhcpeterd/internal/dns"
+)
+
+// reverseZones writes a zone file of PTR records for the reverse zones of
+// the served networks. A zone's serial is bumped each time its records
+// change.
+type reverseZones struct {
+	conf    config.ReverseZones
+	changed chan struct{}
+	records map[string][]byte // records last written by zone
+	serials map[string]uint32 // serials last written by zone
+}
+
+func newReverseZones(conf *config.ReverseZones) (*reverseZones, error) {
+	if conf.Dir == "" || conf.Domain == "" || conf.NS == "" {
+		return nil, fmt.Errorf("reverse_zones requires dir, domain and ns")
+	}
+	z := &reverseZones{
+		conf:    *conf,
+		changed: make(chan struct{}, 1),
+		records: make(map[string][]byte),
+		serials: make(map[string]uint32),
+	}
+	z.conf.Domain = strings.Trim(conf.Domain, ".")
+	if z.conf.Hostmaster == "" {
+		z.conf.Hostmaster = "hostmaster." + z.conf.Domain
+	}
+	z.conf.Hostmaster = strings.Replace(z.conf.Hostmaster, "@", ".", 1)
+	if z.conf.TTL == 0 {
+		z.conf.TTL = 5 * time.Minute
+	}
+	return z, nil
+}
+
+func (z *reverseZones) send(iface string, ev dhcp4d.Event) {
+	switch ev.Type {
+	case dhcp4d.EventAdd, dhcp4d.EventOld, dhcp4d.EventRelease, dhcp4d.EventExpire:
+	default:
+		return
+	}
+	select {
+	case z.changed <- struct{}{}:
+	default: // a write is already pending
+	}
+}
+
+// loop writes the zones once the networks of d have been started, and again
+// after lease changes and every exportInterval, until ctx is done.
+func (z *reverseZones) loop(ctx context.Context, d *daemon) {
+	ready := make(chan struct{})
+	go func() {
+		d.bound.Wait()
+		close(ready)
+	}()
+	select {
+	case <-ctx.Done():
+		return
+	case <-ready:
+	}
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	for {
+		z.write(d)
+		select {
+		case <-ctx.Done():
+			return
+		case <-z.changed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// write rewrites the zone files whose records changed.
+func (z *reverseZones) write(d *daemon) {
+	now := time.Now()
+	type served struct {
+		subnet *net.IPNet
+		h      *dhcp4d.Handler
+	}
+	var networks []served
+	d.mu.Lock()
+	for iface, nw := range d.networks {
+		ip := net.ParseIP(nw.conf.StartIP).To4()
+		mask := parseNetMask(nw.conf.NetMask)
+		if ip != nil && mask != nil {
+			networks = append(networks, served{subnet: &net.IPNet{IP: ip.Mask(mask), Mask: mask}, h: d.handlers[iface]})
+		}
+	}
+	d.mu.Unlock()
+
+	zones := make(map[string][]dhcp4d.Lease)
+	for _, n := range networks {
+		for _, name := range reverseZoneNames(n.subnet) {
+			if _, ok := zones[name]; !ok {
+				zones[name] = nil
+			}
+		}
+		if n.h == nil {
+			continue // still starting
+		}
+		for _, l := range n.h.ListLeases() {
+			if l.Addr.To4() == nil || l.Unknown || l.Expired(now) || !n.subnet.Contains(l.Addr) {
+				continue
+			}
+			name := reverseZoneName(l.Addr, n.subnet.Mask)
+			zones[name] = append(zones[name], l)
+		}
+	}
+
+	for name, leases := range zones {
+		records := z.zoneRecords(name, leases)
+		if bytes.Equal(records, z.records[name]) {
+			continue
+		}
+		path := filepath.Join(z.conf.Dir, name+".zone")
+		serial, ok := z.serials[name]
+		if !ok {
+			serial = readZoneSerial(path)
+		}
+		serial = max(serial+1, uint32(now.Unix()))
+		if err := writeFileAtomic(path, z.zoneFile(name, serial, records), 0644); err != nil {
+			slog.Error("write reverse zone err", "zone", name, "path", path, "err", err)
+			continue
+		}
+		z.records[name] = records
+		z.serials[name] = serial
+	}
+}
+
+// zoneRecords returns the NS and PTR records of the zone name, which holds
+// leases, ordered by address.
+func (z *reverseZones) zoneRecords(name string, leases []dhcp4d.Lease) []byte {
+	slices.SortFunc(leases, func(a, b dhcp4d.Lease) int {
+		return bytes.Compare(a.Addr.To4(), b.Addr.To4())
+	})
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "@\tIN\tNS\t%s.\n", strings.TrimSuffix(z.conf.NS, "."))
+	seen := make(map[string]bool)
+	for _, l := range leases {
+		hostname := leaseHostname(l)
+		owner := strings.TrimSuffix(dns.ReverseName(l.Addr), "."+name)
+		if hostname == "" || seen[owner] {
+			continue
+		}
+		seen[owner] = true
+		fmt.Fprintf(&b, "%s\tIN\tPTR\t%s.%s.\n", owner, hostname, z.conf.Domain)
+	}
+	return b.Bytes()
+}
+
+// zoneFile returns the zone file of name with the given serial and records.
+func (z *reverseZones) zoneFile(name string, serial uint32, records []byte) []byte {
+	ttl := int(z.conf.TTL / time.Second)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "; generated by dhcpeterd\n")
+	fmt.Fprintf(&b, "$ORIGIN %s.\n", name)
+	fmt.Fprintf(&b, "$TTL %d\n", ttl)
+	fmt.Fprintf(&b, "@\tIN\tSOA\t%s. %s. (\n", strings.TrimSuffix(z.conf.NS, "."), strings.TrimSuffix(z.conf.Hostmaster, "."))
+	fmt.Fprintf(&b, "\t%d\t; serial\n", serial)
+	fmt.Fprintf(&b, "\t3600\t; refresh\n")
+	fmt.Fprintf(&b, "\t900\t; retry\n")
+	fmt.Fprintf(&b, "\t604800\t; expire\n")
+	fmt.Fprintf(&b, "\t%d )\t; minimum\n", ttl)
+	b.Write(records)
+	return b.Bytes()
+}
+
+var zoneSerialRE = regexp.MustCompile(`(?m)^\s*(\d+)\s*; serial$`)
+
+// readZoneSerial returns the serial of the zone file at path written by a
+// previous run, or 0.
+func readZoneSerial(path string) uint32 {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	m := zoneSerialRE.FindSubmatch(b)
+	if m == nil {
+		return 0
+	}
+	serial, _ := strconv.ParseUint(string(m[1]), 10, 32)
+	return uint32(serial)
+}
+
+// reverseZoneBits returns the prefix length of the reverse zones of a
+// network with mask: its own rounded up to an octet boundary, but at most
+// 24.
+func reverseZoneBits(mask net.IPMask) int {
+	ones, _ := mask.Size()
+	return min((ones+7)/8*8, 24)
+}
+
+// reverseZoneName returns the name of the reverse zone of ip in a network
+// with mask.
+func reverseZoneName(ip net.IP, mask net.IPMask) string {
+	octets := reverseZoneBits(mask) / 8
+	labels := strings.Split(dns.ReverseName(ip), ".")
+	return strings.Join(labels[4-octets:], ".")
+}
+
+// reverseZoneNames returns the names of the reverse zones covering subnet.
+func reverseZoneNames(subnet *net.IPNet) []string {
+	bits := reverseZoneBits(subnet.Mask)
+	ones, _ := subnet.Mask.Size()
+	n := uint32(1)
+	if ones < bits {
+		n = 1 << (bits - ones)
+	}
+	start := ipToUint32(subnet.IP)
+	var names []string
+	for i := uint32(0); i < n; i++ {
+		ip := start + i<<(32-bits)
+		names = append(names, reverseZoneName(net.IPv4(byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip)), subnet.Mask))
+	}
+	return names
+}
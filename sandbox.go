@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/psanford/dhcpeterd/config"
+)
+
+const prSetNoNewPrivs = 38 // PR_SET_NO_NEW_PRIVS of linux/prctl.h
+
+// sandboxAccess is what the sandbox allows on a path.
+type sandboxAccess int
+
+const (
+	sandboxRead   sandboxAccess = iota
+	sandboxExec                 // read and execute
+	sandboxWrite                // read, write, create and remove
+	sandboxSocket               // create and remove sockets in a directory
+)
+
+// sandboxPath is a file or directory, and everything beneath it, that
+// stays accessible in the sandbox.
+type sandboxPath struct {
+	path   string
+	access sandboxAccess
+}
+
+// sandboxPaths returns the paths the daemon uses once it has started with
+// conf, loaded from confPath.
+func sandboxPaths(conf *config.Config, confPath string) []sandboxPath {
+	var paths []sandboxPath
+	add := func(access sandboxAccess, names ...string) {
+		for _, name := range names {
+			if name != "" {
+				paths = append(paths, sandboxPath{name, access})
+			}
+		}
+	}
+	// Files are replaced through temporary files next to them, where lease
+	// files also keep their lock files and backups and the audit log is
+	// rotated, so their directories are needed.
+	dir := func(name string) string {
+		if name == "" {
+			return ""
+		}
+		return filepath.Dir(name)
+	}
+
+	// The config is reread on reload, and editors replace files rather
+	// than rewriting them.
+	add(sandboxRead, dir(confPath))
+	if inc := conf.IncludeDir; inc != "" {
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(filepath.Dir(confPath), inc)
+		}
+		add(sandboxRead, inc)
+	}
+
+	add(sandboxWrite, dir(conf.LeaseFile), dir(conf.DnsmasqLeaseFile), dir(conf.HostsFile),
+		conf.HostsDir, dir(conf.LeaseDumpFile), dir(conf.ReservationsFile))
+	for _, n := range conf.Networks {
+		if n.Netns != "" {
+			add(sandboxRead, netnsPath(n.Netns))
+		}
+		add(sandboxWrite, dir(n.LeaseFile))
+		if n.DHCPv6 != nil {
+			add(sandboxWrite, dir(n.DHCPv6.LeaseFile))
+		}
+	}
+	if conf.AuditLog != nil {
+		add(sandboxWrite, dir(conf.AuditLog.Path))
+	}
+	if conf.LeaseHistory != nil {
+		add(sandboxWrite, dir(conf.LeaseHistory.Path))
+	}
+	if conf.ReverseZones != nil {
+		add(sandboxWrite, conf.ReverseZones.Dir)
+	}
+	if conf.Tailscale != nil {
+		add(sandboxWrite, conf.Tailscale.StateDir)
+	}
+	if conf.Keepalived != nil {
+		add(sandboxWrite, conf.Keepalived.FIFO)
+	}
+	if conf.HostnameFallback != nil {
+		add(sandboxRead, conf.HostnameFallback.File)
+	}
+	// Values are read again on reload.
+	add(sandboxRead, conf.ValueFiles...)
+	// The control socket is removed on shutdown.
+	add(sandboxSocket, dir(conf.ControlSocket))
+	// Connections to hostapd bind a socket of their own, again whenever
+	// hostapd restarts.
+	if len(conf.Hostapd) > 0 {
+		add(sandboxSocket, os.TempDir())
+	}
+
+	commands := []string{conf.OnLeaseScript}
+	if conf.NewDevice != nil && len(conf.NewDevice.Command) > 0 {
+		commands = append(commands, conf.NewDevice.Command[0])
+	}
+	for _, c := range commands {
+		if strings.Contains(c, "/") {
+			add(sandboxExec, c)
+		}
+	}
+	if conf.OnLeaseScript != "" || len(commands) > 1 || len(conf.FirewallSets) > 0 {
+		add(sandboxExec, "/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64")
+		add(sandboxRead, "/etc/ld.so.cache")
+	}
+	// os/exec connects the unset stdin and stdout of commands to it.
+	add(sandboxWrite, os.DevNull)
+	// Name resolution and TLS certificate verification.
+	add(sandboxRead, "/etc/resolv.conf", "/etc/hosts", "/etc/nsswitch.conf",
+		"/etc/ssl", "/etc/pki", "/etc/ca-certificates")
+
+	add(sandboxRead, conf.SandboxReadPaths...)
+	add(sandboxWrite, conf.SandboxWritePaths...)
+	return paths
+}
+
+// allows reports whether a grants everything b does.
+func (a sandboxAccess) allows(b sandboxAccess) bool {
+	return a == b || b == sandboxRead && (a == sandboxExec || a == sandboxWrite)
+}
+
+// sandboxMissing returns the paths of want that the sandbox of paths does
+// not give the access they need.
+func sandboxMissing(paths, want []sandboxPath) []string {
+	var missing []string
+	for _, w := range want {
+		covered := slices.ContainsFunc(paths, func(p sandboxPath) bool {
+			return p.access.allows(w.access) &&
+				(w.path == p.path || strings.HasPrefix(w.path, strings.TrimSuffix(p.path, "/")+"/"))
+		})
+		if !covered {
+			missing = append(missing, w.path)
+		}
+	}
+	return missing
+}
+
+// installSandbox restricts the file system access of the process, all of
+// its threads and the commands it runs from then on to paths with
+// Landlock, or if the kernel does not support it, by chrooting to chroot
+// if it is set.
+func installSandbox(paths []sandboxPath, chroot string) error {
+	err := landlock(paths)
+	if !errors.Is(err, errLandlockUnsupported) || chroot == "" {
+		return err
+	}
+	slog.Info("landlock is not supported, chrooting", "dir", chroot)
+	return chrootTo(chroot, paths)
+}
+
+// chrootTo changes the root directory to dir, which must hold the
+// writable paths and the working directory at the same paths as outside.
+func chrootTo(dir string, paths []sandboxPath) error {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	need := []string{cwd}
+	for _, p := range paths {
+		if p.access == sandboxWrite || p.access == sandboxSocket {
+			need = append(need, p.path)
+		}
+	}
+	for _, name := range need {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(cwd, name)
+		}
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("chroot %s: %w", dir, err)
+		}
+	}
+	if err := syscall.Chroot(dir); err != nil {
+		return fmt.Errorf("chroot %s: %w", dir, err)
+	}
+	return os.Chdir(cwd)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/psanford/dhcpeterd/config"
+)
+
+func TestSandboxPaths(t *testing.T) {
+	dir := t.TempDir()
+	secrets := t.TempDir()
+	token := filepath.Join(secrets, "token")
+	if err := os.WriteFile(token, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	confPath := filepath.Join(dir, "dhcpeterd.toml")
+	if err := os.WriteFile(confPath, []byte(`
+lease_file = "/var/lib/dhcpeterd/leases.json"
+control_socket = "/run/dhcpeterd/control.sock"
+
+[[api_tokens]]
+token = "@file:`+token+`"
+
+[[hostapd]]
+socket = "/var/run/hostapd/wlan0"
+
+[tailscale]
+state_dir = "/var/lib/dhcpeterd/tailscale"
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := config.Load(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := make(map[string]sandboxAccess)
+	for _, p := range sandboxPaths(conf, confPath) {
+		paths[p.path] = p.access
+	}
+	for _, want := range []sandboxPath{
+		{dir, sandboxRead},
+		{token, sandboxRead},
+		{"/var/lib/dhcpeterd", sandboxWrite},
+		{"/run/dhcpeterd", sandboxSocket},
+		{"/var/lib/dhcpeterd/tailscale", sandboxWrite},
+		{os.TempDir(), sandboxSocket},
+	} {
+		if got, ok := paths[want.path]; !ok || got != want.access {
+			t.Errorf("access to %s = %v (%v), want %v", want.path, got, ok, want.access)
+		}
+	}
+}
+
+func TestSandboxMissing(t *testing.T) {
+	paths := []sandboxPath{
+		{"/etc/dhcpeterd", sandboxRead},
+		{"/var/lib/dhcpeterd/", sandboxWrite},
+		{"/run/dhcpeterd", sandboxSocket},
+	}
+	want := []sandboxPath{
+		{"/etc/dhcpeterd", sandboxRead},
+		{"/var/lib/dhcpeterd/leases", sandboxRead},
+		{"/var/lib/dhcpeterd/history", sandboxWrite},
+		{"/var/lib/dhcpeterd-other", sandboxWrite},
+		{"/etc/dhcpeterd/hook", sandboxExec},
+		{"/run/dhcpeterd", sandboxWrite},
+	}
+	got := sandboxMissing(paths, want)
+	if !slices.Equal(got, []string{"/var/lib/dhcpeterd-other", "/etc/dhcpeterd/hook", "/run/dhcpeterd"}) {
+		t.Errorf("missing %q", got)
+	}
+}
+
+// TestLandlock checks that the sandbox allows its paths and nothing else,
+// in a child process as it cannot be removed.
+func TestLandlock(t *testing.T) {
+	allowed, other := os.Getenv("DHCPETERD_TEST_ALLOWED"), os.Getenv("DHCPETERD_TEST_OTHER")
+	if allowed == "" {
+		allowed, other = t.TempDir(), t.TempDir()
+		cmd := exec.Command(os.Args[0], "-test.run=^TestLandlock$", "-test.v")
+		cmd.Env = append(os.Environ(), "DHCPETERD_TEST_ALLOWED="+allowed, "DHCPETERD_TEST_OTHER="+other)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		}
+		if bytes.Contains(out, []byte("SKIP")) {
+			t.Skipf("%s", out)
+		}
+		return
+	}
+
+	err := installSandbox([]sandboxPath{{allowed, sandboxWrite}}, "")
+	if errors.Is(err, errLandlockUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(filepath.Join(allowed, "leases.json"), []byte("{}"), 0600); err != nil {
+		t.Errorf("writing an allowed path: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(other, "leases.json"), []byte("{}"), 0600); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("writing another path: %v, want a permission error", err)
+	}
+	if _, err := os.ReadFile("/etc/passwd"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("reading /etc/passwd: %v, want a permission error", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+// leaseScript runs the on_lease_script for each lease event, in the style of
+// dnsmasq's dhcp-script: "<script> add|old|del <mac> <ip> [hostname]".
+// Events are run one at a time in the order they occurred.
+type leaseScript struct {
+	path   string
+	events chan ifaceEvent
+}
+
+type ifaceEvent struct {
+	iface string
+	ev    dhcp4d.Event
+}
+
+func newLeaseScript(path string) *leaseScript {
+	return &leaseScript{
+		path:   path,
+		events: make(chan ifaceEvent, 128),
+	}
+}
+
+func (s *leaseScript) queue(iface string, ev dhcp4d.Event) {
+	switch ev.Type {
+	case dhcp4d.EventOffer, dhcp4d.EventNAK, dhcp4d.EventFlap, dhcp4d.EventPoolWarning, dhcp4d.EventPoolExhausted:
+		return
+	}
+	select {
+	case s.events <- ifaceEvent{iface: iface, ev: ev}:
+	default:
+		slog.Error("on_lease_script queue full, dropping event", "type", ev.Type, "hw", ev.Lease.HardwareAddr)
+	}
+}
+
+func (s *leaseScript) loop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-s.events:
+			s.run(ctx, e.iface, e.ev)
+		}
+	}
+}
+
+func (s *leaseScript) run(ctx context.Context, iface string, ev dhcp4d.Event) {
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+
+	action := string(ev.Type)
+	switch ev.Type {
+	case dhcp4d.EventRelease, dhcp4d.EventExpire:
+		action = "del"
+	}
+
+	l := ev.Lease
+	args := []string{action, l.HardwareAddr, l.Addr.String()}
+	if l.Hostname != "" {
+		args = append(args, l.Hostname)
+	}
+
+	var expires string
+	if !l.Expiry.IsZero() {
+		expires = strconv.FormatInt(l.Expiry.Unix(), 10)
+	}
+
+	cmd := exec.CommandContext(ctx, s.path, args...)
+	cmd.Env = append(os.Environ(),
+		"DHCPETERD_INTERFACE="+iface,
+		"DHCPETERD_MAC="+l.HardwareAddr,
+		"DHCPETERD_IP="+l.Addr.String(),
+		"DHCPETERD_HOSTNAME="+l.Hostname,
+		"DHCPETERD_LEASE_EXPIRES="+expires,
+		"DHCPETERD_CLIENT_ID="+l.ClientID,
+		"DHCPETERD_VENDOR="+l.Vendor,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		slog.Error("on_lease_script err", "type", ev.Type, "hw", l.HardwareAddr, "err", err, "output", string(out))
+	}
+}
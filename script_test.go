@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+func TestLeaseScriptExpiry(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "calls")
+	script := filepath.Join(dir, "script")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" >> "+out+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s := newLeaseScript(script)
+
+	iface := &net.Interface{HardwareAddr: net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}}
+	const leasePeriod = 500 * time.Millisecond
+	h, err := dhcp4d.NewHandler(iface, net.IPv4(192, 168, 42, 1), net.IPv4(192, 168, 42, 2), net.IP{255, 255, 255, 0}, 100, leasePeriod, nil, nil, dhcp4d.WithUDP())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Events = func(ev dhcp4d.Event) { s.queue("eth0", ev) }
+	run := func() {
+		for len(s.events) > 0 {
+			e := <-s.events
+			s.run(context.Background(), e.iface, e.ev)
+		}
+	}
+
+	p := dhcp4.RequestPacket(dhcp4.Request, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}, net.IP{192, 168, 42, 10}, []byte{1, 2, 3, 4}, false, []dhcp4.Option{
+		{Code: dhcp4.OptionHostName, Value: []byte("laptop")},
+	})
+	if reply := h.ServeDHCP(p, dhcp4.Request, p.ParseOptions()); reply == nil {
+		t.Fatal("DHCPREQUEST was not acknowledged")
+	}
+	// The client leaves without releasing its lease.
+	time.Sleep(leasePeriod + 100*time.Millisecond)
+	h.ExpireLeases()
+	run()
+
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "add aa:bb:cc:dd:ee:ff 192.168.42.10 laptop\ndel aa:bb:cc:dd:ee:ff 192.168.42.10 laptop\n"
+	if got := string(b); got != want {
+		t.Errorf("script calls:\n%s\nwant:\n%s", strings.TrimSpace(got), strings.TrimSpace(want))
+	}
+}
@@ -0,0 +1,107 @@
+//go:build amd64 || arm64
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// Constants of linux/seccomp.h and linux/filter.h.
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTSync = 1
+	seccompRetKillProcess  = 0x80000000
+	seccompRetErrno        = 0x00050000
+	seccompRetAllow        = 0x7fff0000
+
+	bpfLdWAbs = syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS
+	bpfJeqK   = syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K
+	bpfRetK   = syscall.BPF_RET | syscall.BPF_K
+)
+
+// seccompArg allows a system call only when the low 32 bits of its
+// argument arg are one of values.
+type seccompArg struct {
+	nr     uintptr
+	arg    int
+	values []uint32
+}
+
+// seccompArgs are the system calls allowed for some arguments only: sockets
+// of the families the daemon uses and entering network namespaces.
+var seccompArgs = []seccompArg{
+	{syscall.SYS_SOCKET, 0, []uint32{syscall.AF_UNIX, syscall.AF_INET, syscall.AF_INET6, syscall.AF_NETLINK, syscall.AF_PACKET}},
+	{sysSetns, 1, []uint32{syscall.CLONE_NEWNET}},
+}
+
+// installSeccomp restricts the process and all of its threads to the
+// system calls of seccompAllowed and seccompArgs. Others fail with EPERM,
+// so commands cannot be run.
+func installSeccomp() error {
+	filter, err := seccompFilter(seccompAuditArch, seccompAllowed, seccompArgs)
+	if err != nil {
+		return err
+	}
+	prog := struct {
+		len    uint16
+		filter *syscall.SockFilter
+	}{uint16(len(filter)), &filter[0]}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("prctl(PR_SET_NO_NEW_PRIVS): %w", errno)
+	}
+	if _, _, errno := syscall.RawSyscall(sysSeccomp, seccompSetModeFilter, seccompFilterFlagTSync, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return fmt.Errorf("seccomp: %w", errno)
+	}
+	return nil
+}
+
+// seccompFilter returns a BPF program that kills the process on system
+// calls of another architecture than arch, allows those in allowed and
+// those in args with the arguments they list, and fails the rest with
+// EPERM.
+func seccompFilter(arch uint32, allowed []uintptr, args []seccompArg) ([]syscall.SockFilter, error) {
+	deny := syscall.SockFilter{Code: bpfRetK, K: seccompRetErrno | uint32(syscall.EPERM)}
+	filter := []syscall.SockFilter{
+		{Code: bpfLdWAbs, K: 4}, // seccomp_data.arch
+		{Code: bpfJeqK, Jt: 1, K: arch},
+		{Code: bpfRetK, K: seccompRetKillProcess},
+		{Code: bpfLdWAbs, K: 0}, // seccomp_data.nr
+	}
+	// Jumps to the allow instruction at the end are filled in once its
+	// position is known.
+	var allows []int
+	for _, nr := range allowed {
+		allows = append(allows, len(filter))
+		filter = append(filter, syscall.SockFilter{Code: bpfJeqK, K: uint32(nr)})
+	}
+	for _, a := range args {
+		// Skip the argument checks of other system calls, which leave
+		// the system call number loaded.
+		filter = append(filter,
+			syscall.SockFilter{Code: bpfJeqK, Jf: uint8(len(a.values) + 2), K: uint32(a.nr)},
+			syscall.SockFilter{Code: bpfLdWAbs, K: uint32(16 + 8*a.arg)}, // seccomp_data.args[arg], low half
+		)
+		for _, v := range a.values {
+			allows = append(allows, len(filter))
+			filter = append(filter, syscall.SockFilter{Code: bpfJeqK, K: v})
+		}
+		filter = append(filter, deny)
+	}
+	filter = append(filter, deny, syscall.SockFilter{Code: bpfRetK, K: seccompRetAllow})
+	allow := len(filter) - 1
+	for _, i := range allows {
+		// Jumps are relative to the next instruction and must fit in 8
+		// bits.
+		if allow-i-1 > 255 {
+			return nil, fmt.Errorf("seccomp: too many system calls")
+		}
+		filter[i].Jt = uint8(allow - i - 1)
+	}
+	return filter, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import "syscall"
+
+const (
+	seccompAuditArch = 0xc000003e // AUDIT_ARCH_X86_64
+	sysSeccomp       = 317
+)
+
+// seccompAllowed are the system calls of the serve loops, the lease writers
+// and the Go runtime. socket and setns are allowed by seccompArgs.
+var seccompAllowed = []uintptr{
+	// Memory, threads, signals and time.
+	syscall.SYS_BRK,
+	syscall.SYS_MMAP,
+	syscall.SYS_MPROTECT,
+	syscall.SYS_MUNMAP,
+	syscall.SYS_MREMAP,
+	syscall.SYS_MADVISE,
+	syscall.SYS_FUTEX,
+	syscall.SYS_CLONE,
+	syscall.SYS_SET_TID_ADDRESS,
+	syscall.SYS_SET_ROBUST_LIST,
+	334, // rseq
+	syscall.SYS_ARCH_PRCTL,
+	syscall.SYS_PRCTL,
+	syscall.SYS_GETTID,
+	syscall.SYS_GETPID,
+	syscall.SYS_GETPPID,
+	syscall.SYS_TGKILL,
+	syscall.SYS_TKILL,
+	syscall.SYS_RT_SIGACTION,
+	syscall.SYS_RT_SIGPROCMASK,
+	syscall.SYS_RT_SIGRETURN,
+	syscall.SYS_SIGALTSTACK,
+	syscall.SYS_SCHED_YIELD,
+	syscall.SYS_SCHED_GETAFFINITY,
+	syscall.SYS_NANOSLEEP,
+	syscall.SYS_CLOCK_GETTIME,
+	syscall.SYS_CLOCK_GETRES,
+	syscall.SYS_CLOCK_NANOSLEEP,
+	syscall.SYS_GETTIMEOFDAY,
+	syscall.SYS_SETITIMER,
+	syscall.SYS_TIMER_CREATE,
+	syscall.SYS_TIMER_SETTIME,
+	syscall.SYS_TIMER_DELETE,
+	syscall.SYS_RESTART_SYSCALL,
+	syscall.SYS_EXIT,
+	syscall.SYS_EXIT_GROUP,
+	318, // getrandom
+
+	// Polling and descriptors.
+	syscall.SYS_EPOLL_CREATE,
+	syscall.SYS_EPOLL_CREATE1,
+	syscall.SYS_EPOLL_CTL,
+	syscall.SYS_EPOLL_WAIT,
+	syscall.SYS_EPOLL_PWAIT,
+	syscall.SYS_EVENTFD2,
+	syscall.SYS_POLL,
+	syscall.SYS_PPOLL,
+	syscall.SYS_SELECT,
+	syscall.SYS_PSELECT6,
+	syscall.SYS_PIPE,
+	syscall.SYS_PIPE2,
+	syscall.SYS_DUP,
+	syscall.SYS_DUP2,
+	syscall.SYS_DUP3,
+	syscall.SYS_FCNTL,
+	syscall.SYS_IOCTL,
+	syscall.SYS_CLOSE,
+	syscall.SYS_READ,
+	syscall.SYS_WRITE,
+	syscall.SYS_READV,
+	syscall.SYS_WRITEV,
+	syscall.SYS_PREAD64,
+	syscall.SYS_PWRITE64,
+	syscall.SYS_LSEEK,
+
+	// Files, for lease files, exports and hosts files.
+	syscall.SYS_OPEN,
+	syscall.SYS_OPENAT,
+	syscall.SYS_STAT,
+	syscall.SYS_FSTAT,
+	syscall.SYS_LSTAT,
+	syscall.SYS_NEWFSTATAT,
+	332, // statx
+	syscall.SYS_ACCESS,
+	syscall.SYS_FACCESSAT,
+	439, // faccessat2
+	syscall.SYS_GETDENTS64,
+	syscall.SYS_GETCWD,
+	syscall.SYS_READLINK,
+	syscall.SYS_READLINKAT,
+	syscall.SYS_RENAME,
+	syscall.SYS_RENAMEAT,
+	316, // renameat2
+	syscall.SYS_UNLINK,
+	syscall.SYS_UNLINKAT,
+	syscall.SYS_FCHMOD,
+	syscall.SYS_FSYNC,
+	syscall.SYS_FDATASYNC,
+	syscall.SYS_FTRUNCATE,
+	syscall.SYS_FADVISE64,
+	syscall.SYS_FLOCK,
+	syscall.SYS_UTIMENSAT,
+	syscall.SYS_SENDFILE, // io.Copy of files
+	syscall.SYS_SPLICE,
+	326, // copy_file_range
+
+	// Sockets.
+	syscall.SYS_BIND,
+	syscall.SYS_CONNECT,
+	syscall.SYS_LISTEN,
+	syscall.SYS_ACCEPT,
+	syscall.SYS_ACCEPT4,
+	syscall.SYS_GETSOCKNAME,
+	syscall.SYS_GETPEERNAME,
+	syscall.SYS_SETSOCKOPT,
+	syscall.SYS_GETSOCKOPT,
+	syscall.SYS_SENDTO,
+	syscall.SYS_RECVFROM,
+	syscall.SYS_SENDMSG,
+	syscall.SYS_RECVMSG,
+	307, // sendmmsg
+	syscall.SYS_RECVMMSG,
+	syscall.SYS_SHUTDOWN,
+
+	// Identity.
+	syscall.SYS_GETUID,
+	syscall.SYS_GETGID,
+	syscall.SYS_GETEUID,
+	syscall.SYS_GETEGID,
+	syscall.SYS_GETRESUID,
+	syscall.SYS_GETRESGID,
+	syscall.SYS_GETGROUPS,
+	syscall.SYS_UNAME,
+}
@@ -0,0 +1,12 @@
+//go:build !amd64 && !arm64
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func installSeccomp() error {
+	return fmt.Errorf("seccomp is not supported on %s", runtime.GOARCH)
+}
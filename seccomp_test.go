@@ -0,0 +1,132 @@
+//go:build amd64 || arm64
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/psanford/dhcpeterd/internal/hostapd"
+)
+
+// TestSeccomp runs what the daemon does after startup under the filter, in
+// a child process as the filter cannot be removed.
+func TestSeccomp(t *testing.T) {
+	if os.Getenv("DHCPETERD_TEST_SECCOMP") == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestSeccomp$", "-test.v")
+		cmd.Env = append(os.Environ(), "DHCPETERD_TEST_SECCOMP=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		}
+		return
+	}
+
+	dir := t.TempDir()
+	// hostapd's control socket, before the filter like hostapd itself.
+	ctrl, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "wlan0"), Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+
+	if err := installSeccomp(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lease files and exports are written through temporary files.
+	name := filepath.Join(dir, "leases.json")
+	if err := writeFileAtomic(name, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.ReadFile(name); err != nil {
+		t.Fatal(err)
+	}
+
+	// hostapd monitors dial again whenever hostapd restarts.
+	c, err := hostapd.Dial(ctrl.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	if err := exec.Command("/bin/true").Run(); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("running a command: %v, want EPERM", err)
+	}
+	if _, err := syscall.Socket(syscall.AF_BLUETOOTH, syscall.SOCK_RAW, 0); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("bluetooth socket: %v, want EPERM", err)
+	}
+}
+
+// TestSeccompFilter runs the filter on system calls, as the kernel would.
+func TestSeccompFilter(t *testing.T) {
+	filter, err := seccompFilter(seccompAuditArch, seccompAllowed, seccompArgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filter) > 4096 { // BPF_MAXINSNS
+		t.Fatalf("filter has %d instructions", len(filter))
+	}
+	deny := seccompRetErrno | uint32(syscall.EPERM)
+
+	for _, tt := range []struct {
+		name string
+		arch uint32
+		nr   uintptr
+		args [6]uint64
+		want uint32
+	}{
+		{name: "read", arch: seccompAuditArch, nr: syscall.SYS_READ, want: seccompRetAllow},
+		{name: "sendmsg", arch: seccompAuditArch, nr: syscall.SYS_SENDMSG, want: seccompRetAllow},
+		{name: "udp socket", arch: seccompAuditArch, nr: syscall.SYS_SOCKET, args: [6]uint64{syscall.AF_INET, syscall.SOCK_DGRAM}, want: seccompRetAllow},
+		{name: "packet socket", arch: seccompAuditArch, nr: syscall.SYS_SOCKET, args: [6]uint64{syscall.AF_PACKET, syscall.SOCK_RAW}, want: seccompRetAllow},
+		{name: "bluetooth socket", arch: seccompAuditArch, nr: syscall.SYS_SOCKET, args: [6]uint64{syscall.AF_BLUETOOTH}, want: deny},
+		{name: "setns net", arch: seccompAuditArch, nr: sysSetns, args: [6]uint64{3, syscall.CLONE_NEWNET}, want: seccompRetAllow},
+		{name: "setns mount", arch: seccompAuditArch, nr: sysSetns, args: [6]uint64{3, syscall.CLONE_NEWNS}, want: deny},
+		{name: "execve", arch: seccompAuditArch, nr: syscall.SYS_EXECVE, want: deny},
+		{name: "fchmodat", arch: seccompAuditArch, nr: syscall.SYS_FCHMODAT, want: deny},
+		{name: "other architecture", arch: 0x40000003, nr: syscall.SYS_READ, want: seccompRetKillProcess},
+	} {
+		if got := runSeccompFilter(t, filter, tt.arch, tt.nr, tt.args); got != tt.want {
+			t.Errorf("%s: %#x, want %#x", tt.name, got, tt.want)
+		}
+	}
+}
+
+// runSeccompFilter returns what filter returns for a system call, running
+// the instructions seccompFilter uses.
+func runSeccompFilter(t *testing.T, filter []syscall.SockFilter, arch uint32, nr uintptr, args [6]uint64) uint32 {
+	var acc uint32
+	for pc := 0; pc < len(filter); pc++ {
+		ins := filter[pc]
+		switch ins.Code {
+		case bpfLdWAbs:
+			switch {
+			case ins.K == 0:
+				acc = uint32(nr)
+			case ins.K == 4:
+				acc = arch
+			case ins.K >= 16 && ins.K < 64 && ins.K%8 == 0:
+				acc = uint32(args[(ins.K-16)/8])
+			default:
+				t.Fatalf("load of offset %d", ins.K)
+			}
+		case bpfJeqK:
+			if acc == ins.K {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case bpfRetK:
+			return ins.K
+		default:
+			t.Fatalf("instruction %#x", ins.Code)
+		}
+	}
+	t.Fatal("filter ran past its end")
+	return 0
+}
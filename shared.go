@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// sharedSocket is one UDP socket on port 67 for all networks. Messages
+// are passed to the port of the interface they arrived on, which IP_PKTINFO
+// tells.
+type sharedSocket struct {
+	conn *net.UDPConn
+
+	mu    sync.Mutex
+	ports map[int]*sharedPort // by interface index
+}
+
+// sharedMessage is a message received on a sharedSocket.
+type sharedMessage struct {
+	b    []byte
+	addr *net.UDPAddr
+}
+
+func listenShared() (*sharedSocket, error) {
+	pc, err := newUDP4BoundListener("", ":67")
+	if err != nil {
+		return nil, err
+	}
+	return newSharedSocket(pc.(*net.UDPConn))
+}
+
+// newSharedSocket returns the shared socket of conn, which it enables
+// IP_PKTINFO on. conn is closed if that fails.
+func newSharedSocket(conn *net.UDPConn) (*sharedSocket, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+	}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if serr != nil {
+		conn.Close()
+		return nil, serr
+	}
+	return &sharedSocket{conn: conn, ports: make(map[int]*sharedPort)}, nil
+}
+
+// serve passes the received messages to their ports until reading from
+// the socket fails. Messages for interfaces without a port are dropped, as
+// are those for a port that is not keeping up.
+func (s *sharedSocket) serve() error {
+	buf := make([]byte, 1<<16)
+	oob := make([]byte, syscall.CmsgSpace(syscall.SizeofInet4Pktinfo))
+	for {
+		n, oobn, _, addr, err := s.conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			return err
+		}
+		ifindex, ok := pktinfoIndex(oob[:oobn])
+		if !ok {
+			continue
+		}
+		s.mu.Lock()
+		p := s.ports[ifindex]
+		s.mu.Unlock()
+		if p == nil {
+			continue
+		}
+		select {
+		case p.messages <- sharedMessage{b: append([]byte(nil), buf[:n]...), addr: addr}:
+		default:
+			slog.Debug("shared socket queue full", "ifindex", ifindex, "addr", addr)
+		}
+	}
+}
+
+// listen returns the port of the interface with index ifindex.
+func (s *sharedSocket) listen(ifindex int) (*sharedPort, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.ports[ifindex]; ok {
+		return nil, fmt.Errorf("interface %d is already listening on the shared socket", ifindex)
+	}
+	p := &sharedPort{
+		s:        s,
+		ifindex:  ifindex,
+		messages: make(chan sharedMessage, 64),
+		done:     make(chan struct{}),
+	}
+	s.ports[ifindex] = p
+	return p, nil
+}
+
+// pktinfoIndex returns the interface index of the IP_PKTINFO control
+// message in oob.
+func pktinfoIndex(oob []byte) (int, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+	for _, m := range msgs {
+		if m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_PKTINFO && len(m.Data) >= syscall.SizeofInet4Pktinfo {
+			return int(int32(binary.NativeEndian.Uint32(m.Data))), true
+		}
+	}
+	return 0, false
+}
+
+// sharedPort is the net.PacketConn of one interface on a sharedSocket.
+// Replies are sent on the interface.
+type sharedPort struct {
+	s        *sharedSocket
+	ifindex  int
+	messages chan sharedMessage
+	done     chan struct{}
+	once     sync.Once
+}
+
+func (p *sharedPort) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case m := <-p.messages:
+		return copy(b, m.b), m.addr, nil
+	case <-p.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (p *sharedPort) WriteTo(b []byte, addr net.Addr) (int, error) {
+	to, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("invalid address %s", addr)
+	}
+	n, _, err := p.WriteMsgUDP(b, pktinfo(p.ifindex, nil), to)
+	return n, err
+}
+
+// WriteMsgUDP sends b to addr with the control messages oob, which should
+// include an IP_PKTINFO for the interface.
+func (p *sharedPort) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error) {
+	return p.s.conn.WriteMsgUDP(b, oob, addr)
+}
+
+// Close removes the port from its socket and ends pending reads.
+func (p *sharedPort) Close() error {
+	p.once.Do(func() {
+		p.s.mu.Lock()
+		if p.s.ports[p.ifindex] == p {
+			delete(p.s.ports, p.ifindex)
+		}
+		p.s.mu.Unlock()
+		close(p.done)
+	})
+	return nil
+}
+
+func (p *sharedPort) LocalAddr() net.Addr { return p.s.conn.LocalAddr() }
+
+func (p *sharedPort) SetDeadline(t time.Time) error      { return os.ErrNoDeadline }
+func (p *sharedPort) SetReadDeadline(t time.Time) error  { return os.ErrNoDeadline }
+func (p *sharedPort) SetWriteDeadline(t time.Time) error { return os.ErrNoDeadline }
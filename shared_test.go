@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPktinfoIndex(t *testing.T) {
+	if got, ok := pktinfoIndex(pktinfo(7, net.IP{192, 168, 42, 1})); !ok || got != 7 {
+		t.Errorf("pktinfoIndex = %d, %v, want 7", got, ok)
+	}
+	if _, ok := pktinfoIndex(nil); ok {
+		t.Errorf("pktinfoIndex found an index without control messages")
+	}
+}
+
+func TestSharedSocket(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip(err)
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSharedSocket(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go s.serve()
+
+	port, err := s.listen(lo.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.listen(lo.Index + 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.listen(lo.Index); err == nil {
+		t.Errorf("listening twice on interface %d succeeded", lo.Index)
+	}
+
+	client, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-port.messages:
+		if string(m.b) != "request" || m.addr.Port != client.LocalAddr().(*net.UDPAddr).Port {
+			t.Errorf("got %q from %v", m.b, m.addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not passed to the port of its interface")
+	}
+	select {
+	case m := <-other.messages:
+		t.Errorf("port of another interface got %q", m.b)
+	default:
+	}
+
+	// Replies leave through the socket.
+	if _, err := port.WriteTo([]byte("reply"), client.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16)
+	n, err := client.Read(buf)
+	if err != nil || string(buf[:n]) != "reply" {
+		t.Errorf("client read %q, %v", buf[:n], err)
+	}
+
+	// Closed ports stop reading and free their interface.
+	port.Close()
+	if _, _, err := port.ReadFrom(buf); err != net.ErrClosed {
+		t.Errorf("ReadFrom after Close = %v, want net.ErrClosed", err)
+	}
+	if _, err := s.listen(lo.Index); err != nil {
+		t.Errorf("listen after Close: %v", err)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import "log/slog"
+
+// shutdown stops the serve loops, waits for messages being handled to
+// finish, and closes the handlers' raw sockets. Lease updates produced by
+// those messages have been handed to the lease manager when it returns.
+func (d *daemon) shutdown() {
+	d.mu.Lock()
+	d.stopping = true
+	close(d.done)
+	for iface, l := range d.loops {
+		if err := l.conn.Close(); err != nil {
+			slog.Error("close listener err", "iface", iface, "err", err)
+		}
+	}
+	d.mu.Unlock()
+
+	d.serving.Wait()
+	if d.shared != nil {
+		d.shared.conn.Close()
+	}
+
+	for iface, h := range d.allHandlers() {
+		if err := h.Close(); err != nil {
+			slog.Error("close raw socket err", "iface", iface, "err", err)
+		}
+	}
+}
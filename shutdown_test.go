@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+func TestShutdown(t *testing.T) {
+	store := &memStore{lf: newLeaseFile()}
+	lm := newLeaseManager("/var/lib/dhcpeterd/leases.json", func(string) (LeaseStore, error) {
+		return store, nil
+	})
+	// Updates are only written on shutdown.
+	lm.writeInterval = time.Hour
+	if err := lm.open(""); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go lm.updateLeaseFileLoop(ctx)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	iface := &net.Interface{Index: 1, HardwareAddr: net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}}
+	h, err := dhcp4d.NewHandler(iface, net.IP{192, 168, 42, 1}, net.IP{192, 168, 42, 2}, net.IP{255, 255, 255, 0}, 10, time.Hour, nil, nil, dhcp4d.WithUDP())
+	if err != nil {
+		t.Fatal(err)
+	}
+	loop := &serveLoop{handler: h, conn: conn}
+	d := &daemon{
+		lm:       lm,
+		handlers: map[string]*dhcp4d.Handler{"eth0": h},
+		loops:    map[string]*serveLoop{"eth0": loop},
+		networks: make(map[string]*network),
+		done:     make(chan struct{}),
+	}
+	served := make(chan error, 1)
+	d.serving.Add(1)
+	go func() {
+		defer d.serving.Done()
+		served <- dhcp4.Serve(conn, loop)
+	}()
+
+	lm.leaseUpdate <- LeaseUpdate{IfaceName: "eth0", Leases: []dhcp4d.Lease{{Num: 1, HardwareAddr: "aa:bb:cc:dd:ee:ff"}}}
+	d.shutdown()
+	select {
+	case <-served:
+	default:
+		t.Error("serve loop still running after shutdown")
+	}
+	select {
+	case <-d.done:
+	default:
+		t.Error("done not closed by shutdown")
+	}
+
+	cancel()
+	<-lm.done
+	lf, saves := store.saved()
+	if saves != 1 {
+		t.Fatalf("%d writes on shutdown, want 1", saves)
+	}
+	if l := lf.LeaseByInterface["eth0"]; len(l) != 1 || l[0].HardwareAddr != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("saved %+v, want the pending lease", l)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+// eventHub fans lease events out to streaming subscribers. Subscribers that
+// fall behind lose events rather than blocking the handler.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan leaseEvent]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		subs: make(map[chan leaseEvent]struct{}),
+	}
+}
+
+func (h *eventHub) send(iface string, ev dhcp4d.Event) {
+	le := newLeaseEvent(iface, ev)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		select {
+		case sub <- le:
+		default:
+		}
+	}
+}
+
+func (h *eventHub) subscribe() chan leaseEvent {
+	sub := make(chan leaseEvent, 64)
+	h.mu.Lock()
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub
+}
+
+func (h *eventHub) unsubscribe(sub chan leaseEvent) {
+	h.mu.Lock()
+	delete(h.subs, sub)
+	h.mu.Unlock()
+}
+
+// serveEvents streams lease events as server-sent events. The optional
+// interface query parameter limits the stream to one network.
+func (h *eventHub) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	iface := r.URL.Query().Get("interface")
+
+	sub := h.subscribe()
+	defer h.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case ev := <-sub:
+			if iface != "" && ev.Interface != iface {
+				continue
+			}
+			b, err := json.Marshal(ev)
+			if err != nil {
+				slog.Error("marshal lease event err", "err", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Event, b)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// maxNetworkBackoff is the longest a failed network waits before it is
+// restarted. A network that ran for longer than this before failing is
+// restarted after the minimum backoff again.
+const maxNetworkBackoff = time.Minute
+
+// supervise runs nw until it is stopped, restarting it with exponential
+// backoff whenever it fails so that one broken network does not take down
+// the others.
+func (d *daemon) supervise(nw *network, ready func()) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		d.mu.Lock()
+		ns := nw.conf.Netns
+		d.mu.Unlock()
+		err := inNetns(ns, func() error { return d.run(nw, ready) })
+		if err == nil {
+			return
+		}
+		// Don't hold up readiness while this network is retried.
+		ready()
+
+		d.mu.Lock()
+		iface := nw.conf.Interface
+		current := !d.stopping && d.networks[iface] == nw
+		if current {
+			nw.err = err
+		}
+		d.mu.Unlock()
+		if !current {
+			return
+		}
+
+		if time.Since(start) > maxNetworkBackoff {
+			backoff = time.Second
+		}
+		d.metrics.networkRestarts.inc(iface)
+		slog.Error("network failed, restarting", "iface", iface, "err", err, "backoff", backoff)
+		select {
+		case <-d.done:
+			return
+		case <-time.After(backoff):
+		}
+		d.mu.Lock()
+		current = d.networks[iface] == nw
+		d.mu.Unlock()
+		if !current {
+			return
+		}
+		backoff = min(2*backoff, maxNetworkBackoff)
+	}
+}
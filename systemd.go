@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+// sdNotify sends state to the systemd notification socket. It does nothing
+// if the daemon was not started by systemd with Type=notify.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:] // abstract socket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the watchdog timeout systemd expects pings
+// within, or 0 if the watchdog is not enabled for this process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// watchdog pings systemd at half the timeout for as long as every serve
+// loop is alive, so a wedged handler gets the daemon restarted.
+func (d *daemon) watchdog(ctx context.Context, timeout time.Duration) {
+	t := time.NewTicker(timeout / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if iface, ok := d.serveLoopsAlive(timeout / 2); !ok {
+			slog.Error("serve loop not responding, withholding watchdog ping", "iface", iface)
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			slog.Error("sd_notify err", "err", err)
+		}
+	}
+}
+
+// serveLoopsAlive reports whether every configured network has a serve loop
+// that has not been stuck handling one message for longer than limit. If
+// not, it returns the first interface that is not alive.
+func (d *daemon) serveLoopsAlive(limit time.Duration) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, iface := range d.interfacesLocked() {
+		l, ok := d.loops[iface]
+		if !ok || l.stuck(limit) {
+			return iface, false
+		}
+	}
+	return "", true
+}
+
+// serveLoop serves the messages read from conn with a handler that can be
+// replaced on reload, recording when it starts and finishes handling each
+// message.
+type serveLoop struct {
+	conn      net.PacketConn
+	busySince atomic.Int64 // unix nanoseconds; 0 while waiting for packets
+
+	mu      sync.Mutex // held while handling a message
+	handler *dhcp4d.Handler
+	dest    *net.UDPAddr // of the reply ServeDHCP returned last, guarded by mu
+}
+
+func (l *serveLoop) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options dhcp4.Options) dhcp4.Packet {
+	l.busySince.Store(time.Now().UnixNano())
+	defer l.busySince.Store(0)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	reply := l.handler.ServeDHCP(p, msgType, options)
+	if reply != nil {
+		l.dest = l.handler.ReplyAddr(p, reply)
+	}
+	return reply
+}
+
+// replyAddr returns, once, where to send the reply ServeDHCP returned last.
+func (l *serveLoop) replyAddr() *net.UDPAddr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	dest := l.dest
+	l.dest = nil
+	return dest
+}
+
+// current returns the handler serving messages.
+func (l *serveLoop) current() *dhcp4d.Handler {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.handler
+}
+
+// replace swaps in h, after copying the current handler's state to it. It
+// returns the previous handler.
+func (l *serveLoop) replace(h *dhcp4d.Handler) *dhcp4d.Handler {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	old := l.handler
+	h.CopyStateFrom(old)
+	l.handler = h
+	return old
+}
+
+func (l *serveLoop) stuck(limit time.Duration) bool {
+	since := l.busySince.Load()
+	return since != 0 && time.Since(time.Unix(0, since)) > limit
+}
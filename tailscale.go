@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+
+	"tailscale.com/tsnet"
+
+	"github.com/psanford/dhcpeterd/config"
+)
+
+// listenTailscale starts the tailnet node configured by conf and listens on
+// its port 80. The node runs until it is closed.
+func listenTailscale(conf *config.Tailscale) (*tsnet.Server, net.Listener, error) {
+	hostname := conf.Hostname
+	if hostname == "" {
+		hostname = "dhcpeterd"
+	}
+	srv := &tsnet.Server{
+		Dir:        conf.StateDir,
+		Hostname:   hostname,
+		AuthKey:    conf.AuthKey,
+		ControlURL: conf.ControlURL,
+		UserLogf: func(format string, args ...any) {
+			slog.Info("tailscale: "+fmt.Sprintf(format, args...), "hostname", hostname)
+		},
+	}
+	l, err := srv.Listen("tcp", ":80")
+	if err != nil {
+		srv.Close()
+		return nil, nil, fmt.Errorf("tailscale: %w", err)
+	}
+	return srv, l, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+const (
+	traceBatchSize     = 256
+	traceFlushInterval = 5 * time.Second
+)
+
+// otlpExporter batches handler spans and POSTs them to an OTLP/HTTP
+// collector using the JSON encoding. All messages of one exchange share a
+// trace ID derived from the interface, client MAC and XID.
+type otlpExporter struct {
+	url         string
+	serviceName string
+	headers     map[string]string
+	client      *http.Client
+	queue       chan dhcp4d.Span
+}
+
+func newOTLPExporter(conf *config.Tracing) (*otlpExporter, error) {
+	if conf.Endpoint == "" {
+		return nil, fmt.Errorf("tracing requires endpoint")
+	}
+	u, err := url.Parse(conf.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parse tracing endpoint err: %w", err)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	e := &otlpExporter{
+		url:         u.String(),
+		serviceName: conf.ServiceName,
+		headers:     conf.Headers,
+		client:      &http.Client{Timeout: hookTimeout},
+		queue:       make(chan dhcp4d.Span, 1024),
+	}
+	if e.serviceName == "" {
+		e.serviceName = "dhcpeterd"
+	}
+	return e, nil
+}
+
+// Span implements dhcp4d.Tracer.
+func (e *otlpExporter) Span(s dhcp4d.Span) {
+	select {
+	case e.queue <- s:
+	default:
+		slog.Error("trace queue full, dropping span", "hw", s.HardwareAddr)
+	}
+}
+
+func (e *otlpExporter) loop(ctx context.Context) {
+	t := time.NewTicker(traceFlushInterval)
+	defer t.Stop()
+	var batch []dhcp4d.Span
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-t.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := e.export(ctx, batch); err != nil {
+			slog.Error("export spans err", "err", err, "spans", len(batch))
+		}
+		batch = nil
+	}
+}
+
+func (e *otlpExporter) export(ctx context.Context, batch []dhcp4d.Span) error {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		spans = append(spans, newOTLPSpan(s))
+	}
+	body, err := json.Marshal(otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: []otlpAttr{stringAttr("service.name", e.serviceName)}},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "dhcpeterd"},
+				Spans: spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// traceID derives a stable trace ID for the exchange s belongs to.
+func traceID(s dhcp4d.Span) string {
+	h := sha256.New()
+	h.Write([]byte(s.Interface))
+	h.Write(s.HardwareAddr)
+	h.Write(s.XID)
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+func newSpanID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newOTLPSpan(s dhcp4d.Span) otlpSpan {
+	attrs := []otlpAttr{
+		stringAttr("dhcp.interface", s.Interface),
+		stringAttr("dhcp.xid", hex.EncodeToString(s.XID)),
+		stringAttr("dhcp.client_mac", s.HardwareAddr.String()),
+		stringAttr("dhcp.message_type", strings.ToLower(s.MessageType.String())),
+	}
+	if s.Reply != 0 {
+		attrs = append(attrs, stringAttr("dhcp.reply_type", strings.ToLower(s.Reply.String())))
+	}
+	if s.YourIP != nil {
+		attrs = append(attrs, stringAttr("dhcp.your_ip", s.YourIP.String()))
+	}
+	status := otlpStatus{Code: 1}
+	if s.Err != nil {
+		status = otlpStatus{Code: 2, Message: s.Err.Error()}
+	}
+	return otlpSpan{
+		TraceID:           traceID(s),
+		SpanID:            newSpanID(),
+		Name:              "DHCP " + s.MessageType.String(),
+		Kind:              2, // server
+		StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		Attributes:        attrs,
+		Status:            status,
+	}
+}
+
+// The types below are the subset of the OTLP JSON encoding we emit.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes"`
+	Status            otlpStatus `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string        `json:"key"`
+	Value otlpAttrValue `json:"value"`
+}
+
+type otlpAttrValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func stringAttr(k, v string) otlpAttr {
+	return otlpAttr{Key: k, Value: otlpAttrValue{StringValue: v}}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"syscall"
+)
+
+// packetSocketDenied reports whether err is from a packet socket that
+// cannot be opened in this environment, such as a container without
+// CAP_NET_RAW or without AF_PACKET.
+func packetSocketDenied(err error) bool {
+	return errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EAFNOSUPPORT)
+}
+
+// replyConn sends the replies of handlers created WithUDP from the address
+// of the current handler of its serve loop, with IP_PKTINFO, so that they
+// come from the server identifier even on interfaces with several
+// addresses, and leave on the interface of the loop from a shared socket.
+type replyConn struct {
+	net.PacketConn
+	w       msgWriter
+	ifindex int
+	loop    *serveLoop
+}
+
+// msgWriter sends UDP messages with control messages, like *net.UDPConn.
+type msgWriter interface {
+	WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error)
+}
+
+func newReplyConn(conn net.PacketConn, ifindex int, loop *serveLoop) net.PacketConn {
+	w, ok := conn.(msgWriter)
+	if !ok {
+		return conn
+	}
+	return &replyConn{PacketConn: conn, w: w, ifindex: ifindex, loop: loop}
+}
+
+// WriteTo sends b to addr, or replies of the serve loop to where its
+// handler chose. Errors are logged rather than returned, as they would stop
+// dhcp4.Serve, and a client can make them happen by sending from an
+// unreachable address.
+func (c *replyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	to, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return c.PacketConn.WriteTo(b, addr)
+	}
+	if dest := c.loop.replyAddr(); dest != nil {
+		to = dest
+	}
+	n, _, err := c.w.WriteMsgUDP(b, pktinfo(c.ifindex, c.loop.current().ServerIP()), to)
+	if err != nil {
+		slog.Error("udp reply err", "addr", to, "err", err)
+		return len(b), nil
+	}
+	return n, nil
+}
+
+// pktinfo returns an IP_PKTINFO control message that sends from src on the
+// interface with index ifindex.
+func pktinfo(ifindex int, src net.IP) []byte {
+	h := syscall.Cmsghdr{Level: syscall.IPPROTO_IP, Type: syscall.IP_PKTINFO}
+	h.SetLen(syscall.CmsgLen(syscall.SizeofInet4Pktinfo))
+	info := syscall.Inet4Pktinfo{Ifindex: int32(ifindex)}
+	copy(info.Spec_dst[:], src.To4())
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.NativeEndian, h)
+	binary.Write(&buf, binary.NativeEndian, info)
+	oob := make([]byte, syscall.CmsgSpace(syscall.SizeofInet4Pktinfo))
+	copy(oob, buf.Bytes())
+	return oob
+}
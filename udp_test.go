@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/psanford/dhcpeterd/internal/dhcp4"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+// msgRecorder records the addresses of the messages written to it.
+type msgRecorder struct {
+	net.PacketConn
+	to []string
+}
+
+func (r *msgRecorder) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (int, int, error) {
+	r.to = append(r.to, addr.String())
+	return len(b), len(oob), nil
+}
+
+func TestReplyConnDest(t *testing.T) {
+	var (
+		hw    = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+		addr  = net.IP{192, 168, 42, 2}
+		other = net.IP{10, 0, 0, 9}
+		from  = &net.UDPAddr{IP: addr, Port: 68}
+	)
+	renew := func(ip net.IP) dhcp4.Packet {
+		p := dhcp4.RequestPacket(dhcp4.Request, hw, ip, []byte{1, 2, 3, 4}, false, nil)
+		p.SetCIAddr(ip)
+		return p
+	}
+
+	for _, tt := range []struct {
+		name string
+		opts []dhcp4d.Option
+		p    dhcp4.Packet
+		want string
+	}{
+		{name: "renewal", p: renew(addr), want: "192.168.42.2:68"},
+		{name: "always broadcast", opts: []dhcp4d.Option{dhcp4d.WithAlwaysBroadcast()}, p: renew(addr), want: "255.255.255.255:68"},
+		{name: "nak", p: renew(other), want: "255.255.255.255:68"},
+	} {
+		iface := &net.Interface{Index: 1, HardwareAddr: net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}}
+		h, err := dhcp4d.NewHandler(iface, net.IP{192, 168, 42, 1}, addr, net.IP{255, 255, 255, 0}, 10, time.Hour, nil, nil, append(tt.opts, dhcp4d.WithUDP())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loop := &serveLoop{handler: h}
+		rec := &msgRecorder{}
+		conn := newReplyConn(rec, iface.Index, loop)
+
+		reply := loop.ServeDHCP(tt.p, dhcp4.Request, tt.p.ParseOptions())
+		if reply == nil {
+			t.Fatalf("%s: no reply", tt.name)
+		}
+		conn.WriteTo(reply, from)
+		if len(rec.to) != 1 || rec.to[0] != tt.want {
+			t.Errorf("%s: sent to %v, want %s", tt.name, rec.to, tt.want)
+		}
+	}
+}
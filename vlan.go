@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+// vlanServer serves the VLANs of a trunk network from one packet socket.
+type vlanServer struct {
+	conn     net.PacketConn
+	handlers map[int]*dhcp4d.Handler
+	names    map[int]string
+}
+
+// vlanNetwork returns the network that VLAN v of n is served as. It is
+// named like the kernel's VLAN interfaces, <interface>.<id>, for its leases
+// and in the API. Settings tied to the pool of n or to the interface are
+// dropped.
+func vlanNetwork(n config.Network, v config.VLAN) config.Network {
+	vn := n
+	vn.Interface = fmt.Sprintf("%s.%d", n.Interface, v.ID)
+	vn.StartIP = v.StartIP
+	vn.Range = v.Range
+	vn.NetMask = v.NetMask
+	if v.LeaseDuration > 0 {
+		vn.LeaseDuration = v.LeaseDuration
+	}
+	vn.StaticLeases = v.StaticLeases
+	vn.DNSServers = v.DNSServers
+	vn.OptionSets = v.OptionSets
+	vn.Routes = nil
+	vn.Classes = nil
+	vn.Quarantine = nil
+	vn.VirtualIP = ""
+	vn.ServerID = ""
+	vn.Failover = false
+	vn.SplitScope = nil
+	vn.MDNS = false
+	vn.DHCPv6 = nil
+	vn.RouterAdvertisement = nil
+	vn.VLANs = nil
+	vn.UDPOnly = false
+	return vn
+}
+
+// startVLANs listens on the trunk interface of conf and builds the
+// handlers of its VLANs, which are registered with the daemon until
+// stopVLANs.
+func (d *daemon) startVLANs(conf config.Network) (*vlanServer, error) {
+	ifi, err := net.InterfaceByName(conf.Interface)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dhcp4d.ListenTrunk(ifi)
+	if err != nil {
+		return nil, err
+	}
+	s := &vlanServer{
+		conn:     conn,
+		handlers: make(map[int]*dhcp4d.Handler),
+		names:    make(map[int]string),
+	}
+	for _, v := range conf.VLANs {
+		vn := vlanNetwork(conf, v)
+		serverIP := net.ParseIP(v.ServerIP).To4()
+		if serverIP == nil {
+			conn.Close()
+			return nil, fmt.Errorf("vlan %d: invalid server_ip %q", v.ID, v.ServerIP)
+		}
+		h, err := d.newHandlerOn(vn, ifi, serverIP, dhcp4d.WithVLAN(v.ID), dhcp4d.WithConn(conn))
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("vlan %d: %w", v.ID, err)
+		}
+		d.restoreState(h, vn)
+		s.handlers[v.ID] = h
+		s.names[v.ID] = vn.Interface
+	}
+	d.mu.Lock()
+	for id, h := range s.handlers {
+		d.handlers[s.names[id]] = h
+	}
+	d.mu.Unlock()
+	return s, nil
+}
+
+// stopVLANs unregisters the handlers of s and closes its socket, which
+// they share.
+func (d *daemon) stopVLANs(s *vlanServer) {
+	d.mu.Lock()
+	for id, h := range s.handlers {
+		if d.handlers[s.names[id]] == h {
+			delete(d.handlers, s.names[id])
+		}
+	}
+	d.mu.Unlock()
+	s.conn.Close()
+}
+
+// checkVLAN returns an error if VLAN v of n cannot be served.
+func checkVLAN(n config.Network, v config.VLAN) error {
+	if v.ID < 1 || v.ID > 4094 {
+		return fmt.Errorf("vlan %d: id must be between 1 and 4094", v.ID)
+	}
+	start := net.ParseIP(v.StartIP).To4()
+	if start == nil {
+		return fmt.Errorf("vlan %d: invalid start_ip: %q", v.ID, v.StartIP)
+	}
+	mask := parseNetMask(v.NetMask)
+	if mask == nil {
+		return fmt.Errorf("vlan %d: invalid net_mask: %q", v.ID, v.NetMask)
+	}
+	if v.Range <= 0 {
+		return fmt.Errorf("vlan %d: range must be positive", v.ID)
+	}
+	subnet := &net.IPNet{IP: start.Mask(mask), Mask: mask}
+	if err := checkPool(subnet, start, v.Range); err != nil {
+		return fmt.Errorf("vlan %d: pool: %w", v.ID, err)
+	}
+	serverIP := net.ParseIP(v.ServerIP).To4()
+	if serverIP == nil || !usableHost(subnet, serverIP) {
+		return fmt.Errorf("vlan %d: server_ip %q is not a host address of %s", v.ID, v.ServerIP, subnet)
+	}
+	if _, err := parseIPv4s(v.DNSServers); err != nil {
+		return fmt.Errorf("vlan %d: dns_servers: %w", v.ID, err)
+	}
+	if _, err := newOptionSets(vlanNetwork(n, v)); err != nil {
+		return fmt.Errorf("vlan %d: %w", v.ID, err)
+	}
+	return nil
+}
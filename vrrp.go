@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/psanford/dhcpeterd/config"
+)
+
+// vipPresent reports whether the virtual IP of n, if it has one, is on its
+// interface.
+func vipPresent(n config.Network) bool {
+	if n.VirtualIP == "" {
+		return true
+	}
+	vip := net.ParseIP(n.VirtualIP)
+	if vip == nil {
+		return false
+	}
+	addrs, err := interfaceAddrs(n)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(vip) {
+			return true
+		}
+	}
+	return false
+}
+
+// watchKeepalived reads the state changes keepalived writes to its
+// notify_fifo and reports on master whether this instance is the VRRP
+// master of the configured instance (or of any, if none is configured).
+// Lines have the form `INSTANCE "name" MASTER 100`. The FIFO is created if
+// it does not exist, so that notify scripts can write to it as well.
+func watchKeepalived(ctx context.Context, conf config.Keepalived, master chan<- bool) error {
+	if err := syscall.Mkfifo(conf.FIFO, 0o600); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	// Opening for writing too keeps the FIFO from reporting EOF when
+	// keepalived restarts.
+	f, err := os.OpenFile(conf.FIFO, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 3 || (fields[0] != "INSTANCE" && fields[0] != "GROUP") {
+			continue
+		}
+		name := strings.Trim(fields[1], `"`)
+		if conf.Instance != "" && name != conf.Instance {
+			continue
+		}
+		slog.Info("keepalived state", "instance", name, "state", fields[2])
+		select {
+		case master <- fields[2] == "MASTER":
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return s.Err()
+}
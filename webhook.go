@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/psanford/dhcpeterd/config"
+	"github.com/psanford/dhcpeterd/internal/dhcp4d"
+)
+
+type webhook struct {
+	url     string
+	secret  []byte
+	events  map[string]bool // nil means all
+	retries int
+	client  *http.Client
+	queue   chan leaseEvent
+}
+
+func newWebhook(conf *config.Webhook) (*webhook, error) {
+	if conf.URL == "" {
+		return nil, fmt.Errorf("webhook requires url")
+	}
+	w := &webhook{
+		url:     conf.URL,
+		secret:  []byte(conf.Secret),
+		retries: 3,
+		client:  &http.Client{Timeout: hookTimeout},
+		queue:   make(chan leaseEvent, 256),
+	}
+	if conf.Retries != nil {
+		w.retries = *conf.Retries
+	}
+	if len(conf.Events) > 0 {
+		w.events = make(map[string]bool)
+		for _, e := range conf.Events {
+			switch e {
+			case "offer", "ack", "nak", "expire", "release", "flap", "pool_warning", "pool_exhausted":
+				w.events[e] = true
+			default:
+				return nil, fmt.Errorf("invalid webhook event: %s", e)
+			}
+		}
+	}
+	return w, nil
+}
+
+func (w *webhook) send(iface string, ev dhcp4d.Event) {
+	name := eventName(ev.Type)
+	if w.events != nil && !w.events[name] {
+		return
+	}
+	select {
+	case w.queue <- newLeaseEvent(iface, ev):
+	default:
+		slog.Error("webhook queue full, dropping event", "event", name, "hw", ev.Lease.HardwareAddr)
+	}
+}
+
+func (w *webhook) loop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-w.queue:
+			w.deliver(ctx, ev)
+		}
+	}
+}
+
+// deliver POSTs ev, retrying with exponential backoff.
+func (w *webhook) deliver(ctx context.Context, ev leaseEvent) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("marshal webhook event err", "err", err)
+		return
+	}
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err = w.post(ctx, body)
+		if err == nil {
+			return
+		}
+		if attempt >= w.retries {
+			slog.Error("webhook delivery failed", "event", ev.Event, "hw", ev.Lease.HardwareAddr, "attempts", attempt+1, "err", err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (w *webhook) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.secret) > 0 {
+		req.Header.Set("X-Dhcpeterd-Signature", "sha256="+sign(w.secret, body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// sign returns the hex encoded HMAC-SHA256 of body.
+func sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}